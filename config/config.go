@@ -14,8 +14,13 @@
 package config
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"net/url"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/golang/protobuf/proto"
@@ -69,6 +74,18 @@ func (c Config) Validate() error {
 		return fmt.Errorf("invalid global labels: %s", err)
 	}
 
+	// Check the storage configuration section for validity.
+	if storage := c.Storage; storage != nil {
+		if storage.Retention != nil {
+			if _, err := utility.StringToDuration(storage.GetRetention()); err != nil {
+				return fmt.Errorf("invalid storage retention: %s", err)
+			}
+		}
+		if storage.MemoryChunks != nil && storage.GetMemoryChunks() <= 0 {
+			return fmt.Errorf("invalid number of storage memory chunks: %d", storage.GetMemoryChunks())
+		}
+	}
+
 	// Check each job configuration for validity.
 	jobNames := map[string]bool{}
 	for _, job := range c.Job {
@@ -89,6 +106,9 @@ func (c Config) Validate() error {
 		if _, err := utility.StringToDuration(job.GetScrapeTimeout()); err != nil {
 			return fmt.Errorf("invalid scrape timeout for job '%s': %s", job.GetName(), err)
 		}
+		if _, err := utility.StringToDuration(job.GetScrapeOffset()); err != nil {
+			return fmt.Errorf("invalid scrape offset for job '%s': %s", job.GetName(), err)
+		}
 		for _, targetGroup := range job.TargetGroup {
 			if err := c.validateLabels(targetGroup.Labels); err != nil {
 				return fmt.Errorf("invalid labels for job '%s': %s", job.GetName(), err)
@@ -97,11 +117,177 @@ func (c Config) Validate() error {
 		if job.SdName != nil && len(job.TargetGroup) > 0 {
 			return fmt.Errorf("specified both DNS-SD name and target group for job: %s", job.GetName())
 		}
+		switch job.GetSdRecordType() {
+		case pb.JobConfig_A, pb.JobConfig_AAAA, pb.JobConfig_MX:
+			if job.SdName != nil && (job.GetSdPort() <= 0 || job.GetSdPort() > 65535) {
+				return fmt.Errorf("missing or invalid DNS-SD port for record type %s for job '%s'", job.GetSdRecordType(), job.GetName())
+			}
+		}
+		if k := job.KubernetesSd; k != nil {
+			if job.SdName != nil || len(job.TargetGroup) > 0 {
+				return fmt.Errorf("specified Kubernetes SD together with DNS-SD name or target group for job: %s", job.GetName())
+			}
+			if u, err := url.Parse(k.GetApiServer()); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("invalid Kubernetes API server URL '%s' for job '%s'", k.GetApiServer(), job.GetName())
+			}
+			if _, err := utility.StringToDuration(k.GetRetryInterval()); err != nil {
+				return fmt.Errorf("invalid Kubernetes SD retry interval for job '%s': %s", job.GetName(), err)
+			}
+		}
+		if c := job.ConsulSd; c != nil {
+			if job.SdName != nil || len(job.TargetGroup) > 0 || job.KubernetesSd != nil {
+				return fmt.Errorf("specified Consul SD together with DNS-SD name, target group, or Kubernetes SD for job: %s", job.GetName())
+			}
+			if c.GetScheme() != "http" && c.GetScheme() != "https" {
+				return fmt.Errorf("invalid Consul scheme '%s' for job '%s'", c.GetScheme(), job.GetName())
+			}
+			if _, err := utility.StringToDuration(c.GetRetryInterval()); err != nil {
+				return fmt.Errorf("invalid Consul SD retry interval for job '%s': %s", job.GetName(), err)
+			}
+		}
+		if z := job.ZookeeperSd; z != nil {
+			if job.SdName != nil || len(job.TargetGroup) > 0 || job.KubernetesSd != nil || job.ConsulSd != nil {
+				return fmt.Errorf("specified Zookeeper SD together with DNS-SD name, target group, Kubernetes SD, or Consul SD for job: %s", job.GetName())
+			}
+			if len(z.Server) == 0 || len(z.Path) == 0 {
+				return fmt.Errorf("missing Zookeeper servers or paths for job '%s'", job.GetName())
+			}
+			for _, p := range z.Path {
+				if !strings.HasPrefix(p, "/") {
+					return fmt.Errorf("invalid Zookeeper path '%s' for job '%s'", p, job.GetName())
+				}
+			}
+			if _, err := utility.StringToDuration(z.GetTimeout()); err != nil {
+				return fmt.Errorf("invalid Zookeeper SD timeout for job '%s': %s", job.GetName(), err)
+			}
+		}
+		for _, rc := range job.RelabelConfig {
+			if err := validateRelabelConfig(rc); err != nil {
+				return fmt.Errorf("invalid relabel config for job '%s': %s", job.GetName(), err)
+			}
+		}
+		for _, rc := range job.MetricRelabelConfig {
+			if err := validateRelabelConfig(rc); err != nil {
+				return fmt.Errorf("invalid metric relabel config for job '%s': %s", job.GetName(), err)
+			}
+		}
+		if s := job.GetScheme(); s != "http" && s != "https" {
+			return fmt.Errorf("invalid scheme '%s' for job '%s'", s, job.GetName())
+		}
+		if job.BearerTokenFile != nil && job.BasicAuth != nil {
+			return fmt.Errorf("specified both bearer token file and basic auth for job: %s", job.GetName())
+		}
+		if job.ProxyUrl != nil {
+			u, err := url.Parse(job.GetProxyUrl())
+			if err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("invalid proxy URL '%s' for job '%s'", job.GetProxyUrl(), job.GetName())
+			}
+		}
+		if _, err := newTLSConfig(job.TlsConfig); err != nil {
+			return fmt.Errorf("invalid TLS config for job '%s': %s", job.GetName(), err)
+		}
 	}
 
+	// Check each remote write configuration for validity.
+	remoteTypes := map[string]bool{}
+	for _, rw := range c.RemoteWrite {
+		if !remoteStorageTypes[rw.GetType()] {
+			return fmt.Errorf("invalid remote storage type '%s'", rw.GetType())
+		}
+		if remoteTypes[rw.GetType()] {
+			return fmt.Errorf("found multiple remote write configurations for type '%s'", rw.GetType())
+		}
+		remoteTypes[rw.GetType()] = true
+
+		for _, rc := range rw.WriteRelabelConfig {
+			if err := validateRelabelConfig(rc); err != nil {
+				return fmt.Errorf("invalid write relabel config for remote storage type '%s': %s", rw.GetType(), err)
+			}
+		}
+	}
+
+	// Check each rule group configuration for validity.
+	groupNames := map[string]bool{}
+	for _, rf := range global.RuleFile {
+		groupNames[rf] = true
+	}
+	for _, rg := range c.RuleGroup {
+		if !jobNameRE.MatchString(rg.GetName()) {
+			return fmt.Errorf("invalid rule group name '%s'", rg.GetName())
+		}
+		if groupNames[rg.GetName()] {
+			return fmt.Errorf("found multiple rule groups with the same name: '%s'", rg.GetName())
+		}
+		groupNames[rg.GetName()] = true
+
+		if _, err := utility.StringToDuration(rg.GetEvaluationInterval()); err != nil {
+			return fmt.Errorf("invalid evaluation interval for rule group '%s': %s", rg.GetName(), err)
+		}
+	}
+
+	return nil
+}
+
+// remoteStorageTypes are the types of remote storages that can be written to.
+var remoteStorageTypes = map[string]bool{
+	"opentsdb": true,
+	"influxdb": true,
+	"generic":  true,
+	"kafka":    true,
+	"graphite": true,
+}
+
+// validateRelabelConfig checks a single relabel configuration for validity.
+func validateRelabelConfig(rc *pb.RelabelConfig) error {
+	if _, err := regexp.Compile(anchored(rc.GetRegex())); err != nil {
+		return fmt.Errorf("invalid regex '%s': %s", rc.GetRegex(), err)
+	}
+	for _, ln := range rc.SourceLabel {
+		if !labelNameRE.MatchString(ln) {
+			return fmt.Errorf("invalid source label name '%s'", ln)
+		}
+	}
+	if rc.GetAction() == pb.RelabelConfig_REPLACE && !labelNameRE.MatchString(rc.GetTargetLabel()) {
+		return fmt.Errorf("invalid target label name '%s'", rc.GetTargetLabel())
+	}
+	if rc.GetAction() == pb.RelabelConfig_LABELMAP && rc.GetReplacement() == "" {
+		return fmt.Errorf("missing replacement for LABELMAP action")
+	}
 	return nil
 }
 
+// newTLSConfig creates the TLS configuration for the given settings, reading
+// the CA certificates and the client certificate from their files.
+func newTLSConfig(c *pb.TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.GetInsecureSkipVerify()}
+	if c.GetCaFile() != "" {
+		caCert, err := ioutil.ReadFile(c.GetCaFile())
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA file: %s", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", c.GetCaFile())
+		}
+	}
+	if (c.GetCertFile() == "") != (c.GetKeyFile() == "") {
+		return nil, fmt.Errorf("client certificate and key files must be specified together")
+	}
+	if c.GetCertFile() != "" {
+		cert, err := tls.LoadX509KeyPair(c.GetCertFile(), c.GetKeyFile())
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// anchored anchors a regular expression at both ends.
+func anchored(re string) string {
+	return "^(?:" + re + ")$"
+}
+
 // GetJobByName finds a job by its name in a Config object.
 func (c Config) GetJobByName(name string) *JobConfig {
 	for _, job := range c.Job {
@@ -150,6 +336,91 @@ func (c Config) EvaluationInterval() time.Duration {
 	return stringToDuration(c.Global.GetEvaluationInterval())
 }
 
+// RuleGroup is a named group of rule files evaluated at a common interval.
+type RuleGroup struct {
+	Name     string
+	Interval time.Duration
+	Files    []string
+}
+
+// RuleGroups returns the rule groups of a Config. Each rule file listed in the
+// global section forms a group of its own, named after the file and evaluated
+// at the global evaluation interval. The configured rule groups follow in
+// order.
+func (c Config) RuleGroups() []RuleGroup {
+	groups := make([]RuleGroup, 0, len(c.Global.RuleFile)+len(c.RuleGroup))
+	for _, rf := range c.Global.RuleFile {
+		groups = append(groups, RuleGroup{
+			Name:     rf,
+			Interval: c.EvaluationInterval(),
+			Files:    []string{rf},
+		})
+	}
+	for _, rg := range c.RuleGroup {
+		groups = append(groups, RuleGroup{
+			Name:     rg.GetName(),
+			Interval: stringToDuration(rg.GetEvaluationInterval()),
+			Files:    rg.RuleFile,
+		})
+	}
+	return groups
+}
+
+// StorageRetention returns the retention period of the local storage and true,
+// or false if the Config does not set it.
+func (c Config) StorageRetention() (time.Duration, bool) {
+	if c.Storage == nil || c.Storage.Retention == nil {
+		return 0, false
+	}
+	return stringToDuration(c.Storage.GetRetention()), true
+}
+
+// StorageMemoryChunks returns the number of chunks the local storage keeps in
+// memory and true, or false if the Config does not set it.
+func (c Config) StorageMemoryChunks() (int, bool) {
+	if c.Storage == nil || c.Storage.MemoryChunks == nil {
+		return 0, false
+	}
+	return int(c.Storage.GetMemoryChunks()), true
+}
+
+// RemoteWriteRelabelConfigs returns the write relabel configurations for the
+// remote storage of the given type, or nil if the Config sets none.
+func (c Config) RemoteWriteRelabelConfigs(remoteType string) []*RelabelConfig {
+	for _, rw := range c.RemoteWrite {
+		if rw.GetType() != remoteType {
+			continue
+		}
+		return newRelabelConfigs(rw.WriteRelabelConfig)
+	}
+	return nil
+}
+
+// newRelabelConfigs wraps the given raw relabel configurations.
+func newRelabelConfigs(raw []*pb.RelabelConfig) []*RelabelConfig {
+	rcs := make([]*RelabelConfig, 0, len(raw))
+	for _, rc := range raw {
+		rcs = append(rcs, &RelabelConfig{
+			RelabelConfig: *rc,
+			regex:         regexp.MustCompile(anchored(rc.GetRegex())),
+		})
+	}
+	return rcs
+}
+
+// RelabelConfig encapsulates a single relabel configuration. It wraps the raw
+// relabel protocol buffer to be able to add custom methods to it.
+type RelabelConfig struct {
+	pb.RelabelConfig
+	regex *regexp.Regexp
+}
+
+// Regexp returns the compiled regular expression of the relabel configuration,
+// anchored at both ends.
+func (c *RelabelConfig) Regexp() *regexp.Regexp {
+	return c.regex
+}
+
 // JobConfig encapsulates the configuration of a single job. It wraps the raw
 // job protocol buffer to be able to add custom methods to it.
 type JobConfig struct {
@@ -165,3 +436,45 @@ func (c JobConfig) ScrapeInterval() time.Duration {
 func (c JobConfig) ScrapeTimeout() time.Duration {
 	return stringToDuration(c.GetScrapeTimeout())
 }
+
+// ScrapeOffset gets the offset added to the scrape offsets of the targets of a
+// job.
+func (c JobConfig) ScrapeOffset() time.Duration {
+	return stringToDuration(c.GetScrapeOffset())
+}
+
+// KubernetesRetryInterval gets the time to wait before retrying to list the
+// objects of a job using Kubernetes SD.
+func (c JobConfig) KubernetesRetryInterval() time.Duration {
+	return stringToDuration(c.GetKubernetesSd().GetRetryInterval())
+}
+
+// ConsulRetryInterval gets the time to wait before retrying to query the
+// Consul agent for a job using Consul SD.
+func (c JobConfig) ConsulRetryInterval() time.Duration {
+	return stringToDuration(c.GetConsulSd().GetRetryInterval())
+}
+
+// ZookeeperTimeout gets the Zookeeper session timeout for a job using
+// Zookeeper SD.
+func (c JobConfig) ZookeeperTimeout() time.Duration {
+	return stringToDuration(c.GetZookeeperSd().GetTimeout())
+}
+
+// RelabelConfigs returns the relabel configurations applied to the targets of
+// a job.
+func (c JobConfig) RelabelConfigs() []*RelabelConfig {
+	return newRelabelConfigs(c.RelabelConfig)
+}
+
+// MetricRelabelConfigs returns the relabel configurations applied to the
+// series scraped from the targets of a job.
+func (c JobConfig) MetricRelabelConfigs() []*RelabelConfig {
+	return newRelabelConfigs(c.MetricRelabelConfig)
+}
+
+// TLSConfig returns the TLS configuration to scrape the targets of a job with.
+// The certificate files are read anew on each call.
+func (c JobConfig) TLSConfig() (*tls.Config, error) {
+	return newTLSConfig(c.TlsConfig)
+}
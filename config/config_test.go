@@ -15,8 +15,14 @@ package config
 
 import (
 	"path"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+
+	pb "github.com/prometheus/prometheus/config/generated"
 )
 
 var fixturesPath = "fixtures"
@@ -34,6 +40,12 @@ var configTests = []struct {
 		inputFile: "empty.conf.input",
 	}, {
 		inputFile: "sd_targets.conf.input",
+	}, {
+		inputFile: "storage.conf.input",
+	}, {
+		inputFile: "remote_write.conf.input",
+	}, {
+		inputFile: "rule_groups.conf.input",
 	},
 	{
 		inputFile:   "invalid_proto_format.conf.input",
@@ -45,6 +57,11 @@ var configTests = []struct {
 		shouldFail:  true,
 		errContains: "invalid global scrape interval",
 	},
+	{
+		inputFile:   "invalid_storage_retention.conf.input",
+		shouldFail:  true,
+		errContains: "invalid storage retention",
+	},
 	{
 		inputFile:   "invalid_job_name.conf.input",
 		shouldFail:  true,
@@ -65,6 +82,99 @@ var configTests = []struct {
 		shouldFail:  true,
 		errContains: "found multiple jobs configured with the same name: 'testjob1'",
 	},
+	{
+		inputFile:   "invalid_relabel_regex.conf.input",
+		shouldFail:  true,
+		errContains: "invalid regex 'api('",
+	},
+	{
+		inputFile:   "repeated_remote_write_type.conf.input",
+		shouldFail:  true,
+		errContains: "found multiple remote write configurations for type 'influxdb'",
+	},
+	{
+		inputFile:   "repeated_rule_group_name.conf.input",
+		shouldFail:  true,
+		errContains: "found multiple rule groups with the same name: 'api_aggregations'",
+	},
+	{
+		inputFile:   "invalid_rule_group_interval.conf.input",
+		shouldFail:  true,
+		errContains: "invalid evaluation interval for rule group 'api_aggregations'",
+	},
+	{
+		inputFile: "kubernetes_sd.conf.input",
+	},
+	{
+		inputFile:   "mixing_kubernetes_sd_and_manual_targets.conf.input",
+		shouldFail:  true,
+		errContains: "specified Kubernetes SD together with DNS-SD name or target group for job: testjob",
+	},
+	{
+		inputFile: "consul_sd.conf.input",
+	},
+	{
+		inputFile: "zookeeper_sd.conf.input",
+	},
+	{
+		inputFile:   "invalid_zookeeper_path.conf.input",
+		shouldFail:  true,
+		errContains: "invalid Zookeeper path 'services/api' for job 'testjob'",
+	},
+	{
+		inputFile: "metric_relabel.conf.input",
+	},
+	{
+		inputFile:   "invalid_labelmap.conf.input",
+		shouldFail:  true,
+		errContains: "invalid metric relabel config for job 'testjob': missing replacement for LABELMAP action",
+	},
+	{
+		inputFile: "scrape_auth.conf.input",
+	},
+	{
+		inputFile:   "mixing_bearer_token_and_basic_auth.conf.input",
+		shouldFail:  true,
+		errContains: "specified both bearer token file and basic auth for job: testjob",
+	},
+	{
+		inputFile:   "missing_tls_key_file.conf.input",
+		shouldFail:  true,
+		errContains: "invalid TLS config for job 'testjob': client certificate and key files must be specified together",
+	},
+	{
+		inputFile:   "invalid_proxy_url.conf.input",
+		shouldFail:  true,
+		errContains: "invalid proxy URL 'proxy:3128' for job 'testjob'",
+	},
+	{
+		inputFile:   "invalid_scrape_offset.conf.input",
+		shouldFail:  true,
+		errContains: "invalid scrape offset for job 'testjob'",
+	},
+	{
+		inputFile: "sample.conf.yml",
+	},
+	{
+		inputFile:   "invalid_fields.conf.yml",
+		shouldFail:  true,
+		errContains: `line 3, column 3: unknown field "evaluation_intervall" in GlobalConfig`,
+	},
+	{
+		inputFile:   "missing_sd_port.conf.input",
+		shouldFail:  true,
+		errContains: "missing or invalid DNS-SD port for record type A for job 'testjob'",
+	},
+	{
+		inputFile:   "mixing_consul_sd_and_kubernetes_sd.conf.input",
+		shouldFail:  true,
+		errContains: "specified Consul SD together with DNS-SD name, target group, or Kubernetes SD for job: testjob",
+	},
+	{
+		inputFile:   "invalid_kubernetes_api_server.conf.input",
+		shouldFail:  true,
+		errContains: "invalid Kubernetes API server URL 'kubernetes:443' for job 'testjob'",
+	},
 }
 
 func TestConfigs(t *testing.T) {
@@ -82,3 +192,142 @@ func TestConfigs(t *testing.T) {
 		}
 	}
 }
+
+func TestStorageConfig(t *testing.T) {
+	c, err := LoadFromFile(path.Join(fixturesPath, "storage.conf.input"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retention, ok := c.StorageRetention(); !ok || retention != 30*24*time.Hour {
+		t.Errorf("got retention %v, %v, want %v, true", retention, ok, 30*24*time.Hour)
+	}
+	if memoryChunks, ok := c.StorageMemoryChunks(); !ok || memoryChunks != 2097152 {
+		t.Errorf("got memory chunks %d, %v, want 2097152, true", memoryChunks, ok)
+	}
+
+	c, err = LoadFromFile(path.Join(fixturesPath, "minimal.conf.input"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.StorageRetention(); ok {
+		t.Error("retention set in config without storage section")
+	}
+	if _, ok := c.StorageMemoryChunks(); ok {
+		t.Error("memory chunks set in config without storage section")
+	}
+}
+
+func TestRemoteWriteRelabelConfigs(t *testing.T) {
+	c, err := LoadFromFile(path.Join(fixturesPath, "remote_write.conf.input"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcs := c.RemoteWriteRelabelConfigs("generic")
+	if len(rcs) != 2 {
+		t.Fatalf("got %d write relabel configs, want 2", len(rcs))
+	}
+	if !rcs[0].Regexp().MatchString("go_goroutines") || rcs[0].Regexp().MatchString("xgo_goroutines") {
+		t.Errorf("regex %v not anchored", rcs[0].Regexp())
+	}
+	if rcs[1].GetSeparator() != ";" {
+		t.Errorf("got separator %q, want %q", rcs[1].GetSeparator(), ";")
+	}
+	if rcs := c.RemoteWriteRelabelConfigs("influxdb"); rcs != nil {
+		t.Errorf("got write relabel configs %v for unconfigured remote storage", rcs)
+	}
+}
+
+func TestJobRelabelConfigs(t *testing.T) {
+	c, err := LoadFromFile(path.Join(fixturesPath, "kubernetes_sd.conf.input"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := c.GetJobByName("kubernetes-pods")
+	if job == nil {
+		t.Fatal("job kubernetes-pods not found")
+	}
+	if role := job.GetKubernetesSd().GetRole(); role != pb.KubernetesSDConfig_POD {
+		t.Errorf("got Kubernetes SD role %s, want %s", role, pb.KubernetesSDConfig_POD)
+	}
+	if i := job.KubernetesRetryInterval(); i != 10*time.Second {
+		t.Errorf("got Kubernetes SD retry interval %s, want %s", i, 10*time.Second)
+	}
+	rcs := job.RelabelConfigs()
+	if len(rcs) != 2 {
+		t.Fatalf("got %d relabel configs, want 2", len(rcs))
+	}
+	if !rcs[0].Regexp().MatchString("true") || rcs[0].Regexp().MatchString("untrue") {
+		t.Errorf("regex %v not anchored", rcs[0].Regexp())
+	}
+}
+
+func TestJobMetricRelabelConfigs(t *testing.T) {
+	c, err := LoadFromFile(path.Join(fixturesPath, "metric_relabel.conf.input"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := c.GetJobByName("node")
+	if job == nil {
+		t.Fatal("job node not found")
+	}
+	if rcs := job.RelabelConfigs(); len(rcs) != 1 || rcs[0].GetAction() != pb.RelabelConfig_LABELMAP {
+		t.Errorf("got relabel configs %v, want one LABELMAP config", rcs)
+	}
+	rcs := job.MetricRelabelConfigs()
+	if len(rcs) != 2 {
+		t.Fatalf("got %d metric relabel configs, want 2", len(rcs))
+	}
+	if l := job.GetSampleLimit(); l != 5000 {
+		t.Errorf("got sample limit %d, want 5000", l)
+	}
+	if !rcs[0].Regexp().MatchString("node_cpu_seconds") || rcs[0].Regexp().MatchString("go_node_cpu") {
+		t.Errorf("regex %v not anchored", rcs[0].Regexp())
+	}
+}
+
+func TestRuleGroups(t *testing.T) {
+	c, err := LoadFromFile(path.Join(fixturesPath, "rule_groups.conf.input"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []RuleGroup{
+		{Name: "prometheus.rules", Interval: 30 * time.Second, Files: []string{"prometheus.rules"}},
+		{Name: "api_aggregations", Interval: 10 * time.Second, Files: []string{"api.rules", "api_alerts.rules"}},
+		{Name: "slow_aggregations", Interval: 30 * time.Second, Files: []string{"slow.rules"}},
+	}
+	if !reflect.DeepEqual(c.RuleGroups(), expected) {
+		t.Errorf("got rule groups %v, want %v", c.RuleGroups(), expected)
+	}
+}
+
+func TestYAMLConfig(t *testing.T) {
+	textConfig, err := LoadFromFile(path.Join(fixturesPath, "sample.conf.input"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	yamlConfig, err := LoadFromFile(path.Join(fixturesPath, "sample.conf.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(&yamlConfig.PrometheusConfig, &textConfig.PrometheusConfig) {
+		t.Errorf("expected YAML config to equal text config, got:\n%s\nexpected:\n%s", yamlConfig, textConfig)
+	}
+}
+
+func TestYAMLConfigParseErrors(t *testing.T) {
+	_, err := LoadFromFile(path.Join(fixturesPath, "invalid_fields.conf.yml"))
+	errs, ok := err.(ParseErrors)
+	if !ok {
+		t.Fatalf("expected parse errors, got %v", err)
+	}
+	expected := ParseErrors{
+		{Line: 2, Column: 20, Msg: `invalid duration "30" for field "scrape_interval": not a valid duration string: "30"`},
+		{Line: 3, Column: 3, Msg: `unknown field "evaluation_intervall" in GlobalConfig`},
+		{Line: 7, Column: 19, Msg: `invalid value "many" for field "sample_limit" of type uint32`},
+		{Line: 8, Column: 21, Msg: `invalid value "CNAME" for field "sd_record_type"`},
+		{Line: 13, Column: 7, Msg: `expected a sequence for field "target_group", got a mapping`},
+	}
+	if !reflect.DeepEqual(errs, expected) {
+		t.Errorf("expected errors:\n%v\ngot:\n%v", expected, errs)
+	}
+}
@@ -13,7 +13,16 @@ It has these top-level messages:
 	LabelPairs
 	GlobalConfig
 	TargetGroup
+	KubernetesSDConfig
+	ConsulSDConfig
+	ZookeeperSDConfig
+	TLSConfig
+	BasicAuth
 	JobConfig
+	StorageConfig
+	RelabelConfig
+	RemoteWriteConfig
+	RuleGroupConfig
 	PrometheusConfig
 */
 package io_prometheus
@@ -25,6 +34,194 @@ import math "math"
 var _ = proto.Marshal
 var _ = math.Inf
 
+type KubernetesSDConfig_Role int32
+
+const (
+	// Discover a target for each address and port of each endpoints
+	// object. Meta labels: namespace, endpoints_name,
+	// endpoint_port_name, endpoint_ready, and pod_name if the
+	// address belongs to a pod.
+	KubernetesSDConfig_ENDPOINTS KubernetesSDConfig_Role = 0
+	// Discover a target for each declared container port of each
+	// running pod, or for the pod IP if no port is declared. Meta
+	// labels: namespace, pod_name, pod_ip, pod_node_name,
+	// pod_container_name, pod_container_port_name,
+	// pod_label_<name>, and pod_annotation_<name>.
+	KubernetesSDConfig_POD KubernetesSDConfig_Role = 1
+	// Discover a target for each port of each service, addressed by
+	// the DNS name of the service. Meta labels: namespace,
+	// service_name, service_port_name, service_label_<name>, and
+	// service_annotation_<name>.
+	KubernetesSDConfig_SERVICE KubernetesSDConfig_Role = 2
+)
+
+var KubernetesSDConfig_Role_name = map[int32]string{
+	0: "ENDPOINTS",
+	1: "POD",
+	2: "SERVICE",
+}
+var KubernetesSDConfig_Role_value = map[string]int32{
+	"ENDPOINTS": 0,
+	"POD":       1,
+	"SERVICE":   2,
+}
+
+func (x KubernetesSDConfig_Role) Enum() *KubernetesSDConfig_Role {
+	p := new(KubernetesSDConfig_Role)
+	*p = x
+	return p
+}
+func (x KubernetesSDConfig_Role) String() string {
+	return proto.EnumName(KubernetesSDConfig_Role_name, int32(x))
+}
+func (x *KubernetesSDConfig_Role) UnmarshalJSON(data []byte) error {
+	value, err := proto.UnmarshalJSONEnum(KubernetesSDConfig_Role_value, data, "KubernetesSDConfig_Role")
+	if err != nil {
+		return err
+	}
+	*x = KubernetesSDConfig_Role(value)
+	return nil
+}
+
+type ZookeeperSDConfig_Format int32
+
+const (
+	// The Serverset format of Finagle.
+	ZookeeperSDConfig_SERVERSET ZookeeperSDConfig_Format = 0
+	// The format of Airbnb's Nerve, as used by SmartStack.
+	ZookeeperSDConfig_NERVE ZookeeperSDConfig_Format = 1
+)
+
+var ZookeeperSDConfig_Format_name = map[int32]string{
+	0: "SERVERSET",
+	1: "NERVE",
+}
+var ZookeeperSDConfig_Format_value = map[string]int32{
+	"SERVERSET": 0,
+	"NERVE":     1,
+}
+
+func (x ZookeeperSDConfig_Format) Enum() *ZookeeperSDConfig_Format {
+	p := new(ZookeeperSDConfig_Format)
+	*p = x
+	return p
+}
+func (x ZookeeperSDConfig_Format) String() string {
+	return proto.EnumName(ZookeeperSDConfig_Format_name, int32(x))
+}
+func (x *ZookeeperSDConfig_Format) UnmarshalJSON(data []byte) error {
+	value, err := proto.UnmarshalJSONEnum(ZookeeperSDConfig_Format_value, data, "ZookeeperSDConfig_Format")
+	if err != nil {
+		return err
+	}
+	*x = ZookeeperSDConfig_Format(value)
+	return nil
+}
+
+// The types of DNS records targets can be discovered from. Each
+// target discovered via DNS-SD carries the meta labels
+// "__meta_dns_name" with the name of the record it was discovered from
+// and "__meta_dns_record_type" with the type of that record.
+type JobConfig_DNSRecordType int32
+
+const (
+	// Discover the targets at the hosts and ports of SRV records.
+	JobConfig_SRV JobConfig_DNSRecordType = 0
+	// Discover the targets at the addresses of A records and sd_port.
+	JobConfig_A JobConfig_DNSRecordType = 1
+	// Discover the targets at the addresses of AAAA records and
+	// sd_port.
+	JobConfig_AAAA JobConfig_DNSRecordType = 2
+	// Discover the targets at the mail exchangers of MX records and
+	// sd_port.
+	JobConfig_MX JobConfig_DNSRecordType = 3
+	// Discover the targets at the "<host>:<port>" strings in TXT
+	// records.
+	JobConfig_TXT JobConfig_DNSRecordType = 4
+)
+
+var JobConfig_DNSRecordType_name = map[int32]string{
+	0: "SRV",
+	1: "A",
+	2: "AAAA",
+	3: "MX",
+	4: "TXT",
+}
+var JobConfig_DNSRecordType_value = map[string]int32{
+	"SRV":  0,
+	"A":    1,
+	"AAAA": 2,
+	"MX":   3,
+	"TXT":  4,
+}
+
+func (x JobConfig_DNSRecordType) Enum() *JobConfig_DNSRecordType {
+	p := new(JobConfig_DNSRecordType)
+	*p = x
+	return p
+}
+func (x JobConfig_DNSRecordType) String() string {
+	return proto.EnumName(JobConfig_DNSRecordType_name, int32(x))
+}
+func (x *JobConfig_DNSRecordType) UnmarshalJSON(data []byte) error {
+	value, err := proto.UnmarshalJSONEnum(JobConfig_DNSRecordType_value, data, "JobConfig_DNSRecordType")
+	if err != nil {
+		return err
+	}
+	*x = JobConfig_DNSRecordType(value)
+	return nil
+}
+
+type RelabelConfig_Action int32
+
+const (
+	// Set the target label to the replacement, in which $1, $2, ...
+	// refer to the submatches of the regular expression. The target
+	// label is removed if the replacement expands to the empty
+	// string. Nothing happens if the regular expression does not
+	// match.
+	RelabelConfig_REPLACE RelabelConfig_Action = 0
+	// Drop the series if the regular expression does not match.
+	RelabelConfig_KEEP RelabelConfig_Action = 1
+	// Drop the series if the regular expression matches.
+	RelabelConfig_DROP RelabelConfig_Action = 2
+	// Copy the value of each label whose name matches the regular
+	// expression to the label named by the replacement, in which
+	// $1, $2, ... refer to the submatches of the name. The source
+	// labels are ignored.
+	RelabelConfig_LABELMAP RelabelConfig_Action = 3
+)
+
+var RelabelConfig_Action_name = map[int32]string{
+	0: "REPLACE",
+	1: "KEEP",
+	2: "DROP",
+	3: "LABELMAP",
+}
+var RelabelConfig_Action_value = map[string]int32{
+	"REPLACE":  0,
+	"KEEP":     1,
+	"DROP":     2,
+	"LABELMAP": 3,
+}
+
+func (x RelabelConfig_Action) Enum() *RelabelConfig_Action {
+	p := new(RelabelConfig_Action)
+	*p = x
+	return p
+}
+func (x RelabelConfig_Action) String() string {
+	return proto.EnumName(RelabelConfig_Action_name, int32(x))
+}
+func (x *RelabelConfig_Action) UnmarshalJSON(data []byte) error {
+	value, err := proto.UnmarshalJSONEnum(RelabelConfig_Action_value, data, "RelabelConfig_Action")
+	if err != nil {
+		return err
+	}
+	*x = RelabelConfig_Action(value)
+	return nil
+}
+
 // A label/value pair suitable for attaching to timeseries.
 type LabelPair struct {
 	// The name of the label. Must adhere to the regex "[a-zA-Z_][a-zA-Z0-9_]*".
@@ -146,9 +343,305 @@ func (m *TargetGroup) GetLabels() *LabelPairs {
 	return nil
 }
 
+// The settings for discovering targets via the Kubernetes API. Each
+// discovered target carries the label "__address__" with the host and port to
+// scrape and meta labels starting with "__meta_kubernetes_", which can be
+// used in relabel configurations. All labels starting with "__" are removed
+// after relabeling.
+type KubernetesSDConfig struct {
+	// The URL of the Kubernetes API server, e.g. "https://kubernetes".
+	ApiServer *string `protobuf:"bytes,1,req,name=api_server" json:"api_server,omitempty"`
+	// The kind of objects to discover targets from.
+	Role *KubernetesSDConfig_Role `protobuf:"varint,2,opt,name=role,enum=io.prometheus.KubernetesSDConfig_Role,def=0" json:"role,omitempty"`
+	// The namespace to discover targets in. All namespaces if empty.
+	Namespace *string `protobuf:"bytes,3,opt,name=namespace" json:"namespace,omitempty"`
+	// The file to read the bearer token from to authenticate against the
+	// API server.
+	BearerTokenFile *string `protobuf:"bytes,4,opt,name=bearer_token_file" json:"bearer_token_file,omitempty"`
+	// The file to read the CA certificates from to verify the API server.
+	CaFile *string `protobuf:"bytes,5,opt,name=ca_file" json:"ca_file,omitempty"`
+	// How long to wait before listing the objects again after the watch
+	// of the API server failed. Must be a valid Prometheus duration string
+	// in the form "[0-9]+[smhdwy]".
+	RetryInterval    *string `protobuf:"bytes,6,opt,name=retry_interval,def=10s" json:"retry_interval,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *KubernetesSDConfig) Reset()         { *m = KubernetesSDConfig{} }
+func (m *KubernetesSDConfig) String() string { return proto.CompactTextString(m) }
+func (*KubernetesSDConfig) ProtoMessage()    {}
+
+const Default_KubernetesSDConfig_Role KubernetesSDConfig_Role = KubernetesSDConfig_ENDPOINTS
+const Default_KubernetesSDConfig_RetryInterval string = "10s"
+
+func (m *KubernetesSDConfig) GetApiServer() string {
+	if m != nil && m.ApiServer != nil {
+		return *m.ApiServer
+	}
+	return ""
+}
+
+func (m *KubernetesSDConfig) GetRole() KubernetesSDConfig_Role {
+	if m != nil && m.Role != nil {
+		return *m.Role
+	}
+	return Default_KubernetesSDConfig_Role
+}
+
+func (m *KubernetesSDConfig) GetNamespace() string {
+	if m != nil && m.Namespace != nil {
+		return *m.Namespace
+	}
+	return ""
+}
+
+func (m *KubernetesSDConfig) GetBearerTokenFile() string {
+	if m != nil && m.BearerTokenFile != nil {
+		return *m.BearerTokenFile
+	}
+	return ""
+}
+
+func (m *KubernetesSDConfig) GetCaFile() string {
+	if m != nil && m.CaFile != nil {
+		return *m.CaFile
+	}
+	return ""
+}
+
+func (m *KubernetesSDConfig) GetRetryInterval() string {
+	if m != nil && m.RetryInterval != nil {
+		return *m.RetryInterval
+	}
+	return Default_KubernetesSDConfig_RetryInterval
+}
+
+// The settings for discovering targets via the Consul catalog. A target is
+// discovered for each instance of each selected service. Each target carries
+// the label "__address__" with the host and port to scrape and the meta labels
+// "__meta_consul_node", "__meta_consul_address", "__meta_consul_dc",
+// "__meta_consul_service", "__meta_consul_service_id",
+// "__meta_consul_service_address", "__meta_consul_service_port",
+// "__meta_consul_tags", "__meta_consul_health", and
+// "__meta_consul_metadata_<key>" for the metadata of the node. The tags are
+// joined by the tag separator, which is also placed at both ends, so that a
+// single tag can be matched by the regex ".*,tag,.*".
+type ConsulSDConfig struct {
+	// The address of the Consul agent, e.g. "localhost:8500".
+	Server *string `protobuf:"bytes,1,req,name=server" json:"server,omitempty"`
+	// The scheme to use to talk to the Consul agent.
+	Scheme *string `protobuf:"bytes,2,opt,name=scheme,def=http" json:"scheme,omitempty"`
+	// The datacenter to discover targets in. The datacenter of the agent if
+	// empty.
+	Datacenter *string `protobuf:"bytes,3,opt,name=datacenter" json:"datacenter,omitempty"`
+	// The ACL token to use to talk to the Consul agent.
+	Token *string `protobuf:"bytes,4,opt,name=token" json:"token,omitempty"`
+	// The names of the services to discover targets for. All services if
+	// empty.
+	Service []string `protobuf:"bytes,5,rep,name=service" json:"service,omitempty"`
+	// The separator to join the tags of a service instance by.
+	TagSeparator *string `protobuf:"bytes,6,opt,name=tag_separator,def=," json:"tag_separator,omitempty"`
+	// How long to wait before querying the agent again after a query
+	// failed. Must be a valid Prometheus duration string in the form
+	// "[0-9]+[smhdwy]".
+	RetryInterval    *string `protobuf:"bytes,7,opt,name=retry_interval,def=10s" json:"retry_interval,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *ConsulSDConfig) Reset()         { *m = ConsulSDConfig{} }
+func (m *ConsulSDConfig) String() string { return proto.CompactTextString(m) }
+func (*ConsulSDConfig) ProtoMessage()    {}
+
+const Default_ConsulSDConfig_Scheme string = "http"
+const Default_ConsulSDConfig_TagSeparator string = ","
+const Default_ConsulSDConfig_RetryInterval string = "10s"
+
+func (m *ConsulSDConfig) GetServer() string {
+	if m != nil && m.Server != nil {
+		return *m.Server
+	}
+	return ""
+}
+
+func (m *ConsulSDConfig) GetScheme() string {
+	if m != nil && m.Scheme != nil {
+		return *m.Scheme
+	}
+	return Default_ConsulSDConfig_Scheme
+}
+
+func (m *ConsulSDConfig) GetDatacenter() string {
+	if m != nil && m.Datacenter != nil {
+		return *m.Datacenter
+	}
+	return ""
+}
+
+func (m *ConsulSDConfig) GetToken() string {
+	if m != nil && m.Token != nil {
+		return *m.Token
+	}
+	return ""
+}
+
+func (m *ConsulSDConfig) GetService() []string {
+	if m != nil {
+		return m.Service
+	}
+	return nil
+}
+
+func (m *ConsulSDConfig) GetTagSeparator() string {
+	if m != nil && m.TagSeparator != nil {
+		return *m.TagSeparator
+	}
+	return Default_ConsulSDConfig_TagSeparator
+}
+
+func (m *ConsulSDConfig) GetRetryInterval() string {
+	if m != nil && m.RetryInterval != nil {
+		return *m.RetryInterval
+	}
+	return Default_ConsulSDConfig_RetryInterval
+}
+
+// The settings for discovering targets registered in Zookeeper. A target is
+// discovered for each child znode of the configured paths, whose data
+// describes the member of a service in the Serverset format used by Finagle
+// or in the format of Airbnb's Nerve. Each target carries the label
+// "__address__" with the host and port to scrape. For the SERVERSET format,
+// the meta labels are "__meta_serverset_path", "__meta_serverset_status",
+// "__meta_serverset_shard", "__meta_serverset_endpoint_host",
+// "__meta_serverset_endpoint_port", and
+// "__meta_serverset_endpoint_host_<name>" and
+// "__meta_serverset_endpoint_port_<name>" for each additional endpoint. For
+// the NERVE format, they are "__meta_nerve_path", "__meta_nerve_name",
+// "__meta_nerve_endpoint_host", and "__meta_nerve_endpoint_port".
+type ZookeeperSDConfig struct {
+	// The Zookeeper servers as "<host>:<port>".
+	Server []string `protobuf:"bytes,1,rep,name=server" json:"server,omitempty"`
+	// The paths of the znodes whose children describe the members.
+	Path []string `protobuf:"bytes,2,rep,name=path" json:"path,omitempty"`
+	// The format of the data of the member znodes.
+	Format *ZookeeperSDConfig_Format `protobuf:"varint,3,opt,name=format,enum=io.prometheus.ZookeeperSDConfig_Format,def=0" json:"format,omitempty"`
+	// The Zookeeper session timeout. Must be a valid Prometheus duration
+	// string in the form "[0-9]+[smhdwy]".
+	Timeout          *string `protobuf:"bytes,4,opt,name=timeout,def=10s" json:"timeout,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *ZookeeperSDConfig) Reset()         { *m = ZookeeperSDConfig{} }
+func (m *ZookeeperSDConfig) String() string { return proto.CompactTextString(m) }
+func (*ZookeeperSDConfig) ProtoMessage()    {}
+
+const Default_ZookeeperSDConfig_Format ZookeeperSDConfig_Format = ZookeeperSDConfig_SERVERSET
+const Default_ZookeeperSDConfig_Timeout string = "10s"
+
+func (m *ZookeeperSDConfig) GetServer() []string {
+	if m != nil {
+		return m.Server
+	}
+	return nil
+}
+
+func (m *ZookeeperSDConfig) GetPath() []string {
+	if m != nil {
+		return m.Path
+	}
+	return nil
+}
+
+func (m *ZookeeperSDConfig) GetFormat() ZookeeperSDConfig_Format {
+	if m != nil && m.Format != nil {
+		return *m.Format
+	}
+	return Default_ZookeeperSDConfig_Format
+}
+
+func (m *ZookeeperSDConfig) GetTimeout() string {
+	if m != nil && m.Timeout != nil {
+		return *m.Timeout
+	}
+	return Default_ZookeeperSDConfig_Timeout
+}
+
+// The TLS settings for scraping targets via HTTPS.
+type TLSConfig struct {
+	// The file to read the CA certificates from to verify the targets.
+	// The system's CA certificates are used if omitted.
+	CaFile *string `protobuf:"bytes,1,opt,name=ca_file" json:"ca_file,omitempty"`
+	// The file to read the client certificate from to authenticate
+	// against the targets. Requires key_file.
+	CertFile *string `protobuf:"bytes,2,opt,name=cert_file" json:"cert_file,omitempty"`
+	// The file to read the key of the client certificate from.
+	KeyFile *string `protobuf:"bytes,3,opt,name=key_file" json:"key_file,omitempty"`
+	// Whether to accept any certificate presented by the targets.
+	InsecureSkipVerify *bool  `protobuf:"varint,4,opt,name=insecure_skip_verify,def=0" json:"insecure_skip_verify,omitempty"`
+	XXX_unrecognized   []byte `json:"-"`
+}
+
+func (m *TLSConfig) Reset()         { *m = TLSConfig{} }
+func (m *TLSConfig) String() string { return proto.CompactTextString(m) }
+func (*TLSConfig) ProtoMessage()    {}
+
+const Default_TLSConfig_InsecureSkipVerify bool = false
+
+func (m *TLSConfig) GetCaFile() string {
+	if m != nil && m.CaFile != nil {
+		return *m.CaFile
+	}
+	return ""
+}
+
+func (m *TLSConfig) GetCertFile() string {
+	if m != nil && m.CertFile != nil {
+		return *m.CertFile
+	}
+	return ""
+}
+
+func (m *TLSConfig) GetKeyFile() string {
+	if m != nil && m.KeyFile != nil {
+		return *m.KeyFile
+	}
+	return ""
+}
+
+func (m *TLSConfig) GetInsecureSkipVerify() bool {
+	if m != nil && m.InsecureSkipVerify != nil {
+		return *m.InsecureSkipVerify
+	}
+	return Default_TLSConfig_InsecureSkipVerify
+}
+
+// The credentials for HTTP basic authentication.
+type BasicAuth struct {
+	Username         *string `protobuf:"bytes,1,req,name=username" json:"username,omitempty"`
+	Password         *string `protobuf:"bytes,2,opt,name=password" json:"password,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *BasicAuth) Reset()         { *m = BasicAuth{} }
+func (m *BasicAuth) String() string { return proto.CompactTextString(m) }
+func (*BasicAuth) ProtoMessage()    {}
+
+func (m *BasicAuth) GetUsername() string {
+	if m != nil && m.Username != nil {
+		return *m.Username
+	}
+	return ""
+}
+
+func (m *BasicAuth) GetPassword() string {
+	if m != nil && m.Password != nil {
+		return *m.Password
+	}
+	return ""
+}
+
 // The configuration for a Prometheus job to scrape.
 //
-// The next field no. is 8.
+// The next field no. is 23.
 type JobConfig struct {
 	// The job name. Must adhere to the regex "[a-zA-Z_][a-zA-Z0-9_-]*".
 	Name *string `protobuf:"bytes,1,req,name=name" json:"name,omitempty"`
@@ -161,16 +654,74 @@ type JobConfig struct {
 	ScrapeTimeout *string `protobuf:"bytes,7,opt,name=scrape_timeout,def=10s" json:"scrape_timeout,omitempty"`
 	// The DNS-SD service name pointing to SRV records containing endpoint
 	// information for a job. When this field is provided, no target_group
-	// elements may be set.
+	// kubernetes_sd, consul_sd, or zookeeper_sd elements may be set.
 	SdName *string `protobuf:"bytes,3,opt,name=sd_name" json:"sd_name,omitempty"`
 	// Discovery refresh period when using DNS-SD to discover targets. Must be a
 	// valid Prometheus duration string in the form "[0-9]+[smhdwy]".
 	SdRefreshInterval *string `protobuf:"bytes,4,opt,name=sd_refresh_interval,def=30s" json:"sd_refresh_interval,omitempty"`
+	// The type of DNS records to look up for sd_name.
+	SdRecordType *JobConfig_DNSRecordType `protobuf:"varint,11,opt,name=sd_record_type,enum=io.prometheus.JobConfig_DNSRecordType,def=0" json:"sd_record_type,omitempty"`
+	// The port to scrape the targets discovered from A, AAAA, or MX records
+	// at. Required for these record types.
+	SdPort *int32 `protobuf:"varint,12,opt,name=sd_port" json:"sd_port,omitempty"`
 	// List of labeled target groups for this job. Only legal when DNS-SD isn't
 	// used for a job.
 	TargetGroup []*TargetGroup `protobuf:"bytes,5,rep,name=target_group" json:"target_group,omitempty"`
 	// The HTTP resource path to fetch metrics from on targets.
-	MetricsPath      *string `protobuf:"bytes,6,opt,name=metrics_path,def=/metrics" json:"metrics_path,omitempty"`
+	MetricsPath *string `protobuf:"bytes,6,opt,name=metrics_path,def=/metrics" json:"metrics_path,omitempty"`
+	// The settings for discovering targets via the Kubernetes API. When
+	// this field is provided, no target_group elements may be set.
+	KubernetesSd *KubernetesSDConfig `protobuf:"bytes,8,opt,name=kubernetes_sd" json:"kubernetes_sd,omitempty"`
+	// Rules applied in order to the labels of each target before it is
+	// scraped. Targets are dropped like series are dropped by write relabel
+	// configurations. Labels starting with "__" are removed afterwards.
+	// Discovered targets are scraped at the address in the "__address__"
+	// label, which cannot be changed for the targets of target groups.
+	RelabelConfig []*RelabelConfig `protobuf:"bytes,9,rep,name=relabel_config" json:"relabel_config,omitempty"`
+	// The settings for discovering targets via the Consul catalog. When
+	// this field is provided, no target_group or kubernetes_sd elements may
+	// be set.
+	ConsulSd *ConsulSDConfig `protobuf:"bytes,10,opt,name=consul_sd" json:"consul_sd,omitempty"`
+	// The settings for discovering targets registered in Zookeeper. When
+	// this field is provided, no target_group, kubernetes_sd, or consul_sd
+	// elements may be set.
+	ZookeeperSd *ZookeeperSDConfig `protobuf:"bytes,13,opt,name=zookeeper_sd" json:"zookeeper_sd,omitempty"`
+	// Rules applied in order to each scraped series, after the target
+	// labels have been attached and before the series is stored. Dropping
+	// series here keeps unwanted metrics out of the storage.
+	MetricRelabelConfig []*RelabelConfig `protobuf:"bytes,14,rep,name=metric_relabel_config" json:"metric_relabel_config,omitempty"`
+	// The scheme to scrape discovered targets with, "http" or "https".
+	// The targets of target groups are scraped with the scheme of their
+	// URL.
+	Scheme *string `protobuf:"bytes,15,opt,name=scheme,def=http" json:"scheme,omitempty"`
+	// The TLS settings for scraping targets via HTTPS.
+	TlsConfig *TLSConfig `protobuf:"bytes,16,opt,name=tls_config" json:"tls_config,omitempty"`
+	// The file to read the bearer token from to authenticate against the
+	// targets. It is read for each scrape, so that the token can be
+	// rotated. May not be set together with basic_auth.
+	BearerTokenFile *string `protobuf:"bytes,17,opt,name=bearer_token_file" json:"bearer_token_file,omitempty"`
+	// The credentials to authenticate against the targets with HTTP basic
+	// authentication.
+	BasicAuth *BasicAuth `protobuf:"bytes,18,opt,name=basic_auth" json:"basic_auth,omitempty"`
+	// The URL of the HTTP proxy to scrape the targets through, e.g.
+	// "http://proxy:3128".
+	ProxyUrl *string `protobuf:"bytes,19,opt,name=proxy_url" json:"proxy_url,omitempty"`
+	// The maximum number of samples, after metric relabeling, a single
+	// scrape of a target may yield. Scrapes yielding more samples fail and
+	// store none of them. 0 means no limit.
+	SampleLimit *uint32 `protobuf:"varint,20,opt,name=sample_limit,def=0" json:"sample_limit,omitempty"`
+	// Whether the labels of scraped series win over conflicting target
+	// labels, e.g. for federation or a Pushgateway. Conflicting target
+	// labels are then not attached. Otherwise, the conflicting scraped
+	// labels are renamed by prefixing them with "exporter_".
+	HonorLabels *bool `protobuf:"varint,21,opt,name=honor_labels,def=0" json:"honor_labels,omitempty"`
+	// Targets are scraped at a fixed offset within each scrape interval,
+	// derived from a hash of their URL, to spread the scrapes of a job
+	// evenly. This offset is added to it, e.g. to shift the scrapes of a
+	// job relative to other Prometheus servers scraping the same targets.
+	// Must be a valid Prometheus duration string in the form
+	// "[0-9]+[smhdwy]".
+	ScrapeOffset     *string `protobuf:"bytes,22,opt,name=scrape_offset,def=0s" json:"scrape_offset,omitempty"`
 	XXX_unrecognized []byte  `json:"-"`
 }
 
@@ -180,7 +731,12 @@ func (*JobConfig) ProtoMessage()    {}
 
 const Default_JobConfig_ScrapeTimeout string = "10s"
 const Default_JobConfig_SdRefreshInterval string = "30s"
+const Default_JobConfig_SdRecordType JobConfig_DNSRecordType = JobConfig_SRV
 const Default_JobConfig_MetricsPath string = "/metrics"
+const Default_JobConfig_Scheme string = "http"
+const Default_JobConfig_SampleLimit uint32 = 0
+const Default_JobConfig_HonorLabels bool = false
+const Default_JobConfig_ScrapeOffset string = "0s"
 
 func (m *JobConfig) GetName() string {
 	if m != nil && m.Name != nil {
@@ -217,6 +773,20 @@ func (m *JobConfig) GetSdRefreshInterval() string {
 	return Default_JobConfig_SdRefreshInterval
 }
 
+func (m *JobConfig) GetSdRecordType() JobConfig_DNSRecordType {
+	if m != nil && m.SdRecordType != nil {
+		return *m.SdRecordType
+	}
+	return Default_JobConfig_SdRecordType
+}
+
+func (m *JobConfig) GetSdPort() int32 {
+	if m != nil && m.SdPort != nil {
+		return *m.SdPort
+	}
+	return 0
+}
+
 func (m *JobConfig) GetTargetGroup() []*TargetGroup {
 	if m != nil {
 		return m.TargetGroup
@@ -231,6 +801,267 @@ func (m *JobConfig) GetMetricsPath() string {
 	return Default_JobConfig_MetricsPath
 }
 
+func (m *JobConfig) GetKubernetesSd() *KubernetesSDConfig {
+	if m != nil {
+		return m.KubernetesSd
+	}
+	return nil
+}
+
+func (m *JobConfig) GetRelabelConfig() []*RelabelConfig {
+	if m != nil {
+		return m.RelabelConfig
+	}
+	return nil
+}
+
+func (m *JobConfig) GetConsulSd() *ConsulSDConfig {
+	if m != nil {
+		return m.ConsulSd
+	}
+	return nil
+}
+
+func (m *JobConfig) GetZookeeperSd() *ZookeeperSDConfig {
+	if m != nil {
+		return m.ZookeeperSd
+	}
+	return nil
+}
+
+func (m *JobConfig) GetMetricRelabelConfig() []*RelabelConfig {
+	if m != nil {
+		return m.MetricRelabelConfig
+	}
+	return nil
+}
+
+func (m *JobConfig) GetScheme() string {
+	if m != nil && m.Scheme != nil {
+		return *m.Scheme
+	}
+	return Default_JobConfig_Scheme
+}
+
+func (m *JobConfig) GetTlsConfig() *TLSConfig {
+	if m != nil {
+		return m.TlsConfig
+	}
+	return nil
+}
+
+func (m *JobConfig) GetBearerTokenFile() string {
+	if m != nil && m.BearerTokenFile != nil {
+		return *m.BearerTokenFile
+	}
+	return ""
+}
+
+func (m *JobConfig) GetBasicAuth() *BasicAuth {
+	if m != nil {
+		return m.BasicAuth
+	}
+	return nil
+}
+
+func (m *JobConfig) GetProxyUrl() string {
+	if m != nil && m.ProxyUrl != nil {
+		return *m.ProxyUrl
+	}
+	return ""
+}
+
+func (m *JobConfig) GetSampleLimit() uint32 {
+	if m != nil && m.SampleLimit != nil {
+		return *m.SampleLimit
+	}
+	return Default_JobConfig_SampleLimit
+}
+
+func (m *JobConfig) GetHonorLabels() bool {
+	if m != nil && m.HonorLabels != nil {
+		return *m.HonorLabels
+	}
+	return Default_JobConfig_HonorLabels
+}
+
+func (m *JobConfig) GetScrapeOffset() string {
+	if m != nil && m.ScrapeOffset != nil {
+		return *m.ScrapeOffset
+	}
+	return Default_JobConfig_ScrapeOffset
+}
+
+// The settings of the local storage that can be changed at runtime (upon
+// SIGHUP). If set, they override the corresponding command-line flags.
+type StorageConfig struct {
+	// How long to retain samples in the local storage. Must be a valid
+	// Prometheus duration string in the form "[0-9]+[smhdwy]".
+	Retention *string `protobuf:"bytes,1,opt,name=retention" json:"retention,omitempty"`
+	// How many chunks to keep in memory. Must be positive.
+	MemoryChunks     *int64 `protobuf:"varint,2,opt,name=memory_chunks" json:"memory_chunks,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *StorageConfig) Reset()         { *m = StorageConfig{} }
+func (m *StorageConfig) String() string { return proto.CompactTextString(m) }
+func (*StorageConfig) ProtoMessage()    {}
+
+func (m *StorageConfig) GetRetention() string {
+	if m != nil && m.Retention != nil {
+		return *m.Retention
+	}
+	return ""
+}
+
+func (m *StorageConfig) GetMemoryChunks() int64 {
+	if m != nil && m.MemoryChunks != nil {
+		return *m.MemoryChunks
+	}
+	return 0
+}
+
+// A rule to relabel a series or to filter it by its labels. The values of the
+// source labels are concatenated with the separator, and the regular
+// expression is matched against the result.
+type RelabelConfig struct {
+	// The labels whose values are concatenated.
+	SourceLabel []string `protobuf:"bytes,1,rep,name=source_label" json:"source_label,omitempty"`
+	// The separator placed between the concatenated label values.
+	Separator *string `protobuf:"bytes,2,opt,name=separator,def=;" json:"separator,omitempty"`
+	// The regular expression to match against the concatenated label
+	// values. It is anchored at both ends.
+	Regex *string `protobuf:"bytes,3,req,name=regex" json:"regex,omitempty"`
+	// The label to set with the REPLACE action. Must adhere to the regex
+	// "[a-zA-Z_][a-zA-Z0-9_]*".
+	TargetLabel *string `protobuf:"bytes,4,opt,name=target_label" json:"target_label,omitempty"`
+	// The replacement for the REPLACE and LABELMAP actions. Required for
+	// the LABELMAP action.
+	Replacement      *string               `protobuf:"bytes,5,opt,name=replacement" json:"replacement,omitempty"`
+	Action           *RelabelConfig_Action `protobuf:"varint,6,opt,name=action,enum=io.prometheus.RelabelConfig_Action,def=0" json:"action,omitempty"`
+	XXX_unrecognized []byte                `json:"-"`
+}
+
+func (m *RelabelConfig) Reset()         { *m = RelabelConfig{} }
+func (m *RelabelConfig) String() string { return proto.CompactTextString(m) }
+func (*RelabelConfig) ProtoMessage()    {}
+
+const Default_RelabelConfig_Separator string = ";"
+const Default_RelabelConfig_Action RelabelConfig_Action = RelabelConfig_REPLACE
+
+func (m *RelabelConfig) GetSourceLabel() []string {
+	if m != nil {
+		return m.SourceLabel
+	}
+	return nil
+}
+
+func (m *RelabelConfig) GetSeparator() string {
+	if m != nil && m.Separator != nil {
+		return *m.Separator
+	}
+	return Default_RelabelConfig_Separator
+}
+
+func (m *RelabelConfig) GetRegex() string {
+	if m != nil && m.Regex != nil {
+		return *m.Regex
+	}
+	return ""
+}
+
+func (m *RelabelConfig) GetTargetLabel() string {
+	if m != nil && m.TargetLabel != nil {
+		return *m.TargetLabel
+	}
+	return ""
+}
+
+func (m *RelabelConfig) GetReplacement() string {
+	if m != nil && m.Replacement != nil {
+		return *m.Replacement
+	}
+	return ""
+}
+
+func (m *RelabelConfig) GetAction() RelabelConfig_Action {
+	if m != nil && m.Action != nil {
+		return *m.Action
+	}
+	return Default_RelabelConfig_Action
+}
+
+// The settings for writing samples to a remote storage.
+type RemoteWriteConfig struct {
+	// The type of the remote storage the settings apply to: "opentsdb",
+	// "influxdb", "generic", "kafka", or "graphite". Its address is set
+	// with the corresponding -storage.remote.* flag.
+	Type *string `protobuf:"bytes,1,req,name=type" json:"type,omitempty"`
+	// Rules applied in order to the metric of each sample before it is
+	// queued for the remote storage. Samples of dropped series are not
+	// sent.
+	WriteRelabelConfig []*RelabelConfig `protobuf:"bytes,2,rep,name=write_relabel_config" json:"write_relabel_config,omitempty"`
+	XXX_unrecognized   []byte           `json:"-"`
+}
+
+func (m *RemoteWriteConfig) Reset()         { *m = RemoteWriteConfig{} }
+func (m *RemoteWriteConfig) String() string { return proto.CompactTextString(m) }
+func (*RemoteWriteConfig) ProtoMessage()    {}
+
+func (m *RemoteWriteConfig) GetType() string {
+	if m != nil && m.Type != nil {
+		return *m.Type
+	}
+	return ""
+}
+
+func (m *RemoteWriteConfig) GetWriteRelabelConfig() []*RelabelConfig {
+	if m != nil {
+		return m.WriteRelabelConfig
+	}
+	return nil
+}
+
+// A named group of rules. The rules of a group are evaluated sequentially in
+// the order they are loaded, so that each rule sees the output of the rules
+// preceding it.
+type RuleGroupConfig struct {
+	// The name of the group. Must be unique among all rule groups.
+	Name *string `protobuf:"bytes,1,req,name=name" json:"name,omitempty"`
+	// How frequently to evaluate the rules of the group. Must be a valid
+	// Prometheus duration string in the form "[0-9]+[smhdwy]". If omitted,
+	// the global evaluation interval is used.
+	EvaluationInterval *string `protobuf:"bytes,2,opt,name=evaluation_interval" json:"evaluation_interval,omitempty"`
+	// The list of file names of rule files to load into the group.
+	RuleFile         []string `protobuf:"bytes,3,rep,name=rule_file" json:"rule_file,omitempty"`
+	XXX_unrecognized []byte   `json:"-"`
+}
+
+func (m *RuleGroupConfig) Reset()         { *m = RuleGroupConfig{} }
+func (m *RuleGroupConfig) String() string { return proto.CompactTextString(m) }
+func (*RuleGroupConfig) ProtoMessage()    {}
+
+func (m *RuleGroupConfig) GetName() string {
+	if m != nil && m.Name != nil {
+		return *m.Name
+	}
+	return ""
+}
+
+func (m *RuleGroupConfig) GetEvaluationInterval() string {
+	if m != nil && m.EvaluationInterval != nil {
+		return *m.EvaluationInterval
+	}
+	return ""
+}
+
+func (m *RuleGroupConfig) GetRuleFile() []string {
+	if m != nil {
+		return m.RuleFile
+	}
+	return nil
+}
+
 // The top-level Prometheus configuration.
 type PrometheusConfig struct {
 	// Global Prometheus configuration options. If omitted, an empty global
@@ -238,8 +1069,14 @@ type PrometheusConfig struct {
 	// created.
 	Global *GlobalConfig `protobuf:"bytes,1,opt,name=global" json:"global,omitempty"`
 	// The list of jobs to scrape.
-	Job              []*JobConfig `protobuf:"bytes,2,rep,name=job" json:"job,omitempty"`
-	XXX_unrecognized []byte       `json:"-"`
+	Job []*JobConfig `protobuf:"bytes,2,rep,name=job" json:"job,omitempty"`
+	// Settings of the local storage.
+	Storage *StorageConfig `protobuf:"bytes,3,opt,name=storage" json:"storage,omitempty"`
+	// Settings for writing to remote storages, at most one per type.
+	RemoteWrite []*RemoteWriteConfig `protobuf:"bytes,4,rep,name=remote_write" json:"remote_write,omitempty"`
+	// Groups of rules evaluated at their own intervals.
+	RuleGroup        []*RuleGroupConfig `protobuf:"bytes,5,rep,name=rule_group" json:"rule_group,omitempty"`
+	XXX_unrecognized []byte             `json:"-"`
 }
 
 func (m *PrometheusConfig) Reset()         { *m = PrometheusConfig{} }
@@ -260,5 +1097,30 @@ func (m *PrometheusConfig) GetJob() []*JobConfig {
 	return nil
 }
 
+func (m *PrometheusConfig) GetStorage() *StorageConfig {
+	if m != nil {
+		return m.Storage
+	}
+	return nil
+}
+
+func (m *PrometheusConfig) GetRemoteWrite() []*RemoteWriteConfig {
+	if m != nil {
+		return m.RemoteWrite
+	}
+	return nil
+}
+
+func (m *PrometheusConfig) GetRuleGroup() []*RuleGroupConfig {
+	if m != nil {
+		return m.RuleGroup
+	}
+	return nil
+}
+
 func init() {
+	proto.RegisterEnum("io.prometheus.KubernetesSDConfig_Role", KubernetesSDConfig_Role_name, KubernetesSDConfig_Role_value)
+	proto.RegisterEnum("io.prometheus.ZookeeperSDConfig_Format", ZookeeperSDConfig_Format_name, ZookeeperSDConfig_Format_value)
+	proto.RegisterEnum("io.prometheus.JobConfig_DNSRecordType", JobConfig_DNSRecordType_name, JobConfig_DNSRecordType_value)
+	proto.RegisterEnum("io.prometheus.RelabelConfig_Action", RelabelConfig_Action_name, RelabelConfig_Action_value)
 }
@@ -15,6 +15,7 @@ package config
 
 import (
 	"io/ioutil"
+	"path/filepath"
 
 	"github.com/golang/protobuf/proto"
 
@@ -27,6 +28,12 @@ func LoadFromString(configStr string) (Config, error) {
 	if err := proto.UnmarshalText(configStr, &configProto); err != nil {
 		return Config{}, err
 	}
+	return newConfig(configProto)
+}
+
+// newConfig fills in the defaults that depend on other fields of a parsed
+// configuration protocol buffer and validates it.
+func newConfig(configProto pb.PrometheusConfig) (Config, error) {
 	if configProto.Global == nil {
 		configProto.Global = &pb.GlobalConfig{}
 	}
@@ -35,6 +42,11 @@ func LoadFromString(configStr string) (Config, error) {
 			job.ScrapeInterval = proto.String(configProto.Global.GetScrapeInterval())
 		}
 	}
+	for _, group := range configProto.RuleGroup {
+		if group.EvaluationInterval == nil {
+			group.EvaluationInterval = proto.String(configProto.Global.GetEvaluationInterval())
+		}
+	}
 
 	config := Config{configProto}
 	err := config.Validate()
@@ -43,11 +55,18 @@ func LoadFromString(configStr string) (Config, error) {
 }
 
 // LoadFromFile returns a config parsed from the file of the provided name.
+// Files ending in ".yml" or ".yaml" are parsed as YAML, all others as protocol
+// buffer text format.
 func LoadFromFile(fileName string) (Config, error) {
 	configStr, err := ioutil.ReadFile(fileName)
 	if err != nil {
 		return Config{}, err
 	}
 
-	return LoadFromString(string(configStr))
+	switch filepath.Ext(fileName) {
+	case ".yml", ".yaml":
+		return LoadFromYAMLString(string(configStr))
+	default:
+		return LoadFromString(string(configStr))
+	}
 }
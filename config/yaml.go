@@ -0,0 +1,281 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/prometheus/prometheus/utility"
+
+	pb "github.com/prometheus/prometheus/config/generated"
+)
+
+// durationFields are the names of the string fields holding Prometheus
+// durations.
+var durationFields = map[string]bool{
+	"scrape_interval":     true,
+	"scrape_timeout":      true,
+	"scrape_offset":       true,
+	"evaluation_interval": true,
+	"sd_refresh_interval": true,
+	"retry_interval":      true,
+	"timeout":             true,
+	"retention":           true,
+}
+
+var (
+	labelPairsType  = reflect.TypeOf(pb.LabelPairs{})
+	unmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+)
+
+// A ParseError is an error encountered while parsing a YAML configuration at
+// the given position.
+type ParseError struct {
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Msg)
+}
+
+// ParseErrors is the error returned when parsing a YAML configuration fails,
+// listing all errors encountered.
+type ParseErrors []*ParseError
+
+func (errs ParseErrors) Error() string {
+	msgs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// LoadFromYAMLString returns a config parsed from the provided YAML string.
+// The fields are named as in the configuration protocol buffer, and label sets
+// are written as maps from label names to values. Unknown fields, values of
+// the wrong type, and invalid durations are rejected, and all of them are
+// returned as ParseErrors.
+func LoadFromYAMLString(configStr string) (Config, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal([]byte(configStr), &root); err != nil {
+		return Config{}, err
+	}
+
+	configProto := pb.PrometheusConfig{}
+	d := &yamlDecoder{}
+	// An empty document leaves the root node without content.
+	if len(root.Content) > 0 {
+		d.decodeMessage(root.Content[0], reflect.ValueOf(&configProto).Elem())
+	}
+	if len(d.errs) > 0 {
+		return Config{}, d.errs
+	}
+	return newConfig(configProto)
+}
+
+// yamlDecoder decodes YAML nodes into configuration protocol buffers,
+// collecting the errors found on the way.
+type yamlDecoder struct {
+	errs ParseErrors
+}
+
+func (d *yamlDecoder) errorf(n *yaml.Node, format string, args ...interface{}) {
+	d.errs = append(d.errs, &ParseError{
+		Line:   n.Line,
+		Column: n.Column,
+		Msg:    fmt.Sprintf(format, args...),
+	})
+}
+
+// decodeMessage decodes a mapping node into the protocol buffer message v.
+func (d *yamlDecoder) decodeMessage(n *yaml.Node, v reflect.Value) {
+	n = resolveAlias(n)
+	if n.Kind != yaml.MappingNode {
+		d.errorf(n, "expected a mapping for %s, got %s", v.Type().Name(), nodeKind(n))
+		return
+	}
+
+	fields := map[string]int{}
+	for i := 0; i < v.NumField(); i++ {
+		if name := protoFieldName(v.Type().Field(i)); name != "" {
+			fields[name] = i
+		}
+	}
+	seen := map[string]bool{}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, value := n.Content[i], n.Content[i+1]
+		idx, ok := fields[key.Value]
+		if !ok {
+			d.errorf(key, "unknown field %q in %s", key.Value, v.Type().Name())
+			continue
+		}
+		if seen[key.Value] {
+			d.errorf(key, "field %q already set in %s", key.Value, v.Type().Name())
+			continue
+		}
+		seen[key.Value] = true
+		d.decodeField(key.Value, value, v.Field(idx))
+	}
+}
+
+// decodeField decodes a node into the field of the given name of a protocol
+// buffer message.
+func (d *yamlDecoder) decodeField(name string, n *yaml.Node, f reflect.Value) {
+	n = resolveAlias(n)
+	t := f.Type()
+	switch {
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Ptr:
+		if n.Kind != yaml.SequenceNode {
+			d.errorf(n, "expected a sequence for field %q, got %s", name, nodeKind(n))
+			return
+		}
+		for _, item := range n.Content {
+			m := reflect.New(t.Elem().Elem())
+			d.decodeMessage(item, m.Elem())
+			f.Set(reflect.Append(f, m))
+		}
+	case t.Kind() == reflect.Slice:
+		if n.Kind != yaml.SequenceNode {
+			d.errorf(n, "expected a sequence for field %q, got %s", name, nodeKind(n))
+			return
+		}
+		for _, item := range n.Content {
+			s := reflect.New(t.Elem())
+			if d.decodeScalar(name, item, s) {
+				f.Set(reflect.Append(f, s.Elem()))
+			}
+		}
+	case t.Elem() == labelPairsType:
+		d.decodeLabels(n, f)
+	case t.Elem().Kind() == reflect.Struct:
+		m := reflect.New(t.Elem())
+		d.decodeMessage(n, m.Elem())
+		f.Set(m)
+	default:
+		s := reflect.New(t.Elem())
+		if d.decodeScalar(name, n, s) {
+			f.Set(s)
+		}
+	}
+}
+
+// decodeScalar decodes a scalar node into the value p points to, which is of a
+// scalar or enum type. It returns whether decoding succeeded.
+func (d *yamlDecoder) decodeScalar(name string, n *yaml.Node, p reflect.Value) bool {
+	n = resolveAlias(n)
+	if n.Kind != yaml.ScalarNode {
+		d.errorf(n, "expected a scalar for field %q, got %s", name, nodeKind(n))
+		return false
+	}
+	if n.Tag == "!!null" {
+		d.errorf(n, "missing value for field %q", name)
+		return false
+	}
+	if p.Type().Implements(unmarshalerType) {
+		// Enum values are given by their names.
+		quoted, _ := json.Marshal(strings.ToUpper(n.Value))
+		if err := p.Interface().(json.Unmarshaler).UnmarshalJSON(quoted); err != nil {
+			d.errorf(n, "invalid value %q for field %q", n.Value, name)
+			return false
+		}
+		return true
+	}
+	if p.Elem().Kind() == reflect.String {
+		// Any scalar is a valid string, e.g. a label value of 1.
+		if durationFields[name] {
+			if _, err := utility.StringToDuration(n.Value); err != nil {
+				d.errorf(n, "invalid duration %q for field %q: %s", n.Value, name, err)
+				return false
+			}
+		}
+		p.Elem().SetString(n.Value)
+		return true
+	}
+	if err := n.Decode(p.Interface()); err != nil {
+		d.errorf(n, "invalid value %q for field %q of type %s", n.Value, name, p.Elem().Type())
+		return false
+	}
+	return true
+}
+
+// decodeLabels decodes a mapping of label names to label values into the
+// LabelPairs field f.
+func (d *yamlDecoder) decodeLabels(n *yaml.Node, f reflect.Value) {
+	n = resolveAlias(n)
+	if n.Kind != yaml.MappingNode {
+		d.errorf(n, "expected a mapping of label names to values, got %s", nodeKind(n))
+		return
+	}
+	labels := &pb.LabelPairs{}
+	seen := map[string]bool{}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, value := n.Content[i], n.Content[i+1]
+		if seen[key.Value] {
+			d.errorf(key, "label %q already set", key.Value)
+			continue
+		}
+		seen[key.Value] = true
+		value = resolveAlias(value)
+		if value.Kind != yaml.ScalarNode {
+			d.errorf(value, "expected a scalar for the value of label %q, got %s", key.Value, nodeKind(value))
+			continue
+		}
+		labels.Label = append(labels.Label, &pb.LabelPair{
+			Name:  proto.String(key.Value),
+			Value: proto.String(value.Value),
+		})
+	}
+	f.Set(reflect.ValueOf(labels))
+}
+
+// protoFieldName returns the name of a protocol buffer message field as given
+// in its struct tag, or "" if the struct field is not a message field.
+func protoFieldName(f reflect.StructField) string {
+	for _, part := range strings.Split(f.Tag.Get("protobuf"), ",") {
+		if strings.HasPrefix(part, "name=") {
+			return strings.TrimPrefix(part, "name=")
+		}
+	}
+	return ""
+}
+
+// resolveAlias returns the node an alias node refers to, or the node itself if
+// it is no alias.
+func resolveAlias(n *yaml.Node) *yaml.Node {
+	for n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	return n
+}
+
+// nodeKind describes a node for use in error messages.
+func nodeKind(n *yaml.Node) string {
+	switch n.Kind {
+	case yaml.MappingNode:
+		return "a mapping"
+	case yaml.SequenceNode:
+		return "a sequence"
+	default:
+		return fmt.Sprintf("%q", n.Value)
+	}
+}
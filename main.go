@@ -16,6 +16,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io"
 	_ "net/http/pprof" // Comment this line to disable pprof endpoint.
 	"os"
 	"os/signal"
@@ -33,11 +34,18 @@ import (
 	"github.com/prometheus/prometheus/config"
 	"github.com/prometheus/prometheus/notification"
 	"github.com/prometheus/prometheus/retrieval"
+	"github.com/prometheus/prometheus/rules"
+	"github.com/prometheus/prometheus/rules/ast"
 	"github.com/prometheus/prometheus/rules/manager"
 	"github.com/prometheus/prometheus/storage"
 	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/local/index"
+	"github.com/prometheus/prometheus/storage/local/objectstore"
 	"github.com/prometheus/prometheus/storage/remote"
+	"github.com/prometheus/prometheus/storage/remote/generic"
+	"github.com/prometheus/prometheus/storage/remote/graphite"
 	"github.com/prometheus/prometheus/storage/remote/influxdb"
+	"github.com/prometheus/prometheus/storage/remote/kafka"
 	"github.com/prometheus/prometheus/storage/remote/opentsdb"
 	"github.com/prometheus/prometheus/web"
 	"github.com/prometheus/prometheus/web/api"
@@ -47,32 +55,103 @@ const deletionBatchSize = 100
 
 // Commandline flags.
 var (
-	configFile = flag.String("config.file", "prometheus.conf", "Prometheus configuration file name.")
+	configFile = flag.String("config.file", "prometheus.conf", "Prometheus configuration file name. The file is reloaded on SIGHUP or on a POST request to /-/reload.")
 
-	alertmanagerURL           = flag.String("alertmanager.url", "", "The URL of the alert manager to send notifications to.")
-	notificationQueueCapacity = flag.Int("alertmanager.notification-queue-capacity", 100, "The capacity of the queue for pending alert manager notifications.")
+	alertmanagerURL           = flag.String("alertmanager.url", "", "Comma-separated URLs of the alert managers to send notifications to. Every notification is sent to every alert manager.")
+	alertmanagerSDName        = flag.String("alertmanager.sd-name", "", "The DNS SRV record name to discover further alert managers by. None, if empty.")
+	alertmanagerSDRefresh     = flag.Duration("alertmanager.sd-refresh-interval", 30*time.Second, "The interval at which alert managers are discovered via -alertmanager.sd-name.")
+	notificationQueueCapacity = flag.Int("alertmanager.notification-queue-capacity", 100, "The capacity of the queue for pending notifications of each alert manager.")
+	notificationQueueDir      = flag.String("alertmanager.notification-queue-dir", "", "The directory to persist pending alert manager notifications in, so that they survive restarts. Notifications are kept in memory only if empty.")
+	notificationMaxBackoff    = flag.Duration("alertmanager.notification-max-retry-backoff", time.Minute, "The maximum time to wait between retries of sending notifications to an alert manager. Failed notifications are retried with exponential backoff until they are sent or dropped from a full queue.")
+
+	ruleEvaluationWorkers   = flag.Int("rules.evaluation-workers", 4, "The maximum number of rules evaluated concurrently. Rules of a group that select series recorded by preceding rules of the group are always evaluated after them.")
+	alertForOutageTolerance = flag.Duration("rules.alert.for-outage-tolerance", time.Hour, "How long Prometheus can have been down and still restore the time since which alerts have been active, so that the FOR duration of alerts that are still active after a restart is not restarted. 0 disables restoring alert state.")
 
 	persistenceStoragePath = flag.String("storage.local.path", "/tmp/metrics", "Base path for metrics storage.")
 
 	opentsdbURL          = flag.String("storage.remote.opentsdb-url", "", "The URL of the remote OpenTSDB server to send samples to. None, if empty.")
 	influxdbURL          = flag.String("storage.remote.influxdb-url", "", "The URL of the remote InfluxDB server to send samples to. None, if empty.")
+	genericURL           = flag.String("storage.remote.generic-url", "", "The URL of an HTTP endpoint to send samples to, as snappy-compressed protocol buffers of the generic remote storage protocol (see storage/remote/generic/generic.proto). None, if empty.")
+	genericReadURL       = flag.String("storage.remote.generic-read-url", "", "The URL of an HTTP endpoint to read series from for queries of the web API and consoles, using the generic remote storage protocol (see storage/remote/generic/generic.proto). Remote samples are merged into the query results where no local samples exist. None, if empty.")
+	kafkaBrokers         = flag.String("storage.remote.kafka-brokers", "", "Comma-separated addresses (host:port) of Kafka brokers to look up the partitions of the topic to publish samples to. Samples are published as JSON messages. None, if empty.")
+	kafkaTopic           = flag.String("storage.remote.kafka-topic", "prometheus", "The Kafka topic to publish samples to.")
+	graphiteAddress      = flag.String("storage.remote.graphite-address", "", "The address (host:port) of the Graphite carbon daemon to send samples to. None, if empty.")
+	graphiteProtocol     = flag.String("storage.remote.graphite-protocol", graphite.ProtocolPlaintext, "The protocol to send samples to Graphite with. Possible values: 'plaintext', 'pickle'.")
+	graphitePrefix       = flag.String("storage.remote.graphite-prefix", "", "The prefix to prepend to the Graphite metric paths.")
+	graphiteTemplate     = flag.String("storage.remote.graphite-template", "", "The template to build Graphite metric paths from the labels of a sample, in which '{label}' is replaced by the value of the label, e.g. '{job}.{instance}.{__name__}'. If empty, the metric name is followed by the names and values of all other labels, sorted by label name.")
 	remoteStorageTimeout = flag.Duration("storage.remote.timeout", 30*time.Second, "The timeout to use when sending samples to the remote storage.")
 
-	numMemoryChunks = flag.Int("storage.local.memory-chunks", 1024*1024, "How many chunks to keep in memory. While the size of a chunk is 1kiB, the total memory usage will be significantly higher than this value * 1kiB. Furthermore, for various reasons, more chunks might have to be kept in memory temporarily.")
-
-	persistenceRetentionPeriod = flag.Duration("storage.local.retention", 15*24*time.Hour, "How long to retain samples in the local storage.")
+	haPeerURL    = flag.String("storage.remote.ha-peer-url", "", "The URL of the /api/v1/read endpoint of the other Prometheus server of an HA pair scraping the same targets, e.g. 'http://peer:9090/api/v1/read'. Queries of the web API and consoles also read the peer's local series, deduplicated by their metrics, and its samples fill gaps in the local samples, e.g. while this server was restarting. Cannot be combined with -storage.remote.generic-read-url. None, if empty.")
+	haPeerMinGap = flag.Duration("storage.remote.ha-peer-min-gap", time.Minute, "Gaps between local samples at least that long are filled with samples of the HA peer. Should exceed the longest scrape interval.")
+
+	targetHeapSize  = flag.Uint64("storage.local.target-heap-size", 0, "The heap size in bytes the local storage aims for by evicting chunks from memory. Tracking the actual heap size accounts for the memory taken by chunk descriptors and label sets, which dominates with many series. Chunks are evicted at most once per garbage collection, so leave some headroom to the memory available. If set, -storage.local.memory-chunks and the memory chunks in the storage section of the configuration file are ignored. 0 disables heap-based eviction.")
+	numMemoryChunks = flag.Int("storage.local.memory-chunks", 1024*1024, "How many chunks to keep in memory. While the size of a chunk is 1kiB, the total memory usage will be significantly higher than this value * 1kiB. Furthermore, for various reasons, more chunks might have to be kept in memory temporarily. Overridden by the storage section of the configuration file, which can be reloaded with SIGHUP.")
+
+	persistenceRetentionPeriod = flag.Duration("storage.local.retention", 15*24*time.Hour, "How long to retain samples in the local storage. Overridden by the storage section of the configuration file, which can be reloaded with SIGHUP.")
+	persistenceRetentionSize   = flag.Int64("storage.local.retention.size", 0, "The maximum number of bytes the local storage may use on disk (not counting snapshots and orphaned files). If exceeded, the oldest samples are dropped, even if younger than the retention period. The size is checked once per minute, and space is only reclaimed during the regular maintenance sweeps, so leave some headroom. 0 disables size-based retention.")
+	downsampleAfter            = flag.Duration("storage.local.downsample-after", 0, "Persisted samples at least that old are rolled up into 5m and 1h buckets (min, max, sum, count), which are used to evaluate *_over_time functions over long ranges. Rolling up happens once per hour. 0 disables downsampling.")
+	chunkCacheSize             = flag.Int("storage.local.chunk-cache-size", 0, "The size in bytes of the LRU cache for chunks loaded from series files, shared across queries. 0 disables the cache.")
+	archivedFilterSize         = flag.Int("storage.local.archived-fingerprint-filter-size", 0, "The size in bytes of the bloom filter over archived fingerprints, which spares lookups in the archive indexes for series that are not archived. Allow at least 1 byte per archived series. 0 disables the filter.")
+	maintenanceIOBytes         = flag.Int("storage.local.maintenance-io.bytes-per-second", 0, "The maximum number of bytes per second read or written by checkpointing, by rewriting series files when dropping chunks, and by crash recovery, so that maintenance does not starve queries on a shared disk. 0 means no limit.")
+	maintenanceIOOps           = flag.Int("storage.local.maintenance-io.ops-per-second", 0, "The maximum number of I/O operations per second done by checkpointing, by rewriting series files when dropping chunks, and by crash recovery. 0 means no limit.")
+	outOfOrderTolerance        = flag.Duration("storage.local.out-of-order-tolerance", 0, "Samples at most that much older than the most recent sample of their series are merged into the series, as long as they fall into the chunk currently being filled. Other out-of-order samples are discarded. 0 discards all out-of-order samples.")
+	compactionInterval         = flag.Duration("storage.local.compaction-interval", 0, "The period at which series files are compacted by coalescing under-filled chunks, reclaiming disk space. Only chunks not currently referenced in memory are compacted. 0 disables compaction.")
+	chunkDescIdleTimeout       = flag.Duration("storage.local.chunk-desc-idle-timeout", 0, "If a series has not been queried for that long, the descriptors of its chunks evicted from memory are evicted, too, with the next maintenance of the series. They are loaded again from the series file once a query needs them. Saves a lot of memory with many rarely queried series that are not quite old enough to be archived. 0 disables it.")
 	maxChunksToPersist         = flag.Int("storage.local.max-chunks-to-persist", 1024*1024, "How many chunks can be waiting for persistence before sample ingestion will stop. Many chunks waiting to be persisted will increase the checkpoint size.")
 
-	checkpointInterval         = flag.Duration("storage.local.checkpoint-interval", 5*time.Minute, "The period at which the in-memory metrics and the chunks not yet persisted to series files are checkpointed.")
+	fingerprintToMetricCacheSize    = flag.Int("storage.local.index-cache-size.fingerprint-to-metric", index.DefaultCacheSizes.FingerprintToMetric, "The size in bytes for the fingerprint to metric index cache.")
+	fingerprintTimeRangeCacheSize   = flag.Int("storage.local.index-cache-size.fingerprint-to-timerange", index.DefaultCacheSizes.FingerprintTimeRange, "The size in bytes for the metric time range index cache.")
+	labelNameToLabelValuesCacheSize = flag.Int("storage.local.index-cache-size.label-name-to-label-values", index.DefaultCacheSizes.LabelNameToLabelValues, "The size in bytes for the label name to label values index cache.")
+	chunkEncodingVersion            = flag.Int("storage.local.chunk-encoding-version", int(local.DefaultChunkEncoding), "Which chunk encoding version to use for newly created chunks. Currently supported is 0 (delta encoding), 1 (double-delta encoding), and 2 (varbit encoding).")
+	mmapSeriesFiles                 = flag.Bool("storage.local.series-file-mmap", false, "If set, series files are memory-mapped to load chunks and chunk descriptors, instead of reading them with a seek and a read per batch of chunks. Ignored on platforms without memory-mapped files.")
+
+	maxSeriesPerMetricName = flag.Int("storage.local.series-quota.per-metric-name", 0, "If set, samples of new series are rejected while that many series with the same metric name are in memory. 0 disables the quota.")
+	maxSeriesPerJob        = flag.Int("storage.local.series-quota.per-job", 0, "If set, samples of new series are rejected while that many series with the same job label are in memory. 0 disables the quota.")
+
+	purgeUnqueriedAfter = flag.Duration("storage.local.purge-unqueried-after", 0, "If set, archived series that have not been queried for that long are purged, even if they are within the retention period. Query times are recorded with a resolution of one hour. Series archived before enabling this count as queried at the time of enabling. 0 disables it.")
+
+	encryptionKeyFile    = flag.String("storage.local.encryption-key-file", "", "If set, chunk data in series files, checkpoints, and the write-ahead log are encrypted with AES-GCM, using the hex-encoded 16, 24, or 32 byte key read from this file. Encryption can only be enabled for a new storage. The indexes are not encrypted.")
+	encryptionKeyCommand = flag.String("storage.local.encryption-key-command", "", "Like -storage.local.encryption-key-file, but the key is read from the standard output of this command (split into arguments at whitespace), e.g. a plugin fetching the key from a key management service.")
+
+	dataSync          = flag.Bool("storage.local.fdatasync", false, "If set, series files and checkpoints are synced with fdatasync instead of fsync (on Linux), which skips syncing file metadata like the modification time. When series files are synced is still determined by -storage.local.series-sync-strategy.")
+	pageCacheEviction = flag.Bool("storage.local.page-cache-eviction", false, "If set, series files and checkpoints are evicted from the page cache after they have been written, and series files after they have been scanned for downsampling, series file compaction, or consistency checks via /api/admin/check_series (with posix_fadvise on 64-bit Linux), so that persistence traffic does not displace the data queried most. Only pages already synced to disk can be evicted, so this is most effective with -storage.local.series-sync-strategy=always. To bypass the page cache altogether when appending to series files, use -storage.local.direct-io.")
+	directIO          = flag.Bool("storage.local.direct-io", false, "If set, chunks are appended to series files with O_DIRECT (on 64-bit Linux), bypassing the page cache. As chunks are not aligned to disk blocks, the last block of a series file is read back and rewritten with each append. Checkpoints, the WAL, and series files rewritten by maintenance still use the page cache. Start-up fails if the file system does not support O_DIRECT.")
+
+	coldTierS3Endpoint = flag.String("storage.local.cold-tier.s3-endpoint", "", "The endpoint of an S3-compatible object storage service to move old chunks to, e.g. 'https://s3.amazonaws.com' or 'https://storage.googleapis.com' (with HMAC keys). The credentials are read from the environment variables AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY. Chunks moved there are deleted locally and fetched on demand by queries. They are deleted once they leave the retention period. No cold tier, if empty.")
+	coldTierS3Bucket   = flag.String("storage.local.cold-tier.s3-bucket", "", "The bucket of the object storage service to move old chunks to.")
+	coldTierS3Region   = flag.String("storage.local.cold-tier.s3-region", "us-east-1", "The region of the bucket to move old chunks to, used for signing requests.")
+	coldTierDirectory  = flag.String("storage.local.cold-tier.directory", "", "Like -storage.local.cold-tier.s3-endpoint, but old chunks are moved to this directory, e.g. on a network file system.")
+	coldTierAfter      = flag.Duration("storage.local.cold-tier.after", 7*24*time.Hour, "Persisted chunks ending that long ago are moved to the cold tier. The most recent chunk of each series always stays local. Chunks in the cold tier are not rolled up anymore, so -storage.local.downsample-after should be shorter. Snapshots do not include the cold tier.")
+	coldTierTimeout    = flag.Duration("storage.local.cold-tier.timeout", time.Minute, "The timeout for requests to the object storage service of the cold tier.")
+	coldCacheSize      = flag.Int("storage.local.cold-tier.cache-size", 64*1024*1024, "The size in bytes of the LRU cache for chunks fetched from the cold tier, shared across queries. Chunks in use by queries are kept even if that exceeds the size.")
+
+	replicationJournalLength = flag.Int("storage.local.replication.journal-length", 0, "If not 0, persisted chunks and index updates are served to replication standbys at /replication, and that many series changes are kept for standbys to catch up with. A standby further behind, or restarted, catches up by syncing all series. 0 disables serving replication.")
+	replicateFrom            = flag.String("storage.local.replication.primary-url", "", "If set, the local storage is a standby of the primary Prometheus serving replication at this URL, e.g. 'http://primary:9090/replication'. A standby discards scraped and backfilled samples, syncs the persisted chunks of the primary, and serves them to queries. Chunks not yet persisted on the primary are not replicated. To take over, restart the standby without this flag. Requires the same -storage.local.encryption-key-file as the primary, if any.")
+	replicationInterval      = flag.Duration("storage.local.replication.interval", 10*time.Second, "How often a standby syncs the series changed on its primary.")
+
+	indexCompactionInterval = flag.Duration("storage.local.index-compaction.interval", 0, "The period at which the archive and label indexes are compacted, reclaiming the space of deleted entries, e.g. after heavy series churn. 0 disables periodic index compaction.")
+	indexCompactionWindow   = flag.String("storage.local.index-compaction.window", "", "The daily time window (UTC) in which index compaction runs, e.g. '02:00-05:00'. Compaction that is due waits for the window, and while the storage is rushed to persist chunks. Any time of day, if empty.")
+
+	labelIndexSnapshotInterval = flag.Duration("storage.local.label-index-snapshot-interval", 0, "The period at which a snapshot of the metrics of all series is written for rebuilding the label indexes after a crash. Crash recovery then resets the label indexes to the snapshot and only indexes what has changed since, instead of re-indexing all metrics. 0 disables snapshots.")
+
+	minCheckpointInterval      = flag.Duration("storage.local.checkpoint-interval.min", time.Minute, "The minimum period at which the in-memory metrics and the chunks not yet persisted to series files are checkpointed. The actual period adapts to the rate at which series become dirty (see -storage.local.checkpoint-dirty-series-limit), between this minimum and the maximum.")
+	maxCheckpointInterval      = flag.Duration("storage.local.checkpoint-interval.max", 15*time.Minute, "The maximum period at which the in-memory metrics and the chunks not yet persisted to series files are checkpointed. Checkpoints happen this rarely if only few series become dirty, or if the storage is in graceful degradation mode.")
 	checkpointDirtySeriesLimit = flag.Int("storage.local.checkpoint-dirty-series-limit", 5000, "If approx. that many time series are in a state that would require a recovery operation after a crash, a checkpoint is triggered, even if the checkpoint interval hasn't passed yet. A recovery operation requires a disk seek. The default limit intends to keep the recovery time below 1min even on spinning disks. With SSD, recovery is much faster, so you might want to increase this value in that case to avoid overly frequent checkpoints.")
+	checkpointCompression      = flag.String("storage.local.checkpoint-compression", "none", "How to compress the series in the checkpoint file, which reduces the time to write and load it if disk I/O is the bottleneck. Possible values: 'none', 'snappy', 'gzip'. Changes the checkpoint format, which older versions cannot read. If the storage is encrypted, the series are compressed before they are encrypted.")
 	seriesSyncStrategy         = flag.String("storage.local.series-sync-strategy", "adaptive", "When to sync series files after modification. Possible values: 'never', 'always', 'adaptive'. Sync'ing slows down storage performance but reduces the risk of data loss in case of an OS crash. With the 'adaptive' strategy, series files are sync'd for as long as the storage is not too much behind on chunk persistence.")
+	walFlushInterval           = flag.Duration("storage.local.wal-flush-interval", time.Second, "The period at which samples logged to the write-ahead log are flushed to disk (and sync'd according to the series sync strategy). Samples ingested since the last checkpoint are recovered from the write-ahead log after a crash, and crash recovery only needs to check series changed since the last checkpoint. A value of 0 disables the write-ahead log.")
 
+	lockDebugThreshold    = flag.Duration("storage.local.debug.lock-threshold", 0, "If set, the local storage logs goroutines locking time series in an order that risks a deadlock, and time series locks held or waited for longer than this duration, with stack traces. Slows down the storage considerably, only meant for debugging stalls. 0 disables it.")
 	storageDirty          = flag.Bool("storage.local.dirty", false, "If set, the local storage layer will perform crash recovery even if the last shutdown appears to be clean.")
 	storagePedanticChecks = flag.Bool("storage.local.pedantic-checks", false, "If set, a crash recovery will perform checks on each series file. This might take a very long time.")
+	storageVerifyAndExit  = flag.Bool("storage.local.verify-and-exit", false, "If set, verify the consistency of the local storage without modifying it, print a report, and exit. The exit code is 0 if no problems were found, 1 otherwise. Prometheus must not be running on the same storage at the same time.")
 
 	pathPrefix = flag.String("web.path-prefix", "/", "Prefix for all web paths.")
 
+	shutdownDrainTimeout = flag.Duration("shutdown.drain-timeout", time.Minute, "How long to wait on shutdown for scrapes and rule evaluations in progress to finish and their samples to be appended. Samples appended later are dropped. Afterwards, the local storage is checkpointed and closed cleanly, so that no crash recovery is needed on the next start. 0 waits indefinitely.")
+
 	printVersion = flag.Bool("version", false, "Print version information.")
+	checkConfig  = flag.Bool("check-config", false, "If set, check the configuration file and the rule files it refers to, print all errors found with their positions, and exit. The exit code is 0 if no errors were found, 1 otherwise.")
 )
 
 type prometheus struct {
@@ -81,9 +160,16 @@ type prometheus struct {
 	notificationHandler *notification.NotificationHandler
 	storage             local.Storage
 	remoteStorageQueues []*remote.StorageQueueManager
+	// All samples from scrapes and rule evaluations pass the gate, which
+	// is closed on shutdown before the storage is stopped.
+	sampleGate *storage.Gate
 
 	webService *web.WebService
 
+	// The configuration currently applied, restored if applying a
+	// reloaded configuration fails halfway.
+	conf config.Config
+
 	closeOnce sync.Once
 }
 
@@ -96,7 +182,14 @@ func NewPrometheus() *prometheus {
 		os.Exit(2)
 	}
 
-	notificationHandler := notification.NewNotificationHandler(*alertmanagerURL, *notificationQueueCapacity)
+	notificationHandler := notification.NewNotificationHandler(&notification.NotificationHandlerOptions{
+		AlertmanagerURLs:  strings.Split(*alertmanagerURL, ","),
+		SDName:            *alertmanagerSDName,
+		SDRefreshInterval: *alertmanagerSDRefresh,
+		QueueCapacity:     *notificationQueueCapacity,
+		QueueDir:          *notificationQueueDir,
+		MaxRetryBackoff:   *notificationMaxBackoff,
+	})
 
 	var syncStrategy local.SyncStrategy
 	switch *seriesSyncStrategy {
@@ -111,26 +204,124 @@ func NewPrometheus() *prometheus {
 		os.Exit(2)
 	}
 
+	var compression local.Compression
+	switch *checkpointCompression {
+	case "none":
+		compression = local.NoCompression
+	case "snappy":
+		compression = local.Snappy
+	case "gzip":
+		compression = local.Gzip
+	default:
+		glog.Errorf("Invalid flag value for 'storage.local.checkpoint-compression': %s\n", *checkpointCompression)
+		os.Exit(2)
+	}
+
+	// Serve the progress of a possible crash recovery while the storage
+	// is loading.
+	recoveryProgress := local.NewRecoveryProgress()
+	registry.MustRegister(recoveryProgress)
+	startupServer, err := web.ServeStartupStatus(*pathPrefix, recoveryProgress)
+	if err != nil {
+		glog.Error("Error serving startup status: ", err)
+		os.Exit(1)
+	}
+
+	retention, memoryChunks := storageLimits(conf)
 	o := &local.MemorySeriesStorageOptions{
-		MemoryChunks:               *numMemoryChunks,
+		MemoryChunks:               memoryChunks,
+		TargetHeapSize:             *targetHeapSize,
+		ChunkDescIdleTimeout:       *chunkDescIdleTimeout,
+		LockDebugThreshold:         *lockDebugThreshold,
 		MaxChunksToPersist:         *maxChunksToPersist,
+		ChunkEncoding:              local.ChunkEncoding(*chunkEncodingVersion),
 		PersistenceStoragePath:     *persistenceStoragePath,
-		PersistenceRetentionPeriod: *persistenceRetentionPeriod,
-		CheckpointInterval:         *checkpointInterval,
+		PersistenceRetentionPeriod: retention,
+		PersistenceRetentionSize:   *persistenceRetentionSize,
+		MinCheckpointInterval:      *minCheckpointInterval,
+		MaxCheckpointInterval:      *maxCheckpointInterval,
 		CheckpointDirtySeriesLimit: *checkpointDirtySeriesLimit,
-		Dirty:          *storageDirty,
-		PedanticChecks: *storagePedanticChecks,
-		SyncStrategy:   syncStrategy,
+		CheckpointCompression:      compression,
+		DataSync:                   *dataSync,
+		EvictFromPageCache:         *pageCacheEviction,
+		DirectIO:                   *directIO,
+		Dirty:                      *storageDirty,
+		PedanticChecks:             *storagePedanticChecks,
+		SyncStrategy:               syncStrategy,
+		WALFlushInterval:           *walFlushInterval,
+		RecoveryProgress:           recoveryProgress,
+		DownsampleAfter:            *downsampleAfter,
+		CompactionInterval:         *compactionInterval,
+		ChunkCacheSize:             *chunkCacheSize,
+		MmapSeriesFiles:            *mmapSeriesFiles,
+		ArchivedFilterSize:         *archivedFilterSize,
+		MaintenanceIOBytes:         *maintenanceIOBytes,
+		MaintenanceIOOps:           *maintenanceIOOps,
+		OutOfOrderTolerance:        *outOfOrderTolerance,
+		PurgeUnqueriedAfter:        *purgeUnqueriedAfter,
+		IndexCacheSizes: index.CacheSizes{
+			FingerprintToMetric:    *fingerprintToMetricCacheSize,
+			FingerprintTimeRange:   *fingerprintTimeRangeCacheSize,
+			LabelNameToLabelValues: *labelNameToLabelValuesCacheSize,
+		},
+	}
+	if *maxSeriesPerMetricName > 0 {
+		o.SeriesQuotas = append(o.SeriesQuotas, local.SeriesQuota{LabelName: clientmodel.MetricNameLabel, MaxSeries: *maxSeriesPerMetricName})
+	}
+	if *maxSeriesPerJob > 0 {
+		o.SeriesQuotas = append(o.SeriesQuotas, local.SeriesQuota{LabelName: clientmodel.JobLabel, MaxSeries: *maxSeriesPerJob})
+	}
+	switch {
+	case *encryptionKeyFile != "" && *encryptionKeyCommand != "":
+		glog.Error("Only one of -storage.local.encryption-key-file and -storage.local.encryption-key-command may be set.")
+		os.Exit(2)
+	case *encryptionKeyFile != "":
+		o.EncryptionKey = local.KeyFile(*encryptionKeyFile)
+	case *encryptionKeyCommand != "":
+		o.EncryptionKey = local.KeyCommand(strings.Fields(*encryptionKeyCommand))
+	}
+	switch {
+	case *coldTierS3Endpoint != "" && *coldTierDirectory != "":
+		glog.Error("Only one of -storage.local.cold-tier.s3-endpoint and -storage.local.cold-tier.directory may be set.")
+		os.Exit(2)
+	case *coldTierS3Endpoint != "":
+		s3, err := objectstore.NewS3(
+			*coldTierS3Endpoint, *coldTierS3Bucket, *coldTierS3Region,
+			os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			*coldTierTimeout,
+		)
+		if err != nil {
+			glog.Error("Error setting up the cold tier: ", err)
+			os.Exit(2)
+		}
+		o.ColdTier = s3
+	case *coldTierDirectory != "":
+		o.ColdTier = objectstore.Dir(*coldTierDirectory)
+	}
+	o.ColdTierAfter = *coldTierAfter
+	o.ColdCacheSize = *coldCacheSize
+	o.ReplicationJournalLength = *replicationJournalLength
+	o.ReplicateFrom = *replicateFrom
+	o.ReplicationInterval = *replicationInterval
+	o.IndexCompactionInterval = *indexCompactionInterval
+	o.LabelIndexSnapshotInterval = *labelIndexSnapshotInterval
+	if o.IndexCompactionWindow, err = local.ParseDailyWindow(*indexCompactionWindow); err != nil {
+		glog.Error("Invalid -storage.local.index-compaction.window: ", err)
+		os.Exit(2)
 	}
 	memStorage, err := local.NewMemorySeriesStorage(o)
 	if err != nil {
 		glog.Error("Error opening memory series storage: ", err)
 		os.Exit(1)
 	}
+	if err := startupServer.Close(); err != nil {
+		glog.Error("Error stopping to serve startup status: ", err)
+		os.Exit(1)
+	}
 
 	var sampleAppender storage.SampleAppender
 	var remoteStorageQueues []*remote.StorageQueueManager
-	if *opentsdbURL == "" && *influxdbURL == "" {
+	if *opentsdbURL == "" && *influxdbURL == "" && *genericURL == "" && *kafkaBrokers == "" && *graphiteAddress == "" {
 		glog.Warningf("No remote storage URLs provided; not sending any samples to long-term storage")
 		sampleAppender = memStorage
 	} else {
@@ -138,6 +329,7 @@ func NewPrometheus() *prometheus {
 
 		addRemoteStorage := func(c remote.StorageClient) {
 			qm := remote.NewStorageQueueManager(c, 100*1024)
+			qm.SetRelabelConfigs(conf.RemoteWriteRelabelConfigs(c.Name()))
 			fanout = append(fanout, qm)
 			remoteStorageQueues = append(remoteStorageQueues, qm)
 		}
@@ -148,17 +340,52 @@ func NewPrometheus() *prometheus {
 		if *influxdbURL != "" {
 			addRemoteStorage(influxdb.NewClient(*influxdbURL, *remoteStorageTimeout))
 		}
+		if *genericURL != "" {
+			addRemoteStorage(generic.NewClient(*genericURL, *remoteStorageTimeout))
+		}
+		if *kafkaBrokers != "" {
+			addRemoteStorage(kafka.NewClient(strings.Split(*kafkaBrokers, ","), *kafkaTopic, *remoteStorageTimeout))
+		}
+		if *graphiteAddress != "" {
+			c, err := graphite.NewClient(*graphiteAddress, *graphiteProtocol, *graphitePrefix, *graphiteTemplate, *remoteStorageTimeout)
+			if err != nil {
+				glog.Errorf("Invalid Graphite remote storage flags: %s", err)
+				os.Exit(2)
+			}
+			addRemoteStorage(c)
+		}
 
 		sampleAppender = fanout
 	}
 
+	// Queries of the web API and consoles may also read from the remote
+	// storage, while rules are only evaluated against the local storage.
+	var queryStorage local.Storage = memStorage
+	switch {
+	case *genericReadURL != "" && *haPeerURL != "":
+		glog.Error("Only one of -storage.remote.generic-read-url and -storage.remote.ha-peer-url may be set.")
+		os.Exit(2)
+	case *genericReadURL != "":
+		mergingStorage := remote.NewMergingStorage(memStorage, generic.NewClient(*genericReadURL, *remoteStorageTimeout))
+		registry.MustRegister(mergingStorage)
+		queryStorage = mergingStorage
+	case *haPeerURL != "":
+		mergingStorage := remote.NewPeerMergingStorage(memStorage, generic.NewClient(*haPeerURL, *remoteStorageTimeout), *haPeerMinGap)
+		registry.MustRegister(mergingStorage)
+		queryStorage = mergingStorage
+	}
+
+	sampleGate := storage.NewGate(sampleAppender)
+	sampleAppender = sampleGate
+
 	targetManager := retrieval.NewTargetManager(sampleAppender, conf.GlobalLabels())
 	targetManager.AddTargetsFromConfig(conf)
 
 	ruleManager := manager.NewRuleManager(&manager.RuleManagerOptions{
 		SampleAppender:      sampleAppender,
 		NotificationHandler: notificationHandler,
-		EvaluationInterval:  conf.EvaluationInterval(),
+		ForOutageTolerance:  *alertForOutageTolerance,
+		EvaluationWorkers:   *ruleEvaluationWorkers,
 		Storage:             memStorage,
 		PrometheusURL:       web.MustBuildServerURL(*pathPrefix),
 		PathPrefix:          *pathPrefix,
@@ -180,6 +407,8 @@ func NewPrometheus() *prometheus {
 		Flags:       flags,
 		Birth:       time.Now(),
 		PathPrefix:  *pathPrefix,
+
+		RecoveryProgress: recoveryProgress,
 	}
 
 	alertsHandler := &web.AlertsHandler{
@@ -188,7 +417,7 @@ func NewPrometheus() *prometheus {
 	}
 
 	consolesHandler := &web.ConsolesHandler{
-		Storage:    memStorage,
+		Storage:    queryStorage,
 		PathPrefix: *pathPrefix,
 	}
 
@@ -196,17 +425,29 @@ func NewPrometheus() *prometheus {
 		PathPrefix: *pathPrefix,
 	}
 
+	// Federation only serves local samples.
+	federationHandler := &web.FederationHandler{
+		Storage:        memStorage,
+		StalenessDelta: ast.StalenessDelta(),
+	}
+
 	metricsService := &api.MetricsService{
-		Now:     clientmodel.Now,
-		Storage: memStorage,
+		Now:           clientmodel.Now,
+		Storage:       queryStorage,
+		TargetManager: targetManager,
 	}
 
 	webService := &web.WebService{
-		StatusHandler:   prometheusStatus,
-		MetricsHandler:  metricsService,
-		ConsolesHandler: consolesHandler,
-		AlertsHandler:   alertsHandler,
-		GraphsHandler:   graphsHandler,
+		StatusHandler:     prometheusStatus,
+		MetricsHandler:    metricsService,
+		ConsolesHandler:   consolesHandler,
+		AlertsHandler:     alertsHandler,
+		GraphsHandler:     graphsHandler,
+		FederationHandler: federationHandler,
+		LifecycleHandler:  &web.LifecycleHandler{Storage: memStorage},
+		StorageHandler:    &web.StorageStatusHandler{Storage: memStorage, PathPrefix: *pathPrefix},
+		ReplicaHandler:    local.NewReplicationHandler(memStorage),
+		ReadHandler:       generic.NewReadHandler(memStorage),
 	}
 
 	p := &prometheus{
@@ -215,10 +456,14 @@ func NewPrometheus() *prometheus {
 		notificationHandler: notificationHandler,
 		storage:             memStorage,
 		remoteStorageQueues: remoteStorageQueues,
+		sampleGate:          sampleGate,
 
 		webService: webService,
+
+		conf: conf,
 	}
 	webService.QuitChan = make(chan struct{})
+	webService.ReloadChan = make(chan chan error)
 	return p
 }
 
@@ -241,6 +486,27 @@ func (p *prometheus) Serve() {
 		}
 	}()
 
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for {
+			select {
+			case <-hup:
+				glog.Info("Received SIGHUP, reloading the configuration file...")
+				if err := p.reloadConfig(); err != nil {
+					glog.Errorf("Couldn't reload configuration (-config.file=%s): %v", *configFile, err)
+				}
+			case errc := <-p.webService.ReloadChan:
+				glog.Info("Received reload request via web service, reloading the configuration file...")
+				err := p.reloadConfig()
+				if err != nil {
+					glog.Errorf("Couldn't reload configuration (-config.file=%s): %v", *configFile, err)
+				}
+				errc <- err
+			}
+		}
+	}()
+
 	notifier := make(chan os.Signal)
 	signal.Notify(notifier, os.Interrupt, syscall.SIGTERM)
 	select {
@@ -250,8 +516,15 @@ func (p *prometheus) Serve() {
 		glog.Warning("Received termination request via web service, exiting gracefully...")
 	}
 
-	p.targetManager.Stop()
-	p.ruleManager.Stop()
+	p.webService.LifecycleHandler.ShutdownStarted()
+	signal.Stop(hup)
+	go func() {
+		for range notifier {
+			glog.Warning("Shutdown in progress, waiting for the local storage to be checkpointed. Killing the process now requires crash recovery on the next start.")
+		}
+	}()
+
+	p.drain(*shutdownDrainTimeout)
 
 	if err := p.storage.Stop(); err != nil {
 		glog.Error("Error stopping local storage: ", err)
@@ -262,9 +535,135 @@ func (p *prometheus) Serve() {
 	}
 
 	p.notificationHandler.Stop()
+	if dropped := p.sampleGate.Dropped(); dropped > 0 {
+		glog.Warningf("Dropped %d samples appended after draining.", dropped)
+	}
 	glog.Info("See you next time!")
 }
 
+// drain stops scraping and rule evaluation, waiting up to the given timeout (or
+// indefinitely if 0) for scrapes and evaluations in progress to finish, and
+// then closes the sample gate, so that the storage can be stopped safely.
+func (p *prometheus) drain(timeout time.Duration) {
+	glog.Info("Draining scrapes and rule evaluations...")
+	drained := make(chan struct{})
+	go func() {
+		p.targetManager.Stop()
+		p.ruleManager.Stop()
+		close(drained)
+	}()
+
+	var timedOut <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timedOut = timer.C
+	}
+	select {
+	case <-drained:
+		glog.Info("Scrapes and rule evaluations drained.")
+	case <-timedOut:
+		glog.Warningf("Scrapes and rule evaluations not drained after %s, dropping their samples.", timeout)
+	}
+
+	p.sampleGate.Close()
+}
+
+// storageLimits returns the retention period and the number of chunks to keep
+// in memory for the local storage, as set in the storage section of the
+// configuration or, if not set there, by the flags.
+func storageLimits(conf config.Config) (time.Duration, int) {
+	retention, ok := conf.StorageRetention()
+	if !ok {
+		retention = *persistenceRetentionPeriod
+	}
+	memoryChunks, ok := conf.StorageMemoryChunks()
+	if !ok {
+		memoryChunks = *numMemoryChunks
+	}
+	return retention, memoryChunks
+}
+
+// checkConfigFiles loads the configuration file and the rule files it refers
+// to, and prints the errors found to out, prefixed with the file name and, if
+// known, the position. It returns whether no errors were found.
+func checkConfigFiles(fileName string, out io.Writer) bool {
+	conf, err := config.LoadFromFile(fileName)
+	if err != nil {
+		if errs, ok := err.(config.ParseErrors); ok {
+			for _, e := range errs {
+				fmt.Fprintf(out, "%s:%d:%d: %s\n", fileName, e.Line, e.Column, e.Msg)
+			}
+		} else {
+			fmt.Fprintf(out, "%s: %s\n", fileName, err)
+		}
+		return false
+	}
+
+	ok := true
+	checked := map[string]bool{}
+	for _, rg := range conf.RuleGroups() {
+		for _, ruleFile := range rg.Files {
+			if checked[ruleFile] {
+				continue
+			}
+			checked[ruleFile] = true
+
+			_, err := rules.LoadRulesFromFile(ruleFile)
+			if err == nil {
+				continue
+			}
+			ok = false
+			if errs, isParseErrors := err.(rules.ParseErrors); isParseErrors {
+				for _, e := range errs {
+					fmt.Fprintf(out, "%s:%d:%d: %s\n", ruleFile, e.Line, e.Column, e.Msg)
+				}
+			} else {
+				fmt.Fprintf(out, "%s: %s\n", ruleFile, err)
+			}
+		}
+	}
+	if ok {
+		fmt.Fprintf(out, "%s: %d jobs and %d rule files OK\n", fileName, len(conf.Job), len(checked))
+	}
+	return ok
+}
+
+// reloadConfig reloads the configuration file and applies it to the running
+// server: the jobs to scrape, the rule files, the storage settings, and the
+// write relabel configurations of the remote storage queues. The alert manager
+// settings are given by flags and not reloaded. An invalid configuration is
+// rejected as a whole, and jobs and alerts that did not change keep running
+// undisturbed.
+func (p *prometheus) reloadConfig() error {
+	conf, err := config.LoadFromFile(*configFile)
+	if err != nil {
+		return err
+	}
+	// Loading rule files is the most likely step to fail, and nothing is
+	// changed if it does.
+	if err := p.ruleManager.ApplyConfig(conf); err != nil {
+		return fmt.Errorf("error loading rule files: %s", err)
+	}
+	if err := p.targetManager.ApplyConfig(conf); err != nil {
+		if rerr := p.ruleManager.ApplyConfig(p.conf); rerr != nil {
+			glog.Errorf("Error restoring the rules of the previous configuration: %s", rerr)
+		}
+		return err
+	}
+	p.conf = conf
+
+	retention, memoryChunks := storageLimits(conf)
+	p.storage.SetRetention(retention)
+	p.storage.SetMemoryChunks(memoryChunks)
+	for _, q := range p.remoteStorageQueues {
+		q.SetRelabelConfigs(conf.RemoteWriteRelabelConfigs(q.Name()))
+	}
+	p.webService.StatusHandler.ApplyConfig(conf.String(), p.targetManager.Pools())
+	glog.Info("Configuration reloaded.")
+	return nil
+}
+
 // Describe implements registry.Collector.
 func (p *prometheus) Describe(ch chan<- *registry.Desc) {
 	p.notificationHandler.Describe(ch)
@@ -363,6 +762,26 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *checkConfig {
+		if !checkConfigFiles(*configFile, os.Stdout) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if *storageVerifyAndExit {
+		report, err := local.Verify(*persistenceStoragePath)
+		if err != nil {
+			glog.Error("Error verifying local storage: ", err)
+			os.Exit(2)
+		}
+		fmt.Print(report)
+		if !report.OK() {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	p := NewPrometheus()
 	registry.MustRegister(p)
 	p.Serve()
@@ -17,10 +17,16 @@ import (
 	"bytes"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
@@ -40,13 +46,20 @@ const (
 const (
 	namespace = "prometheus"
 	subsystem = "notifications"
+
+	alertmanagerLabel = "alertmanager"
 )
 
 var (
 	deadline = flag.Duration("alertmanager.http-deadline", 10*time.Second, "Alert manager HTTP API timeout.")
+
+	// retryBackoff is the time to wait before the first retry of sending
+	// notifications. It doubles with every further retry up to the maximum
+	// retry backoff of the NotificationHandler.
+	retryBackoff = time.Second
 )
 
-// NotificationReq is a request for sending a notification to the alert manager
+// NotificationReq is a request for sending a notification to the alert managers
 // for a single alert vector element.
 type NotificationReq struct {
 	// Short-form alert summary. May contain text/template-style interpolations.
@@ -55,6 +68,9 @@ type NotificationReq struct {
 	Description string
 	// Labels associated with this alert notification, including alert name.
 	Labels clientmodel.LabelSet
+	// Further information about the alert, like links to runbooks, with
+	// template interpolations already rendered.
+	Annotations clientmodel.LabelSet
 	// Current value of alert
 	Value clientmodel.SampleValue
 	// Since when this alert has been active (pending or firing).
@@ -74,75 +90,179 @@ type httpPoster interface {
 	Post(url string, bodyType string, body io.Reader) (*http.Response, error)
 }
 
-// NotificationHandler is responsible for dispatching alert notifications to an
-// alert manager service.
+// An alertmanager is a single alert manager notifications are sent to. It has
+// its own queue, so that an unavailable alert manager does not delay
+// notifications to the others.
+type alertmanager struct {
+	url   string
+	queue *notificationQueue
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// newAlertmanager returns an alertmanager with a queue of the given capacity.
+// If queueDir is not empty, the queue is persisted to a file in it.
+func newAlertmanager(u string, queueCapacity int, queueDir string) *alertmanager {
+	filename := ""
+	if queueDir != "" {
+		filename = filepath.Join(queueDir, url.QueryEscape(u)+".json")
+	}
+	return &alertmanager{
+		url:   u,
+		queue: newNotificationQueue(queueCapacity, filename),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// shutdown stops sending notifications to the alert manager. The sender
+// finishes asynchronously, closing am.done. If discard is true, pending
+// notifications are deleted from disk. Otherwise, they are sent once the
+// alert manager is notified again, possibly after a restart.
+func (am *alertmanager) shutdown(discard bool) {
+	close(am.stop)
+	if discard {
+		am.queue.discard()
+	} else {
+		am.queue.close()
+	}
+}
+
+// NotificationHandler is responsible for dispatching alert notifications to
+// alert manager services. Every notification is sent to every alert manager.
 type NotificationHandler struct {
-	// The URL of the alert manager to send notifications to.
-	alertmanagerURL string
-	// Buffer of notifications that have not yet been sent.
-	pendingNotifications chan NotificationReqs
+	// The URLs of the statically configured alert managers.
+	alertmanagerURLs []string
+	// The DNS SRV record name to discover further alert managers by.
+	sdName            string
+	sdRefreshInterval time.Duration
+	// The capacity of the queue of each alert manager.
+	queueCapacity int
+	// The directory to persist the queues in. Queues are kept in memory
+	// only if empty.
+	queueDir string
+	// The maximum time to wait between retries of sending notifications.
+	maxRetryBackoff time.Duration
 	// HTTP client with custom timeout settings.
 	httpClient httpPoster
 
-	notificationLatency        prometheus.Summary
-	notificationErrors         prometheus.Counter
-	notificationDropped        prometheus.Counter
-	notificationsQueueLength   prometheus.Gauge
+	// Protects alertmanagers.
+	mtx sync.RWMutex
+	// The alert managers currently notified, by URL.
+	alertmanagers map[string]*alertmanager
+
+	notificationLatency        *prometheus.SummaryVec
+	notificationErrors         *prometheus.CounterVec
+	notificationDropped        *prometheus.CounterVec
+	notificationsQueueLength   *prometheus.GaugeVec
 	notificationsQueueCapacity prometheus.Metric
 
+	stop    chan struct{}
 	stopped chan struct{}
 }
 
+// NotificationHandlerOptions bundles options for the NotificationHandler.
+type NotificationHandlerOptions struct {
+	// The URLs of the alert managers to send notifications to.
+	AlertmanagerURLs []string
+	// If set, alert managers are additionally discovered by looking up this
+	// DNS SRV record name every SDRefreshInterval.
+	SDName            string
+	SDRefreshInterval time.Duration
+	// The capacity of the notification queue of each alert manager. If a
+	// queue is full, its oldest notifications are dropped.
+	QueueCapacity int
+	// If set, the notification queues are persisted in this directory, so
+	// that pending notifications survive restarts.
+	QueueDir string
+	// Notifications are retried until they are sent, waiting exponentially
+	// longer between retries, but never longer than MaxRetryBackoff.
+	MaxRetryBackoff time.Duration
+}
+
 // NewNotificationHandler constructs a new NotificationHandler.
-func NewNotificationHandler(alertmanagerURL string, notificationQueueCapacity int) *NotificationHandler {
+func NewNotificationHandler(o *NotificationHandlerOptions) *NotificationHandler {
+	if o.QueueDir != "" {
+		if err := os.MkdirAll(o.QueueDir, 0777); err != nil {
+			glog.Errorf("Error creating notification queue directory %s: %s", o.QueueDir, err)
+		}
+	}
+	urls := make([]string, 0, len(o.AlertmanagerURLs))
+	alertmanagers := map[string]*alertmanager{}
+	for _, u := range o.AlertmanagerURLs {
+		if u = strings.TrimRight(u, "/"); u != "" {
+			urls = append(urls, u)
+			alertmanagers[u] = newAlertmanager(u, o.QueueCapacity, o.QueueDir)
+		}
+	}
 	return &NotificationHandler{
-		alertmanagerURL:      strings.TrimRight(alertmanagerURL, "/"),
-		pendingNotifications: make(chan NotificationReqs, notificationQueueCapacity),
+		alertmanagerURLs:  urls,
+		sdName:            o.SDName,
+		sdRefreshInterval: o.SDRefreshInterval,
+		queueCapacity:     o.QueueCapacity,
+		queueDir:          o.QueueDir,
+		maxRetryBackoff:   o.MaxRetryBackoff,
 
 		httpClient: utility.NewDeadlineClient(*deadline),
 
-		notificationLatency: prometheus.NewSummary(prometheus.SummaryOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "latency_milliseconds",
-			Help:      "Latency quantiles for sending alert notifications (not including dropped notifications).",
-		}),
-		notificationErrors: prometheus.NewCounter(prometheus.CounterOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "errors_total",
-			Help:      "Total number of errors sending alert notifications.",
-		}),
-		notificationDropped: prometheus.NewCounter(prometheus.CounterOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "dropped_total",
-			Help:      "Total number of alert notifications dropped due to alert manager missing in configuration.",
-		}),
-		notificationsQueueLength: prometheus.NewGauge(prometheus.GaugeOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "queue_length",
-			Help:      "The number of alert notifications in the queue.",
-		}),
+		alertmanagers: alertmanagers,
+
+		notificationLatency: prometheus.NewSummaryVec(
+			prometheus.SummaryOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "latency_milliseconds",
+				Help:      "Latency quantiles for sending alert notifications (not including dropped notifications).",
+			},
+			[]string{alertmanagerLabel},
+		),
+		notificationErrors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "errors_total",
+				Help:      "Total number of errors sending alert notifications, including retries.",
+			},
+			[]string{alertmanagerLabel},
+		),
+		notificationDropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "dropped_total",
+				Help:      "Total number of alert notifications dropped due to a full queue, or alert managers missing in configuration (empty alertmanager label).",
+			},
+			[]string{alertmanagerLabel},
+		),
+		notificationsQueueLength: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "queue_length",
+				Help:      "The number of alert notification batches in the queue, including the batch currently being sent.",
+			},
+			[]string{alertmanagerLabel},
+		),
 		notificationsQueueCapacity: prometheus.MustNewConstMetric(
 			prometheus.NewDesc(
 				prometheus.BuildFQName(namespace, subsystem, "queue_capacity"),
-				"The capacity of the alert notifications queue.",
+				"The capacity of the alert notifications queue of each alert manager.",
 				nil, nil,
 			),
 			prometheus.GaugeValue,
-			float64(notificationQueueCapacity),
+			float64(o.QueueCapacity),
 		),
+		stop:    make(chan struct{}),
 		stopped: make(chan struct{}),
 	}
 }
 
-// Send a list of notifications to the configured alert manager.
-func (n *NotificationHandler) sendNotifications(reqs NotificationReqs) error {
+// encodeNotifications encodes a list of notifications in the format of the
+// alert manager API.
+func encodeNotifications(reqs NotificationReqs) ([]byte, error) {
 	alerts := make([]map[string]interface{}, 0, len(reqs))
 	for _, req := range reqs {
-		alerts = append(alerts, map[string]interface{}{
+		alert := map[string]interface{}{
 			"Summary":     req.Summary,
 			"Description": req.Description,
 			"Labels":      req.Labels,
@@ -152,15 +272,20 @@ func (n *NotificationHandler) sendNotifications(reqs NotificationReqs) error {
 				"GeneratorURL": req.GeneratorURL,
 				"AlertingRule": req.RuleString,
 			},
-		})
-	}
-	buf, err := json.Marshal(alerts)
-	if err != nil {
-		return err
+		}
+		if len(req.Annotations) > 0 {
+			alert["Annotations"] = req.Annotations
+		}
+		alerts = append(alerts, alert)
 	}
-	glog.V(1).Infoln("Sending notifications to alertmanager:", string(buf))
+	return json.Marshal(alerts)
+}
+
+// Send encoded notifications to the alert manager at the given URL.
+func (n *NotificationHandler) sendNotifications(url string, buf []byte) error {
+	glog.V(1).Infof("Sending notifications to alertmanager %s: %s", url, buf)
 	resp, err := n.httpClient.Post(
-		n.alertmanagerURL+alertmanagerAPIEventsPath,
+		url+alertmanagerAPIEventsPath,
 		contentTypeJSON,
 		bytes.NewBuffer(buf),
 	)
@@ -173,41 +298,151 @@ func (n *NotificationHandler) sendNotifications(reqs NotificationReqs) error {
 	if err != nil {
 		return err
 	}
-	// BUG: Do we need to check the response code?
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("bad response status %s", resp.Status)
+	}
 	return nil
 }
 
-// Run dispatches notifications continuously.
-func (n *NotificationHandler) Run() {
-	for reqs := range n.pendingNotifications {
-		if n.alertmanagerURL == "" {
-			glog.Warning("No alert manager configured, not dispatching notification")
-			n.notificationDropped.Inc()
-			continue
-		}
+// runAlertmanager sends the queued notifications to the given alert manager
+// until it is shut down. A batch of notifications stays at the head of the
+// queue, blocking the ones behind it, until it has been sent successfully or
+// has been dropped to make room for newer ones.
+func (n *NotificationHandler) runAlertmanager(am *alertmanager) {
+	defer close(am.done)
 
+	for {
+		b := am.queue.peek()
+		if b == nil {
+			return
+		}
 		begin := time.Now()
-		err := n.sendNotifications(reqs)
+		backoff := retryBackoff
+		for {
+			err := n.sendNotifications(am.url, b.body)
+			if err == nil {
+				break
+			}
+			n.notificationErrors.WithLabelValues(am.url).Inc()
+			glog.Errorf("Error sending notification to alertmanager %s, retrying in %v: %s", am.url, backoff, err)
+			select {
+			case <-time.After(backoff):
+			case <-am.stop:
+				return
+			}
+			if backoff *= 2; backoff > n.maxRetryBackoff {
+				backoff = n.maxRetryBackoff
+			}
+		}
+		n.notificationLatency.WithLabelValues(am.url).Observe(float64(time.Since(begin) / time.Millisecond))
+		am.queue.remove(b)
+	}
+}
 
-		if err != nil {
-			glog.Error("Error sending notification: ", err)
-			n.notificationErrors.Inc()
+// discoverAlertmanagers looks up the alert managers by their DNS SRV record
+// name, starts sending to newly discovered alert managers and stops sending to
+// the ones that went away.
+func (n *NotificationHandler) discoverAlertmanagers() {
+	_, addrs, err := net.LookupSRV("", "", n.sdName)
+	if err != nil {
+		// Keep the previously discovered alert managers.
+		glog.Errorf("Error looking up alertmanagers via %s: %s", n.sdName, err)
+		return
+	}
+	urls := map[string]bool{}
+	for _, u := range n.alertmanagerURLs {
+		urls[u] = true
+	}
+	for _, addr := range addrs {
+		// Remove the final dot from rooted DNS names to make them look more usual.
+		host := strings.TrimSuffix(addr.Target, ".")
+		urls[fmt.Sprintf("http://%s:%d", host, addr.Port)] = true
+	}
+
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	for u, am := range n.alertmanagers {
+		if !urls[u] {
+			glog.Infof("Stopping to send notifications to alertmanager %s", u)
+			am.shutdown(true)
+			delete(n.alertmanagers, u)
+			n.notificationsQueueLength.DeleteLabelValues(u)
+		}
+	}
+	for u := range urls {
+		if _, ok := n.alertmanagers[u]; !ok {
+			am := newAlertmanager(u, n.queueCapacity, n.queueDir)
+			n.alertmanagers[u] = am
+			go n.runAlertmanager(am)
 		}
+	}
+}
+
+// Run dispatches notifications continuously.
+func (n *NotificationHandler) Run() {
+	n.mtx.RLock()
+	for _, am := range n.alertmanagers {
+		go n.runAlertmanager(am)
+	}
+	n.mtx.RUnlock()
+
+	var refresh <-chan time.Time
+	if n.sdName != "" {
+		n.discoverAlertmanagers()
+		ticker := time.NewTicker(n.sdRefreshInterval)
+		defer ticker.Stop()
+		refresh = ticker.C
+	}
 
-		n.notificationLatency.Observe(float64(time.Since(begin) / time.Millisecond))
+	for {
+		select {
+		case <-refresh:
+			n.discoverAlertmanagers()
+		case <-n.stop:
+			n.mtx.Lock()
+			for u, am := range n.alertmanagers {
+				am.shutdown(false)
+				<-am.done
+				delete(n.alertmanagers, u)
+			}
+			n.mtx.Unlock()
+			close(n.stopped)
+			return
+		}
 	}
-	close(n.stopped)
 }
 
-// SubmitReqs queues the given notification requests for processing.
+// SubmitReqs queues the given notification requests for processing by every
+// alert manager. For alert managers whose queue is full, the oldest queued
+// notifications are dropped.
 func (n *NotificationHandler) SubmitReqs(reqs NotificationReqs) {
-	n.pendingNotifications <- reqs
+	n.mtx.RLock()
+	defer n.mtx.RUnlock()
+
+	if len(n.alertmanagers) == 0 {
+		glog.Warning("No alert manager configured, not dispatching notification")
+		n.notificationDropped.WithLabelValues("").Inc()
+		return
+	}
+	buf, err := encodeNotifications(reqs)
+	if err != nil {
+		glog.Errorf("Error encoding notifications: %s", err)
+		n.notificationDropped.WithLabelValues("").Inc()
+		return
+	}
+	for _, am := range n.alertmanagers {
+		if !am.queue.push(&queuedBatch{body: buf}) {
+			glog.Warningf("Notification queue of alertmanager %s full, dropped oldest notification", am.url)
+			n.notificationDropped.WithLabelValues(am.url).Inc()
+		}
+	}
 }
 
 // Stop shuts down the notification handler.
 func (n *NotificationHandler) Stop() {
 	glog.Info("Stopping notification handler...")
-	close(n.pendingNotifications)
+	close(n.stop)
 	<-n.stopped
 	glog.Info("Notification handler stopped.")
 }
@@ -215,14 +450,22 @@ func (n *NotificationHandler) Stop() {
 // Describe implements prometheus.Collector.
 func (n *NotificationHandler) Describe(ch chan<- *prometheus.Desc) {
 	n.notificationLatency.Describe(ch)
-	ch <- n.notificationsQueueLength.Desc()
+	n.notificationErrors.Describe(ch)
+	n.notificationDropped.Describe(ch)
+	n.notificationsQueueLength.Describe(ch)
 	ch <- n.notificationsQueueCapacity.Desc()
 }
 
 // Collect implements prometheus.Collector.
 func (n *NotificationHandler) Collect(ch chan<- prometheus.Metric) {
 	n.notificationLatency.Collect(ch)
-	n.notificationsQueueLength.Set(float64(len(n.pendingNotifications)))
-	ch <- n.notificationsQueueLength
+	n.notificationErrors.Collect(ch)
+	n.notificationDropped.Collect(ch)
+	n.mtx.RLock()
+	for u, am := range n.alertmanagers {
+		n.notificationsQueueLength.WithLabelValues(u).Set(float64(am.queue.len()))
+	}
+	n.mtx.RUnlock()
+	n.notificationsQueueLength.Collect(ch)
 	ch <- n.notificationsQueueCapacity
 }
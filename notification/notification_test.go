@@ -15,9 +15,14 @@ package notification
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
 	"testing"
 	"time"
 
@@ -35,18 +40,23 @@ func (p *testHTTPPoster) Post(url string, bodyType string, body io.Reader) (*htt
 	p.message = buf.String()
 	p.receivedPost <- true
 	return &http.Response{
-		Body: ioutil.NopCloser(&bytes.Buffer{}),
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(&bytes.Buffer{}),
 	}, nil
 }
 
 type testNotificationScenario struct {
 	description string
 	summary     string
+	annotations clientmodel.LabelSet
 	message     string
 }
 
 func (s *testNotificationScenario) test(i int, t *testing.T) {
-	h := NewNotificationHandler("alertmanager_url", 0)
+	h := NewNotificationHandler(&NotificationHandlerOptions{
+		AlertmanagerURLs: []string{"alertmanager_url"},
+		QueueCapacity:    1,
+	})
 	defer h.Stop()
 
 	receivedPost := make(chan bool, 1)
@@ -59,6 +69,7 @@ func (s *testNotificationScenario) test(i int, t *testing.T) {
 		{
 			Summary:     s.summary,
 			Description: s.description,
+			Annotations: s.annotations,
 			Labels: clientmodel.LabelSet{
 				clientmodel.LabelName("instance"): clientmodel.LabelValue("testinstance"),
 			},
@@ -83,9 +94,159 @@ func TestNotificationHandler(t *testing.T) {
 			description: "Description",
 			message:     `[{"Description":"Description","Labels":{"instance":"testinstance"},"Payload":{"ActiveSince":"0001-01-01T00:00:00Z","AlertingRule":"Test rule string","GeneratorURL":"prometheus_url","Value":"0.3333333333333333"},"Summary":"Summary"}]`,
 		},
+		{
+			// Message with annotations.
+			summary:     "Summary",
+			description: "Description",
+			annotations: clientmodel.LabelSet{"runbook": "http://runbooks.example.org/testalert"},
+			message:     `[{"Annotations":{"runbook":"http://runbooks.example.org/testalert"},"Description":"Description","Labels":{"instance":"testinstance"},"Payload":{"ActiveSince":"0001-01-01T00:00:00Z","AlertingRule":"Test rule string","GeneratorURL":"prometheus_url","Value":"0.3333333333333333"},"Summary":"Summary"}]`,
+		},
 	}
 
 	for i, s := range scenarios {
 		s.test(i, t)
 	}
 }
+
+// fanOutHTTPPoster records the URLs posted to and fails the first post to
+// each URL in failOnce.
+type fanOutHTTPPoster struct {
+	mtx      sync.Mutex
+	failOnce map[string]bool
+	posts    []string
+	done     chan struct{}
+	want     int
+}
+
+func (p *fanOutHTTPPoster) Post(url string, bodyType string, body io.Reader) (*http.Response, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	status := http.StatusOK
+	if p.failOnce[url] {
+		p.failOnce[url] = false
+		status = http.StatusServiceUnavailable
+	}
+	p.posts = append(p.posts, fmt.Sprintf("%s %d", url, status))
+	if len(p.posts) == p.want {
+		close(p.done)
+	}
+	return &http.Response{
+		StatusCode: status,
+		Status:     http.StatusText(status),
+		Body:       ioutil.NopCloser(&bytes.Buffer{}),
+	}, nil
+}
+
+func TestNotificationHandlerFanOut(t *testing.T) {
+	retryBackoff = time.Millisecond
+
+	h := NewNotificationHandler(&NotificationHandlerOptions{
+		AlertmanagerURLs: []string{"http://am1/", "http://am2", ""},
+		QueueCapacity:    1,
+		MaxRetryBackoff:  time.Millisecond,
+	})
+	poster := &fanOutHTTPPoster{
+		failOnce: map[string]bool{"http://am2/api/alerts": true},
+		done:     make(chan struct{}),
+		want:     3,
+	}
+	h.httpClient = poster
+
+	go h.Run()
+	h.SubmitReqs(NotificationReqs{{Summary: "Summary"}})
+	<-poster.done
+	h.Stop()
+
+	sort.Strings(poster.posts)
+	expected := []string{
+		"http://am1/api/alerts 200",
+		"http://am2/api/alerts 200",
+		"http://am2/api/alerts 503",
+	}
+	if !reflect.DeepEqual(poster.posts, expected) {
+		t.Errorf("expected posts %v, got %v", expected, poster.posts)
+	}
+}
+
+// failingHTTPPoster fails all posts until it is told to succeed.
+type failingHTTPPoster struct {
+	mtx     sync.Mutex
+	succeed bool
+	failed  chan struct{}
+	bodies  chan string
+}
+
+func (p *failingHTTPPoster) Post(url string, bodyType string, body io.Reader) (*http.Response, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if !p.succeed {
+		select {
+		case p.failed <- struct{}{}:
+		default:
+		}
+		return nil, fmt.Errorf("connection refused")
+	}
+	buf, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	p.bodies <- string(buf)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(&bytes.Buffer{}),
+	}, nil
+}
+
+func TestNotificationHandlerDurableQueue(t *testing.T) {
+	retryBackoff = time.Millisecond
+
+	dir, err := ioutil.TempDir("", "notification_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	opts := &NotificationHandlerOptions{
+		AlertmanagerURLs: []string{"http://am"},
+		QueueCapacity:    10,
+		QueueDir:         dir,
+		MaxRetryBackoff:  time.Millisecond,
+	}
+	reqs := NotificationReqs{{Summary: "Summary"}}
+	expected, err := encodeNotifications(reqs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The alert manager is down until the notification handler is stopped.
+	h := NewNotificationHandler(opts)
+	poster := &failingHTTPPoster{
+		failed: make(chan struct{}),
+		bodies: make(chan string, 1),
+	}
+	h.httpClient = poster
+	go h.Run()
+	h.SubmitReqs(reqs)
+	<-poster.failed
+	<-poster.failed
+	h.Stop()
+
+	// After the restart, the alert manager is up again and receives the
+	// notification submitted before.
+	poster.succeed = true
+	h = NewNotificationHandler(opts)
+	h.httpClient = poster
+	go h.Run()
+	defer h.Stop()
+
+	select {
+	case body := <-poster.bodies:
+		if body != string(expected) {
+			t.Errorf("expected notification %s, got %s", expected, body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("notification not sent after restart")
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notification
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// A queuedBatch is a batch of notifications for an alert manager, already
+// encoded in the format of the alert manager API.
+type queuedBatch struct {
+	body json.RawMessage
+}
+
+// notificationQueue is a bounded FIFO queue of notification batches for a
+// single alert manager. If the queue is full, the oldest batch is dropped to
+// make room for a new one. If the queue has a file, the queued batches are
+// written to it on every change and read from it on creation, so that pending
+// notifications survive restarts.
+type notificationQueue struct {
+	mtx      sync.Mutex
+	cond     *sync.Cond
+	batches  []*queuedBatch
+	capacity int
+	closed   bool
+	filename string
+}
+
+// newNotificationQueue returns a queue with the given capacity. If filename is
+// not empty, the queue is persisted to that file and initialized with the
+// batches found in it.
+func newNotificationQueue(capacity int, filename string) *notificationQueue {
+	q := &notificationQueue{
+		capacity: capacity,
+		filename: filename,
+	}
+	q.cond = sync.NewCond(&q.mtx)
+	if filename != "" {
+		q.load()
+	}
+	return q
+}
+
+// push adds a batch to the end of the queue. It returns false if the oldest
+// batch had to be dropped to make room for it.
+func (q *notificationQueue) push(b *queuedBatch) bool {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	ok := true
+	if len(q.batches) >= q.capacity {
+		if q.capacity <= 0 {
+			return false
+		}
+		q.batches = q.batches[1:]
+		ok = false
+	}
+	q.batches = append(q.batches, b)
+	q.persist()
+	q.cond.Signal()
+	return ok
+}
+
+// peek returns the oldest batch without removing it. It blocks until a batch
+// is available. It returns nil once the queue is closed.
+func (q *notificationQueue) peek() *queuedBatch {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	for len(q.batches) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return nil
+	}
+	return q.batches[0]
+}
+
+// remove removes the given batch if it is still the oldest one in the queue.
+// It may have been dropped in the meantime to make room for newer batches.
+func (q *notificationQueue) remove(b *queuedBatch) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if len(q.batches) > 0 && q.batches[0] == b {
+		q.batches[0] = nil
+		q.batches = q.batches[1:]
+		q.persist()
+	}
+}
+
+// len returns the number of queued batches.
+func (q *notificationQueue) len() int {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	return len(q.batches)
+}
+
+// close makes peek return nil. Queued batches are kept in the queue's file.
+func (q *notificationQueue) close() {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// discard closes the queue and deletes its file. The queue is not persisted
+// anymore afterwards.
+func (q *notificationQueue) discard() {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	q.closed = true
+	q.cond.Broadcast()
+	if q.filename == "" {
+		return
+	}
+	if err := os.Remove(q.filename); err != nil && !os.IsNotExist(err) {
+		glog.Errorf("Error removing notification queue file %s: %s", q.filename, err)
+	}
+	q.filename = ""
+}
+
+// persist writes the queued batches to the queue's file, if any. The file is
+// replaced atomically so that a crash never leaves a partially written file
+// behind. The caller must hold q.mtx.
+func (q *notificationQueue) persist() {
+	if q.filename == "" {
+		return
+	}
+	bodies := make([]json.RawMessage, 0, len(q.batches))
+	for _, b := range q.batches {
+		bodies = append(bodies, b.body)
+	}
+	buf, err := json.Marshal(bodies)
+	if err == nil {
+		tmp := q.filename + ".tmp"
+		if err = ioutil.WriteFile(tmp, buf, 0666); err == nil {
+			err = os.Rename(tmp, q.filename)
+		}
+	}
+	if err != nil {
+		glog.Errorf("Error persisting notification queue to %s: %s", q.filename, err)
+	}
+}
+
+// load reads the batches persisted in the queue's file, if it exists. If
+// there are more batches than fit into the queue, the oldest ones are
+// dropped.
+func (q *notificationQueue) load() {
+	buf, err := ioutil.ReadFile(q.filename)
+	if os.IsNotExist(err) {
+		return
+	}
+	var bodies []json.RawMessage
+	if err == nil {
+		err = json.Unmarshal(buf, &bodies)
+	}
+	if err != nil {
+		glog.Errorf("Error loading notification queue from %s: %s", q.filename, err)
+		return
+	}
+	if len(bodies) > q.capacity {
+		glog.Warningf("Dropping %d notification batches from %s exceeding the queue capacity", len(bodies)-q.capacity, q.filename)
+		bodies = bodies[len(bodies)-q.capacity:]
+	}
+	for _, body := range bodies {
+		q.batches = append(q.batches, &queuedBatch{body: body})
+	}
+	glog.Infof("Loaded %d pending notification batches from %s", len(q.batches), q.filename)
+}
@@ -0,0 +1,83 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package notification
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func queuedBodies(q *notificationQueue) []string {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	bodies := []string{}
+	for _, b := range q.batches {
+		bodies = append(bodies, string(b.body))
+	}
+	return bodies
+}
+
+func TestNotificationQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "notification_queue_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "queue.json")
+
+	q := newNotificationQueue(2, filename)
+	a, b, c := &queuedBatch{body: []byte(`"a"`)}, &queuedBatch{body: []byte(`"b"`)}, &queuedBatch{body: []byte(`"c"`)}
+	if !q.push(a) || !q.push(b) {
+		t.Fatal("expected pushing into non-full queue to succeed")
+	}
+	if q.push(c) {
+		t.Fatal("expected pushing into full queue to drop the oldest batch")
+	}
+	if got := q.peek(); got != b {
+		t.Fatalf("expected oldest batch %s, got %s", b.body, got.body)
+	}
+	// Removing a batch that has been dropped in the meantime is a no-op.
+	q.remove(a)
+	if q.len() != 2 {
+		t.Fatalf("expected 2 queued batches, got %d", q.len())
+	}
+
+	// A new queue picks up the batches persisted by the old one, dropping
+	// those exceeding its capacity.
+	q.close()
+	if q.peek() != nil {
+		t.Fatal("expected closed queue to return no batch")
+	}
+	q = newNotificationQueue(1, filename)
+	if got := queuedBodies(q); len(got) != 1 || got[0] != `"c"` {
+		t.Fatalf("expected loaded batches [\"c\"], got %v", got)
+	}
+	q.remove(q.peek())
+	if q.len() != 0 {
+		t.Fatalf("expected empty queue, got %d batches", q.len())
+	}
+	q = newNotificationQueue(1, filename)
+	if q.len() != 0 {
+		t.Fatalf("expected empty loaded queue, got %d batches", q.len())
+	}
+
+	q.push(a)
+	q.discard()
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Fatalf("expected queue file to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package relabel implements relabeling of series and targets by relabel
+// configurations.
+package relabel
+
+import (
+	"strings"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/config"
+	pb "github.com/prometheus/prometheus/config/generated"
+)
+
+// Relabel applies the relabel configurations in order to the metric. It
+// returns nil if the series is dropped. Otherwise, it returns the relabeled
+// metric, which is a copy if any label changed, so that metrics shared with
+// other users are never modified.
+func Relabel(m clientmodel.Metric, rcs []*config.RelabelConfig) clientmodel.Metric {
+	copied := false
+	for _, rc := range rcs {
+		values := make([]string, 0, len(rc.SourceLabel))
+		for _, ln := range rc.SourceLabel {
+			values = append(values, string(m[clientmodel.LabelName(ln)]))
+		}
+		val := strings.Join(values, rc.GetSeparator())
+		re := rc.Regexp()
+
+		switch rc.GetAction() {
+		case pb.RelabelConfig_KEEP:
+			if !re.MatchString(val) {
+				return nil
+			}
+		case pb.RelabelConfig_DROP:
+			if re.MatchString(val) {
+				return nil
+			}
+		case pb.RelabelConfig_REPLACE:
+			indexes := re.FindStringSubmatchIndex(val)
+			if indexes == nil {
+				continue
+			}
+			res := re.ExpandString(nil, rc.GetReplacement(), val, indexes)
+			if !copied {
+				m = m.Clone()
+				copied = true
+			}
+			if len(res) == 0 {
+				delete(m, clientmodel.LabelName(rc.GetTargetLabel()))
+			} else {
+				m[clientmodel.LabelName(rc.GetTargetLabel())] = clientmodel.LabelValue(res)
+			}
+		case pb.RelabelConfig_LABELMAP:
+			// Collect the mapped labels first so that labels added by
+			// this rule are not matched again.
+			mapped := clientmodel.LabelSet{}
+			for ln, lv := range m {
+				if re.MatchString(string(ln)) {
+					res := re.ReplaceAllString(string(ln), rc.GetReplacement())
+					mapped[clientmodel.LabelName(res)] = lv
+				}
+			}
+			if len(mapped) == 0 {
+				continue
+			}
+			if !copied {
+				m = m.Clone()
+				copied = true
+			}
+			for ln, lv := range mapped {
+				m[ln] = lv
+			}
+		}
+	}
+	return m
+}
@@ -0,0 +1,104 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package relabel
+
+import (
+	"reflect"
+	"testing"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/config"
+)
+
+func relabelConfigs(t *testing.T, rules string) []*config.RelabelConfig {
+	conf, err := config.LoadFromString(`
+		global <
+			scrape_interval: "30s"
+			evaluation_interval: "30s"
+		>
+		remote_write <
+			type: "generic"
+			` + rules + `
+		>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conf.RemoteWriteRelabelConfigs("generic")
+}
+
+func TestRelabel(t *testing.T) {
+	scenarios := []struct {
+		rules string
+		in    clientmodel.Metric
+		out   clientmodel.Metric
+	}{
+		{
+			rules: `write_relabel_config < source_label: "__name__" regex: "go_.*" action: DROP >`,
+			in:    clientmodel.Metric{clientmodel.MetricNameLabel: "go_goroutines"},
+			out:   nil,
+		},
+		{
+			rules: `write_relabel_config < source_label: "__name__" regex: "go_.*" action: DROP >`,
+			in:    clientmodel.Metric{clientmodel.MetricNameLabel: "up"},
+			out:   clientmodel.Metric{clientmodel.MetricNameLabel: "up"},
+		},
+		{
+			rules: `write_relabel_config < source_label: "job" regex: "api|db" action: KEEP >`,
+			in:    clientmodel.Metric{clientmodel.MetricNameLabel: "up", "job": "apiserver"},
+			out:   nil,
+		},
+		{
+			rules: `write_relabel_config < source_label: "job" source_label: "instance" regex: "(.*);(.*):.*" target_label: "origin" replacement: "$1/$2" >`,
+			in:    clientmodel.Metric{clientmodel.MetricNameLabel: "up", "job": "api", "instance": "a:80"},
+			out:   clientmodel.Metric{clientmodel.MetricNameLabel: "up", "job": "api", "instance": "a:80", "origin": "api/a"},
+		},
+		{
+			rules: `write_relabel_config < source_label: "job" regex: "x" target_label: "job" replacement: "" >`,
+			in:    clientmodel.Metric{clientmodel.MetricNameLabel: "up", "job": "api"},
+			out:   clientmodel.Metric{clientmodel.MetricNameLabel: "up", "job": "api"},
+		},
+		{
+			rules: `write_relabel_config < source_label: "instance" regex: ".*" target_label: "instance" replacement: "" >
+				write_relabel_config < source_label: "instance" regex: "" action: KEEP >`,
+			in:  clientmodel.Metric{clientmodel.MetricNameLabel: "up", "instance": "a:80"},
+			out: clientmodel.Metric{clientmodel.MetricNameLabel: "up"},
+		},
+		{
+			rules: `write_relabel_config < regex: "__meta_consul_(.+)" replacement: "consul_$1" action: LABELMAP >`,
+			in:    clientmodel.Metric{clientmodel.MetricNameLabel: "up", "__meta_consul_dc": "dc1", "__meta_consul_node": "n1"},
+			out:   clientmodel.Metric{clientmodel.MetricNameLabel: "up", "__meta_consul_dc": "dc1", "__meta_consul_node": "n1", "consul_dc": "dc1", "consul_node": "n1"},
+		},
+		{
+			rules: `write_relabel_config < regex: "(.*)" replacement: "x_$1" action: LABELMAP >`,
+			in:    clientmodel.Metric{"a": "1"},
+			out:   clientmodel.Metric{"a": "1", "x_a": "1"},
+		},
+		{
+			rules: `write_relabel_config < regex: "__meta_.+" replacement: "meta" action: LABELMAP >`,
+			in:    clientmodel.Metric{clientmodel.MetricNameLabel: "up"},
+			out:   clientmodel.Metric{clientmodel.MetricNameLabel: "up"},
+		},
+	}
+
+	for i, s := range scenarios {
+		in := s.in.Clone()
+		if got := Relabel(in, relabelConfigs(t, s.rules)); !reflect.DeepEqual(got, s.out) {
+			t.Errorf("%d. got relabeled metric %v, want %v", i, got, s.out)
+		}
+		if !in.Equal(s.in) {
+			t.Errorf("%d. input metric modified to %v", i, in)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/config"
+)
+
+const (
+	// consulMetaLabelPrefix is the prefix of the meta labels of targets
+	// discovered via Consul SD.
+	consulMetaLabelPrefix = "__meta_consul_"
+	// consulWatchTimeout is the maximum time a blocking query to the Consul
+	// agent waits for changes.
+	consulWatchTimeout = 2 * time.Minute
+)
+
+var consulSDFailuresCount = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "consul_sd_failures_total",
+		Help:      "The number of failed queries to the Consul agent.",
+	})
+
+func init() {
+	prometheus.MustRegister(consulSDFailuresCount)
+}
+
+// The subset of the Consul health API response needed to discover targets.
+type consulServiceEntry struct {
+	Node struct {
+		Node       string            `json:"Node"`
+		Address    string            `json:"Address"`
+		Datacenter string            `json:"Datacenter"`
+		Meta       map[string]string `json:"Meta"`
+	} `json:"Node"`
+	Service struct {
+		ID      string   `json:"ID"`
+		Service string   `json:"Service"`
+		Tags    []string `json:"Tags"`
+		Address string   `json:"Address"`
+		Port    int      `json:"Port"`
+	} `json:"Service"`
+	Checks []struct {
+		Status string `json:"Status"`
+	} `json:"Checks"`
+}
+
+// consulTargetProvider discovers the targets of a job by watching the Consul
+// catalog with blocking queries. Each watched service is watched by a
+// goroutine of its own.
+type consulTargetProvider struct {
+	job            config.JobConfig
+	globalLabels   clientmodel.LabelSet
+	relabelConfigs []*config.RelabelConfig
+
+	url           string
+	datacenter    string
+	token         string
+	tagSeparator  string
+	services      map[string]bool
+	transport     *http.Transport
+	retryInterval time.Duration
+
+	// Protects the fields below.
+	mtx sync.RWMutex
+	// The label sets of the discovered targets by service.
+	targets map[string][]clientmodel.LabelSet
+	// Whether the services have been listed successfully at least once.
+	listed bool
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// NewConsulTargetProvider constructs a new consulTargetProvider for a job.
+// Discovery starts once Run is called.
+func NewConsulTargetProvider(job config.JobConfig, globalLabels clientmodel.LabelSet) *consulTargetProvider {
+	conf := job.GetConsulSd()
+	services := make(map[string]bool, len(conf.Service))
+	for _, s := range conf.Service {
+		services[s] = true
+	}
+	return &consulTargetProvider{
+		job:            job,
+		globalLabels:   globalLabels,
+		relabelConfigs: job.RelabelConfigs(),
+		url:            conf.GetScheme() + "://" + conf.GetServer(),
+		datacenter:     conf.GetDatacenter(),
+		token:          conf.GetToken(),
+		tagSeparator:   conf.GetTagSeparator(),
+		services:       services,
+		transport:      &http.Transport{Proxy: http.ProxyFromEnvironment},
+		retryInterval:  job.ConsulRetryInterval(),
+		targets:        map[string][]clientmodel.LabelSet{},
+		stop:           make(chan struct{}),
+		stopped:        make(chan struct{}),
+	}
+}
+
+// Run watches the catalog for the services to discover targets for until
+// Stop is called, and starts and stops watching the individual services
+// accordingly. Run is usually called as a goroutine.
+func (p *consulTargetProvider) Run() {
+	defer close(p.stopped)
+
+	watchers := map[string]chan struct{}{}
+	var wg sync.WaitGroup
+	defer func() {
+		for _, stop := range watchers {
+			close(stop)
+		}
+		wg.Wait()
+	}()
+
+	index := ""
+	for {
+		var services map[string][]string
+		newIndex, err := p.get("/v1/catalog/services", index, p.stop, &services)
+		select {
+		case <-p.stop:
+			return
+		default:
+		}
+		if err != nil {
+			consulSDFailuresCount.Inc()
+			glog.Errorf("Error listing Consul services for job %s, retrying in %v: %s", p.job.GetName(), p.retryInterval, err)
+			index = ""
+			select {
+			case <-time.After(p.retryInterval):
+				continue
+			case <-p.stop:
+				return
+			}
+		}
+		index = newIndex
+
+		for name := range services {
+			if len(p.services) > 0 && !p.services[name] {
+				continue
+			}
+			if _, ok := watchers[name]; !ok {
+				stop := make(chan struct{})
+				watchers[name] = stop
+				wg.Add(1)
+				go func(name string) {
+					defer wg.Done()
+					p.watchService(name, stop)
+				}(name)
+			}
+		}
+		for name, stop := range watchers {
+			if _, ok := services[name]; !ok {
+				close(stop)
+				delete(watchers, name)
+			}
+		}
+
+		p.mtx.Lock()
+		p.listed = true
+		p.mtx.Unlock()
+	}
+}
+
+// Stop stops watching the Consul catalog and returns once Run has returned.
+func (p *consulTargetProvider) Stop() {
+	close(p.stop)
+	<-p.stopped
+}
+
+// watchService updates the targets of the given service until stop is
+// closed. The targets of the service are removed then.
+func (p *consulTargetProvider) watchService(name string, stop <-chan struct{}) {
+	defer func() {
+		p.mtx.Lock()
+		delete(p.targets, name)
+		p.mtx.Unlock()
+	}()
+
+	index := ""
+	for {
+		var entries []*consulServiceEntry
+		newIndex, err := p.get("/v1/health/service/"+url.QueryEscape(name), index, stop, &entries)
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		if err != nil {
+			consulSDFailuresCount.Inc()
+			glog.Errorf("Error querying Consul service %s for job %s, retrying in %v: %s", name, p.job.GetName(), p.retryInterval, err)
+			index = ""
+			select {
+			case <-time.After(p.retryInterval):
+				continue
+			case <-stop:
+				return
+			}
+		}
+		index = newIndex
+
+		targets := make([]clientmodel.LabelSet, 0, len(entries))
+		for _, e := range entries {
+			targets = append(targets, p.entryLabels(e))
+		}
+		p.mtx.Lock()
+		p.targets[name] = targets
+		p.mtx.Unlock()
+	}
+}
+
+// get queries the given path of the Consul HTTP API and decodes the response
+// into v. If index is not empty, the query blocks until the result changes
+// after the given index or the watch timeout has passed. It returns the index
+// of the result.
+func (p *consulTargetProvider) get(path, index string, stop <-chan struct{}, v interface{}) (string, error) {
+	params := url.Values{}
+	if p.datacenter != "" {
+		params.Set("dc", p.datacenter)
+	}
+	if p.token != "" {
+		params.Set("token", p.token)
+	}
+	if index != "" {
+		params.Set("index", index)
+		params.Set("wait", fmt.Sprintf("%ds", consulWatchTimeout/time.Second))
+	}
+	req, err := http.NewRequest("GET", p.url+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := getCancelable(p.transport, req, stop)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return "", err
+	}
+	return resp.Header.Get("X-Consul-Index"), nil
+}
+
+// entryLabels returns the labels of the target discovered from a service
+// instance.
+func (p *consulTargetProvider) entryLabels(e *consulServiceEntry) clientmodel.LabelSet {
+	addr := e.Service.Address
+	if addr == "" {
+		addr = e.Node.Address
+	}
+	dc := e.Node.Datacenter
+	if p.datacenter != "" {
+		dc = p.datacenter
+	}
+	// Join the tags with the separator at both ends, so that single tags
+	// can be matched by regular expressions.
+	tags := ""
+	if len(e.Service.Tags) > 0 {
+		tags = p.tagSeparator + strings.Join(e.Service.Tags, p.tagSeparator) + p.tagSeparator
+	}
+	health := "passing"
+	for _, c := range e.Checks {
+		if c.Status == "critical" {
+			health = "critical"
+			break
+		}
+		if c.Status == "warning" {
+			health = "warning"
+		}
+	}
+
+	ls := clientmodel.LabelSet{
+		addressLabel:                              clientmodel.LabelValue(addr + ":" + strconv.Itoa(e.Service.Port)),
+		consulMetaLabelPrefix + "node":            clientmodel.LabelValue(e.Node.Node),
+		consulMetaLabelPrefix + "address":         clientmodel.LabelValue(e.Node.Address),
+		consulMetaLabelPrefix + "dc":              clientmodel.LabelValue(dc),
+		consulMetaLabelPrefix + "service":         clientmodel.LabelValue(e.Service.Service),
+		consulMetaLabelPrefix + "service_id":      clientmodel.LabelValue(e.Service.ID),
+		consulMetaLabelPrefix + "service_address": clientmodel.LabelValue(e.Service.Address),
+		consulMetaLabelPrefix + "service_port":    clientmodel.LabelValue(strconv.Itoa(e.Service.Port)),
+		consulMetaLabelPrefix + "tags":            clientmodel.LabelValue(tags),
+		consulMetaLabelPrefix + "health":          clientmodel.LabelValue(health),
+	}
+	for k, v := range e.Node.Meta {
+		ls[sanitizedLabelName(consulMetaLabelPrefix+"metadata_"+k)] = clientmodel.LabelValue(v)
+	}
+	return ls
+}
+
+// Targets implements TargetProvider.
+func (p *consulTargetProvider) Targets() ([]Target, error) {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	if !p.listed {
+		return nil, fmt.Errorf("Consul services not listed yet")
+	}
+
+	targets := []Target{}
+	for _, labelSets := range p.targets {
+		for _, ls := range labelSets {
+			if t := discoveredTarget(p.job, p.globalLabels, p.relabelConfigs, ls); t != nil {
+				targets = append(targets, t)
+			}
+		}
+	}
+	return targets, nil
+}
@@ -0,0 +1,180 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/config"
+)
+
+const testConsulAPIHealth = `[
+	{
+		"Node": {"Node": "node-1", "Address": "10.0.0.1", "Meta": {"rack": "r1"}},
+		"Service": {"ID": "api-1", "Service": "api", "Tags": ["production", "v2"], "Address": "", "Port": 8080},
+		"Checks": [{"Status": "passing"}, {"Status": "warning"}]
+	},
+	{
+		"Node": {"Node": "node-2", "Address": "10.0.0.2"},
+		"Service": {"ID": "api-2", "Service": "api", "Tags": ["canary"], "Address": "10.0.1.2", "Port": 8080},
+		"Checks": [{"Status": "critical"}]
+	}
+]`
+
+func TestConsulTargetProvider(t *testing.T) {
+	// Blocking queries are answered with the next catalog sent on
+	// catalogs, or when quit is closed.
+	catalogs := make(chan string)
+	quit := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("dc") != "dc1" || q.Get("token") != "secret" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/catalog/services":
+			w.Header().Set("X-Consul-Index", "1")
+			if q.Get("index") == "" {
+				fmt.Fprint(w, `{"api": ["production", "v2", "canary"], "db": [], "consul": []}`)
+				return
+			}
+			select {
+			case c := <-catalogs:
+				fmt.Fprint(w, c)
+			case <-quit:
+				fmt.Fprint(w, `{}`)
+			}
+		case "/v1/health/service/api":
+			w.Header().Set("X-Consul-Index", "1")
+			if q.Get("index") != "" {
+				<-quit
+			}
+			fmt.Fprint(w, testConsulAPIHealth)
+		case "/v1/health/service/db":
+			w.Header().Set("X-Consul-Index", "1")
+			if q.Get("index") != "" {
+				<-quit
+			}
+			fmt.Fprint(w, `[{"Node": {"Node": "node-3", "Address": "10.0.0.3"}, "Service": {"ID": "db", "Service": "db", "Port": 5432}}]`)
+		default:
+			t.Errorf("unexpected query of %s", r.URL.Path)
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	defer close(quit)
+
+	conf, err := config.LoadFromString(`
+		job: <
+			name: "consul"
+			consul_sd: <
+				server: "` + server.Listener.Addr().String() + `"
+				datacenter: "dc1"
+				token: "secret"
+				service: "api"
+				service: "db"
+			>
+			relabel_config: <
+				source_label: "__meta_consul_tags"
+				regex: ".*,canary,.*"
+				action: DROP
+			>
+			relabel_config: <
+				source_label: "__meta_consul_metadata_rack"
+				source_label: "__meta_consul_health"
+				regex: "(.*);(.*)"
+				target_label: "rack_health"
+				replacement: "$1/$2"
+			>
+		>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewConsulTargetProvider(conf.Jobs()[0], nil)
+	if _, err := p.Targets(); err == nil {
+		t.Fatal("expected error for targets requested before the first list")
+	}
+	go p.Run()
+	defer p.Stop()
+
+	// waitForTargets waits until the provider returns targets with the
+	// expected URLs.
+	waitForTargets := func(expected []string) []Target {
+		for i := 0; i < 100; i++ {
+			targets, err := p.Targets()
+			if err == nil && reflect.DeepEqual(targetURLs(targets), expected) {
+				sort.Sort(targetsByURL(targets))
+				return targets
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		targets, err := p.Targets()
+		t.Fatalf("expected target URLs %v, got %v (error: %v)", expected, targetURLs(targets), err)
+		return nil
+	}
+
+	targets := waitForTargets([]string{"http://10.0.0.1:8080/metrics", "http://10.0.0.3:5432/metrics"})
+	expectedLabels := clientmodel.LabelSet{
+		clientmodel.JobLabel: "consul",
+		InstanceLabel:        "10.0.0.1:8080",
+		"rack_health":        "r1/warning",
+	}
+	if labels := targets[0].BaseLabels(); !reflect.DeepEqual(labels, expectedLabels) {
+		t.Errorf("expected base labels %v, got %v", expectedLabels, labels)
+	}
+
+	// Services removed from the catalog are not watched anymore.
+	catalogs <- `{"api": ["production", "v2", "canary"], "consul": []}`
+	waitForTargets([]string{"http://10.0.0.1:8080/metrics"})
+}
+
+func TestConsulEntryLabels(t *testing.T) {
+	p := &consulTargetProvider{tagSeparator: ","}
+	e := &consulServiceEntry{}
+	e.Node.Node = "node-1"
+	e.Node.Address = "10.0.0.1"
+	e.Node.Datacenter = "dc2"
+	e.Node.Meta = map[string]string{"os-version": "1.2"}
+	e.Service.ID = "api-1"
+	e.Service.Service = "api"
+	e.Service.Tags = []string{"a", "b"}
+	e.Service.Address = "10.0.1.1"
+	e.Service.Port = 80
+
+	expected := clientmodel.LabelSet{
+		"__address__":                       "10.0.1.1:80",
+		"__meta_consul_node":                "node-1",
+		"__meta_consul_address":             "10.0.0.1",
+		"__meta_consul_dc":                  "dc2",
+		"__meta_consul_service":             "api",
+		"__meta_consul_service_id":          "api-1",
+		"__meta_consul_service_address":     "10.0.1.1",
+		"__meta_consul_service_port":        "80",
+		"__meta_consul_tags":                ",a,b,",
+		"__meta_consul_health":              "passing",
+		"__meta_consul_metadata_os_version": "1.2",
+	}
+	if ls := p.entryLabels(e); !reflect.DeepEqual(ls, expected) {
+		t.Errorf("expected labels %v, got %v", expected, ls)
+	}
+}
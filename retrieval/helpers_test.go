@@ -17,6 +17,8 @@ import (
 	"time"
 
 	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage"
 )
 
 type nopAppender struct{}
@@ -38,3 +40,16 @@ type collectResultAppender struct {
 func (a *collectResultAppender) Append(s *clientmodel.Sample) {
 	a.result = append(a.result, s)
 }
+
+// appenderIngester is an extraction.Ingester appending the ingested samples
+// to a storage.SampleAppender.
+type appenderIngester struct {
+	app storage.SampleAppender
+}
+
+func (i *appenderIngester) Ingest(samples clientmodel.Samples) error {
+	for _, s := range samples {
+		i.app.Append(s)
+	}
+	return nil
+}
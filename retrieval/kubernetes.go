@@ -0,0 +1,474 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/config"
+	pb "github.com/prometheus/prometheus/config/generated"
+)
+
+const (
+	// kubernetesMetaLabelPrefix is the prefix of the meta labels of targets
+	// discovered via Kubernetes SD.
+	kubernetesMetaLabelPrefix = "__meta_kubernetes_"
+
+	kubernetesEventLabel = "event"
+)
+
+var (
+	kubernetesSDEventsCount = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "kubernetes_sd_events_total",
+			Help:      "The number of Kubernetes SD watch events by type.",
+		},
+		[]string{kubernetesEventLabel},
+	)
+	kubernetesSDFailuresCount = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "kubernetes_sd_failures_total",
+			Help:      "The number of failed attempts to list or watch Kubernetes objects.",
+		})
+)
+
+func init() {
+	prometheus.MustRegister(kubernetesSDEventsCount)
+	prometheus.MustRegister(kubernetesSDFailuresCount)
+}
+
+// The subset of the Kubernetes API objects needed to discover targets.
+type kubernetesObjectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace"`
+	ResourceVersion string            `json:"resourceVersion"`
+	Labels          map[string]string `json:"labels"`
+	Annotations     map[string]string `json:"annotations"`
+}
+
+type kubernetesPod struct {
+	Metadata kubernetesObjectMeta `json:"metadata"`
+	Spec     struct {
+		NodeName   string `json:"nodeName"`
+		Containers []struct {
+			Name  string `json:"name"`
+			Ports []struct {
+				Name          string `json:"name"`
+				ContainerPort int    `json:"containerPort"`
+			} `json:"ports"`
+		} `json:"containers"`
+	} `json:"spec"`
+	Status struct {
+		Phase string `json:"phase"`
+		PodIP string `json:"podIP"`
+	} `json:"status"`
+}
+
+type kubernetesService struct {
+	Metadata kubernetesObjectMeta `json:"metadata"`
+	Spec     struct {
+		Ports []struct {
+			Name string `json:"name"`
+			Port int    `json:"port"`
+		} `json:"ports"`
+	} `json:"spec"`
+}
+
+type kubernetesEndpointAddress struct {
+	IP        string `json:"ip"`
+	TargetRef *struct {
+		Kind string `json:"kind"`
+		Name string `json:"name"`
+	} `json:"targetRef"`
+}
+
+type kubernetesEndpoints struct {
+	Metadata kubernetesObjectMeta `json:"metadata"`
+	Subsets  []struct {
+		Addresses         []kubernetesEndpointAddress `json:"addresses"`
+		NotReadyAddresses []kubernetesEndpointAddress `json:"notReadyAddresses"`
+		Ports             []struct {
+			Name string `json:"name"`
+			Port int    `json:"port"`
+		} `json:"ports"`
+	} `json:"subsets"`
+}
+
+type kubernetesList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []json.RawMessage `json:"items"`
+}
+
+type kubernetesEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// kubernetesObjectDecoder decodes a Kubernetes API object. It returns the key
+// identifying the object and the label sets of the targets discovered from
+// it.
+type kubernetesObjectDecoder func(json.RawMessage) (key string, targets []clientmodel.LabelSet, err error)
+
+// kubernetesTargetProvider discovers the targets of a job by watching the
+// Kubernetes API server for changes of pods, services, or endpoints.
+type kubernetesTargetProvider struct {
+	job            config.JobConfig
+	globalLabels   clientmodel.LabelSet
+	relabelConfigs []*config.RelabelConfig
+
+	url             string
+	bearerTokenFile string
+	transport       *http.Transport
+	retryInterval   time.Duration
+	decode          kubernetesObjectDecoder
+
+	// Protects the fields below.
+	mtx sync.RWMutex
+	// The label sets of the discovered targets by object key.
+	objects map[string][]clientmodel.LabelSet
+	// Whether the objects have been listed successfully at least once.
+	listed bool
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// NewKubernetesTargetProvider constructs a new kubernetesTargetProvider for a
+// job. Discovery starts once Run is called.
+func NewKubernetesTargetProvider(job config.JobConfig, globalLabels clientmodel.LabelSet) (*kubernetesTargetProvider, error) {
+	conf := job.GetKubernetesSd()
+
+	tlsConfig := &tls.Config{}
+	if conf.CaFile != nil {
+		caCert, err := ioutil.ReadFile(conf.GetCaFile())
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA file: %s", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", conf.GetCaFile())
+		}
+	}
+
+	var resource string
+	var decode kubernetesObjectDecoder
+	switch conf.GetRole() {
+	case pb.KubernetesSDConfig_POD:
+		resource, decode = "pods", decodeKubernetesPod
+	case pb.KubernetesSDConfig_SERVICE:
+		resource, decode = "services", decodeKubernetesService
+	default:
+		resource, decode = "endpoints", decodeKubernetesEndpoints
+	}
+	path := "/api/v1/" + resource
+	if ns := conf.GetNamespace(); ns != "" {
+		path = "/api/v1/namespaces/" + url.QueryEscape(ns) + "/" + resource
+	}
+
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: tlsConfig,
+	}
+	return &kubernetesTargetProvider{
+		job:             job,
+		globalLabels:    globalLabels,
+		relabelConfigs:  job.RelabelConfigs(),
+		url:             strings.TrimRight(conf.GetApiServer(), "/") + path,
+		bearerTokenFile: conf.GetBearerTokenFile(),
+		transport:       transport,
+		retryInterval:   job.KubernetesRetryInterval(),
+		decode:          decode,
+		objects:         map[string][]clientmodel.LabelSet{},
+		stop:            make(chan struct{}),
+		stopped:         make(chan struct{}),
+	}, nil
+}
+
+// Run lists and watches the objects to discover targets from until Stop is
+// called. After failures, the objects are listed again after the retry
+// interval. Run is usually called as a goroutine.
+func (p *kubernetesTargetProvider) Run() {
+	defer close(p.stopped)
+
+	for {
+		resourceVersion, err := p.list()
+		if err == nil {
+			err = p.watch(resourceVersion)
+		}
+		select {
+		case <-p.stop:
+			return
+		default:
+		}
+		if err != nil {
+			kubernetesSDFailuresCount.Inc()
+			glog.Errorf("Error discovering Kubernetes targets for job %s, retrying in %v: %s", p.job.GetName(), p.retryInterval, err)
+			select {
+			case <-time.After(p.retryInterval):
+			case <-p.stop:
+				return
+			}
+		}
+	}
+}
+
+// Stop stops watching the Kubernetes API server and returns once Run has
+// returned.
+func (p *kubernetesTargetProvider) Stop() {
+	close(p.stop)
+	<-p.stopped
+}
+
+// get requests the given URL from the API server. The request is canceled
+// once Stop is called.
+func (p *kubernetesTargetProvider) get(u string) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if p.bearerTokenFile != "" {
+		// Read the token for each request, as it may be rotated.
+		token, err := ioutil.ReadFile(p.bearerTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read bearer token file: %s", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := getCancelable(p.transport, req, p.stop)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// list replaces the known objects by the ones currently present. It returns
+// the resource version to start watching from.
+func (p *kubernetesTargetProvider) list() (string, error) {
+	body, err := p.get(p.url)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	var list kubernetesList
+	if err := json.NewDecoder(body).Decode(&list); err != nil {
+		return "", err
+	}
+	objects := make(map[string][]clientmodel.LabelSet, len(list.Items))
+	for _, item := range list.Items {
+		key, targets, err := p.decode(item)
+		if err != nil {
+			return "", err
+		}
+		objects[key] = targets
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.objects = objects
+	p.listed = true
+	return list.Metadata.ResourceVersion, nil
+}
+
+// watch applies the changes of objects after the given resource version until
+// the API server ends the watch.
+func (p *kubernetesTargetProvider) watch(resourceVersion string) error {
+	body, err := p.get(p.url + "?watch=true&resourceVersion=" + url.QueryEscape(resourceVersion))
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	dec := json.NewDecoder(body)
+	for {
+		var event kubernetesEvent
+		if err := dec.Decode(&event); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		kubernetesSDEventsCount.WithLabelValues(event.Type).Inc()
+		if event.Type == "ERROR" {
+			return fmt.Errorf("watch failed: %s", event.Object)
+		}
+		key, targets, err := p.decode(event.Object)
+		if err != nil {
+			return err
+		}
+		p.mtx.Lock()
+		if event.Type == "DELETED" {
+			delete(p.objects, key)
+		} else {
+			p.objects[key] = targets
+		}
+		p.mtx.Unlock()
+	}
+}
+
+// Targets implements TargetProvider.
+func (p *kubernetesTargetProvider) Targets() ([]Target, error) {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	if !p.listed {
+		return nil, fmt.Errorf("Kubernetes objects not listed yet")
+	}
+
+	targets := []Target{}
+	for _, labelSets := range p.objects {
+		for _, ls := range labelSets {
+			if t := discoveredTarget(p.job, p.globalLabels, p.relabelConfigs, ls); t != nil {
+				targets = append(targets, t)
+			}
+		}
+	}
+	return targets, nil
+}
+
+// kubernetesLabelName returns the name of a meta label.
+func kubernetesLabelName(name string) clientmodel.LabelName {
+	return sanitizedLabelName(kubernetesMetaLabelPrefix + name)
+}
+
+// objectLabels returns the meta labels derived from the namespace, labels and
+// annotations of an object. The kind is used as prefix for labels and
+// annotations.
+func (m *kubernetesObjectMeta) objectLabels(kind string) clientmodel.LabelSet {
+	ls := clientmodel.LabelSet{
+		kubernetesLabelName("namespace"): clientmodel.LabelValue(m.Namespace),
+	}
+	for n, v := range m.Labels {
+		ls[kubernetesLabelName(kind+"_label_"+n)] = clientmodel.LabelValue(v)
+	}
+	for n, v := range m.Annotations {
+		ls[kubernetesLabelName(kind+"_annotation_"+n)] = clientmodel.LabelValue(v)
+	}
+	return ls
+}
+
+func (m *kubernetesObjectMeta) key() string {
+	return m.Namespace + "/" + m.Name
+}
+
+func hostPort(host string, port int) clientmodel.LabelValue {
+	return clientmodel.LabelValue(host + ":" + strconv.Itoa(port))
+}
+
+func decodeKubernetesPod(raw json.RawMessage) (string, []clientmodel.LabelSet, error) {
+	var pod kubernetesPod
+	if err := json.Unmarshal(raw, &pod); err != nil {
+		return "", nil, err
+	}
+	// Pods without IP are not scheduled yet, and pods in a final phase do
+	// not run anymore.
+	if pod.Status.PodIP == "" || pod.Status.Phase == "Succeeded" || pod.Status.Phase == "Failed" {
+		return pod.Metadata.key(), nil, nil
+	}
+
+	base := pod.Metadata.objectLabels("pod")
+	base[kubernetesLabelName("pod_name")] = clientmodel.LabelValue(pod.Metadata.Name)
+	base[kubernetesLabelName("pod_ip")] = clientmodel.LabelValue(pod.Status.PodIP)
+	base[kubernetesLabelName("pod_node_name")] = clientmodel.LabelValue(pod.Spec.NodeName)
+
+	var targets []clientmodel.LabelSet
+	for _, c := range pod.Spec.Containers {
+		for _, port := range c.Ports {
+			targets = append(targets, base.Merge(clientmodel.LabelSet{
+				addressLabel: hostPort(pod.Status.PodIP, port.ContainerPort),
+				kubernetesLabelName("pod_container_name"):      clientmodel.LabelValue(c.Name),
+				kubernetesLabelName("pod_container_port_name"): clientmodel.LabelValue(port.Name),
+			}))
+		}
+	}
+	if targets == nil {
+		base[addressLabel] = clientmodel.LabelValue(pod.Status.PodIP)
+		targets = append(targets, base)
+	}
+	return pod.Metadata.key(), targets, nil
+}
+
+func decodeKubernetesService(raw json.RawMessage) (string, []clientmodel.LabelSet, error) {
+	var svc kubernetesService
+	if err := json.Unmarshal(raw, &svc); err != nil {
+		return "", nil, err
+	}
+	base := svc.Metadata.objectLabels("service")
+	base[kubernetesLabelName("service_name")] = clientmodel.LabelValue(svc.Metadata.Name)
+
+	host := svc.Metadata.Name + "." + svc.Metadata.Namespace + ".svc"
+	targets := make([]clientmodel.LabelSet, 0, len(svc.Spec.Ports))
+	for _, port := range svc.Spec.Ports {
+		targets = append(targets, base.Merge(clientmodel.LabelSet{
+			addressLabel:                             hostPort(host, port.Port),
+			kubernetesLabelName("service_port_name"): clientmodel.LabelValue(port.Name),
+		}))
+	}
+	return svc.Metadata.key(), targets, nil
+}
+
+func decodeKubernetesEndpoints(raw json.RawMessage) (string, []clientmodel.LabelSet, error) {
+	var eps kubernetesEndpoints
+	if err := json.Unmarshal(raw, &eps); err != nil {
+		return "", nil, err
+	}
+	base := clientmodel.LabelSet{
+		kubernetesLabelName("namespace"):      clientmodel.LabelValue(eps.Metadata.Namespace),
+		kubernetesLabelName("endpoints_name"): clientmodel.LabelValue(eps.Metadata.Name),
+	}
+
+	var targets []clientmodel.LabelSet
+	add := func(addr kubernetesEndpointAddress, port int, portName string, ready bool) {
+		ls := base.Merge(clientmodel.LabelSet{
+			addressLabel: hostPort(addr.IP, port),
+			kubernetesLabelName("endpoint_port_name"): clientmodel.LabelValue(portName),
+			kubernetesLabelName("endpoint_ready"):     clientmodel.LabelValue(strconv.FormatBool(ready)),
+		})
+		if addr.TargetRef != nil && addr.TargetRef.Kind == "Pod" {
+			ls[kubernetesLabelName("pod_name")] = clientmodel.LabelValue(addr.TargetRef.Name)
+		}
+		targets = append(targets, ls)
+	}
+	for _, subset := range eps.Subsets {
+		for _, port := range subset.Ports {
+			for _, addr := range subset.Addresses {
+				add(addr, port.Port, port.Name, true)
+			}
+			for _, addr := range subset.NotReadyAddresses {
+				add(addr, port.Port, port.Name, false)
+			}
+		}
+	}
+	return eps.Metadata.key(), targets, nil
+}
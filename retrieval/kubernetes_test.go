@@ -0,0 +1,226 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/config"
+)
+
+const testKubernetesPods = `{
+	"kind": "PodList",
+	"metadata": {"resourceVersion": "42"},
+	"items": [
+		{
+			"metadata": {"name": "pod-a", "namespace": "default", "annotations": {"prometheus.io/scrape": "true"}},
+			"spec": {"nodeName": "node-1", "containers": [{"name": "app", "ports": [{"name": "metrics", "containerPort": 9100}]}]},
+			"status": {"phase": "Running", "podIP": "10.0.0.1"}
+		},
+		{
+			"metadata": {"name": "pod-b", "namespace": "default", "annotations": {"prometheus.io/scrape": "false"}},
+			"spec": {"nodeName": "node-1", "containers": [{"name": "app", "ports": [{"containerPort": 80}]}]},
+			"status": {"phase": "Running", "podIP": "10.0.0.2"}
+		},
+		{
+			"metadata": {"name": "pod-c", "namespace": "default", "annotations": {"prometheus.io/scrape": "true"}},
+			"spec": {"containers": [{"name": "app"}]},
+			"status": {"phase": "Pending"}
+		}
+	]
+}`
+
+const testKubernetesPodEvents = `{"type": "DELETED", "object": {"metadata": {"name": "pod-a", "namespace": "default"}}}
+{"type": "ADDED", "object": {"metadata": {"name": "pod-d", "namespace": "default", "annotations": {"prometheus.io/scrape": "true"}}, "spec": {"containers": [{"name": "app"}]}, "status": {"phase": "Running", "podIP": "10.0.0.4"}}}
+`
+
+func targetURLs(targets []Target) []string {
+	urls := []string{}
+	for _, t := range targets {
+		urls = append(urls, t.URL())
+	}
+	sort.Strings(urls)
+	return urls
+}
+
+func TestKubernetesTargetProvider(t *testing.T) {
+	tokenFile, err := ioutil.TempFile("", "kubernetes_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tokenFile.Name())
+	fmt.Fprintln(tokenFile, "secret")
+	tokenFile.Close()
+
+	events := make(chan string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/api/v1/namespaces/default/pods" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("watch") != "true" {
+			fmt.Fprint(w, testKubernetesPods)
+			return
+		}
+		if rv := r.URL.Query().Get("resourceVersion"); rv != "42" {
+			t.Errorf("expected watch from resource version 42, got %q", rv)
+		}
+		w.(http.Flusher).Flush()
+		for e := range events {
+			fmt.Fprint(w, e)
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer server.Close()
+
+	conf, err := config.LoadFromString(`
+		job: <
+			name: "kubernetes"
+			kubernetes_sd: <
+				api_server: "` + server.URL + `"
+				role: POD
+				namespace: "default"
+				bearer_token_file: "` + tokenFile.Name() + `"
+			>
+			relabel_config: <
+				source_label: "__meta_kubernetes_pod_annotation_prometheus_io_scrape"
+				regex: "true"
+				action: KEEP
+			>
+			relabel_config: <
+				source_label: "__meta_kubernetes_pod_name"
+				source_label: "__meta_kubernetes_pod_container_port_name"
+				regex: "(.*);(.*)"
+				target_label: "pod"
+				replacement: "$1$2"
+			>
+		>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewKubernetesTargetProvider(conf.Jobs()[0], clientmodel.LabelSet{"zone": "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Targets(); err == nil {
+		t.Fatal("expected error for targets requested before the first list")
+	}
+	go p.Run()
+	defer func() {
+		close(events)
+		p.Stop()
+	}()
+
+	// waitForTargets waits until the provider returns targets with the
+	// expected URLs.
+	waitForTargets := func(expected []string) []Target {
+		for i := 0; i < 100; i++ {
+			targets, err := p.Targets()
+			if err == nil && reflect.DeepEqual(targetURLs(targets), expected) {
+				return targets
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		targets, err := p.Targets()
+		t.Fatalf("expected target URLs %v, got %v (error: %v)", expected, targetURLs(targets), err)
+		return nil
+	}
+
+	targets := waitForTargets([]string{"http://10.0.0.1:9100/metrics"})
+	expectedLabels := clientmodel.LabelSet{
+		clientmodel.JobLabel: "kubernetes",
+		InstanceLabel:        "10.0.0.1:9100",
+		"zone":               "a",
+		"pod":                "pod-ametrics",
+	}
+	if labels := targets[0].BaseLabels(); !reflect.DeepEqual(labels, expectedLabels) {
+		t.Errorf("expected base labels %v, got %v", expectedLabels, labels)
+	}
+
+	events <- testKubernetesPodEvents
+	waitForTargets([]string{"http://10.0.0.4/metrics"})
+}
+
+func TestDecodeKubernetesEndpoints(t *testing.T) {
+	_, targets, err := decodeKubernetesEndpoints([]byte(`{
+		"metadata": {"name": "api", "namespace": "prod"},
+		"subsets": [{
+			"addresses": [{"ip": "10.0.0.1", "targetRef": {"kind": "Pod", "name": "api-1"}}],
+			"notReadyAddresses": [{"ip": "10.0.0.2"}],
+			"ports": [{"name": "http", "port": 8080}]
+		}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []clientmodel.LabelSet{
+		{
+			"__address__":                          "10.0.0.1:8080",
+			"__meta_kubernetes_namespace":          "prod",
+			"__meta_kubernetes_endpoints_name":     "api",
+			"__meta_kubernetes_endpoint_port_name": "http",
+			"__meta_kubernetes_endpoint_ready":     "true",
+			"__meta_kubernetes_pod_name":           "api-1",
+		},
+		{
+			"__address__":                          "10.0.0.2:8080",
+			"__meta_kubernetes_namespace":          "prod",
+			"__meta_kubernetes_endpoints_name":     "api",
+			"__meta_kubernetes_endpoint_port_name": "http",
+			"__meta_kubernetes_endpoint_ready":     "false",
+		},
+	}
+	if !reflect.DeepEqual(targets, expected) {
+		t.Errorf("expected targets %v, got %v", expected, targets)
+	}
+}
+
+func TestDecodeKubernetesService(t *testing.T) {
+	key, targets, err := decodeKubernetesService([]byte(`{
+		"metadata": {"name": "api", "namespace": "prod", "labels": {"tier": "backend"}},
+		"spec": {"ports": [{"name": "http", "port": 80}]}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "prod/api" {
+		t.Errorf("expected key prod/api, got %s", key)
+	}
+	expected := []clientmodel.LabelSet{
+		{
+			"__address__":                          "api.prod.svc:80",
+			"__meta_kubernetes_namespace":          "prod",
+			"__meta_kubernetes_service_name":       "api",
+			"__meta_kubernetes_service_port_name":  "http",
+			"__meta_kubernetes_service_label_tier": "backend",
+		},
+	}
+	if !reflect.DeepEqual(targets, expected) {
+		t.Errorf("expected targets %v, got %v", expected, targets)
+	}
+}
@@ -0,0 +1,267 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/extraction"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+const (
+	openMetricsMediaType = "application/openmetrics-text"
+	// The number of samples ingested at once while decoding OpenMetrics.
+	openMetricsBatchSize = 100
+	// The maximum length of a line in the OpenMetrics format.
+	openMetricsMaxLineLength = 1 << 20
+)
+
+var openMetricsTypes = map[string]bool{
+	"counter":        true,
+	"gauge":          true,
+	"histogram":      true,
+	"gaugehistogram": true,
+	"summary":        true,
+	"info":           true,
+	"stateset":       true,
+	"unknown":        true,
+}
+
+// processorForResponseHeader returns the processor decoding the exposition
+// format of a scrape response with the given header. Besides the formats
+// supported by the extraction package, it supports the OpenMetrics text
+// format.
+func processorForResponseHeader(header http.Header) (extraction.Processor, error) {
+	mediatype, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || mediatype != openMetricsMediaType {
+		return extraction.ProcessorForRequestHeader(header)
+	}
+	switch params["version"] {
+	case "", "0.0.1", "1.0.0":
+		return openMetricsProcessor{}, nil
+	default:
+		return nil, fmt.Errorf("unrecognized OpenMetrics version %s", params["version"])
+	}
+}
+
+// openMetricsProcessor decodes the OpenMetrics text format. The metadata in
+// HELP, TYPE, and UNIT lines is checked for syntax but otherwise ignored, as
+// are exemplars. Timestamps are given in seconds.
+type openMetricsProcessor struct{}
+
+// ProcessSingle implements extraction.Processor.
+func (openMetricsProcessor) ProcessSingle(in io.Reader, out extraction.Ingester, o *extraction.ProcessOptions) error {
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(nil, openMetricsMaxLineLength)
+
+	samples := make(clientmodel.Samples, 0, openMetricsBatchSize)
+	eof := false
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if eof {
+			return fmt.Errorf("line %d: data after # EOF", lineNo)
+		}
+		if line == "# EOF" {
+			eof = true
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			if err := checkOpenMetricsDescriptor(line); err != nil {
+				return fmt.Errorf("line %d: %s", lineNo, err)
+			}
+			continue
+		}
+		s, err := parseOpenMetricsSample(line, o.Timestamp)
+		if err != nil {
+			return fmt.Errorf("line %d: %s", lineNo, err)
+		}
+		samples = append(samples, s)
+		if len(samples) == openMetricsBatchSize {
+			if err := out.Ingest(samples); err != nil {
+				return err
+			}
+			samples = make(clientmodel.Samples, 0, openMetricsBatchSize)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(samples) > 0 {
+		if err := out.Ingest(samples); err != nil {
+			return err
+		}
+	}
+	if !eof {
+		return errors.New("missing # EOF")
+	}
+	return nil
+}
+
+// checkOpenMetricsDescriptor checks the syntax of a HELP, TYPE, or UNIT line.
+func checkOpenMetricsDescriptor(line string) error {
+	fields := strings.SplitN(line, " ", 4)
+	if len(fields) < 3 || fields[0] != "#" {
+		return fmt.Errorf("invalid descriptor %q", line)
+	}
+	if !isMetricName(fields[2]) {
+		return fmt.Errorf("invalid metric name %q", fields[2])
+	}
+	switch fields[1] {
+	case "HELP", "UNIT":
+		return nil
+	case "TYPE":
+		if len(fields) != 4 || !openMetricsTypes[fields[3]] {
+			return fmt.Errorf("invalid metric type in %q", line)
+		}
+		return nil
+	default:
+		return fmt.Errorf("invalid descriptor %q", line)
+	}
+}
+
+// parseOpenMetricsSample parses a line holding a sample with an optional
+// timestamp in seconds and an optional exemplar. Samples without timestamp
+// get the default timestamp.
+func parseOpenMetricsSample(line string, defaultTimestamp clientmodel.Timestamp) (*clientmodel.Sample, error) {
+	i := 0
+	for i < len(line) && isMetricNameChar(line[i], i == 0) {
+		i++
+	}
+	if i == 0 {
+		return nil, fmt.Errorf("invalid metric name in %q", line)
+	}
+	metric := clientmodel.Metric{clientmodel.MetricNameLabel: clientmodel.LabelValue(line[:i])}
+
+	rest := line[i:]
+	if strings.HasPrefix(rest, "{") {
+		var err error
+		if rest, err = parseOpenMetricsLabels(rest[1:], metric); err != nil {
+			return nil, err
+		}
+	}
+	if !strings.HasPrefix(rest, " ") {
+		return nil, fmt.Errorf("missing value in %q", line)
+	}
+
+	fields := strings.Fields(rest)
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value in %q", line)
+	}
+	timestamp := defaultTimestamp
+	fields = fields[1:]
+	if len(fields) > 0 && fields[0] != "#" {
+		ts, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timestamp in %q", line)
+		}
+		timestamp = clientmodel.TimestampFromUnixNano(int64(ts * 1e9))
+		fields = fields[1:]
+	}
+	// Anything left must be an exemplar, which is ignored.
+	if len(fields) > 0 && (fields[0] != "#" || len(fields) < 3) {
+		return nil, fmt.Errorf("invalid exemplar in %q", line)
+	}
+
+	return &clientmodel.Sample{
+		Metric:    metric,
+		Value:     clientmodel.SampleValue(value),
+		Timestamp: timestamp,
+	}, nil
+}
+
+// parseOpenMetricsLabels parses the labels following the opening brace into
+// the metric and returns the remainder of the line after the closing brace.
+func parseOpenMetricsLabels(s string, metric clientmodel.Metric) (string, error) {
+	for {
+		if strings.HasPrefix(s, "}") {
+			return s[1:], nil
+		}
+		i := 0
+		for i < len(s) && isLabelNameChar(s[i], i == 0) {
+			i++
+		}
+		if i == 0 || !strings.HasPrefix(s[i:], `="`) {
+			return "", errors.New("invalid label")
+		}
+		name := clientmodel.LabelName(s[:i])
+		s = s[i+2:]
+
+		var value []byte
+		for {
+			if len(s) == 0 {
+				return "", fmt.Errorf("unterminated value of label %s", name)
+			}
+			c := s[0]
+			s = s[1:]
+			if c == '"' {
+				break
+			}
+			if c == '\\' {
+				if len(s) == 0 {
+					return "", fmt.Errorf("unterminated value of label %s", name)
+				}
+				switch s[0] {
+				case '\\', '"':
+					c = s[0]
+				case 'n':
+					c = '\n'
+				default:
+					return "", fmt.Errorf("invalid escape sequence in value of label %s", name)
+				}
+				s = s[1:]
+			}
+			value = append(value, c)
+		}
+		if _, ok := metric[name]; ok {
+			return "", fmt.Errorf("duplicate label %s", name)
+		}
+		metric[name] = clientmodel.LabelValue(value)
+
+		if strings.HasPrefix(s, ",") {
+			s = s[1:]
+		} else if !strings.HasPrefix(s, "}") {
+			return "", errors.New("invalid label separator")
+		}
+	}
+}
+
+func isMetricName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isMetricNameChar(s[i], i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func isMetricNameChar(c byte, first bool) bool {
+	return isLabelNameChar(c, first) || c == ':'
+}
+
+func isLabelNameChar(c byte, first bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
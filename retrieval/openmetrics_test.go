@@ -0,0 +1,199 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/extraction"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+func TestOpenMetricsProcessor(t *testing.T) {
+	in := `# TYPE http_requests counter
+# UNIT http_requests requests
+# HELP http_requests The total number of "requests".
+http_requests_total{method="post",code="200"} 1027 1395066363.5 # {trace_id="KOO5S4vxi0o"} 0.67
+http_requests_total{method="post",code="400"} 3 1395066363
+http_requests_created{method="post",code="200"} 1395066000
+# TYPE rpc_duration_seconds histogram
+rpc_duration_seconds_bucket{le="0.5"} 12
+rpc_duration_seconds_bucket{le="+Inf"} 15 # {} 7.5
+rpc_duration_seconds_sum -Inf
+rpc_duration_seconds_count NaN
+# TYPE escaped gauge
+escaped{path="C:\\dir\\",quote="\"",newline="\n",empty=""} 1
+# EOF
+`
+	now := clientmodel.TimestampFromUnix(1400000000)
+	want := clientmodel.Samples{
+		{
+			Metric:    clientmodel.Metric{clientmodel.MetricNameLabel: "http_requests_total", "method": "post", "code": "200"},
+			Value:     1027,
+			Timestamp: clientmodel.TimestampFromUnixNano(1395066363500000000),
+		},
+		{
+			Metric:    clientmodel.Metric{clientmodel.MetricNameLabel: "http_requests_total", "method": "post", "code": "400"},
+			Value:     3,
+			Timestamp: clientmodel.TimestampFromUnix(1395066363),
+		},
+		{
+			Metric:    clientmodel.Metric{clientmodel.MetricNameLabel: "http_requests_created", "method": "post", "code": "200"},
+			Value:     1395066000,
+			Timestamp: now,
+		},
+		{
+			Metric:    clientmodel.Metric{clientmodel.MetricNameLabel: "rpc_duration_seconds_bucket", "le": "0.5"},
+			Value:     12,
+			Timestamp: now,
+		},
+		{
+			Metric:    clientmodel.Metric{clientmodel.MetricNameLabel: "rpc_duration_seconds_bucket", "le": "+Inf"},
+			Value:     15,
+			Timestamp: now,
+		},
+		{
+			Metric:    clientmodel.Metric{clientmodel.MetricNameLabel: "rpc_duration_seconds_sum"},
+			Value:     clientmodel.SampleValue(math.Inf(-1)),
+			Timestamp: now,
+		},
+		{
+			Metric:    clientmodel.Metric{clientmodel.MetricNameLabel: "rpc_duration_seconds_count"},
+			Value:     clientmodel.SampleValue(math.NaN()),
+			Timestamp: now,
+		},
+		{
+			Metric:    clientmodel.Metric{clientmodel.MetricNameLabel: "escaped", "path": `C:\dir\`, "quote": `"`, "newline": "\n", "empty": ""},
+			Value:     1,
+			Timestamp: now,
+		},
+	}
+
+	app := &collectResultAppender{}
+	ingester := &appenderIngester{app}
+	if err := (openMetricsProcessor{}).ProcessSingle(strings.NewReader(in), ingester, &extraction.ProcessOptions{Timestamp: now}); err != nil {
+		t.Fatal(err)
+	}
+	if len(app.result) != len(want) {
+		t.Fatalf("expected %d samples, got %d: %v", len(want), len(app.result), app.result)
+	}
+	for i, s := range app.result {
+		// NaN is not equal to itself.
+		if math.IsNaN(float64(want[i].Value)) && math.IsNaN(float64(s.Value)) {
+			s.Value, want[i].Value = 0, 0
+		}
+		if !s.Equal(want[i]) {
+			t.Errorf("%d. expected sample %v, got %v", i, want[i], s)
+		}
+	}
+}
+
+func TestOpenMetricsProcessorErrors(t *testing.T) {
+	scenarios := []struct {
+		in  string
+		err string
+	}{
+		{
+			in:  "metric 1\n",
+			err: "missing # EOF",
+		},
+		{
+			in:  "metric 1\n# EOF\nmetric 2\n",
+			err: "line 3: data after # EOF",
+		},
+		{
+			in:  "# TYPE metric counters\n# EOF\n",
+			err: `line 1: invalid metric type in "# TYPE metric counters"`,
+		},
+		{
+			in:  "# a comment\n# EOF\n",
+			err: `line 1: invalid descriptor "# a comment"`,
+		},
+		{
+			in:  "metric{a=\"1\",a=\"2\"} 1\n# EOF\n",
+			err: "line 1: duplicate label a",
+		},
+		{
+			in:  "metric{a=\"\\t\"} 1\n# EOF\n",
+			err: "line 1: invalid escape sequence in value of label a",
+		},
+		{
+			in:  "metric{a=\"1} 1\n# EOF\n",
+			err: "line 1: unterminated value of label a",
+		},
+		{
+			in:  "metric{a=1} 1\n# EOF\n",
+			err: "line 1: invalid label",
+		},
+		{
+			in:  "metric one\n# EOF\n",
+			err: `line 1: invalid value in "metric one"`,
+		},
+		{
+			in:  "metric 1 now\n# EOF\n",
+			err: `line 1: invalid timestamp in "metric 1 now"`,
+		},
+		{
+			in:  "metric 1 1 1\n# EOF\n",
+			err: `line 1: invalid exemplar in "metric 1 1 1"`,
+		},
+		{
+			in:  "0metric 1\n# EOF\n",
+			err: `line 1: invalid metric name in "0metric 1"`,
+		},
+	}
+
+	for i, s := range scenarios {
+		err := (openMetricsProcessor{}).ProcessSingle(strings.NewReader(s.in), &appenderIngester{nopAppender{}}, &extraction.ProcessOptions{})
+		if err == nil || err.Error() != s.err {
+			t.Errorf("%d. expected error %q, got %v", i, s.err, err)
+		}
+	}
+}
+
+func TestProcessorForResponseHeader(t *testing.T) {
+	scenarios := []struct {
+		contentType string
+		openMetrics bool
+		fail        bool
+	}{
+		{contentType: "application/openmetrics-text; version=1.0.0; charset=utf-8", openMetrics: true},
+		{contentType: "application/openmetrics-text; version=0.0.1", openMetrics: true},
+		{contentType: "application/openmetrics-text; version=2.0.0", fail: true},
+		{contentType: "application/vnd.google.protobuf; proto=io.prometheus.client.MetricFamily; encoding=delimited"},
+		{contentType: "text/plain; version=0.0.4"},
+		{contentType: "text/html", fail: true},
+	}
+
+	for i, s := range scenarios {
+		p, err := processorForResponseHeader(http.Header{"Content-Type": {s.contentType}})
+		if s.fail {
+			if err == nil {
+				t.Errorf("%d. expected error for %q, got none", i, s.contentType)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d. unexpected error for %q: %s", i, s.contentType, err)
+			continue
+		}
+		if _, ok := p.(openMetricsProcessor); ok != s.openMetrics {
+			t.Errorf("%d. got processor %T for %q", i, p, s.contentType)
+		}
+	}
+}
@@ -16,7 +16,8 @@ package retrieval
 import (
 	"errors"
 	"fmt"
-	"math/rand"
+	"hash/fnv"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
@@ -30,6 +31,8 @@ import (
 
 	clientmodel "github.com/prometheus/client_golang/model"
 
+	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/relabel"
 	"github.com/prometheus/prometheus/storage"
 	"github.com/prometheus/prometheus/utility"
 )
@@ -45,6 +48,10 @@ const (
 	scrapeDurationMetricName clientmodel.LabelValue = "scrape_duration_seconds"
 	// Capacity of the channel to buffer samples during ingestion.
 	ingestedSamplesCap = 256
+	// After consecutive failed scrapes, scrapes of a target are attempted
+	// exponentially less often, but at least once within this duration.
+	// The health of the target is still recorded at the nominal interval.
+	maxScrapeBackoff = 5 * time.Minute
 
 	// Constants for instrumentation.
 	namespace = "prometheus"
@@ -53,6 +60,7 @@ const (
 
 var (
 	errIngestChannelFull = errors.New("ingestion channel full")
+	errSampleLimit       = errors.New("sample limit exceeded")
 
 	localhostRepresentations = []string{"http://127.0.0.1", "http://localhost"}
 
@@ -65,10 +73,26 @@ var (
 		},
 		[]string{interval},
 	)
+	targetDroppedSamples = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "target_relabel_dropped_samples_total",
+			Help:      "The number of scraped samples dropped by metric relabeling.",
+		},
+	)
+	targetSampleLimitExceeded = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "target_scrapes_exceeded_sample_limit_total",
+			Help:      "The number of scrapes that failed because they yielded more samples than the sample limit.",
+		},
+	)
 )
 
 func init() {
 	prometheus.MustRegister(targetIntervalLength)
+	prometheus.MustRegister(targetDroppedSamples)
+	prometheus.MustRegister(targetSampleLimitExceeded)
 }
 
 // TargetState describes the state of a Target.
@@ -115,6 +139,8 @@ type Target interface {
 	State() TargetState
 	// Return the last time a scrape was attempted.
 	LastScrape() time.Time
+	// Return how long the last scrape took.
+	LastScrapeDuration() time.Duration
 	// The URL to which the Target corresponds.  Out of all of the available
 	// points in this interface, this one is the best candidate to change given
 	// the ways to express the endpoint.
@@ -151,6 +177,12 @@ type target struct {
 	lastError error
 	// The last time a scrape was attempted.
 	lastScrape time.Time
+	// How long the last scrape took.
+	lastScrapeDuration time.Duration
+	// The number of consecutive failed scrapes and the number of upcoming
+	// scrapes to skip because of them. Only accessed in the goroutine
+	// running the RunScraper loop.
+	consecutiveFailures, scrapesToSkip int
 	// Closing scraperStopping signals that scraping should stop.
 	scraperStopping chan struct{}
 	// Closing scraperStopped signals that scraping has been stopped.
@@ -165,26 +197,66 @@ type target struct {
 	deadline time.Duration
 	// Any base labels that are added to this target and its metrics.
 	baseLabels clientmodel.LabelSet
+	// The relabel configurations applied to the scraped series.
+	metricRelabelConfigs []*config.RelabelConfig
+	// The maximum number of samples accepted per scrape, or 0.
+	sampleLimit int
+	// Whether scraped labels win over conflicting base labels.
+	honorLabels bool
+	// Added to the offset of the scrapes within the scrape interval.
+	scrapeOffset time.Duration
 	// The HTTP client used to scrape the target's endpoint.
 	httpClient *http.Client
 
-	// Mutex protects lastError, lastScrape, state, and baseLabels.  Writing
-	// the above must only happen in the goroutine running the RunScraper
-	// loop, and it must happen under the lock. In that way, no mutex lock
-	// is required for reading the above in the goroutine running the
-	// RunScraper loop, but only for reading in other goroutines.
+	// Mutex protects lastError, lastScrape, lastScrapeDuration, state, and
+	// baseLabels.  Writing the above must only happen in the goroutine
+	// running the RunScraper loop, and it must happen under the lock. In
+	// that way, no mutex lock is required for reading the above in the
+	// goroutine running the RunScraper loop, but only for reading in other
+	// goroutines.
 	sync.Mutex
 }
 
+// TargetOptions are the settings of a target besides its URL and base labels.
+type TargetOptions struct {
+	// The timeout of each scrape.
+	Deadline time.Duration
+	// The HTTP client to scrape the target with. If nil, a client without
+	// authentication that times out after the deadline is used.
+	HTTPClient *http.Client
+	// The relabel configurations applied to each scraped series after the
+	// base labels have been attached.
+	MetricRelabelConfigs []*config.RelabelConfig
+	// The maximum number of samples, after metric relabeling, that a scrape
+	// may yield. Scrapes yielding more fail without storing any sample. 0
+	// means no limit.
+	SampleLimit int
+	// Whether the labels of scraped series win over conflicting base
+	// labels, which are then not attached. Otherwise, conflicting scraped
+	// labels are prefixed with "exporter_".
+	HonorLabels bool
+	// Added to the offset within each scrape interval at which the target
+	// is scraped, which is derived from a hash of its URL.
+	ScrapeOffset time.Duration
+}
+
 // NewTarget creates a reasonably configured target for querying.
-func NewTarget(url string, deadline time.Duration, baseLabels clientmodel.LabelSet) Target {
+func NewTarget(url string, baseLabels clientmodel.LabelSet, o TargetOptions) Target {
+	httpClient := o.HTTPClient
+	if httpClient == nil {
+		httpClient = utility.NewDeadlineClient(o.Deadline)
+	}
 	t := &target{
-		url:             url,
-		deadline:        deadline,
-		httpClient:      utility.NewDeadlineClient(deadline),
-		scraperStopping: make(chan struct{}),
-		scraperStopped:  make(chan struct{}),
-		newBaseLabels:   make(chan clientmodel.LabelSet, 1),
+		url:                  url,
+		deadline:             o.Deadline,
+		httpClient:           httpClient,
+		scraperStopping:      make(chan struct{}),
+		scraperStopped:       make(chan struct{}),
+		newBaseLabels:        make(chan clientmodel.LabelSet, 1),
+		metricRelabelConfigs: o.MetricRelabelConfigs,
+		sampleLimit:          o.SampleLimit,
+		honorLabels:          o.HonorLabels,
+		scrapeOffset:         o.ScrapeOffset,
 	}
 	t.baseLabels = clientmodel.LabelSet{InstanceLabel: clientmodel.LabelValue(t.InstanceIdentifier())}
 	for baseLabel, baseValue := range baseLabels {
@@ -193,6 +265,93 @@ func NewTarget(url string, deadline time.Duration, baseLabels clientmodel.LabelS
 	return t
 }
 
+// jobTargetOptions returns the options of the targets of a job.
+func jobTargetOptions(job config.JobConfig) (TargetOptions, error) {
+	client, err := newScrapeClient(job)
+	if err != nil {
+		return TargetOptions{}, fmt.Errorf("error creating HTTP client: %s", err)
+	}
+	return TargetOptions{
+		Deadline:             job.ScrapeTimeout(),
+		HTTPClient:           client,
+		MetricRelabelConfigs: job.MetricRelabelConfigs(),
+		SampleLimit:          int(job.GetSampleLimit()),
+		HonorLabels:          job.GetHonorLabels(),
+		ScrapeOffset:         job.ScrapeOffset(),
+	}, nil
+}
+
+// newScrapeClient creates the HTTP client to scrape the targets of a job with,
+// which authenticates and connects as configured for the job and times out
+// after the scrape timeout of the job.
+func newScrapeClient(job config.JobConfig) (*http.Client, error) {
+	tlsConfig, err := job.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := utility.NewDeadlineTransport(job.ScrapeTimeout())
+	transport.TLSClientConfig = tlsConfig
+	if job.ProxyUrl != nil {
+		proxyURL, err := url.Parse(job.GetProxyUrl())
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	var rt http.RoundTripper = transport
+	if job.BearerTokenFile != nil {
+		rt = &bearerAuthRoundTripper{bearerTokenFile: job.GetBearerTokenFile(), rt: rt}
+	}
+	if ba := job.BasicAuth; ba != nil {
+		rt = &basicAuthRoundTripper{username: ba.GetUsername(), password: ba.GetPassword(), rt: rt}
+	}
+	return &http.Client{Transport: rt}, nil
+}
+
+// bearerAuthRoundTripper sets the Authorization header of each request to the
+// bearer token read from a file.
+type bearerAuthRoundTripper struct {
+	bearerTokenFile string
+	rt              http.RoundTripper
+}
+
+func (rt *bearerAuthRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// Read the token for each request, as it may be rotated.
+	token, err := ioutil.ReadFile(rt.bearerTokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read bearer token file: %s", err)
+	}
+	req = cloneRequest(req)
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	return rt.rt.RoundTrip(req)
+}
+
+// basicAuthRoundTripper sets the basic authentication credentials of each
+// request.
+type basicAuthRoundTripper struct {
+	username, password string
+	rt                 http.RoundTripper
+}
+
+func (rt *basicAuthRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = cloneRequest(req)
+	req.SetBasicAuth(rt.username, rt.password)
+	return rt.rt.RoundTrip(req)
+}
+
+// cloneRequest returns a shallow copy of the request with a deep copy of its
+// headers, as round trippers must not modify the requests passed to them.
+func cloneRequest(req *http.Request) *http.Request {
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		r.Header[k] = append([]string(nil), v...)
+	}
+	return r
+}
+
 // Ingest implements Target and extraction.Ingester.
 func (t *target) Ingest(s clientmodel.Samples) error {
 	// Since the regular case is that ingestedSamples is ready to receive,
@@ -226,14 +385,14 @@ func (t *target) RunScraper(sampleAppender storage.SampleAppender, interval time
 		}
 	}()
 
-	jitterTimer := time.NewTimer(time.Duration(float64(interval) * rand.Float64()))
+	offsetTimer := time.NewTimer(t.untilFirstScrape(interval, time.Now()))
 	select {
-	case <-jitterTimer.C:
+	case <-offsetTimer.C:
 	case <-t.scraperStopping:
-		jitterTimer.Stop()
+		offsetTimer.Stop()
 		return
 	}
-	jitterTimer.Stop()
+	offsetTimer.Stop()
 
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
@@ -241,7 +400,7 @@ func (t *target) RunScraper(sampleAppender storage.SampleAppender, interval time
 	t.Lock() // Writing t.lastScrape requires the lock.
 	t.lastScrape = time.Now()
 	t.Unlock()
-	t.scrape(sampleAppender)
+	t.updateBackoff(t.scrape(sampleAppender), interval)
 
 	// Explanation of the contraption below:
 	//
@@ -268,6 +427,13 @@ func (t *target) RunScraper(sampleAppender storage.SampleAppender, interval time
 			case <-t.scraperStopping:
 				return
 			case <-ticker.C:
+				if t.scrapesToSkip > 0 {
+					// Backing off from a failing target. Do not
+					// scrape, but still record it as down.
+					t.scrapesToSkip--
+					t.recordScrapeHealth(sampleAppender, clientmodel.Now(), false, 0)
+					continue
+				}
 				took := time.Since(t.lastScrape)
 				t.Lock() // Write t.lastScrape requires locking.
 				t.lastScrape = time.Now()
@@ -275,32 +441,86 @@ func (t *target) RunScraper(sampleAppender storage.SampleAppender, interval time
 				targetIntervalLength.WithLabelValues(interval.String()).Observe(
 					float64(took) / float64(time.Second), // Sub-second precision.
 				)
-				t.scrape(sampleAppender)
+				t.updateBackoff(t.scrape(sampleAppender), interval)
 			}
 		}
 	}
 }
 
+// untilFirstScrape returns how long to wait from now until the first scrape.
+// Each target is scraped at a fixed offset within each interval, counted from
+// the Unix epoch. The offset is derived from a hash of the URL, so that the
+// targets of a job are spread evenly across the interval, but stay at the
+// same position when scraping restarts.
+func (t *target) untilFirstScrape(interval time.Duration, now time.Time) time.Duration {
+	if interval <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(t.url))
+	offset := (time.Duration(h.Sum64()%uint64(interval)) + t.scrapeOffset%interval) % interval
+
+	wait := offset - time.Duration(now.UnixNano()%int64(interval))
+	if wait < 0 {
+		wait += interval
+	}
+	return wait
+}
+
+// updateBackoff updates the count of consecutive failed scrapes with the result
+// of the last scrape and determines how many of the upcoming scrapes to skip.
+// Must only be called from the goroutine running the RunScraper loop.
+func (t *target) updateBackoff(scrapeErr error, interval time.Duration) {
+	if scrapeErr == nil {
+		t.consecutiveFailures = 0
+		t.scrapesToSkip = 0
+		return
+	}
+	t.consecutiveFailures++
+	t.scrapesToSkip = numScrapesToSkip(t.consecutiveFailures, interval)
+}
+
+// numScrapesToSkip returns the number of scrapes to skip after the given number
+// of consecutive failed scrapes. A single failure does not cause any scrapes to be
+// skipped. After that, the effective scrape interval doubles with each failure,
+// but it never exceeds maxScrapeBackoff (unless interval itself does).
+func numScrapesToSkip(consecutiveFailures int, interval time.Duration) int {
+	maxSkip := int(maxScrapeBackoff/interval) - 1
+	if consecutiveFailures <= 1 || maxSkip <= 0 {
+		return 0
+	}
+	skip := 1
+	for i := 2; i < consecutiveFailures && skip < maxSkip; i++ {
+		skip = 2*skip + 1
+	}
+	if skip > maxSkip {
+		return maxSkip
+	}
+	return skip
+}
+
 // StopScraper implements Target.
 func (t *target) StopScraper() {
 	close(t.scraperStopping)
 	<-t.scraperStopped
 }
 
-const acceptHeader = `application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,text/plain;version=0.0.4;q=0.3,application/json;schema="prometheus/telemetry";version=0.0.2;q=0.2,*/*;q=0.1`
+const acceptHeader = `application/openmetrics-text;version=1.0.0;q=0.8,application/vnd.google.protobuf;proto=io.prometheus.client.MetricFamily;encoding=delimited;q=0.7,text/plain;version=0.0.4;q=0.3,application/json;schema="prometheus/telemetry";version=0.0.2;q=0.2,*/*;q=0.1`
 
 func (t *target) scrape(sampleAppender storage.SampleAppender) (err error) {
 	timestamp := clientmodel.Now()
 	defer func(start time.Time) {
-		t.Lock() // Writing t.state and t.lastError requires the lock.
+		took := time.Since(start)
+		t.Lock() // Writing t.state, t.lastError, and t.lastScrapeDuration requires the lock.
 		if err == nil {
 			t.state = Healthy
 		} else {
 			t.state = Unhealthy
 		}
 		t.lastError = err
+		t.lastScrapeDuration = took
 		t.Unlock()
-		t.recordScrapeHealth(sampleAppender, timestamp, err == nil, time.Since(start))
+		t.recordScrapeHealth(sampleAppender, timestamp, err == nil, took)
 	}(time.Now())
 
 	req, err := http.NewRequest("GET", t.URL(), nil)
@@ -318,7 +538,7 @@ func (t *target) scrape(sampleAppender storage.SampleAppender) (err error) {
 		return fmt.Errorf("server returned HTTP status %s", resp.Status)
 	}
 
-	processor, err := extraction.ProcessorForRequestHeader(resp.Header)
+	processor, err := processorForResponseHeader(resp.Header)
 	if err != nil {
 		return err
 	}
@@ -333,15 +553,68 @@ func (t *target) scrape(sampleAppender storage.SampleAppender) (err error) {
 		close(t.ingestedSamples)
 	}()
 
+	// With a sample limit, samples are only appended once the whole scrape
+	// is known not to exceed it.
+	var buffered clientmodel.Samples
+	numSamples := 0
 	for samples := range t.ingestedSamples {
+		batch := samples[:0]
 		for _, s := range samples {
-			s.Metric.MergeFromLabelSet(t.baseLabels, clientmodel.ExporterLabelPrefix)
-			sampleAppender.Append(s)
+			if t.sampleLimit > 0 && numSamples > t.sampleLimit {
+				// Keep draining to let the processor finish.
+				continue
+			}
+			attachBaseLabels(s.Metric, t.baseLabels, t.honorLabels)
+			if len(t.metricRelabelConfigs) > 0 {
+				if s.Metric = relabel.Relabel(s.Metric, t.metricRelabelConfigs); s.Metric == nil {
+					targetDroppedSamples.Inc()
+					continue
+				}
+			}
+			numSamples++
+			if t.sampleLimit > 0 {
+				if numSamples <= t.sampleLimit {
+					buffered = append(buffered, s)
+				}
+				continue
+			}
+			batch = append(batch, s)
+		}
+		storage.AppendBatch(sampleAppender, batch)
+	}
+	if t.sampleLimit > 0 {
+		if numSamples > t.sampleLimit {
+			targetSampleLimitExceeded.Inc()
+			return errSampleLimit
 		}
+		storage.AppendBatch(sampleAppender, buffered)
 	}
 	return err
 }
 
+// attachBaseLabels adds the base labels of a target to a scraped metric. If
+// honorLabels is true, base labels conflicting with scraped labels are not
+// added. Otherwise, the conflicting scraped labels are renamed by prefixing
+// them with "exporter_" as often as needed to avoid further conflicts.
+func attachBaseLabels(m clientmodel.Metric, baseLabels clientmodel.LabelSet, honorLabels bool) {
+	for ln, lv := range baseLabels {
+		if scraped, ok := m[ln]; ok {
+			if honorLabels {
+				continue
+			}
+			exported := clientmodel.ExporterLabelPrefix + ln
+			for {
+				if _, ok := m[exported]; !ok {
+					break
+				}
+				exported = clientmodel.ExporterLabelPrefix + exported
+			}
+			m[exported] = scraped
+		}
+		m[ln] = lv
+	}
+}
+
 // LastError implements Target.
 func (t *target) LastError() error {
 	t.Lock()
@@ -363,6 +636,13 @@ func (t *target) LastScrape() time.Time {
 	return t.lastScrape
 }
 
+// LastScrapeDuration implements Target.
+func (t *target) LastScrapeDuration() time.Duration {
+	t.Lock()
+	defer t.Unlock()
+	return t.lastScrapeDuration
+}
+
 // URL implements Target.
 func (t *target) URL() string {
 	return t.url
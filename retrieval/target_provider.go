@@ -15,9 +15,13 @@ package retrieval
 
 import (
 	"fmt"
+	"io"
 	"net"
+	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
@@ -27,10 +31,18 @@ import (
 	clientmodel "github.com/prometheus/client_golang/model"
 
 	"github.com/prometheus/prometheus/config"
+	pb "github.com/prometheus/prometheus/config/generated"
+	"github.com/prometheus/prometheus/relabel"
 	"github.com/prometheus/prometheus/utility"
 )
 
-const resolvConf = "/etc/resolv.conf"
+const (
+	resolvConf = "/etc/resolv.conf"
+
+	// addressLabel is the label holding the host and port of a discovered
+	// target.
+	addressLabel clientmodel.LabelName = "__address__"
+)
 
 var (
 	dnsSDLookupsCount = prometheus.NewCounter(
@@ -58,10 +70,110 @@ type TargetProvider interface {
 	Targets() ([]Target, error)
 }
 
+// A stoppableTargetProvider is a TargetProvider that has to be stopped once
+// its targets are not needed anymore.
+type stoppableTargetProvider interface {
+	TargetProvider
+	// Stop stops the provider and returns once it is stopped.
+	Stop()
+}
+
+// discoveredTarget creates a target of the job from the labels of a target
+// discovered by a service discovery, which include the global labels of the
+// job. Relabeling is applied to the labels before the target is scraped at
+// the address in the "__address__" label with the scheme of the job. It
+// returns nil if the target is dropped by relabeling or has no address.
+func discoveredTarget(job config.JobConfig, globalLabels clientmodel.LabelSet, rcs []*config.RelabelConfig, ls clientmodel.LabelSet) Target {
+	m := clientmodel.Metric{
+		clientmodel.JobLabel: clientmodel.LabelValue(job.GetName()),
+	}
+	for n, v := range globalLabels {
+		m[n] = v
+	}
+	for n, v := range ls {
+		m[n] = v
+	}
+	if m = relabel.Relabel(m, rcs); m == nil {
+		return nil
+	}
+	addr := m[addressLabel]
+	if addr == "" {
+		return nil
+	}
+	baseLabels := clientmodel.LabelSet{}
+	for n, v := range m {
+		if !strings.HasPrefix(string(n), clientmodel.ReservedLabelPrefix) {
+			baseLabels[n] = v
+		}
+	}
+	o, err := jobTargetOptions(job)
+	if err != nil {
+		glog.Errorf("Error setting up target %s of job %s, not scraping it: %s", addr, job.GetName(), err)
+		return nil
+	}
+	endpoint := &url.URL{
+		Scheme: job.GetScheme(),
+		Host:   string(addr),
+		Path:   job.GetMetricsPath(),
+	}
+	return NewTarget(endpoint.String(), baseLabels, o)
+}
+
+// sanitizedLabelName returns the given name as label name, replacing
+// characters not allowed in label names by underscores.
+func sanitizedLabelName(name string) clientmodel.LabelName {
+	return clientmodel.LabelName(strings.Map(func(r rune) rune {
+		if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name))
+}
+
+// getCancelable sends the request with the given transport and returns the
+// response if its status is 200 OK. The request is canceled once stop is
+// closed, so that reading a long-polled response body does not block
+// shutdown. The caller has to close the response body.
+func getCancelable(t *http.Transport, req *http.Request, stop <-chan struct{}) (*http.Response, error) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-stop:
+			t.CancelRequest(req)
+		case <-done:
+		}
+	}()
+	resp, err := (&http.Client{Transport: t}).Do(req)
+	if err != nil {
+		close(done)
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		close(done)
+		return nil, fmt.Errorf("server returned HTTP status %s for %s", resp.Status, req.URL)
+	}
+	resp.Body = &closeNotifyingBody{ReadCloser: resp.Body, done: done}
+	return resp, nil
+}
+
+// closeNotifyingBody closes done once the body is closed.
+type closeNotifyingBody struct {
+	io.ReadCloser
+	done chan struct{}
+	once sync.Once
+}
+
+func (b *closeNotifyingBody) Close() error {
+	b.once.Do(func() { close(b.done) })
+	return b.ReadCloser.Close()
+}
+
 type sdTargetProvider struct {
-	job          config.JobConfig
-	globalLabels clientmodel.LabelSet
-	targets      []Target
+	job            config.JobConfig
+	globalLabels   clientmodel.LabelSet
+	relabelConfigs []*config.RelabelConfig
+	targets        []Target
 
 	lastRefresh     time.Time
 	refreshInterval time.Duration
@@ -76,11 +188,25 @@ func NewSdTargetProvider(job config.JobConfig, globalLabels clientmodel.LabelSet
 	return &sdTargetProvider{
 		job:             job,
 		globalLabels:    globalLabels,
+		relabelConfigs:  job.RelabelConfigs(),
 		refreshInterval: i,
 	}
 }
 
+// dnsQueryTypes maps the configurable record types to DNS query types.
+var dnsQueryTypes = map[pb.JobConfig_DNSRecordType]uint16{
+	pb.JobConfig_SRV:  dns.TypeSRV,
+	pb.JobConfig_A:    dns.TypeA,
+	pb.JobConfig_AAAA: dns.TypeAAAA,
+	pb.JobConfig_MX:   dns.TypeMX,
+	pb.JobConfig_TXT:  dns.TypeTXT,
+}
+
 func (p *sdTargetProvider) Targets() ([]Target, error) {
+	if time.Since(p.lastRefresh) < p.refreshInterval {
+		return p.targets, nil
+	}
+
 	var err error
 	defer func() {
 		dnsSDLookupsCount.Inc()
@@ -89,48 +215,66 @@ func (p *sdTargetProvider) Targets() ([]Target, error) {
 		}
 	}()
 
-	if time.Since(p.lastRefresh) < p.refreshInterval {
-		return p.targets, nil
-	}
-
-	response, err := lookupSRV(p.job.GetSdName())
-
+	qtype := dnsQueryTypes[p.job.GetSdRecordType()]
+	response, err := lookupAll(p.job.GetSdName(), qtype)
 	if err != nil {
 		return nil, err
 	}
 
-	baseLabels := clientmodel.LabelSet{
-		clientmodel.JobLabel: clientmodel.LabelValue(p.job.GetName()),
-	}
-	for n, v := range p.globalLabels {
-		baseLabels[n] = v
-	}
-
 	targets := make([]Target, 0, len(response.Answer))
-	endpoint := &url.URL{
-		Scheme: "http",
-		Path:   p.job.GetMetricsPath(),
-	}
 	for _, record := range response.Answer {
-		addr, ok := record.(*dns.SRV)
-		if !ok {
-			glog.Warningf("%q is not a valid SRV record", record)
+		// Skip other records in the answer, like the CNAME records
+		// leading to the requested ones.
+		if record.Header().Rrtype != qtype {
 			continue
 		}
-		// Remove the final dot from rooted DNS names to make them look more usual.
-		if addr.Target[len(addr.Target)-1] == '.' {
-			addr.Target = addr.Target[:len(addr.Target)-1]
+		ls, err := dnsRecordLabels(record, int(p.job.GetSdPort()))
+		if err != nil {
+			glog.Warningf("Skipping DNS-SD record %q: %s", record, err)
+			continue
+		}
+		if t := discoveredTarget(p.job, p.globalLabels, p.relabelConfigs, ls); t != nil {
+			targets = append(targets, t)
 		}
-		endpoint.Host = fmt.Sprintf("%s:%d", addr.Target, addr.Port)
-		t := NewTarget(endpoint.String(), p.job.ScrapeTimeout(), baseLabels)
-		targets = append(targets, t)
 	}
 
 	p.targets = targets
+	p.lastRefresh = time.Now()
 	return targets, nil
 }
 
-func lookupSRV(name string) (*dns.Msg, error) {
+// dnsRecordLabels returns the labels of the target discovered from a DNS
+// record. The given port is used for records that do not contain a port.
+func dnsRecordLabels(record dns.RR, port int) (clientmodel.LabelSet, error) {
+	var addr string
+	switch rr := record.(type) {
+	case *dns.SRV:
+		addr = net.JoinHostPort(strings.TrimSuffix(rr.Target, "."), strconv.Itoa(int(rr.Port)))
+	case *dns.A:
+		addr = net.JoinHostPort(rr.A.String(), strconv.Itoa(port))
+	case *dns.AAAA:
+		addr = net.JoinHostPort(rr.AAAA.String(), strconv.Itoa(port))
+	case *dns.MX:
+		addr = net.JoinHostPort(strings.TrimSuffix(rr.Mx, "."), strconv.Itoa(port))
+	case *dns.TXT:
+		addr = strings.Join(rr.Txt, "")
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported record type")
+	}
+	return clientmodel.LabelSet{
+		addressLabel: clientmodel.LabelValue(addr),
+		// Remove the final dot from rooted DNS names to make them look more usual.
+		"__meta_dns_name":        clientmodel.LabelValue(strings.TrimSuffix(record.Header().Name, ".")),
+		"__meta_dns_record_type": clientmodel.LabelValue(dns.TypeToString[record.Header().Rrtype]),
+	}, nil
+}
+
+// lookupAll looks up the records of the given type for the name, trying the
+// search domains of the resolver configuration first.
+func lookupAll(name string, qtype uint16) (*dns.Msg, error) {
 	conf, err := dns.ClientConfigFromFile(resolvConf)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't load resolv.conf: %s", err)
@@ -142,7 +286,7 @@ func lookupSRV(name string) (*dns.Msg, error) {
 	for _, server := range conf.Servers {
 		servAddr := net.JoinHostPort(server, conf.Port)
 		for _, suffix := range conf.Search {
-			response, err = lookup(name, dns.TypeSRV, client, servAddr, suffix, false)
+			response, err = lookup(name, qtype, client, servAddr, suffix, false)
 			if err == nil {
 				if len(response.Answer) > 0 {
 					return response, nil
@@ -151,7 +295,7 @@ func lookupSRV(name string) (*dns.Msg, error) {
 				glog.Warningf("resolving %s.%s failed: %s", name, suffix, err)
 			}
 		}
-		response, err = lookup(name, dns.TypeSRV, client, servAddr, "", false)
+		response, err = lookup(name, qtype, client, servAddr, "", false)
 		if err == nil {
 			return response, nil
 		}
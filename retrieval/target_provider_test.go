@@ -0,0 +1,86 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+func TestDNSRecordLabels(t *testing.T) {
+	hdr := func(rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: "api.example.com.", Rrtype: rrtype}
+	}
+	scenarios := []struct {
+		record dns.RR
+		addr   clientmodel.LabelValue
+		fails  bool
+	}{
+		{
+			record: &dns.SRV{Hdr: hdr(dns.TypeSRV), Target: "host1.example.com.", Port: 8080},
+			addr:   "host1.example.com:8080",
+		},
+		{
+			record: &dns.A{Hdr: hdr(dns.TypeA), A: net.ParseIP("10.0.0.1")},
+			addr:   "10.0.0.1:9100",
+		},
+		{
+			record: &dns.AAAA{Hdr: hdr(dns.TypeAAAA), AAAA: net.ParseIP("2001:db8::1")},
+			addr:   "[2001:db8::1]:9100",
+		},
+		{
+			record: &dns.MX{Hdr: hdr(dns.TypeMX), Mx: "mail.example.com."},
+			addr:   "mail.example.com:9100",
+		},
+		{
+			record: &dns.TXT{Hdr: hdr(dns.TypeTXT), Txt: []string{"host2.example.com:", "8080"}},
+			addr:   "host2.example.com:8080",
+		},
+		{
+			record: &dns.TXT{Hdr: hdr(dns.TypeTXT), Txt: []string{"host2.example.com"}},
+			fails:  true,
+		},
+		{
+			record: &dns.CNAME{Hdr: hdr(dns.TypeCNAME), Target: "other.example.com."},
+			fails:  true,
+		},
+	}
+
+	for i, s := range scenarios {
+		ls, err := dnsRecordLabels(s.record, 9100)
+		if s.fails {
+			if err == nil {
+				t.Errorf("%d. expected error for record %q, got labels %v", i, s.record, ls)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d. unexpected error for record %q: %s", i, s.record, err)
+			continue
+		}
+		expected := clientmodel.LabelSet{
+			addressLabel:             s.addr,
+			"__meta_dns_name":        "api.example.com",
+			"__meta_dns_record_type": clientmodel.LabelValue(dns.TypeToString[s.record.Header().Rrtype]),
+		}
+		if !reflect.DeepEqual(ls, expected) {
+			t.Errorf("%d. expected labels %v, got %v", i, expected, ls)
+		}
+	}
+}
@@ -14,21 +14,26 @@
 package retrieval
 
 import (
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"time"
 
 	clientmodel "github.com/prometheus/client_golang/model"
 
+	"github.com/prometheus/prometheus/config"
 	"github.com/prometheus/prometheus/utility"
 )
 
 func TestBaseLabels(t *testing.T) {
-	target := NewTarget("http://example.com/metrics", 0, clientmodel.LabelSet{"job": "some_job", "foo": "bar"})
+	target := NewTarget("http://example.com/metrics", clientmodel.LabelSet{"job": "some_job", "foo": "bar"}, TargetOptions{})
 	want := clientmodel.LabelSet{"job": "some_job", "foo": "bar", "instance": "example.com:80"}
 	got := target.BaseLabels()
 	if !reflect.DeepEqual(want, got) {
@@ -91,8 +96,8 @@ func TestTargetScrapeWithFullChannel(t *testing.T) {
 
 	testTarget := NewTarget(
 		server.URL,
-		10*time.Millisecond,
 		clientmodel.LabelSet{"dings": "bums"},
+		TargetOptions{Deadline: 10 * time.Millisecond},
 	).(*target)
 
 	testTarget.scrape(slowAppender{})
@@ -106,7 +111,7 @@ func TestTargetScrapeWithFullChannel(t *testing.T) {
 
 func TestTargetRecordScrapeHealth(t *testing.T) {
 	testTarget := NewTarget(
-		"http://example.url", 0, clientmodel.LabelSet{clientmodel.JobLabel: "testjob"},
+		"http://example.url", clientmodel.LabelSet{clientmodel.JobLabel: "testjob"}, TargetOptions{},
 	).(*target)
 
 	now := clientmodel.Now()
@@ -163,7 +168,7 @@ func TestTargetScrapeTimeout(t *testing.T) {
 	)
 	defer server.Close()
 
-	testTarget := NewTarget(server.URL, 10*time.Millisecond, clientmodel.LabelSet{})
+	testTarget := NewTarget(server.URL, clientmodel.LabelSet{}, TargetOptions{Deadline: 10 * time.Millisecond})
 	appender := nopAppender{}
 
 	// scrape once without timeout
@@ -205,7 +210,7 @@ func TestTargetScrape404(t *testing.T) {
 	)
 	defer server.Close()
 
-	testTarget := NewTarget(server.URL, 10*time.Millisecond, clientmodel.LabelSet{})
+	testTarget := NewTarget(server.URL, clientmodel.LabelSet{}, TargetOptions{Deadline: 10 * time.Millisecond})
 	appender := nopAppender{}
 
 	want := errors.New("server returned HTTP status 404 Not Found")
@@ -215,6 +220,253 @@ func TestTargetScrape404(t *testing.T) {
 	}
 }
 
+func TestTargetScrapeMetricRelabel(t *testing.T) {
+	server := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", `text/plain; version=0.0.4`)
+				w.Write([]byte("node_cpu_seconds{cpu=\"0\"} 1\nnode_disk_bytes{device=\"/dev/sda\"} 2\n"))
+			},
+		),
+	)
+	defer server.Close()
+
+	conf, err := config.LoadFromString(`
+		job: <
+			name: "node"
+			metric_relabel_config: <
+				source_label: "__name__"
+				regex: "node_cpu_.*"
+				action: DROP
+			>
+			metric_relabel_config: <
+				source_label: "device"
+				regex: "/dev/(.+)"
+				target_label: "device"
+				replacement: "$1"
+			>
+		>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcs := conf.GetJobByName("node").MetricRelabelConfigs()
+
+	testTarget := NewTarget(server.URL, clientmodel.LabelSet{clientmodel.JobLabel: "node"}, TargetOptions{
+		Deadline:             100 * time.Millisecond,
+		MetricRelabelConfigs: rcs,
+	}).(*target)
+	appender := &collectResultAppender{}
+	if err := testTarget.scrape(appender); err != nil {
+		t.Fatal(err)
+	}
+
+	// The scraped series are followed by the synthetic health and
+	// duration series, which are not relabeled.
+	if len(appender.result) != 3 {
+		t.Fatalf("Expected three samples, got %v", appender.result)
+	}
+	want := clientmodel.Metric{
+		clientmodel.MetricNameLabel: "node_disk_bytes",
+		clientmodel.JobLabel:        "node",
+		InstanceLabel:               clientmodel.LabelValue(testTarget.InstanceIdentifier()),
+		"device":                    "sda",
+	}
+	if got := appender.result[0].Metric; !got.Equal(want) {
+		t.Errorf("Expected metric %v, got %v", want, got)
+	}
+}
+
+func TestAttachBaseLabels(t *testing.T) {
+	baseLabels := clientmodel.LabelSet{
+		clientmodel.JobLabel: "federate",
+		InstanceLabel:        "prometheus:9090",
+	}
+	scenarios := []struct {
+		honorLabels bool
+		in          clientmodel.Metric
+		out         clientmodel.Metric
+	}{
+		{
+			in: clientmodel.Metric{clientmodel.MetricNameLabel: "up"},
+			out: clientmodel.Metric{
+				clientmodel.MetricNameLabel: "up",
+				clientmodel.JobLabel:        "federate",
+				InstanceLabel:               "prometheus:9090",
+			},
+		},
+		{
+			in: clientmodel.Metric{
+				clientmodel.MetricNameLabel: "up",
+				clientmodel.JobLabel:        "node",
+				"exporter_job":              "pushgateway",
+			},
+			out: clientmodel.Metric{
+				clientmodel.MetricNameLabel: "up",
+				clientmodel.JobLabel:        "federate",
+				InstanceLabel:               "prometheus:9090",
+				"exporter_job":              "pushgateway",
+				"exporter_exporter_job":     "node",
+			},
+		},
+		{
+			honorLabels: true,
+			in: clientmodel.Metric{
+				clientmodel.MetricNameLabel: "up",
+				clientmodel.JobLabel:        "node",
+			},
+			out: clientmodel.Metric{
+				clientmodel.MetricNameLabel: "up",
+				clientmodel.JobLabel:        "node",
+				InstanceLabel:               "prometheus:9090",
+			},
+		},
+	}
+
+	for i, s := range scenarios {
+		attachBaseLabels(s.in, baseLabels, s.honorLabels)
+		if !s.in.Equal(s.out) {
+			t.Errorf("%d. expected metric %v, got %v", i, s.out, s.in)
+		}
+	}
+}
+
+func TestTargetScrapeSampleLimit(t *testing.T) {
+	server := httptest.NewServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", `text/plain; version=0.0.4`)
+				for i := 0; i < 3*ingestedSamplesCap; i++ {
+					fmt.Fprintf(w, "test_metric_%d 1\n", i)
+				}
+			},
+		),
+	)
+	defer server.Close()
+
+	conf, err := config.LoadFromString(`
+		job: <
+			name: "testjob"
+			metric_relabel_config: <
+				source_label: "__name__"
+				regex: "test_metric_1.*"
+				action: DROP
+			>
+		>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcs := conf.GetJobByName("testjob").MetricRelabelConfigs()
+
+	// Of the 768 exposed samples, 111 are dropped by relabeling.
+	for _, limit := range []int{656, 657} {
+		testTarget := NewTarget(server.URL, clientmodel.LabelSet{}, TargetOptions{
+			Deadline:             100 * time.Millisecond,
+			MetricRelabelConfigs: rcs,
+			SampleLimit:          limit,
+		}).(*target)
+		appender := &collectResultAppender{}
+		err := testTarget.scrape(appender)
+
+		if limit < 657 {
+			if err != errSampleLimit {
+				t.Errorf("limit %d: expected error %q, got %v", limit, errSampleLimit, err)
+			}
+			if testTarget.state != Unhealthy {
+				t.Errorf("limit %d: expected target state %v, got %v", limit, Unhealthy, testTarget.state)
+			}
+			// Only the synthetic health and duration samples are stored.
+			if len(appender.result) != 2 {
+				t.Errorf("limit %d: expected 2 samples, got %d", limit, len(appender.result))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("limit %d: unexpected error: %s", limit, err)
+		}
+		if len(appender.result) != 657+2 {
+			t.Errorf("limit %d: expected %d samples, got %d", limit, 657+2, len(appender.result))
+		}
+	}
+}
+
+func TestScrapeClientAuth(t *testing.T) {
+	server := httptest.NewTLSServer(
+		http.HandlerFunc(
+			func(w http.ResponseWriter, r *http.Request) {
+				user, pass, _ := r.BasicAuth()
+				if r.Header.Get("Authorization") != "Bearer token1" && (user != "prometheus" || pass != "secret") {
+					http.Error(w, "unauthorized", http.StatusUnauthorized)
+					return
+				}
+				w.Header().Set("Content-Type", `text/plain; version=0.0.4`)
+				w.Write([]byte("test_metric 1\n"))
+			},
+		),
+	)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "scrape_client_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, caPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("token1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	scenarios := []struct {
+		auth    string
+		success bool
+	}{
+		{
+			auth:    `tls_config: < ca_file: "` + caFile + `" > bearer_token_file: "` + tokenFile + `"`,
+			success: true,
+		},
+		{
+			auth:    `tls_config: < ca_file: "` + caFile + `" > basic_auth: < username: "prometheus" password: "secret" >`,
+			success: true,
+		},
+		{
+			auth:    `tls_config: < insecure_skip_verify: true > bearer_token_file: "` + tokenFile + `"`,
+			success: true,
+		},
+		{
+			auth:    `tls_config: < ca_file: "` + caFile + `" > basic_auth: < username: "prometheus" >`,
+			success: false,
+		},
+		{
+			// The certificate of the server is not trusted.
+			auth:    `bearer_token_file: "` + tokenFile + `"`,
+			success: false,
+		},
+	}
+
+	for i, s := range scenarios {
+		conf, err := config.LoadFromString(`job: < name: "testjob" ` + s.auth + ` >`)
+		if err != nil {
+			t.Fatalf("%d. %s", i, err)
+		}
+		client, err := newScrapeClient(*conf.GetJobByName("testjob"))
+		if err != nil {
+			t.Fatalf("%d. %s", i, err)
+		}
+		testTarget := NewTarget(server.URL, clientmodel.LabelSet{}, TargetOptions{Deadline: 100 * time.Millisecond, HTTPClient: client})
+		err = testTarget.(*target).scrape(nopAppender{})
+		if s.success && err != nil {
+			t.Errorf("%d. unexpected scrape error: %s", i, err)
+		}
+		if !s.success && err == nil {
+			t.Errorf("%d. expected scrape error, got none", i)
+		}
+	}
+}
+
 func TestTargetRunScraperScrapes(t *testing.T) {
 	testTarget := target{
 		state:           Unknown,
@@ -242,6 +494,76 @@ func TestTargetRunScraperScrapes(t *testing.T) {
 	}
 }
 
+func TestNumScrapesToSkip(t *testing.T) {
+	scenarios := []struct {
+		failures int
+		interval time.Duration
+		want     int
+	}{
+		{failures: 0, interval: 15 * time.Second, want: 0},
+		{failures: 1, interval: 15 * time.Second, want: 0},
+		{failures: 2, interval: 15 * time.Second, want: 1},
+		{failures: 3, interval: 15 * time.Second, want: 3},
+		{failures: 4, interval: 15 * time.Second, want: 7},
+		{failures: 5, interval: 15 * time.Second, want: 15},
+		{failures: 6, interval: 15 * time.Second, want: 19},
+		{failures: 100, interval: 15 * time.Second, want: 19},
+		{failures: 3, interval: 2 * time.Minute, want: 1},
+		{failures: 3, interval: maxScrapeBackoff, want: 0},
+		{failures: 3, interval: time.Hour, want: 0},
+	}
+
+	for i, s := range scenarios {
+		if got := numScrapesToSkip(s.failures, s.interval); got != s.want {
+			t.Errorf("%d. want %d scrapes to skip, got %d", i, s.want, got)
+		}
+	}
+}
+
+func TestTargetUpdateBackoff(t *testing.T) {
+	testTarget := target{}
+	for i := 0; i < 3; i++ {
+		testTarget.updateBackoff(errors.New("scrape failed"), time.Second)
+	}
+	if testTarget.scrapesToSkip != 3 {
+		t.Errorf("Expected 3 scrapes to skip, actual: %d", testTarget.scrapesToSkip)
+	}
+	testTarget.updateBackoff(nil, time.Second)
+	if testTarget.consecutiveFailures != 0 || testTarget.scrapesToSkip != 0 {
+		t.Errorf("Expected backoff to be reset after successful scrape, actual: %d failures, %d scrapes to skip", testTarget.consecutiveFailures, testTarget.scrapesToSkip)
+	}
+}
+
+func TestTargetUntilFirstScrape(t *testing.T) {
+	interval := 10 * time.Second
+	now := time.Unix(1430000000, 123456789)
+
+	for _, u := range []string{"http://a.example.org/metrics", "http://b.example.org/metrics", "http://c.example.org/metrics"} {
+		testTarget := &target{url: u}
+		wait := testTarget.untilFirstScrape(interval, now)
+		if wait < 0 || wait >= interval {
+			t.Fatalf("%s: expected wait within [0, %v), got %v", u, interval, wait)
+		}
+		if again := testTarget.untilFirstScrape(interval, now); again != wait {
+			t.Errorf("%s: expected deterministic wait %v, got %v", u, wait, again)
+		}
+		// The scrape stays at the same offset in later intervals.
+		if later := testTarget.untilFirstScrape(interval, now.Add(3*interval)); later != wait {
+			t.Errorf("%s: expected wait %v in later interval, got %v", u, wait, later)
+		}
+
+		testTarget.scrapeOffset = 2 * time.Second
+		shifted := testTarget.untilFirstScrape(interval, now)
+		if want := (wait + 2*time.Second) % interval; shifted != want {
+			t.Errorf("%s: expected wait %v with scrape offset, got %v", u, want, shifted)
+		}
+	}
+
+	if wait := (&target{url: "http://a.example.org/metrics"}).untilFirstScrape(0, now); wait != 0 {
+		t.Errorf("expected no wait for zero interval, got %v", wait)
+	}
+}
+
 func BenchmarkScrape(b *testing.B) {
 	server := httptest.NewServer(
 		http.HandlerFunc(
@@ -255,8 +577,8 @@ func BenchmarkScrape(b *testing.B) {
 
 	testTarget := NewTarget(
 		server.URL,
-		100*time.Millisecond,
 		clientmodel.LabelSet{"dings": "bums"},
+		TargetOptions{Deadline: 100 * time.Millisecond},
 	)
 	appender := nopAppender{}
 
@@ -14,13 +14,18 @@
 package retrieval
 
 import (
+	"fmt"
+	"net/url"
+	"strings"
 	"sync"
 
 	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
 
 	clientmodel "github.com/prometheus/client_golang/model"
 
 	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/relabel"
 	"github.com/prometheus/prometheus/storage"
 )
 
@@ -30,15 +35,24 @@ type TargetManager interface {
 	ReplaceTargets(job config.JobConfig, newTargets []Target)
 	Remove(t Target)
 	AddTargetsFromConfig(config config.Config)
+	// ApplyConfig replaces the jobs of the target manager by those of the
+	// given configuration. Pools of unchanged jobs keep running. Pools of
+	// changed or removed jobs are stopped, letting scrapes in progress
+	// finish, and new pools are started for changed or added jobs. If the
+	// targets of any job cannot be set up, nothing is changed and an
+	// error is returned.
+	ApplyConfig(config config.Config) error
 	Stop()
 	Pools() map[string]*TargetPool // Returns a copy of the name -> TargetPool mapping.
 }
 
 type targetManager struct {
-	sync.Mutex     // Protects poolByJob.
+	sync.Mutex     // Protects poolByJob, jobsByName, and globalLabels.
 	globalLabels   clientmodel.LabelSet
 	sampleAppender storage.SampleAppender
 	poolsByJob     map[string]*TargetPool
+	// The configurations the pools of configured jobs were created from.
+	jobsByName map[string]config.JobConfig
 }
 
 // NewTargetManager returns a newly initialized TargetManager ready to use.
@@ -47,6 +61,7 @@ func NewTargetManager(sampleAppender storage.SampleAppender, globalLabels client
 		sampleAppender: sampleAppender,
 		globalLabels:   globalLabels,
 		poolsByJob:     make(map[string]*TargetPool),
+		jobsByName:     make(map[string]config.JobConfig),
 	}
 }
 
@@ -58,6 +73,25 @@ func (m *targetManager) targetPoolForJob(job config.JobConfig) *TargetPool {
 		if job.SdName != nil {
 			provider = NewSdTargetProvider(job, m.globalLabels)
 		}
+		if job.KubernetesSd != nil {
+			p, err := NewKubernetesTargetProvider(job, m.globalLabels)
+			if err != nil {
+				glog.Errorf("Error setting up Kubernetes SD for job %s, not discovering any targets: %s", job.GetName(), err)
+			} else {
+				go p.Run()
+				provider = p
+			}
+		}
+		if job.ConsulSd != nil {
+			p := NewConsulTargetProvider(job, m.globalLabels)
+			go p.Run()
+			provider = p
+		}
+		if job.ZookeeperSd != nil {
+			p := NewZookeeperTargetProvider(job, m.globalLabels)
+			go p.Run()
+			provider = p
+		}
 
 		interval := job.ScrapeInterval()
 		targetPool = NewTargetPool(provider, m.sampleAppender, interval)
@@ -92,33 +126,140 @@ func (m *targetManager) Remove(t Target) {
 }
 
 func (m *targetManager) AddTargetsFromConfig(config config.Config) {
+	m.Lock()
+	defer m.Unlock()
+
 	for _, job := range config.Jobs() {
-		if job.SdName != nil {
-			m.Lock()
-			m.targetPoolForJob(job)
-			m.Unlock()
+		o, err := jobTargetOptions(job)
+		if err != nil {
+			glog.Errorf("Error setting up the targets of job %s, not scraping them: %s", job.GetName(), err)
 			continue
 		}
+		m.addJob(job, o)
+	}
+}
 
-		for _, targetGroup := range job.TargetGroup {
-			baseLabels := clientmodel.LabelSet{
-				clientmodel.JobLabel: clientmodel.LabelValue(job.GetName()),
-			}
-			for n, v := range m.globalLabels {
-				baseLabels[n] = v
-			}
-			if targetGroup.Labels != nil {
-				for _, label := range targetGroup.Labels.Label {
-					baseLabels[clientmodel.LabelName(label.GetName())] = clientmodel.LabelValue(label.GetValue())
-				}
+func (m *targetManager) ApplyConfig(config config.Config) error {
+	jobs := config.Jobs()
+	options := make([]TargetOptions, len(jobs))
+	for i, job := range jobs {
+		o, err := jobTargetOptions(job)
+		if err != nil {
+			return fmt.Errorf("error setting up the targets of job %s: %s", job.GetName(), err)
+		}
+		options[i] = o
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	// All targets carry the global labels, so all jobs change with them.
+	globalLabels := config.GlobalLabels()
+	globalLabelsChanged := !labelSetsEqual(globalLabels, m.globalLabels)
+	m.globalLabels = globalLabels
+
+	changed := make(map[string]bool, len(jobs))
+	for _, job := range jobs {
+		old, ok := m.jobsByName[job.GetName()]
+		changed[job.GetName()] = !ok || globalLabelsChanged || !proto.Equal(&old.JobConfig, &job.JobConfig)
+	}
+
+	var obsoletePools []*TargetPool
+	for name, p := range m.poolsByJob {
+		if c, ok := changed[name]; ok && !c {
+			continue
+		}
+		glog.Infof("Configuration of job %s changed or removed, stopping its pool...", name)
+		obsoletePools = append(obsoletePools, p)
+		delete(m.poolsByJob, name)
+		delete(m.jobsByName, name)
+	}
+	// Stopping waits for scrapes in progress, so that no scrape is
+	// aborted and no target is scraped by an old and a new pool at once.
+	var wg sync.WaitGroup
+	for _, p := range obsoletePools {
+		wg.Add(1)
+		go func(p *TargetPool) {
+			defer wg.Done()
+			p.Stop()
+		}(p)
+	}
+	wg.Wait()
+
+	for i, job := range jobs {
+		if changed[job.GetName()] {
+			m.addJob(job, options[i])
+		}
+	}
+	return nil
+}
+
+// addJob creates the pool of a job and adds the targets of its target groups to
+// it. The caller must hold the lock.
+func (m *targetManager) addJob(job config.JobConfig, o TargetOptions) {
+	m.jobsByName[job.GetName()] = job
+	targetPool := m.targetPoolForJob(job)
+	if job.SdName != nil || job.KubernetesSd != nil || job.ConsulSd != nil || job.ZookeeperSd != nil {
+		return
+	}
+
+	relabelConfigs := job.RelabelConfigs()
+	for _, targetGroup := range job.TargetGroup {
+		groupLabels := clientmodel.Metric{
+			clientmodel.JobLabel: clientmodel.LabelValue(job.GetName()),
+		}
+		for n, v := range m.globalLabels {
+			groupLabels[n] = v
+		}
+		if targetGroup.Labels != nil {
+			for _, label := range targetGroup.Labels.Label {
+				groupLabels[clientmodel.LabelName(label.GetName())] = clientmodel.LabelValue(label.GetValue())
 			}
+		}
 
-			for _, endpoint := range targetGroup.Target {
-				target := NewTarget(endpoint, job.ScrapeTimeout(), baseLabels)
-				m.AddTarget(job, target)
+		for _, endpoint := range targetGroup.Target {
+			baseLabels := staticTargetLabels(endpoint, groupLabels, relabelConfigs)
+			if baseLabels == nil {
+				continue
 			}
+			targetPool.AddTarget(NewTarget(endpoint, baseLabels, o))
+		}
+	}
+}
+
+// labelSetsEqual returns whether both label sets contain the same labels.
+func labelSetsEqual(a, b clientmodel.LabelSet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for n, v := range a {
+		if w, ok := b[n]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
+
+// staticTargetLabels applies relabeling to the labels of a target in a target
+// group, with the host of the endpoint in the "__address__" label. It returns
+// the resulting labels without those starting with "__", or nil if the target
+// is dropped.
+func staticTargetLabels(endpoint string, groupLabels clientmodel.Metric, rcs []*config.RelabelConfig) clientmodel.LabelSet {
+	m := groupLabels
+	if u, err := url.Parse(endpoint); err == nil {
+		m = groupLabels.Clone()
+		m[addressLabel] = clientmodel.LabelValue(u.Host)
+	}
+	if m = relabel.Relabel(m, rcs); m == nil {
+		return nil
+	}
+	ls := clientmodel.LabelSet{}
+	for n, v := range m {
+		if !strings.HasPrefix(string(n), clientmodel.ReservedLabelPrefix) {
+			ls[n] = v
 		}
 	}
+	return ls
 }
 
 func (m *targetManager) Stop() {
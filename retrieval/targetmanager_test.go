@@ -14,6 +14,14 @@
 package retrieval
 
 import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -65,6 +73,10 @@ func (t fakeTarget) LastScrape() time.Time {
 	return t.lastScrape
 }
 
+func (t fakeTarget) LastScrapeDuration() time.Duration {
+	return 0
+}
+
 func (t fakeTarget) scrape(storage.SampleAppender) error {
 	t.scrapeCount++
 
@@ -119,6 +131,127 @@ func testTargetManager(t testing.TB) {
 	targetManager.AddTarget(testJob2, target1GroupB)
 }
 
+func TestStaticTargetLabels(t *testing.T) {
+	conf, err := config.LoadFromString(`
+		job: <
+			name: "node"
+			relabel_config: <
+				source_label: "__address__"
+				regex: "node2:.*"
+				action: DROP
+			>
+			relabel_config: <
+				regex: "__zone"
+				replacement: "zone"
+				action: LABELMAP
+			>
+		>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcs := conf.GetJobByName("node").RelabelConfigs()
+	groupLabels := clientmodel.Metric{
+		clientmodel.JobLabel: "node",
+		"__zone":             "eu-west-1a",
+	}
+
+	got := staticTargetLabels("http://node1:9100/metrics", groupLabels, rcs)
+	want := clientmodel.LabelSet{
+		clientmodel.JobLabel: "node",
+		"zone":               "eu-west-1a",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected labels %v, got %v", want, got)
+	}
+	if got := staticTargetLabels("http://node2:9100/metrics", groupLabels, rcs); got != nil {
+		t.Errorf("Expected target to be dropped, got labels %v", got)
+	}
+	if _, ok := groupLabels[addressLabel]; ok {
+		t.Errorf("Group labels modified to %v", groupLabels)
+	}
+}
+
+func TestTargetManagerApplyConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "target_manager_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	server.Close()
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, caPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	loadConfig := func(s string) config.Config {
+		conf, err := config.LoadFromString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conf
+	}
+	const (
+		unchangedJob = `job: < name: "unchanged" scrape_interval: "1h" target_group: < target: "http://unchanged.example.org/metrics" > >`
+		changedJob   = `job: < name: "changed" scrape_interval: "1h" target_group: < target: "http://changed.example.org/metrics" > >`
+		removedJob   = `job: < name: "removed" scrape_interval: "1h" target_group: < target: "http://removed.example.org/metrics" > >`
+	)
+
+	targetManager := NewTargetManager(nopAppender{}, nil)
+	defer targetManager.Stop()
+	if err := targetManager.ApplyConfig(loadConfig(unchangedJob + changedJob + removedJob)); err != nil {
+		t.Fatal(err)
+	}
+	oldPools := targetManager.Pools()
+	if len(oldPools) != 3 {
+		t.Fatalf("expected 3 pools, got %d", len(oldPools))
+	}
+
+	// Reading the CA file fails after the configuration has been
+	// validated, so that the changes are rejected as a whole.
+	failing := loadConfig(unchangedJob + `job: < name: "changed" scrape_interval: "1h" tls_config: < ca_file: "` + caFile + `" > >`)
+	if err := os.Remove(caFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := targetManager.ApplyConfig(failing); err == nil {
+		t.Fatal("expected error applying config with unreadable CA file, got none")
+	}
+	if !reflect.DeepEqual(targetManager.Pools(), oldPools) {
+		t.Fatalf("expected pools to be unchanged after failed reload")
+	}
+
+	if err := targetManager.ApplyConfig(loadConfig(unchangedJob + strings.Replace(changedJob, `"1h"`, `"2h"`, 1))); err != nil {
+		t.Fatal(err)
+	}
+	newPools := targetManager.Pools()
+	if len(newPools) != 2 {
+		t.Fatalf("expected 2 pools, got %d", len(newPools))
+	}
+	if newPools["unchanged"] != oldPools["unchanged"] {
+		t.Errorf("expected pool of unchanged job to be kept")
+	}
+	if newPools["changed"] == oldPools["changed"] || newPools["changed"].interval != 2*time.Hour {
+		t.Errorf("expected pool of changed job to be replaced")
+	}
+	if _, ok := newPools["removed"]; ok {
+		t.Errorf("expected pool of removed job to be stopped")
+	}
+	select {
+	case <-oldPools["removed"].stopped:
+	default:
+		t.Errorf("expected pool of removed job to be stopped")
+	}
+
+	// All pools change with the global labels.
+	if err := targetManager.ApplyConfig(loadConfig(`global < labels: < label: < name: "monitor" value: "test" > > >` + unchangedJob)); err != nil {
+		t.Fatal(err)
+	}
+	if targetManager.Pools()["unchanged"] == oldPools["unchanged"] {
+		t.Errorf("expected pool to be replaced after global labels changed")
+	}
+}
+
 func TestTargetManager(t *testing.T) {
 	testTargetManager(t)
 }
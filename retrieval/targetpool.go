@@ -77,6 +77,9 @@ func (p *TargetPool) Run() {
 		case newTarget := <-p.addTargetQueue:
 			p.addTarget(newTarget)
 		case <-p.stopping:
+			if s, ok := p.targetProvider.(stoppableTargetProvider); ok {
+				s.Stop()
+			}
 			p.ReplaceTargets([]Target{})
 			close(p.stopped)
 			return
@@ -0,0 +1,288 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/samuel/go-zookeeper/zk"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/config"
+	pb "github.com/prometheus/prometheus/config/generated"
+)
+
+const (
+	serversetMetaLabelPrefix = "__meta_serverset_"
+	nerveMetaLabelPrefix     = "__meta_nerve_"
+)
+
+var zookeeperSDFailuresCount = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "zookeeper_sd_failures_total",
+		Help:      "The number of failed attempts to read member znodes from Zookeeper.",
+	})
+
+func init() {
+	prometheus.MustRegister(zookeeperSDFailuresCount)
+}
+
+type serversetEndpoint struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+}
+
+// serversetMember is the data of a member znode in the Serverset format.
+type serversetMember struct {
+	ServiceEndpoint     serversetEndpoint            `json:"serviceEndpoint"`
+	AdditionalEndpoints map[string]serversetEndpoint `json:"additionalEndpoints"`
+	Status              string                       `json:"status"`
+	Shard               *int                         `json:"shard"`
+}
+
+// nerveMember is the data of a member znode registered by Nerve.
+type nerveMember struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	Name string `json:"name"`
+}
+
+// zookeeperMemberDecoder decodes the data of a member znode below the given
+// path into the labels of a target.
+type zookeeperMemberDecoder func(path string, data []byte) (clientmodel.LabelSet, error)
+
+func decodeServersetMember(path string, data []byte) (clientmodel.LabelSet, error) {
+	var m serversetMember
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	ls := clientmodel.LabelSet{
+		addressLabel:                               hostPort(m.ServiceEndpoint.Host, m.ServiceEndpoint.Port),
+		serversetMetaLabelPrefix + "path":          clientmodel.LabelValue(path),
+		serversetMetaLabelPrefix + "status":        clientmodel.LabelValue(m.Status),
+		serversetMetaLabelPrefix + "endpoint_host": clientmodel.LabelValue(m.ServiceEndpoint.Host),
+		serversetMetaLabelPrefix + "endpoint_port": clientmodel.LabelValue(strconv.Itoa(m.ServiceEndpoint.Port)),
+	}
+	if m.Shard != nil {
+		ls[serversetMetaLabelPrefix+"shard"] = clientmodel.LabelValue(strconv.Itoa(*m.Shard))
+	}
+	for name, e := range m.AdditionalEndpoints {
+		ls[sanitizedLabelName(serversetMetaLabelPrefix+"endpoint_host_"+name)] = clientmodel.LabelValue(e.Host)
+		ls[sanitizedLabelName(serversetMetaLabelPrefix+"endpoint_port_"+name)] = clientmodel.LabelValue(strconv.Itoa(e.Port))
+	}
+	return ls, nil
+}
+
+func decodeNerveMember(path string, data []byte) (clientmodel.LabelSet, error) {
+	var m nerveMember
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return clientmodel.LabelSet{
+		addressLabel:                           hostPort(m.Host, m.Port),
+		nerveMetaLabelPrefix + "path":          clientmodel.LabelValue(path),
+		nerveMetaLabelPrefix + "name":          clientmodel.LabelValue(m.Name),
+		nerveMetaLabelPrefix + "endpoint_host": clientmodel.LabelValue(m.Host),
+		nerveMetaLabelPrefix + "endpoint_port": clientmodel.LabelValue(strconv.Itoa(m.Port)),
+	}, nil
+}
+
+// zookeeperTargetProvider discovers the targets of a job by watching the
+// children of znodes in Zookeeper.
+type zookeeperTargetProvider struct {
+	job            config.JobConfig
+	globalLabels   clientmodel.LabelSet
+	relabelConfigs []*config.RelabelConfig
+
+	servers []string
+	paths   []string
+	timeout time.Duration
+	decode  zookeeperMemberDecoder
+
+	// Protects targets.
+	mtx sync.RWMutex
+	// The label sets of the discovered targets by watched path.
+	targets map[string][]clientmodel.LabelSet
+
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// NewZookeeperTargetProvider constructs a new zookeeperTargetProvider for a
+// job. Discovery starts once Run is called.
+func NewZookeeperTargetProvider(job config.JobConfig, globalLabels clientmodel.LabelSet) *zookeeperTargetProvider {
+	conf := job.GetZookeeperSd()
+	decode := decodeServersetMember
+	if conf.GetFormat() == pb.ZookeeperSDConfig_NERVE {
+		decode = decodeNerveMember
+	}
+	return &zookeeperTargetProvider{
+		job:            job,
+		globalLabels:   globalLabels,
+		relabelConfigs: job.RelabelConfigs(),
+		servers:        conf.Server,
+		paths:          conf.Path,
+		timeout:        job.ZookeeperTimeout(),
+		decode:         decode,
+		targets:        map[string][]clientmodel.LabelSet{},
+		stop:           make(chan struct{}),
+		stopped:        make(chan struct{}),
+	}
+}
+
+// zookeeperLogger logs messages of the Zookeeper client to glog.
+type zookeeperLogger struct{}
+
+func (zookeeperLogger) Printf(format string, args ...interface{}) {
+	glog.V(1).Infof(format, args...)
+}
+
+// Run watches the configured paths until Stop is called. Run is usually
+// called as a goroutine.
+func (p *zookeeperTargetProvider) Run() {
+	defer close(p.stopped)
+
+	var conn *zk.Conn
+	for {
+		var err error
+		conn, _, err = zk.Connect(p.servers, p.timeout, zk.WithLogger(zookeeperLogger{}))
+		if err == nil {
+			break
+		}
+		zookeeperSDFailuresCount.Inc()
+		glog.Errorf("Error connecting to Zookeeper for job %s, retrying in %v: %s", p.job.GetName(), p.timeout, err)
+		select {
+		case <-time.After(p.timeout):
+		case <-p.stop:
+			return
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, path := range p.paths {
+		wg.Add(1)
+		go func(path string) {
+			defer wg.Done()
+			p.watchPath(conn, path)
+		}(path)
+	}
+	<-p.stop
+	// Closing the connection ends all pending watches.
+	conn.Close()
+	wg.Wait()
+}
+
+// Stop stops watching Zookeeper and returns once Run has returned.
+func (p *zookeeperTargetProvider) Stop() {
+	close(p.stop)
+	<-p.stopped
+}
+
+// watchPath updates the targets discovered from the children of the given
+// path whenever they change, until Stop is called.
+func (p *zookeeperTargetProvider) watchPath(conn *zk.Conn, path string) {
+	for {
+		targets, changed, err := p.readPath(conn, path)
+		if err != nil {
+			zookeeperSDFailuresCount.Inc()
+			glog.Errorf("Error reading Zookeeper path %s for job %s, retrying in %v: %s", path, p.job.GetName(), p.timeout, err)
+			select {
+			case <-time.After(p.timeout):
+				continue
+			case <-p.stop:
+				return
+			}
+		}
+		p.mtx.Lock()
+		p.targets[path] = targets
+		p.mtx.Unlock()
+
+		select {
+		case <-changed:
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// readPath reads the members below the given path. It returns the labels of
+// the discovered targets and a channel that receives once the children of the
+// path change. If the path does not exist, no targets are returned, and the
+// channel receives once the path is created.
+func (p *zookeeperTargetProvider) readPath(conn *zk.Conn, path string) ([]clientmodel.LabelSet, <-chan zk.Event, error) {
+	children, _, changed, err := conn.ChildrenW(path)
+	if err == zk.ErrNoNode {
+		exists, _, created, err := conn.ExistsW(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if exists {
+			// Created in the meantime.
+			return p.readPath(conn, path)
+		}
+		return []clientmodel.LabelSet{}, created, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	targets := make([]clientmodel.LabelSet, 0, len(children))
+	for _, child := range children {
+		childPath := path + "/" + child
+		data, _, err := conn.Get(childPath)
+		if err == zk.ErrNoNode {
+			// Removed since listing the children. The watch fires
+			// for the removal.
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		ls, err := p.decode(path, data)
+		if err != nil {
+			glog.Warningf("Skipping invalid member znode %s for job %s: %s", childPath, p.job.GetName(), err)
+			continue
+		}
+		targets = append(targets, ls)
+	}
+	return targets, changed, nil
+}
+
+// Targets implements TargetProvider.
+func (p *zookeeperTargetProvider) Targets() ([]Target, error) {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	if len(p.targets) < len(p.paths) {
+		return nil, fmt.Errorf("Zookeeper paths not read yet")
+	}
+
+	targets := []Target{}
+	for _, labelSets := range p.targets {
+		for _, ls := range labelSets {
+			if t := discoveredTarget(p.job, p.globalLabels, p.relabelConfigs, ls); t != nil {
+				targets = append(targets, t)
+			}
+		}
+	}
+	return targets, nil
+}
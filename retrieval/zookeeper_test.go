@@ -0,0 +1,104 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package retrieval
+
+import (
+	"reflect"
+	"testing"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+func TestDecodeZookeeperMembers(t *testing.T) {
+	var scenarios = []struct {
+		decode zookeeperMemberDecoder
+		data   string
+		labels clientmodel.LabelSet
+		fail   bool
+	}{
+		{
+			decode: decodeServersetMember,
+			data: `{
+				"serviceEndpoint": {"host": "10.0.0.1", "port": 8080},
+				"additionalEndpoints": {
+					"admin": {"host": "10.0.0.1", "port": 9990},
+					"health-check": {"host": "10.0.0.2", "port": 9991}
+				},
+				"status": "ALIVE",
+				"shard": 2
+			}`,
+			labels: clientmodel.LabelSet{
+				"__address__":                                 "10.0.0.1:8080",
+				"__meta_serverset_path":                       "/services/api",
+				"__meta_serverset_status":                     "ALIVE",
+				"__meta_serverset_shard":                      "2",
+				"__meta_serverset_endpoint_host":              "10.0.0.1",
+				"__meta_serverset_endpoint_port":              "8080",
+				"__meta_serverset_endpoint_host_admin":        "10.0.0.1",
+				"__meta_serverset_endpoint_port_admin":        "9990",
+				"__meta_serverset_endpoint_host_health_check": "10.0.0.2",
+				"__meta_serverset_endpoint_port_health_check": "9991",
+			},
+		},
+		{
+			decode: decodeServersetMember,
+			data:   `{"serviceEndpoint": {"host": "10.0.0.1", "port": 8080}, "status": "ALIVE"}`,
+			labels: clientmodel.LabelSet{
+				"__address__":                    "10.0.0.1:8080",
+				"__meta_serverset_path":          "/services/api",
+				"__meta_serverset_status":        "ALIVE",
+				"__meta_serverset_endpoint_host": "10.0.0.1",
+				"__meta_serverset_endpoint_port": "8080",
+			},
+		},
+		{
+			decode: decodeNerveMember,
+			data:   `{"host": "10.0.0.3", "port": 3000, "name": "api-3"}`,
+			labels: clientmodel.LabelSet{
+				"__address__":                "10.0.0.3:3000",
+				"__meta_nerve_path":          "/services/api",
+				"__meta_nerve_name":          "api-3",
+				"__meta_nerve_endpoint_host": "10.0.0.3",
+				"__meta_nerve_endpoint_port": "3000",
+			},
+		},
+		{
+			decode: decodeServersetMember,
+			data:   `not json`,
+			fail:   true,
+		},
+		{
+			decode: decodeNerveMember,
+			data:   `{"host": "10.0.0.3", "port": "3000"}`,
+			fail:   true,
+		},
+	}
+
+	for i, s := range scenarios {
+		labels, err := s.decode("/services/api", []byte(s.data))
+		if s.fail {
+			if err == nil {
+				t.Errorf("%d. expected error, got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d. unexpected error: %s", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(labels, s.labels) {
+			t.Errorf("%d. expected labels %v, got %v", i, s.labels, labels)
+		}
+	}
+}
@@ -14,30 +14,66 @@
 package rules
 
 import (
+	"bytes"
 	"fmt"
 	"html/template"
 	"reflect"
+	"strings"
 	"sync"
+	text_template "text/template"
 	"time"
 
+	"github.com/golang/glog"
+
 	clientmodel "github.com/prometheus/client_golang/model"
 
 	"github.com/prometheus/prometheus/rules/ast"
 	"github.com/prometheus/prometheus/stats"
 	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
 	"github.com/prometheus/prometheus/utility"
 )
 
 const (
 	// AlertMetricName is the metric name for synthetic alert timeseries.
 	AlertMetricName clientmodel.LabelValue = "ALERTS"
+	// AlertForStateMetricName is the metric name for synthetic timeseries
+	// recording the time since which an alert has been active, so that the
+	// alert can be restored after a restart.
+	AlertForStateMetricName clientmodel.LabelValue = "ALERTS_FOR_STATE"
 
 	// AlertNameLabel is the label name indicating the name of an alert.
 	AlertNameLabel clientmodel.LabelName = "alertname"
 	// AlertStateLabel is the label name indicating the state of an alert.
 	AlertStateLabel clientmodel.LabelName = "alertstate"
+
+	// AlertTemplateDefs are prepended to the templates of alerting rules.
+	// They inject convenience variables that are easier to remember for
+	// users who are not used to Go's templating system.
+	AlertTemplateDefs = "{{$labels := .Labels}}{{$value := .Value}}"
 )
 
+// AlertTemplateData returns the data the templates of an alerting rule are
+// executed with for an alert of the given labels and value.
+func AlertTemplateData(labels clientmodel.LabelSet, value clientmodel.SampleValue) interface{} {
+	l := map[string]string{}
+	for k, v := range labels {
+		l[string(k)] = string(v)
+	}
+	return struct {
+		Labels map[string]string
+		Value  clientmodel.SampleValue
+	}{
+		Labels: l,
+		Value:  value,
+	}
+}
+
+// parseLabelTemplate parses a label value of an alerting rule as a template.
+func parseLabelTemplate(name clientmodel.LabelName, text clientmodel.LabelValue) (*text_template.Template, error) {
+	return text_template.New("__alert_label_" + string(name)).Parse(AlertTemplateDefs + string(text))
+}
+
 // AlertState denotes the state of an active alert.
 type AlertState int
 
@@ -100,6 +136,32 @@ func (a Alert) sample(timestamp clientmodel.Timestamp, value clientmodel.SampleV
 	}
 }
 
+// forStateSample returns a Sample suitable for recording the time since which
+// the alert has been active, in seconds since the epoch. Resolved alerts are
+// recorded with a value of 0.
+func (a Alert) forStateSample(timestamp clientmodel.Timestamp, resolved bool) *ast.Sample {
+	recordedMetric := clientmodel.Metric{}
+	for label, value := range a.Labels {
+		recordedMetric[label] = value
+	}
+
+	recordedMetric[clientmodel.MetricNameLabel] = AlertForStateMetricName
+	recordedMetric[AlertNameLabel] = clientmodel.LabelValue(a.Name)
+
+	value := clientmodel.SampleValue(a.ActiveSince.Unix())
+	if resolved {
+		value = 0
+	}
+	return &ast.Sample{
+		Metric: clientmodel.COWMetric{
+			Metric: recordedMetric,
+			Copied: true,
+		},
+		Value:     value,
+		Timestamp: timestamp,
+	}
+}
+
 // An AlertingRule generates alerts from its vector expression.
 type AlertingRule struct {
 	// The name of the alert.
@@ -109,18 +171,27 @@ type AlertingRule struct {
 	// The duration for which a labelset needs to persist in the expression
 	// output vector before an alert transitions from Pending to Firing state.
 	holdDuration time.Duration
-	// Extra labels to attach to the resulting alert sample vectors.
+	// Extra labels to attach to the resulting alert sample vectors. Values
+	// may contain text/template-style interpolations, which are rendered
+	// when an alert becomes active.
 	Labels clientmodel.LabelSet
 	// Short alert summary, suitable for email subjects.
 	Summary string
 	// More detailed alert description.
 	Description string
+	// Further information attached to the alert notifications, like links
+	// to runbooks. Values may contain text/template-style interpolations,
+	// just like the summary and the description.
+	Annotations clientmodel.LabelSet
 
 	// Protects the below.
 	mutex sync.Mutex
 	// A map of alerts which are currently active (Pending or Firing), keyed by
 	// the fingerprint of the labelset they correspond to.
 	activeAlerts map[clientmodel.Fingerprint]*Alert
+	// The times since which alerts were active before a restart, keyed by
+	// the fingerprint of the alert labels. Only used by the next evaluation.
+	restoredActiveSince map[clientmodel.Fingerprint]clientmodel.Timestamp
 }
 
 // Name returns the name of the alert.
@@ -154,15 +225,19 @@ func (rule *AlertingRule) Eval(timestamp clientmodel.Timestamp, storage local.St
 		if alert, ok := rule.activeAlerts[fp]; !ok {
 			labels := clientmodel.LabelSet{}
 			labels.MergeFromMetric(sample.Metric.Metric)
-			labels = labels.Merge(rule.Labels)
+			labels = labels.Merge(rule.expandLabels(labels, sample.Value))
 			if _, ok := labels[clientmodel.MetricNameLabel]; ok {
 				delete(labels, clientmodel.MetricNameLabel)
 			}
+			activeSince := timestamp
+			if since, ok := rule.restoredActiveSince[clientmodel.Metric(labels).Fingerprint()]; ok {
+				activeSince = since
+			}
 			rule.activeAlerts[fp] = &Alert{
 				Name:        rule.name,
 				Labels:      labels,
 				State:       Pending,
-				ActiveSince: timestamp,
+				ActiveSince: activeSince,
 				Value:       sample.Value,
 			}
 		} else {
@@ -170,12 +245,15 @@ func (rule *AlertingRule) Eval(timestamp clientmodel.Timestamp, storage local.St
 		}
 	}
 
+	rule.restoredActiveSince = nil
+
 	vector := ast.Vector{}
 
 	// Check if any pending alerts should be removed or fire now. Write out alert timeseries.
 	for fp, activeAlert := range rule.activeAlerts {
 		if !resultFingerprints.Has(fp) {
 			vector = append(vector, activeAlert.sample(timestamp, 0))
+			vector = append(vector, activeAlert.forStateSample(timestamp, true))
 			delete(rule.activeAlerts, fp)
 			continue
 		}
@@ -186,11 +264,87 @@ func (rule *AlertingRule) Eval(timestamp clientmodel.Timestamp, storage local.St
 		}
 
 		vector = append(vector, activeAlert.sample(timestamp, 1))
+		vector = append(vector, activeAlert.forStateSample(timestamp, false))
 	}
 
 	return vector, nil
 }
 
+// expandLabels renders the templates in the label values of the rule against
+// the labels and the value of a new alert.
+func (rule *AlertingRule) expandLabels(labels clientmodel.LabelSet, value clientmodel.SampleValue) clientmodel.LabelSet {
+	expanded := make(clientmodel.LabelSet, len(rule.Labels))
+	for name, text := range rule.Labels {
+		if !strings.Contains(string(text), "{{") {
+			expanded[name] = text
+			continue
+		}
+		var buf bytes.Buffer
+		tmpl, err := parseLabelTemplate(name, text)
+		if err == nil {
+			err = tmpl.Execute(&buf, AlertTemplateData(labels, value))
+		}
+		if err != nil {
+			glog.Warningf("Error expanding label %s of alert %s: %s", name, rule.name, err)
+			expanded[name] = clientmodel.LabelValue(err.Error())
+			continue
+		}
+		expanded[name] = clientmodel.LabelValue(buf.String())
+	}
+	return expanded
+}
+
+// RestoreForState looks up the times since which the alerts of the rule were
+// active, as recorded in the ALERTS_FOR_STATE series up to the given tolerance
+// before the timestamp. Alerts that are still active at the next evaluation
+// keep their recorded active-since time, so that their hold duration is not
+// restarted.
+func (rule *AlertingRule) RestoreForState(timestamp clientmodel.Timestamp, tolerance time.Duration, storage local.Storage) (err error) {
+	defer ast.CatchQueryAbort(&err)
+
+	nameMatcher, err := metric.NewLabelMatcher(metric.Equal, clientmodel.MetricNameLabel, AlertForStateMetricName)
+	if err != nil {
+		return err
+	}
+	alertMatcher, err := metric.NewLabelMatcher(metric.Equal, AlertNameLabel, clientmodel.LabelValue(rule.name))
+	if err != nil {
+		return err
+	}
+	selector := ast.NewMatrixSelector(ast.NewVectorSelector(metric.LabelMatchers{nameMatcher, alertMatcher}, 0), tolerance, 0)
+
+	queryStats := stats.NewTimerGroup()
+	totalEvalTimer := queryStats.GetTimer(stats.TotalEvalTime).Start()
+	defer totalEvalTimer.Stop()
+
+	closer, err := ast.PrepareInstantQuery(selector, timestamp, storage, queryStats)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+
+	restored := map[clientmodel.Fingerprint]clientmodel.Timestamp{}
+	for _, stream := range selector.Eval(timestamp) {
+		if len(stream.Values) == 0 {
+			continue
+		}
+		last := stream.Values[len(stream.Values)-1]
+		if last.Value == 0 {
+			// The alert was resolved.
+			continue
+		}
+		labels := clientmodel.LabelSet{}
+		labels.MergeFromMetric(stream.Metric.Metric)
+		delete(labels, clientmodel.MetricNameLabel)
+		delete(labels, AlertNameLabel)
+		restored[clientmodel.Metric(labels).Fingerprint()] = clientmodel.TimestampFromUnix(int64(last.Value))
+	}
+
+	rule.mutex.Lock()
+	defer rule.mutex.Unlock()
+	rule.restoredActiveSince = restored
+	return nil
+}
+
 // ToDotGraph returns the text representation of a dot graph.
 func (rule *AlertingRule) ToDotGraph() string {
 	graph := fmt.Sprintf(
@@ -206,7 +360,11 @@ func (rule *AlertingRule) ToDotGraph() string {
 }
 
 func (rule *AlertingRule) String() string {
-	return fmt.Sprintf("ALERT %s IF %s FOR %s WITH %s", rule.name, rule.Vector, utility.DurationToString(rule.holdDuration), rule.Labels)
+	s := fmt.Sprintf("ALERT %s IF %s FOR %s WITH %s", rule.name, rule.Vector, utility.DurationToString(rule.holdDuration), rule.Labels)
+	if len(rule.Annotations) > 0 {
+		s += fmt.Sprintf(" ANNOTATIONS %s", rule.Annotations)
+	}
+	return s
 }
 
 // HTMLSnippet returns an HTML snippet representing this alerting rule.
@@ -252,7 +410,7 @@ func (rule *AlertingRule) ActiveAlerts() []Alert {
 }
 
 // NewAlertingRule constructs a new AlertingRule.
-func NewAlertingRule(name string, vector ast.VectorNode, holdDuration time.Duration, labels clientmodel.LabelSet, summary string, description string) *AlertingRule {
+func NewAlertingRule(name string, vector ast.VectorNode, holdDuration time.Duration, labels clientmodel.LabelSet, summary string, description string, annotations clientmodel.LabelSet) *AlertingRule {
 	return &AlertingRule{
 		name:         name,
 		Vector:       vector,
@@ -260,6 +418,7 @@ func NewAlertingRule(name string, vector ast.VectorNode, holdDuration time.Durat
 		Labels:       labels,
 		Summary:      summary,
 		Description:  description,
+		Annotations:  annotations,
 
 		activeAlerts: map[clientmodel.Fingerprint]*Alert{},
 	}
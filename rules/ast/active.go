@@ -0,0 +1,175 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package ast
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// queryCanceledError is returned when a query was canceled while it was
+// evaluated.
+type queryCanceledError struct{}
+
+func (e queryCanceledError) Error() string {
+	return "query canceled"
+}
+
+// IsQueryCanceled returns whether the error was returned because a query was
+// canceled with CancelQuery.
+func IsQueryCanceled(err error) bool {
+	_, ok := err.(queryCanceledError)
+	return ok
+}
+
+// ActiveQuery is a query registered with RegisterQuery while it is evaluated.
+type ActiveQuery struct {
+	ID     uint64
+	Expr   string
+	Client string
+	Start  time.Time
+
+	node       Node
+	canceled   chan struct{}
+	cancelOnce sync.Once
+}
+
+// cancel closes the canceled channel of the query. It may be called more than
+// once.
+func (q *ActiveQuery) cancel() {
+	q.cancelOnce.Do(func() { close(q.canceled) })
+}
+
+// Done removes the query from the active queries and lets the next waiting
+// query be evaluated. It has to be called once the evaluation of the query has
+// finished.
+func (q *ActiveQuery) Done() {
+	activeQueries.remove(q)
+	queryGate.release()
+}
+
+// queryRegistry keeps track of the queries currently evaluated.
+type queryRegistry struct {
+	mtx    sync.Mutex
+	lastID uint64
+	byID   map[uint64]*ActiveQuery
+	byNode map[Node]*ActiveQuery
+}
+
+var activeQueries = &queryRegistry{
+	byID:   map[uint64]*ActiveQuery{},
+	byNode: map[Node]*ActiveQuery{},
+}
+
+// RegisterQuery adds the query with the given root node to the active queries
+// until Done is called on the returned ActiveQuery. Once the query is canceled
+// with CancelQuery, preloading and evaluating the node fail with an error for
+// which IsQueryCanceled returns true. The client describes where the query
+// originates from, e.g. the remote host of an HTTP request.
+//
+// If -query.max-concurrency registered queries are already evaluated,
+// RegisterQuery waits until the query may be evaluated, taking turns with the
+// waiting queries of other clients. It fails if -query.max-queued queries are
+// waiting already, or if the query is canceled or times out while waiting.
+func RegisterQuery(node Node, client string) (*ActiveQuery, error) {
+	q := activeQueries.add(node, client)
+	if err := queryGate.acquire(client, q.canceled, *queryTimeout); err != nil {
+		activeQueries.remove(q)
+		return nil, err
+	}
+	return q, nil
+}
+
+func (r *queryRegistry) add(node Node, client string) *ActiveQuery {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.lastID++
+	q := &ActiveQuery{
+		ID:       r.lastID,
+		Expr:     node.String(),
+		Client:   client,
+		Start:    time.Now(),
+		node:     node,
+		canceled: make(chan struct{}),
+	}
+	r.byID[q.ID] = q
+	r.byNode[node] = q
+	return q
+}
+
+// ActiveQueries returns the registered queries, oldest first.
+func ActiveQueries() []*ActiveQuery {
+	activeQueries.mtx.Lock()
+	defer activeQueries.mtx.Unlock()
+
+	queries := make([]*ActiveQuery, 0, len(activeQueries.byID))
+	for _, q := range activeQueries.byID {
+		queries = append(queries, q)
+	}
+	sort.Sort(queriesByID(queries))
+	return queries
+}
+
+// CancelQuery cancels the registered query with the given ID. It returns false
+// if there is no such query.
+func CancelQuery(id uint64) bool {
+	activeQueries.mtx.Lock()
+	defer activeQueries.mtx.Unlock()
+
+	q, ok := activeQueries.byID[id]
+	if ok {
+		q.cancel()
+	}
+	return ok
+}
+
+func (r *queryRegistry) remove(q *ActiveQuery) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	delete(r.byID, q.ID)
+	if r.byNode[q.node] == q {
+		delete(r.byNode, q.node)
+	}
+}
+
+// canceled returns the channel closed once the query with the given root node
+// is canceled, or nil if the query is not registered.
+func (r *queryRegistry) canceled(node Node) <-chan struct{} {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if q, ok := r.byNode[node]; ok {
+		return q.canceled
+	}
+	return nil
+}
+
+// isCanceled returns whether the channel returned by canceled is closed.
+func isCanceled(canceled <-chan struct{}) bool {
+	select {
+	case <-canceled:
+		return true
+	default:
+		return false
+	}
+}
+
+// queriesByID implements sort.Interface for a slice of ActiveQuery pointers.
+type queriesByID []*ActiveQuery
+
+func (q queriesByID) Len() int           { return len(q) }
+func (q queriesByID) Less(i, j int) bool { return q[i].ID < q[j].ID }
+func (q queriesByID) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
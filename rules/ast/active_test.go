@@ -0,0 +1,86 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package ast
+
+import (
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/stats"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+func TestCancelQuery(t *testing.T) {
+	storage, closer := local.NewTestStorage(t, 1)
+	defer closer.Close()
+	m := clientmodel.Metric{clientmodel.MetricNameLabel: "testmetric"}
+	for ts := clientmodel.Timestamp(0); ts < 100000; ts += 10000 {
+		storage.Append(&clientmodel.Sample{Metric: m, Timestamp: ts, Value: 1})
+	}
+	storage.WaitForIndexing()
+
+	matcher, err := metric.NewLabelMatcher(metric.Equal, clientmodel.MetricNameLabel, "testmetric")
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := NewVectorSelector(metric.LabelMatchers{matcher}, 0)
+
+	q, err := RegisterQuery(node, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queries := ActiveQueries(); len(queries) != 1 || queries[0] != q {
+		t.Fatalf("want registered query to be active, got %v", queries)
+	}
+	if q.Expr != `testmetric` || q.Client != "test" {
+		t.Errorf("got expression %q and client %q", q.Expr, q.Client)
+	}
+
+	// Cancel the query between preloading and evaluation.
+	evalAfterCancel := func() (err error) {
+		defer CatchQueryAbort(&err)
+		queryStats := stats.NewTimerGroup()
+		queryStats.GetTimer(stats.TotalEvalTime).Start()
+		p, err := PrepareInstantQuery(node, 90000, storage, queryStats)
+		if err != nil {
+			return err
+		}
+		defer p.Close()
+		if !CancelQuery(q.ID) {
+			t.Fatalf("query %d not found", q.ID)
+		}
+		node.Eval(90000)
+		return nil
+	}
+	if err := evalAfterCancel(); !IsQueryCanceled(err) {
+		t.Errorf("want canceled evaluation, got %v", err)
+	}
+	// A canceled query fails already while preloading.
+	if _, err := EvalVectorRange(node, 0, 90000, 10*time.Second, storage, stats.NewTimerGroup()); !IsQueryCanceled(err) {
+		t.Errorf("want canceled range query, got %v", err)
+	}
+
+	q.Done()
+	if queries := ActiveQueries(); len(queries) != 0 {
+		t.Errorf("want no active queries, got %v", queries)
+	}
+	if CancelQuery(q.ID) {
+		t.Errorf("query %d still found after it is done", q.ID)
+	}
+	if _, err := EvalVectorInstant(node, 90000, storage, stats.NewTimerGroup()); err != nil {
+		t.Errorf("unregistered query failed: %v", err)
+	}
+}
@@ -20,6 +20,8 @@ import (
 	"math"
 	"time"
 
+	"github.com/golang/glog"
+
 	clientmodel "github.com/prometheus/client_golang/model"
 
 	"github.com/prometheus/prometheus/stats"
@@ -30,6 +32,7 @@ import (
 var (
 	stalenessDelta = flag.Duration("query.staleness-delta", 300*time.Second, "Staleness delta allowance during expression evaluations.")
 	queryTimeout   = flag.Duration("query.timeout", 2*time.Minute, "Maximum time a query may take before being aborted.")
+	logThreshold   = flag.Duration("query.log-threshold", 0, "Queries taking longer than this are logged with their stats. 0 disables logging slow queries.")
 )
 
 type queryTimeoutError struct {
@@ -40,6 +43,35 @@ func (e queryTimeoutError) Error() string {
 	return fmt.Sprintf("query timeout after %v", e.timeoutAfter)
 }
 
+// IsQueryTimeout returns whether the error was returned because a query took
+// longer than its timeout.
+func IsQueryTimeout(err error) bool {
+	_, ok := err.(queryTimeoutError)
+	return ok
+}
+
+// StalenessDelta returns how far back in time expression evaluations look for
+// the latest sample of a series.
+func StalenessDelta() time.Duration {
+	return *stalenessDelta
+}
+
+// QueryTimeout returns the maximum time a query may take before being aborted.
+func QueryTimeout() time.Duration {
+	return *queryTimeout
+}
+
+// LogIfSlow logs the expression and the stats of a query if its total
+// evaluation time exceeded -query.log-threshold.
+func LogIfSlow(node Node, queryStats *stats.TimerGroup) {
+	if *logThreshold <= 0 {
+		return
+	}
+	if d := queryStats.GetTimer(stats.TotalEvalTime).Duration(); d > *logThreshold {
+		glog.Warningf("Slow query took %v: %s\nQuery stats:\n%s", d, node, queryStats)
+	}
+}
+
 // ----------------------------------------------------------------------------
 // Raw data value types.
 
@@ -131,6 +163,10 @@ const (
 	Count
 	Stdvar
 	Stddev
+	CountValues
+	TopK
+	BottomK
+	Quantile
 )
 
 // ----------------------------------------------------------------------------
@@ -217,6 +253,9 @@ type (
 	VectorSelector struct {
 		labelMatchers metric.LabelMatchers
 		offset        time.Duration
+		// If set, the selector is evaluated at this timestamp instead
+		// of the evaluation timestamp.
+		at *clientmodel.Timestamp
 		// The series iterators are populated at query analysis time.
 		iterators map[clientmodel.Fingerprint]local.SeriesIterator
 		metrics   map[clientmodel.Fingerprint]clientmodel.COWMetric
@@ -233,7 +272,10 @@ type (
 
 	// A VectorAggregation with vector return type.
 	VectorAggregation struct {
-		aggrType        AggrType
+		aggrType AggrType
+		// The parameter of count_values, topk, bottomk and quantile,
+		// nil for all other aggregations.
+		param           Node
 		groupBy         clientmodel.LabelNames
 		keepExtraLabels bool
 		vector          VectorNode
@@ -248,7 +290,17 @@ type (
 		rhs              Node
 		matchCardinality VectorMatchCardinality
 		matchOn          clientmodel.LabelNames
-		includeLabels    clientmodel.LabelNames
+		// If true, samples are matched on all labels except those in
+		// matchOn.
+		matchIgnoring bool
+		includeLabels clientmodel.LabelNames
+	}
+
+	// An OffsetExpr evaluates a vector expression at the evaluation
+	// timestamp shifted into the past, as in "(a / b) offset 1w".
+	OffsetExpr struct {
+		expr   VectorNode
+		offset time.Duration
 	}
 )
 
@@ -278,6 +330,22 @@ type (
 		fingerprints clientmodel.Fingerprints
 		interval     time.Duration
 		offset       time.Duration
+		// If set, the selector is evaluated at this timestamp instead
+		// of the evaluation timestamp.
+		at *clientmodel.Timestamp
+		// Set if only the aggregate of the values within the range is
+		// needed and the range is long enough to profit from the
+		// rollups of the storage.
+		useRollups bool
+	}
+
+	// A Subquery evaluates a vector expression at a fixed resolution
+	// over a range, as in "rate(foo[5m])[1h:1m]".
+	Subquery struct {
+		expr       VectorNode
+		interval   time.Duration
+		resolution time.Duration
+		offset     time.Duration
 	}
 )
 
@@ -322,9 +390,15 @@ func (node VectorAggregation) Type() ExprType { return VectorType }
 // Type implements the Node interface.
 func (node VectorArithExpr) Type() ExprType { return VectorType }
 
+// Type implements the Node interface.
+func (node OffsetExpr) Type() ExprType { return VectorType }
+
 // Type implements the Node interface.
 func (node MatrixSelector) Type() ExprType { return MatrixType }
 
+// Type implements the Node interface.
+func (node Subquery) Type() ExprType { return MatrixType }
+
 // Type implements the Node interface.
 func (node StringLiteral) Type() ExprType { return StringType }
 
@@ -351,15 +425,26 @@ func (node VectorFunctionCall) Children() Nodes { return node.args }
 
 // Children implements the Node interface and returns the vector to be
 // aggregated.
-func (node VectorAggregation) Children() Nodes { return Nodes{node.vector} }
+func (node VectorAggregation) Children() Nodes {
+	if node.param != nil {
+		return Nodes{node.param, node.vector}
+	}
+	return Nodes{node.vector}
+}
 
 // Children implements the Node interface and returns the LHS and the RHS
 // of the expression.
 func (node VectorArithExpr) Children() Nodes { return Nodes{node.lhs, node.rhs} }
 
+// Children implements the Node interface and returns the shifted expression.
+func (node OffsetExpr) Children() Nodes { return Nodes{node.expr} }
+
 // Children implements the Node interface and returns an empty slice.
 func (node MatrixSelector) Children() Nodes { return Nodes{} }
 
+// Children implements the Node interface and returns the subquery expression.
+func (node Subquery) Children() Nodes { return Nodes{node.expr} }
+
 // Children implements the Node interface and returns an empty slice.
 func (node StringLiteral) Children() Nodes { return Nodes{} }
 
@@ -388,7 +473,8 @@ func (node *ScalarFunctionCall) Eval(timestamp clientmodel.Timestamp) clientmode
 }
 
 // EvalVectorInstant evaluates a VectorNode with an instant query.
-func EvalVectorInstant(node VectorNode, timestamp clientmodel.Timestamp, storage local.Storage, queryStats *stats.TimerGroup) (Vector, error) {
+func EvalVectorInstant(node VectorNode, timestamp clientmodel.Timestamp, storage local.Storage, queryStats *stats.TimerGroup) (_ Vector, err error) {
+	defer CatchQueryAbort(&err)
 	totalEvalTimer := queryStats.GetTimer(stats.TotalEvalTime).Start()
 	defer totalEvalTimer.Stop()
 
@@ -405,6 +491,13 @@ func EvalVectorInstant(node VectorNode, timestamp clientmodel.Timestamp, storage
 
 // EvalVectorRange evaluates a VectorNode with a range query.
 func EvalVectorRange(node VectorNode, start clientmodel.Timestamp, end clientmodel.Timestamp, interval time.Duration, storage local.Storage, queryStats *stats.TimerGroup) (Matrix, error) {
+	return EvalVectorRangeWithTimeout(node, start, end, interval, *queryTimeout, storage, queryStats)
+}
+
+// EvalVectorRangeWithTimeout evaluates a VectorNode with a range query, which
+// is aborted after the given timeout.
+func EvalVectorRangeWithTimeout(node VectorNode, start clientmodel.Timestamp, end clientmodel.Timestamp, interval time.Duration, timeout time.Duration, storage local.Storage, queryStats *stats.TimerGroup) (_ Matrix, err error) {
+	defer CatchQueryAbort(&err)
 	totalEvalTimer := queryStats.GetTimer(stats.TotalEvalTime).Start()
 	defer totalEvalTimer.Stop()
 	// Explicitly initialize to an empty matrix since a nil Matrix encodes to
@@ -412,7 +505,7 @@ func EvalVectorRange(node VectorNode, start clientmodel.Timestamp, end clientmod
 	matrix := Matrix{}
 
 	prepareTimer := queryStats.GetTimer(stats.TotalQueryPreparationTime).Start()
-	closer, err := PrepareRangeQuery(node, start, end, interval, storage, queryStats)
+	closer, err := prepareRangeQuery(node, start, end, interval, timeout, storage, queryStats)
 	prepareTimer.Stop()
 	if err != nil {
 		return nil, err
@@ -420,12 +513,17 @@ func EvalVectorRange(node VectorNode, start clientmodel.Timestamp, end clientmod
 	defer closer.Close()
 
 	evalTimer := queryStats.GetTimer(stats.InnerEvalTime).Start()
+	canceled := activeQueries.canceled(node)
 	sampleStreams := map[clientmodel.Fingerprint]*SampleStream{}
 	for t := start; !t.After(end); t = t.Add(interval) {
-		if et := totalEvalTimer.ElapsedTime(); et > *queryTimeout {
+		if et := totalEvalTimer.ElapsedTime(); et > timeout {
 			evalTimer.Stop()
 			return nil, queryTimeoutError{et}
 		}
+		if isCanceled(canceled) {
+			evalTimer.Stop()
+			return nil, queryCanceledError{}
+		}
 		vector := node.Eval(t)
 		for _, sample := range vector {
 			samplePair := metric.SamplePair{
@@ -490,10 +588,92 @@ func (node *VectorAggregation) groupedAggregationsToVector(aggregations map[uint
 	return vector
 }
 
+// groupMetric returns the labels of the aggregated sample of a group of
+// samples.
+func (node *VectorAggregation) groupMetric(group Vector) clientmodel.COWMetric {
+	if node.keepExtraLabels {
+		m := group[0].Metric
+		m.Delete(clientmodel.MetricNameLabel)
+		for _, sample := range group[1:] {
+			m = labelIntersection(m, sample.Metric)
+		}
+		return m
+	}
+	m := clientmodel.COWMetric{
+		Metric: clientmodel.Metric{},
+		Copied: true,
+	}
+	for _, l := range node.groupBy {
+		if v, ok := group[0].Metric.Metric[l]; ok {
+			m.Set(l, v)
+		}
+	}
+	return m
+}
+
+// evalWithParam evaluates the aggregations taking a parameter. Unlike the
+// other aggregations, they need all samples of a group at once.
+func (node *VectorAggregation) evalWithParam(timestamp clientmodel.Timestamp, vector Vector) Vector {
+	groups := map[uint64]Vector{}
+	for _, sample := range vector {
+		groupingKey := clientmodel.SignatureForLabels(sample.Metric.Metric, node.groupBy)
+		groups[groupingKey] = append(groups[groupingKey], sample)
+	}
+
+	result := Vector{}
+	switch node.aggrType {
+	case TopK, BottomK:
+		k := int(node.param.(ScalarNode).Eval(timestamp))
+		for _, group := range groups {
+			if node.aggrType == TopK {
+				result = append(result, topK(group, k)...)
+			} else {
+				result = append(result, bottomK(group, k)...)
+			}
+		}
+	case Quantile:
+		q := node.param.(ScalarNode).Eval(timestamp)
+		for _, group := range groups {
+			values := make([]float64, 0, len(group))
+			for _, sample := range group {
+				values = append(values, float64(sample.Value))
+			}
+			result = append(result, &Sample{
+				Metric:    node.groupMetric(group),
+				Value:     clientmodel.SampleValue(valueQuantile(q, values)),
+				Timestamp: timestamp,
+			})
+		}
+	case CountValues:
+		label := clientmodel.LabelName(node.param.(StringNode).Eval(timestamp))
+		for _, group := range groups {
+			counts := map[clientmodel.SampleValue]int{}
+			for _, sample := range group {
+				counts[sample.Value]++
+			}
+			for value, count := range counts {
+				m := node.groupMetric(group)
+				m.Set(label, clientmodel.LabelValue(value.String()))
+				result = append(result, &Sample{
+					Metric:    m,
+					Value:     clientmodel.SampleValue(count),
+					Timestamp: timestamp,
+				})
+			}
+		}
+	default:
+		panic("Unknown aggregation type")
+	}
+	return result
+}
+
 // Eval implements the VectorNode interface and returns the aggregated
 // Vector.
 func (node *VectorAggregation) Eval(timestamp clientmodel.Timestamp) Vector {
 	vector := node.vector.Eval(timestamp)
+	if node.param != nil {
+		return node.evalWithParam(timestamp, vector)
+	}
 	result := map[uint64]*groupedAggregation{}
 	for _, sample := range vector {
 		groupingKey := clientmodel.SignatureForLabels(sample.Metric.Metric, node.groupBy)
@@ -558,9 +738,10 @@ func (node *VectorAggregation) Eval(timestamp clientmodel.Timestamp) Vector {
 func (node *VectorSelector) Eval(timestamp clientmodel.Timestamp) Vector {
 	//// timer := v.stats.GetTimer(stats.GetValueAtTimeTime).Start()
 	samples := Vector{}
+	evalTime := atOrTimestamp(node.at, timestamp).Add(-node.offset)
 	for fp, it := range node.iterators {
-		sampleCandidates := it.GetValueAtTime(timestamp.Add(-node.offset))
-		samplePair := chooseClosestSample(sampleCandidates, timestamp.Add(-node.offset))
+		sampleCandidates := it.GetValueAtTime(evalTime)
+		samplePair := chooseClosestSample(sampleCandidates, evalTime)
 		if samplePair != nil {
 			samples = append(samples, &Sample{
 				Metric:    node.metrics[fp],
@@ -573,6 +754,25 @@ func (node *VectorSelector) Eval(timestamp clientmodel.Timestamp) Vector {
 	return samples
 }
 
+// atOrTimestamp returns the timestamp of an @ modifier if set, or else the
+// evaluation timestamp.
+func atOrTimestamp(at *clientmodel.Timestamp, timestamp clientmodel.Timestamp) clientmodel.Timestamp {
+	if at != nil {
+		return *at
+	}
+	return timestamp
+}
+
+// Eval implements the VectorNode interface and returns the samples of the
+// expression at the shifted timestamp.
+func (node *OffsetExpr) Eval(timestamp clientmodel.Timestamp) Vector {
+	vector := node.expr.Eval(timestamp.Add(-node.offset))
+	for _, sample := range vector {
+		sample.Timestamp = timestamp
+	}
+	return vector
+}
+
 // chooseClosestSample chooses the closest sample of a list of samples
 // surrounding a given target time. If samples are found both before and after
 // the target time, the sample value is interpolated between these. Otherwise,
@@ -913,6 +1113,17 @@ func (node *VectorArithExpr) evalVectors(timestamp clientmodel.Timestamp, lhs, r
 // binary operation and the matching options. If a label that has to be included is set on
 // both sides an error is returned.
 func (node *VectorArithExpr) resultMetric(ls, rs *Sample) clientmodel.COWMetric {
+	if node.matchIgnoring && node.opType != Or && node.opType != And {
+		if node.opType.shouldDropMetric() {
+			ls.Metric.Delete(clientmodel.MetricNameLabel)
+		}
+		for _, ln := range node.matchOn {
+			if !labelNamesContain(node.includeLabels, ln) {
+				ls.Metric.Delete(ln)
+			}
+		}
+		return ls.Metric
+	}
 	if len(node.matchOn) == 0 || node.opType == Or || node.opType == And {
 		if node.opType.shouldDropMetric() {
 			ls.Metric.Delete(clientmodel.MetricNameLabel)
@@ -935,12 +1146,29 @@ func (node *VectorArithExpr) resultMetric(ls, rs *Sample) clientmodel.COWMetric
 	return clientmodel.COWMetric{false, m}
 }
 
+// labelNamesContain returns whether the label name is in the list.
+func labelNamesContain(lns clientmodel.LabelNames, ln clientmodel.LabelName) bool {
+	for _, l := range lns {
+		if l == ln {
+			return true
+		}
+	}
+	return false
+}
+
 // hashForMetric calculates a hash value for the given metric based on the matching
 // options for the binary operation.
 func (node *VectorArithExpr) hashForMetric(metric clientmodel.Metric) uint64 {
 	var labels clientmodel.LabelNames
 
-	if len(node.matchOn) > 0 {
+	if node.matchIgnoring {
+		labels = make(clientmodel.LabelNames, 0, len(metric))
+		for ln := range metric {
+			if ln != clientmodel.MetricNameLabel && !labelNamesContain(node.matchOn, ln) {
+				labels = append(labels, ln)
+			}
+		}
+	} else if len(node.matchOn) > 0 {
 		var match bool
 		for _, ln := range node.matchOn {
 			if _, match = metric[ln]; !match {
@@ -971,6 +1199,7 @@ func (node *VectorArithExpr) hashForMetric(metric clientmodel.Metric) uint64 {
 // Eval implements the MatrixNode interface and returns the value of
 // the selector.
 func (node *MatrixSelector) Eval(timestamp clientmodel.Timestamp) Matrix {
+	timestamp = atOrTimestamp(node.at, timestamp)
 	interval := &metric.Interval{
 		OldestInclusive: timestamp.Add(-node.interval - node.offset),
 		NewestInclusive: timestamp.Add(-node.offset),
@@ -1000,9 +1229,75 @@ func (node *MatrixSelector) Eval(timestamp clientmodel.Timestamp) Matrix {
 	return sampleStreams
 }
 
+// rollupSample is the aggregate of the values of a series within the range of
+// a MatrixSelector.
+type rollupSample struct {
+	Metric clientmodel.COWMetric
+	Rollup metric.Rollup
+}
+
+// evalRollups returns the aggregate of the values within the range of the
+// selector for each series with values in that range. If the selector uses
+// rollups, the rollups available in the storage are combined with the raw
+// values of the remainder of the range.
+func (node *MatrixSelector) evalRollups(timestamp clientmodel.Timestamp) []rollupSample {
+	timestamp = atOrTimestamp(node.at, timestamp)
+	interval := metric.Interval{
+		OldestInclusive: timestamp.Add(-node.interval - node.offset),
+		NewestInclusive: timestamp.Add(-node.offset),
+	}
+	res := local.RollupResolution(node.interval)
+
+	rollupSamples := []rollupSample{}
+	for fp, it := range node.iterators {
+		var r metric.Rollup
+		addRange := func(in metric.Interval) {
+			if in.NewestInclusive.Before(in.OldestInclusive) {
+				return
+			}
+			for _, sp := range it.GetRangeValues(in) {
+				r.Add(sp.Value)
+			}
+		}
+
+		var (
+			rollups []metric.Rollup
+			covered metric.Interval
+			ok      bool
+		)
+		if node.useRollups {
+			rollups, covered, ok = it.GetRollups(interval, res)
+		}
+		if ok {
+			addRange(metric.Interval{
+				OldestInclusive: interval.OldestInclusive,
+				NewestInclusive: covered.OldestInclusive - 1,
+			})
+			for i := range rollups {
+				r.Merge(&rollups[i])
+			}
+			addRange(metric.Interval{
+				OldestInclusive: covered.NewestInclusive + 1,
+				NewestInclusive: interval.NewestInclusive,
+			})
+		} else {
+			addRange(interval)
+		}
+		if r.Count == 0 {
+			continue
+		}
+		rollupSamples = append(rollupSamples, rollupSample{
+			Metric: node.metrics[fp],
+			Rollup: r,
+		})
+	}
+	return rollupSamples
+}
+
 // EvalBoundaries implements the MatrixNode interface and returns the
 // boundary values of the selector.
 func (node *MatrixSelector) EvalBoundaries(timestamp clientmodel.Timestamp) Matrix {
+	timestamp = atOrTimestamp(node.at, timestamp)
 	interval := &metric.Interval{
 		OldestInclusive: timestamp.Add(-node.interval),
 		NewestInclusive: timestamp,
@@ -1026,6 +1321,54 @@ func (node *MatrixSelector) EvalBoundaries(timestamp clientmodel.Timestamp) Matr
 	return sampleStreams
 }
 
+// Eval implements the MatrixNode interface and returns the values of the
+// subquery expression at every multiple of the resolution within the range.
+func (node *Subquery) Eval(timestamp clientmodel.Timestamp) Matrix {
+	end := timestamp.Add(-node.offset)
+	resolution := clientmodel.Timestamp(node.resolution / clientmodel.MinimumTick)
+	start := end.Add(-node.interval)
+	start -= start % resolution
+	if start.Before(end.Add(-node.interval)) {
+		start += resolution
+	}
+
+	sampleStreams := map[clientmodel.Fingerprint]*SampleStream{}
+	var fingerprints clientmodel.Fingerprints
+	for ts := start; !ts.After(end); ts += resolution {
+		for _, sample := range node.expr.Eval(ts) {
+			fp := sample.Metric.Metric.Fingerprint()
+			ss, ok := sampleStreams[fp]
+			if !ok {
+				ss = &SampleStream{Metric: sample.Metric}
+				sampleStreams[fp] = ss
+				fingerprints = append(fingerprints, fp)
+			}
+			ss.Values = append(ss.Values, metric.SamplePair{
+				Timestamp: ts.Add(node.offset),
+				Value:     sample.Value,
+			})
+		}
+	}
+
+	matrix := make(Matrix, 0, len(fingerprints))
+	for _, fp := range fingerprints {
+		matrix = append(matrix, *sampleStreams[fp])
+	}
+	return matrix
+}
+
+// EvalBoundaries implements the MatrixNode interface and returns the first
+// and last values of the subquery within the range.
+func (node *Subquery) EvalBoundaries(timestamp clientmodel.Timestamp) Matrix {
+	matrix := node.Eval(timestamp)
+	for i, ss := range matrix {
+		if len(ss.Values) > 2 {
+			matrix[i].Values = metric.Values{ss.Values[0], ss.Values[len(ss.Values)-1]}
+		}
+	}
+	return matrix
+}
+
 // Len implements sort.Interface.
 func (matrix Matrix) Len() int {
 	return len(matrix)
@@ -1074,6 +1417,20 @@ func NewVectorSelector(m metric.LabelMatchers, offset time.Duration) *VectorSele
 	}
 }
 
+// NewVectorSelectorAt returns a (not yet evaluated) VectorSelector that is
+// evaluated at the given timestamp instead of the evaluation timestamp.
+func NewVectorSelectorAt(m metric.LabelMatchers, offset time.Duration, at clientmodel.Timestamp) *VectorSelector {
+	node := NewVectorSelector(m, offset)
+	node.at = &at
+	return node
+}
+
+// LabelMatchers returns the label matchers the VectorSelector selects series
+// with.
+func (node *VectorSelector) LabelMatchers() metric.LabelMatchers {
+	return node.labelMatchers
+}
+
 // NewVectorAggregation returns a (not yet evaluated)
 // VectorAggregation, aggregating the given VectorNode using the given
 // AggrType, grouping by the given LabelNames.
@@ -1086,6 +1443,34 @@ func NewVectorAggregation(aggrType AggrType, vector VectorNode, groupBy clientmo
 	}
 }
 
+// NewParameterizedVectorAggregation returns a (not yet evaluated)
+// VectorAggregation taking a parameter: the name of the label holding the
+// counted values for CountValues, the number of samples for TopK and BottomK,
+// or the φ-quantile for Quantile.
+func NewParameterizedVectorAggregation(aggrType AggrType, param Node, vector VectorNode, groupBy clientmodel.LabelNames) (*VectorAggregation, error) {
+	switch aggrType {
+	case CountValues:
+		if _, ok := param.(StringNode); !ok {
+			return nil, fmt.Errorf("parameter of %v aggregation must be of string type", aggrType)
+		}
+		if lit, ok := param.(*StringLiteral); ok && !labelNameRE.MatchString(lit.str) {
+			return nil, fmt.Errorf("invalid label name %q in %v aggregation", lit.str, aggrType)
+		}
+	case TopK, BottomK, Quantile:
+		if _, ok := param.(ScalarNode); !ok {
+			return nil, fmt.Errorf("parameter of %v aggregation must be of scalar type", aggrType)
+		}
+	default:
+		return nil, fmt.Errorf("%v aggregation does not take a parameter", aggrType)
+	}
+	return &VectorAggregation{
+		aggrType: aggrType,
+		param:    param,
+		groupBy:  groupBy,
+		vector:   vector,
+	}, nil
+}
+
 // NewFunctionCall returns a (not yet evaluated) function call node
 // (of type ScalarFunctionCall, VectorFunctionCall, or
 // StringFunctionCall).
@@ -1093,6 +1478,11 @@ func NewFunctionCall(function *Function, args Nodes) (Node, error) {
 	if err := function.CheckArgTypes(args); err != nil {
 		return nil, err
 	}
+	if function.rollups {
+		if ms, ok := args[0].(*MatrixSelector); ok && local.RollupResolution(ms.interval) != 0 {
+			ms.useRollups = true
+		}
+	}
 	switch function.returnType {
 	case ScalarType:
 		return &ScalarFunctionCall{
@@ -1129,8 +1519,9 @@ func nodesHaveTypes(nodes Nodes, exprTypes []ExprType) bool {
 }
 
 // NewArithExpr returns a (not yet evaluated) expression node (of type
-// VectorArithExpr or ScalarArithExpr).
-func NewArithExpr(opType BinOpType, lhs Node, rhs Node, matchCard VectorMatchCardinality, matchOn, include clientmodel.LabelNames) (Node, error) {
+// VectorArithExpr or ScalarArithExpr). If ignoring is true, vector samples
+// are matched on all labels except those in matchOn.
+func NewArithExpr(opType BinOpType, lhs Node, rhs Node, matchCard VectorMatchCardinality, matchOn clientmodel.LabelNames, ignoring bool, include clientmodel.LabelNames) (Node, error) {
 	if !nodesHaveTypes(Nodes{lhs, rhs}, []ExprType{ScalarType, VectorType}) {
 		return nil, errors.New("binary operands must be of vector or scalar type")
 	}
@@ -1145,7 +1536,7 @@ func NewArithExpr(opType BinOpType, lhs Node, rhs Node, matchCard VectorMatchCar
 		}
 	}
 	if lhs.Type() != VectorType || rhs.Type() != VectorType {
-		if matchCard != MatchOneToOne || matchOn != nil || include != nil {
+		if matchCard != MatchOneToOne || matchOn != nil || ignoring || include != nil {
 			return nil, errors.New("binary scalar expressions cannot have vector matching options")
 		}
 	}
@@ -1157,6 +1548,7 @@ func NewArithExpr(opType BinOpType, lhs Node, rhs Node, matchCard VectorMatchCar
 			rhs:              rhs,
 			matchCardinality: matchCard,
 			matchOn:          matchOn,
+			matchIgnoring:    ignoring,
 			includeLabels:    include,
 		}, nil
 	}
@@ -1180,6 +1572,35 @@ func NewMatrixSelector(vector *VectorSelector, interval time.Duration, offset ti
 	}
 }
 
+// NewMatrixSelectorAt returns a (not yet evaluated) MatrixSelector that
+// selects the range before the given timestamp instead of the evaluation
+// timestamp.
+func NewMatrixSelectorAt(vector *VectorSelector, interval time.Duration, offset time.Duration, at clientmodel.Timestamp) *MatrixSelector {
+	node := NewMatrixSelector(vector, interval, offset)
+	node.at = &at
+	return node
+}
+
+// NewOffsetExpr returns a (not yet evaluated) OffsetExpr evaluating the
+// expression at the evaluation timestamp shifted by the offset.
+func NewOffsetExpr(expr VectorNode, offset time.Duration) *OffsetExpr {
+	return &OffsetExpr{
+		expr:   expr,
+		offset: offset,
+	}
+}
+
+// NewSubquery returns a (not yet evaluated) Subquery evaluating the
+// expression every resolution within the given range.
+func NewSubquery(expr VectorNode, interval, resolution, offset time.Duration) *Subquery {
+	return &Subquery{
+		expr:       expr,
+		interval:   interval,
+		resolution: resolution,
+		offset:     offset,
+	}
+}
+
 // NewStringLiteral returns a StringLiteral with the given string as
 // value.
 func NewStringLiteral(str string) *StringLiteral {
@@ -0,0 +1,188 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package ast
+
+import (
+	"flag"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	maxConcurrency = flag.Int("query.max-concurrency", 20, "Maximum number of queries registered by API clients that are evaluated concurrently. Rule evaluations are not limited. 0 means no limit.")
+	maxQueued      = flag.Int("query.max-queued", 100, "Maximum number of queries waiting for evaluation once -query.max-concurrency is reached. Further queries are rejected.")
+)
+
+var (
+	queueDuration = prometheus.NewSummary(prometheus.SummaryOpts{
+		Namespace: "prometheus",
+		Name:      "query_queue_duration_milliseconds",
+		Help:      "The time queries waited for evaluation because -query.max-concurrency was reached.",
+	})
+	queriesRejected = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "prometheus",
+		Name:      "queries_rejected_total",
+		Help:      "The total number of queries rejected because too many queries were waiting for evaluation.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(queueDuration)
+	prometheus.MustRegister(queriesRejected)
+}
+
+// queryQueueFullError is returned when a query is rejected because too many
+// queries are waiting for evaluation.
+type queryQueueFullError struct {
+	max int
+}
+
+func (e queryQueueFullError) Error() string {
+	return fmt.Sprintf("too many queries waiting for evaluation (%d)", e.max)
+}
+
+// IsQueryQueueFull returns whether the error was returned because a query was
+// rejected as too many queries were waiting for evaluation.
+func IsQueryQueueFull(err error) bool {
+	_, ok := err.(queryQueueFullError)
+	return ok
+}
+
+// queryWaiter is a query waiting for evaluation.
+type queryWaiter struct {
+	client string
+	ready  chan struct{} // Closed once the query may be evaluated.
+}
+
+// concurrencyGate limits the number of queries evaluated concurrently to
+// -query.max-concurrency. Queries beyond the limit wait in one queue per
+// client. Slots freed by finished queries are handed to the clients in turn,
+// so that a client sending many queries at once cannot starve the others.
+type concurrencyGate struct {
+	mtx     sync.Mutex
+	running int
+	queued  int
+	queues  map[string][]*queryWaiter
+	clients []string // The clients with waiting queries, next one first.
+}
+
+var queryGate = &concurrencyGate{
+	queues: map[string][]*queryWaiter{},
+}
+
+// acquire returns once the query of the client may be evaluated. It fails if
+// the wait queue is full, the canceled channel is closed, or the query has
+// waited longer than the timeout. After a successful call, release has to be
+// called once the query has finished.
+func (g *concurrencyGate) acquire(client string, canceled <-chan struct{}, timeout time.Duration) error {
+	g.mtx.Lock()
+	if *maxConcurrency <= 0 || g.running < *maxConcurrency {
+		g.running++
+		g.mtx.Unlock()
+		return nil
+	}
+	if g.queued >= *maxQueued {
+		g.mtx.Unlock()
+		queriesRejected.Inc()
+		return queryQueueFullError{*maxQueued}
+	}
+	w := &queryWaiter{client: client, ready: make(chan struct{})}
+	if len(g.queues[client]) == 0 {
+		g.clients = append(g.clients, client)
+	}
+	g.queues[client] = append(g.queues[client], w)
+	g.queued++
+	g.mtx.Unlock()
+
+	begin := time.Now()
+	defer func() {
+		queueDuration.Observe(float64(time.Since(begin) / time.Millisecond))
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-w.ready:
+		return nil
+	case <-canceled:
+		err = queryCanceledError{}
+	case <-timer.C:
+		err = queryTimeoutError{time.Since(begin)}
+	}
+
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if !g.dequeue(w) {
+		// The query got its slot in the meantime. Pass it on.
+		g.releaseLocked()
+	}
+	return err
+}
+
+// release frees the slot of a finished query.
+func (g *concurrencyGate) release() {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	g.releaseLocked()
+}
+
+// releaseLocked hands the slot of a finished query to the next waiting one.
+// The caller must hold the mutex.
+func (g *concurrencyGate) releaseLocked() {
+	if len(g.clients) == 0 {
+		g.running--
+		return
+	}
+	client := g.clients[0]
+	g.clients = g.clients[1:]
+	queue := g.queues[client]
+	w := queue[0]
+	if len(queue) > 1 {
+		g.queues[client] = queue[1:]
+		g.clients = append(g.clients, client)
+	} else {
+		delete(g.queues, client)
+	}
+	g.queued--
+	close(w.ready)
+}
+
+// dequeue removes a waiting query from the queue of its client. It returns
+// false if the query is not waiting anymore. The caller must hold the mutex.
+func (g *concurrencyGate) dequeue(w *queryWaiter) bool {
+	queue := g.queues[w.client]
+	for i, qw := range queue {
+		if qw != w {
+			continue
+		}
+		g.queued--
+		if len(queue) > 1 {
+			g.queues[w.client] = append(queue[:i], queue[i+1:]...)
+			return true
+		}
+		delete(g.queues, w.client)
+		for j, c := range g.clients {
+			if c == w.client {
+				g.clients = append(g.clients[:j], g.clients[j+1:]...)
+				break
+			}
+		}
+		return true
+	}
+	return false
+}
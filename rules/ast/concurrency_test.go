@@ -0,0 +1,103 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package ast
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConcurrencyGate(t *testing.T) {
+	defer func(concurrency, queued int) {
+		*maxConcurrency, *maxQueued = concurrency, queued
+	}(*maxConcurrency, *maxQueued)
+	*maxConcurrency, *maxQueued = 1, 3
+
+	g := &concurrencyGate{queues: map[string][]*queryWaiter{}}
+	if err := g.acquire("a", nil, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	// Queue three queries, two of them from client a, and wait until each
+	// of them is queued to make the order deterministic.
+	order := make(chan string, 3)
+	for i, client := range []string{"a", "a", "b"} {
+		go func(client string) {
+			if err := g.acquire(client, nil, time.Minute); err != nil {
+				t.Error(err)
+				return
+			}
+			order <- client
+			g.release()
+		}(client)
+		waitForQueued(t, g, i+1)
+		if len(order) > 0 {
+			t.Fatal("query evaluated while the limit was reached")
+		}
+	}
+
+	if err := g.acquire("c", nil, time.Minute); !IsQueryQueueFull(err) {
+		t.Errorf("want full queue error, got %v", err)
+	}
+
+	g.release()
+	// The second query of client a has to wait for the one of client b.
+	for _, want := range []string{"a", "b", "a"} {
+		if got := <-order; got != want {
+			t.Errorf("want query of client %s to be evaluated next, got %s", want, got)
+		}
+	}
+}
+
+func TestConcurrencyGateAbort(t *testing.T) {
+	defer func(concurrency, queued int) {
+		*maxConcurrency, *maxQueued = concurrency, queued
+	}(*maxConcurrency, *maxQueued)
+	*maxConcurrency, *maxQueued = 1, 10
+
+	g := &concurrencyGate{queues: map[string][]*queryWaiter{}}
+	if err := g.acquire("a", nil, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := g.acquire("b", nil, time.Millisecond); !IsQueryTimeout(err) {
+		t.Errorf("want timeout error, got %v", err)
+	}
+	canceled := make(chan struct{})
+	close(canceled)
+	if err := g.acquire("b", canceled, time.Minute); !IsQueryCanceled(err) {
+		t.Errorf("want canceled error, got %v", err)
+	}
+	if g.queued != 0 || len(g.queues) != 0 || len(g.clients) != 0 {
+		t.Errorf("aborted queries still queued: %d queued, queues %v, clients %v", g.queued, g.queues, g.clients)
+	}
+
+	g.release()
+	if g.running != 0 {
+		t.Errorf("want no running queries, got %d", g.running)
+	}
+}
+
+// waitForQueued waits until n queries are waiting at the gate.
+func waitForQueued(t *testing.T, g *concurrencyGate, n int) {
+	for i := 0; i < 1000; i++ {
+		g.mtx.Lock()
+		queued := g.queued
+		g.mtx.Unlock()
+		if queued >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("%d queries not queued in time", n)
+}
@@ -0,0 +1,149 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ast
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/utility"
+)
+
+// A Plan describes how an expression is evaluated, as a tree with a Plan per
+// node of the expression.
+type Plan struct {
+	// The operation of the node, e.g. "SUM BY (job)" or "rate".
+	Operation string `json:"operation"`
+	Type      string `json:"type"`
+	// The number of series selected in the local storage, for selectors
+	// only.
+	Series *int `json:"series,omitempty"`
+	// The range of matrix selectors and subqueries and the offset of
+	// selectors and subqueries.
+	Range  string `json:"range,omitempty"`
+	Offset string `json:"offset,omitempty"`
+	// The evaluation resolution of subqueries.
+	Resolution string `json:"resolution,omitempty"`
+	// Whether a matrix selector aggregates over the rollups of the storage
+	// instead of raw samples.
+	Rollups  bool    `json:"rollups,omitempty"`
+	Children []*Plan `json:"children,omitempty"`
+}
+
+// Explain returns the evaluation plan of the expression without evaluating
+// it. Only the indexes of the storage are used to count the series selected.
+func Explain(node Node, storage local.Storage) *Plan {
+	plan := &Plan{
+		Operation: operation(node),
+		Type:      node.Type().String(),
+	}
+	switch n := node.(type) {
+	case *VectorSelector:
+		numSeries := len(storage.GetFingerprintsForLabelMatchers(n.labelMatchers))
+		plan.Series = &numSeries
+		if n.offset != 0 {
+			plan.Offset = utility.DurationToString(n.offset)
+		}
+	case *MatrixSelector:
+		numSeries := len(storage.GetFingerprintsForLabelMatchers(n.labelMatchers))
+		plan.Series = &numSeries
+		plan.Range = utility.DurationToString(n.interval)
+		if n.offset != 0 {
+			plan.Offset = utility.DurationToString(n.offset)
+		}
+		plan.Rollups = n.useRollups
+	case *OffsetExpr:
+		plan.Offset = utility.DurationToString(n.offset)
+	case *Subquery:
+		plan.Range = utility.DurationToString(n.interval)
+		plan.Resolution = utility.DurationToString(n.resolution)
+		if n.offset != 0 {
+			plan.Offset = utility.DurationToString(n.offset)
+		}
+	}
+	for _, child := range node.Children() {
+		plan.Children = append(plan.Children, Explain(child, storage))
+	}
+	return plan
+}
+
+// operation describes what a node does, leaving out its children.
+func operation(node Node) string {
+	switch n := node.(type) {
+	case *VectorSelector:
+		return n.String()
+	case *MatrixSelector:
+		return (&VectorSelector{labelMatchers: n.labelMatchers, at: n.at}).String()
+	case *OffsetExpr:
+		return "offset"
+	case *Subquery:
+		return "subquery"
+	case *VectorAggregation:
+		op := n.aggrType.String()
+		if len(n.groupBy) > 0 {
+			op = fmt.Sprintf("%s BY (%s)", op, n.groupBy)
+		}
+		if n.keepExtraLabels {
+			op += " KEEPING_EXTRA"
+		}
+		return op
+	case *VectorArithExpr:
+		if matching := n.matchingString(); matching != "" {
+			return n.opType.String() + " " + matching
+		}
+		return n.opType.String()
+	case *ScalarArithExpr:
+		return n.opType.String()
+	case *VectorFunctionCall:
+		return n.function.name
+	case *ScalarFunctionCall:
+		return n.function.name
+	case *StringFunctionCall:
+		return n.function.name
+	default:
+		return node.String()
+	}
+}
+
+// String returns the plan as an indented tree, one node per line.
+func (p *Plan) String() string {
+	buf := &bytes.Buffer{}
+	p.write(buf, 0)
+	return buf.String()
+}
+
+func (p *Plan) write(buf *bytes.Buffer, depth int) {
+	fmt.Fprintf(buf, "%s%s [%s]", strings.Repeat("  ", depth), p.Operation, p.Type)
+	if p.Range != "" {
+		fmt.Fprintf(buf, " range=%s", p.Range)
+	}
+	if p.Offset != "" {
+		fmt.Fprintf(buf, " offset=%s", p.Offset)
+	}
+	if p.Resolution != "" {
+		fmt.Fprintf(buf, " resolution=%s", p.Resolution)
+	}
+	if p.Rollups {
+		buf.WriteString(" rollups")
+	}
+	if p.Series != nil {
+		fmt.Fprintf(buf, " series=%d", *p.Series)
+	}
+	buf.WriteByte('\n')
+	for _, child := range p.Children {
+		child.write(buf, depth+1)
+	}
+}
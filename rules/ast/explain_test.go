@@ -0,0 +1,77 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ast
+
+import (
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+func TestExplain(t *testing.T) {
+	storage, closer := local.NewTestStorage(t, 1)
+	defer closer.Close()
+	for _, job := range []clientmodel.LabelValue{"api", "db"} {
+		storage.Append(&clientmodel.Sample{
+			Metric: clientmodel.Metric{
+				clientmodel.MetricNameLabel: "requests",
+				"job":                       job,
+			},
+			Timestamp: 0,
+			Value:     1,
+		})
+	}
+	storage.WaitForIndexing()
+
+	requests, err := metric.NewLabelMatcher(metric.Equal, clientmodel.MetricNameLabel, "requests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	api, err := metric.NewLabelMatcher(metric.Equal, "job", "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rate, err := NewFunctionCall(functions["rate"], Nodes{
+		NewMatrixSelector(NewVectorSelector(metric.LabelMatchers{requests}, 0), 5*time.Minute, 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, err := NewArithExpr(
+		Div,
+		NewVectorAggregation(Sum, rate.(VectorNode), clientmodel.LabelNames{"job"}, false),
+		NewVectorSelector(metric.LabelMatchers{requests, api}, time.Hour),
+		MatchManyToOne,
+		clientmodel.LabelNames{"job"},
+		false,
+		nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `/ ON (job) GROUP_LEFT [vector]
+  SUM BY (job) [vector]
+    rate [vector]
+      requests [matrix] range=5m series=2
+  requests{job="api"} [vector] offset=1h series=1
+`
+	if got := Explain(node, storage).String(); got != want {
+		t.Errorf("got plan\n%s\nwant\n%s", got, want)
+	}
+}
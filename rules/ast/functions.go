@@ -17,8 +17,10 @@ import (
 	"container/heap"
 	"fmt"
 	"math"
+	"regexp"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	clientmodel "github.com/prometheus/client_golang/model"
@@ -34,12 +36,22 @@ type Function struct {
 	optionalArgs int
 	returnType   ExprType
 	callFn       func(timestamp clientmodel.Timestamp, args []Node) interface{}
+	// If rollups is true, the function only needs the aggregate of the
+	// values of its MatrixSelector argument, which can be evaluated from
+	// the rollups of the storage.
+	rollups bool
+	// If variadic is true, the last argument type may be repeated any
+	// number of times.
+	variadic bool
+	// checkArgs optionally validates the arguments beyond their types,
+	// e.g. string literals that have to be valid label names.
+	checkArgs func(args []Node) error
 }
 
 // CheckArgTypes returns a non-nil error if the number or types of
 // passed in arg nodes do not match the function's expectations.
 func (function *Function) CheckArgTypes(args []Node) error {
-	if len(function.argTypes) < len(args) {
+	if !function.variadic && len(function.argTypes) < len(args) {
 		return fmt.Errorf(
 			"too many arguments to function %v(): %v expected at most, %v given",
 			function.name, len(function.argTypes), len(args),
@@ -52,21 +64,25 @@ func (function *Function) CheckArgTypes(args []Node) error {
 		)
 	}
 	for idx, arg := range args {
+		argType := function.argTypes[len(function.argTypes)-1]
+		if idx < len(function.argTypes) {
+			argType = function.argTypes[idx]
+		}
 		invalidType := false
 		var expectedType string
-		if _, ok := arg.(ScalarNode); function.argTypes[idx] == ScalarType && !ok {
+		if _, ok := arg.(ScalarNode); argType == ScalarType && !ok {
 			invalidType = true
 			expectedType = "scalar"
 		}
-		if _, ok := arg.(VectorNode); function.argTypes[idx] == VectorType && !ok {
+		if _, ok := arg.(VectorNode); argType == VectorType && !ok {
 			invalidType = true
 			expectedType = "vector"
 		}
-		if _, ok := arg.(MatrixNode); function.argTypes[idx] == MatrixType && !ok {
+		if _, ok := arg.(MatrixNode); argType == MatrixType && !ok {
 			invalidType = true
 			expectedType = "matrix"
 		}
-		if _, ok := arg.(StringNode); function.argTypes[idx] == StringType && !ok {
+		if _, ok := arg.(StringNode); argType == StringType && !ok {
 			invalidType = true
 			expectedType = "string"
 		}
@@ -78,6 +94,9 @@ func (function *Function) CheckArgTypes(args []Node) error {
 			)
 		}
 	}
+	if function.checkArgs != nil {
+		return function.checkArgs(args)
+	}
 	return nil
 }
 
@@ -119,7 +138,7 @@ func deltaImpl(timestamp clientmodel.Timestamp, args []Node) interface{} {
 		}
 		resultValue := lastValue - samples.Values[0].Value + counterCorrection
 
-		targetInterval := args[0].(*MatrixSelector).interval
+		targetInterval := matrixRange(matrixNode)
 		sampledInterval := samples.Values[len(samples.Values)-1].Timestamp.Sub(samples.Values[0].Timestamp)
 		if sampledInterval == 0 {
 			// Only found one sample. Cannot compute a rate from this.
@@ -147,15 +166,23 @@ func deltaImpl(timestamp clientmodel.Timestamp, args []Node) interface{} {
 	return resultVector
 }
 
+// matrixRange returns the duration of the range covered by a matrix node.
+func matrixRange(node MatrixNode) time.Duration {
+	switch n := node.(type) {
+	case *MatrixSelector:
+		return n.interval
+	case *Subquery:
+		return n.interval
+	}
+	panic(fmt.Sprintf("unknown matrix node %T", node))
+}
+
 // === rate(node MatrixNode) Vector ===
 func rateImpl(timestamp clientmodel.Timestamp, args []Node) interface{} {
 	args = append(args, &ScalarLiteral{value: 1})
 	vector := deltaImpl(timestamp, args).(Vector)
 
-	// TODO: could be other type of MatrixNode in the future (right now, only
-	// MatrixSelector exists). Find a better way of getting the duration of a
-	// matrix, such as looking at the samples themselves.
-	interval := args[0].(*MatrixSelector).interval
+	interval := matrixRange(args[0].(MatrixNode))
 	for i := range vector {
 		vector[i].Value /= clientmodel.SampleValue(interval / time.Second)
 	}
@@ -213,16 +240,14 @@ func sortDescImpl(timestamp clientmodel.Timestamp, args []Node) interface{} {
 	return Vector(byValueSorter)
 }
 
-// === topk(k ScalarNode, node VectorNode) Vector ===
-func topkImpl(timestamp clientmodel.Timestamp, args []Node) interface{} {
-	k := int(args[0].(ScalarNode).Eval(timestamp))
+// topK returns the k samples of the vector with the largest values, sorted
+// by descending value.
+func topK(vector Vector, k int) Vector {
 	if k < 1 {
 		return Vector{}
 	}
 
 	topk := make(vectorByValueHeap, 0, k)
-	vector := args[1].(VectorNode).Eval(timestamp)
-
 	for _, el := range vector {
 		if len(topk) < k || topk[0].Value < el.Value {
 			if len(topk) == k {
@@ -235,17 +260,15 @@ func topkImpl(timestamp clientmodel.Timestamp, args []Node) interface{} {
 	return Vector(topk)
 }
 
-// === bottomk(k ScalarNode, node VectorNode) Vector ===
-func bottomkImpl(timestamp clientmodel.Timestamp, args []Node) interface{} {
-	k := int(args[0].(ScalarNode).Eval(timestamp))
+// bottomK returns the k samples of the vector with the smallest values,
+// sorted by ascending value.
+func bottomK(vector Vector, k int) Vector {
 	if k < 1 {
 		return Vector{}
 	}
 
 	bottomk := make(vectorByValueHeap, 0, k)
 	bkHeap := reverseHeap{Interface: &bottomk}
-	vector := args[1].(VectorNode).Eval(timestamp)
-
 	for _, el := range vector {
 		if len(bottomk) < k || bottomk[0].Value > el.Value {
 			if len(bottomk) == k {
@@ -329,16 +352,55 @@ func countScalarImpl(timestamp clientmodel.Timestamp, args []Node) interface{} {
 	return clientmodel.SampleValue(len(args[0].(VectorNode).Eval(timestamp)))
 }
 
-func aggrOverTime(timestamp clientmodel.Timestamp, args []Node, aggrFn func(metric.Values) clientmodel.SampleValue) interface{} {
-	n := args[0].(MatrixNode)
-	matrixVal := n.Eval(timestamp)
+func aggrOverTime(timestamp clientmodel.Timestamp, args []Node, aggrFn func(*metric.Rollup) clientmodel.SampleValue) interface{} {
+	n, ok := args[0].(*MatrixSelector)
+	if !ok {
+		// Subqueries have no rollups, so aggregate over their values.
+		return valuesOverTime(timestamp, args[0].(MatrixNode), func(values metric.Values) clientmodel.SampleValue {
+			var r metric.Rollup
+			for _, v := range values {
+				r.Add(v.Value)
+			}
+			return aggrFn(&r)
+		})
+	}
+	resultVector := Vector{}
+
+	for _, el := range n.evalRollups(timestamp) {
+		el.Metric.Delete(clientmodel.MetricNameLabel)
+		resultVector = append(resultVector, &Sample{
+			Metric:    el.Metric,
+			Value:     aggrFn(&el.Rollup),
+			Timestamp: timestamp,
+		})
+	}
+	return resultVector
+}
+
+// === avg_over_time(matrix MatrixNode) Vector ===
+func avgOverTimeImpl(timestamp clientmodel.Timestamp, args []Node) interface{} {
+	return aggrOverTime(timestamp, args, func(r *metric.Rollup) clientmodel.SampleValue {
+		return r.Avg()
+	})
+}
+
+// === count_over_time(matrix MatrixNode) Vector ===
+func countOverTimeImpl(timestamp clientmodel.Timestamp, args []Node) interface{} {
+	return aggrOverTime(timestamp, args, func(r *metric.Rollup) clientmodel.SampleValue {
+		return clientmodel.SampleValue(r.Count)
+	})
+}
+
+// valuesOverTime applies aggrFn to the raw values of each series in the
+// matrix. Unlike aggrOverTime, it doesn't use rollups and thus works for
+// aggregations that cannot be derived from them.
+func valuesOverTime(timestamp clientmodel.Timestamp, node MatrixNode, aggrFn func(metric.Values) clientmodel.SampleValue) interface{} {
 	resultVector := Vector{}
 
-	for _, el := range matrixVal {
+	for _, el := range node.Eval(timestamp) {
 		if len(el.Values) == 0 {
 			continue
 		}
-
 		el.Metric.Delete(clientmodel.MetricNameLabel)
 		resultVector = append(resultVector, &Sample{
 			Metric:    el.Metric,
@@ -349,24 +411,44 @@ func aggrOverTime(timestamp clientmodel.Timestamp, args []Node, aggrFn func(metr
 	return resultVector
 }
 
-// === avg_over_time(matrix MatrixNode) Vector ===
-func avgOverTimeImpl(timestamp clientmodel.Timestamp, args []Node) interface{} {
-	return aggrOverTime(timestamp, args, func(values metric.Values) clientmodel.SampleValue {
-		var sum clientmodel.SampleValue
+// === quantile_over_time(q ScalarNode, matrix MatrixNode) Vector ===
+func quantileOverTimeImpl(timestamp clientmodel.Timestamp, args []Node) interface{} {
+	q := args[0].(ScalarNode).Eval(timestamp)
+	return valuesOverTime(timestamp, args[1].(MatrixNode), func(values metric.Values) clientmodel.SampleValue {
+		floats := make([]float64, 0, len(values))
 		for _, v := range values {
-			sum += v.Value
+			floats = append(floats, float64(v.Value))
 		}
-		return sum / clientmodel.SampleValue(len(values))
+		return clientmodel.SampleValue(valueQuantile(q, floats))
 	})
 }
 
-// === count_over_time(matrix MatrixNode) Vector ===
-func countOverTimeImpl(timestamp clientmodel.Timestamp, args []Node) interface{} {
-	return aggrOverTime(timestamp, args, func(values metric.Values) clientmodel.SampleValue {
-		return clientmodel.SampleValue(len(values))
+// stdvarOverTime returns the population variance of the values. It uses
+// Welford's algorithm, as subtracting the squared mean from the mean of the
+// squares loses all precision for large values that barely change, up to
+// returning a negative variance.
+func stdvarOverTime(values metric.Values) clientmodel.SampleValue {
+	var mean, m2 float64
+	for i, v := range values {
+		delta := float64(v.Value) - mean
+		mean += delta / float64(i+1)
+		m2 += delta * (float64(v.Value) - mean)
+	}
+	return clientmodel.SampleValue(m2 / float64(len(values)))
+}
+
+// === stddev_over_time(matrix MatrixNode) Vector ===
+func stddevOverTimeImpl(timestamp clientmodel.Timestamp, args []Node) interface{} {
+	return valuesOverTime(timestamp, args[0].(MatrixNode), func(values metric.Values) clientmodel.SampleValue {
+		return clientmodel.SampleValue(math.Sqrt(float64(stdvarOverTime(values))))
 	})
 }
 
+// === stdvar_over_time(matrix MatrixNode) Vector ===
+func stdvarOverTimeImpl(timestamp clientmodel.Timestamp, args []Node) interface{} {
+	return valuesOverTime(timestamp, args[0].(MatrixNode), stdvarOverTime)
+}
+
 // === floor(vector VectorNode) Vector ===
 func floorImpl(timestamp clientmodel.Timestamp, args []Node) interface{} {
 	n := args[0].(VectorNode)
@@ -380,34 +462,22 @@ func floorImpl(timestamp clientmodel.Timestamp, args []Node) interface{} {
 
 // === max_over_time(matrix MatrixNode) Vector ===
 func maxOverTimeImpl(timestamp clientmodel.Timestamp, args []Node) interface{} {
-	return aggrOverTime(timestamp, args, func(values metric.Values) clientmodel.SampleValue {
-		max := math.Inf(-1)
-		for _, v := range values {
-			max = math.Max(max, float64(v.Value))
-		}
-		return clientmodel.SampleValue(max)
+	return aggrOverTime(timestamp, args, func(r *metric.Rollup) clientmodel.SampleValue {
+		return r.Max
 	})
 }
 
 // === min_over_time(matrix MatrixNode) Vector ===
 func minOverTimeImpl(timestamp clientmodel.Timestamp, args []Node) interface{} {
-	return aggrOverTime(timestamp, args, func(values metric.Values) clientmodel.SampleValue {
-		min := math.Inf(1)
-		for _, v := range values {
-			min = math.Min(min, float64(v.Value))
-		}
-		return clientmodel.SampleValue(min)
+	return aggrOverTime(timestamp, args, func(r *metric.Rollup) clientmodel.SampleValue {
+		return r.Min
 	})
 }
 
 // === sum_over_time(matrix MatrixNode) Vector ===
 func sumOverTimeImpl(timestamp clientmodel.Timestamp, args []Node) interface{} {
-	return aggrOverTime(timestamp, args, func(values metric.Values) clientmodel.SampleValue {
-		var sum clientmodel.SampleValue
-		for _, v := range values {
-			sum += v.Value
-		}
-		return sum
+	return aggrOverTime(timestamp, args, func(r *metric.Rollup) clientmodel.SampleValue {
+		return r.Sum
 	})
 }
 
@@ -527,28 +597,61 @@ func derivImpl(timestamp clientmodel.Timestamp, args []Node) interface{} {
 			continue
 		}
 
-		// Least squares.
-		n := clientmodel.SampleValue(0)
-		sumY := clientmodel.SampleValue(0)
-		sumX := clientmodel.SampleValue(0)
-		sumXY := clientmodel.SampleValue(0)
-		sumX2 := clientmodel.SampleValue(0)
-		for _, sample := range samples.Values {
-			x := clientmodel.SampleValue(sample.Timestamp.UnixNano() / 1e9)
-			n += 1.0
-			sumY += sample.Value
-			sumX += x
-			sumXY += x * sample.Value
-			sumX2 += x * x
+		slope, _ := linearRegression(samples.Values, timestamp)
+		resultSample := &Sample{
+			Metric:    samples.Metric,
+			Value:     slope,
+			Timestamp: timestamp,
 		}
-		numerator := sumXY - sumX*sumY/n
-		denominator := sumX2 - (sumX*sumX)/n
+		resultSample.Metric.Delete(clientmodel.MetricNameLabel)
+		resultVector = append(resultVector, resultSample)
+	}
+	return resultVector
+}
 
-		resultValue := numerator / denominator
+// linearRegression performs a least-squares linear regression analysis on the
+// provided values. It returns the slope per second, and the value of the
+// regression line at the intercept time.
+func linearRegression(values metric.Values, interceptTime clientmodel.Timestamp) (slope, intercept clientmodel.SampleValue) {
+	n := clientmodel.SampleValue(0)
+	sumY := clientmodel.SampleValue(0)
+	sumX := clientmodel.SampleValue(0)
+	sumXY := clientmodel.SampleValue(0)
+	sumX2 := clientmodel.SampleValue(0)
+	for _, sample := range values {
+		x := clientmodel.SampleValue(sample.Timestamp.Sub(interceptTime).Seconds())
+		n += 1.0
+		sumY += sample.Value
+		sumX += x
+		sumXY += x * sample.Value
+		sumX2 += x * x
+	}
+	covXY := sumXY - sumX*sumY/n
+	varX := sumX2 - sumX*sumX/n
+
+	slope = covXY / varX
+	intercept = sumY/n - slope*sumX/n
+	return slope, intercept
+}
 
+// === predict_linear(node MatrixNode, t ScalarNode) Vector ===
+func predictLinearImpl(timestamp clientmodel.Timestamp, args []Node) interface{} {
+	matrixNode := args[0].(MatrixNode)
+	duration := args[1].(ScalarNode).Eval(timestamp)
+	resultVector := Vector{}
+
+	matrixValue := matrixNode.Eval(timestamp)
+	for _, samples := range matrixValue {
+		// No sense in trying to predict anything without at least two points.
+		// Drop this vector element.
+		if len(samples.Values) < 2 {
+			continue
+		}
+
+		slope, intercept := linearRegression(samples.Values, timestamp)
 		resultSample := &Sample{
 			Metric:    samples.Metric,
-			Value:     resultValue,
+			Value:     intercept + slope*duration,
 			Timestamp: timestamp,
 		}
 		resultSample.Metric.Delete(clientmodel.MetricNameLabel)
@@ -557,7 +660,148 @@ func derivImpl(timestamp clientmodel.Timestamp, args []Node) interface{} {
 	return resultVector
 }
 
-// === histogram_quantile(k ScalarNode, vector VectorNode) Vector ===
+// === holt_winters(node MatrixNode, sf ScalarNode, tf ScalarNode) Vector ===
+func holtWintersImpl(timestamp clientmodel.Timestamp, args []Node) interface{} {
+	matrixNode := args[0].(MatrixNode)
+	// The smoothing factor weights recent values against older ones, the
+	// trend factor recent trends against older ones. Both have to be
+	// between 0 and 1, otherwise the result is empty.
+	sf := args[1].(ScalarNode).Eval(timestamp)
+	tf := args[2].(ScalarNode).Eval(timestamp)
+	resultVector := Vector{}
+	if sf <= 0 || sf >= 1 || tf <= 0 || tf >= 1 {
+		return resultVector
+	}
+
+	matrixValue := matrixNode.Eval(timestamp)
+	for _, samples := range matrixValue {
+		// No sense in trying to smooth a trend without at least two points.
+		// Drop this vector element.
+		if len(samples.Values) < 2 {
+			continue
+		}
+
+		// Double exponential smoothing, starting with the first value as
+		// the level and the first difference as the trend.
+		prevLevel, level := clientmodel.SampleValue(0), samples.Values[0].Value
+		trend := samples.Values[1].Value - samples.Values[0].Value
+		for i := 1; i < len(samples.Values); i++ {
+			if i > 1 {
+				trend = tf*(level-prevLevel) + (1-tf)*trend
+			}
+			prevLevel, level = level, sf*samples.Values[i].Value+(1-sf)*(level+trend)
+		}
+
+		resultSample := &Sample{
+			Metric:    samples.Metric,
+			Value:     level,
+			Timestamp: timestamp,
+		}
+		resultSample.Metric.Delete(clientmodel.MetricNameLabel)
+		resultVector = append(resultVector, resultSample)
+	}
+	return resultVector
+}
+
+// labelNameRE matches valid label names.
+var labelNameRE = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// checkLabelNameArg returns an error if the argument is a string literal
+// that is not a valid label name.
+func checkLabelNameArg(function string, arg Node) error {
+	if lit, ok := arg.(*StringLiteral); ok && !labelNameRE.MatchString(lit.str) {
+		return fmt.Errorf("invalid label name %q in function %v()", lit.str, function)
+	}
+	return nil
+}
+
+// labelReplaceRegex returns the regular expression matching the complete
+// source label value for label_replace.
+func labelReplaceRegex(regex string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + regex + ")$")
+}
+
+func checkLabelReplaceArgs(args []Node) error {
+	for _, arg := range []Node{args[1], args[3]} {
+		if err := checkLabelNameArg("label_replace", arg); err != nil {
+			return err
+		}
+	}
+	if lit, ok := args[4].(*StringLiteral); ok {
+		if _, err := labelReplaceRegex(lit.str); err != nil {
+			return fmt.Errorf("invalid regular expression in function label_replace(): %s", err)
+		}
+	}
+	return nil
+}
+
+// === label_replace(vector VectorNode, dst, replacement, src, regex StringNode) Vector ===
+func labelReplaceImpl(timestamp clientmodel.Timestamp, args []Node) interface{} {
+	vector := args[0].(VectorNode).Eval(timestamp)
+	dst := clientmodel.LabelName(args[1].(StringNode).Eval(timestamp))
+	replacement := args[2].(StringNode).Eval(timestamp)
+	src := clientmodel.LabelName(args[3].(StringNode).Eval(timestamp))
+	regex, err := labelReplaceRegex(args[4].(StringNode).Eval(timestamp))
+	if err != nil {
+		// Literals are checked when parsing the expression.
+		return Vector{}
+	}
+
+	for _, el := range vector {
+		srcValue := string(el.Metric.Metric[src])
+		indexes := regex.FindStringSubmatchIndex(srcValue)
+		if indexes == nil {
+			// The sample is passed on unchanged.
+			continue
+		}
+		value := regex.ExpandString(nil, replacement, srcValue, indexes)
+		setOrDeleteLabel(&el.Metric, dst, clientmodel.LabelValue(value))
+	}
+	return vector
+}
+
+func checkLabelJoinArgs(args []Node) error {
+	if err := checkLabelNameArg("label_join", args[1]); err != nil {
+		return err
+	}
+	for _, arg := range args[3:] {
+		if err := checkLabelNameArg("label_join", arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// === label_join(vector VectorNode, dst, separator StringNode, src ...StringNode) Vector ===
+func labelJoinImpl(timestamp clientmodel.Timestamp, args []Node) interface{} {
+	vector := args[0].(VectorNode).Eval(timestamp)
+	dst := clientmodel.LabelName(args[1].(StringNode).Eval(timestamp))
+	separator := args[2].(StringNode).Eval(timestamp)
+	srcs := make([]clientmodel.LabelName, 0, len(args)-3)
+	for _, arg := range args[3:] {
+		srcs = append(srcs, clientmodel.LabelName(arg.(StringNode).Eval(timestamp)))
+	}
+
+	values := make([]string, len(srcs))
+	for _, el := range vector {
+		for i, src := range srcs {
+			values[i] = string(el.Metric.Metric[src])
+		}
+		setOrDeleteLabel(&el.Metric, dst, clientmodel.LabelValue(strings.Join(values, separator)))
+	}
+	return vector
+}
+
+// setOrDeleteLabel sets the label of the metric to the value, or deletes it if
+// the value is empty.
+func setOrDeleteLabel(m *clientmodel.COWMetric, name clientmodel.LabelName, value clientmodel.LabelValue) {
+	if value == "" {
+		m.Delete(name)
+		return
+	}
+	m.Set(name, value)
+}
+
 func histogramQuantileImpl(timestamp clientmodel.Timestamp, args []Node) interface{} {
 	q := args[0].(ScalarNode).Eval(timestamp)
 	inVec := args[1].(VectorNode).Eval(timestamp)
@@ -612,12 +856,7 @@ var functions = map[string]*Function{
 		argTypes:   []ExprType{MatrixType},
 		returnType: VectorType,
 		callFn:     avgOverTimeImpl,
-	},
-	"bottomk": {
-		name:       "bottomk",
-		argTypes:   []ExprType{ScalarType, VectorType},
-		returnType: VectorType,
-		callFn:     bottomkImpl,
+		rollups:    true,
 	},
 	"ceil": {
 		name:       "ceil",
@@ -630,6 +869,7 @@ var functions = map[string]*Function{
 		argTypes:   []ExprType{MatrixType},
 		returnType: VectorType,
 		callFn:     countOverTimeImpl,
+		rollups:    true,
 	},
 	"count_scalar": {
 		name:       "count_scalar",
@@ -674,6 +914,28 @@ var functions = map[string]*Function{
 		returnType: VectorType,
 		callFn:     histogramQuantileImpl,
 	},
+	"holt_winters": {
+		name:       "holt_winters",
+		argTypes:   []ExprType{MatrixType, ScalarType, ScalarType},
+		returnType: VectorType,
+		callFn:     holtWintersImpl,
+	},
+	"label_join": {
+		name:         "label_join",
+		argTypes:     []ExprType{VectorType, StringType, StringType, StringType},
+		optionalArgs: 1,
+		returnType:   VectorType,
+		callFn:       labelJoinImpl,
+		variadic:     true,
+		checkArgs:    checkLabelJoinArgs,
+	},
+	"label_replace": {
+		name:       "label_replace",
+		argTypes:   []ExprType{VectorType, StringType, StringType, StringType, StringType},
+		returnType: VectorType,
+		callFn:     labelReplaceImpl,
+		checkArgs:  checkLabelReplaceArgs,
+	},
 	"ln": {
 		name:       "ln",
 		argTypes:   []ExprType{VectorType},
@@ -697,12 +959,26 @@ var functions = map[string]*Function{
 		argTypes:   []ExprType{MatrixType},
 		returnType: VectorType,
 		callFn:     maxOverTimeImpl,
+		rollups:    true,
 	},
 	"min_over_time": {
 		name:       "min_over_time",
 		argTypes:   []ExprType{MatrixType},
 		returnType: VectorType,
 		callFn:     minOverTimeImpl,
+		rollups:    true,
+	},
+	"predict_linear": {
+		name:       "predict_linear",
+		argTypes:   []ExprType{MatrixType, ScalarType},
+		returnType: VectorType,
+		callFn:     predictLinearImpl,
+	},
+	"quantile_over_time": {
+		name:       "quantile_over_time",
+		argTypes:   []ExprType{ScalarType, MatrixType},
+		returnType: VectorType,
+		callFn:     quantileOverTimeImpl,
 	},
 	"rate": {
 		name:       "rate",
@@ -741,11 +1017,24 @@ var functions = map[string]*Function{
 		returnType: VectorType,
 		callFn:     sqrtImpl,
 	},
+	"stddev_over_time": {
+		name:       "stddev_over_time",
+		argTypes:   []ExprType{MatrixType},
+		returnType: VectorType,
+		callFn:     stddevOverTimeImpl,
+	},
+	"stdvar_over_time": {
+		name:       "stdvar_over_time",
+		argTypes:   []ExprType{MatrixType},
+		returnType: VectorType,
+		callFn:     stdvarOverTimeImpl,
+	},
 	"sum_over_time": {
 		name:       "sum_over_time",
 		argTypes:   []ExprType{MatrixType},
 		returnType: VectorType,
 		callFn:     sumOverTimeImpl,
+		rollups:    true,
 	},
 	"time": {
 		name:       "time",
@@ -753,12 +1042,16 @@ var functions = map[string]*Function{
 		returnType: ScalarType,
 		callFn:     timeImpl,
 	},
-	"topk": {
-		name:       "topk",
-		argTypes:   []ExprType{ScalarType, VectorType},
-		returnType: VectorType,
-		callFn:     topkImpl,
-	},
+}
+
+// FunctionNames returns the names of all functions, sorted.
+func FunctionNames() []string {
+	names := make([]string, 0, len(functions))
+	for name := range functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
 // GetFunction returns a predefined Function object for the given
@@ -14,6 +14,7 @@
 package ast
 
 import (
+	"math"
 	"testing"
 
 	clientmodel "github.com/prometheus/client_golang/model"
@@ -61,3 +62,18 @@ func TestDeltaWithEmptyElementDoesNotCrash(t *testing.T) {
 		t.Fatalf("Expected empty result vector, got: %v", vector)
 	}
 }
+
+func TestStdvarOverTimeOfLargeValues(t *testing.T) {
+	// The values alternate around 1e9 with a variance of 0.01.
+	values := metric.Values{}
+	for i := 0; i < 100; i++ {
+		v := 1e9 + 0.1
+		if i%2 == 1 {
+			v = 1e9 - 0.1
+		}
+		values = append(values, metric.SamplePair{Timestamp: clientmodel.Timestamp(i), Value: clientmodel.SampleValue(v)})
+	}
+	if got := float64(stdvarOverTime(values)); math.Abs(got-0.01) > 1e-6 {
+		t.Errorf("got variance %v, want 0.01", got)
+	}
+}
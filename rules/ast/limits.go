@@ -0,0 +1,121 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ast
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/stats"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+var (
+	maxSamples = flag.Int("query.max-samples", 0, "Maximum number of samples a single query may read from the storage. 0 means no limit.")
+	maxSeries  = flag.Int("query.max-series", 0, "Maximum number of series a single query may select. 0 means no limit.")
+)
+
+// queryLimitError is returned when a query exceeds one of its resource limits.
+type queryLimitError struct {
+	resource string
+	limit    int
+}
+
+func (e queryLimitError) Error() string {
+	return fmt.Sprintf("query exceeded the maximum number of %s (%d)", e.resource, e.limit)
+}
+
+// IsQueryLimitExceeded returns whether the error was returned because a query
+// selected too many series or read too many samples.
+func IsQueryLimitExceeded(err error) bool {
+	_, ok := err.(queryLimitError)
+	return ok
+}
+
+// CatchQueryAbort recovers from the panic with which the evaluation of a
+// prepared query is aborted once it has read more samples than allowed or has
+// been canceled, and stores the error in errp. Other panics are passed on. It
+// has to be deferred by callers of the Eval methods of nodes prepared with
+// PrepareInstantQuery or PrepareRangeQuery.
+func CatchQueryAbort(errp *error) {
+	if r := recover(); r != nil {
+		switch err := r.(type) {
+		case queryLimitError:
+			*errp = err
+		case queryCanceledError:
+			*errp = err
+		default:
+			panic(r)
+		}
+	}
+}
+
+// sampleLimiter counts the samples a query reads from the storage.
+type sampleLimiter struct {
+	samples, max int // No limit if max is 0.
+	counter      *stats.Counter
+	canceled     <-chan struct{} // Closed once the query is canceled.
+}
+
+// add counts n more samples and panics with a queryLimitError if the maximum
+// is exceeded, or with a queryCanceledError if the query has been canceled.
+func (l *sampleLimiter) add(n int) {
+	if isCanceled(l.canceled) {
+		panic(queryCanceledError{})
+	}
+	l.samples += n
+	l.counter.Add(n)
+	if l.max > 0 && l.samples > l.max {
+		panic(queryLimitError{"samples", l.max})
+	}
+}
+
+// limitedIterator is a local.SeriesIterator that counts the values it returns
+// with a sampleLimiter. Rollups count as one sample each.
+type limitedIterator struct {
+	local.SeriesIterator
+	limiter *sampleLimiter
+}
+
+// GetValueAtTime implements local.SeriesIterator.
+func (it limitedIterator) GetValueAtTime(t clientmodel.Timestamp) metric.Values {
+	values := it.SeriesIterator.GetValueAtTime(t)
+	it.limiter.add(len(values))
+	return values
+}
+
+// GetBoundaryValues implements local.SeriesIterator.
+func (it limitedIterator) GetBoundaryValues(in metric.Interval) metric.Values {
+	values := it.SeriesIterator.GetBoundaryValues(in)
+	it.limiter.add(len(values))
+	return values
+}
+
+// GetRangeValues implements local.SeriesIterator.
+func (it limitedIterator) GetRangeValues(in metric.Interval) metric.Values {
+	values := it.SeriesIterator.GetRangeValues(in)
+	it.limiter.add(len(values))
+	return values
+}
+
+// GetRollups implements local.SeriesIterator.
+func (it limitedIterator) GetRollups(in metric.Interval, res time.Duration) ([]metric.Rollup, metric.Interval, bool) {
+	rollups, covered, ok := it.SeriesIterator.GetRollups(in, res)
+	it.limiter.add(len(rollups))
+	return rollups, covered, ok
+}
@@ -0,0 +1,106 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ast
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/stats"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+func TestQueryLimits(t *testing.T) {
+	storage, closer := local.NewTestStorage(t, 1)
+	defer closer.Close()
+	for i := 0; i < 3; i++ {
+		m := clientmodel.Metric{
+			clientmodel.MetricNameLabel: "testmetric",
+			"instance":                  clientmodel.LabelValue(strconv.Itoa(i)),
+		}
+		for ts := clientmodel.Timestamp(0); ts < 100000; ts += 10000 {
+			storage.Append(&clientmodel.Sample{Metric: m, Timestamp: ts, Value: 1})
+		}
+	}
+	storage.WaitForIndexing()
+
+	matcher, err := metric.NewLabelMatcher(metric.Equal, clientmodel.MetricNameLabel, "testmetric")
+	if err != nil {
+		t.Fatal(err)
+	}
+	newMatrixQuery := func() VectorNode {
+		selector := NewMatrixSelector(NewVectorSelector(metric.LabelMatchers{matcher}, 0), time.Minute, 0)
+		node, err := NewFunctionCall(functions["rate"], Nodes{selector})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return node.(VectorNode)
+	}
+	defer func(samples, series int) {
+		*maxSamples, *maxSeries = samples, series
+	}(*maxSamples, *maxSeries)
+
+	scenarios := []struct {
+		maxSamples, maxSeries int
+		instant, rng          error
+	}{
+		{0, 0, nil, nil},
+		// Each instant evaluation reads 7 samples per series.
+		{21, 3, nil, queryLimitError{"samples", 21}},
+		{20, 0, queryLimitError{"samples", 20}, queryLimitError{"samples", 20}},
+		{0, 2, queryLimitError{"series", 2}, queryLimitError{"series", 2}},
+	}
+	for i, s := range scenarios {
+		*maxSamples, *maxSeries = s.maxSamples, s.maxSeries
+
+		_, err := EvalVectorInstant(newMatrixQuery(), 60000, storage, stats.NewTimerGroup())
+		if err != s.instant {
+			t.Errorf("%d. got instant query error %v, want %v", i, err, s.instant)
+		}
+		_, err = EvalVectorRange(newMatrixQuery(), 60000, 90000, 10*time.Second, storage, stats.NewTimerGroup())
+		if err != s.rng {
+			t.Errorf("%d. got range query error %v, want %v", i, err, s.rng)
+		}
+		if err != nil && !IsQueryLimitExceeded(err) {
+			t.Errorf("%d. error %v not recognized as query limit error", i, err)
+		}
+	}
+}
+
+func TestPreloadDeadline(t *testing.T) {
+	storage, closer := local.NewTestStorage(t, 1)
+	defer closer.Close()
+	storage.Append(&clientmodel.Sample{
+		Metric:    clientmodel.Metric{clientmodel.MetricNameLabel: "testmetric"},
+		Timestamp: 0,
+		Value:     1,
+	})
+	storage.WaitForIndexing()
+
+	matcher, err := metric.NewLabelMatcher(metric.Equal, clientmodel.MetricNameLabel, "testmetric")
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := NewVectorSelector(metric.LabelMatchers{matcher}, 0)
+	// A query that has already exceeded its timeout is aborted before any
+	// chunks are preloaded.
+	_, err = EvalVectorRangeWithTimeout(node, 0, 1000, time.Second, -time.Second, storage, stats.NewTimerGroup())
+	if !IsQueryTimeout(err) {
+		t.Errorf("want query timeout, got %v", err)
+	}
+}
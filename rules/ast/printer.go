@@ -67,6 +67,11 @@ func (aggrType AggrType) String() string {
 		Count:  "COUNT",
 		Stdvar: "STDVAR",
 		Stddev: "STDDEV",
+
+		CountValues: "COUNT_VALUES",
+		TopK:        "TOPK",
+		BottomK:     "BOTTOMK",
+		Quantile:    "QUANTILE",
 	}
 	return aggrTypeMap[aggrType]
 }
@@ -160,14 +165,33 @@ func TypedValueToJSON(data interface{}, typeStr string) string {
 	return string(dataJSON)
 }
 
+// errorToString formats an error like the results of EvalToString.
+func errorToString(err error, format OutputFormat) string {
+	if format == JSON {
+		return ErrorToJSON(err)
+	}
+	return err.Error()
+}
+
 // EvalToString evaluates the given node into a string of the given format.
-func EvalToString(node Node, timestamp clientmodel.Timestamp, format OutputFormat, storage local.Storage, queryStats *stats.TimerGroup) string {
+// If the query exceeds a limit, the error is returned in that format.
+func EvalToString(node Node, timestamp clientmodel.Timestamp, format OutputFormat, storage local.Storage, queryStats *stats.TimerGroup) (result string) {
+	var err error
+	defer func() {
+		if err != nil {
+			result = errorToString(err, format)
+		}
+	}()
+	defer CatchQueryAbort(&err)
 	totalEvalTimer := queryStats.GetTimer(stats.TotalEvalTime).Start()
 	defer totalEvalTimer.Stop()
 
 	prepareTimer := queryStats.GetTimer(stats.TotalQueryPreparationTime).Start()
 	closer, err := PrepareInstantQuery(node, timestamp, storage, queryStats)
 	prepareTimer.Stop()
+	if IsQueryLimitExceeded(err) {
+		return errorToString(err, format)
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -216,13 +240,17 @@ func EvalToString(node Node, timestamp clientmodel.Timestamp, format OutputForma
 }
 
 // EvalToVector evaluates the given node into a Vector. Matrices aren't supported.
-func EvalToVector(node Node, timestamp clientmodel.Timestamp, storage local.Storage, queryStats *stats.TimerGroup) (Vector, error) {
+func EvalToVector(node Node, timestamp clientmodel.Timestamp, storage local.Storage, queryStats *stats.TimerGroup) (_ Vector, err error) {
+	defer CatchQueryAbort(&err)
 	totalEvalTimer := queryStats.GetTimer(stats.TotalEvalTime).Start()
 	defer totalEvalTimer.Stop()
 
 	prepareTimer := queryStats.GetTimer(stats.TotalQueryPreparationTime).Start()
 	closer, err := PrepareInstantQuery(node, timestamp, storage, queryStats)
 	prepareTimer.Stop()
+	if IsQueryLimitExceeded(err) {
+		return nil, err
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -327,6 +355,10 @@ func (node *VectorAggregation) NodeTreeToDotGraph() string {
 		node,
 		node.aggrType,
 		strings.Join(groupByStrings, ", "))
+	if node.param != nil {
+		graph += fmt.Sprintf("%#p -> %x;\n", node, reflect.ValueOf(node.param).Pointer())
+		graph += node.param.NodeTreeToDotGraph()
+	}
 	graph += fmt.Sprintf("%#p -> %x;\n", node, reflect.ValueOf(node.vector).Pointer())
 	graph += node.vector.NodeTreeToDotGraph()
 	return graph
@@ -358,6 +390,23 @@ func (node *MatrixSelector) NodeTreeToDotGraph() string {
 	return fmt.Sprintf("%#p[label=\"%s\"];\n", node, node)
 }
 
+// NodeTreeToDotGraph returns a DOT representation of the offset
+// expression.
+func (node *OffsetExpr) NodeTreeToDotGraph() string {
+	graph := fmt.Sprintf("%#p[label=\"OFFSET %s\"];\n", node, utility.DurationToString(node.offset))
+	graph += fmt.Sprintf("%#p -> %x;\n", node, reflect.ValueOf(node.expr).Pointer())
+	graph += node.expr.NodeTreeToDotGraph()
+	return graph
+}
+
+// NodeTreeToDotGraph returns a DOT representation of the subquery.
+func (node *Subquery) NodeTreeToDotGraph() string {
+	graph := fmt.Sprintf("%#p[label=\"[%s:%s]\"];\n", node, utility.DurationToString(node.interval), utility.DurationToString(node.resolution))
+	graph += fmt.Sprintf("%#p -> %x;\n", node, reflect.ValueOf(node.expr).Pointer())
+	graph += node.expr.NodeTreeToDotGraph()
+	return graph
+}
+
 // NodeTreeToDotGraph returns a DOT representation of the string
 // literal.
 func (node *StringLiteral) NodeTreeToDotGraph() string {
@@ -403,13 +452,21 @@ func (node *VectorSelector) String() string {
 		}
 	}
 
-	switch len(labelStrings) {
-	case 0:
-		return string(metricName)
-	default:
+	selector := string(metricName)
+	if len(labelStrings) > 0 {
 		sort.Strings(labelStrings)
-		return fmt.Sprintf("%s{%s}", metricName, strings.Join(labelStrings, ","))
+		selector = fmt.Sprintf("%s{%s}", metricName, strings.Join(labelStrings, ","))
 	}
+	return selector + atString(node.at)
+}
+
+// atString returns the @ modifier of a selector, or an empty string if it
+// has none.
+func atString(at *clientmodel.Timestamp) string {
+	if at == nil {
+		return ""
+	}
+	return fmt.Sprintf(" @ %s", at)
 }
 
 func (node *VectorFunctionCall) String() string {
@@ -418,6 +475,9 @@ func (node *VectorFunctionCall) String() string {
 
 func (node *VectorAggregation) String() string {
 	aggrString := fmt.Sprintf("%s(%s)", node.aggrType, node.vector)
+	if node.param != nil {
+		aggrString = fmt.Sprintf("%s(%s, %s)", node.aggrType, node.param, node.vector)
+	}
 	if len(node.groupBy) > 0 {
 		return fmt.Sprintf("%s BY (%s)", aggrString, node.groupBy)
 	}
@@ -425,13 +485,48 @@ func (node *VectorAggregation) String() string {
 }
 
 func (node *VectorArithExpr) String() string {
+	if matching := node.matchingString(); matching != "" {
+		return fmt.Sprintf("(%s %s %s %s)", node.lhs, node.opType, matching, node.rhs)
+	}
 	return fmt.Sprintf("(%s %s %s)", node.lhs, node.opType, node.rhs)
 }
 
+// matchingString returns the vector matching clauses of the expression, e.g.
+// "ON (instance) GROUP_LEFT (job)", or an empty string if the samples are
+// matched on all labels.
+func (node *VectorArithExpr) matchingString() string {
+	var clauses []string
+	if len(node.matchOn) > 0 {
+		keyword := "ON"
+		if node.matchIgnoring {
+			keyword = "IGNORING"
+		}
+		clauses = append(clauses, fmt.Sprintf("%s (%s)", keyword, node.matchOn))
+	}
+	switch node.matchCardinality {
+	case MatchManyToOne:
+		clauses = append(clauses, "GROUP_LEFT")
+	case MatchOneToMany:
+		clauses = append(clauses, "GROUP_RIGHT")
+	}
+	if len(node.includeLabels) > 0 {
+		clauses = append(clauses, fmt.Sprintf("(%s)", node.includeLabels))
+	}
+	return strings.Join(clauses, " ")
+}
+
 func (node *MatrixSelector) String() string {
 	vectorString := (&VectorSelector{labelMatchers: node.labelMatchers}).String()
 	intervalString := fmt.Sprintf("[%s]", utility.DurationToString(node.interval))
-	return vectorString + intervalString
+	return vectorString + intervalString + atString(node.at)
+}
+
+func (node *OffsetExpr) String() string {
+	return fmt.Sprintf("(%s) OFFSET %s", node.expr, utility.DurationToString(node.offset))
+}
+
+func (node *Subquery) String() string {
+	return fmt.Sprintf("%s[%s:%s]", node.expr, utility.DurationToString(node.interval), utility.DurationToString(node.resolution))
 }
 
 func (node *StringLiteral) String() string {
@@ -104,3 +104,32 @@ func quantile(q clientmodel.SampleValue, buckets buckets) float64 {
 	}
 	return bucketStart + (bucketEnd-bucketStart)*float64(rank/count)
 }
+
+// valueQuantile calculates the quantile 'q' of the given values. The values
+// will be sorted by this function. If 'q' falls between two values, the
+// quantile is interpolated linearly between them, i.e. the values are treated
+// like buckets with one observation each.
+//
+// Special cases are handled like in quantile: If 'values' is empty, NaN is
+// returned. If q<0, -Inf is returned. If q>1, +Inf is returned.
+func valueQuantile(q clientmodel.SampleValue, values []float64) float64 {
+	if q < 0 {
+		return math.Inf(-1)
+	}
+	if q > 1 {
+		return math.Inf(+1)
+	}
+	if len(values) == 0 {
+		return math.NaN()
+	}
+	sort.Float64s(values)
+
+	rank := float64(q) * float64(len(values)-1)
+	lower := int(math.Floor(rank))
+	upper := lower + 1
+	if upper > len(values)-1 {
+		upper = len(values) - 1
+	}
+	weight := rank - float64(lower)
+	return values[lower]*(1-weight) + values[upper]*weight
+}
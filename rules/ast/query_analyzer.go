@@ -20,6 +20,7 @@ import (
 
 	"github.com/prometheus/prometheus/stats"
 	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
 )
 
 // preloadTimes tracks which instants or ranges to preload for a set of
@@ -34,6 +35,68 @@ type preloadTimes struct {
 	// stretching backwards from the current evaluation timestamp. The length of
 	// the range into the past is given by the duration, as in "foo[5m]".
 	ranges map[clientmodel.Fingerprint]time.Duration
+	// Rollup ranges are ranges that are only aggregated over. Only the
+	// parts of them not covered by rollups in the storage need loading.
+	rollupRanges map[clientmodel.Fingerprint]time.Duration
+}
+
+// An extent is the range and offset added to a selector by the subqueries
+// and offset expressions enclosing it. A selector within "foo[1h:1m] offset
+// 1d" is evaluated at any time of the hour before the day before the
+// evaluation timestamp.
+type extent struct {
+	interval time.Duration
+	offset   time.Duration
+}
+
+// An extentVisitor adds an extent to the extents of the selectors it visits.
+type extentVisitor struct {
+	extents map[Node]extent
+	add     extent
+}
+
+func (v *extentVisitor) visit(node Node) {
+	switch node.(type) {
+	case *VectorSelector, *MatrixSelector:
+		e := v.extents[node]
+		e.interval += v.add.interval
+		e.offset += v.add.offset
+		v.extents[node] = e
+	}
+}
+
+// addExtent adds the extent of a subquery or offset expression to the extents
+// of the selectors within it. As Walk visits a node before the nodes within
+// it, the extents of all enclosing nodes are summed up by the time a selector
+// is visited.
+func addExtent(extents map[Node]extent, node Node) {
+	switch n := node.(type) {
+	case *Subquery:
+		Walk(&extentVisitor{extents, extent{n.interval, n.offset}}, n.expr)
+	case *OffsetExpr:
+		Walk(&extentVisitor{extents, extent{offset: n.offset}}, n.expr)
+	}
+}
+
+// coveringInterval returns the smallest interval covering both intervals.
+func coveringInterval(a, b metric.Interval) metric.Interval {
+	if b.OldestInclusive.Before(a.OldestInclusive) {
+		a.OldestInclusive = b.OldestInclusive
+	}
+	if b.NewestInclusive.After(a.NewestInclusive) {
+		a.NewestInclusive = b.NewestInclusive
+	}
+	return a
+}
+
+// addFixedInterval adds the interval needed by a selector with an @ modifier
+// to the fixed intervals, merging it with the interval already needed for the
+// same series.
+func addFixedInterval(intervals map[clientmodel.Fingerprint]metric.Interval, fp clientmodel.Fingerprint, in metric.Interval) {
+	if old, ok := intervals[fp]; ok {
+		in = coveringInterval(old, in)
+	}
+	intervals[fp] = in
 }
 
 // A queryAnalyzer recursively traverses the AST to look for any nodes
@@ -46,23 +109,49 @@ type queryAnalyzer struct {
 	// The underlying storage to which the query will be applied. Needed for
 	// extracting timeseries fingerprint information during query analysis.
 	storage local.Storage
+	// Times the lookups in the storage indexes.
+	lookupTimer *stats.Timer
+	// The extents of the selectors within subqueries and offset
+	// expressions.
+	extents map[Node]extent
+	// The intervals to preload for selectors with an @ modifier, which
+	// don't depend on the evaluation timestamps.
+	fixedIntervals map[clientmodel.Fingerprint]metric.Interval
 }
 
 // newQueryAnalyzer returns a pointer to a newly instantiated
 // queryAnalyzer. The storage is needed to extract timeseries
 // fingerprint information during query analysis.
-func newQueryAnalyzer(storage local.Storage) *queryAnalyzer {
+func newQueryAnalyzer(storage local.Storage, queryStats *stats.TimerGroup) *queryAnalyzer {
 	return &queryAnalyzer{
 		offsetPreloadTimes: map[time.Duration]preloadTimes{},
 		storage:            storage,
+		lookupTimer:        queryStats.GetTimer(stats.IndexLookupTime),
+		extents:            map[Node]extent{},
+		fixedIntervals:     map[clientmodel.Fingerprint]metric.Interval{},
+	}
+}
+
+// lookupSeries returns the fingerprints and metrics of the series matching
+// the label matchers.
+func (analyzer *queryAnalyzer) lookupSeries(matchers metric.LabelMatchers) (clientmodel.Fingerprints, map[clientmodel.Fingerprint]clientmodel.COWMetric) {
+	analyzer.lookupTimer.Start()
+	defer analyzer.lookupTimer.Stop()
+
+	fingerprints := analyzer.storage.GetFingerprintsForLabelMatchers(matchers)
+	metrics := make(map[clientmodel.Fingerprint]clientmodel.COWMetric, len(fingerprints))
+	for _, fp := range fingerprints {
+		metrics[fp] = analyzer.storage.GetMetricForFingerprint(fp)
 	}
+	return fingerprints, metrics
 }
 
 func (analyzer *queryAnalyzer) getPreloadTimes(offset time.Duration) preloadTimes {
 	if _, ok := analyzer.offsetPreloadTimes[offset]; !ok {
 		analyzer.offsetPreloadTimes[offset] = preloadTimes{
-			instants: map[clientmodel.Fingerprint]struct{}{},
-			ranges:   map[clientmodel.Fingerprint]time.Duration{},
+			instants:     map[clientmodel.Fingerprint]struct{}{},
+			ranges:       map[clientmodel.Fingerprint]time.Duration{},
+			rollupRanges: map[clientmodel.Fingerprint]time.Duration{},
 		}
 	}
 	return analyzer.offsetPreloadTimes[offset]
@@ -71,128 +160,333 @@ func (analyzer *queryAnalyzer) getPreloadTimes(offset time.Duration) preloadTime
 // visit implements the visitor interface.
 func (analyzer *queryAnalyzer) visit(node Node) {
 	switch n := node.(type) {
+	case *Subquery, *OffsetExpr:
+		addExtent(analyzer.extents, n)
 	case *VectorSelector:
-		pt := analyzer.getPreloadTimes(n.offset)
-		fingerprints := analyzer.storage.GetFingerprintsForLabelMatchers(n.labelMatchers)
+		fingerprints, metrics := analyzer.lookupSeries(n.labelMatchers)
 		n.fingerprints = fingerprints
+		if n.at != nil {
+			ts := n.at.Add(-n.offset)
+			for _, fp := range fingerprints {
+				addFixedInterval(analyzer.fixedIntervals, fp, metric.Interval{OldestInclusive: ts, NewestInclusive: ts})
+				n.metrics[fp] = metrics[fp]
+			}
+			return
+		}
+		extent := analyzer.extents[n]
+		pt := analyzer.getPreloadTimes(n.offset + extent.offset)
 		for _, fp := range fingerprints {
+			n.metrics[fp] = metrics[fp]
+			// Within a subquery, the selector is evaluated at any time
+			// of the subquery range.
+			if extent.interval > 0 {
+				if pt.ranges[fp] < extent.interval {
+					pt.ranges[fp] = extent.interval
+					delete(pt.instants, fp)
+				}
+				continue
+			}
 			// Only add the fingerprint to the instants if not yet present in the
 			// ranges. Ranges always contain more points and span more time than
 			// instants for the same offset.
 			if _, alreadyInRanges := pt.ranges[fp]; !alreadyInRanges {
 				pt.instants[fp] = struct{}{}
 			}
-
-			n.metrics[fp] = analyzer.storage.GetMetricForFingerprint(fp)
 		}
 	case *MatrixSelector:
-		pt := analyzer.getPreloadTimes(n.offset)
-		fingerprints := analyzer.storage.GetFingerprintsForLabelMatchers(n.labelMatchers)
+		fingerprints, metrics := analyzer.lookupSeries(n.labelMatchers)
 		n.fingerprints = fingerprints
+		if n.at != nil {
+			ts := n.at.Add(-n.offset)
+			for _, fp := range fingerprints {
+				addFixedInterval(analyzer.fixedIntervals, fp, metric.Interval{OldestInclusive: ts.Add(-n.interval), NewestInclusive: ts})
+				n.metrics[fp] = metrics[fp]
+			}
+			return
+		}
+		extent := analyzer.extents[n]
+		pt := analyzer.getPreloadTimes(n.offset + extent.offset)
+		interval := n.interval + extent.interval
 		for _, fp := range fingerprints {
-			if pt.ranges[fp] < n.interval {
-				pt.ranges[fp] = n.interval
+			if n.useRollups {
+				if pt.rollupRanges[fp] < interval {
+					pt.rollupRanges[fp] = interval
+				}
+			} else if pt.ranges[fp] < interval {
+				pt.ranges[fp] = interval
 				// Delete the fingerprint from the instants. Ranges always contain more
 				// points and span more time than instants, so we don't need to track
 				// an instant for the same fingerprint, should we have one.
 				delete(pt.instants, fp)
 			}
 
-			n.metrics[fp] = analyzer.storage.GetMetricForFingerprint(fp)
+			n.metrics[fp] = metrics[fp]
+		}
+	}
+}
+
+// An IntervalStorage is a storage that has to know the time range of a query
+// before the query is analyzed, e.g. to read series from a remote storage.
+type IntervalStorage interface {
+	local.Storage
+	// ForInterval returns the storage to use for a query needing samples
+	// within the interval.
+	ForInterval(metric.Interval) local.Storage
+}
+
+// A lookbackAnalyzer finds out how far before the evaluation timestamp a
+// query needs samples, and which samples it needs independently of the
+// evaluation timestamp.
+type lookbackAnalyzer struct {
+	lookback time.Duration
+	extents  map[Node]extent
+	// The interval needed by selectors with an @ modifier, nil if there
+	// are none.
+	fixed *metric.Interval
+}
+
+// addFixed extends the fixed interval to include the interval before the
+// timestamp of an @ modifier.
+func (a *lookbackAnalyzer) addFixed(at clientmodel.Timestamp, lookback time.Duration) {
+	in := metric.Interval{OldestInclusive: at.Add(-lookback), NewestInclusive: at}
+	if a.fixed != nil {
+		in = coveringInterval(*a.fixed, in)
+	}
+	a.fixed = &in
+}
+
+func (a *lookbackAnalyzer) visit(node Node) {
+	var lookback time.Duration
+	switch n := node.(type) {
+	case *Subquery, *OffsetExpr:
+		addExtent(a.extents, n)
+	case *VectorSelector:
+		if n.at != nil {
+			a.addFixed(*n.at, n.offset+*stalenessDelta)
+			return
+		}
+		extent := a.extents[n]
+		lookback = n.offset + *stalenessDelta + extent.offset + extent.interval
+	case *MatrixSelector:
+		if n.at != nil {
+			a.addFixed(*n.at, n.offset+n.interval)
+			return
+		}
+		extent := a.extents[n]
+		lookback = n.offset + n.interval + extent.offset + extent.interval
+	}
+	if lookback > a.lookback {
+		a.lookback = lookback
+	}
+}
+
+// storageForQuery returns the storage to use for evaluating the query between
+// start and end, which is the storage itself unless it is an IntervalStorage.
+func storageForQuery(node Node, start, end clientmodel.Timestamp, storage local.Storage) local.Storage {
+	is, ok := storage.(IntervalStorage)
+	if !ok {
+		return storage
+	}
+	la := &lookbackAnalyzer{extents: map[Node]extent{}}
+	Walk(la, node)
+	in := metric.Interval{
+		OldestInclusive: start.Add(-la.lookback),
+		NewestInclusive: end,
+	}
+	if la.fixed != nil {
+		in = coveringInterval(in, *la.fixed)
+	}
+	return is.ForInterval(in)
+}
+
+// numSeries returns the number of distinct series selected by the query.
+func (analyzer *queryAnalyzer) numSeries() int {
+	fps := map[clientmodel.Fingerprint]struct{}{}
+	for _, pt := range analyzer.offsetPreloadTimes {
+		for fp := range pt.instants {
+			fps[fp] = struct{}{}
+		}
+		for fp := range pt.ranges {
+			fps[fp] = struct{}{}
+		}
+		for fp := range pt.rollupRanges {
+			fps[fp] = struct{}{}
 		}
 	}
+	for fp := range analyzer.fixedIntervals {
+		fps[fp] = struct{}{}
+	}
+	return len(fps)
 }
 
 type iteratorInitializer struct {
 	storage local.Storage
+	// Counts the samples read by the iterators.
+	limiter *sampleLimiter
+}
+
+func (i *iteratorInitializer) newIterator(fp clientmodel.Fingerprint) local.SeriesIterator {
+	return limitedIterator{i.storage.NewIterator(fp), i.limiter}
 }
 
 func (i *iteratorInitializer) visit(node Node) {
 	switch n := node.(type) {
 	case *VectorSelector:
 		for _, fp := range n.fingerprints {
-			n.iterators[fp] = i.storage.NewIterator(fp)
+			n.iterators[fp] = i.newIterator(fp)
 		}
 	case *MatrixSelector:
 		for _, fp := range n.fingerprints {
-			n.iterators[fp] = i.storage.NewIterator(fp)
+			n.iterators[fp] = i.newIterator(fp)
 		}
 	}
 }
 
+// newIteratorInitializer returns an iteratorInitializer enforcing the
+// -query.max-samples limit for a single query and counting the samples
+// decoded in the query stats. Its iterators stop the query once the canceled
+// channel is closed.
+func newIteratorInitializer(storage local.Storage, queryStats *stats.TimerGroup, canceled <-chan struct{}) *iteratorInitializer {
+	return &iteratorInitializer{
+		storage: storage,
+		limiter: &sampleLimiter{
+			max:      *maxSamples,
+			counter:  queryStats.GetCounter(stats.SamplesDecoded),
+			canceled: canceled,
+		},
+	}
+}
+
+// checkSeriesLimit counts the series selected by the query in the query stats
+// and returns an error if there are more than allowed by -query.max-series.
+func checkSeriesLimit(analyzer *queryAnalyzer, queryStats *stats.TimerGroup) error {
+	numSeries := analyzer.numSeries()
+	queryStats.GetCounter(stats.SeriesSelected).Add(numSeries)
+	if *maxSeries > 0 && numSeries > *maxSeries {
+		return queryLimitError{"series", *maxSeries}
+	}
+	return nil
+}
+
+// preloadError converts the error returned by a Preloader whose deadline has
+// passed into a query timeout, and the one returned by a canceled Preloader
+// into a canceled query.
+func preloadError(err error, totalTimer *stats.Timer) error {
+	switch err {
+	case local.ErrDeadlineExceeded:
+		return queryTimeoutError{totalTimer.ElapsedTime()}
+	case local.ErrCanceled:
+		return queryCanceledError{}
+	}
+	return err
+}
+
 // PrepareInstantQuery analyzes the query and preloads the necessary time range for each series.
 func PrepareInstantQuery(node Node, timestamp clientmodel.Timestamp, storage local.Storage, queryStats *stats.TimerGroup) (local.Preloader, error) {
 	totalTimer := queryStats.GetTimer(stats.TotalEvalTime)
 
 	analyzeTimer := queryStats.GetTimer(stats.QueryAnalysisTime).Start()
-	analyzer := newQueryAnalyzer(storage)
+	storage = storageForQuery(node, timestamp, timestamp, storage)
+	analyzer := newQueryAnalyzer(storage, queryStats)
 	Walk(analyzer, node)
 	analyzeTimer.Stop()
+	if err := checkSeriesLimit(analyzer, queryStats); err != nil {
+		return nil, err
+	}
 
 	preloadTimer := queryStats.GetTimer(stats.PreloadTime).Start()
 	p := storage.NewPreloader()
+	p.SetDeadline(time.Now().Add(*queryTimeout - totalTimer.ElapsedTime()))
+	canceled := activeQueries.canceled(node)
+	p.SetCancel(canceled)
 	for offset, pt := range analyzer.offsetPreloadTimes {
 		ts := timestamp.Add(-offset)
+		ranges := make(map[clientmodel.Fingerprint]metric.Interval, len(pt.ranges)+len(pt.instants))
 		for fp, rangeDuration := range pt.ranges {
-			if et := totalTimer.ElapsedTime(); et > *queryTimeout {
-				preloadTimer.Stop()
-				p.Close()
-				return nil, queryTimeoutError{et}
-			}
-			if err := p.PreloadRange(fp, ts.Add(-rangeDuration), ts, *stalenessDelta); err != nil {
-				preloadTimer.Stop()
-				p.Close()
-				return nil, err
-			}
+			ranges[fp] = metric.Interval{OldestInclusive: ts.Add(-rangeDuration), NewestInclusive: ts}
 		}
 		for fp := range pt.instants {
+			ranges[fp] = metric.Interval{OldestInclusive: ts, NewestInclusive: ts}
+		}
+		if et := totalTimer.ElapsedTime(); et > *queryTimeout {
+			preloadTimer.Stop()
+			p.Close()
+			return nil, queryTimeoutError{et}
+		}
+		if err := p.PreloadRanges(ranges, *stalenessDelta); err != nil {
+			preloadTimer.Stop()
+			p.Close()
+			return nil, preloadError(err, totalTimer)
+		}
+		for fp, rangeDuration := range pt.rollupRanges {
+			if pt.ranges[fp] >= rangeDuration {
+				// Already preloaded completely.
+				continue
+			}
 			if et := totalTimer.ElapsedTime(); et > *queryTimeout {
 				preloadTimer.Stop()
 				p.Close()
 				return nil, queryTimeoutError{et}
 			}
-			if err := p.PreloadRange(fp, ts, ts, *stalenessDelta); err != nil {
+			if err := p.PreloadRollupRange(fp, ts, ts, rangeDuration, *stalenessDelta); err != nil {
 				preloadTimer.Stop()
 				p.Close()
-				return nil, err
+				return nil, preloadError(err, totalTimer)
 			}
 		}
 	}
+	if len(analyzer.fixedIntervals) > 0 {
+		if et := totalTimer.ElapsedTime(); et > *queryTimeout {
+			preloadTimer.Stop()
+			p.Close()
+			return nil, queryTimeoutError{et}
+		}
+		if err := p.PreloadRanges(analyzer.fixedIntervals, *stalenessDelta); err != nil {
+			preloadTimer.Stop()
+			p.Close()
+			return nil, preloadError(err, totalTimer)
+		}
+	}
 	preloadTimer.Stop()
-
-	ii := &iteratorInitializer{
-		storage: storage,
+	queryStats.GetCounter(stats.ChunksLoaded).Add(p.NumChunks())
+	if isCanceled(canceled) {
+		p.Close()
+		return nil, queryCanceledError{}
 	}
-	Walk(ii, node)
+
+	Walk(newIteratorInitializer(storage, queryStats, canceled), node)
 
 	return p, nil
 }
 
 // PrepareRangeQuery analyzes the query and preloads the necessary time range for each series.
 func PrepareRangeQuery(node Node, start clientmodel.Timestamp, end clientmodel.Timestamp, interval time.Duration, storage local.Storage, queryStats *stats.TimerGroup) (local.Preloader, error) {
+	return prepareRangeQuery(node, start, end, interval, *queryTimeout, storage, queryStats)
+}
+
+func prepareRangeQuery(node Node, start clientmodel.Timestamp, end clientmodel.Timestamp, interval time.Duration, timeout time.Duration, storage local.Storage, queryStats *stats.TimerGroup) (local.Preloader, error) {
 	totalTimer := queryStats.GetTimer(stats.TotalEvalTime)
 
 	analyzeTimer := queryStats.GetTimer(stats.QueryAnalysisTime).Start()
-	analyzer := newQueryAnalyzer(storage)
+	storage = storageForQuery(node, start, end, storage)
+	analyzer := newQueryAnalyzer(storage, queryStats)
 	Walk(analyzer, node)
 	analyzeTimer.Stop()
+	if err := checkSeriesLimit(analyzer, queryStats); err != nil {
+		return nil, err
+	}
 
 	preloadTimer := queryStats.GetTimer(stats.PreloadTime).Start()
 	p := storage.NewPreloader()
+	p.SetDeadline(time.Now().Add(timeout - totalTimer.ElapsedTime()))
+	canceled := activeQueries.canceled(node)
+	p.SetCancel(canceled)
 	for offset, pt := range analyzer.offsetPreloadTimes {
 		offsetStart := start.Add(-offset)
 		offsetEnd := end.Add(-offset)
+		ranges := make(map[clientmodel.Fingerprint]metric.Interval, len(pt.ranges)+len(pt.instants))
 		for fp, rangeDuration := range pt.ranges {
-			if et := totalTimer.ElapsedTime(); et > *queryTimeout {
-				preloadTimer.Stop()
-				p.Close()
-				return nil, queryTimeoutError{et}
-			}
-			if err := p.PreloadRange(fp, offsetStart.Add(-rangeDuration), offsetEnd, *stalenessDelta); err != nil {
-				preloadTimer.Stop()
-				p.Close()
-				return nil, err
-			}
+			ranges[fp] = metric.Interval{OldestInclusive: offsetStart.Add(-rangeDuration), NewestInclusive: offsetEnd}
 			/*
 				if interval < rangeDuration {
 					if err := p.GetMetricRange(fp, offsetEnd, offsetEnd.Sub(offsetStart)+rangeDuration); err != nil {
@@ -208,24 +502,55 @@ func PrepareRangeQuery(node Node, start clientmodel.Timestamp, end clientmodel.T
 			*/
 		}
 		for fp := range pt.instants {
-			if et := totalTimer.ElapsedTime(); et > *queryTimeout {
+			ranges[fp] = metric.Interval{OldestInclusive: offsetStart, NewestInclusive: offsetEnd}
+		}
+		if et := totalTimer.ElapsedTime(); et > timeout {
+			preloadTimer.Stop()
+			p.Close()
+			return nil, queryTimeoutError{et}
+		}
+		if err := p.PreloadRanges(ranges, *stalenessDelta); err != nil {
+			preloadTimer.Stop()
+			p.Close()
+			return nil, preloadError(err, totalTimer)
+		}
+		for fp, rangeDuration := range pt.rollupRanges {
+			if pt.ranges[fp] >= rangeDuration {
+				// Already preloaded completely.
+				continue
+			}
+			if et := totalTimer.ElapsedTime(); et > timeout {
 				preloadTimer.Stop()
 				p.Close()
 				return nil, queryTimeoutError{et}
 			}
-			if err := p.PreloadRange(fp, offsetStart, offsetEnd, *stalenessDelta); err != nil {
+			if err := p.PreloadRollupRange(fp, offsetStart, offsetEnd, rangeDuration, *stalenessDelta); err != nil {
 				preloadTimer.Stop()
 				p.Close()
-				return nil, err
+				return nil, preloadError(err, totalTimer)
 			}
 		}
 	}
+	if len(analyzer.fixedIntervals) > 0 {
+		if et := totalTimer.ElapsedTime(); et > timeout {
+			preloadTimer.Stop()
+			p.Close()
+			return nil, queryTimeoutError{et}
+		}
+		if err := p.PreloadRanges(analyzer.fixedIntervals, *stalenessDelta); err != nil {
+			preloadTimer.Stop()
+			p.Close()
+			return nil, preloadError(err, totalTimer)
+		}
+	}
 	preloadTimer.Stop()
-
-	ii := &iteratorInitializer{
-		storage: storage,
+	queryStats.GetCounter(stats.ChunksLoaded).Add(p.NumChunks())
+	if isCanceled(canceled) {
+		p.Close()
+		return nil, queryCanceledError{}
 	}
-	Walk(ii, node)
+
+	Walk(newIteratorInitializer(storage, queryStats, canceled), node)
 
 	return p, nil
 }
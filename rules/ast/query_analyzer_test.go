@@ -0,0 +1,147 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package ast
+
+import (
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/stats"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+func TestSubqueryPreloadRanges(t *testing.T) {
+	storage, closer := local.NewTestStorage(t, 1)
+	defer closer.Close()
+	storage.Append(&clientmodel.Sample{
+		Metric: clientmodel.Metric{
+			clientmodel.MetricNameLabel: "requests",
+		},
+		Timestamp: 0,
+		Value:     1,
+	})
+	storage.WaitForIndexing()
+
+	requests, err := metric.NewLabelMatcher(metric.Equal, clientmodel.MetricNameLabel, "requests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rate, err := NewFunctionCall(functions["rate"], Nodes{
+		NewMatrixSelector(NewVectorSelector(metric.LabelMatchers{requests}, 0), 5*time.Minute, 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// max_over_time(max_over_time(rate(requests[5m])[1h:1m])[1d:1h] offset 1w)
+	inner, err := NewFunctionCall(functions["max_over_time"], Nodes{
+		NewSubquery(rate.(VectorNode), time.Hour, time.Minute, 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, err := NewFunctionCall(functions["max_over_time"], Nodes{
+		NewSubquery(inner.(VectorNode), 24*time.Hour, time.Hour, 7*24*time.Hour),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	analyzer := newQueryAnalyzer(storage, stats.NewTimerGroup())
+	Walk(analyzer, node)
+	if len(analyzer.offsetPreloadTimes) != 1 {
+		t.Fatalf("expected preload times for one offset, got %v", analyzer.offsetPreloadTimes)
+	}
+	pt, ok := analyzer.offsetPreloadTimes[7*24*time.Hour]
+	if !ok {
+		t.Fatalf("expected preload times for offset 1w, got %v", analyzer.offsetPreloadTimes)
+	}
+	fp := clientmodel.Metric{clientmodel.MetricNameLabel: "requests"}.Fingerprint()
+	if want := 25*time.Hour + 5*time.Minute; pt.ranges[fp] != want {
+		t.Errorf("expected range %v, got %v", want, pt.ranges[fp])
+	}
+
+	la := &lookbackAnalyzer{extents: map[Node]extent{}}
+	Walk(la, node)
+	if want := 7*24*time.Hour + 25*time.Hour + 5*time.Minute; la.lookback != want {
+		t.Errorf("expected lookback %v, got %v", want, la.lookback)
+	}
+}
+
+func TestTimeModifierPreloadRanges(t *testing.T) {
+	storage, closer := local.NewTestStorage(t, 1)
+	defer closer.Close()
+	storage.Append(&clientmodel.Sample{
+		Metric: clientmodel.Metric{
+			clientmodel.MetricNameLabel: "requests",
+		},
+		Timestamp: 0,
+		Value:     1,
+	})
+	storage.WaitForIndexing()
+
+	requests, err := metric.NewLabelMatcher(metric.Equal, clientmodel.MetricNameLabel, "requests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// (requests - requests offset 1h) offset 1d + requests[5m] @ 1000 + requests @ 2000
+	shifted, err := NewArithExpr(
+		Sub,
+		NewVectorSelector(metric.LabelMatchers{requests}, 0),
+		NewVectorSelector(metric.LabelMatchers{requests}, time.Hour),
+		MatchOneToOne, nil, false, nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := NewFunctionCall(functions["count_over_time"], Nodes{
+		NewMatrixSelectorAt(NewVectorSelector(metric.LabelMatchers{requests}, 0), 5*time.Minute, 0, clientmodel.TimestampFromUnix(1000)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum, err := NewArithExpr(Add, NewOffsetExpr(shifted.(VectorNode), 24*time.Hour), count, MatchOneToOne, nil, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, err := NewArithExpr(
+		Add,
+		sum,
+		NewVectorSelectorAt(metric.LabelMatchers{requests}, 0, clientmodel.TimestampFromUnix(2000)),
+		MatchOneToOne, nil, false, nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	analyzer := newQueryAnalyzer(storage, stats.NewTimerGroup())
+	Walk(analyzer, node)
+	fp := clientmodel.Metric{clientmodel.MetricNameLabel: "requests"}.Fingerprint()
+	for _, offset := range []time.Duration{24 * time.Hour, 25 * time.Hour} {
+		if _, ok := analyzer.offsetPreloadTimes[offset].instants[fp]; !ok {
+			t.Errorf("expected instants to preload at offset %v", offset)
+		}
+	}
+	if len(analyzer.offsetPreloadTimes) != 2 {
+		t.Errorf("expected preload times for two offsets, got %v", analyzer.offsetPreloadTimes)
+	}
+	want := metric.Interval{
+		OldestInclusive: clientmodel.TimestampFromUnix(700),
+		NewestInclusive: clientmodel.TimestampFromUnix(2000),
+	}
+	if got := analyzer.fixedIntervals[fp]; got != want {
+		t.Errorf("expected fixed interval %v, got %v", want, got)
+	}
+}
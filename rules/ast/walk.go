@@ -13,6 +13,12 @@
 
 package ast
 
+import (
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
 // visitor is the interface for a Node visitor.
 type visitor interface {
 	visit(node Node)
@@ -26,3 +32,42 @@ func Walk(v visitor, node Node) {
 		Walk(v, childNode)
 	}
 }
+
+// metricNameVisitor collects the metric names selected by the selectors of an
+// AST.
+type metricNameVisitor struct {
+	names map[clientmodel.LabelValue]bool
+	// Set if a selector might select series of any metric name.
+	any bool
+}
+
+func (v *metricNameVisitor) visit(node Node) {
+	var matchers metric.LabelMatchers
+	switch n := node.(type) {
+	case *VectorSelector:
+		matchers = n.labelMatchers
+	case *MatrixSelector:
+		matchers = n.labelMatchers
+	default:
+		return
+	}
+	for _, m := range matchers {
+		if m.Name == clientmodel.MetricNameLabel && m.Type == metric.Equal {
+			v.names[m.Value] = true
+			return
+		}
+	}
+	v.any = true
+}
+
+// SelectedMetricNames returns the metric names selected by the selectors in
+// the AST starting at node, and true. If a selector does not match a single
+// metric name, it might select series of any name, and false is returned.
+func SelectedMetricNames(node Node) (map[clientmodel.LabelValue]bool, bool) {
+	v := &metricNameVisitor{names: map[clientmodel.LabelValue]bool{}}
+	Walk(v, node)
+	if v.any {
+		return nil, false
+	}
+	return v.names, true
+}
@@ -39,7 +39,7 @@ func CreateRecordingRule(name string, labels clientmodel.LabelSet, expr ast.Node
 }
 
 // CreateAlertingRule is a convenience function to create a new alerting rule.
-func CreateAlertingRule(name string, expr ast.Node, holdDurationStr string, labels clientmodel.LabelSet, summary string, description string) (*AlertingRule, error) {
+func CreateAlertingRule(name string, expr ast.Node, holdDurationStr string, labels clientmodel.LabelSet, summary string, description string, annotations clientmodel.LabelSet) (*AlertingRule, error) {
 	if _, ok := expr.(ast.VectorNode); !ok {
 		return nil, fmt.Errorf("alert rule expression %v does not evaluate to vector type", expr)
 	}
@@ -47,7 +47,12 @@ func CreateAlertingRule(name string, expr ast.Node, holdDurationStr string, labe
 	if err != nil {
 		return nil, err
 	}
-	return NewAlertingRule(name, expr.(ast.VectorNode), holdDuration, labels, summary, description), nil
+	for name, text := range labels {
+		if _, err := parseLabelTemplate(name, text); err != nil {
+			return nil, fmt.Errorf("invalid template in label %s: %s", name, err)
+		}
+	}
+	return NewAlertingRule(name, expr.(ast.VectorNode), holdDuration, labels, summary, description, annotations), nil
 }
 
 // NewScalarLiteral returns a ScalarLiteral with the given value. If sign is "-"
@@ -60,9 +65,21 @@ func NewScalarLiteral(value clientmodel.SampleValue, sign string) *ast.ScalarLit
 }
 
 // NewFunctionCall is a convenience function to create a new AST function-call node.
+// Aggregations taking a parameter, e.g. topk(5, x), are parsed like function
+// calls and turned into vector aggregations here.
 func NewFunctionCall(name string, args []ast.Node) (ast.Node, error) {
+	if _, ok := parameterizedAggrTypes[strings.ToUpper(name)]; ok {
+		aggregation, err := NewParameterizedAggregation(name, args, clientmodel.LabelNames{})
+		if err != nil {
+			return nil, err
+		}
+		return aggregation, nil
+	}
 	function, err := ast.GetFunction(name)
 	if err != nil {
+		if suggestion := similarName(name, callableNames()); suggestion != "" {
+			return nil, fmt.Errorf("unknown function %q, did you mean %q?", name, suggestion)
+		}
 		return nil, fmt.Errorf("unknown function %q", name)
 	}
 	functionCall, err := ast.NewFunctionCall(function, args)
@@ -72,6 +89,57 @@ func NewFunctionCall(name string, args []ast.Node) (ast.Node, error) {
 	return functionCall, nil
 }
 
+// callableNames returns the names of all functions and aggregations, which
+// are called alike.
+func callableNames() []string {
+	names := ast.FunctionNames()
+	for _, aggrType := range []ast.AggrType{ast.Sum, ast.Avg, ast.Min, ast.Max, ast.Count, ast.Stdvar, ast.Stddev} {
+		names = append(names, strings.ToLower(aggrType.String()))
+	}
+	for name := range parameterizedAggrTypes {
+		names = append(names, strings.ToLower(name))
+	}
+	return names
+}
+
+// similarName returns the candidate closest to the given name by edit
+// distance, or an empty string if none is close enough to be a likely typo.
+func similarName(name string, candidates []string) string {
+	best, bestDist := "", len(name)/3+1
+	for _, c := range candidates {
+		if d := editDistance(name, c); d < bestDist {
+			best, bestDist = c, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cur[j] = prev[j-1]
+			if a[i-1] != b[j-1] {
+				cur[j]++
+			}
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
 // NewVectorAggregation is a convenience function to create a new AST vector aggregation.
 func NewVectorAggregation(aggrTypeStr string, vector ast.Node, groupBy clientmodel.LabelNames, keepExtraLabels bool) (*ast.VectorAggregation, error) {
 	if _, ok := vector.(ast.VectorNode); !ok {
@@ -93,15 +161,45 @@ func NewVectorAggregation(aggrTypeStr string, vector ast.Node, groupBy clientmod
 	return ast.NewVectorAggregation(aggrType, vector.(ast.VectorNode), groupBy, keepExtraLabels), nil
 }
 
+// parameterizedAggrTypes maps the names of the aggregations taking a
+// parameter to their aggregation types.
+var parameterizedAggrTypes = map[string]ast.AggrType{
+	"COUNT_VALUES": ast.CountValues,
+	"TOPK":         ast.TopK,
+	"BOTTOMK":      ast.BottomK,
+	"QUANTILE":     ast.Quantile,
+}
+
+// NewParameterizedAggregation is a convenience function to create a new AST
+// vector aggregation taking a parameter, from the name and the arguments of
+// the aggregation.
+func NewParameterizedAggregation(aggrTypeStr string, args []ast.Node, groupBy clientmodel.LabelNames) (*ast.VectorAggregation, error) {
+	aggrType, ok := parameterizedAggrTypes[strings.ToUpper(aggrTypeStr)]
+	if !ok {
+		return nil, fmt.Errorf("unknown aggregation type %q", aggrTypeStr)
+	}
+	if len(args) != 2 {
+		return nil, fmt.Errorf("wrong number of arguments to %v aggregation: %d (expected 2)", aggrTypeStr, len(args))
+	}
+	vector, ok := args[1].(ast.VectorNode)
+	if !ok {
+		return nil, fmt.Errorf("operand of %v aggregation must be of vector type", aggrTypeStr)
+	}
+	return ast.NewParameterizedVectorAggregation(aggrType, args[0], vector, groupBy)
+}
+
 // vectorMatching combines data used to match samples between vectors.
 type vectorMatching struct {
 	matchCardinality ast.VectorMatchCardinality
 	matchOn          clientmodel.LabelNames
+	ignoring         bool
 	includeLabels    clientmodel.LabelNames
 }
 
 // newVectorMatching is a convenience function to create a new vectorMatching.
-func newVectorMatching(card string, matchOn, include clientmodel.LabelNames) (*vectorMatching, error) {
+// If ignoring is true, samples are matched on all labels except those in
+// matchOn.
+func newVectorMatching(card string, matchOn clientmodel.LabelNames, ignoring bool, include clientmodel.LabelNames) (*vectorMatching, error) {
 	var matchCardinalities = map[string]ast.VectorMatchCardinality{
 		"":            ast.MatchOneToOne,
 		"GROUP_LEFT":  ast.MatchManyToOne,
@@ -114,15 +212,16 @@ func newVectorMatching(card string, matchOn, include clientmodel.LabelNames) (*v
 	if matchCard != ast.MatchOneToOne && len(include) == 0 {
 		return nil, fmt.Errorf("grouped vector matching must provide labels")
 	}
-	// There must be no overlap between both labelname lists.
+	// There must be no overlap between both labelname lists. Ignored labels
+	// may be included, though, as they differ between the "many" samples.
 	for _, matchLabel := range matchOn {
 		for _, incLabel := range include {
-			if matchLabel == incLabel {
+			if matchLabel == incLabel && !ignoring {
 				return nil, fmt.Errorf("use of label %s in ON and %s clauses not allowed", incLabel, card)
 			}
 		}
 	}
-	return &vectorMatching{matchCard, matchOn, include}, nil
+	return &vectorMatching{matchCard, matchOn, ignoring, include}, nil
 }
 
 // NewArithExpr is a convenience function to create a new AST arithmetic expression.
@@ -154,29 +253,56 @@ func NewArithExpr(opTypeStr string, lhs ast.Node, rhs ast.Node, vecMatching *vec
 			vm.matchCardinality = ast.MatchManyToMany
 		}
 	}
-	expr, err := ast.NewArithExpr(opType, lhs, rhs, vm.matchCardinality, vm.matchOn, vm.includeLabels)
+	expr, err := ast.NewArithExpr(opType, lhs, rhs, vm.matchCardinality, vm.matchOn, vm.ignoring, vm.includeLabels)
 	if err != nil {
 		return nil, fmt.Errorf(err.Error())
 	}
 	return expr, nil
 }
 
+// selectorModifiers combines the offset and the @ modifier of a selector.
+type selectorModifiers struct {
+	offset string
+	// The Unix timestamp in seconds to evaluate the selector at, nil if
+	// the selector has no @ modifier.
+	at *clientmodel.SampleValue
+}
+
+// newSelectorModifiers is a convenience function to create new
+// selectorModifiers. The at value is copied.
+func newSelectorModifiers(offset string, at *clientmodel.SampleValue) *selectorModifiers {
+	mods := &selectorModifiers{offset: offset}
+	if at != nil {
+		v := *at
+		mods.at = &v
+	}
+	return mods
+}
+
+// timestamp returns the timestamp of the @ modifier.
+func (mods *selectorModifiers) timestamp() clientmodel.Timestamp {
+	return clientmodel.TimestampFromUnixNano(int64(float64(*mods.at) * 1e9))
+}
+
 // NewVectorSelector is a convenience function to create a new AST vector selector.
-func NewVectorSelector(m metric.LabelMatchers, offsetStr string) (ast.VectorNode, error) {
-	offset, err := utility.StringToDuration(offsetStr)
+func NewVectorSelector(m metric.LabelMatchers, mods *selectorModifiers) (ast.VectorNode, error) {
+	offset, err := utility.StringToDuration(mods.offset)
 	if err != nil {
 		return nil, err
 	}
+	if mods.at != nil {
+		return ast.NewVectorSelectorAt(m, offset, mods.timestamp()), nil
+	}
 	return ast.NewVectorSelector(m, offset), nil
 }
 
 // NewMatrixSelector is a convenience function to create a new AST matrix selector.
-func NewMatrixSelector(vector ast.Node, intervalStr string, offsetStr string) (ast.MatrixNode, error) {
+func NewMatrixSelector(vector ast.Node, intervalStr string, mods *selectorModifiers) (ast.MatrixNode, error) {
 	interval, err := utility.StringToDuration(intervalStr)
 	if err != nil {
 		return nil, err
 	}
-	offset, err := utility.StringToDuration(offsetStr)
+	offset, err := utility.StringToDuration(mods.offset)
 	if err != nil {
 		return nil, err
 	}
@@ -184,9 +310,55 @@ func NewMatrixSelector(vector ast.Node, intervalStr string, offsetStr string) (a
 	if !ok {
 		return nil, fmt.Errorf("intervals are currently only supported for vector selectors")
 	}
+	if mods.at != nil {
+		return ast.NewMatrixSelectorAt(vectorSelector, interval, offset, mods.timestamp()), nil
+	}
 	return ast.NewMatrixSelector(vectorSelector, interval, offset), nil
 }
 
+// NewOffsetExpr is a convenience function to create a new AST expression
+// evaluated at an offset.
+func NewOffsetExpr(expr ast.Node, offsetStr string) (*ast.OffsetExpr, error) {
+	vector, ok := expr.(ast.VectorNode)
+	if !ok {
+		return nil, fmt.Errorf("offset expression %v must be of vector type", expr)
+	}
+	offset, err := utility.StringToDuration(offsetStr)
+	if err != nil {
+		return nil, err
+	}
+	return ast.NewOffsetExpr(vector, offset), nil
+}
+
+// NewSubquery is a convenience function to create a new AST subquery. As
+// colons are valid in metric names, the lexer returns the colon and the
+// resolution of "[1h:5m]" as a single metric name token.
+func NewSubquery(expr ast.Node, intervalStr string, resolutionStr string, offsetStr string) (*ast.Subquery, error) {
+	if !strings.HasPrefix(resolutionStr, ":") {
+		return nil, fmt.Errorf("unexpected %q in range", resolutionStr)
+	}
+	vector, ok := expr.(ast.VectorNode)
+	if !ok {
+		return nil, fmt.Errorf("subquery expression %v must be of vector type", expr)
+	}
+	interval, err := utility.StringToDuration(intervalStr)
+	if err != nil {
+		return nil, err
+	}
+	resolution, err := utility.StringToDuration(resolutionStr[1:])
+	if err != nil {
+		return nil, err
+	}
+	if resolution <= 0 {
+		return nil, fmt.Errorf("subquery resolution must be positive")
+	}
+	offset, err := utility.StringToDuration(offsetStr)
+	if err != nil {
+		return nil, err
+	}
+	return ast.NewSubquery(vector, interval, resolution, offset), nil
+}
+
 func newLabelMatcher(matchTypeStr string, name clientmodel.LabelName, value clientmodel.LabelValue) (*metric.LabelMatcher, error) {
 	matchTypes := map[string]metric.MatchType{
 		"=":  metric.Equal,
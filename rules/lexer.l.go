@@ -49,6 +49,7 @@ func (lexer *RulesLexer) Lex(lval *yySymType) int {
 yystate0:
 
 	lexer.buf = lexer.buf[:0] // The code before the first rule executed before every scan cycle (rule #0 / state 0 action)
+	lexer.tokenLine, lexer.tokenPos = lexer.line, lexer.pos
 
 	switch yyt := currentState; yyt {
 	default:
@@ -2867,6 +2868,12 @@ yyrule25: // {D}+{U}
 yyrule26: // {L}({L}|{D})*
 	{
 		lval.str = lexer.token()
+		if lval.str == "ignoring" || lval.str == "IGNORING" {
+			return IGNORING
+		}
+		if lval.str == "annotations" || lval.str == "ANNOTATIONS" {
+			return ANNOTATIONS
+		}
 		return IDENTIFIER
 		goto yystate0
 	}
@@ -2897,6 +2904,10 @@ yyrule30: // [\t\n\r ]
 
 yyabort: // no lexem recognized
 
+	// No rule matched, so the current character is returned as the token.
+	if c != 0 {
+		lexer.buf = append(lexer.buf, c)
+	}
 	lexer.empty = true
 	return int(c)
 }
@@ -15,7 +15,6 @@ package rules
 
 import (
 	"bufio"
-	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -26,10 +25,46 @@ import (
 	"github.com/prometheus/prometheus/rules/ast"
 )
 
+// A ParseError is an error encountered while parsing rules or an expression.
+// The position is the one of the token the parser was looking at when the
+// error occurred.
+type ParseError struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+	// The offending token, empty at the end of the input.
+	Token string `json:"token"`
+	Msg   string `json:"message"`
+}
+
+func (e *ParseError) Error() string {
+	near := "at end of input"
+	if e.Token != "" {
+		near = fmt.Sprintf("near %q", e.Token)
+	}
+	return fmt.Sprintf("Error parsing rules at line %v, char %v %s: %v", e.Line, e.Column, near, e.Msg)
+}
+
+// ParseErrors is the error returned when parsing rules or an expression
+// fails, listing all errors encountered.
+type ParseErrors []*ParseError
+
+func (errs ParseErrors) Error() string {
+	msgs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func init() {
+	// Report the unexpected and the expected tokens of syntax errors.
+	yyErrorVerbose = true
+}
+
 // RulesLexer is the lexer for rule expressions.
 type RulesLexer struct {
 	// Errors encountered during parsing.
-	errors []string
+	errors ParseErrors
 	// Dummy token to simulate multiple start symbols (see below).
 	startToken int
 	// Parsed full rules.
@@ -45,16 +80,28 @@ type RulesLexer struct {
 	src *bufio.Reader
 	// Whether we have a current char.
 	empty bool
+	// Whether the end of the input has been reached.
+	eof bool
 
 	// Current input line.
 	line int
 	// Current character position within the current input line.
 	pos int
+	// Position of the first character of the current token.
+	tokenLine, tokenPos int
 }
 
+// yaccTokenNames replaces the names yacc uses for special tokens in syntax
+// error messages.
+var yaccTokenNames = strings.NewReplacer("$end", "end of input", "$unk", "character")
+
 func (lexer *RulesLexer) Error(errorStr string) {
-	err := fmt.Sprintf("Error parsing rules at line %v, char %v: %v", lexer.line, lexer.pos, errorStr)
-	lexer.errors = append(lexer.errors, err)
+	lexer.errors = append(lexer.errors, &ParseError{
+		Line:   lexer.tokenLine,
+		Column: lexer.tokenPos,
+		Token:  lexer.token(),
+		Msg:    yaccTokenNames.Replace(errorStr),
+	})
 }
 
 func (lexer *RulesLexer) getChar() byte {
@@ -72,6 +119,10 @@ func (lexer *RulesLexer) getChar() byte {
 		lexer.current = b
 	} else if err != io.EOF {
 		glog.Fatal(err)
+	} else if !lexer.eof {
+		// Place the end of the input after the last character.
+		lexer.eof = true
+		lexer.pos++
 	}
 	return lexer.current
 }
@@ -84,7 +135,6 @@ func newRulesLexer(src io.Reader, singleExpr bool) *RulesLexer {
 	lexer := &RulesLexer{
 		startToken: START_RULES,
 		src:        bufio.NewReader(src),
-		pos:        1,
 		line:       1,
 	}
 
@@ -103,8 +153,7 @@ func lexAndParse(rulesReader io.Reader, singleExpr bool) (*RulesLexer, error) {
 	}
 
 	if len(lexer.errors) > 0 {
-		err := errors.New(strings.Join(lexer.errors, "\n"))
-		return nil, err
+		return nil, lexer.errors
 	}
 	return lexer, nil
 }
@@ -38,6 +38,9 @@ const (
 	ruleTypeLabel     = "rule_type"
 	alertingRuleType  = "alerting"
 	recordingRuleType = "recording"
+
+	ruleGroupLabel = "rule_group"
+	ruleNameLabel  = "rule_name"
 )
 
 var (
@@ -47,21 +50,25 @@ var (
 			Name:      "rule_evaluation_duration_milliseconds",
 			Help:      "The duration for a rule to execute.",
 		},
-		[]string{ruleTypeLabel},
+		[]string{ruleTypeLabel, ruleGroupLabel, ruleNameLabel},
 	)
-	evalFailures = prometheus.NewCounter(
+	evalFailures = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: namespace,
 			Name:      "rule_evaluation_failures_total",
 			Help:      "The total number of rule evaluation failures.",
 		},
+		[]string{ruleTypeLabel, ruleGroupLabel, ruleNameLabel},
+	)
+	iterationDuration = prometheus.NewSummaryVec(
+		prometheus.SummaryOpts{
+			Namespace:  namespace,
+			Name:       "evaluator_duration_milliseconds",
+			Help:       "The duration for all evaluations of a rule group to execute.",
+			Objectives: map[float64]float64{0.01: 0.001, 0.05: 0.005, 0.5: 0.05, 0.90: 0.01, 0.99: 0.001},
+		},
+		[]string{ruleGroupLabel},
 	)
-	iterationDuration = prometheus.NewSummary(prometheus.SummaryOpts{
-		Namespace:  namespace,
-		Name:       "evaluator_duration_milliseconds",
-		Help:       "The duration for all evaluations to execute.",
-		Objectives: map[float64]float64{0.01: 0.001, 0.05: 0.005, 0.5: 0.05, 0.90: 0.01, 0.99: 0.001},
-	})
 )
 
 func init() {
@@ -75,25 +82,89 @@ func init() {
 type RuleManager interface {
 	// Load and add rules from rule files specified in the configuration.
 	AddRulesFromConfig(config config.Config) error
+	// Replace the rule groups by those loaded from the rule files
+	// specified in the configuration. Alerting rules whose definition
+	// did not change keep their state. If any rule file cannot be
+	// loaded, the rule groups are left unchanged.
+	ApplyConfig(config config.Config) error
 	// Start the rule manager's periodic rule evaluation.
 	Run()
 	// Stop the rule manager's rule evaluation cycles.
 	Stop()
 	// Return all rules.
 	Rules() []rules.Rule
+	// Return all rule groups.
+	Groups() []*Group
 	// Return all alerting rules.
 	AlertingRules() []*rules.AlertingRule
 }
 
+// A Group is a named list of rules evaluated at a common interval. A rule of a
+// group that selects series recorded by rules preceding it is evaluated after
+// them, so that it sees their samples. Other rules are evaluated concurrently.
+type Group struct {
+	name     string
+	interval time.Duration
+	rules    []rules.Rule
+
+	// The indexes of the preceding rules each rule depends on.
+	dependencies [][]int
+	// Whether any following rule depends on each rule.
+	hasDependents []bool
+}
+
+// newGroup returns a Group of the given rules with their dependencies
+// resolved.
+func newGroup(name string, interval time.Duration, groupRules []rules.Rule) *Group {
+	g := &Group{
+		name:          name,
+		interval:      interval,
+		rules:         groupRules,
+		dependencies:  make([][]int, len(groupRules)),
+		hasDependents: make([]bool, len(groupRules)),
+	}
+	for i, rule := range groupRules {
+		for j := 0; j < i; j++ {
+			if rules.DependsOn(rule, groupRules[j]) {
+				g.dependencies[i] = append(g.dependencies[i], j)
+				g.hasDependents[j] = true
+			}
+		}
+	}
+	return g
+}
+
+// Name returns the name of the group.
+func (g *Group) Name() string {
+	return g.name
+}
+
+// Interval returns the evaluation interval of the group.
+func (g *Group) Interval() time.Duration {
+	return g.interval
+}
+
+// Rules returns the rules of the group in the order they were loaded.
+func (g *Group) Rules() []rules.Rule {
+	rules := make([]rules.Rule, len(g.rules))
+	copy(rules, g.rules)
+	return rules
+}
+
 type ruleManager struct {
-	// Protects the rules list.
+	// Protects the groups list.
 	sync.Mutex
-	rules []rules.Rule
+	groups []*Group
 
 	done chan bool
+	// Signals Run to restart the evaluation of the groups after they have
+	// been replaced.
+	reload chan struct{}
+	// Holds a token for each rule being evaluated.
+	workers chan struct{}
 
-	interval time.Duration
-	storage  local.Storage
+	storage            local.Storage
+	forOutageTolerance time.Duration
 
 	sampleAppender      storage.SampleAppender
 	notificationHandler *notification.NotificationHandler
@@ -104,8 +175,13 @@ type ruleManager struct {
 
 // RuleManagerOptions bundles options for the RuleManager.
 type RuleManagerOptions struct {
-	EvaluationInterval time.Duration
-	Storage            local.Storage
+	Storage local.Storage
+	// The maximum number of rules evaluated concurrently. Defaults to 1.
+	EvaluationWorkers int
+	// How long alerts can have been unevaluated, e.g. during a restart,
+	// and still keep the time since which they have been active. 0
+	// disables restoring alert state.
+	ForOutageTolerance time.Duration
 
 	NotificationHandler *notification.NotificationHandler
 	SampleAppender      storage.SampleAppender
@@ -117,12 +193,18 @@ type RuleManagerOptions struct {
 // NewRuleManager returns an implementation of RuleManager, ready to be started
 // by calling the Run method.
 func NewRuleManager(o *RuleManagerOptions) RuleManager {
+	workers := o.EvaluationWorkers
+	if workers < 1 {
+		workers = 1
+	}
 	manager := &ruleManager{
-		rules: []rules.Rule{},
-		done:  make(chan bool),
+		groups:  []*Group{},
+		done:    make(chan bool),
+		reload:  make(chan struct{}, 1),
+		workers: make(chan struct{}, workers),
 
-		interval:            o.EvaluationInterval,
 		storage:             o.Storage,
+		forOutageTolerance:  o.ForOutageTolerance,
 		sampleAppender:      o.SampleAppender,
 		notificationHandler: o.NotificationHandler,
 		prometheusURL:       o.PrometheusURL,
@@ -133,24 +215,73 @@ func NewRuleManager(o *RuleManagerOptions) RuleManager {
 func (m *ruleManager) Run() {
 	defer glog.Info("Rule manager stopped.")
 
-	ticker := time.NewTicker(m.interval)
+	groups := m.Groups()
+	if m.forOutageTolerance > 0 {
+		m.restoreForState(groups, clientmodel.Now())
+	}
+
+	for {
+		stop := make(chan struct{})
+		wg := sync.WaitGroup{}
+		for _, g := range groups {
+			wg.Add(1)
+			go func(g *Group) {
+				defer wg.Done()
+				m.runGroup(g, stop)
+			}(g)
+		}
+
+		// Evaluations in progress finish before the groups are
+		// restarted or the rule manager stops.
+		select {
+		case <-m.done:
+			close(stop)
+			wg.Wait()
+			return
+		case <-m.reload:
+			close(stop)
+			wg.Wait()
+			groups = m.Groups()
+			glog.Infof("Restarted evaluation of %d rule groups.", len(groups))
+		}
+	}
+}
+
+// restoreForState restores the times since which the alerts of the given
+// groups have been active, as recorded before the last shutdown.
+func (m *ruleManager) restoreForState(groups []*Group, now clientmodel.Timestamp) {
+	for _, g := range groups {
+		for _, rule := range g.rules {
+			if alertingRule, ok := rule.(*rules.AlertingRule); ok {
+				if err := alertingRule.RestoreForState(now, m.forOutageTolerance, m.storage); err != nil {
+					glog.Warningf("Error restoring state of alert %q: %s", alertingRule.Name(), err)
+				}
+			}
+		}
+	}
+}
+
+// runGroup evaluates the rules of the given group at the group's interval
+// until stop is closed.
+func (m *ruleManager) runGroup(g *Group, stop <-chan struct{}) {
+	ticker := time.NewTicker(g.interval)
 	defer ticker.Stop()
 
 	for {
-		// The outer select clause makes sure that m.done is looked at
+		// The outer select clause makes sure that stop is looked at
 		// first. Otherwise, if m.runIteration takes longer than
-		// m.interval, there is only a 50% chance that m.done will be
+		// g.interval, there is only a 50% chance that stop will be
 		// looked at before the next m.runIteration call happens.
 		select {
-		case <-m.done:
+		case <-stop:
 			return
 		default:
 			select {
 			case <-ticker.C:
 				start := time.Now()
-				m.runIteration()
-				iterationDuration.Observe(float64(time.Since(start) / time.Millisecond))
-			case <-m.done:
+				m.runIteration(g, clientmodel.Now())
+				iterationDuration.WithLabelValues(g.name).Observe(float64(time.Since(start) / time.Millisecond))
+			case <-stop:
 				return
 			}
 		}
@@ -176,23 +307,10 @@ func (m *ruleManager) queueAlertNotifications(rule *rules.AlertingRule, timestam
 		}
 
 		// Provide the alert information to the template.
-		l := map[string]string{}
-		for k, v := range aa.Labels {
-			l[string(k)] = string(v)
-		}
-		tmplData := struct {
-			Labels map[string]string
-			Value  clientmodel.SampleValue
-		}{
-			Labels: l,
-			Value:  aa.Value,
-		}
-		// Inject some convenience variables that are easier to remember for users
-		// who are not used to Go's templating system.
-		defs := "{{$labels := .Labels}}{{$value := .Value}}"
+		tmplData := rules.AlertTemplateData(aa.Labels, aa.Value)
 
 		expand := func(text string) string {
-			template := templates.NewTemplateExpander(defs+text, "__alert_"+rule.Name(), tmplData, timestamp, m.storage, m.pathPrefix)
+			template := templates.NewTemplateExpander(rules.AlertTemplateDefs+text, "__alert_"+rule.Name(), tmplData, timestamp, m.storage, m.pathPrefix)
 			result, err := template.Expand()
 			if err != nil {
 				result = err.Error()
@@ -201,9 +319,15 @@ func (m *ruleManager) queueAlertNotifications(rule *rules.AlertingRule, timestam
 			return result
 		}
 
+		annotations := make(clientmodel.LabelSet, len(rule.Annotations))
+		for name, text := range rule.Annotations {
+			annotations[name] = clientmodel.LabelValue(expand(string(text)))
+		}
+
 		notifications = append(notifications, &notification.NotificationReq{
 			Summary:     expand(rule.Summary),
 			Description: expand(rule.Description),
+			Annotations: annotations,
 			Labels: aa.Labels.Merge(clientmodel.LabelSet{
 				rules.AlertNameLabel: clientmodel.LabelValue(rule.Name()),
 			}),
@@ -216,87 +340,165 @@ func (m *ruleManager) queueAlertNotifications(rule *rules.AlertingRule, timestam
 	m.notificationHandler.SubmitReqs(notifications)
 }
 
-func (m *ruleManager) runIteration() {
-	now := clientmodel.Now()
-	wg := sync.WaitGroup{}
-
-	m.Lock()
-	rulesSnapshot := make([]rules.Rule, len(m.rules))
-	copy(rulesSnapshot, m.rules)
-	m.Unlock()
+// runIteration evaluates the rules of the given group at the given timestamp.
+// Rules are evaluated concurrently, limited by the worker pool of the rule
+// manager, but never before the rules of the group they depend on.
+func (m *ruleManager) runIteration(g *Group, now clientmodel.Timestamp) {
+	done := make([]chan struct{}, len(g.rules))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
 
-	for _, rule := range rulesSnapshot {
+	wg := sync.WaitGroup{}
+	for i, rule := range g.rules {
 		wg.Add(1)
-		// BUG(julius): Look at fixing thundering herd.
-		go func(rule rules.Rule) {
+		go func(i int, rule rules.Rule) {
 			defer wg.Done()
+			defer close(done[i])
 
-			start := time.Now()
-			vector, err := rule.Eval(now, m.storage)
-			duration := time.Since(start)
-
-			if err != nil {
-				evalFailures.Inc()
-				glog.Warningf("Error while evaluating rule %q: %s", rule, err)
-				return
+			for _, j := range g.dependencies[i] {
+				<-done[j]
 			}
+			m.workers <- struct{}{}
+			m.evalRule(g, rule, now, g.hasDependents[i])
+			<-m.workers
+		}(i, rule)
+	}
+	wg.Wait()
+}
 
-			switch r := rule.(type) {
-			case *rules.AlertingRule:
-				m.queueAlertNotifications(r, now)
-				evalDuration.WithLabelValues(alertingRuleType).Observe(
-					float64(duration / time.Millisecond),
-				)
-			case *rules.RecordingRule:
-				evalDuration.WithLabelValues(recordingRuleType).Observe(
-					float64(duration / time.Millisecond),
-				)
-			default:
-				panic(fmt.Sprintf("Unknown rule type: %T", rule))
-			}
+// evalRule evaluates a single rule of the given group and appends its output.
+// If waitForIndexing is true, evalRule returns only once the output is
+// queryable by the rules depending on it.
+func (m *ruleManager) evalRule(g *Group, rule rules.Rule, now clientmodel.Timestamp, waitForIndexing bool) {
+	start := time.Now()
+	vector, err := rule.Eval(now, m.storage)
+	duration := time.Since(start)
+
+	var ruleType string
+	switch rule.(type) {
+	case *rules.AlertingRule:
+		ruleType = alertingRuleType
+	case *rules.RecordingRule:
+		ruleType = recordingRuleType
+	default:
+		panic(fmt.Sprintf("Unknown rule type: %T", rule))
+	}
+	evalDuration.WithLabelValues(ruleType, g.name, rule.Name()).Observe(
+		float64(duration / time.Millisecond),
+	)
 
-			for _, s := range vector {
-				m.sampleAppender.Append(&clientmodel.Sample{
-					Metric:    s.Metric.Metric,
-					Value:     s.Value,
-					Timestamp: s.Timestamp,
-				})
-			}
-		}(rule)
+	if err != nil {
+		evalFailures.WithLabelValues(ruleType, g.name, rule.Name()).Inc()
+		glog.Warningf("Error while evaluating rule %q in group %q: %s", rule, g.name, err)
+		return
+	}
+
+	if r, ok := rule.(*rules.AlertingRule); ok {
+		m.queueAlertNotifications(r, now)
+	}
+
+	samples := make(clientmodel.Samples, 0, len(vector))
+	for _, s := range vector {
+		samples = append(samples, &clientmodel.Sample{
+			Metric:    s.Metric.Metric,
+			Value:     s.Value,
+			Timestamp: s.Timestamp,
+		})
+	}
+	storage.AppendBatch(m.sampleAppender, samples)
+	// Newly created series are not queryable before they are indexed.
+	if waitForIndexing && len(vector) > 0 {
+		m.storage.WaitForIndexing()
 	}
-	wg.Wait()
 }
 
 func (m *ruleManager) AddRulesFromConfig(config config.Config) error {
-	for _, ruleFile := range config.Global.RuleFile {
-		newRules, err := rules.LoadRulesFromFile(ruleFile)
-		if err != nil {
-			return fmt.Errorf("%s: %s", ruleFile, err)
+	for _, rg := range config.RuleGroups() {
+		var groupRules []rules.Rule
+		for _, ruleFile := range rg.Files {
+			newRules, err := rules.LoadRulesFromFile(ruleFile)
+			if err != nil {
+				return fmt.Errorf("%s: %s", ruleFile, err)
+			}
+			groupRules = append(groupRules, newRules...)
 		}
 		m.Lock()
-		m.rules = append(m.rules, newRules...)
+		m.groups = append(m.groups, newGroup(rg.Name, rg.Interval, groupRules))
 		m.Unlock()
 	}
 	return nil
 }
 
+func (m *ruleManager) ApplyConfig(config config.Config) error {
+	// Alerting rules are identified by their definition, so that the
+	// active alerts of unchanged rules survive the reload.
+	oldAlertingRules := map[string]*rules.AlertingRule{}
+	for _, rule := range m.AlertingRules() {
+		oldAlertingRules[rule.String()] = rule
+	}
+
+	var groups []*Group
+	for _, rg := range config.RuleGroups() {
+		var groupRules []rules.Rule
+		for _, ruleFile := range rg.Files {
+			newRules, err := rules.LoadRulesFromFile(ruleFile)
+			if err != nil {
+				return fmt.Errorf("%s: %s", ruleFile, err)
+			}
+			for i, rule := range newRules {
+				if old, ok := oldAlertingRules[rule.String()]; ok {
+					newRules[i] = old
+					delete(oldAlertingRules, rule.String())
+				}
+			}
+			groupRules = append(groupRules, newRules...)
+		}
+		groups = append(groups, newGroup(rg.Name, rg.Interval, groupRules))
+	}
+
+	m.Lock()
+	m.groups = groups
+	m.Unlock()
+
+	select {
+	case m.reload <- struct{}{}:
+	default:
+		// A restart is already pending and picks up the new groups.
+	}
+	return nil
+}
+
 func (m *ruleManager) Rules() []rules.Rule {
 	m.Lock()
 	defer m.Unlock()
 
-	rules := make([]rules.Rule, len(m.rules))
-	copy(rules, m.rules)
+	rules := []rules.Rule{}
+	for _, g := range m.groups {
+		rules = append(rules, g.rules...)
+	}
 	return rules
 }
 
+func (m *ruleManager) Groups() []*Group {
+	m.Lock()
+	defer m.Unlock()
+
+	groups := make([]*Group, len(m.groups))
+	copy(groups, m.groups)
+	return groups
+}
+
 func (m *ruleManager) AlertingRules() []*rules.AlertingRule {
 	m.Lock()
 	defer m.Unlock()
 
 	alerts := []*rules.AlertingRule{}
-	for _, rule := range m.rules {
-		if alertingRule, ok := rule.(*rules.AlertingRule); ok {
-			alerts = append(alerts, alertingRule)
+	for _, g := range m.groups {
+		for _, rule := range g.rules {
+			if alertingRule, ok := rule.(*rules.AlertingRule); ok {
+				alerts = append(alerts, alertingRule)
+			}
 		}
 	}
 	return alerts
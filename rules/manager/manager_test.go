@@ -0,0 +1,156 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package manager
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/rules"
+	"github.com/prometheus/prometheus/rules/ast"
+	"github.com/prometheus/prometheus/stats"
+	"github.com/prometheus/prometheus/storage/local"
+)
+
+func TestGroupSequentialEvaluation(t *testing.T) {
+	storage, closer := local.NewTestStorage(t, 1)
+	defer closer.Close()
+
+	now := clientmodel.Now()
+	storage.Append(&clientmodel.Sample{
+		Metric: clientmodel.Metric{
+			clientmodel.MetricNameLabel: "http_requests",
+			"job":                       "api",
+		},
+		Value:     10,
+		Timestamp: now.Add(-time.Minute),
+	})
+	storage.WaitForIndexing()
+
+	groupRules, err := rules.LoadRulesFromString(`
+		job:http_requests:sum = sum(http_requests) by (job)
+		job:http_requests:sum_doubled = job:http_requests:sum * 2
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewRuleManager(&RuleManagerOptions{
+		Storage:        storage,
+		SampleAppender: storage,
+	}).(*ruleManager)
+	m.runIteration(newGroup("test", time.Minute, groupRules), now)
+	storage.WaitForIndexing()
+
+	expr, err := rules.LoadExprFromString("job:http_requests:sum_doubled")
+	if err != nil {
+		t.Fatal(err)
+	}
+	vector, err := ast.EvalVectorInstant(expr.(ast.VectorNode), now, storage, stats.NewTimerGroup())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vector) != 1 || vector[0].Value != 20 {
+		t.Fatalf("expected a single sample of value 20 recorded by the second rule, got %v", vector)
+	}
+}
+
+func TestGroupDependencies(t *testing.T) {
+	groupRules, err := rules.LoadRulesFromString(`
+		job:http_requests:sum = sum(http_requests) by (job)
+		job:http_errors:sum = sum(http_errors) by (job)
+		job:http_errors:ratio = job:http_errors:sum / job:http_requests:sum
+		ALERT HighErrorRatio IF job:http_errors:ratio > 0.1 WITH {}
+		  SUMMARY "High error ratio" DESCRIPTION "High error ratio"
+		job:alerts:count = count(ALERTS) by (job)
+		instance:up:count = count({job="api"}) by (instance)
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := newGroup("test", time.Minute, groupRules)
+
+	expectedDependencies := [][]int{nil, nil, {0, 1}, {2}, {3}, {0, 1, 2, 3, 4}}
+	if !reflect.DeepEqual(g.dependencies, expectedDependencies) {
+		t.Errorf("expected dependencies %v, got %v", expectedDependencies, g.dependencies)
+	}
+	expectedHasDependents := []bool{true, true, true, true, true, false}
+	if !reflect.DeepEqual(g.hasDependents, expectedHasDependents) {
+		t.Errorf("expected dependents %v, got %v", expectedHasDependents, g.hasDependents)
+	}
+}
+
+func TestRuleManagerApplyConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rule_manager_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ruleFile := filepath.Join(dir, "test.rules")
+	writeRules := func(s string) {
+		if err := ioutil.WriteFile(ruleFile, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conf, err := config.LoadFromString(`global < evaluation_interval: "1h" rule_file: "` + ruleFile + `" >`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const (
+		unchangedAlert = `ALERT Unchanged IF up == 0 WITH {} SUMMARY "Unchanged" DESCRIPTION "Unchanged"` + "\n"
+		changedAlert   = `ALERT Changed IF up == 0 WITH {} SUMMARY "Changed" DESCRIPTION "Changed"` + "\n"
+	)
+
+	m := NewRuleManager(&RuleManagerOptions{})
+	go m.Run()
+	defer m.Stop()
+
+	writeRules(unchangedAlert + changedAlert)
+	if err := m.ApplyConfig(conf); err != nil {
+		t.Fatal(err)
+	}
+	oldRules := m.AlertingRules()
+	if len(oldRules) != 2 {
+		t.Fatalf("expected 2 alerting rules, got %d", len(oldRules))
+	}
+
+	writeRules("invalid rule")
+	if err := m.ApplyConfig(conf); err == nil {
+		t.Fatal("expected error applying invalid rule file, got none")
+	}
+	if !reflect.DeepEqual(m.AlertingRules(), oldRules) {
+		t.Fatalf("expected rules to be unchanged after failed reload")
+	}
+
+	writeRules(unchangedAlert + `ALERT Changed IF up == 1 WITH {} SUMMARY "Changed" DESCRIPTION "Changed"` + "\n")
+	if err := m.ApplyConfig(conf); err != nil {
+		t.Fatal(err)
+	}
+	newRules := m.AlertingRules()
+	if len(newRules) != 2 {
+		t.Fatalf("expected 2 alerting rules, got %d", len(newRules))
+	}
+	if newRules[0] != oldRules[0] {
+		t.Errorf("expected unchanged alerting rule to be kept")
+	}
+	if newRules[1] == oldRules[1] {
+		t.Errorf("expected changed alerting rule to be replaced")
+	}
+}
@@ -33,6 +33,7 @@
         labelMatcher *metric.LabelMatcher
         labelMatchers metric.LabelMatchers
         vectorMatching *vectorMatching
+        selectorMods *selectorModifiers
 }
 
 /* We simulate multiple start symbols for closely-related grammars via dummy tokens. See
@@ -43,16 +44,17 @@
 
 %token <str> IDENTIFIER STRING DURATION METRICNAME
 %token <num> NUMBER
-%token PERMANENT GROUP_OP KEEPING_EXTRA OFFSET MATCH_OP
+%token PERMANENT GROUP_OP KEEPING_EXTRA OFFSET MATCH_OP IGNORING
 %token <str> AGGR_OP CMP_OP ADDITIVE_OP MULT_OP MATCH_MOD
-%token ALERT IF FOR WITH SUMMARY DESCRIPTION
+%token ALERT IF FOR WITH SUMMARY DESCRIPTION ANNOTATIONS
 
 %type <ruleNodeSlice> func_arg_list
 %type <labelNameSlice> label_list grouping_opts
-%type <labelSet> label_assign label_assign_list rule_labels
+%type <labelSet> label_assign label_assign_list rule_labels annotations_opts
 %type <labelMatcher> label_match
 %type <labelMatchers> label_match_list label_matches
 %type <vectorMatching> vector_matching
+%type <selectorMods> selector_mods
 %type <ruleNode> rule_expr func_arg
 %type <boolean> qualifier extra_labels_opts
 %type <str> for_duration metric_name label_match_type offset_opts
@@ -83,9 +85,9 @@ rules_stat         : qualifier metric_name rule_labels '=' rule_expr
                        if err != nil { yylex.Error(err.Error()); return 1 }
                        yylex.(*RulesLexer).parsedRules = append(yylex.(*RulesLexer).parsedRules, rule)
                      }
-                   | ALERT IDENTIFIER IF rule_expr for_duration WITH rule_labels SUMMARY STRING DESCRIPTION STRING
+                   | ALERT IDENTIFIER IF rule_expr for_duration WITH rule_labels SUMMARY STRING DESCRIPTION STRING annotations_opts
                      {
-                       rule, err := CreateAlertingRule($2, $4, $5, $7, $9, $11)
+                       rule, err := CreateAlertingRule($2, $4, $5, $7, $9, $11, $12)
                        if err != nil { yylex.Error(err.Error()); return 1 }
                        yylex.(*RulesLexer).parsedRules = append(yylex.(*RulesLexer).parsedRules, rule)
                      }
@@ -97,6 +99,12 @@ for_duration       : /* empty */
                      { $$ = $2 }
                    ;
 
+annotations_opts   : /* empty */
+                     { $$ = clientmodel.LabelSet{} }
+                   | ANNOTATIONS '{' label_assign_list '}'
+                     { $$ = $3 }
+                   ;
+
 qualifier          : /* empty */
                      { $$ = false }
                    | PERMANENT
@@ -160,15 +168,29 @@ offset_opts        : /* empty */
                      { $$ = $2 }
                    ;
 
+selector_mods      : offset_opts
+                     { $$ = newSelectorModifiers($1, nil) }
+                   | OFFSET DURATION '@' NUMBER
+                     { $$ = newSelectorModifiers($2, &$4) }
+                   | '@' NUMBER offset_opts
+                     { $$ = newSelectorModifiers($3, &$2) }
+                   ;
+
 rule_expr          : '(' rule_expr ')'
                      { $$ = $2 }
-                   | '{' label_match_list '}' offset_opts
+                   | '(' rule_expr ')' OFFSET DURATION
+                     {
+                       var err error
+                       $$, err = NewOffsetExpr($2, $5)
+                       if err != nil { yylex.Error(err.Error()); return 1 }
+                     }
+                   | '{' label_match_list '}' selector_mods
                      {
                        var err error
                        $$, err = NewVectorSelector($2, $4)
                        if err != nil { yylex.Error(err.Error()); return 1 }
                      }
-                   | metric_name label_matches offset_opts
+                   | metric_name label_matches selector_mods
                      {
                        var err error
                        m, err := metric.NewLabelMatcher(metric.Equal, clientmodel.MetricNameLabel, clientmodel.LabelValue($1))
@@ -183,18 +205,36 @@ rule_expr          : '(' rule_expr ')'
                        $$, err = NewFunctionCall($1, $3)
                        if err != nil { yylex.Error(err.Error()); return 1 }
                      }
+                   | IDENTIFIER '(' func_arg_list ')' GROUP_OP '(' label_list ')'
+                     {
+                       var err error
+                       $$, err = NewParameterizedAggregation($1, $3, $7)
+                       if err != nil { yylex.Error(err.Error()); return 1 }
+                     }
+                   | IDENTIFIER GROUP_OP '(' label_list ')' '(' func_arg_list ')'
+                     {
+                       var err error
+                       $$, err = NewParameterizedAggregation($1, $7, $4)
+                       if err != nil { yylex.Error(err.Error()); return 1 }
+                     }
                    | IDENTIFIER '(' ')'
                      {
                        var err error
                        $$, err = NewFunctionCall($1, []ast.Node{})
                        if err != nil { yylex.Error(err.Error()); return 1 }
                      }
-                   | rule_expr '[' DURATION ']' offset_opts
+                   | rule_expr '[' DURATION ']' selector_mods
                      {
                        var err error
                        $$, err = NewMatrixSelector($1, $3, $5)
                        if err != nil { yylex.Error(err.Error()); return 1 }
                      }
+                   | rule_expr '[' DURATION METRICNAME ']' offset_opts
+                     {
+                       var err error
+                       $$, err = NewSubquery($1, $3, $4, $6)
+                       if err != nil { yylex.Error(err.Error()); return 1 }
+                     }
                    | AGGR_OP '(' rule_expr ')' grouping_opts extra_labels_opts
                      {
                        var err error
@@ -244,13 +284,25 @@ vector_matching    : /* empty */
                    | MATCH_OP '(' label_list ')'
                      {
                        var err error
-                       $$, err = newVectorMatching("", $3, nil)
+                       $$, err = newVectorMatching("", $3, false, nil)
                        if err != nil { yylex.Error(err.Error()); return 1 }
                      }
                    | MATCH_OP '(' label_list ')' MATCH_MOD '(' label_list ')'
                      {
                        var err error
-                       $$, err = newVectorMatching($5, $3, $7)
+                       $$, err = newVectorMatching($5, $3, false, $7)
+                       if err != nil { yylex.Error(err.Error()); return 1 }
+                     }
+                   | IGNORING '(' label_list ')'
+                     {
+                       var err error
+                       $$, err = newVectorMatching("", $3, true, nil)
+                       if err != nil { yylex.Error(err.Error()); return 1 }
+                     }
+                   | IGNORING '(' label_list ')' MATCH_MOD '(' label_list ')'
+                     {
+                       var err error
+                       $$, err = newVectorMatching($5, $3, true, $7)
                        if err != nil { yylex.Error(err.Error()); return 1 }
                      }
                    ;
@@ -1,9 +1,12 @@
+// Code generated by goyacc -o parser.y.go -v  parser.y. DO NOT EDIT.
+
 //line parser.y:15
 package rules
 
 import __yyfmt__ "fmt"
 
 //line parser.y:15
+
 import (
 	clientmodel "github.com/prometheus/client_golang/model"
 
@@ -24,6 +27,7 @@ type yySymType struct {
 	labelMatcher   *metric.LabelMatcher
 	labelMatchers  metric.LabelMatchers
 	vectorMatching *vectorMatching
+	selectorMods   *selectorModifiers
 }
 
 const START_RULES = 57346
@@ -38,19 +42,24 @@ const GROUP_OP = 57354
 const KEEPING_EXTRA = 57355
 const OFFSET = 57356
 const MATCH_OP = 57357
-const AGGR_OP = 57358
-const CMP_OP = 57359
-const ADDITIVE_OP = 57360
-const MULT_OP = 57361
-const MATCH_MOD = 57362
-const ALERT = 57363
-const IF = 57364
-const FOR = 57365
-const WITH = 57366
-const SUMMARY = 57367
-const DESCRIPTION = 57368
-
-var yyToknames = []string{
+const IGNORING = 57358
+const AGGR_OP = 57359
+const CMP_OP = 57360
+const ADDITIVE_OP = 57361
+const MULT_OP = 57362
+const MATCH_MOD = 57363
+const ALERT = 57364
+const IF = 57365
+const FOR = 57366
+const WITH = 57367
+const SUMMARY = 57368
+const DESCRIPTION = 57369
+const ANNOTATIONS = 57370
+
+var yyToknames = [...]string{
+	"$end",
+	"error",
+	"$unk",
 	"START_RULES",
 	"START_EXPRESSION",
 	"IDENTIFIER",
@@ -63,6 +72,7 @@ var yyToknames = []string{
 	"KEEPING_EXTRA",
 	"OFFSET",
 	"MATCH_OP",
+	"IGNORING",
 	"AGGR_OP",
 	"CMP_OP",
 	"ADDITIVE_OP",
@@ -74,166 +84,218 @@ var yyToknames = []string{
 	"WITH",
 	"SUMMARY",
 	"DESCRIPTION",
+	"ANNOTATIONS",
 	"'='",
+	"'{'",
+	"'}'",
+	"','",
+	"'@'",
+	"'('",
+	"')'",
+	"'['",
+	"']'",
 }
-var yyStatenames = []string{}
+
+var yyStatenames = [...]string{}
 
 const yyEofCode = 1
 const yyErrCode = 2
-const yyMaxDepth = 200
+const yyInitialStackSize = 16
 
-//line parser.y:281
+//line parser.y:333
 
 //line yacctab:1
-var yyExca = []int{
+var yyExca = [...]int8{
 	-1, 1,
 	1, -1,
 	-2, 0,
 	-1, 4,
 	1, 1,
-	-2, 10,
+	-2, 12,
 }
 
-const yyNprod = 56
 const yyPrivate = 57344
 
-var yyTokenNames []string
-var yyStates []string
-
-const yyLast = 159
-
-var yyAct = []int{
-
-	78, 61, 83, 58, 55, 54, 31, 48, 6, 25,
-	20, 21, 23, 21, 10, 56, 64, 14, 12, 10,
-	56, 19, 14, 12, 11, 19, 13, 19, 92, 11,
-	113, 13, 22, 20, 21, 57, 8, 32, 109, 7,
-	53, 8, 77, 65, 7, 67, 68, 101, 19, 22,
-	20, 21, 70, 69, 10, 98, 30, 14, 12, 22,
-	20, 21, 94, 95, 11, 19, 13, 87, 85, 92,
-	96, 99, 86, 84, 76, 19, 8, 66, 60, 7,
-	29, 88, 90, 89, 24, 93, 22, 20, 21, 22,
-	20, 21, 92, 100, 91, 75, 82, 74, 103, 73,
-	43, 42, 19, 44, 43, 19, 26, 108, 62, 47,
-	111, 28, 80, 51, 114, 110, 38, 105, 63, 46,
-	18, 107, 39, 9, 49, 59, 32, 33, 35, 50,
-	17, 14, 106, 72, 37, 115, 112, 104, 40, 41,
-	34, 71, 79, 84, 102, 26, 36, 2, 3, 15,
-	5, 4, 1, 45, 97, 16, 27, 81, 52,
+const yyLast = 202
+
+var yyAct = [...]uint8{
+	91, 85, 66, 56, 93, 63, 51, 59, 58, 32,
+	50, 6, 25, 10, 60, 23, 14, 12, 97, 19,
+	22, 20, 21, 137, 11, 136, 13, 70, 22, 20,
+	21, 123, 10, 60, 116, 14, 12, 8, 19, 62,
+	122, 7, 57, 11, 101, 13, 19, 71, 20, 21,
+	74, 75, 22, 20, 21, 69, 8, 78, 77, 107,
+	7, 21, 145, 107, 33, 19, 144, 89, 84, 126,
+	19, 139, 88, 73, 98, 99, 95, 19, 10, 72,
+	96, 14, 12, 22, 20, 21, 31, 107, 102, 11,
+	138, 13, 107, 105, 150, 119, 109, 108, 111, 114,
+	87, 19, 8, 65, 117, 61, 7, 30, 22, 20,
+	21, 52, 107, 107, 125, 118, 110, 107, 127, 84,
+	106, 94, 83, 26, 133, 44, 19, 134, 67, 29,
+	53, 28, 135, 152, 113, 112, 113, 90, 141, 142,
+	82, 45, 46, 45, 49, 24, 92, 149, 54, 146,
+	140, 151, 129, 39, 68, 48, 18, 132, 131, 40,
+	41, 9, 103, 76, 64, 33, 104, 17, 120, 81,
+	36, 34, 147, 14, 55, 42, 43, 130, 35, 121,
+	100, 80, 38, 143, 128, 79, 94, 86, 124, 26,
+	37, 2, 3, 15, 5, 4, 1, 47, 115, 16,
+	27, 148,
 }
-var yyPact = []int{
-
-	143, -1000, -1000, 48, 109, -1000, 72, 48, 139, 83,
-	49, 25, -1000, 117, -1000, -1000, 122, 140, -1000, 126,
-	107, 107, 107, 69, 74, -1000, 92, 110, 100, 8,
-	48, 112, 47, -1000, 80, -1000, 96, -18, 48, 46,
-	48, 48, -1000, 139, 110, 134, -1000, -1000, -1000, 125,
-	-1000, 70, 65, -1000, -1000, 72, -1000, 42, 11, -1000,
-	136, 85, 67, 48, 110, -6, 136, -12, -8, -1000,
-	-1000, -1000, -1000, -1000, -1000, 13, 114, 48, 62, -1000,
-	48, 33, -1000, -1000, 43, 32, -1000, 39, -1000, 112,
-	15, -1000, 138, 72, -1000, 137, 130, 93, 124, 101,
-	-1000, -1000, -1000, -1000, -1000, 80, -1000, 7, 90, 136,
-	129, -2, 88, -1000, 128, -1000,
+
+var yyPact = [...]int16{
+	187, -1000, -1000, 72, 145, -1000, 2, 72, 183, 101,
+	95, 52, -1000, 161, -1000, -1000, 164, 184, -1000, 174,
+	144, 144, 144, 90, 111, -1000, 126, 97, 117, 7,
+	71, 72, 151, 69, -1000, 98, -1000, 131, 18, 72,
+	45, 39, 72, 72, 149, 183, 97, 178, -1000, -1000,
+	-1000, -1000, 173, 159, -1000, 109, 87, -1000, -1000, 2,
+	-1000, 181, 65, 38, -1000, 181, 108, 115, 72, 97,
+	-19, 41, 181, 181, -17, 29, 172, -1000, -1000, -1000,
+	11, 148, -1000, 154, 26, 85, -1000, 153, 72, 81,
+	72, 104, -1000, -1000, 70, 10, -1000, 148, 80, 60,
+	-1000, 158, -1000, 171, 6, -1000, -3, 182, 151, 34,
+	-1000, 2, -1000, 180, 177, 127, 169, -1000, 137, 136,
+	-1000, -1000, 181, 26, -1000, -1000, -1000, -1000, -1000, 98,
+	-1000, -9, -11, 55, 36, 124, 181, 181, -1000, -1000,
+	176, 31, 27, 122, -1000, -1000, 165, 119, -1000, 64,
+	180, 102, -1000,
 }
-var yyPgo = []int{
 
-	0, 158, 0, 6, 2, 157, 1, 9, 84, 156,
-	116, 4, 5, 155, 3, 154, 123, 153, 7, 152,
-	151, 150, 149,
+var yyPgo = [...]uint8{
+	0, 3, 1, 9, 4, 0, 2, 201, 12, 145,
+	200, 153, 10, 7, 8, 199, 5, 198, 161, 197,
+	6, 196, 195, 194, 193,
 }
-var yyR1 = []int{
-
-	0, 19, 19, 20, 20, 21, 22, 22, 15, 15,
-	13, 13, 16, 16, 6, 6, 6, 5, 5, 4,
-	9, 9, 9, 8, 8, 7, 17, 17, 18, 18,
-	11, 11, 11, 11, 11, 11, 11, 11, 11, 11,
-	11, 11, 11, 14, 14, 10, 10, 10, 3, 3,
-	2, 2, 1, 1, 12, 12,
+
+var yyR1 = [...]int8{
+	0, 21, 21, 22, 22, 23, 24, 24, 17, 17,
+	7, 7, 15, 15, 18, 18, 6, 6, 6, 5,
+	5, 4, 10, 10, 10, 9, 9, 8, 19, 19,
+	20, 20, 12, 12, 12, 13, 13, 13, 13, 13,
+	13, 13, 13, 13, 13, 13, 13, 13, 13, 13,
+	13, 13, 16, 16, 11, 11, 11, 11, 11, 3,
+	3, 2, 2, 1, 1, 14, 14,
 }
-var yyR2 = []int{
-
-	0, 2, 2, 0, 2, 1, 5, 11, 0, 2,
-	0, 1, 1, 1, 0, 3, 2, 1, 3, 3,
-	0, 2, 3, 1, 3, 3, 1, 1, 0, 2,
-	3, 4, 3, 4, 3, 5, 6, 6, 4, 4,
-	4, 1, 2, 0, 1, 0, 4, 8, 0, 4,
-	1, 3, 1, 3, 1, 1,
+
+var yyR2 = [...]int8{
+	0, 2, 2, 0, 2, 1, 5, 12, 0, 2,
+	0, 4, 0, 1, 1, 1, 0, 3, 2, 1,
+	3, 3, 0, 2, 3, 1, 3, 3, 1, 1,
+	0, 2, 1, 4, 3, 3, 5, 4, 3, 4,
+	8, 8, 3, 5, 6, 6, 6, 4, 4, 4,
+	1, 2, 0, 1, 0, 4, 8, 4, 8, 0,
+	4, 1, 3, 1, 3, 1, 1,
 }
-var yyChk = []int{
-
-	-1000, -19, 4, 5, -20, -21, -11, 31, 28, -16,
-	6, 16, 10, 18, 9, -22, -13, 21, 11, 33,
-	18, 19, 17, -11, -8, -7, 6, -9, 28, 31,
-	31, -3, 12, 10, -16, 6, 6, 8, -10, 15,
-	-10, -10, 32, 30, 29, -17, 27, 17, -18, 14,
-	29, -8, -1, 32, -12, -11, 7, -11, -14, 13,
-	31, -6, 28, 22, 34, -11, 31, -11, -11, -7,
-	-18, 7, 8, 29, 32, 30, 32, 31, -2, 6,
-	27, -5, 29, -4, 6, -11, -18, -2, -12, -3,
-	-11, 32, 30, -11, 29, 30, 27, -15, 23, 32,
-	-14, 32, 6, -4, 7, 24, 8, 20, -6, 31,
-	25, -2, 7, 32, 26, 7,
+
+var yyChk = [...]int16{
+	-1000, -21, 4, 5, -22, -23, -13, 34, 30, -18,
+	6, 17, 10, 19, 9, -24, -15, 22, 11, 36,
+	19, 20, 18, -13, -9, -8, 6, -10, 30, 34,
+	12, 34, -3, 12, 10, -18, 6, 6, 8, -11,
+	15, 16, -11, -11, 35, 32, 31, -19, 29, 18,
+	-12, -20, 14, 33, 31, -9, -1, 35, -14, -13,
+	7, 34, -13, -16, 13, 34, -6, 30, 23, 37,
+	9, -13, 34, 34, -13, -13, 14, -8, -12, 7,
+	8, 10, 31, 35, 32, -2, 6, 35, 34, -2,
+	29, -5, 31, -4, 6, -13, -12, 37, -2, -2,
+	8, 33, -20, 14, 12, -14, 35, 32, -3, -13,
+	35, -13, 31, 32, 29, -17, 24, -20, 35, 35,
+	10, 8, 34, 34, 6, -16, 35, -4, 7, 25,
+	8, 21, 21, -2, -1, -6, 34, 34, 35, 35,
+	26, -2, -2, 7, 35, 35, 27, 7, -7, 28,
+	30, -5, 31,
 }
-var yyDef = []int{
-
-	0, -2, 3, 0, -2, 2, 5, 0, 0, 20,
-	13, 48, 41, 0, 12, 4, 0, 0, 11, 0,
-	45, 45, 45, 0, 0, 23, 0, 28, 0, 0,
-	0, 43, 0, 42, 14, 13, 0, 0, 0, 0,
-	0, 0, 30, 0, 28, 0, 26, 27, 32, 0,
-	21, 0, 0, 34, 52, 54, 55, 0, 0, 44,
-	0, 0, 0, 0, 28, 38, 0, 39, 40, 24,
-	31, 25, 29, 22, 33, 0, 48, 0, 0, 50,
-	0, 0, 16, 17, 0, 8, 35, 0, 53, 43,
-	0, 49, 0, 6, 15, 0, 0, 0, 0, 46,
-	36, 37, 51, 18, 19, 14, 9, 0, 0, 0,
-	0, 0, 0, 47, 0, 7,
+
+var yyDef = [...]int8{
+	0, -2, 3, 0, -2, 2, 5, 0, 0, 22,
+	15, 59, 50, 0, 14, 4, 0, 0, 13, 0,
+	54, 54, 54, 0, 0, 25, 0, 30, 0, 0,
+	0, 0, 52, 0, 51, 16, 15, 0, 0, 0,
+	0, 0, 0, 0, 35, 0, 30, 0, 28, 29,
+	38, 32, 0, 0, 23, 0, 0, 42, 63, 65,
+	66, 0, 0, 0, 53, 0, 0, 0, 0, 30,
+	0, 47, 0, 0, 48, 49, 0, 26, 37, 27,
+	31, 30, 24, 39, 0, 0, 61, 59, 0, 0,
+	0, 0, 18, 19, 0, 8, 43, 30, 0, 0,
+	36, 0, 34, 0, 0, 64, 0, 0, 52, 0,
+	60, 6, 17, 0, 0, 0, 0, 44, 55, 57,
+	33, 31, 0, 0, 62, 45, 46, 20, 21, 16,
+	9, 0, 0, 0, 0, 0, 0, 0, 40, 41,
+	0, 0, 0, 0, 56, 58, 0, 10, 7, 0,
+	0, 0, 11,
 }
-var yyTok1 = []int{
 
+var yyTok1 = [...]int8{
 	1, 3, 3, 3, 3, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
-	31, 32, 3, 3, 30, 3, 3, 3, 3, 3,
+	34, 35, 3, 3, 32, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
-	3, 27, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 29, 3, 3, 33, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
-	3, 33, 3, 34, 3, 3, 3, 3, 3, 3,
+	3, 36, 3, 37, 3, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
 	3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
-	3, 3, 3, 28, 3, 29,
+	3, 3, 3, 30, 3, 31,
 }
-var yyTok2 = []int{
 
+var yyTok2 = [...]int8{
 	2, 3, 4, 5, 6, 7, 8, 9, 10, 11,
 	12, 13, 14, 15, 16, 17, 18, 19, 20, 21,
-	22, 23, 24, 25, 26,
+	22, 23, 24, 25, 26, 27, 28,
 }
-var yyTok3 = []int{
+
+var yyTok3 = [...]int8{
 	0,
 }
 
+var yyErrorMessages = [...]struct {
+	state int
+	token int
+	msg   string
+}{}
+
 //line yaccpar:1
 
 /*	parser for yacc output	*/
 
-var yyDebug = 0
+var (
+	yyDebug        = 0
+	yyErrorVerbose = false
+)
 
 type yyLexer interface {
 	Lex(lval *yySymType) int
 	Error(s string)
 }
 
+type yyParser interface {
+	Parse(yyLexer) int
+	Lookahead() int
+}
+
+type yyParserImpl struct {
+	lval  yySymType
+	stack [yyInitialStackSize]yySymType
+	char  int
+}
+
+func (p *yyParserImpl) Lookahead() int {
+	return p.char
+}
+
+func yyNewParser() yyParser {
+	return &yyParserImpl{}
+}
+
 const yyFlag = -1000
 
 func yyTokname(c int) string {
-	// 4 is TOKSTART above
-	if c >= 4 && c-4 < len(yyToknames) {
-		if yyToknames[c-4] != "" {
-			return yyToknames[c-4]
+	if c >= 1 && c-1 < len(yyToknames) {
+		if yyToknames[c-1] != "" {
+			return yyToknames[c-1]
 		}
 	}
 	return __yyfmt__.Sprintf("tok-%v", c)
@@ -248,51 +310,127 @@ func yyStatname(s int) string {
 	return __yyfmt__.Sprintf("state-%v", s)
 }
 
-func yylex1(lex yyLexer, lval *yySymType) int {
-	c := 0
-	char := lex.Lex(lval)
+func yyErrorMessage(state, lookAhead int) string {
+	const TOKSTART = 4
+
+	if !yyErrorVerbose {
+		return "syntax error"
+	}
+
+	for _, e := range yyErrorMessages {
+		if e.state == state && e.token == lookAhead {
+			return "syntax error: " + e.msg
+		}
+	}
+
+	res := "syntax error: unexpected " + yyTokname(lookAhead)
+
+	// To match Bison, suggest at most four expected tokens.
+	expected := make([]int, 0, 4)
+
+	// Look for shiftable tokens.
+	base := int(yyPact[state])
+	for tok := TOKSTART; tok-1 < len(yyToknames); tok++ {
+		if n := base + tok; n >= 0 && n < yyLast && int(yyChk[int(yyAct[n])]) == tok {
+			if len(expected) == cap(expected) {
+				return res
+			}
+			expected = append(expected, tok)
+		}
+	}
+
+	if yyDef[state] == -2 {
+		i := 0
+		for yyExca[i] != -1 || int(yyExca[i+1]) != state {
+			i += 2
+		}
+
+		// Look for tokens that we accept or reduce.
+		for i += 2; yyExca[i] >= 0; i += 2 {
+			tok := int(yyExca[i])
+			if tok < TOKSTART || yyExca[i+1] == 0 {
+				continue
+			}
+			if len(expected) == cap(expected) {
+				return res
+			}
+			expected = append(expected, tok)
+		}
+
+		// If the default action is to accept or reduce, give up.
+		if yyExca[i+1] != 0 {
+			return res
+		}
+	}
+
+	for i, tok := range expected {
+		if i == 0 {
+			res += ", expecting "
+		} else {
+			res += " or "
+		}
+		res += yyTokname(tok)
+	}
+	return res
+}
+
+func yylex1(lex yyLexer, lval *yySymType) (char, token int) {
+	token = 0
+	char = lex.Lex(lval)
 	if char <= 0 {
-		c = yyTok1[0]
+		token = int(yyTok1[0])
 		goto out
 	}
 	if char < len(yyTok1) {
-		c = yyTok1[char]
+		token = int(yyTok1[char])
 		goto out
 	}
 	if char >= yyPrivate {
 		if char < yyPrivate+len(yyTok2) {
-			c = yyTok2[char-yyPrivate]
+			token = int(yyTok2[char-yyPrivate])
 			goto out
 		}
 	}
 	for i := 0; i < len(yyTok3); i += 2 {
-		c = yyTok3[i+0]
-		if c == char {
-			c = yyTok3[i+1]
+		token = int(yyTok3[i+0])
+		if token == char {
+			token = int(yyTok3[i+1])
 			goto out
 		}
 	}
 
 out:
-	if c == 0 {
-		c = yyTok2[1] /* unknown char */
+	if token == 0 {
+		token = int(yyTok2[1]) /* unknown char */
 	}
 	if yyDebug >= 3 {
-		__yyfmt__.Printf("lex %s(%d)\n", yyTokname(c), uint(char))
+		__yyfmt__.Printf("lex %s(%d)\n", yyTokname(token), uint(char))
 	}
-	return c
+	return char, token
 }
 
 func yyParse(yylex yyLexer) int {
+	return yyNewParser().Parse(yylex)
+}
+
+func (yyrcvr *yyParserImpl) Parse(yylex yyLexer) int {
 	var yyn int
-	var yylval yySymType
 	var yyVAL yySymType
-	yyS := make([]yySymType, yyMaxDepth)
+	var yyDollar []yySymType
+	_ = yyDollar // silence set and not used
+	yyS := yyrcvr.stack[:]
 
 	Nerrs := 0   /* number of errors */
 	Errflag := 0 /* error recovery flag */
 	yystate := 0
-	yychar := -1
+	yyrcvr.char = -1
+	yytoken := -1 // yyrcvr.char translated into internal numbering
+	defer func() {
+		// Make sure we report no lookahead when not parsing.
+		yystate = -1
+		yyrcvr.char = -1
+		yytoken = -1
+	}()
 	yyp := -1
 	goto yystack
 
@@ -305,7 +443,7 @@ ret1:
 yystack:
 	/* put a state and value onto the stack */
 	if yyDebug >= 4 {
-		__yyfmt__.Printf("char %v in %v\n", yyTokname(yychar), yyStatname(yystate))
+		__yyfmt__.Printf("char %v in %v\n", yyTokname(yytoken), yyStatname(yystate))
 	}
 
 	yyp++
@@ -318,21 +456,22 @@ yystack:
 	yyS[yyp].yys = yystate
 
 yynewstate:
-	yyn = yyPact[yystate]
+	yyn = int(yyPact[yystate])
 	if yyn <= yyFlag {
 		goto yydefault /* simple state */
 	}
-	if yychar < 0 {
-		yychar = yylex1(yylex, &yylval)
+	if yyrcvr.char < 0 {
+		yyrcvr.char, yytoken = yylex1(yylex, &yyrcvr.lval)
 	}
-	yyn += yychar
+	yyn += yytoken
 	if yyn < 0 || yyn >= yyLast {
 		goto yydefault
 	}
-	yyn = yyAct[yyn]
-	if yyChk[yyn] == yychar { /* valid shift */
-		yychar = -1
-		yyVAL = yylval
+	yyn = int(yyAct[yyn])
+	if int(yyChk[yyn]) == yytoken { /* valid shift */
+		yyrcvr.char = -1
+		yytoken = -1
+		yyVAL = yyrcvr.lval
 		yystate = yyn
 		if Errflag > 0 {
 			Errflag--
@@ -342,27 +481,27 @@ yynewstate:
 
 yydefault:
 	/* default state action */
-	yyn = yyDef[yystate]
+	yyn = int(yyDef[yystate])
 	if yyn == -2 {
-		if yychar < 0 {
-			yychar = yylex1(yylex, &yylval)
+		if yyrcvr.char < 0 {
+			yyrcvr.char, yytoken = yylex1(yylex, &yyrcvr.lval)
 		}
 
 		/* look through exception table */
 		xi := 0
 		for {
-			if yyExca[xi+0] == -1 && yyExca[xi+1] == yystate {
+			if yyExca[xi+0] == -1 && int(yyExca[xi+1]) == yystate {
 				break
 			}
 			xi += 2
 		}
 		for xi += 2; ; xi += 2 {
-			yyn = yyExca[xi+0]
-			if yyn < 0 || yyn == yychar {
+			yyn = int(yyExca[xi+0])
+			if yyn < 0 || yyn == yytoken {
 				break
 			}
 		}
-		yyn = yyExca[xi+1]
+		yyn = int(yyExca[xi+1])
 		if yyn < 0 {
 			goto ret0
 		}
@@ -371,11 +510,11 @@ yydefault:
 		/* error ... attempt to resume parsing */
 		switch Errflag {
 		case 0: /* brand new error */
-			yylex.Error("syntax error")
+			yylex.Error(yyErrorMessage(yystate, yytoken))
 			Nerrs++
 			if yyDebug >= 1 {
 				__yyfmt__.Printf("%s", yyStatname(yystate))
-				__yyfmt__.Printf(" saw %s\n", yyTokname(yychar))
+				__yyfmt__.Printf(" saw %s\n", yyTokname(yytoken))
 			}
 			fallthrough
 
@@ -384,10 +523,10 @@ yydefault:
 
 			/* find a state where "error" is a legal shift action */
 			for yyp >= 0 {
-				yyn = yyPact[yyS[yyp].yys] + yyErrCode
+				yyn = int(yyPact[yyS[yyp].yys]) + yyErrCode
 				if yyn >= 0 && yyn < yyLast {
-					yystate = yyAct[yyn] /* simulate a shift of "error" */
-					if yyChk[yystate] == yyErrCode {
+					yystate = int(yyAct[yyn]) /* simulate a shift of "error" */
+					if int(yyChk[yystate]) == yyErrCode {
 						goto yystack
 					}
 				}
@@ -403,12 +542,13 @@ yydefault:
 
 		case 3: /* no shift yet; clobber input char */
 			if yyDebug >= 2 {
-				__yyfmt__.Printf("error recovery discards %s\n", yyTokname(yychar))
+				__yyfmt__.Printf("error recovery discards %s\n", yyTokname(yytoken))
 			}
-			if yychar == yyEofCode {
+			if yytoken == yyEofCode {
 				goto ret1
 			}
-			yychar = -1
+			yyrcvr.char = -1
+			yytoken = -1
 			goto yynewstate /* try again in the same state */
 		}
 	}
@@ -422,34 +562,43 @@ yydefault:
 	yypt := yyp
 	_ = yypt // guard against "declared and not used"
 
-	yyp -= yyR2[yyn]
+	yyp -= int(yyR2[yyn])
+	// yyp is now the index of $0. Perform the default action. Iff the
+	// reduced production is ε, $1 is possibly out of range.
+	if yyp+1 >= len(yyS) {
+		nyys := make([]yySymType, len(yyS)*2)
+		copy(nyys, yyS)
+		yyS = nyys
+	}
 	yyVAL = yyS[yyp+1]
 
 	/* consult goto table to find next state */
-	yyn = yyR1[yyn]
-	yyg := yyPgo[yyn]
+	yyn = int(yyR1[yyn])
+	yyg := int(yyPgo[yyn])
 	yyj := yyg + yyS[yyp].yys + 1
 
 	if yyj >= yyLast {
-		yystate = yyAct[yyg]
+		yystate = int(yyAct[yyg])
 	} else {
-		yystate = yyAct[yyj]
-		if yyChk[yystate] != -yyn {
-			yystate = yyAct[yyg]
+		yystate = int(yyAct[yyj])
+		if int(yyChk[yystate]) != -yyn {
+			yystate = int(yyAct[yyg])
 		}
 	}
 	// dummy call; replaced with literal code
 	switch yynt {
 
 	case 5:
-		//line parser.y:76
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.y:78
 		{
-			yylex.(*RulesLexer).parsedExpr = yyS[yypt-0].ruleNode
+			yylex.(*RulesLexer).parsedExpr = yyDollar[1].ruleNode
 		}
 	case 6:
-		//line parser.y:81
+		yyDollar = yyS[yypt-5 : yypt+1]
+//line parser.y:83
 		{
-			rule, err := CreateRecordingRule(yyS[yypt-3].str, yyS[yypt-2].labelSet, yyS[yypt-0].ruleNode, yyS[yypt-4].boolean)
+			rule, err := CreateRecordingRule(yyDollar[2].str, yyDollar[3].labelSet, yyDollar[5].ruleNode, yyDollar[1].boolean)
 			if err != nil {
 				yylex.Error(err.Error())
 				return 1
@@ -457,9 +606,10 @@ yydefault:
 			yylex.(*RulesLexer).parsedRules = append(yylex.(*RulesLexer).parsedRules, rule)
 		}
 	case 7:
-		//line parser.y:87
+		yyDollar = yyS[yypt-12 : yypt+1]
+//line parser.y:89
 		{
-			rule, err := CreateAlertingRule(yyS[yypt-9].str, yyS[yypt-7].ruleNode, yyS[yypt-6].str, yyS[yypt-4].labelSet, yyS[yypt-2].str, yyS[yypt-0].str)
+			rule, err := CreateAlertingRule(yyDollar[2].str, yyDollar[4].ruleNode, yyDollar[5].str, yyDollar[7].labelSet, yyDollar[9].str, yyDollar[11].str, yyDollar[12].labelSet)
 			if err != nil {
 				yylex.Error(err.Error())
 				return 1
@@ -467,317 +617,461 @@ yydefault:
 			yylex.(*RulesLexer).parsedRules = append(yylex.(*RulesLexer).parsedRules, rule)
 		}
 	case 8:
-		//line parser.y:95
+		yyDollar = yyS[yypt-0 : yypt+1]
+//line parser.y:97
 		{
 			yyVAL.str = "0s"
 		}
 	case 9:
-		//line parser.y:97
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line parser.y:99
 		{
-			yyVAL.str = yyS[yypt-0].str
+			yyVAL.str = yyDollar[2].str
 		}
 	case 10:
-		//line parser.y:101
+		yyDollar = yyS[yypt-0 : yypt+1]
+//line parser.y:103
 		{
-			yyVAL.boolean = false
+			yyVAL.labelSet = clientmodel.LabelSet{}
 		}
 	case 11:
-		//line parser.y:103
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line parser.y:105
 		{
-			yyVAL.boolean = true
+			yyVAL.labelSet = yyDollar[3].labelSet
 		}
 	case 12:
-		//line parser.y:107
+		yyDollar = yyS[yypt-0 : yypt+1]
+//line parser.y:109
 		{
-			yyVAL.str = yyS[yypt-0].str
+			yyVAL.boolean = false
 		}
 	case 13:
-		//line parser.y:109
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.y:111
 		{
-			yyVAL.str = yyS[yypt-0].str
+			yyVAL.boolean = true
 		}
 	case 14:
-		//line parser.y:113
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.y:115
 		{
-			yyVAL.labelSet = clientmodel.LabelSet{}
+			yyVAL.str = yyDollar[1].str
 		}
 	case 15:
-		//line parser.y:115
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.y:117
 		{
-			yyVAL.labelSet = yyS[yypt-1].labelSet
+			yyVAL.str = yyDollar[1].str
 		}
 	case 16:
-		//line parser.y:117
+		yyDollar = yyS[yypt-0 : yypt+1]
+//line parser.y:121
 		{
 			yyVAL.labelSet = clientmodel.LabelSet{}
 		}
 	case 17:
-		//line parser.y:120
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.y:123
 		{
-			yyVAL.labelSet = yyS[yypt-0].labelSet
+			yyVAL.labelSet = yyDollar[2].labelSet
 		}
 	case 18:
-		//line parser.y:122
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line parser.y:125
 		{
-			for k, v := range yyS[yypt-0].labelSet {
-				yyVAL.labelSet[k] = v
-			}
+			yyVAL.labelSet = clientmodel.LabelSet{}
 		}
 	case 19:
-		//line parser.y:126
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.y:128
 		{
-			yyVAL.labelSet = clientmodel.LabelSet{clientmodel.LabelName(yyS[yypt-2].str): clientmodel.LabelValue(yyS[yypt-0].str)}
+			yyVAL.labelSet = yyDollar[1].labelSet
 		}
 	case 20:
-		//line parser.y:130
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.y:130
 		{
-			yyVAL.labelMatchers = metric.LabelMatchers{}
+			for k, v := range yyDollar[3].labelSet {
+				yyVAL.labelSet[k] = v
+			}
 		}
 	case 21:
-		//line parser.y:132
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.y:134
 		{
-			yyVAL.labelMatchers = metric.LabelMatchers{}
+			yyVAL.labelSet = clientmodel.LabelSet{clientmodel.LabelName(yyDollar[1].str): clientmodel.LabelValue(yyDollar[3].str)}
 		}
 	case 22:
-		//line parser.y:134
+		yyDollar = yyS[yypt-0 : yypt+1]
+//line parser.y:138
 		{
-			yyVAL.labelMatchers = yyS[yypt-1].labelMatchers
+			yyVAL.labelMatchers = metric.LabelMatchers{}
 		}
 	case 23:
-		//line parser.y:138
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line parser.y:140
 		{
-			yyVAL.labelMatchers = metric.LabelMatchers{yyS[yypt-0].labelMatcher}
+			yyVAL.labelMatchers = metric.LabelMatchers{}
 		}
 	case 24:
-		//line parser.y:140
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.y:142
 		{
-			yyVAL.labelMatchers = append(yyVAL.labelMatchers, yyS[yypt-0].labelMatcher)
+			yyVAL.labelMatchers = yyDollar[2].labelMatchers
 		}
 	case 25:
-		//line parser.y:144
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.y:146
+		{
+			yyVAL.labelMatchers = metric.LabelMatchers{yyDollar[1].labelMatcher}
+		}
+	case 26:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.y:148
+		{
+			yyVAL.labelMatchers = append(yyVAL.labelMatchers, yyDollar[3].labelMatcher)
+		}
+	case 27:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.y:152
 		{
 			var err error
-			yyVAL.labelMatcher, err = newLabelMatcher(yyS[yypt-1].str, clientmodel.LabelName(yyS[yypt-2].str), clientmodel.LabelValue(yyS[yypt-0].str))
+			yyVAL.labelMatcher, err = newLabelMatcher(yyDollar[2].str, clientmodel.LabelName(yyDollar[1].str), clientmodel.LabelValue(yyDollar[3].str))
 			if err != nil {
 				yylex.Error(err.Error())
 				return 1
 			}
 		}
-	case 26:
-		//line parser.y:152
+	case 28:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.y:160
 		{
 			yyVAL.str = "="
 		}
-	case 27:
-		//line parser.y:154
+	case 29:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.y:162
 		{
-			yyVAL.str = yyS[yypt-0].str
+			yyVAL.str = yyDollar[1].str
 		}
-	case 28:
-		//line parser.y:158
+	case 30:
+		yyDollar = yyS[yypt-0 : yypt+1]
+//line parser.y:166
 		{
 			yyVAL.str = "0s"
 		}
-	case 29:
-		//line parser.y:160
+	case 31:
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line parser.y:168
 		{
-			yyVAL.str = yyS[yypt-0].str
+			yyVAL.str = yyDollar[2].str
 		}
-	case 30:
-		//line parser.y:164
+	case 32:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.y:172
 		{
-			yyVAL.ruleNode = yyS[yypt-1].ruleNode
+			yyVAL.selectorMods = newSelectorModifiers(yyDollar[1].str, nil)
 		}
-	case 31:
-		//line parser.y:166
+	case 33:
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line parser.y:174
+		{
+			yyVAL.selectorMods = newSelectorModifiers(yyDollar[2].str, &yyDollar[4].num)
+		}
+	case 34:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.y:176
+		{
+			yyVAL.selectorMods = newSelectorModifiers(yyDollar[3].str, &yyDollar[2].num)
+		}
+	case 35:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.y:180
+		{
+			yyVAL.ruleNode = yyDollar[2].ruleNode
+		}
+	case 36:
+		yyDollar = yyS[yypt-5 : yypt+1]
+//line parser.y:182
 		{
 			var err error
-			yyVAL.ruleNode, err = NewVectorSelector(yyS[yypt-2].labelMatchers, yyS[yypt-0].str)
+			yyVAL.ruleNode, err = NewOffsetExpr(yyDollar[2].ruleNode, yyDollar[5].str)
 			if err != nil {
 				yylex.Error(err.Error())
 				return 1
 			}
 		}
-	case 32:
-		//line parser.y:172
+	case 37:
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line parser.y:188
 		{
 			var err error
-			m, err := metric.NewLabelMatcher(metric.Equal, clientmodel.MetricNameLabel, clientmodel.LabelValue(yyS[yypt-2].str))
+			yyVAL.ruleNode, err = NewVectorSelector(yyDollar[2].labelMatchers, yyDollar[4].selectorMods)
 			if err != nil {
 				yylex.Error(err.Error())
 				return 1
 			}
-			yyS[yypt-1].labelMatchers = append(yyS[yypt-1].labelMatchers, m)
-			yyVAL.ruleNode, err = NewVectorSelector(yyS[yypt-1].labelMatchers, yyS[yypt-0].str)
+		}
+	case 38:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.y:194
+		{
+			var err error
+			m, err := metric.NewLabelMatcher(metric.Equal, clientmodel.MetricNameLabel, clientmodel.LabelValue(yyDollar[1].str))
+			if err != nil {
+				yylex.Error(err.Error())
+				return 1
+			}
+			yyDollar[2].labelMatchers = append(yyDollar[2].labelMatchers, m)
+			yyVAL.ruleNode, err = NewVectorSelector(yyDollar[2].labelMatchers, yyDollar[3].selectorMods)
 			if err != nil {
 				yylex.Error(err.Error())
 				return 1
 			}
 		}
-	case 33:
-		//line parser.y:181
+	case 39:
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line parser.y:203
 		{
 			var err error
-			yyVAL.ruleNode, err = NewFunctionCall(yyS[yypt-3].str, yyS[yypt-1].ruleNodeSlice)
+			yyVAL.ruleNode, err = NewFunctionCall(yyDollar[1].str, yyDollar[3].ruleNodeSlice)
 			if err != nil {
 				yylex.Error(err.Error())
 				return 1
 			}
 		}
-	case 34:
-		//line parser.y:187
+	case 40:
+		yyDollar = yyS[yypt-8 : yypt+1]
+//line parser.y:209
 		{
 			var err error
-			yyVAL.ruleNode, err = NewFunctionCall(yyS[yypt-2].str, []ast.Node{})
+			yyVAL.ruleNode, err = NewParameterizedAggregation(yyDollar[1].str, yyDollar[3].ruleNodeSlice, yyDollar[7].labelNameSlice)
 			if err != nil {
 				yylex.Error(err.Error())
 				return 1
 			}
 		}
-	case 35:
-		//line parser.y:193
+	case 41:
+		yyDollar = yyS[yypt-8 : yypt+1]
+//line parser.y:215
 		{
 			var err error
-			yyVAL.ruleNode, err = NewMatrixSelector(yyS[yypt-4].ruleNode, yyS[yypt-2].str, yyS[yypt-0].str)
+			yyVAL.ruleNode, err = NewParameterizedAggregation(yyDollar[1].str, yyDollar[7].ruleNodeSlice, yyDollar[4].labelNameSlice)
 			if err != nil {
 				yylex.Error(err.Error())
 				return 1
 			}
 		}
-	case 36:
-		//line parser.y:199
+	case 42:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.y:221
 		{
 			var err error
-			yyVAL.ruleNode, err = NewVectorAggregation(yyS[yypt-5].str, yyS[yypt-3].ruleNode, yyS[yypt-1].labelNameSlice, yyS[yypt-0].boolean)
+			yyVAL.ruleNode, err = NewFunctionCall(yyDollar[1].str, []ast.Node{})
 			if err != nil {
 				yylex.Error(err.Error())
 				return 1
 			}
 		}
-	case 37:
-		//line parser.y:205
+	case 43:
+		yyDollar = yyS[yypt-5 : yypt+1]
+//line parser.y:227
 		{
 			var err error
-			yyVAL.ruleNode, err = NewVectorAggregation(yyS[yypt-5].str, yyS[yypt-1].ruleNode, yyS[yypt-4].labelNameSlice, yyS[yypt-3].boolean)
+			yyVAL.ruleNode, err = NewMatrixSelector(yyDollar[1].ruleNode, yyDollar[3].str, yyDollar[5].selectorMods)
 			if err != nil {
 				yylex.Error(err.Error())
 				return 1
 			}
 		}
-	case 38:
-		//line parser.y:213
+	case 44:
+		yyDollar = yyS[yypt-6 : yypt+1]
+//line parser.y:233
 		{
 			var err error
-			yyVAL.ruleNode, err = NewArithExpr(yyS[yypt-2].str, yyS[yypt-3].ruleNode, yyS[yypt-0].ruleNode, yyS[yypt-1].vectorMatching)
+			yyVAL.ruleNode, err = NewSubquery(yyDollar[1].ruleNode, yyDollar[3].str, yyDollar[4].str, yyDollar[6].str)
 			if err != nil {
 				yylex.Error(err.Error())
 				return 1
 			}
 		}
-	case 39:
-		//line parser.y:219
+	case 45:
+		yyDollar = yyS[yypt-6 : yypt+1]
+//line parser.y:239
 		{
 			var err error
-			yyVAL.ruleNode, err = NewArithExpr(yyS[yypt-2].str, yyS[yypt-3].ruleNode, yyS[yypt-0].ruleNode, yyS[yypt-1].vectorMatching)
+			yyVAL.ruleNode, err = NewVectorAggregation(yyDollar[1].str, yyDollar[3].ruleNode, yyDollar[5].labelNameSlice, yyDollar[6].boolean)
 			if err != nil {
 				yylex.Error(err.Error())
 				return 1
 			}
 		}
-	case 40:
-		//line parser.y:225
+	case 46:
+		yyDollar = yyS[yypt-6 : yypt+1]
+//line parser.y:245
 		{
 			var err error
-			yyVAL.ruleNode, err = NewArithExpr(yyS[yypt-2].str, yyS[yypt-3].ruleNode, yyS[yypt-0].ruleNode, yyS[yypt-1].vectorMatching)
+			yyVAL.ruleNode, err = NewVectorAggregation(yyDollar[1].str, yyDollar[5].ruleNode, yyDollar[2].labelNameSlice, yyDollar[3].boolean)
 			if err != nil {
 				yylex.Error(err.Error())
 				return 1
 			}
 		}
-	case 41:
-		//line parser.y:231
+	case 47:
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line parser.y:253
 		{
-			yyVAL.ruleNode = NewScalarLiteral(yyS[yypt-0].num, "+")
+			var err error
+			yyVAL.ruleNode, err = NewArithExpr(yyDollar[2].str, yyDollar[1].ruleNode, yyDollar[4].ruleNode, yyDollar[3].vectorMatching)
+			if err != nil {
+				yylex.Error(err.Error())
+				return 1
+			}
 		}
-	case 42:
-		//line parser.y:233
+	case 48:
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line parser.y:259
 		{
-			yyVAL.ruleNode = NewScalarLiteral(yyS[yypt-0].num, yyS[yypt-1].str)
+			var err error
+			yyVAL.ruleNode, err = NewArithExpr(yyDollar[2].str, yyDollar[1].ruleNode, yyDollar[4].ruleNode, yyDollar[3].vectorMatching)
+			if err != nil {
+				yylex.Error(err.Error())
+				return 1
+			}
 		}
-	case 43:
-		//line parser.y:237
+	case 49:
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line parser.y:265
+		{
+			var err error
+			yyVAL.ruleNode, err = NewArithExpr(yyDollar[2].str, yyDollar[1].ruleNode, yyDollar[4].ruleNode, yyDollar[3].vectorMatching)
+			if err != nil {
+				yylex.Error(err.Error())
+				return 1
+			}
+		}
+	case 50:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.y:271
+		{
+			yyVAL.ruleNode = NewScalarLiteral(yyDollar[1].num, "+")
+		}
+	case 51:
+		yyDollar = yyS[yypt-2 : yypt+1]
+//line parser.y:273
+		{
+			yyVAL.ruleNode = NewScalarLiteral(yyDollar[2].num, yyDollar[1].str)
+		}
+	case 52:
+		yyDollar = yyS[yypt-0 : yypt+1]
+//line parser.y:277
 		{
 			yyVAL.boolean = false
 		}
-	case 44:
-		//line parser.y:239
+	case 53:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.y:279
 		{
 			yyVAL.boolean = true
 		}
-	case 45:
-		//line parser.y:243
+	case 54:
+		yyDollar = yyS[yypt-0 : yypt+1]
+//line parser.y:283
 		{
 			yyVAL.vectorMatching = nil
 		}
-	case 46:
-		//line parser.y:245
+	case 55:
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line parser.y:285
 		{
 			var err error
-			yyVAL.vectorMatching, err = newVectorMatching("", yyS[yypt-1].labelNameSlice, nil)
+			yyVAL.vectorMatching, err = newVectorMatching("", yyDollar[3].labelNameSlice, false, nil)
 			if err != nil {
 				yylex.Error(err.Error())
 				return 1
 			}
 		}
-	case 47:
-		//line parser.y:251
+	case 56:
+		yyDollar = yyS[yypt-8 : yypt+1]
+//line parser.y:291
 		{
 			var err error
-			yyVAL.vectorMatching, err = newVectorMatching(yyS[yypt-3].str, yyS[yypt-5].labelNameSlice, yyS[yypt-1].labelNameSlice)
+			yyVAL.vectorMatching, err = newVectorMatching(yyDollar[5].str, yyDollar[3].labelNameSlice, false, yyDollar[7].labelNameSlice)
 			if err != nil {
 				yylex.Error(err.Error())
 				return 1
 			}
 		}
-	case 48:
-		//line parser.y:259
+	case 57:
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line parser.y:297
+		{
+			var err error
+			yyVAL.vectorMatching, err = newVectorMatching("", yyDollar[3].labelNameSlice, true, nil)
+			if err != nil {
+				yylex.Error(err.Error())
+				return 1
+			}
+		}
+	case 58:
+		yyDollar = yyS[yypt-8 : yypt+1]
+//line parser.y:303
+		{
+			var err error
+			yyVAL.vectorMatching, err = newVectorMatching(yyDollar[5].str, yyDollar[3].labelNameSlice, true, yyDollar[7].labelNameSlice)
+			if err != nil {
+				yylex.Error(err.Error())
+				return 1
+			}
+		}
+	case 59:
+		yyDollar = yyS[yypt-0 : yypt+1]
+//line parser.y:311
 		{
 			yyVAL.labelNameSlice = clientmodel.LabelNames{}
 		}
-	case 49:
-		//line parser.y:261
+	case 60:
+		yyDollar = yyS[yypt-4 : yypt+1]
+//line parser.y:313
 		{
-			yyVAL.labelNameSlice = yyS[yypt-1].labelNameSlice
+			yyVAL.labelNameSlice = yyDollar[3].labelNameSlice
 		}
-	case 50:
-		//line parser.y:265
+	case 61:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.y:317
 		{
-			yyVAL.labelNameSlice = clientmodel.LabelNames{clientmodel.LabelName(yyS[yypt-0].str)}
+			yyVAL.labelNameSlice = clientmodel.LabelNames{clientmodel.LabelName(yyDollar[1].str)}
 		}
-	case 51:
-		//line parser.y:267
+	case 62:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.y:319
 		{
-			yyVAL.labelNameSlice = append(yyVAL.labelNameSlice, clientmodel.LabelName(yyS[yypt-0].str))
+			yyVAL.labelNameSlice = append(yyVAL.labelNameSlice, clientmodel.LabelName(yyDollar[3].str))
 		}
-	case 52:
-		//line parser.y:271
+	case 63:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.y:323
 		{
-			yyVAL.ruleNodeSlice = []ast.Node{yyS[yypt-0].ruleNode}
+			yyVAL.ruleNodeSlice = []ast.Node{yyDollar[1].ruleNode}
 		}
-	case 53:
-		//line parser.y:273
+	case 64:
+		yyDollar = yyS[yypt-3 : yypt+1]
+//line parser.y:325
 		{
-			yyVAL.ruleNodeSlice = append(yyVAL.ruleNodeSlice, yyS[yypt-0].ruleNode)
+			yyVAL.ruleNodeSlice = append(yyVAL.ruleNodeSlice, yyDollar[3].ruleNode)
 		}
-	case 54:
-		//line parser.y:277
+	case 65:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.y:329
 		{
-			yyVAL.ruleNode = yyS[yypt-0].ruleNode
+			yyVAL.ruleNode = yyDollar[1].ruleNode
 		}
-	case 55:
-		//line parser.y:279
+	case 66:
+		yyDollar = yyS[yypt-1 : yypt+1]
+//line parser.y:331
 		{
-			yyVAL.ruleNode = ast.NewStringLiteral(yyS[yypt-0].str)
+			yyVAL.ruleNode = ast.NewStringLiteral(yyDollar[1].str)
 		}
 	}
 	goto yystack /* stack new state and value */
@@ -40,3 +40,29 @@ type Rule interface {
 	// decorated with HTML elements for use the web frontend.
 	HTMLSnippet() template.HTML
 }
+
+// DependsOn reports whether the expression of rule might select series
+// recorded by the other rule, so that rule has to be evaluated after it.
+func DependsOn(rule, other Rule) bool {
+	var expr ast.Node
+	switch r := rule.(type) {
+	case *AlertingRule:
+		expr = r.Vector
+	case *RecordingRule:
+		expr = r.vector
+	default:
+		return true
+	}
+	names, ok := ast.SelectedMetricNames(expr)
+	if !ok {
+		return true
+	}
+	switch o := other.(type) {
+	case *AlertingRule:
+		return names[AlertMetricName] || names[AlertForStateMetricName]
+	case *RecordingRule:
+		return names[clientmodel.LabelValue(o.name)]
+	default:
+		return true
+	}
+}
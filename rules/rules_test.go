@@ -17,7 +17,9 @@ import (
 	"fmt"
 	"math"
 	"path"
+	"reflect"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
@@ -363,6 +365,64 @@ func TestExpressions(t *testing.T) {
 				`http_requests{group="canary", instance="1", job="app-server"} => 800 @[%v]`,
 			},
 			checkOrder: true,
+		}, {
+			expr: `topk(1, http_requests) BY (job)`,
+			output: []string{
+				`http_requests{group="canary", instance="1", job="api-server"} => 400 @[%v]`,
+				`http_requests{group="canary", instance="1", job="app-server"} => 800 @[%v]`,
+			},
+		}, {
+			expr: `bottomk BY (group) (1, http_requests)`,
+			output: []string{
+				`http_requests{group="production", instance="0", job="api-server"} => 100 @[%v]`,
+				`http_requests{group="canary", instance="0", job="api-server"} => 300 @[%v]`,
+			},
+		}, {
+			expr:   `topk(0, http_requests)`,
+			output: []string{},
+		}, {
+			expr: `quantile(0.5, http_requests) BY (job)`,
+			output: []string{
+				`{job="api-server"} => 250 @[%v]`,
+				`{job="app-server"} => 650 @[%v]`,
+			},
+		}, {
+			expr: `QUANTILE(0.75, http_requests{job="api-server"}) BY (group)`,
+			output: []string{
+				`{group="canary"} => 375 @[%v]`,
+				`{group="production"} => 175 @[%v]`,
+			},
+		}, {
+			expr: `count_values("value", http_requests > 500)`,
+			output: []string{
+				`{value="600"} => 1 @[%v]`,
+				`{value="700"} => 1 @[%v]`,
+				`{value="800"} => 1 @[%v]`,
+			},
+		}, {
+			expr: `count_values("value", http_requests{job="api-server"} % 200) BY (group)`,
+			output: []string{
+				`{group="canary", value="100"} => 1 @[%v]`,
+				`{group="canary", value="0"} => 1 @[%v]`,
+				`{group="production", value="100"} => 1 @[%v]`,
+				`{group="production", value="0"} => 1 @[%v]`,
+			},
+		}, {
+			// The parameter of topk needs to be a scalar.
+			expr:       `topk("3", http_requests)`,
+			shouldFail: true,
+		}, {
+			// The parameter of count_values needs to be a valid label name.
+			expr:       `count_values("1value", http_requests)`,
+			shouldFail: true,
+		}, {
+			// Parameterized aggregations take exactly two arguments.
+			expr:       `quantile(http_requests)`,
+			shouldFail: true,
+		}, {
+			// Only aggregations support grouping.
+			expr:       `rate(http_requests[5m]) BY (job)`,
+			shouldFail: true,
 		}, {
 			// Single-letter label names and values.
 			expr: `x{y="testvalue"}`,
@@ -404,6 +464,26 @@ func TestExpressions(t *testing.T) {
 			// Deriv should return correct result.
 			expr:   `deriv(testcounter_reset_middle[100m])`,
 			output: []string{`{} => 0.010606060606060607 @[%v]`},
+		}, {
+			// predict_linear should return correct result.
+			expr:   `predict_linear(testcounter_reset_middle[100m], 3600)`,
+			output: []string{`{} => 76.81818181818181 @[%v]`},
+		}, {
+			// predict_linear extrapolates a linear series exactly.
+			expr:   `predict_linear(http_requests{group="canary", instance="1", job="app-server"}[60m], 3600)`,
+			output: []string{`{group="canary", instance="1", job="app-server"} => 1760 @[%v]`},
+		}, {
+			// holt_winters should return correct result.
+			expr:   `holt_winters(testcounter_reset_middle[100m], 0.5, 0.1)`,
+			output: []string{`{} => 47.0806953125 @[%v]`},
+		}, {
+			// holt_winters smoothes a linear series to its last value.
+			expr:   `holt_winters(http_requests{group="canary", instance="1", job="app-server"}[60m], 0.5, 0.5)`,
+			output: []string{`{group="canary", instance="1", job="app-server"} => 800 @[%v]`},
+		}, {
+			// holt_winters returns nothing for invalid smoothing factors.
+			expr:   `holt_winters(testcounter_reset_middle[100m], 1, 0.1)`,
+			output: []string{},
 		}, {
 			// count_scalar for a non-empty vector should return scalar element count.
 			expr:   `count_scalar(http_requests)`,
@@ -575,6 +655,114 @@ func TestExpressions(t *testing.T) {
 				`{group="production", instance="1", job="api-server"} => 11 @[%v]`,
 			},
 		},
+		{
+			expr: `max_over_time(http_requests{group="production",job="api-server"}[30m:10m])`,
+			output: []string{
+				`{group="production", instance="0", job="api-server"} => 100 @[%v]`,
+				`{group="production", instance="1", job="api-server"} => 200 @[%v]`,
+			},
+		},
+		{
+			// The subquery is evaluated at 20m, 30m, 40m and 50m.
+			expr: `min_over_time(http_requests{group="production",job="api-server"}[30m:10m])`,
+			output: []string{
+				`{group="production", instance="0", job="api-server"} => 40 @[%v]`,
+				`{group="production", instance="1", job="api-server"} => 80 @[%v]`,
+			},
+		},
+		{
+			expr: `min_over_time(http_requests{group="production",job="api-server"}[10m:5m] offset 20m)`,
+			output: []string{
+				`{group="production", instance="0", job="api-server"} => 40 @[%v]`,
+				`{group="production", instance="1", job="api-server"} => 80 @[%v]`,
+			},
+		},
+		{
+			expr: `count_over_time(rate(http_requests{group="production",job="api-server"}[10m])[30m:10m])`,
+			output: []string{
+				`{group="production", instance="0", job="api-server"} => 4 @[%v]`,
+				`{group="production", instance="1", job="api-server"} => 4 @[%v]`,
+			},
+		},
+		{
+			expr: `delta(sum(http_requests{group="production"})[20m:5m])`,
+			output: []string{
+				`{} => 560 @[%v]`,
+			},
+		},
+		{
+			expr: `http_requests{group="production",job="api-server",instance="0"} @ 600`,
+			output: []string{
+				`http_requests{group="production", instance="0", job="api-server"} => 20 @[%v]`,
+			},
+		},
+		{
+			expr: `http_requests{group="production",job="api-server",instance="0"} offset 10m @ 1200`,
+			output: []string{
+				`http_requests{group="production", instance="0", job="api-server"} => 20 @[%v]`,
+			},
+		},
+		{
+			expr: `http_requests{group="production",job="api-server",instance="0"} @ 1200 offset 10m`,
+			output: []string{
+				`http_requests{group="production", instance="0", job="api-server"} => 20 @[%v]`,
+			},
+		},
+		{
+			expr: `max_over_time(http_requests{group="production",job="api-server"}[10m] @ 1200)`,
+			output: []string{
+				`{group="production", instance="0", job="api-server"} => 40 @[%v]`,
+				`{group="production", instance="1", job="api-server"} => 80 @[%v]`,
+			},
+		},
+		{
+			expr: `(http_requests{group="production",job="api-server",instance="0"}) offset 20m`,
+			output: []string{
+				`http_requests{group="production", instance="0", job="api-server"} => 60 @[%v]`,
+			},
+		},
+		{
+			expr: `((http_requests{group="production",job="api-server",instance="0"}) offset 10m) offset 10m`,
+			output: []string{
+				`http_requests{group="production", instance="0", job="api-server"} => 60 @[%v]`,
+			},
+		},
+		{
+			expr: `sum(http_requests{group="production"}) - (sum(http_requests{group="production"})) offset 10m`,
+			output: []string{
+				`{} => 280 @[%v]`,
+			},
+		},
+		{
+			// The shifted expression is evaluated at 10m, 20m and 30m.
+			expr: `max_over_time((http_requests{group="production",job="api-server",instance="0"}) offset 20m [20m:10m])`,
+			output: []string{
+				`{group="production", instance="0", job="api-server"} => 60 @[%v]`,
+			},
+		},
+		{
+			// Offset expressions are only supported for vector expressions.
+			expr:       `(time()) offset 5m`,
+			shouldFail: true,
+		},
+		{
+			expr:       `http_requests @ 5m`,
+			shouldFail: true,
+		},
+		{
+			// Subqueries need a resolution.
+			expr:       `http_requests[5m:]`,
+			shouldFail: true,
+		},
+		{
+			expr:       `http_requests[5m:0s]`,
+			shouldFail: true,
+		},
+		{
+			// Subqueries are only supported for vector expressions.
+			expr:       `time()[5m:1m]`,
+			shouldFail: true,
+		},
 		{
 			expr: `max_over_time(http_requests{group="production",job="api-server"}[1h])`,
 			output: []string{
@@ -596,6 +784,92 @@ func TestExpressions(t *testing.T) {
 				`{group="production", instance="1", job="api-server"} => 1100 @[%v]`,
 			},
 		},
+		{
+			expr: `quantile_over_time(0.5, http_requests{group="production",job="api-server"}[1h])`,
+			output: []string{
+				`{group="production", instance="0", job="api-server"} => 50 @[%v]`,
+				`{group="production", instance="1", job="api-server"} => 100 @[%v]`,
+			},
+		},
+		{
+			// The quantile is interpolated between the two closest values.
+			expr: `quantile_over_time(0.95, http_requests{group="production",job="api-server"}[1h])`,
+			output: []string{
+				`{group="production", instance="0", job="api-server"} => 95 @[%v]`,
+				`{group="production", instance="1", job="api-server"} => 190 @[%v]`,
+			},
+		},
+		{
+			// Quantiles out of range are handled like in histogram_quantile.
+			expr: `quantile_over_time(-0.1, http_requests{group="production",job="api-server"}[1h])`,
+			output: []string{
+				`{group="production", instance="0", job="api-server"} => -Inf @[%v]`,
+				`{group="production", instance="1", job="api-server"} => -Inf @[%v]`,
+			},
+		},
+		{
+			expr: `quantile_over_time(1.01, http_requests{group="production",job="api-server"}[1h])`,
+			output: []string{
+				`{group="production", instance="0", job="api-server"} => +Inf @[%v]`,
+				`{group="production", instance="1", job="api-server"} => +Inf @[%v]`,
+			},
+		},
+		{
+			expr: `stddev_over_time(http_requests{group="production",job="api-server"}[1h])`,
+			output: []string{
+				`{group="production", instance="0", job="api-server"} => 31.622776601683793 @[%v]`,
+				`{group="production", instance="1", job="api-server"} => 63.245553203367585 @[%v]`,
+			},
+		},
+		{
+			expr: `stdvar_over_time(http_requests{group="production",job="api-server"}[1h])`,
+			output: []string{
+				`{group="production", instance="0", job="api-server"} => 1000 @[%v]`,
+				`{group="production", instance="1", job="api-server"} => 4000 @[%v]`,
+			},
+		},
+		{
+			expr: `label_replace(http_requests{group="production",job="api-server"}, "dst", "value-$1", "instance", "(.*)")`,
+			output: []string{
+				`http_requests{dst="value-0", group="production", instance="0", job="api-server"} => 100 @[%v]`,
+				`http_requests{dst="value-1", group="production", instance="1", job="api-server"} => 200 @[%v]`,
+			},
+		},
+		{
+			// Samples with non-matching source label values are not changed.
+			expr: `label_replace(http_requests{group="production",job="api-server"}, "dst", "value", "instance", "1")`,
+			output: []string{
+				`http_requests{group="production", instance="0", job="api-server"} => 100 @[%v]`,
+				`http_requests{dst="value", group="production", instance="1", job="api-server"} => 200 @[%v]`,
+			},
+		},
+		{
+			// An empty replacement deletes the destination label.
+			expr: `label_replace(http_requests{group="production",job="api-server"}, "group", "", "job", ".*")`,
+			output: []string{
+				`http_requests{instance="0", job="api-server"} => 100 @[%v]`,
+				`http_requests{instance="1", job="api-server"} => 200 @[%v]`,
+			},
+		},
+		{
+			expr:       `label_replace(http_requests, "invalid-label", "", "instance", ".*")`,
+			shouldFail: true,
+		},
+		{
+			expr:       `label_replace(http_requests, "dst", "", "instance", "(")`,
+			shouldFail: true,
+		},
+		{
+			expr: `label_join(http_requests{group="production",job="api-server"}, "dst", "-", "job", "instance")`,
+			output: []string{
+				`http_requests{dst="api-server-0", group="production", instance="0", job="api-server"} => 100 @[%v]`,
+				`http_requests{dst="api-server-1", group="production", instance="1", job="api-server"} => 200 @[%v]`,
+			},
+		},
+		{
+			expr:       `label_join(http_requests, "dst", "-", "job", "invalid-label")`,
+			shouldFail: true,
+		},
 		{
 			expr:   `time()`,
 			output: []string{`scalar: 3000 @[%v]`},
@@ -832,6 +1106,52 @@ func TestExpressions(t *testing.T) {
 				`{group="production", instance="1", job="app-server"} => 600 @[%v]`,
 			},
 		},
+		{
+			expr: `http_requests{group="canary"} / ignoring(group) http_requests{group="production"}`,
+			output: []string{
+				`{instance="0", job="api-server"} => 3 @[%v]`,
+				`{instance="0", job="app-server"} => 1.4 @[%v]`,
+				`{instance="1", job="api-server"} => 2 @[%v]`,
+				`{instance="1", job="app-server"} => 1.3333333333333333 @[%v]`,
+			},
+		},
+		{
+			// Samples only match if all labels but the ignored ones are equal.
+			expr:   `http_requests{group="production"} / ignoring(group) cpu_count{type="smp"}`,
+			output: []string{},
+		},
+		{
+			expr: `http_requests{group="production"} / ignoring(group,job,type) group_left(job) cpu_count{type="smp"}`,
+			output: []string{
+				`{instance="1", job="api-server"} => 1 @[%v]`,
+				`{instance="0", job="app-server"} => 5 @[%v]`,
+				`{instance="1", job="app-server"} => 3 @[%v]`,
+				`{instance="0", job="api-server"} => 1 @[%v]`,
+			},
+		},
+		{
+			expr: `cpu_count{type="smp"} / ignoring(group,job,type) group_right(job) http_requests{group="production"}`,
+			output: []string{
+				`{instance="1", job="app-server"} => 0.3333333333333333 @[%v]`,
+				`{instance="0", job="app-server"} => 0.2 @[%v]`,
+				`{instance="1", job="api-server"} => 1 @[%v]`,
+				`{instance="0", job="api-server"} => 1 @[%v]`,
+			},
+		},
+		{
+			// Comparisons keep the metric name and all labels not ignored.
+			expr: `http_requests{group="canary"} > ignoring(group) http_requests{group="production"}`,
+			output: []string{
+				`http_requests{instance="0", job="api-server"} => 300 @[%v]`,
+				`http_requests{instance="0", job="app-server"} => 700 @[%v]`,
+				`http_requests{instance="1", job="api-server"} => 400 @[%v]`,
+				`http_requests{instance="1", job="app-server"} => 800 @[%v]`,
+			},
+		},
+		{
+			expr:       `http_requests / ignoring(instance) 3`,
+			shouldFail: true,
+		},
 		{
 			expr:       `http_requests / on(instance) 3`,
 			shouldFail: true,
@@ -1396,6 +1716,127 @@ func TestExpressions(t *testing.T) {
 	}
 }
 
+func TestVectorMatchingStringification(t *testing.T) {
+	for _, expr := range []string{
+		`(a / ON (instance) b)`,
+		`(a / IGNORING (group, job) GROUP_LEFT (job) b)`,
+		`(a * ON (instance) GROUP_RIGHT (job) b)`,
+		`(a AND ON (instance) b)`,
+	} {
+		node, err := LoadExprFromString(expr)
+		if err != nil {
+			t.Fatalf("Error parsing %s: %s", expr, err)
+		}
+		if got := node.String(); got != expr {
+			t.Errorf("Expression %s stringified as %s", expr, got)
+		}
+	}
+}
+
+func TestParameterizedAggregationStringification(t *testing.T) {
+	for _, expr := range []string{
+		`TOPK(5, a)`,
+		`BOTTOMK(1, a) BY (job)`,
+		`QUANTILE(0.9, a) BY (instance, job)`,
+		`COUNT_VALUES("version", a)`,
+	} {
+		node, err := LoadExprFromString(expr)
+		if err != nil {
+			t.Fatalf("Error parsing %s: %s", expr, err)
+		}
+		if got := node.String(); got != expr {
+			t.Errorf("Expression %s stringified as %s", expr, got)
+		}
+	}
+}
+
+func TestTimeModifierStringification(t *testing.T) {
+	for _, expr := range []string{
+		`a[1h:5m]`,
+		`max_over_time(rate(a[5m])[1h:1m])`,
+		`a @ 1500`,
+		`rate(a[5m] @ 1500.5)`,
+		`(SUM(a)) OFFSET 1d`,
+	} {
+		node, err := LoadExprFromString(expr)
+		if err != nil {
+			t.Fatalf("Error parsing %s: %s", expr, err)
+		}
+		if got := node.String(); got != expr {
+			t.Errorf("Expression %s stringified as %s", expr, got)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	scenarios := []struct {
+		expr        string
+		line        int
+		column      int
+		token       string
+		msgContains string
+	}{
+		{
+			expr:        `sum(foo) BY job`,
+			line:        1,
+			column:      13,
+			token:       "job",
+			msgContains: "unexpected IDENTIFIER, expecting '('",
+		},
+		{
+			expr:        "foo{a=\"b\"}\n  + bar)",
+			line:        2,
+			column:      8,
+			token:       ")",
+			msgContains: "unexpected ')'",
+		},
+		{
+			expr:        `foo +`,
+			line:        1,
+			column:      6,
+			token:       "",
+			msgContains: "unexpected end of input",
+		},
+		{
+			expr:        `foo[5]`,
+			line:        1,
+			column:      5,
+			token:       "5",
+			msgContains: "expecting DURATION",
+		},
+		{
+			expr:        `rat(foo[5m])`,
+			line:        1,
+			column:      13,
+			token:       "",
+			msgContains: `unknown function "rat", did you mean "rate"?`,
+		},
+		{
+			expr:        `sun(foo)`,
+			line:        1,
+			column:      9,
+			token:       "",
+			msgContains: `did you mean "sum"?`,
+		},
+	}
+
+	for i, s := range scenarios {
+		_, err := LoadExprFromString(s.expr)
+		errs, ok := err.(ParseErrors)
+		if !ok || len(errs) != 1 {
+			t.Errorf("%d. Expected a single parse error for %q, got %v", i, s.expr, err)
+			continue
+		}
+		pe := errs[0]
+		if pe.Line != s.line || pe.Column != s.column || pe.Token != s.token {
+			t.Errorf("%d. Expected error at line %d, column %d, token %q for %q, got line %d, column %d, token %q", i, s.line, s.column, s.token, s.expr, pe.Line, pe.Column, pe.Token)
+		}
+		if !strings.Contains(pe.Msg, s.msgContains) {
+			t.Errorf("%d. Expected error message containing %q for %q, got %q", i, s.msgContains, s.expr, pe.Msg)
+		}
+	}
+}
+
 func TestRangedEvaluationRegressions(t *testing.T) {
 	scenarios := []struct {
 		in   ast.Matrix
@@ -1657,6 +2098,10 @@ var ruleTests = []struct {
 		inputFile:         "mixed.rules",
 		numRecordingRules: 2,
 		numAlertingRules:  2,
+	}, {
+		inputFile:         "annotations.rules",
+		numRecordingRules: 0,
+		numAlertingRules:  1,
 	},
 	{
 		inputFile:   "syntax_error.rules",
@@ -1668,6 +2113,11 @@ var ruleTests = []struct {
 		shouldFail:  true,
 		errContains: "does not evaluate to vector type",
 	},
+	{
+		inputFile:   "invalid_label_template.rules",
+		shouldFail:  true,
+		errContains: "invalid template in label instance_job",
+	},
 }
 
 func TestRules(t *testing.T) {
@@ -1715,16 +2165,22 @@ func TestAlertingRule(t *testing.T) {
 		{
 			`ALERTS{alertname="HttpRequestRateLow", alertstate="pending", group="canary", instance="0", job="app-server", severity="critical"} => 1 @[%v]`,
 			`ALERTS{alertname="HttpRequestRateLow", alertstate="pending", group="canary", instance="1", job="app-server", severity="critical"} => 1 @[%v]`,
+			`ALERTS_FOR_STATE{alertname="HttpRequestRateLow", group="canary", instance="0", job="app-server", severity="critical"} => 0 @[%v]`,
+			`ALERTS_FOR_STATE{alertname="HttpRequestRateLow", group="canary", instance="1", job="app-server", severity="critical"} => 0 @[%v]`,
 		},
 		{
 			`ALERTS{alertname="HttpRequestRateLow", alertstate="pending", group="canary", instance="0", job="app-server", severity="critical"} => 0 @[%v]`,
 			`ALERTS{alertname="HttpRequestRateLow", alertstate="firing", group="canary", instance="0", job="app-server", severity="critical"} => 1 @[%v]`,
 			`ALERTS{alertname="HttpRequestRateLow", alertstate="pending", group="canary", instance="1", job="app-server", severity="critical"} => 0 @[%v]`,
 			`ALERTS{alertname="HttpRequestRateLow", alertstate="firing", group="canary", instance="1", job="app-server", severity="critical"} => 1 @[%v]`,
+			`ALERTS_FOR_STATE{alertname="HttpRequestRateLow", group="canary", instance="0", job="app-server", severity="critical"} => 0 @[%v]`,
+			`ALERTS_FOR_STATE{alertname="HttpRequestRateLow", group="canary", instance="1", job="app-server", severity="critical"} => 0 @[%v]`,
 		},
 		{
 			`ALERTS{alertname="HttpRequestRateLow", alertstate="firing", group="canary", instance="1", job="app-server", severity="critical"} => 0 @[%v]`,
 			`ALERTS{alertname="HttpRequestRateLow", alertstate="firing", group="canary", instance="0", job="app-server", severity="critical"} => 0 @[%v]`,
+			`ALERTS_FOR_STATE{alertname="HttpRequestRateLow", group="canary", instance="1", job="app-server", severity="critical"} => 0 @[%v]`,
+			`ALERTS_FOR_STATE{alertname="HttpRequestRateLow", group="canary", instance="0", job="app-server", severity="critical"} => 0 @[%v]`,
 		},
 		{
 		/* empty */
@@ -1745,7 +2201,7 @@ func TestAlertingRule(t *testing.T) {
 	alertLabels := clientmodel.LabelSet{
 		"severity": "critical",
 	}
-	rule := NewAlertingRule(alertName, alertExpr.(ast.VectorNode), time.Minute, alertLabels, "summary", "description")
+	rule := NewAlertingRule(alertName, alertExpr.(ast.VectorNode), time.Minute, alertLabels, "summary", "description", clientmodel.LabelSet{})
 
 	for i, expected := range evalOutputs {
 		evalTime := testStartTime.Add(testSampleInterval * time.Duration(i))
@@ -1783,3 +2239,92 @@ func TestAlertingRule(t *testing.T) {
 		}
 	}
 }
+
+func TestAlertingRuleLabelTemplates(t *testing.T) {
+	storage, closer := newTestStorage(t)
+	defer closer.Close()
+
+	alertExpr, err := LoadExprFromString(`http_requests{group="canary", job="app-server", instance="0"} < 100`)
+	if err != nil {
+		t.Fatalf("Unable to parse alert expression: %s", err)
+	}
+	alertLabels := clientmodel.LabelSet{
+		"severity": "critical",
+		"origin":   "{{$labels.job}}/{{$labels.instance}} at {{$value}}",
+	}
+	rule := NewAlertingRule("HttpRequestRateLow", alertExpr.(ast.VectorNode), time.Minute, alertLabels, "summary", "description", clientmodel.LabelSet{})
+
+	actual, err := rule.Eval(testStartTime, storage)
+	if err != nil {
+		t.Fatalf("Error during alerting rule evaluation: %s", err)
+	}
+	expected := annotateWithTime([]string{
+		`ALERTS_FOR_STATE{alertname="HttpRequestRateLow", group="canary", instance="0", job="app-server", origin="app-server/0 at 0", severity="critical"} => 0 @[%v]`,
+		`ALERTS{alertname="HttpRequestRateLow", alertstate="pending", group="canary", instance="0", job="app-server", origin="app-server/0 at 0", severity="critical"} => 1 @[%v]`,
+	}, testStartTime)
+	actualLines := strings.Split(actual.String(), "\n")
+	sort.Strings(actualLines)
+	if !reflect.DeepEqual(actualLines, expected) {
+		t.Fatalf("Expected and actual outputs don't match:\n%v", vectorComparisonString(expected, actualLines))
+	}
+}
+
+func TestAlertingRuleRestoreForState(t *testing.T) {
+	storage, closer := newTestStorage(t)
+	defer closer.Close()
+
+	alertExpr, err := LoadExprFromString(`http_requests{group="canary", job="app-server"} < 100`)
+	if err != nil {
+		t.Fatalf("Unable to parse alert expression: %s", err)
+	}
+	newRule := func() *AlertingRule {
+		return NewAlertingRule("HttpRequestRateLow", alertExpr.(ast.VectorNode), 2*time.Minute, clientmodel.LabelSet{}, "summary", "description", clientmodel.LabelSet{})
+	}
+
+	// Evaluate the rule once and record its output, as the rule manager
+	// would do before a restart.
+	activeSince := testStartTime.Add(time.Minute)
+	vector, err := newRule().Eval(activeSince, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range vector {
+		storage.Append(&clientmodel.Sample{
+			Metric:    s.Metric.Metric,
+			Value:     s.Value,
+			Timestamp: s.Timestamp,
+		})
+	}
+	storage.WaitForIndexing()
+
+	evalTime := testStartTime.Add(4 * time.Minute)
+	restored := newRule()
+	if err := restored.RestoreForState(evalTime, time.Hour, storage); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restored.Eval(evalTime, storage); err != nil {
+		t.Fatal(err)
+	}
+	alerts := restored.ActiveAlerts()
+	if len(alerts) != 2 {
+		t.Fatalf("expected 2 active alerts, got %d", len(alerts))
+	}
+	for _, alert := range alerts {
+		if alert.ActiveSince != activeSince || alert.State != Firing {
+			t.Errorf("expected restored alert %v to be firing since %v, got state %v since %v", alert.Labels, activeSince, alert.State, alert.ActiveSince)
+		}
+	}
+
+	fresh := newRule()
+	if err := fresh.RestoreForState(evalTime, time.Minute, storage); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fresh.Eval(evalTime, storage); err != nil {
+		t.Fatal(err)
+	}
+	for _, alert := range fresh.ActiveAlerts() {
+		if alert.ActiveSince != evalTime || alert.State != Pending {
+			t.Errorf("expected alert %v outside of the outage tolerance to be pending since %v, got state %v since %v", alert.Labels, evalTime, alert.State, alert.ActiveSince)
+		}
+	}
+}
@@ -35,6 +35,7 @@ const (
 	ViewDiskPreparationTime
 	ViewDataExtractionTime
 	ViewDiskExtractionTime
+	IndexLookupTime
 )
 
 // Return a string represenation of a QueryTiming identifier.
@@ -72,7 +73,33 @@ func (s QueryTiming) String() string {
 		return "Total view data extraction time"
 	case ViewDiskExtractionTime:
 		return "View disk data extraction time"
+	case IndexLookupTime:
+		return "Index lookup time"
 	default:
 		return "Unknown query timing"
 	}
 }
+
+// QueryCount identifies a quantity counted during a query.
+type QueryCount int
+
+// Query counts.
+const (
+	SeriesSelected QueryCount = iota
+	ChunksLoaded
+	SamplesDecoded
+)
+
+// Return a string represenation of a QueryCount identifier.
+func (s QueryCount) String() string {
+	switch s {
+	case SeriesSelected:
+		return "Series selected"
+	case ChunksLoaded:
+		return "Chunks loaded"
+	case SamplesDecoded:
+		return "Samples decoded"
+	default:
+		return "Unknown query count"
+	}
+}
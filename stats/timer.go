@@ -40,6 +40,11 @@ func (t *Timer) Stop() {
 	t.duration += time.Since(t.start)
 }
 
+// Duration returns the total time the timer was running.
+func (t *Timer) Duration() time.Duration {
+	return t.duration
+}
+
 // ElapsedTime returns the time that passed since starting the timer.
 func (t *Timer) ElapsedTime() time.Duration {
 	return time.Since(t.start)
@@ -50,15 +55,42 @@ func (t *Timer) String() string {
 	return fmt.Sprintf("%s: %s", t.name, t.duration)
 }
 
-// A TimerGroup represents a group of timers relevant to a single query.
+// A Counter counts a quantity during a query.
+type Counter struct {
+	name    fmt.Stringer
+	created time.Time
+	value   int
+}
+
+// Add adds n to the counter.
+func (c *Counter) Add(n int) {
+	c.value += n
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() int {
+	return c.value
+}
+
+// Return a string representation of the Counter.
+func (c *Counter) String() string {
+	return fmt.Sprintf("%s: %d", c.name, c.value)
+}
+
+// A TimerGroup represents a group of timers and counters relevant to a single
+// query.
 type TimerGroup struct {
-	timers map[fmt.Stringer]*Timer
-	child  *TimerGroup
+	timers   map[fmt.Stringer]*Timer
+	counters map[fmt.Stringer]*Counter
+	child    *TimerGroup
 }
 
 // NewTimerGroup constructs a new TimerGroup.
 func NewTimerGroup() *TimerGroup {
-	return &TimerGroup{timers: map[fmt.Stringer]*Timer{}}
+	return &TimerGroup{
+		timers:   map[fmt.Stringer]*Timer{},
+		counters: map[fmt.Stringer]*Counter{},
+	}
 }
 
 // GetTimer gets (and creates, if necessary) the Timer for a given code section.
@@ -74,6 +106,20 @@ func (t *TimerGroup) GetTimer(name fmt.Stringer) *Timer {
 	return timer
 }
 
+// GetCounter gets (and creates, if necessary) the Counter for a given
+// quantity.
+func (t *TimerGroup) GetCounter(name fmt.Stringer) *Counter {
+	if counter, exists := t.counters[name]; exists {
+		return counter
+	}
+	counter := &Counter{
+		name:    name,
+		created: time.Now(),
+	}
+	t.counters[name] = counter
+	return counter
+}
+
 // Timers is a slice of Timer pointers that implements Len and Swap from
 // sort.Interface.
 type Timers []*Timer
@@ -105,5 +151,21 @@ func (t *TimerGroup) String() string {
 	for _, timer := range timers.Timers {
 		fmt.Fprintf(result, "%s\n", timer)
 	}
+	counters := make([]*Counter, 0, len(t.counters))
+	for _, counter := range t.counters {
+		counters = append(counters, counter)
+	}
+	sort.Sort(countersByCreationTime(counters))
+	for _, counter := range counters {
+		fmt.Fprintf(result, "%s\n", counter)
+	}
 	return result.String()
 }
+
+// countersByCreationTime implements sort.Interface, sorting counters by their
+// creation time.
+type countersByCreationTime []*Counter
+
+func (c countersByCreationTime) Len() int           { return len(c) }
+func (c countersByCreationTime) Less(i, j int) bool { return c[i].created.Before(c[j].created) }
+func (c countersByCreationTime) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
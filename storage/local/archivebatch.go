@@ -0,0 +1,203 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"sync"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/prometheus/storage/local/codable"
+)
+
+const (
+	// archiveMaxBatchSize is the number of pending changes of the archive
+	// indexes that triggers a commit. Otherwise, pending changes are
+	// committed with the next indexing batch timeout.
+	archiveMaxBatchSize = 1024 * 16
+
+	fpToMetricIndexLabel    = "fingerprint_to_metric"
+	fpToTimeRangeIndexLabel = "fingerprint_to_timerange"
+)
+
+// archiveOp is a pending change of the archive indexes for one fingerprint.
+type archiveOp struct {
+	remove      bool // true if the fingerprint is unarchived.
+	hasMetric   bool // false if only the time range is updated.
+	metric      clientmodel.Metric
+	first, last clientmodel.Timestamp
+}
+
+// archiveBatch collects changes of the archive indexes so that they can be
+// written in one LevelDB batch per index instead of one write per change.
+// Lookups have to consult the batch before the indexes. It is goroutine-safe.
+type archiveBatch struct {
+	mtx        sync.Mutex
+	pending    map[clientmodel.Fingerprint]archiveOp
+	committing map[clientmodel.Fingerprint]archiveOp // Being written, nil otherwise.
+
+	commitMtx sync.Mutex    // Serializes commits.
+	full      chan struct{} // Signaled once archiveMaxBatchSize changes are pending.
+
+	queueLength *prometheus.GaugeVec
+	batchSizes  prometheus.Summary
+}
+
+func newArchiveBatch() *archiveBatch {
+	return &archiveBatch{
+		pending: map[clientmodel.Fingerprint]archiveOp{},
+		full:    make(chan struct{}, 1),
+		queueLength: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "archive_index_queue_length",
+				Help:      "The number of changes of the archive indexes waiting to be committed.",
+			},
+			[]string{"index"},
+		),
+		batchSizes: prometheus.NewSummary(prometheus.SummaryOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "archive_index_batch_sizes",
+			Help:      "Quantiles for archive index batch sizes (number of changed fingerprints per batch).",
+		}),
+	}
+}
+
+// put queues op for fp, replacing any change queued before. An update of the
+// time range only keeps a metric queued before for fp.
+func (b *archiveBatch) put(fp clientmodel.Fingerprint, op archiveOp) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if op.hasMetric && op.metric == nil {
+		// Only metrics of fingerprints not archived are looked up as nil.
+		op.metric = clientmodel.Metric{}
+	}
+	if prev, ok := b.pending[fp]; ok && !op.hasMetric && !op.remove && !prev.remove {
+		op.hasMetric, op.metric = prev.hasMetric, prev.metric
+	}
+	b.pending[fp] = op
+	if len(b.pending) >= archiveMaxBatchSize {
+		select {
+		case b.full <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// timeRange returns the time range of fp according to the queued changes. If
+// ok is false, the archive index has to be consulted.
+func (b *archiveBatch) timeRange(fp clientmodel.Fingerprint) (first, last clientmodel.Timestamp, has, ok bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	for _, ops := range []map[clientmodel.Fingerprint]archiveOp{b.pending, b.committing} {
+		if op, found := ops[fp]; found {
+			return op.first, op.last, !op.remove, true
+		}
+	}
+	return 0, 0, false, false
+}
+
+// metric returns the metric of fp according to the queued changes. If ok is
+// false, the archive index has to be consulted.
+func (b *archiveBatch) metric(fp clientmodel.Fingerprint) (m clientmodel.Metric, ok bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	for _, ops := range []map[clientmodel.Fingerprint]archiveOp{b.pending, b.committing} {
+		if op, found := ops[fp]; found {
+			if op.remove {
+				return nil, true
+			}
+			if op.hasMetric {
+				return op.metric, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Describe implements prometheus.Collector.
+func (b *archiveBatch) Describe(ch chan<- *prometheus.Desc) {
+	b.queueLength.Describe(ch)
+	b.batchSizes.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (b *archiveBatch) Collect(ch chan<- prometheus.Metric) {
+	b.mtx.Lock()
+	metricOps := 0
+	for _, op := range b.pending {
+		if op.remove || op.hasMetric {
+			metricOps++
+		}
+	}
+	b.queueLength.WithLabelValues(fpToMetricIndexLabel).Set(float64(metricOps))
+	b.queueLength.WithLabelValues(fpToTimeRangeIndexLabel).Set(float64(len(b.pending)))
+	b.mtx.Unlock()
+
+	b.queueLength.Collect(ch)
+	b.batchSizes.Collect(ch)
+}
+
+// commitArchiveBatch writes the pending changes of the archive indexes. The
+// changes stay visible to lookups while they are written. If writing fails,
+// the persistence is marked dirty. This method is goroutine-safe.
+func (p *persistence) commitArchiveBatch() error {
+	b := p.archiveBatch
+	b.commitMtx.Lock()
+	defer b.commitMtx.Unlock()
+
+	b.mtx.Lock()
+	if len(b.pending) == 0 {
+		b.mtx.Unlock()
+		return nil
+	}
+	ops := b.pending
+	b.committing = ops
+	b.pending = make(map[clientmodel.Fingerprint]archiveOp, len(ops))
+	b.mtx.Unlock()
+
+	b.batchSizes.Observe(float64(len(ops)))
+
+	metricBatch := p.archivedFingerprintToMetrics.NewBatch()
+	timeRangeBatch := p.archivedFingerprintToTimeRange.NewBatch()
+	for fp, op := range ops {
+		if op.remove {
+			metricBatch.Delete(codable.Fingerprint(fp))
+			timeRangeBatch.Delete(codable.Fingerprint(fp))
+			continue
+		}
+		if op.hasMetric {
+			metricBatch.Put(codable.Fingerprint(fp), codable.Metric(op.metric))
+		}
+		timeRangeBatch.Put(codable.Fingerprint(fp), codable.TimeRange{First: op.first, Last: op.last})
+	}
+	err := p.archivedFingerprintToMetrics.Commit(metricBatch)
+	if err == nil {
+		err = p.archivedFingerprintToTimeRange.Commit(timeRangeBatch)
+	}
+	if err != nil {
+		p.setDirty(true)
+	}
+
+	b.mtx.Lock()
+	b.committing = nil
+	b.mtx.Unlock()
+	return err
+}
@@ -0,0 +1,251 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+// backfillResult describes the rewrite of a series file by backfillSeriesFile.
+type backfillResult struct {
+	chunksBefore, chunksAfter int                   // Number of rewritten chunks.
+	firstTime, lastTime       clientmodel.Timestamp // Of the rewritten chunks.
+	samplesWritten            int
+}
+
+// mergeIntoChunks re-encodes the samples of the given chunks together with the
+// given samples, which must be sorted by timestamp, into as few chunks as
+// possible. Samples with the timestamp of a sample in the chunks are
+// skipped. The resulting chunks have the given encoding. It returns them and
+// the number of samples merged.
+func mergeIntoChunks(chunks []chunk, samples metric.Values, encoding ChunkEncoding) ([]chunk, int) {
+	merged := []chunk{newChunkForEncoding(encoding)}
+	add := func(v *metric.SamplePair) {
+		head := merged[len(merged)-1]
+		merged = append(merged[:len(merged)-1], head.add(v)...)
+	}
+	written := 0
+	for _, c := range chunks {
+		it := c.newIterator()
+		for batch := it.nextBatch(); batch != nil; batch = it.nextBatch() {
+			for i := range batch {
+				for len(samples) > 0 && !samples[0].Timestamp.After(batch[i].Timestamp) {
+					if samples[0].Timestamp.Before(batch[i].Timestamp) {
+						add(&samples[0])
+						written++
+					}
+					samples = samples[1:]
+				}
+				add(&batch[i])
+			}
+		}
+	}
+	for i := range samples {
+		add(&samples[i])
+		written++
+	}
+	return merged, written
+}
+
+// backfillSeriesFile merges the given samples, which must be sorted by
+// timestamp, into the first n chunks of the series file of the given
+// fingerprint (or into all its chunks if n is negative), and rewrites the file
+// with the merged chunks, followed by the remaining chunks unchanged. A missing
+// series file is created. The file is not touched if no sample is left to be
+// merged. The caller must have locked the fingerprint.
+func (p *persistence) backfillSeriesFile(fp clientmodel.Fingerprint, n int, samples metric.Values) (r backfillResult, err error) {
+	defer func() {
+		if err != nil {
+			p.setDirty(true)
+		}
+	}()
+
+	var chunks []chunk
+	f, err := p.openChunkFileForReading(fp)
+	switch {
+	case os.IsNotExist(err):
+		f = nil
+	case err != nil:
+		return r, err
+	default:
+		defer f.Close()
+
+		fi, err := f.Stat()
+		if err != nil {
+			return r, err
+		}
+		numChunks := int(fi.Size() / int64(p.chunkRecordLen()))
+		if n < 0 || n > numChunks {
+			n = numChunks
+		}
+		if chunks, err = p.readChunks(f, n); err != nil {
+			return r, err
+		}
+	}
+
+	merged, written := mergeIntoChunks(chunks, samples, p.chunkEncoding)
+	if written == 0 {
+		return r, nil
+	}
+
+	p.logSeriesChange(fp)
+	if err := os.MkdirAll(p.dirNameForFingerprint(fp), 0700); err != nil {
+		return r, err
+	}
+	temp, err := os.OpenFile(p.tempFileNameForFingerprint(fp), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return r, err
+	}
+	if err := p.writeChunks(temp, merged); err != nil {
+		temp.Close()
+		return r, err
+	}
+	if f != nil {
+		// The file position of f is right after the merged chunks.
+		if _, err := io.Copy(temp, f); err != nil {
+			temp.Close()
+			return r, err
+		}
+	}
+	p.closeChunkFile(temp)
+	if err := os.Rename(p.tempFileNameForFingerprint(fp), p.fileNameForFingerprint(fp)); err != nil {
+		return r, err
+	}
+	p.invalidateChunkCache(fp)
+
+	return backfillResult{
+		chunksBefore:   len(chunks),
+		chunksAfter:    len(merged),
+		firstTime:      merged[0].firstTime(),
+		lastTime:       merged[len(merged)-1].lastTime(),
+		samplesWritten: written,
+	}, nil
+}
+
+// valuesByTimestamp implements sort.Interface, sorting by ascending Timestamp.
+type valuesByTimestamp metric.Values
+
+func (v valuesByTimestamp) Len() int           { return len(v) }
+func (v valuesByTimestamp) Less(i, j int) bool { return v[i].Timestamp.Before(v[j].Timestamp) }
+func (v valuesByTimestamp) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+
+// Backfill implements Storage.
+func (s *memorySeriesStorage) Backfill(samples clientmodel.Samples) (int, error) {
+	type backfillSeries struct {
+		metric clientmodel.Metric
+		values metric.Values
+	}
+	bySeries := map[string]*backfillSeries{}
+	for _, sample := range samples {
+		key := metricToUniqueString(sample.Metric)
+		bs, ok := bySeries[key]
+		if !ok {
+			bs = &backfillSeries{metric: sample.Metric}
+			bySeries[key] = bs
+		}
+		bs.values = append(bs.values, metric.SamplePair{Timestamp: sample.Timestamp, Value: sample.Value})
+	}
+
+	written := 0
+	for _, bs := range bySeries {
+		sort.Stable(valuesByTimestamp(bs.values))
+		// Of samples with the same timestamp, the first one wins.
+		deduped := bs.values[:0]
+		for i, v := range bs.values {
+			if i == 0 || v.Timestamp.After(deduped[len(deduped)-1].Timestamp) {
+				deduped = append(deduped, v)
+			}
+		}
+		n, err := s.backfillSeries(bs.metric, deduped)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// backfillSeries writes the given samples, sorted by timestamp and with unique
+// timestamps, to the series file of the given metric. For a series in memory,
+// only samples older than its chunks in memory are written, as the chunkDescs
+// refer to chunks by their position in the series file. It returns the number
+// of samples written.
+func (s *memorySeriesStorage) backfillSeries(m clientmodel.Metric, values metric.Values) (int, error) {
+	rawFP := m.Fingerprint()
+	s.fpLocker.Lock(rawFP)
+	fp, err := s.mapper.mapFP(rawFP, m)
+	if err != nil {
+		s.fpLocker.Unlock(rawFP)
+		return 0, err
+	}
+	if fp != rawFP {
+		// Switch locks.
+		s.fpLocker.Unlock(rawFP)
+		s.fpLocker.Lock(fp)
+	}
+	defer s.fpLocker.Unlock(fp)
+
+	n := -1
+	series, inMemory := s.fpToSeries.get(fp)
+	archived := false
+	if inMemory {
+		// A chunkDescsOffset of -1 means unknown.
+		if series.chunkDescsOffset < 0 || len(series.chunkDescs) == 0 {
+			return 0, fmt.Errorf("cannot backfill series %v while the position of its chunks in memory is unknown", m)
+		}
+		limit := series.chunkDescs[0].firstTime()
+		values = values[:sort.Search(len(values), func(i int) bool {
+			return !values[i].Timestamp.Before(limit)
+		})]
+		n = series.chunkDescsOffset
+	} else if archived, _, _, err = s.persistence.hasArchivedMetric(fp); err != nil {
+		return 0, err
+	}
+	if len(values) == 0 {
+		return 0, nil
+	}
+
+	r, err := s.persistence.backfillSeriesFile(fp, n, values)
+	if err != nil || r.samplesWritten == 0 {
+		return 0, err
+	}
+	switch {
+	case inMemory:
+		// All chunks before the ones in memory have been rewritten, so
+		// the first of them is the first chunk of the series.
+		series.chunkDescsOffset = r.chunksAfter
+		series.savedFirstTime = r.firstTime
+		series.modTime = s.persistence.getSeriesFileModTime(fp)
+		series.dirty = true
+	case archived:
+		if err := s.persistence.updateArchivedTimeRange(fp, r.firstTime, r.lastTime); err != nil {
+			return r.samplesWritten, err
+		}
+	default:
+		// A genuinely new series is indexed and archived right away.
+		s.persistence.indexMetric(fp, m)
+		if err := s.persistence.archiveMetric(fp, m, r.firstTime, r.lastTime); err != nil {
+			return r.samplesWritten, err
+		}
+	}
+	s.seriesOps.WithLabelValues(backfill).Inc()
+	return r.samplesWritten, nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/local/codable"
+	"github.com/prometheus/prometheus/storage/local/index"
+)
+
+// fingerprintFilterHashes is the number of bits set per fingerprint in a
+// fingerprintFilter. With 4 hashes, the false positive rate stays below 2.5%
+// as long as the filter has at least 8 bits per fingerprint added.
+const fingerprintFilterHashes = 4
+
+// fingerprintFilter is a bloom filter over fingerprints. As fingerprints are
+// hashes already, the bit positions are derived from the fingerprint itself by
+// double hashing. Fingerprints cannot be removed, so the false positive rate
+// grows with every fingerprint ever added. All methods are goroutine-safe.
+type fingerprintFilter struct {
+	mtx  sync.RWMutex
+	bits []uint64
+
+	negatives prometheus.Counter
+}
+
+// newFingerprintFilter returns an empty fingerprintFilter of the given size in
+// bytes (rounded up to a multiple of 8).
+func newFingerprintFilter(sizeBytes int) *fingerprintFilter {
+	return &fingerprintFilter{
+		bits: make([]uint64, (sizeBytes+7)/8),
+		negatives: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "archived_fingerprint_filter_negatives_total",
+			Help:      "The total number of lookups in the archive indexes avoided because the bloom filter over archived fingerprints ruled them out.",
+		}),
+	}
+}
+
+// positions calls fn with the word index and bit mask of each bit position for
+// fp.
+func (f *fingerprintFilter) positions(fp clientmodel.Fingerprint, fn func(word int, mask uint64)) {
+	numBits := uint64(len(f.bits)) * 64
+	h1, h2 := uint64(fp), uint64(fp>>32)|1
+	for i := uint64(0); i < fingerprintFilterHashes; i++ {
+		pos := (h1 + i*h2) % numBits
+		fn(int(pos/64), 1<<(pos%64))
+	}
+}
+
+// add adds fp to the filter.
+func (f *fingerprintFilter) add(fp clientmodel.Fingerprint) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+
+	f.positions(fp, func(word int, mask uint64) {
+		f.bits[word] |= mask
+	})
+}
+
+// mayContain returns false if fp has definitely not been added to the filter.
+func (f *fingerprintFilter) mayContain(fp clientmodel.Fingerprint) bool {
+	f.mtx.RLock()
+	defer f.mtx.RUnlock()
+
+	contained := true
+	f.positions(fp, func(word int, mask uint64) {
+		if f.bits[word]&mask == 0 {
+			contained = false
+		}
+	})
+	if !contained {
+		f.negatives.Inc()
+	}
+	return contained
+}
+
+// addFromIndex adds all fingerprints used as keys in the given index to the
+// filter and returns their number.
+func (f *fingerprintFilter) addFromIndex(kvs index.KeyValueStore) (int, error) {
+	var (
+		fp    codable.Fingerprint
+		count int
+	)
+	err := kvs.ForEach(func(kv index.KeyValueAccessor) error {
+		if err := kv.Key(&fp); err != nil {
+			return err
+		}
+		f.add(clientmodel.Fingerprint(fp))
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// Describe implements prometheus.Collector.
+func (f *fingerprintFilter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- f.negatives.Desc()
+}
+
+// Collect implements prometheus.Collector.
+func (f *fingerprintFilter) Collect(ch chan<- prometheus.Metric) {
+	ch <- f.negatives
+}
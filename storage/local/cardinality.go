@@ -0,0 +1,136 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/golang/glog"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/local/codable"
+	"github.com/prometheus/prometheus/storage/local/index"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+// setSize is an encoding.BinaryUnmarshaler that only decodes the number of
+// elements of a codable.FingerprintSet or codable.LabelValueSet, which both
+// start with it as a varint. It spares decoding the elements themselves.
+type setSize int
+
+func (s *setSize) UnmarshalBinary(buf []byte) error {
+	n, offset := binary.Varint(buf)
+	if offset <= 0 {
+		return fmt.Errorf("could not decode size of set, varint decoding returned %d", offset)
+	}
+	*s = setSize(n)
+	return nil
+}
+
+// topCardinalities keeps the n LabelCardinalities with the highest Count. It
+// implements heap.Interface as a min-heap, so that the lowest Count kept can be
+// replaced cheaply.
+type topCardinalities struct {
+	n     int
+	items []LabelCardinality
+}
+
+func (t *topCardinalities) Len() int           { return len(t.items) }
+func (t *topCardinalities) Less(i, j int) bool { return t.items[i].Count < t.items[j].Count }
+func (t *topCardinalities) Swap(i, j int)      { t.items[i], t.items[j] = t.items[j], t.items[i] }
+
+func (t *topCardinalities) Push(x interface{}) {
+	t.items = append(t.items, x.(LabelCardinality))
+}
+
+func (t *topCardinalities) Pop() interface{} {
+	last := t.items[len(t.items)-1]
+	t.items = t.items[:len(t.items)-1]
+	return last
+}
+
+// add adds lc if it is among the n highest counts seen so far.
+func (t *topCardinalities) add(lc LabelCardinality) {
+	if len(t.items) < t.n {
+		heap.Push(t, lc)
+		return
+	}
+	if t.n > 0 && lc.Count > t.items[0].Count {
+		t.items[0] = lc
+		heap.Fix(t, 0)
+	}
+}
+
+// sorted returns the kept LabelCardinalities sorted by descending Count.
+func (t *topCardinalities) sorted() []LabelCardinality {
+	sort.Sort(sort.Reverse(t))
+	return t.items
+}
+
+// cardinalities iterates through the label indexes and returns the n label
+// names with the most values, the n label pairs with the most fingerprints,
+// and, among the latter, the n metric names with the most fingerprints. It
+// covers series in memory as well as archived series. As the indexes are
+// updated asynchronously, the result might lag behind.
+func (p *persistence) cardinalities(n int) (*CardinalityStats, error) {
+	labelNames := &topCardinalities{n: n}
+	labelPairs := &topCardinalities{n: n}
+	metricNames := &topCardinalities{n: n}
+
+	var (
+		ln   codable.LabelName
+		size setSize
+	)
+	if err := p.labelNameToLabelValues.ForEach(func(kv index.KeyValueAccessor) error {
+		if err := kv.Key(&ln); err != nil {
+			return err
+		}
+		if err := kv.Value(&size); err != nil {
+			return err
+		}
+		labelNames.add(LabelCardinality{Name: clientmodel.LabelName(ln), Count: int(size)})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := p.labelPairToFingerprints.ForEach(func(lp metric.LabelPair, numFPs int) error {
+		lc := LabelCardinality{Name: lp.Name, Value: lp.Value, Count: numFPs}
+		labelPairs.add(lc)
+		if lp.Name == clientmodel.MetricNameLabel {
+			metricNames.add(lc)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return &CardinalityStats{
+		LabelNames:  labelNames.sorted(),
+		LabelPairs:  labelPairs.sorted(),
+		MetricNames: metricNames.sorted(),
+	}, nil
+}
+
+// GetCardinalityStats implements Storage.
+func (s *memorySeriesStorage) GetCardinalityStats(n int) (*CardinalityStats, error) {
+	stats, err := s.persistence.cardinalities(n)
+	if err != nil {
+		glog.Error("Error iterating through label indexes: ", err)
+	}
+	return stats, err
+}
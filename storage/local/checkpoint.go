@@ -0,0 +1,361 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/local/codable"
+)
+
+// seriesRemoved records that the series with the given fingerprint has been
+// removed from memory (by archiving or purging it), so that the next
+// incremental checkpoint can remove it, too.
+func (p *persistence) seriesRemoved(fp clientmodel.Fingerprint) {
+	p.removedMtx.Lock()
+	defer p.removedMtx.Unlock()
+
+	p.removedFPs[fp] = struct{}{}
+}
+
+// takeRemovedFPs returns the fingerprints recorded by seriesRemoved so far and
+// starts recording anew.
+func (p *persistence) takeRemovedFPs() map[clientmodel.Fingerprint]struct{} {
+	p.removedMtx.Lock()
+	defer p.removedMtx.Unlock()
+
+	removed := p.removedFPs
+	p.removedFPs = map[clientmodel.Fingerprint]struct{}{}
+	return removed
+}
+
+// incrementalCheckpointTooLarge returns true if the incremental heads file has
+// grown at least as large as the heads file it is based on (or if there is no
+// heads file to base it on), in which case a full checkpoint is cheaper to load
+// and compacts away all the outdated versions of series.
+func (p *persistence) incrementalCheckpointTooLarge() bool {
+	headsInfo, err := os.Stat(p.headsFileName())
+	if err != nil {
+		return true
+	}
+	incInfo, err := os.Stat(p.headsIncrementalFileName())
+	if os.IsNotExist(err) {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	return incInfo.Size() >= headsInfo.Size()
+}
+
+// checkpointIncremental appends the series that have changed since the last
+// checkpoint to the incremental heads file, together with the fingerprints of
+// the series removed from memory in the meantime. It must only be called by
+// checkpointSeriesMapAndHeads after a full checkpoint has been written. If it
+// fails, the next checkpoint will be a full one again.
+//
+// Description of the file format:
+//
+// (1) Magic string (const headsIncrementalMagicString).
+//
+// (2) Varint-encoded format version (const headsIncrementalFormatVersion).
+//
+// (3) The size of the heads file the incremental file is based on as
+// big-endian uint64.
+//
+// (4) The modification time of that heads file as nanoseconds elapsed since
+// January 1, 1970 UTC, as big-endian uint64.
+//
+// (5) Repeated once per incremental checkpoint (a batch):
+//
+// (5.1) Number of removed series as big-endian uint64.
+//
+// (5.2) The fingerprint of each removed series as big-endian uint64.
+//
+// (5.3) Number of series in the batch as big-endian uint64. It is only written
+// once the batch is complete. Until then, it is math.MaxUint64.
+//
+// (5.4) Each series in the batch, exactly as in the heads file (see
+// checkpointSeriesMapAndHeads, item (4)).
+//
+// Upon loading, the removals of a batch are applied before its series, as a
+// series removed and added again since the previous batch appears in both.
+func (p *persistence) checkpointIncremental(fingerprintToSeries *seriesMap, fpLocker *fingerprintLocker) (err error) {
+	glog.Info("Checkpointing changed in-memory metrics and chunks incrementally...")
+	begin := time.Now()
+	var walSegment int
+	if p.wal != nil {
+		if walSegment, err = p.wal.rotate(); err != nil {
+			return
+		}
+	}
+	removed := p.takeRemovedFPs()
+
+	f, err := os.OpenFile(p.headsIncrementalFileName(), os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		p.fullCheckpointDone = false
+		return
+	}
+	batchOffset, err := f.Seek(0, os.SEEK_END)
+	if err != nil {
+		f.Close()
+		p.fullCheckpointDone = false
+		return
+	}
+
+	var numberOfSeries uint64
+	defer func() {
+		if err == nil {
+			err = p.syncFile(f)
+		}
+		if err != nil {
+			// Cut off the incomplete batch and make sure the series
+			// and removals lost with it end up in the next
+			// checkpoint by making it a full one.
+			f.Truncate(batchOffset)
+			f.Close()
+			p.fullCheckpointDone = false
+			return
+		}
+		p.evictFromPageCache(f)
+		if err = f.Close(); err != nil {
+			p.fullCheckpointDone = false
+			return
+		}
+		if p.wal != nil {
+			err = p.wal.removeSegmentsBefore(walSegment)
+		}
+		duration := time.Since(begin)
+		p.checkpointDuration.Set(float64(duration) / float64(time.Millisecond))
+		glog.Infof(
+			"Done checkpointing %d changed and %d removed in-memory metrics incrementally in %v.",
+			numberOfSeries, len(removed), duration,
+		)
+	}()
+
+	w := bufio.NewWriterSize(p.ioThrottle.writer(f), fileBufSize)
+	if batchOffset == 0 {
+		if err = p.writeHeadsIncrementalHeader(w); err != nil {
+			return
+		}
+	}
+	if err = codable.EncodeUint64(w, uint64(len(removed))); err != nil {
+		return
+	}
+	for fp := range removed {
+		if err = codable.EncodeUint64(w, uint64(fp)); err != nil {
+			return
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return
+	}
+	numberOfSeriesOffset, err := f.Seek(0, os.SEEK_CUR)
+	if err != nil {
+		return
+	}
+	if err = codable.EncodeUint64(w, math.MaxUint64); err != nil {
+		return
+	}
+
+	iter := fingerprintToSeries.iter()
+	defer func() {
+		// Consume the iterator in any case to not leak goroutines.
+		for range iter {
+		}
+	}()
+
+	for m := range iter {
+		func() { // Wrapped in function to use defer for unlocking the fp.
+			fpLocker.Lock(m.fp)
+			defer fpLocker.Unlock(m.fp)
+
+			if len(m.series.chunkDescs) == 0 {
+				// This series was completely purged or archived in the meantime. Ignore.
+				return
+			}
+			if !m.series.dirty && m.series.checkpointState() == m.series.checkpointed {
+				return
+			}
+			numberOfSeries++
+			err = p.writeCheckpointedSeries(w, m.fp, m.series)
+		}()
+		if err != nil {
+			return
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return
+	}
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, numberOfSeries)
+	_, err = f.WriteAt(buf, numberOfSeriesOffset)
+	return
+}
+
+// writeHeadsIncrementalHeader writes items (1) to (4) of the incremental heads
+// file, see checkpointIncremental.
+func (p *persistence) writeHeadsIncrementalHeader(w *bufio.Writer) error {
+	fi, err := os.Stat(p.headsFileName())
+	if err != nil {
+		return err
+	}
+	if _, err := w.WriteString(headsIncrementalMagicString); err != nil {
+		return err
+	}
+	if _, err := codable.EncodeVarint(w, headsIncrementalFormatVersion); err != nil {
+		return err
+	}
+	if err := codable.EncodeUint64(w, uint64(fi.Size())); err != nil {
+		return err
+	}
+	return codable.EncodeUint64(w, uint64(fi.ModTime().UnixNano()))
+}
+
+// loadHeadsIncremental applies the incremental heads file (if any) to the
+// series loaded from the heads file described by headsInfo. It returns the
+// changes of the number of chunks not persisted yet and of the total number of
+// chunkDescs. A batch is only applied once it has been read completely. An
+// incremental heads file that is based on a different heads file is ignored. If
+// the file is unreadable or corrupt, p.dirty is set.
+func (p *persistence) loadHeadsIncremental(
+	fingerprintToSeries map[clientmodel.Fingerprint]*memorySeries,
+	headsInfo os.FileInfo,
+) (chunksToPersist, chunkDescsTotal int64) {
+	f, err := os.Open(p.headsIncrementalFileName())
+	if os.IsNotExist(err) {
+		return 0, 0
+	}
+	if err != nil {
+		glog.Warning("Could not open incremental heads file:", err)
+		p.dirty = true
+		return 0, 0
+	}
+	defer f.Close()
+	r := bufio.NewReaderSize(f, fileBufSize)
+
+	if err := checkHeadsIncrementalHeader(r, headsInfo); err != nil {
+		glog.Warning("Ignoring incremental heads file: ", err)
+		return 0, 0
+	}
+
+	remove := func(fp clientmodel.Fingerprint) {
+		if old, ok := fingerprintToSeries[fp]; ok {
+			chunkDescsTotal -= int64(old.persistWatermark)
+			chunksToPersist -= int64(len(old.chunkDescs) - old.persistWatermark)
+			delete(fingerprintToSeries, fp)
+		}
+	}
+	for numBatches := 0; ; numBatches++ {
+		if _, err := r.Peek(1); err == io.EOF {
+			glog.Infof("Applied %d incremental checkpoints.", numBatches)
+			return
+		}
+		removed, fps, series, err := p.readHeadsIncrementalBatch(r)
+		if err != nil {
+			glog.Warningf("Could not read incremental checkpoint %d: %s", numBatches, err)
+			p.dirty = true
+			return
+		}
+		for _, fp := range removed {
+			remove(fp)
+		}
+		for i, fp := range fps {
+			remove(fp)
+			s := series[i]
+			chunkDescsTotal += int64(s.persistWatermark)
+			chunksToPersist += int64(len(s.chunkDescs) - s.persistWatermark)
+			fingerprintToSeries[fp] = s
+		}
+	}
+}
+
+// checkHeadsIncrementalHeader reads items (1) to (4) of the incremental heads
+// file and returns an error if they are invalid or do not match the heads file
+// described by headsInfo.
+func checkHeadsIncrementalHeader(r *bufio.Reader, headsInfo os.FileInfo) error {
+	buf := make([]byte, len(headsIncrementalMagicString))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+	if magic := string(buf); magic != headsIncrementalMagicString {
+		return fmt.Errorf(
+			"unexpected magic string, want %q, got %q",
+			headsIncrementalMagicString, magic,
+		)
+	}
+	version, err := binary.ReadVarint(r)
+	if err != nil {
+		return err
+	}
+	if version != headsIncrementalFormatVersion {
+		return fmt.Errorf("unknown format version %d, want %d", version, headsIncrementalFormatVersion)
+	}
+	size, err := codable.DecodeUint64(r)
+	if err != nil {
+		return err
+	}
+	modTime, err := codable.DecodeUint64(r)
+	if err != nil {
+		return err
+	}
+	if int64(size) != headsInfo.Size() || int64(modTime) != headsInfo.ModTime().UnixNano() {
+		return fmt.Errorf("based on a different heads file")
+	}
+	return nil
+}
+
+// readHeadsIncrementalBatch reads one batch of the incremental heads file, see
+// checkpointIncremental, item (5).
+func (p *persistence) readHeadsIncrementalBatch(r *bufio.Reader) (
+	removed, fps []clientmodel.Fingerprint, series []*memorySeries, err error,
+) {
+	numRemoved, err := codable.DecodeUint64(r)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("could not decode number of removed series: %s", err)
+	}
+	for ; numRemoved > 0; numRemoved-- {
+		fp, err := codable.DecodeUint64(r)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("could not decode removed fingerprint: %s", err)
+		}
+		removed = append(removed, clientmodel.Fingerprint(fp))
+	}
+	numSeries, err := codable.DecodeUint64(r)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("could not decode number of series: %s", err)
+	}
+	if numSeries == math.MaxUint64 {
+		return nil, nil, nil, fmt.Errorf("incomplete batch")
+	}
+	for ; numSeries > 0; numSeries-- {
+		fp, s, err := p.readCheckpointedSeries(r, headsFormatVersion)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		fps = append(fps, fp)
+		series = append(series, s)
+	}
+	return removed, fps, series, nil
+}
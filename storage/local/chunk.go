@@ -15,7 +15,6 @@ package local
 
 import (
 	"container/list"
-	"flag"
 	"fmt"
 	"io"
 	"sync"
@@ -26,17 +25,45 @@ import (
 	"github.com/prometheus/prometheus/storage/metric"
 )
 
-var (
-	defaultChunkEncoding = flag.Int("storage.local.chunk-encoding-version", 1, "Which chunk encoding version to use for newly created chunks. Currently supported is 0 (delta encoding) and 1 (double-delta encoding).")
-)
+// chunkIteratorBatchSize is the maximum number of sample values returned by
+// one call of chunkIterator.nextBatch.
+const chunkIteratorBatchSize = 128
 
-type chunkEncoding byte
+// ChunkEncoding is the encoding of a chunk. It is persisted as the first byte
+// of each chunk in a series file, so the values of existing encodings must
+// never change.
+type ChunkEncoding byte
 
+// The supported chunk encodings.
 const (
-	delta chunkEncoding = iota
-	doubleDelta
+	Delta ChunkEncoding = iota
+	DoubleDelta
+	Varbit
 )
 
+// DefaultChunkEncoding is the encoding the Prometheus server uses for newly
+// created chunks by default.
+const DefaultChunkEncoding = DoubleDelta
+
+// String implements fmt.Stringer.
+func (e ChunkEncoding) String() string {
+	switch e {
+	case Delta:
+		return "delta"
+	case DoubleDelta:
+		return "double-delta"
+	case Varbit:
+		return "varbit"
+	default:
+		return fmt.Sprintf("%d", byte(e))
+	}
+}
+
+// valid returns whether chunks of the encoding can be created.
+func (e ChunkEncoding) valid() bool {
+	return e <= Varbit
+}
+
 // chunkDesc contains meta-data for a chunk. Many of its methods are
 // goroutine-safe proxies for chunk methods.
 type chunkDesc struct {
@@ -193,11 +220,12 @@ type chunk interface {
 	marshal(io.Writer) error
 	unmarshal(io.Reader) error
 	unmarshalFromBuf([]byte)
-	encoding() chunkEncoding
+	encoding() ChunkEncoding
 	// values returns a channel, from which all sample values in the chunk
 	// can be received in order. The channel is closed after the last
 	// one. It is generally not safe to mutate the chunk while the channel
-	// is still open.
+	// is still open. Sending each value individually is expensive, so
+	// prefer chunkIterator.nextBatch where performance matters.
 	values() <-chan *metric.SamplePair
 }
 
@@ -216,6 +244,17 @@ type chunkIterator interface {
 	// Whether a given timestamp is contained between first and last value
 	// in the chunk.
 	contains(clientmodel.Timestamp) bool
+	// reverseValues returns a channel, from which all sample values in the
+	// chunk can be received in reverse order, i.e. the most recent one
+	// first. The channel is closed after the oldest one. As the channel is
+	// filled completely before it is returned, receiving can be stopped at
+	// any time, and the chunk may be mutated afterwards.
+	reverseValues() <-chan *metric.SamplePair
+	// nextBatch returns the next batch of at most chunkIteratorBatchSize
+	// sample values in the chunk, starting with the oldest one, or nil
+	// once all values have been returned. The returned slice must not be
+	// modified.
+	nextBatch() metric.Values
 }
 
 func transcodeAndAdd(dst chunk, src chunk, s *metric.SamplePair) []chunk {
@@ -223,27 +262,58 @@ func transcodeAndAdd(dst chunk, src chunk, s *metric.SamplePair) []chunk {
 
 	head := dst
 	body := []chunk{}
-	for v := range src.values() {
-		newChunks := head.add(v)
-		body = append(body, newChunks[:len(newChunks)-1]...)
-		head = newChunks[len(newChunks)-1]
+	it := src.newIterator()
+	for batch := it.nextBatch(); batch != nil; batch = it.nextBatch() {
+		for i := range batch {
+			newChunks := head.add(&batch[i])
+			body = append(body, newChunks[:len(newChunks)-1]...)
+			head = newChunks[len(newChunks)-1]
+		}
 	}
 	newChunks := head.add(s)
 	return append(body, newChunks...)
 }
 
-// newChunk creates a new chunk according to the encoding set by the
-// defaultChunkEncoding flag.
-func newChunk() chunk {
-	return newChunkForEncoding(chunkEncoding(*defaultChunkEncoding))
+// insertAndReencode re-encodes the samples of c into a new chunk of the same
+// encoding, with s inserted in timestamp order. Like chunk.add, it returns the
+// new version of c, followed by overflow chunks, if any. It returns nil if c
+// already contains a sample with the timestamp of s.
+func insertAndReencode(c chunk, s *metric.SamplePair) []chunk {
+	chunkOps.WithLabelValues(reorder).Inc()
+
+	chunks := []chunk{newChunkForEncoding(c.encoding())}
+	add := func(v *metric.SamplePair) {
+		head := chunks[len(chunks)-1]
+		chunks = append(chunks[:len(chunks)-1], head.add(v)...)
+	}
+	inserted := false
+	it := c.newIterator()
+	for batch := it.nextBatch(); batch != nil; batch = it.nextBatch() {
+		for i := range batch {
+			if !inserted && !s.Timestamp.After(batch[i].Timestamp) {
+				if s.Timestamp.Equal(batch[i].Timestamp) {
+					return nil
+				}
+				add(s)
+				inserted = true
+			}
+			add(&batch[i])
+		}
+	}
+	if !inserted {
+		add(s)
+	}
+	return chunks
 }
 
-func newChunkForEncoding(encoding chunkEncoding) chunk {
+func newChunkForEncoding(encoding ChunkEncoding) chunk {
 	switch encoding {
-	case delta:
+	case Delta:
 		return newDeltaEncodedChunk(d1, d0, true, chunkLen)
-	case doubleDelta:
+	case DoubleDelta:
 		return newDoubleDeltaEncodedChunk(d1, d0, true, chunkLen)
+	case Varbit:
+		return newVarbitEncodedChunk(chunkLen)
 	default:
 		panic(fmt.Errorf("unknown chunk encoding: %v", encoding))
 	}
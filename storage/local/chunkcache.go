@@ -0,0 +1,162 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+type chunkCacheKey struct {
+	fp    clientmodel.Fingerprint
+	index int
+}
+
+type chunkCacheEntry struct {
+	key   chunkCacheKey
+	chunk chunk
+}
+
+// chunkCache is an LRU cache of chunks loaded from series files, keyed by
+// fingerprint and index of the chunk within the series file, and bounded by
+// the total size of the cached chunks. Chunks in series files are never
+// modified, so cached chunks can be handed out to any number of callers. But
+// whenever chunks in a series file change their index (or the file is
+// deleted), the cache has to be invalidated for the fingerprint. All methods
+// are goroutine-safe.
+type chunkCache struct {
+	mtx      sync.Mutex
+	capacity int        // In chunks.
+	lru      *list.List // Most recently used at the front.
+	entries  map[chunkCacheKey]*list.Element
+	// The cached indexes per fingerprint, for invalidation.
+	indexes map[clientmodel.Fingerprint]map[int]struct{}
+
+	hits, misses prometheus.Counter
+	cachedBytes  prometheus.Gauge
+}
+
+// newChunkCache returns a chunkCache holding at most sizeBytes worth of
+// chunks.
+func newChunkCache(sizeBytes int) *chunkCache {
+	return &chunkCache{
+		capacity: sizeBytes / chunkLen,
+		lru:      list.New(),
+		entries:  map[chunkCacheKey]*list.Element{},
+		indexes:  map[clientmodel.Fingerprint]map[int]struct{}{},
+
+		hits: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "chunk_cache_hits_total",
+			Help:      "The total number of chunk loads served from the chunk cache.",
+		}),
+		misses: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "chunk_cache_misses_total",
+			Help:      "The total number of chunk loads not found in the chunk cache and thus read from disk.",
+		}),
+		cachedBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "chunk_cache_bytes",
+			Help:      "The current size of the chunks in the chunk cache.",
+		}),
+	}
+}
+
+// get returns the cached chunk with the given index in the series file of the
+// given fingerprint and marks it as most recently used.
+func (c *chunkCache) get(fp clientmodel.Fingerprint, index int) (chunk, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	e, ok := c.entries[chunkCacheKey{fp: fp, index: index}]
+	if !ok {
+		c.misses.Inc()
+		return nil, false
+	}
+	c.hits.Inc()
+	c.lru.MoveToFront(e)
+	return e.Value.(*chunkCacheEntry).chunk, true
+}
+
+// put adds a chunk loaded from the series file of the given fingerprint to
+// the cache, evicting the least recently used chunks if the cache is full.
+func (c *chunkCache) put(fp clientmodel.Fingerprint, index int, ch chunk) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.capacity <= 0 {
+		return
+	}
+	key := chunkCacheKey{fp: fp, index: index}
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*chunkCacheEntry).chunk = ch
+		c.lru.MoveToFront(e)
+		return
+	}
+	for c.lru.Len() >= c.capacity {
+		c.remove(c.lru.Back())
+	}
+	c.entries[key] = c.lru.PushFront(&chunkCacheEntry{key: key, chunk: ch})
+	idxs, ok := c.indexes[fp]
+	if !ok {
+		idxs = map[int]struct{}{}
+		c.indexes[fp] = idxs
+	}
+	idxs[index] = struct{}{}
+	c.cachedBytes.Set(float64(c.lru.Len() * chunkLen))
+}
+
+// invalidate removes all cached chunks of the given fingerprint.
+func (c *chunkCache) invalidate(fp clientmodel.Fingerprint) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for index := range c.indexes[fp] {
+		c.remove(c.entries[chunkCacheKey{fp: fp, index: index}])
+	}
+	c.cachedBytes.Set(float64(c.lru.Len() * chunkLen))
+}
+
+// remove removes an entry from the cache. The caller must hold c.mtx.
+func (c *chunkCache) remove(e *list.Element) {
+	key := c.lru.Remove(e).(*chunkCacheEntry).key
+	delete(c.entries, key)
+	idxs := c.indexes[key.fp]
+	delete(idxs, key.index)
+	if len(idxs) == 0 {
+		delete(c.indexes, key.fp)
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *chunkCache) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.hits.Desc()
+	ch <- c.misses.Desc()
+	ch <- c.cachedBytes.Desc()
+}
+
+// Collect implements prometheus.Collector.
+func (c *chunkCache) Collect(ch chan<- prometheus.Metric) {
+	ch <- c.hits
+	ch <- c.misses
+	ch <- c.cachedBytes
+}
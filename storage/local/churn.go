@@ -0,0 +1,127 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"sort"
+	"sync"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Labels of seriesChurnDesc. The values of churnTypeLabel are the op-types
+// create and archive of seriesOps.
+const (
+	metricNameLabel = "metric_name"
+	churnTypeLabel  = "type"
+)
+
+var seriesChurnDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, subsystem, "series_churn_total"),
+	"The total number of series created (i.e. not unarchived) and archived, by metric name.",
+	[]string{metricNameLabel, churnTypeLabel}, nil,
+)
+
+// seriesChurn counts the series created and archived per metric name since the
+// storage was started. Metric names with many created and archived series
+// typically have a label with ever-changing values, which bloats the archive
+// indexes. All methods are goroutine-safe.
+type seriesChurn struct {
+	mtx          sync.Mutex
+	byMetricName map[clientmodel.LabelValue]*SeriesChurn
+}
+
+func newSeriesChurn() *seriesChurn {
+	return &seriesChurn{byMetricName: map[clientmodel.LabelValue]*SeriesChurn{}}
+}
+
+// get returns the SeriesChurn of the metric name of m. The caller must hold
+// the mutex.
+func (c *seriesChurn) get(m clientmodel.Metric) *SeriesChurn {
+	name := m[clientmodel.MetricNameLabel]
+	sc, ok := c.byMetricName[name]
+	if !ok {
+		sc = &SeriesChurn{MetricName: name}
+		c.byMetricName[name] = sc
+	}
+	return sc
+}
+
+// created counts the creation of a series with the given metric.
+func (c *seriesChurn) created(m clientmodel.Metric) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.get(m).Created++
+}
+
+// archived counts the archiving of a series with the given metric.
+func (c *seriesChurn) archived(m clientmodel.Metric) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.get(m).Archived++
+}
+
+// top returns the n metric names with the most created and archived series,
+// sorted by descending sum of both.
+func (c *seriesChurn) top(n int) []SeriesChurn {
+	c.mtx.Lock()
+	all := make([]SeriesChurn, 0, len(c.byMetricName))
+	for _, sc := range c.byMetricName {
+		all = append(all, *sc)
+	}
+	c.mtx.Unlock()
+
+	sort.Sort(seriesChurnsByTotal(all))
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
+
+// collect sends the counts as metrics to ch.
+func (c *seriesChurn) collect(ch chan<- prometheus.Metric) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for name, sc := range c.byMetricName {
+		ch <- prometheus.MustNewConstMetric(
+			seriesChurnDesc, prometheus.CounterValue, float64(sc.Created), string(name), create,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			seriesChurnDesc, prometheus.CounterValue, float64(sc.Archived), string(name), archive,
+		)
+	}
+}
+
+// seriesChurnsByTotal sorts SeriesChurns by descending sum of created and
+// archived series, and by metric name for equal sums.
+type seriesChurnsByTotal []SeriesChurn
+
+func (s seriesChurnsByTotal) Len() int      { return len(s) }
+func (s seriesChurnsByTotal) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s seriesChurnsByTotal) Less(i, j int) bool {
+	ti, tj := s[i].Created+s[i].Archived, s[j].Created+s[j].Archived
+	if ti != tj {
+		return ti > tj
+	}
+	return s[i].MetricName < s[j].MetricName
+}
+
+// GetSeriesChurn implements Storage.
+func (s *memorySeriesStorage) GetSeriesChurn(n int) []SeriesChurn {
+	return s.seriesChurn.top(n)
+}
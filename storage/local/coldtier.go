@@ -0,0 +1,715 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/local/codable"
+	"github.com/prometheus/prometheus/storage/local/index"
+)
+
+const (
+	coldIndexDir = "cold_index"
+
+	// coldSegmentMinChunks is the minimum number of chunks uploaded to the
+	// cold tier at once, so that slowly growing series do not end up as a
+	// myriad of tiny objects. It is waived if all chunks but the last one
+	// of a series file are old enough.
+	coldSegmentMinChunks = 16
+	// coldRetentionInterval is how often segments are checked for having
+	// left the retention period.
+	coldRetentionInterval = time.Hour
+)
+
+// ObjectStore is a store of objects addressed by keys, e.g. a bucket of an
+// S3-compatible object storage service. It holds the cold tier of the local
+// storage. Keys consist of lowercase hexadecimal digits and slashes only.
+// Implementations must be goroutine-safe.
+type ObjectStore interface {
+	// Put stores data under the given key, replacing any existing object.
+	Put(key string, data []byte) error
+	// Get returns the object with the given key.
+	Get(key string) ([]byte, error)
+	// Delete deletes the object with the given key. Deleting a missing
+	// object is not an error.
+	Delete(key string) error
+}
+
+// coldSegment is a run of consecutive chunks of a series that has been
+// uploaded to the cold tier as a single object, consisting of the chunk records
+// exactly as they were in the series file (and thus encrypted if encryption is
+// enabled).
+type coldSegment struct {
+	firstTime, lastTime clientmodel.Timestamp
+	numChunks           int
+}
+
+// key returns the key of the object holding the segment.
+func (s coldSegment) key(fp clientmodel.Fingerprint) string {
+	return fmt.Sprintf("%016x/%016x", uint64(fp), uint64(s.firstTime))
+}
+
+// coldSegments are the segments of a series, sorted by time. They are the
+// values of the cold index.
+type coldSegments []coldSegment
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (ss coldSegments) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 0, len(ss)*3*binary.MaxVarintLen64)
+	tmp := make([]byte, binary.MaxVarintLen64)
+	for _, s := range ss {
+		for _, v := range []int64{int64(s.firstTime), int64(s.lastTime), int64(s.numChunks)} {
+			buf = append(buf, tmp[:binary.PutVarint(tmp, v)]...)
+		}
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (ss *coldSegments) UnmarshalBinary(buf []byte) error {
+	*ss = (*ss)[:0]
+	r := bytes.NewReader(buf)
+	for r.Len() > 0 {
+		var v [3]int64
+		for i := range v {
+			var err error
+			if v[i], err = binary.ReadVarint(r); err != nil {
+				return err
+			}
+		}
+		*ss = append(*ss, coldSegment{
+			firstTime: clientmodel.Timestamp(v[0]),
+			lastTime:  clientmodel.Timestamp(v[1]),
+			numChunks: int(v[2]),
+		})
+	}
+	return nil
+}
+
+func (ss coldSegments) Len() int           { return len(ss) }
+func (ss coldSegments) Less(i, j int) bool { return ss[i].firstTime.Before(ss[j].firstTime) }
+func (ss coldSegments) Swap(i, j int)      { ss[i], ss[j] = ss[j], ss[i] }
+
+// coldTier moves old chunks from series files to an ObjectStore and fetches
+// them from there for queries. Which segments of a series are in the cold tier
+// is recorded in the cold index, a LevelDB in the storage directory, and kept in
+// memory, too. The last chunk of a series file never moves, so that a series
+// stays indexed (and its series file is the authority on when its samples
+// begin locally) until retention drops it. Cold segments are deleted once they
+// have left the retention period or their series is purged.
+//
+// A nil *coldTier moves nothing and has no segments. All methods are
+// goroutine-safe, but moveChunks requires the fingerprint to be locked.
+type coldTier struct {
+	store ObjectStore
+	after time.Duration // Chunks ending that long ago are moved.
+	p     *persistence
+	index index.KeyValueStore
+
+	mtx      sync.RWMutex
+	segments map[clientmodel.Fingerprint]coldSegments // Never modified in place.
+
+	cache *coldCache
+
+	errors prometheus.Counter
+}
+
+// newColdTier returns a coldTier moving chunks ending at least the given
+// duration ago to store, and caching chunks fetched for queries up to the
+// given size in bytes.
+func newColdTier(store ObjectStore, after time.Duration, cacheSize int, p *persistence) (*coldTier, error) {
+	idx, err := index.NewLevelDB(index.LevelDBOptions{
+		Path: filepath.Join(p.basePath, coldIndexDir),
+	})
+	if err != nil {
+		return nil, err
+	}
+	t := &coldTier{
+		store:    store,
+		after:    after,
+		p:        p,
+		index:    idx,
+		segments: map[clientmodel.Fingerprint]coldSegments{},
+		cache:    newColdCache(cacheSize),
+		errors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "cold_tier_errors_total",
+			Help:      "The total number of failed uploads, fetches, and deletions of cold tier segments.",
+		}),
+	}
+	if err := idx.ForEach(func(kv index.KeyValueAccessor) error {
+		var fp codable.Fingerprint
+		if err := kv.Key(&fp); err != nil {
+			return err
+		}
+		var segs coldSegments
+		if err := kv.Value(&segs); err != nil {
+			return err
+		}
+		t.segments[clientmodel.Fingerprint(fp)] = segs
+		return nil
+	}); err != nil {
+		idx.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+// close closes the cold index.
+func (t *coldTier) close() error {
+	if t == nil {
+		return nil
+	}
+	return t.index.Close()
+}
+
+// moveChunks uploads the chunks of the series file of fp that ended longer ago
+// than t.after as a new segment, leaving out chunks ending before dropBefore,
+// which are about to be dropped anyway, and chunks ending at or after
+// notAfter. firstTime is the time of the first sample in the series file,
+// which saves reading it if nothing is old enough. It returns the time before
+// which chunks can be dropped now, which is dropBefore if nothing has been
+// uploaded. The caller must have locked fp.
+func (t *coldTier) moveChunks(
+	fp clientmodel.Fingerprint, firstTime, dropBefore, notAfter clientmodel.Timestamp,
+) clientmodel.Timestamp {
+	if t == nil {
+		return dropBefore
+	}
+	coldBefore := clientmodel.TimestampFromTime(time.Now()).Add(-t.after)
+	if notAfter.Before(coldBefore) {
+		coldBefore = notAfter
+	}
+	if !coldBefore.After(dropBefore) || !firstTime.Before(coldBefore) {
+		return dropBefore
+	}
+
+	f, err := t.p.openChunkFileForReading(fp)
+	if os.IsNotExist(err) {
+		return dropBefore
+	}
+	if err != nil {
+		glog.Errorf("Error opening series file for fingerprint %v: %v", fp, err)
+		return dropBefore
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		glog.Errorf("Error opening series file for fingerprint %v: %v", fp, err)
+		return dropBefore
+	}
+	numChunks := int(fi.Size()) / t.p.chunkRecordLen()
+
+	var (
+		seg          coldSegment
+		begin, end   int
+		chunkTimeBuf = make([]byte, 16)
+	)
+	for i := 0; i < numChunks-1; i++ {
+		if _, err := f.ReadAt(chunkTimeBuf, t.p.offsetForChunkIndex(i)+chunkHeaderFirstTimeOffset); err != nil {
+			glog.Errorf("Error reading chunk header of fingerprint %v: %v", fp, err)
+			return dropBefore
+		}
+		first := clientmodel.Timestamp(binary.LittleEndian.Uint64(chunkTimeBuf))
+		last := clientmodel.Timestamp(binary.LittleEndian.Uint64(chunkTimeBuf[8:]))
+		if last.Before(dropBefore) {
+			begin, end = i+1, i+1
+			continue
+		}
+		if !last.Before(coldBefore) {
+			break
+		}
+		if end == begin {
+			seg.firstTime = first
+		}
+		seg.lastTime = last
+		end = i + 1
+	}
+	seg.numChunks = end - begin
+	if seg.numChunks == 0 || (seg.numChunks < coldSegmentMinChunks && end < numChunks-1) {
+		return dropBefore
+	}
+
+	records := make([]byte, seg.numChunks*t.p.chunkRecordLen())
+	if _, err := f.ReadAt(records, t.p.offsetForChunkIndex(begin)); err != nil {
+		glog.Errorf("Error reading chunks of fingerprint %v: %v", fp, err)
+		return dropBefore
+	}
+	if err := t.store.Put(seg.key(fp), records); err != nil {
+		t.errors.Inc()
+		glog.Errorf("Error uploading chunks of fingerprint %v to the cold tier: %v", fp, err)
+		return dropBefore
+	}
+	if err := t.addSegment(fp, seg); err != nil {
+		glog.Errorf("Error adding cold tier segment of fingerprint %v to the cold index: %v", fp, err)
+		t.store.Delete(seg.key(fp))
+		return dropBefore
+	}
+	chunkOps.WithLabelValues(moveCold).Add(float64(seg.numChunks))
+	return seg.lastTime + 1
+}
+
+// addSegment adds seg to the segments of fp. Segments overlapping seg, left
+// behind by a crash after uploading but before dropping the chunks locally,
+// are replaced by it.
+func (t *coldTier) addSegment(fp clientmodel.Fingerprint, seg coldSegment) error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	var replaced []coldSegment
+	segs := make(coldSegments, 0, len(t.segments[fp])+1)
+	for _, s := range t.segments[fp] {
+		if s.lastTime.Before(seg.firstTime) || s.firstTime.After(seg.lastTime) {
+			segs = append(segs, s)
+		} else if s.firstTime != seg.firstTime {
+			replaced = append(replaced, s)
+		}
+	}
+	segs = append(segs, seg)
+	sort.Sort(segs)
+	if err := t.index.Put(codable.Fingerprint(fp), segs); err != nil {
+		return err
+	}
+	t.segments[fp] = segs
+	for _, s := range replaced {
+		t.deleteObject(fp, s)
+	}
+	return nil
+}
+
+// deleteObject deletes the object of the given segment and removes it from the
+// cache. Errors are only logged, leaving an orphaned object in the worst case.
+func (t *coldTier) deleteObject(fp clientmodel.Fingerprint, seg coldSegment) {
+	t.cache.remove(seg.key(fp))
+	if err := t.store.Delete(seg.key(fp)); err != nil {
+		t.errors.Inc()
+		glog.Errorf("Error deleting cold tier segment %s: %v", seg.key(fp), err)
+	}
+}
+
+// preload fetches the segments of fp overlapping the given time range into
+// the cache (if they are not there already) and pins them, so that NewIterator
+// can find them. The returned entries must be unpinned once done.
+func (t *coldTier) preload(
+	fp clientmodel.Fingerprint,
+	from clientmodel.Timestamp, through clientmodel.Timestamp,
+	abort preloadAbort,
+) ([]*coldCacheEntry, error) {
+	if t == nil {
+		return nil, nil
+	}
+	t.mtx.RLock()
+	segs := t.segments[fp]
+	t.mtx.RUnlock()
+
+	var pinned []*coldCacheEntry
+	for _, seg := range segs {
+		if seg.lastTime.Before(from) || seg.firstTime.After(through) {
+			continue
+		}
+		e, err := t.fetch(fp, seg, abort)
+		if err != nil {
+			t.cache.unpin(pinned)
+			return nil, err
+		}
+		pinned = append(pinned, e)
+	}
+	return pinned, nil
+}
+
+// fetch returns the pinned cache entry of the given segment, downloading the
+// segment if it is not cached.
+func (t *coldTier) fetch(fp clientmodel.Fingerprint, seg coldSegment, abort preloadAbort) (*coldCacheEntry, error) {
+	key := seg.key(fp)
+	if e := t.cache.getAndPin(key); e != nil {
+		return e, nil
+	}
+	if err := abort.err(); err != nil {
+		return nil, err
+	}
+	records, err := t.store.Get(key)
+	if err != nil {
+		t.errors.Inc()
+		return nil, fmt.Errorf("error fetching cold tier segment %s: %s", key, err)
+	}
+	recordLen := t.p.chunkRecordLen()
+	if len(records) != seg.numChunks*recordLen {
+		t.errors.Inc()
+		return nil, fmt.Errorf(
+			"cold tier segment %s has %d bytes, expected %d chunks of %d bytes",
+			key, len(records), seg.numChunks, recordLen,
+		)
+	}
+	chunks := make([]chunk, seg.numChunks)
+	for i := range chunks {
+		if chunks[i], err = t.p.unmarshalChunkRecord(records[i*recordLen:]); err != nil {
+			return nil, err
+		}
+	}
+	chunkOps.WithLabelValues(fetchCold).Add(float64(len(chunks)))
+	return t.cache.putAndPin(&coldCacheEntry{key: key, fp: fp, seg: seg, chunks: chunks}), nil
+}
+
+// unpin unpins the given cache entries.
+func (t *coldTier) unpin(entries []*coldCacheEntry) {
+	if t == nil {
+		return
+	}
+	t.cache.unpin(entries)
+}
+
+// chunksBefore returns the cached chunks of fp ending before the given time,
+// sorted by time.
+func (t *coldTier) chunksBefore(fp clientmodel.Fingerprint, before clientmodel.Timestamp) []chunk {
+	if t == nil {
+		return nil
+	}
+	var chunks []chunk
+	for _, e := range t.cache.entries(fp) {
+		for _, c := range e.chunks {
+			if c.lastTime().Before(before) {
+				chunks = append(chunks, c)
+			}
+		}
+	}
+	return chunks
+}
+
+// purge deletes all segments of fp.
+func (t *coldTier) purge(fp clientmodel.Fingerprint) {
+	if t == nil {
+		return
+	}
+	t.mtx.Lock()
+	segs := t.segments[fp]
+	if len(segs) == 0 {
+		t.mtx.Unlock()
+		return
+	}
+	if _, err := t.index.Delete(codable.Fingerprint(fp)); err != nil {
+		t.mtx.Unlock()
+		glog.Errorf("Error deleting fingerprint %v from the cold index: %v", fp, err)
+		return
+	}
+	delete(t.segments, fp)
+	t.mtx.Unlock()
+
+	for _, seg := range segs {
+		t.deleteObject(fp, seg)
+	}
+}
+
+// dropBefore deletes all segments ending before the given time. It returns
+// early if stopping is closed.
+func (t *coldTier) dropBefore(beforeTime clientmodel.Timestamp, stopping <-chan struct{}) {
+	t.mtx.RLock()
+	var fps []clientmodel.Fingerprint
+	for fp, segs := range t.segments {
+		if segs[0].lastTime.Before(beforeTime) {
+			fps = append(fps, fp)
+		}
+	}
+	t.mtx.RUnlock()
+
+	numDropped := 0
+	for _, fp := range fps {
+		select {
+		case <-stopping:
+			return
+		default:
+		}
+		t.mtx.Lock()
+		var dropped, kept coldSegments
+		for _, seg := range t.segments[fp] {
+			if seg.lastTime.Before(beforeTime) {
+				dropped = append(dropped, seg)
+			} else {
+				kept = append(kept, seg)
+			}
+		}
+		var err error
+		if len(kept) == 0 {
+			_, err = t.index.Delete(codable.Fingerprint(fp))
+		} else {
+			err = t.index.Put(codable.Fingerprint(fp), kept)
+		}
+		if err != nil {
+			t.mtx.Unlock()
+			glog.Errorf("Error updating fingerprint %v in the cold index: %v", fp, err)
+			continue
+		}
+		if len(kept) == 0 {
+			delete(t.segments, fp)
+		} else {
+			t.segments[fp] = kept
+		}
+		t.mtx.Unlock()
+
+		for _, seg := range dropped {
+			t.deleteObject(fp, seg)
+		}
+		numDropped += len(dropped)
+	}
+	if numDropped > 0 {
+		glog.Infof("Dropped %d cold tier segments outside of the retention period.", numDropped)
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (t *coldTier) Describe(ch chan<- *prometheus.Desc) {
+	ch <- t.errors.Desc()
+	t.cache.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (t *coldTier) Collect(ch chan<- prometheus.Metric) {
+	ch <- t.errors
+	t.cache.Collect(ch)
+}
+
+// coldCacheEntry is a segment fetched from the cold tier. pins is protected by
+// the mutex of the coldCache.
+type coldCacheEntry struct {
+	key    string
+	fp     clientmodel.Fingerprint
+	seg    coldSegment
+	chunks []chunk
+	pins   int
+}
+
+// coldCache is an LRU cache of segments fetched from the cold tier, bounded by
+// the total size of their chunks. Segments pinned by a preloader are never
+// evicted, so the cache might exceed its capacity while many of them are in
+// use. All methods are goroutine-safe.
+type coldCache struct {
+	mtx       sync.Mutex
+	capacity  int        // In chunks.
+	numChunks int        // Currently cached.
+	lru       *list.List // Most recently used at the front.
+	byKey     map[string]*list.Element
+	byFP      map[clientmodel.Fingerprint]map[string]struct{}
+
+	hits, misses prometheus.Counter
+	cachedBytes  prometheus.Gauge
+}
+
+// newColdCache returns a coldCache holding at most sizeBytes worth of chunks
+// that are not pinned.
+func newColdCache(sizeBytes int) *coldCache {
+	return &coldCache{
+		capacity: sizeBytes / chunkLen,
+		lru:      list.New(),
+		byKey:    map[string]*list.Element{},
+		byFP:     map[clientmodel.Fingerprint]map[string]struct{}{},
+
+		hits: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "cold_cache_hits_total",
+			Help:      "The total number of cold tier segments needed by queries and found in the cold cache.",
+		}),
+		misses: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "cold_cache_misses_total",
+			Help:      "The total number of cold tier segments needed by queries and thus fetched from the object store.",
+		}),
+		cachedBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "cold_cache_bytes",
+			Help:      "The current size of the chunks in the cold cache.",
+		}),
+	}
+}
+
+// getAndPin returns the pinned entry with the given key, or nil if it is not
+// cached.
+func (c *coldCache) getAndPin(key string) *coldCacheEntry {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	el, ok := c.byKey[key]
+	if !ok {
+		c.misses.Inc()
+		return nil
+	}
+	c.hits.Inc()
+	c.lru.MoveToFront(el)
+	e := el.Value.(*coldCacheEntry)
+	e.pins++
+	return e
+}
+
+// putAndPin adds the given entry to the cache and pins it, evicting the least
+// recently used unpinned entries if the cache is full. If an entry with the
+// same key has been added concurrently, that one is pinned and returned
+// instead.
+func (c *coldCache) putAndPin(e *coldCacheEntry) *coldCacheEntry {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if el, ok := c.byKey[e.key]; ok {
+		c.lru.MoveToFront(el)
+		e = el.Value.(*coldCacheEntry)
+		e.pins++
+		return e
+	}
+	e.pins = 1
+	c.byKey[e.key] = c.lru.PushFront(e)
+	keys, ok := c.byFP[e.fp]
+	if !ok {
+		keys = map[string]struct{}{}
+		c.byFP[e.fp] = keys
+	}
+	keys[e.key] = struct{}{}
+	c.numChunks += len(e.chunks)
+	c.evict()
+	return e
+}
+
+// unpin unpins the given entries and evicts entries if the cache has exceeded
+// its capacity in the meantime.
+func (c *coldCache) unpin(entries []*coldCacheEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	for _, e := range entries {
+		e.pins--
+	}
+	c.evict()
+}
+
+// entries returns the cached entries of fp, sorted by time.
+func (c *coldCache) entries(fp clientmodel.Fingerprint) []*coldCacheEntry {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	var entries []*coldCacheEntry
+	for key := range c.byFP[fp] {
+		el := c.byKey[key]
+		c.lru.MoveToFront(el)
+		entries = append(entries, el.Value.(*coldCacheEntry))
+	}
+	sort.Sort(coldCacheEntriesByTime(entries))
+	return entries
+}
+
+// remove removes the entry with the given key, if cached. Pinned entries are
+// removed, too, as remove is only called for deleted segments. Those already
+// handed out stay usable.
+func (c *coldCache) remove(key string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if el, ok := c.byKey[key]; ok {
+		c.removeElement(el)
+	}
+	c.cachedBytes.Set(float64(c.numChunks * chunkLen))
+}
+
+// evict removes the least recently used unpinned entries until the cache is
+// within its capacity. The caller must hold c.mtx.
+func (c *coldCache) evict() {
+	for el := c.lru.Back(); el != nil && c.numChunks > c.capacity; {
+		prev := el.Prev()
+		if el.Value.(*coldCacheEntry).pins <= 0 {
+			c.removeElement(el)
+		}
+		el = prev
+	}
+	c.cachedBytes.Set(float64(c.numChunks * chunkLen))
+}
+
+// removeElement removes an entry from the cache. The caller must hold c.mtx.
+func (c *coldCache) removeElement(el *list.Element) {
+	e := c.lru.Remove(el).(*coldCacheEntry)
+	delete(c.byKey, e.key)
+	keys := c.byFP[e.fp]
+	delete(keys, e.key)
+	if len(keys) == 0 {
+		delete(c.byFP, e.fp)
+	}
+	c.numChunks -= len(e.chunks)
+}
+
+// Describe implements prometheus.Collector.
+func (c *coldCache) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.hits.Desc()
+	ch <- c.misses.Desc()
+	ch <- c.cachedBytes.Desc()
+}
+
+// Collect implements prometheus.Collector.
+func (c *coldCache) Collect(ch chan<- prometheus.Metric) {
+	ch <- c.hits
+	ch <- c.misses
+	ch <- c.cachedBytes
+}
+
+type coldCacheEntriesByTime []*coldCacheEntry
+
+func (e coldCacheEntriesByTime) Len() int { return len(e) }
+func (e coldCacheEntriesByTime) Less(i, j int) bool {
+	return e[i].seg.firstTime.Before(e[j].seg.firstTime)
+}
+func (e coldCacheEntriesByTime) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+
+// expireColdSegments deletes cold tier segments that have left the retention
+// period periodically, until s.loopStopping is closed. It returns immediately
+// if there is no cold tier. The returned channel is closed once it has
+// stopped.
+func (s *memorySeriesStorage) expireColdSegments() <-chan struct{} {
+	stopped := make(chan struct{})
+	if s.coldTier == nil {
+		close(stopped)
+		return stopped
+	}
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(coldRetentionInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-s.loopStopping:
+				return
+			}
+			s.coldTier.dropBefore(
+				clientmodel.TimestampFromTime(time.Now()).Add(-s.retention()),
+				s.loopStopping,
+			)
+		}
+	}()
+	return stopped
+}
@@ -0,0 +1,224 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+// A series file is only rewritten by compaction if that reduces the number of
+// compacted chunks by at least 1/compactionMinSavingsDivisor.
+const compactionMinSavingsDivisor = 4
+
+// coalesceChunks re-encodes the samples of the given chunks into as few chunks
+// as possible. Chunks often end up under-filled, e.g. if their series was idle
+// for longer than headChunkTimeout, or after a change of the encoding. The
+// resulting chunks have the given encoding.
+func coalesceChunks(chunks []chunk, encoding ChunkEncoding) []chunk {
+	coalesced := []chunk{newChunkForEncoding(encoding)}
+	for _, c := range chunks {
+		it := c.newIterator()
+		for batch := it.nextBatch(); batch != nil; batch = it.nextBatch() {
+			for i := range batch {
+				head := coalesced[len(coalesced)-1]
+				coalesced = append(coalesced[:len(coalesced)-1], head.add(&batch[i])...)
+			}
+		}
+	}
+	return coalesced
+}
+
+// readChunks reads the next n chunks from r.
+func (p *persistence) readChunks(r io.Reader, n int) ([]chunk, error) {
+	recordLen := p.chunkRecordLen()
+	buf := make([]byte, n*recordLen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	chunks := make([]chunk, n)
+	for i := range chunks {
+		c, err := p.unmarshalChunkRecord(buf[i*recordLen:])
+		if err != nil {
+			return nil, err
+		}
+		chunks[i] = c
+	}
+	return chunks, nil
+}
+
+// compactSeriesFile coalesces the first n chunks in the series file of the
+// given fingerprint (or all its chunks if n is negative) and rewrites the file
+// with the coalesced chunks, followed by the remaining chunks unchanged. The
+// file is only rewritten if that saves enough chunks to be worth it. It
+// returns the number of chunks compacted and the number of chunks they were
+// coalesced into, which is the same if the file was left alone. The caller
+// must have locked the fingerprint.
+func (p *persistence) compactSeriesFile(fp clientmodel.Fingerprint, n int) (before, after int, err error) {
+	f, err := p.openChunkFileForReading(fp)
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	defer p.evictFromPageCache(f)
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	numChunks := int(fi.Size() / int64(p.chunkRecordLen()))
+	if n < 0 || n > numChunks {
+		n = numChunks
+	}
+	if n < 2 {
+		return n, n, nil
+	}
+
+	chunks, err := p.readChunks(f, n)
+	if err != nil {
+		return 0, 0, err
+	}
+	coalesced := coalesceChunks(chunks, p.chunkEncoding)
+	if (n-len(coalesced))*compactionMinSavingsDivisor < n {
+		return n, n, nil
+	}
+
+	p.logSeriesChange(fp)
+	temp, err := os.OpenFile(p.tempFileNameForFingerprint(fp), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := p.writeChunks(temp, coalesced); err != nil {
+		temp.Close()
+		return 0, 0, err
+	}
+	// The file position of f is right after the compacted chunks.
+	if _, err := io.Copy(temp, f); err != nil {
+		temp.Close()
+		return 0, 0, err
+	}
+	p.closeChunkFile(temp)
+	if err := os.Rename(p.tempFileNameForFingerprint(fp), p.fileNameForFingerprint(fp)); err != nil {
+		return 0, 0, err
+	}
+	p.invalidateChunkCache(fp)
+	chunkOps.WithLabelValues(coalesce).Add(float64(n - len(coalesced)))
+	return n, len(coalesced), nil
+}
+
+// compact compacts the series files of all series periodically, until
+// s.loopStopping is closed. It returns immediately if compaction is
+// disabled. The returned channel is closed once compaction has stopped.
+func (s *memorySeriesStorage) compact() <-chan struct{} {
+	stopped := make(chan struct{})
+	if s.compactionInterval <= 0 {
+		close(stopped)
+		return stopped
+	}
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(s.compactionInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-s.loopStopping:
+				return
+			}
+			s.compactAll()
+		}
+	}()
+	return stopped
+}
+
+// compactAll compacts the series files of all series in memory and of all
+// archived series.
+func (s *memorySeriesStorage) compactAll() {
+	stopping := false
+	for fp := range s.fpToSeries.fpIter() {
+		// Keep draining the iterator when stopping.
+		if stopping {
+			continue
+		}
+		select {
+		case <-s.loopStopping:
+			stopping = true
+			continue
+		default:
+		}
+		s.compactSeries(fp)
+	}
+	if stopping {
+		return
+	}
+	archivedFPs, err := s.persistence.getFingerprintsModifiedBefore(clientmodel.Latest)
+	if err != nil {
+		glog.Error("Failed to lookup archived fingerprint ranges: ", err)
+		return
+	}
+	for _, fp := range archivedFPs {
+		select {
+		case <-s.loopStopping:
+			return
+		default:
+		}
+		s.compactSeries(fp)
+	}
+}
+
+// compactSeries compacts the series file of the series with the given
+// fingerprint. For a series in memory, only the chunks without a chunkDesc in
+// memory are compacted, as the chunkDescs refer to chunks by their position in
+// the series file.
+func (s *memorySeriesStorage) compactSeries(fp clientmodel.Fingerprint) {
+	s.fpLocker.Lock(fp)
+	defer s.fpLocker.Unlock(fp)
+
+	n := -1
+	series, inMemory := s.fpToSeries.get(fp)
+	if inMemory {
+		// A chunkDescsOffset of -1 means unknown.
+		if series.chunkDescsOffset < 2 {
+			return
+		}
+		n = series.chunkDescsOffset
+	} else if has, _, _, err := s.persistence.hasArchivedMetric(fp); err != nil || !has {
+		// Purged in the meantime.
+		return
+	}
+
+	before, after, err := s.persistence.compactSeriesFile(fp, n)
+	if err != nil {
+		glog.Errorf("Error compacting series file for fingerprint %v: %v", fp, err)
+		return
+	}
+	if after == before {
+		return
+	}
+	if inMemory {
+		series.chunkDescsOffset = after
+		series.modTime = s.persistence.getSeriesFileModTime(fp)
+		series.dirty = true
+	}
+	s.seriesOps.WithLabelValues(compaction).Inc()
+}
@@ -0,0 +1,87 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/syndtr/gosnappy/snappy"
+)
+
+// Compression is the compression algorithm applied to the series in the heads
+// file.
+type Compression byte
+
+// Possible values for Compression.
+const (
+	NoCompression Compression = iota
+	Snappy
+	Gzip
+)
+
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case Snappy:
+		return "snappy"
+	case Gzip:
+		return "gzip"
+	default:
+		return strconv.Itoa(int(c))
+	}
+}
+
+// valid returns true if c is a known compression algorithm.
+func (c Compression) valid() bool {
+	return c <= Gzip
+}
+
+// newWriter returns a writer compressing to w. It has to be closed to flush
+// all compressed data to w, but closing it does not close w.
+func (c Compression) newWriter(w io.Writer) io.WriteCloser {
+	switch c {
+	case Snappy:
+		return nopWriteCloser{snappy.NewWriter(w)}
+	case Gzip:
+		return gzip.NewWriter(w)
+	default:
+		return nopWriteCloser{w}
+	}
+}
+
+// newReader returns a reader decompressing what newWriter has written to r.
+func (c Compression) newReader(r io.Reader) (io.Reader, error) {
+	switch c {
+	case NoCompression:
+		return r, nil
+	case Snappy:
+		return snappy.NewReader(r), nil
+	case Gzip:
+		return gzip.NewReader(r)
+	default:
+		return nil, fmt.Errorf("unknown compression %v", c)
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
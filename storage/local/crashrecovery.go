@@ -41,12 +41,15 @@ func (p *persistence) recoverFromCrash(fingerprintToSeries map[clientmodel.Finge
 	fpsSeen := map[clientmodel.Fingerprint]struct{}{}
 	count := 0
 	seriesDirNameFmt := fmt.Sprintf("%%0%dx", seriesDirNameLen)
+	numDirs := 1 << (seriesDirNameLen * 4)
 
 	glog.Info("Scanning files.")
-	for i := 0; i < 1<<(seriesDirNameLen*4); i++ {
+	p.recoveryProgress.start(recoveryPhaseScanningFiles, numDirs, 0)
+	for i := 0; i < numDirs; i++ {
 		dirname := path.Join(p.basePath, fmt.Sprintf(seriesDirNameFmt, i))
 		dir, err := os.Open(dirname)
 		if os.IsNotExist(err) {
+			p.recoveryProgress.dirScanned()
 			continue
 		}
 		if err != nil {
@@ -62,57 +65,25 @@ func (p *persistence) recoverFromCrash(fingerprintToSeries map[clientmodel.Finge
 				if ok {
 					fpsSeen[fp] = struct{}{}
 				}
+				p.recoveryProgress.fileScanned(ok)
 				count++
 				if count%10000 == 0 {
 					glog.Infof("%d files scanned.", count)
 				}
 			}
 		}
+		p.recoveryProgress.dirScanned()
 	}
 	glog.Infof("File scan complete. %d series found.", len(fpsSeen))
 
 	glog.Info("Checking for series without series file.")
+	p.recoveryProgress.setPhase(recoveryPhaseCheckingCheckpoint)
 	for fp, s := range fingerprintToSeries {
 		if _, seen := fpsSeen[fp]; !seen {
-			// fp exists in fingerprintToSeries, but has no representation on disk.
-			if s.headChunkClosed {
-				// Oops, everything including the head chunk was
-				// already persisted, but nothing on disk.
-				// Thus, we lost that series completely. Clean
-				// up the remnants.
-				delete(fingerprintToSeries, fp)
-				if err := p.purgeArchivedMetric(fp); err != nil {
-					// Purging the archived metric didn't work, so try
-					// to unindex it, just in case it's in the indexes.
-					p.unindexMetric(fp, s.metric)
-				}
-				glog.Warningf("Lost series detected: fingerprint %v, metric %v.", fp, s.metric)
-				continue
-			}
-			// If we are here, the only chunks we have are the chunks in the checkpoint.
-			// Adjust things accordingly.
-			if s.persistWatermark > 0 || s.chunkDescsOffset != 0 {
-				minLostChunks := s.persistWatermark + s.chunkDescsOffset
-				if minLostChunks <= 0 {
-					glog.Warningf(
-						"Possible loss of chunks for fingerprint %v, metric %v.",
-						fp, s.metric,
-					)
-				} else {
-					glog.Warningf(
-						"Lost at least %d chunks for fingerprint %v, metric %v.",
-						minLostChunks, fp, s.metric,
-					)
-				}
-				s.chunkDescs = append(
-					make([]*chunkDesc, 0, len(s.chunkDescs)-s.persistWatermark),
-					s.chunkDescs[s.persistWatermark:]...,
-				)
-				numMemChunkDescs.Sub(float64(s.persistWatermark))
-				s.persistWatermark = 0
-				s.chunkDescsOffset = 0
+			if p.sanitizeSeriesWithoutFile(fp, s, fingerprintToSeries) {
+				fpsSeen[fp] = struct{}{} // Add so that fpsSeen is complete.
+				p.recoveryProgress.seriesSanitizedWithoutFile()
 			}
-			fpsSeen[fp] = struct{}{} // Add so that fpsSeen is complete.
 		}
 	}
 	glog.Info("Check for series without series file complete.")
@@ -120,15 +91,137 @@ func (p *persistence) recoverFromCrash(fingerprintToSeries map[clientmodel.Finge
 	if err := p.cleanUpArchiveIndexes(fingerprintToSeries, fpsSeen); err != nil {
 		return err
 	}
+	if _, _, err := p.rebuildFPMappings(fingerprintToSeries); err != nil {
+		return err
+	}
+	if err := p.rebuildLabelIndexes(fingerprintToSeries); err != nil {
+		return err
+	}
+
+	p.setDirty(false)
+	p.recoveryProgress.setPhase(recoveryPhaseComplete)
+	glog.Warning("Crash recovery complete.")
+	return nil
+}
+
+// seriesChangedInWAL returns the fingerprints of all series whose series file
+// or archive index entry might have been modified since the last checkpoint,
+// as recorded in the WAL segments found on start-up. If the WAL cannot be
+// relied upon for crash recovery, nil is returned.
+func (p *persistence) seriesChangedInWAL() (map[clientmodel.Fingerprint]struct{}, error) {
+	if p.wal == nil || p.walFullRecovery || len(p.walSegments) == 0 {
+		return nil, nil
+	}
+	changed := map[clientmodel.Fingerprint]struct{}{}
+	walDirty := false
+	for _, n := range p.walSegments {
+		if err := p.wal.readSegment(n, func(rec *walRecord) {
+			switch rec.recordType {
+			case walRecordSeriesChange:
+				changed[rec.fp] = struct{}{}
+			case walRecordDirty:
+				walDirty = true
+			}
+		}); err == errWALCorrupted {
+			glog.Warning("WAL is corrupted, WAL cannot be used for crash recovery.")
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if walDirty {
+		glog.Warning("WAL marks the storage as inconsistent, WAL cannot be used for crash recovery.")
+		return nil, nil
+	}
+	return changed, nil
+}
+
+// recoverFromWAL is a cheaper alternative to recoverFromCrash, called by
+// loadSeriesMapAndHeads if the WAL covers all changes since the last
+// checkpoint. Only the series files of the given fingerprints, as returned by
+// seriesChangedInWAL, are sanitized, so that there is no need to scan all
+// series files. The samples in the WAL are not replayed here. Same concurrency
+// restrictions as for recoverFromCrash apply.
+func (p *persistence) recoverFromWAL(
+	fingerprintToSeries map[clientmodel.Fingerprint]*memorySeries,
+	changedFPs map[clientmodel.Fingerprint]struct{},
+) error {
+	glog.Warningf("Starting crash recovery of %d series changed since the last checkpoint.", len(changedFPs))
+	p.recoveryProgress.start(recoveryPhaseCheckingChanged, 0, len(changedFPs))
+
+	for fp := range changedFPs {
+		seen := false
+		fi, err := os.Stat(p.fileNameForFingerprint(fp))
+		if err == nil {
+			_, seen = p.sanitizeSeries(p.dirNameForFingerprint(fp), fi, fingerprintToSeries)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		if s, ok := fingerprintToSeries[fp]; ok && !seen {
+			seen = p.sanitizeSeriesWithoutFile(fp, s, fingerprintToSeries)
+		}
+		p.recoveryProgress.fileScanned(seen)
+		if err := p.cleanUpArchivedFingerprint(fp, fingerprintToSeries, seen); err != nil {
+			return err
+		}
+	}
+
 	if err := p.rebuildLabelIndexes(fingerprintToSeries); err != nil {
 		return err
 	}
 
 	p.setDirty(false)
+	p.recoveryProgress.setPhase(recoveryPhaseComplete)
 	glog.Warning("Crash recovery complete.")
 	return nil
 }
 
+// sanitizeSeriesWithoutFile deals with a series from the checkpoint that has no
+// representation on disk. It returns false if the series has been lost
+// completely and was therefore removed from fingerprintToSeries.
+func (p *persistence) sanitizeSeriesWithoutFile(
+	fp clientmodel.Fingerprint, s *memorySeries, fingerprintToSeries map[clientmodel.Fingerprint]*memorySeries,
+) bool {
+	if s.headChunkClosed {
+		// Oops, everything including the head chunk was
+		// already persisted, but nothing on disk.
+		// Thus, we lost that series completely. Clean
+		// up the remnants.
+		delete(fingerprintToSeries, fp)
+		if err := p.purgeArchivedMetric(fp); err != nil {
+			// Purging the archived metric didn't work, so try
+			// to unindex it, just in case it's in the indexes.
+			p.unindexMetric(fp, s.metric)
+		}
+		glog.Warningf("Lost series detected: fingerprint %v, metric %v.", fp, s.metric)
+		return false
+	}
+	// If we are here, the only chunks we have are the chunks in the checkpoint.
+	// Adjust things accordingly.
+	if s.persistWatermark > 0 || s.chunkDescsOffset != 0 {
+		minLostChunks := s.persistWatermark + s.chunkDescsOffset
+		if minLostChunks <= 0 {
+			glog.Warningf(
+				"Possible loss of chunks for fingerprint %v, metric %v.",
+				fp, s.metric,
+			)
+		} else {
+			glog.Warningf(
+				"Lost at least %d chunks for fingerprint %v, metric %v.",
+				minLostChunks, fp, s.metric,
+			)
+		}
+		s.chunkDescs = append(
+			make([]*chunkDesc, 0, len(s.chunkDescs)-s.persistWatermark),
+			s.chunkDescs[s.persistWatermark:]...,
+		)
+		numMemChunkDescs.Sub(float64(s.persistWatermark))
+		s.persistWatermark = 0
+		s.chunkDescsOffset = 0
+	}
+	return true
+}
+
 // sanitizeSeries sanitizes a series based on its series file as defined by the
 // provided directory and FileInfo.  The method returns the fingerprint as
 // derived from the directory and file name, and whether the provided file has
@@ -160,6 +253,7 @@ func (p *persistence) sanitizeSeries(
 ) (clientmodel.Fingerprint, bool) {
 	filename := path.Join(dirname, fi.Name())
 	purge := func() {
+		p.recoveryProgress.fileOrphaned()
 		var err error
 		defer func() {
 			if err != nil {
@@ -169,7 +263,7 @@ func (p *persistence) sanitizeSeries(
 				}
 			}
 		}()
-		orphanedDir := path.Join(p.basePath, "orphaned", path.Base(dirname))
+		orphanedDir := path.Join(p.basePath, orphanedDirName, path.Base(dirname))
 		if err = os.MkdirAll(orphanedDir, 0700); err != nil {
 			return
 		}
@@ -191,8 +285,8 @@ func (p *persistence) sanitizeSeries(
 		return fp, false
 	}
 
-	bytesToTrim := fi.Size() % int64(chunkLenWithHeader)
-	chunksInFile := int(fi.Size()) / chunkLenWithHeader
+	bytesToTrim := fi.Size() % int64(p.chunkRecordLen())
+	chunksInFile := int(fi.Size()) / p.chunkRecordLen()
 	modTime := fi.ModTime()
 	if bytesToTrim != 0 {
 		glog.Warningf(
@@ -260,6 +354,7 @@ func (p *persistence) sanitizeSeries(
 		s.chunkDescs = s.chunkDescs[s.persistWatermark:]
 		numMemChunkDescs.Sub(float64(s.persistWatermark))
 		// Load all the chunk descs (which assumes we have none from the future).
+		p.ioThrottle.wait(chunksInFile * chunkHeaderLen)
 		cds, err := p.loadChunkDescs(fp, clientmodel.Now())
 		if err != nil {
 			glog.Errorf(
@@ -328,6 +423,7 @@ func (p *persistence) cleanUpArchiveIndexes(
 	fpsSeen map[clientmodel.Fingerprint]struct{},
 ) error {
 	glog.Info("Cleaning up archive indexes.")
+	p.recoveryProgress.setPhase(recoveryPhaseCleaningArchive)
 	var fp codable.Fingerprint
 	var m codable.Metric
 	count := 0
@@ -420,14 +516,71 @@ func (p *persistence) cleanUpArchiveIndexes(
 	return nil
 }
 
+// cleanUpArchivedFingerprint is the single-fingerprint version of
+// cleanUpArchiveIndexes. fpSeen is whether the series has a sanitized series
+// file (or is legitimately in memory without one).
+func (p *persistence) cleanUpArchivedFingerprint(
+	fp clientmodel.Fingerprint,
+	fpToSeries map[clientmodel.Fingerprint]*memorySeries,
+	fpSeen bool,
+) error {
+	_, inMemory := fpToSeries[fp]
+	if !fpSeen || inMemory {
+		// It's fine if the fp is not in the archive indexes.
+		if _, err := p.archivedFingerprintToMetrics.Delete(codable.Fingerprint(fp)); err != nil {
+			return err
+		}
+		_, err := p.archivedFingerprintToTimeRange.Delete(codable.Fingerprint(fp))
+		return err
+	}
+	m, err := p.getArchivedMetric(fp)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		glog.Warningf("Archive clean-up: Purging unknown fingerprint %v in time-range index.", fp)
+		_, err := p.archivedFingerprintToTimeRange.Delete(codable.Fingerprint(fp))
+		return err
+	}
+	has, err := p.archivedFingerprintToTimeRange.Has(codable.Fingerprint(fp))
+	if err != nil {
+		return err
+	}
+	if has {
+		return nil // All good.
+	}
+	glog.Warningf("Archive clean-up: Fingerprint %v is not in time-range index. Unarchiving it for recovery.", fp)
+	if _, err := p.archivedFingerprintToMetrics.Delete(codable.Fingerprint(fp)); err != nil {
+		return err
+	}
+	series := newMemorySeries(m, false, clientmodel.Earliest)
+	cds, err := p.loadChunkDescs(fp, clientmodel.Now())
+	if err != nil {
+		return err
+	}
+	series.chunkDescs = cds
+	series.chunkDescsOffset = 0
+	series.persistWatermark = len(cds)
+	fpToSeries[fp] = series
+	return nil
+}
+
 func (p *persistence) rebuildLabelIndexes(
 	fpToSeries map[clientmodel.Fingerprint]*memorySeries,
 ) error {
 	count := 0
 	glog.Info("Rebuilding label indexes.")
+	p.recoveryProgress.setPhase(recoveryPhaseRebuildingIndexes)
+	if ok, err := p.rebuildLabelIndexesFromSnapshot(fpToSeries); err != nil {
+		glog.Warning("Error rebuilding label indexes from snapshot, re-indexing all metrics: ", err)
+	} else if ok {
+		glog.Info("All requests for rebuilding the label indexes queued. (Actual processing may lag behind.)")
+		return nil
+	}
 	glog.Info("Indexing metrics in memory.")
 	for fp, s := range fpToSeries {
 		p.indexMetric(fp, s.metric)
+		p.recoveryProgress.metricIndexed()
 		count++
 		if count%10000 == 0 {
 			glog.Infof("%d metrics queued for indexing.", count)
@@ -444,6 +597,7 @@ func (p *persistence) rebuildLabelIndexes(
 			return err
 		}
 		p.indexMetric(clientmodel.Fingerprint(fp), clientmodel.Metric(m))
+		p.recoveryProgress.metricIndexed()
 		count++
 		if count%10000 == 0 {
 			glog.Infof("%d metrics queued for indexing.", count)
@@ -0,0 +1,223 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"time"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/local/index"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+// Options configures a local storage opened with Open. Fields left at their
+// zero values are set to the defaults of the Prometheus server.
+type Options struct {
+	MemoryChunks               int              // How many chunks to keep in memory. Default 1048576.
+	MaxChunksToPersist         int              // Max number of chunks waiting to be persisted. Default 1048576.
+	ChunkEncoding              *ChunkEncoding   // Encoding of new chunks. Default DefaultChunkEncoding. A pointer, as the zero value is Delta.
+	Retention                  time.Duration    // Samples at least that old are dropped. Default 15d.
+	MinCheckpointInterval      time.Duration    // Default 1m.
+	MaxCheckpointInterval      time.Duration    // Default 15m.
+	CheckpointDirtySeriesLimit int              // Default 5000.
+	SyncStrategy               SyncStrategy     // Default Adaptive.
+	WALFlushInterval           time.Duration    // Default 1s. A negative value disables the write-ahead log.
+	IndexCacheSizes            index.CacheSizes // Default index.DefaultCacheSizes.
+	EncryptionKey              KeyProvider      // Optional.
+}
+
+// memorySeriesStorageOptions returns the options to create a
+// memorySeriesStorage in dir with.
+func (o Options) memorySeriesStorageOptions(dir string) *MemorySeriesStorageOptions {
+	mo := &MemorySeriesStorageOptions{
+		MemoryChunks:               o.MemoryChunks,
+		MaxChunksToPersist:         o.MaxChunksToPersist,
+		ChunkEncoding:              DefaultChunkEncoding,
+		PersistenceStoragePath:     dir,
+		PersistenceRetentionPeriod: o.Retention,
+		MinCheckpointInterval:      o.MinCheckpointInterval,
+		MaxCheckpointInterval:      o.MaxCheckpointInterval,
+		CheckpointDirtySeriesLimit: o.CheckpointDirtySeriesLimit,
+		SyncStrategy:               o.SyncStrategy,
+		WALFlushInterval:           o.WALFlushInterval,
+		IndexCacheSizes:            o.IndexCacheSizes,
+		EncryptionKey:              o.EncryptionKey,
+	}
+	if o.ChunkEncoding != nil {
+		mo.ChunkEncoding = *o.ChunkEncoding
+	}
+	if mo.MemoryChunks == 0 {
+		mo.MemoryChunks = 1024 * 1024
+	}
+	if mo.MaxChunksToPersist == 0 {
+		mo.MaxChunksToPersist = 1024 * 1024
+	}
+	if mo.PersistenceRetentionPeriod == 0 {
+		mo.PersistenceRetentionPeriod = 15 * 24 * time.Hour
+	}
+	if mo.MinCheckpointInterval == 0 {
+		mo.MinCheckpointInterval = time.Minute
+	}
+	if mo.MaxCheckpointInterval == 0 {
+		mo.MaxCheckpointInterval = 15 * time.Minute
+	}
+	if mo.CheckpointDirtySeriesLimit == 0 {
+		mo.CheckpointDirtySeriesLimit = 5000
+	}
+	if mo.SyncStrategy == 0 {
+		mo.SyncStrategy = Adaptive
+	}
+	switch {
+	case mo.WALFlushInterval == 0:
+		mo.WALFlushInterval = time.Second
+	case mo.WALFlushInterval < 0:
+		mo.WALFlushInterval = 0
+	}
+	if mo.IndexCacheSizes == (index.CacheSizes{}) {
+		mo.IndexCacheSizes = index.DefaultCacheSizes
+	}
+	return mo
+}
+
+// Appender appends samples to a DB. Samples of the same series have to be
+// appended in chronological order. Appended samples might not be queryable
+// before DB.WaitForIndexing has returned.
+type Appender interface {
+	Append(*clientmodel.Sample)
+	AppendBatch(clientmodel.Samples)
+}
+
+// Series is a series returned by a Querier, with its samples in chronological
+// order.
+type Series struct {
+	Metric clientmodel.Metric
+	Values metric.Values
+}
+
+// Querier queries a DB. Queries fail with ErrCanceled once the cancel channel
+// the Querier was created with is closed, and with ErrDeadlineExceeded once
+// its deadline has passed.
+type Querier interface {
+	// Select returns all series matching the label matchers with their
+	// samples between from and through, inclusively.
+	Select(from, through clientmodel.Timestamp, matchers ...*metric.LabelMatcher) ([]Series, error)
+	// LabelValues returns all values of the given label name.
+	LabelValues(clientmodel.LabelName) (clientmodel.LabelValues, error)
+}
+
+// DB is a local storage embedded into another program. All its methods are
+// goroutine-safe.
+type DB struct {
+	storage Storage
+}
+
+// Open opens the local storage in dir, creating it if it does not exist yet,
+// and starts its maintenance in the background. After an unclean shutdown,
+// crash recovery runs before Open returns. The storage must not be used by any
+// other process at the same time. Call Close to shut it down.
+func Open(dir string, o Options) (*DB, error) {
+	s, err := NewMemorySeriesStorage(o.memorySeriesStorageOptions(dir))
+	if err != nil {
+		return nil, err
+	}
+	s.Start()
+	return &DB{storage: s}, nil
+}
+
+// Appender returns an Appender for the DB.
+func (db *DB) Appender() Appender {
+	return db.storage
+}
+
+// Querier returns a Querier for the DB whose queries are aborted once cancel
+// is closed or the deadline has passed. A nil cancel channel is never closed,
+// and a zero deadline never passes.
+func (db *DB) Querier(cancel <-chan struct{}, deadline time.Time) Querier {
+	return &querier{
+		storage: db.storage,
+		abort:   preloadAbort{deadline: deadline, canceled: cancel},
+	}
+}
+
+// WaitForIndexing returns once all samples appended so far are indexed and
+// thereby visible to Select.
+func (db *DB) WaitForIndexing() {
+	db.storage.WaitForIndexing()
+}
+
+// Storage returns the underlying Storage, e.g. to register it as a
+// prometheus.Collector or to access more advanced functionality.
+func (db *DB) Storage() Storage {
+	return db.storage
+}
+
+// Close persists all data not yet persisted and shuts the storage down.
+func (db *DB) Close() error {
+	return db.storage.Stop()
+}
+
+// querier implements Querier.
+type querier struct {
+	storage Storage
+	abort   preloadAbort
+}
+
+// Select implements Querier.
+func (q *querier) Select(from, through clientmodel.Timestamp, matchers ...*metric.LabelMatcher) ([]Series, error) {
+	if err := q.abort.err(); err != nil {
+		return nil, err
+	}
+	fps := q.storage.GetFingerprintsForLabelMatchers(matchers)
+	if len(fps) == 0 {
+		return nil, nil
+	}
+	in := metric.Interval{OldestInclusive: from, NewestInclusive: through}
+	ranges := make(map[clientmodel.Fingerprint]metric.Interval, len(fps))
+	for _, fp := range fps {
+		ranges[fp] = in
+	}
+
+	p := q.storage.NewPreloader()
+	defer p.Close()
+	p.SetDeadline(q.abort.deadline)
+	p.SetCancel(q.abort.canceled)
+	if err := p.PreloadRanges(ranges, 0); err != nil {
+		return nil, err
+	}
+
+	series := make([]Series, 0, len(fps))
+	for _, fp := range fps {
+		if err := q.abort.err(); err != nil {
+			return nil, err
+		}
+		values := q.storage.NewIterator(fp).GetRangeValues(in)
+		if len(values) == 0 {
+			continue
+		}
+		series = append(series, Series{
+			Metric: q.storage.GetMetricForFingerprint(fp).Metric,
+			Values: values,
+		})
+	}
+	return series, nil
+}
+
+// LabelValues implements Querier.
+func (q *querier) LabelValues(name clientmodel.LabelName) (clientmodel.LabelValues, error) {
+	if err := q.abort.err(); err != nil {
+		return nil, err
+	}
+	return q.storage.GetLabelValuesForLabelName(name), nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/prometheus/prometheus/utility/test"
+)
+
+func TestDB(t *testing.T) {
+	directory := test.NewTemporaryDirectory("test_db", t)
+	defer directory.Close()
+
+	db, err := Open(directory.Path(), Options{MemoryChunks: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := db.Appender()
+	for i := 0; i < 100; i++ {
+		app.AppendBatch(clientmodel.Samples{
+			{
+				Metric:    clientmodel.Metric{clientmodel.MetricNameLabel: "a", "job": "x"},
+				Timestamp: clientmodel.Timestamp(i),
+				Value:     clientmodel.SampleValue(i),
+			},
+			{
+				Metric:    clientmodel.Metric{clientmodel.MetricNameLabel: "a", "job": "y"},
+				Timestamp: clientmodel.Timestamp(i),
+				Value:     clientmodel.SampleValue(-i),
+			},
+		})
+	}
+	db.WaitForIndexing()
+
+	m, err := metric.NewLabelMatcher(metric.Equal, "job", "x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	series, err := db.Querier(nil, time.Time{}).Select(10, 19, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 1 {
+		t.Fatalf("expected 1 series, got %d", len(series))
+	}
+	if got := series[0].Metric["job"]; got != "x" {
+		t.Errorf("expected job x, got %q", got)
+	}
+	if len(series[0].Values) != 10 {
+		t.Fatalf("expected 10 samples, got %d", len(series[0].Values))
+	}
+	for i, v := range series[0].Values {
+		if want := clientmodel.Timestamp(10 + i); v.Timestamp != want || v.Value != clientmodel.SampleValue(want) {
+			t.Errorf("%d. unexpected sample %v", i, v)
+		}
+	}
+
+	values, err := db.Querier(nil, time.Time{}).LabelValues("job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 {
+		t.Errorf("expected 2 label values, got %v", values)
+	}
+
+	canceled := make(chan struct{})
+	close(canceled)
+	if _, err := db.Querier(canceled, time.Time{}).Select(0, 99, m); err != ErrCanceled {
+		t.Errorf("expected %v, got %v", ErrCanceled, err)
+	}
+	if _, err := db.Querier(nil, time.Now().Add(-time.Second)).Select(0, 99, m); err != ErrDeadlineExceeded {
+		t.Errorf("expected %v, got %v", ErrDeadlineExceeded, err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopen and check that the data has been persisted.
+	db, err = Open(directory.Path(), Options{MemoryChunks: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	series, err = db.Querier(nil, time.Time{}).Select(0, 99, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 1 || len(series[0].Values) != 100 {
+		t.Errorf("unexpected series after reopening: %v", series)
+	}
+}
+
+func TestDBOptionsChunkEncoding(t *testing.T) {
+	if got := (Options{}).memorySeriesStorageOptions("").ChunkEncoding; got != DefaultChunkEncoding {
+		t.Errorf("got chunk encoding %v for unset option, want %v", got, DefaultChunkEncoding)
+	}
+	delta := Delta
+	if got := (Options{ChunkEncoding: &delta}).memorySeriesStorageOptions("").ChunkEncoding; got != Delta {
+		t.Errorf("got chunk encoding %v, want %v", got, Delta)
+	}
+}
@@ -89,7 +89,7 @@ func (c deltaEncodedChunk) add(s *metric.SamplePair) []chunk {
 	// Do we generally have space for another sample in this chunk? If not,
 	// overflow into a new one.
 	if remainingBytes < sampleSize {
-		overflowChunks := newChunk().add(s)
+		overflowChunks := newChunkForEncoding(Delta).add(s)
 		return []chunk{&c, overflowChunks[0]}
 	}
 
@@ -128,7 +128,7 @@ func (c deltaEncodedChunk) add(s *metric.SamplePair) []chunk {
 			return transcodeAndAdd(newDeltaEncodedChunk(ntb, nvb, nInt, cap(c)), &c, s)
 		}
 		// Chunk is already half full. Better create a new one and save the transcoding efforts.
-		overflowChunks := newChunk().add(s)
+		overflowChunks := newChunkForEncoding(Delta).add(s)
 		return []chunk{&c, overflowChunks[0]}
 	}
 
@@ -188,12 +188,12 @@ func (c deltaEncodedChunk) clone() chunk {
 
 // firstTime implements chunk.
 func (c deltaEncodedChunk) firstTime() clientmodel.Timestamp {
-	return c.valueAtIndex(0).Timestamp
+	return c.timestampAtIndex(0)
 }
 
 // lastTime implements chunk.
 func (c deltaEncodedChunk) lastTime() clientmodel.Timestamp {
-	return c.valueAtIndex(c.len() - 1).Timestamp
+	return c.timestampAtIndex(c.len() - 1)
 }
 
 // newIterator implements chunk.
@@ -251,7 +251,7 @@ func (c deltaEncodedChunk) values() <-chan *metric.SamplePair {
 }
 
 // encoding implements chunk.
-func (c deltaEncodedChunk) encoding() chunkEncoding { return delta }
+func (c deltaEncodedChunk) encoding() ChunkEncoding { return Delta }
 
 func (c deltaEncodedChunk) timeBytes() deltaBytes {
 	return deltaBytes(c[deltaHeaderTimeBytesOffset])
@@ -285,6 +285,23 @@ func (c deltaEncodedChunk) len() int {
 }
 
 func (c deltaEncodedChunk) valueAtIndex(idx int) *metric.SamplePair {
+	s := c.sampleAtIndex(idx)
+	return &s
+}
+
+// sampleAtIndex returns the sample with the given index by value. Unlike
+// valueAtIndex, it doesn't allocate, so it should be used wherever many
+// samples are decoded.
+func (c deltaEncodedChunk) sampleAtIndex(idx int) metric.SamplePair {
+	return metric.SamplePair{
+		Timestamp: c.timestampAtIndex(idx),
+		Value:     c.sampleValueAtIndex(idx),
+	}
+}
+
+// timestampAtIndex decodes only the timestamp of the sample with the given
+// index, straight from the chunk's bytes.
+func (c deltaEncodedChunk) timestampAtIndex(idx int) clientmodel.Timestamp {
 	offset := deltaHeaderBytes + idx*c.sampleSize()
 
 	var ts clientmodel.Timestamp
@@ -302,6 +319,13 @@ func (c deltaEncodedChunk) valueAtIndex(idx int) *metric.SamplePair {
 		panic("Invalid number of bytes for time delta")
 	}
 
+	return ts
+}
+
+// sampleValueAtIndex decodes only the value of the sample with the given
+// index, straight from the chunk's bytes.
+func (c deltaEncodedChunk) sampleValueAtIndex(idx int) clientmodel.SampleValue {
+	offset := deltaHeaderBytes + idx*c.sampleSize()
 	offset += int(c.timeBytes())
 
 	var v clientmodel.SampleValue
@@ -330,46 +354,46 @@ func (c deltaEncodedChunk) valueAtIndex(idx int) *metric.SamplePair {
 			panic("Invalid number of bytes for floating point delta")
 		}
 	}
-	return &metric.SamplePair{
-		Timestamp: ts,
-		Value:     v,
-	}
+
+	return v
 }
 
 // deltaEncodedChunkIterator implements chunkIterator.
 type deltaEncodedChunkIterator struct {
 	chunk *deltaEncodedChunk
+	// The index of the next sample to be returned by nextBatch.
+	batchIdx int
 	// TODO: add more fields here to keep track of last position.
 }
 
 // getValueAtTime implements chunkIterator.
 func (it *deltaEncodedChunkIterator) getValueAtTime(t clientmodel.Timestamp) metric.Values {
 	i := sort.Search(it.chunk.len(), func(i int) bool {
-		return !it.chunk.valueAtIndex(i).Timestamp.Before(t)
+		return !it.chunk.timestampAtIndex(i).Before(t)
 	})
 
 	switch i {
 	case 0:
-		return metric.Values{*it.chunk.valueAtIndex(0)}
+		return metric.Values{it.chunk.sampleAtIndex(0)}
 	case it.chunk.len():
-		return metric.Values{*it.chunk.valueAtIndex(it.chunk.len() - 1)}
+		return metric.Values{it.chunk.sampleAtIndex(it.chunk.len() - 1)}
 	default:
-		v := it.chunk.valueAtIndex(i)
+		v := it.chunk.sampleAtIndex(i)
 		if v.Timestamp.Equal(t) {
-			return metric.Values{*v}
+			return metric.Values{v}
 		}
-		return metric.Values{*it.chunk.valueAtIndex(i - 1), *v}
+		return metric.Values{it.chunk.sampleAtIndex(i - 1), v}
 	}
 }
 
 // getRangeValues implements chunkIterator.
 func (it *deltaEncodedChunkIterator) getRangeValues(in metric.Interval) metric.Values {
 	oldest := sort.Search(it.chunk.len(), func(i int) bool {
-		return !it.chunk.valueAtIndex(i).Timestamp.Before(in.OldestInclusive)
+		return !it.chunk.timestampAtIndex(i).Before(in.OldestInclusive)
 	})
 
 	newest := sort.Search(it.chunk.len(), func(i int) bool {
-		return it.chunk.valueAtIndex(i).Timestamp.After(in.NewestInclusive)
+		return it.chunk.timestampAtIndex(i).After(in.NewestInclusive)
 	})
 
 	if oldest == it.chunk.len() {
@@ -378,7 +402,7 @@ func (it *deltaEncodedChunkIterator) getRangeValues(in metric.Interval) metric.V
 
 	result := make(metric.Values, 0, newest-oldest)
 	for i := oldest; i < newest; i++ {
-		result = append(result, *it.chunk.valueAtIndex(i))
+		result = append(result, it.chunk.sampleAtIndex(i))
 	}
 	return result
 }
@@ -387,3 +411,31 @@ func (it *deltaEncodedChunkIterator) getRangeValues(in metric.Interval) metric.V
 func (it *deltaEncodedChunkIterator) contains(t clientmodel.Timestamp) bool {
 	return !t.Before(it.chunk.firstTime()) && !t.After(it.chunk.lastTime())
 }
+
+// nextBatch implements chunkIterator.
+func (it *deltaEncodedChunkIterator) nextBatch() metric.Values {
+	n := it.chunk.len()
+	if it.batchIdx >= n {
+		return nil
+	}
+	end := it.batchIdx + chunkIteratorBatchSize
+	if end > n {
+		end = n
+	}
+	batch := make(metric.Values, 0, end-it.batchIdx)
+	for ; it.batchIdx < end; it.batchIdx++ {
+		batch = append(batch, it.chunk.sampleAtIndex(it.batchIdx))
+	}
+	return batch
+}
+
+// reverseValues implements chunkIterator.
+func (it *deltaEncodedChunkIterator) reverseValues() <-chan *metric.SamplePair {
+	n := it.chunk.len()
+	valuesChan := make(chan *metric.SamplePair, n)
+	for i := n - 1; i >= 0; i-- {
+		valuesChan <- it.chunk.valueAtIndex(i)
+	}
+	close(valuesChan)
+	return valuesChan
+}
@@ -0,0 +1,118 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"unsafe"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+// directIOAlignment is the alignment of file offsets, lengths, and buffers
+// required for O_DIRECT. It satisfies the logical block size of all common
+// disks and file systems.
+const directIOAlignment = 4096
+
+// alignedBuffer returns a zeroed buffer of length n that starts at an address
+// aligned to directIOAlignment.
+func alignedBuffer(n int) []byte {
+	buf := make([]byte, n+directIOAlignment)
+	off := int(uintptr(unsafe.Pointer(&buf[0])) & (directIOAlignment - 1))
+	if off != 0 {
+		off = directIOAlignment - off
+	}
+	return buf[off : off+n : off+n]
+}
+
+// checkDirectIO returns an error if series files cannot be written with
+// O_DIRECT, either because the platform or because the file system of the
+// storage directory does not support it.
+func (p *persistence) checkDirectIO() error {
+	if !directIOSupported {
+		return fmt.Errorf("O_DIRECT is not supported on this platform")
+	}
+	probe, err := ioutil.TempFile(p.basePath, "directio")
+	if err != nil {
+		return err
+	}
+	name := probe.Name()
+	probe.Close()
+	defer os.Remove(name)
+
+	f, err := openFileDirect(name, os.O_WRONLY, 0640)
+	if err != nil {
+		return fmt.Errorf("file system of %s does not support O_DIRECT: %s", p.basePath, err)
+	}
+	defer f.Close()
+	if _, err := f.Write(alignedBuffer(directIOAlignment)); err != nil {
+		return fmt.Errorf("file system of %s does not support O_DIRECT: %s", p.basePath, err)
+	}
+	return nil
+}
+
+// appendChunksDirect appends the given chunks to the series file of fp with
+// O_DIRECT, so that they bypass the page cache, and returns the new size of
+// the file. As chunk records are not aligned to disk blocks, the partial
+// block at the end of the file is read back and written again, followed by
+// the chunks and zero padding up to the next block boundary. The file is then
+// truncated to its real size. (A crash before the truncation leaves the
+// padding in place, just like a torn append leaves a partial chunk.) The
+// caller must have logged the series change.
+func (p *persistence) appendChunksDirect(fp clientmodel.Fingerprint, chunks []chunk) (int64, error) {
+	if err := os.MkdirAll(p.dirNameForFingerprint(fp), 0700); err != nil {
+		return 0, err
+	}
+	f, err := openFileDirect(p.fileNameForFingerprint(fp), os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return 0, err
+	}
+	defer p.closeChunkFile(f)
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	var records bytes.Buffer
+	if err := p.writeChunks(&records, chunks); err != nil {
+		return 0, err
+	}
+
+	start := fi.Size() &^ (directIOAlignment - 1)
+	tail := int(fi.Size() - start)
+	end := tail + records.Len()
+	buf := alignedBuffer((end + directIOAlignment - 1) &^ (directIOAlignment - 1))
+	if tail > 0 {
+		n, err := f.ReadAt(buf[:directIOAlignment], start)
+		if n < tail {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, fmt.Errorf("error reading last block of series file: %s", err)
+		}
+	}
+	copy(buf[tail:], records.Bytes())
+	if _, err := f.WriteAt(buf, start); err != nil {
+		return 0, err
+	}
+	size := start + int64(end)
+	if err := f.Truncate(size); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
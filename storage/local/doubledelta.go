@@ -101,7 +101,7 @@ func (c doubleDeltaEncodedChunk) add(s *metric.SamplePair) []chunk {
 	// Do we generally have space for another sample in this chunk? If not,
 	// overflow into a new one.
 	if remainingBytes < sampleSize {
-		overflowChunks := newChunk().add(s)
+		overflowChunks := newChunkForEncoding(DoubleDelta).add(s)
 		return []chunk{&c, overflowChunks[0]}
 	}
 
@@ -136,7 +136,7 @@ func (c doubleDeltaEncodedChunk) add(s *metric.SamplePair) []chunk {
 			return transcodeAndAdd(newDoubleDeltaEncodedChunk(ntb, nvb, nInt, cap(c)), &c, s)
 		}
 		// Chunk is already half full. Better create a new one and save the transcoding efforts.
-		overflowChunks := newChunk().add(s)
+		overflowChunks := newChunkForEncoding(DoubleDelta).add(s)
 		return []chunk{&c, overflowChunks[0]}
 	}
 
@@ -201,7 +201,7 @@ func (c doubleDeltaEncodedChunk) firstTime() clientmodel.Timestamp {
 
 // lastTime implements chunk.
 func (c doubleDeltaEncodedChunk) lastTime() clientmodel.Timestamp {
-	return c.valueAtIndex(c.len() - 1).Timestamp
+	return c.timestampAtIndex(c.len() - 1)
 }
 
 // newIterator implements chunk.
@@ -259,7 +259,7 @@ func (c doubleDeltaEncodedChunk) values() <-chan *metric.SamplePair {
 }
 
 // encoding implements chunk.
-func (c doubleDeltaEncodedChunk) encoding() chunkEncoding { return doubleDelta }
+func (c doubleDeltaEncodedChunk) encoding() ChunkEncoding { return DoubleDelta }
 
 func (c doubleDeltaEncodedChunk) baseTime() clientmodel.Timestamp {
 	return clientmodel.Timestamp(
@@ -388,27 +388,33 @@ func (c doubleDeltaEncodedChunk) addSecondSample(s *metric.SamplePair, tb, vb de
 }
 
 func (c doubleDeltaEncodedChunk) valueAtIndex(idx int) *metric.SamplePair {
-	if idx == 0 {
-		return &metric.SamplePair{
-			Timestamp: c.baseTime(),
-			Value:     c.baseValue(),
-		}
+	s := c.sampleAtIndex(idx)
+	return &s
+}
+
+// sampleAtIndex returns the sample with the given index by value. Unlike
+// valueAtIndex, it doesn't allocate, so it should be used wherever many
+// samples are decoded.
+func (c doubleDeltaEncodedChunk) sampleAtIndex(idx int) metric.SamplePair {
+	return metric.SamplePair{
+		Timestamp: c.timestampAtIndex(idx),
+		Value:     c.sampleValueAtIndex(idx),
 	}
-	if idx == 1 {
-		// If time and/or value bytes are at d8, the time and value is
-		// saved directly rather than as a difference.
-		timestamp := c.baseTimeDelta()
+}
+
+// timestampAtIndex decodes only the timestamp of the sample with the given
+// index, straight from the chunk's bytes.
+func (c doubleDeltaEncodedChunk) timestampAtIndex(idx int) clientmodel.Timestamp {
+	switch idx {
+	case 0:
+		return c.baseTime()
+	case 1:
+		// If time bytes are at d8, the time is saved directly rather
+		// than as a difference.
 		if c.timeBytes() < d8 {
-			timestamp += c.baseTime()
-		}
-		value := c.baseValueDelta()
-		if c.valueBytes() < d8 {
-			value += c.baseValue()
-		}
-		return &metric.SamplePair{
-			Timestamp: timestamp,
-			Value:     value,
+			return c.baseTime() + c.baseTimeDelta()
 		}
+		return c.baseTimeDelta()
 	}
 	offset := doubleDeltaHeaderBytes + (idx-2)*c.sampleSize()
 
@@ -433,6 +439,24 @@ func (c doubleDeltaEncodedChunk) valueAtIndex(idx int) *metric.SamplePair {
 		panic("Invalid number of bytes for time delta")
 	}
 
+	return ts
+}
+
+// sampleValueAtIndex decodes only the value of the sample with the given
+// index, straight from the chunk's bytes.
+func (c doubleDeltaEncodedChunk) sampleValueAtIndex(idx int) clientmodel.SampleValue {
+	switch idx {
+	case 0:
+		return c.baseValue()
+	case 1:
+		// If value bytes are at d8, the value is saved directly rather
+		// than as a difference.
+		if c.valueBytes() < d8 {
+			return c.baseValue() + c.baseValueDelta()
+		}
+		return c.baseValueDelta()
+	}
+	offset := doubleDeltaHeaderBytes + (idx-2)*c.sampleSize()
 	offset += int(c.timeBytes())
 
 	var v clientmodel.SampleValue
@@ -470,15 +494,15 @@ func (c doubleDeltaEncodedChunk) valueAtIndex(idx int) *metric.SamplePair {
 			panic("Invalid number of bytes for floating point delta")
 		}
 	}
-	return &metric.SamplePair{
-		Timestamp: ts,
-		Value:     v,
-	}
+
+	return v
 }
 
 // doubleDeltaEncodedChunkIterator implements chunkIterator.
 type doubleDeltaEncodedChunkIterator struct {
 	chunk *doubleDeltaEncodedChunk
+	// The index of the next sample to be returned by nextBatch.
+	batchIdx int
 	// TODO(beorn7): add more fields here to keep track of last position.
 }
 
@@ -487,20 +511,20 @@ func (it *doubleDeltaEncodedChunkIterator) getValueAtTime(t clientmodel.Timestam
 	// TODO(beorn7): Implement in a more efficient way making use of the
 	// state of the iterator and internals of the doubleDeltaChunk.
 	i := sort.Search(it.chunk.len(), func(i int) bool {
-		return !it.chunk.valueAtIndex(i).Timestamp.Before(t)
+		return !it.chunk.timestampAtIndex(i).Before(t)
 	})
 
 	switch i {
 	case 0:
-		return metric.Values{*it.chunk.valueAtIndex(0)}
+		return metric.Values{it.chunk.sampleAtIndex(0)}
 	case it.chunk.len():
-		return metric.Values{*it.chunk.valueAtIndex(it.chunk.len() - 1)}
+		return metric.Values{it.chunk.sampleAtIndex(it.chunk.len() - 1)}
 	default:
-		v := it.chunk.valueAtIndex(i)
+		v := it.chunk.sampleAtIndex(i)
 		if v.Timestamp.Equal(t) {
-			return metric.Values{*v}
+			return metric.Values{v}
 		}
-		return metric.Values{*it.chunk.valueAtIndex(i - 1), *v}
+		return metric.Values{it.chunk.sampleAtIndex(i - 1), v}
 	}
 }
 
@@ -509,11 +533,11 @@ func (it *doubleDeltaEncodedChunkIterator) getRangeValues(in metric.Interval) me
 	// TODO(beorn7): Implement in a more efficient way making use of the
 	// state of the iterator and internals of the doubleDeltaChunk.
 	oldest := sort.Search(it.chunk.len(), func(i int) bool {
-		return !it.chunk.valueAtIndex(i).Timestamp.Before(in.OldestInclusive)
+		return !it.chunk.timestampAtIndex(i).Before(in.OldestInclusive)
 	})
 
 	newest := sort.Search(it.chunk.len(), func(i int) bool {
-		return it.chunk.valueAtIndex(i).Timestamp.After(in.NewestInclusive)
+		return it.chunk.timestampAtIndex(i).After(in.NewestInclusive)
 	})
 
 	if oldest == it.chunk.len() {
@@ -522,7 +546,7 @@ func (it *doubleDeltaEncodedChunkIterator) getRangeValues(in metric.Interval) me
 
 	result := make(metric.Values, 0, newest-oldest)
 	for i := oldest; i < newest; i++ {
-		result = append(result, *it.chunk.valueAtIndex(i))
+		result = append(result, it.chunk.sampleAtIndex(i))
 	}
 	return result
 }
@@ -531,3 +555,31 @@ func (it *doubleDeltaEncodedChunkIterator) getRangeValues(in metric.Interval) me
 func (it *doubleDeltaEncodedChunkIterator) contains(t clientmodel.Timestamp) bool {
 	return !t.Before(it.chunk.firstTime()) && !t.After(it.chunk.lastTime())
 }
+
+// nextBatch implements chunkIterator.
+func (it *doubleDeltaEncodedChunkIterator) nextBatch() metric.Values {
+	n := it.chunk.len()
+	if it.batchIdx >= n {
+		return nil
+	}
+	end := it.batchIdx + chunkIteratorBatchSize
+	if end > n {
+		end = n
+	}
+	batch := make(metric.Values, 0, end-it.batchIdx)
+	for ; it.batchIdx < end; it.batchIdx++ {
+		batch = append(batch, it.chunk.sampleAtIndex(it.batchIdx))
+	}
+	return batch
+}
+
+// reverseValues implements chunkIterator.
+func (it *doubleDeltaEncodedChunkIterator) reverseValues() <-chan *metric.SamplePair {
+	n := it.chunk.len()
+	valuesChan := make(chan *metric.SamplePair, n)
+	for i := n - 1; i >= 0; i-- {
+		valuesChan <- it.chunk.valueAtIndex(i)
+	}
+	close(valuesChan)
+	return valuesChan
+}
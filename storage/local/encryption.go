@@ -0,0 +1,409 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+const (
+	encryptionFileName    = "ENCRYPTION"
+	encryptionMagicString = "PrometheusEncryption"
+
+	// encryptionOverhead is the number of bytes an encrypted chunk record
+	// is longer than an unencrypted one: the GCM nonce and the GCM tag.
+	encryptionOverhead = 12 + 16
+)
+
+// KeyProvider provides the AES key chunk data, checkpoints, and the
+// write-ahead log are encrypted with.
+type KeyProvider interface {
+	Key() ([]byte, error)
+}
+
+// KeyFile is a KeyProvider reading a hex-encoded key of 16, 24, or 32 bytes
+// (for AES-128, AES-192, or AES-256) from the file with the given name.
+type KeyFile string
+
+// Key implements KeyProvider.
+func (f KeyFile) Key() ([]byte, error) {
+	buf, err := ioutil.ReadFile(string(f))
+	if err != nil {
+		return nil, err
+	}
+	return decodeKey(buf)
+}
+
+// KeyCommand is a KeyProvider running the given command and arguments, e.g. a
+// plugin fetching the key from a key management service. The command has to
+// print the hex-encoded key (see KeyFile) to its standard output.
+type KeyCommand []string
+
+// Key implements KeyProvider.
+func (c KeyCommand) Key() ([]byte, error) {
+	if len(c) == 0 {
+		return nil, fmt.Errorf("no key command given")
+	}
+	out, err := exec.Command(c[0], c[1:]...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("error running key command %s: %s", c[0], err)
+	}
+	return decodeKey(out)
+}
+
+func decodeKey(buf []byte) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(string(buf)))
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode encryption key: %s", err)
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("encryption key has %d bytes, want 16, 24, or 32", len(key))
+	}
+}
+
+// setupEncryption enables the encryption of chunk data, checkpoints, and the
+// write-ahead log with the key from kp, or leaves it disabled if kp is nil. The ENCRYPTION file in
+// the storage directory records that the storage is encrypted and allows to
+// detect a wrong key. As series files cannot contain both encrypted and
+// unencrypted chunks, encryption can only be enabled for a new storage, and an
+// encrypted storage cannot be opened without its key. It must be called before
+// anything is read from or written to the series files, checkpoints, or the
+// write-ahead log.
+func (p *persistence) setupEncryption(kp KeyProvider) error {
+	fileName := filepath.Join(p.basePath, encryptionFileName)
+	sealed, err := ioutil.ReadFile(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	encrypted := err == nil
+	if kp == nil {
+		if encrypted {
+			return fmt.Errorf("storage in %s is encrypted, but no encryption key is configured", p.basePath)
+		}
+		return nil
+	}
+
+	key, err := kp.Key()
+	if err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	if p.aead, err = cipher.NewGCM(block); err != nil {
+		return err
+	}
+
+	if encrypted {
+		magic, err := p.open(sealed, nil)
+		if err != nil || string(magic) != encryptionMagicString {
+			p.aead = nil
+			return fmt.Errorf("wrong encryption key for storage in %s", p.basePath)
+		}
+		if p.wal != nil {
+			p.wal.setAEAD(p.aead)
+		}
+		return nil
+	}
+	if used, err := p.hasUnencryptedData(); err != nil || used {
+		p.aead = nil
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("cannot enable encryption for the existing unencrypted storage in %s", p.basePath)
+	}
+	if sealed, err = p.seal([]byte(encryptionMagicString), nil); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(fileName, sealed, 0640); err != nil {
+		return err
+	}
+	if p.wal != nil {
+		p.wal.setAEAD(p.aead)
+	}
+	return nil
+}
+
+// hasUnencryptedData returns true if the storage directory contains a
+// checkpoint, series files, or WAL segments from an earlier run.
+func (p *persistence) hasUnencryptedData() (bool, error) {
+	if _, err := os.Stat(p.headsFileName()); err == nil {
+		return true, nil
+	}
+	if len(p.walSegments) > 0 {
+		return true, nil
+	}
+	fis, err := ioutil.ReadDir(p.basePath)
+	if err != nil {
+		return false, err
+	}
+	for _, fi := range fis {
+		if !fi.IsDir() || len(fi.Name()) != seriesDirNameLen {
+			continue
+		}
+		if _, err := hex.DecodeString(fi.Name()); err != nil {
+			continue
+		}
+		names, err := ioutil.ReadDir(filepath.Join(p.basePath, fi.Name()))
+		if err != nil {
+			return false, err
+		}
+		if len(names) > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// seal encrypts and authenticates plaintext and the additional data with a
+// random nonce, which is prepended to the result.
+func (p *persistence) seal(plaintext, additionalData []byte) ([]byte, error) {
+	return seal(p.aead, plaintext, additionalData)
+}
+
+// open reverses seal.
+func (p *persistence) open(sealed, additionalData []byte) ([]byte, error) {
+	return open(p.aead, sealed, additionalData)
+}
+
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(aead cipher.AEAD, sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("sealed data too short")
+	}
+	nonce := sealed[:aead.NonceSize()]
+	return aead.Open(nil, nonce, sealed[aead.NonceSize():], additionalData)
+}
+
+// chunkRecordLen returns the length of a chunk in a series file, including
+// its header.
+func (p *persistence) chunkRecordLen() int {
+	if p.aead == nil {
+		return chunkLenWithHeader
+	}
+	return chunkLenWithHeader + encryptionOverhead
+}
+
+// writeChunkPayload writes the chunk following its header to w. With
+// encryption, the chunk is sealed, and the header is authenticated along with
+// it, so that each chunk record stays self-contained.
+func (p *persistence) writeChunkPayload(w io.Writer, header []byte, c chunk) error {
+	if p.aead == nil {
+		return c.marshal(w)
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, chunkLen))
+	if err := c.marshal(buf); err != nil {
+		return err
+	}
+	sealed, err := p.seal(buf.Bytes(), header)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(sealed)
+	return err
+}
+
+// chunkPayload returns the marshaled chunk in the given chunk record,
+// decrypting it if needed.
+func (p *persistence) chunkPayload(record []byte) ([]byte, error) {
+	if p.aead == nil {
+		return record[chunkHeaderLen:chunkLenWithHeader], nil
+	}
+	payload, err := p.open(record[chunkHeaderLen:p.chunkRecordLen()], record[:chunkHeaderLen])
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt chunk: %s", err)
+	}
+	return payload, nil
+}
+
+// unmarshalChunkRecord returns the chunk in the given chunk record.
+func (p *persistence) unmarshalChunkRecord(record []byte) (chunk, error) {
+	payload, err := p.chunkPayload(record)
+	if err != nil {
+		return nil, err
+	}
+	c := newChunkForEncoding(ChunkEncoding(record[chunkHeaderTypeOffset]))
+	c.unmarshalFromBuf(payload)
+	return c, nil
+}
+
+// writeCheckpointedSeries writes a series to a checkpoint with
+// writeSeriesCheckpoint. With encryption, the series is sealed and preceded by
+// its uvarint-encoded length instead. The remaining items of the checkpoint
+// files stay unencrypted, as they do not contain any series data.
+func (p *persistence) writeCheckpointedSeries(w *bufio.Writer, fp clientmodel.Fingerprint, series *memorySeries) error {
+	if p.aead == nil {
+		return writeSeriesCheckpoint(w, fp, series)
+	}
+	var buf bytes.Buffer
+	bw := bufio.NewWriter(&buf)
+	if err := writeSeriesCheckpoint(bw, fp, series); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	sealed, err := p.seal(buf.Bytes(), nil)
+	if err != nil {
+		return err
+	}
+	lenBuf := make([]byte, binary.MaxVarintLen64)
+	if _, err := w.Write(lenBuf[:binary.PutUvarint(lenBuf, uint64(len(sealed)))]); err != nil {
+		return err
+	}
+	_, err = w.Write(sealed)
+	return err
+}
+
+// readCheckpointedSeries reads a series written by writeCheckpointedSeries.
+func (p *persistence) readCheckpointedSeries(r *bufio.Reader, version int64) (clientmodel.Fingerprint, *memorySeries, error) {
+	if p.aead == nil {
+		return readSeriesCheckpoint(r, version)
+	}
+	sealedLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, fmt.Errorf("could not decode length of encrypted series: %s", err)
+	}
+	if sealedLen > 1<<30 {
+		return 0, nil, fmt.Errorf("implausible length of encrypted series: %d", sealedLen)
+	}
+	sealed := make([]byte, sealedLen)
+	if _, err := io.ReadFull(r, sealed); err != nil {
+		return 0, nil, fmt.Errorf("could not read encrypted series: %s", err)
+	}
+	buf, err := p.open(sealed, nil)
+	if err != nil {
+		return 0, nil, fmt.Errorf("could not decrypt series: %s", err)
+	}
+	return readSeriesCheckpoint(bufio.NewReader(bytes.NewReader(buf)), version)
+}
+
+// sealedFrameLen is the maximum number of plaintext bytes sealed in one frame
+// by a sealedWriter.
+const sealedFrameLen = 64 * 1024
+
+// sealedWriter seals everything written to it in frames of up to
+// sealedFrameLen bytes, each preceded by the uvarint-encoded length of the
+// sealed frame. It is used for compressed checkpoints, which have to be
+// compressed before they are encrypted, as encrypted data does not compress.
+// It has to be closed to write the last frame, but closing it does not close
+// the underlying writer.
+type sealedWriter struct {
+	p   *persistence
+	w   io.Writer
+	buf []byte
+}
+
+func (p *persistence) newSealedWriter(w io.Writer) *sealedWriter {
+	return &sealedWriter{p: p, w: w, buf: make([]byte, 0, sealedFrameLen)}
+}
+
+// Write implements io.Writer.
+func (sw *sealedWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := copy(sw.buf[len(sw.buf):cap(sw.buf)], b)
+		sw.buf = sw.buf[:len(sw.buf)+n]
+		b = b[n:]
+		written += n
+		if len(sw.buf) == cap(sw.buf) {
+			if err := sw.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close implements io.Closer.
+func (sw *sealedWriter) Close() error {
+	if len(sw.buf) == 0 {
+		return nil
+	}
+	return sw.flush()
+}
+
+func (sw *sealedWriter) flush() error {
+	sealed, err := sw.p.seal(sw.buf, nil)
+	if err != nil {
+		return err
+	}
+	sw.buf = sw.buf[:0]
+	lenBuf := make([]byte, binary.MaxVarintLen64)
+	if _, err := sw.w.Write(lenBuf[:binary.PutUvarint(lenBuf, uint64(len(sealed)))]); err != nil {
+		return err
+	}
+	_, err = sw.w.Write(sealed)
+	return err
+}
+
+// sealedReader reads what a sealedWriter has written to r.
+type sealedReader struct {
+	p   *persistence
+	r   *bufio.Reader
+	buf []byte // Remaining plaintext of the current frame.
+}
+
+func (p *persistence) newSealedReader(r *bufio.Reader) *sealedReader {
+	return &sealedReader{p: p, r: r}
+}
+
+// Read implements io.Reader.
+func (sr *sealedReader) Read(b []byte) (int, error) {
+	for len(sr.buf) == 0 {
+		sealedLen, err := binary.ReadUvarint(sr.r)
+		if err != nil {
+			return 0, err
+		}
+		if sealedLen > sealedFrameLen+encryptionOverhead {
+			return 0, fmt.Errorf("implausible length of encrypted frame: %d", sealedLen)
+		}
+		sealed := make([]byte, sealedLen)
+		if _, err := io.ReadFull(sr.r, sealed); err != nil {
+			return 0, fmt.Errorf("could not read encrypted frame: %s", err)
+		}
+		if sr.buf, err = sr.p.open(sealed, nil); err != nil {
+			return 0, fmt.Errorf("could not decrypt frame: %s", err)
+		}
+	}
+	n := copy(b, sr.buf)
+	sr.buf = sr.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,47 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build amd64 arm64
+
+package local
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	fadvDontNeed      = 4 // POSIX_FADV_DONTNEED on Linux.
+	directIOSupported = true
+)
+
+func fdatasync(f *os.File) error {
+	return syscall.Fdatasync(int(f.Fd()))
+}
+
+// fadviseDontNeed advises the kernel that the cached pages of f are not needed
+// anymore. Dirty pages are not dropped.
+func fadviseDontNeed(f *os.File) error {
+	_, _, errno := syscall.Syscall6(syscall.SYS_FADVISE64, f.Fd(), 0, 0, fadvDontNeed, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// openFileDirect opens the named file with O_DIRECT, so that reads and writes
+// bypass the page cache. Offsets, lengths, and buffers have to be aligned to
+// directIOAlignment.
+func openFileDirect(name string, flag int, perm os.FileMode) (*os.File, error) {
+	return os.OpenFile(name, flag|syscall.O_DIRECT, perm)
+}
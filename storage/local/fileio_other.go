@@ -0,0 +1,35 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !linux !amd64,!arm64
+
+package local
+
+import (
+	"fmt"
+	"os"
+)
+
+const directIOSupported = false
+
+func fdatasync(f *os.File) error {
+	return f.Sync()
+}
+
+func fadviseDontNeed(f *os.File) error {
+	return nil
+}
+
+func openFileDirect(name string, flag int, perm os.FileMode) (*os.File, error) {
+	return nil, fmt.Errorf("O_DIRECT is not supported on this platform")
+}
@@ -13,33 +13,48 @@
 
 // Package index provides a number of indexes backed by persistent key-value
 // stores.  The only supported implementation of a key-value store is currently
-// goleveldb, but other implementations can easily be added.
+// goleveldb, but other implementations can easily be added. The index of label
+// pairs to fingerprints is an in-process inverted index instead, see
+// LabelPairFingerprintIndex.
 package index
 
 import (
-	"flag"
 	"os"
 	"path"
 
 	clientmodel "github.com/prometheus/client_golang/model"
 
 	"github.com/prometheus/prometheus/storage/local/codable"
-	"github.com/prometheus/prometheus/storage/metric"
 )
 
 const (
 	fingerprintToMetricDir     = "archived_fingerprint_to_metric"
 	fingerprintTimeRangeDir    = "archived_fingerprint_to_timerange"
 	labelNameToLabelValuesDir  = "labelname_to_labelvalues"
-	labelPairToFingerprintsDir = "labelpair_to_fingerprints"
+	labelPairToFingerprintsDir = "labelpair_to_fingerprints" // Only migrated from.
+	labelPairPostingsDir       = "labelpair_postings"
 )
 
-var (
-	fingerprintToMetricCacheSize     = flag.Int("storage.local.index-cache-size.fingerprint-to-metric", 10*1024*1024, "The size in bytes for the fingerprint to metric index cache.")
-	fingerprintTimeRangeCacheSize    = flag.Int("storage.local.index-cache-size.fingerprint-to-timerange", 5*1024*1024, "The size in bytes for the metric time range index cache.")
-	labelNameToLabelValuesCacheSize  = flag.Int("storage.local.index-cache-size.label-name-to-label-values", 10*1024*1024, "The size in bytes for the label name to label values index cache.")
-	labelPairToFingerprintsCacheSize = flag.Int("storage.local.index-cache-size.label-pair-to-fingerprints", 20*1024*1024, "The size in bytes for the label pair to fingerprints index cache.")
-)
+// CacheSizes are the sizes in bytes of the caches of the LevelDB-backed
+// indexes.
+type CacheSizes struct {
+	FingerprintToMetric    int
+	FingerprintTimeRange   int
+	LabelNameToLabelValues int
+}
+
+// DefaultCacheSizes are the cache sizes used if none are configured.
+var DefaultCacheSizes = CacheSizes{
+	FingerprintToMetric:    10 * 1024 * 1024,
+	FingerprintTimeRange:   5 * 1024 * 1024,
+	LabelNameToLabelValues: 10 * 1024 * 1024,
+}
+
+// ArchiveIndexDirs returns the names of the directories, relative to the base
+// path of the storage, that hold the indexes of archived series.
+func ArchiveIndexDirs() []string {
+	return []string{fingerprintToMetricDir, fingerprintTimeRangeDir}
+}
 
 // FingerprintMetricMapping is an in-memory map of fingerprints to metrics.
 type FingerprintMetricMapping map[clientmodel.Fingerprint]clientmodel.Metric
@@ -89,11 +104,11 @@ func (i *FingerprintMetricIndex) Lookup(fp clientmodel.Fingerprint) (metric clie
 }
 
 // NewFingerprintMetricIndex returns a LevelDB-backed FingerprintMetricIndex
-// ready to use.
-func NewFingerprintMetricIndex(basePath string) (*FingerprintMetricIndex, error) {
+// ready to use, with a cache of the given size in bytes.
+func NewFingerprintMetricIndex(basePath string, cacheSize int) (*FingerprintMetricIndex, error) {
 	fingerprintToMetricDB, err := NewLevelDB(LevelDBOptions{
 		Path:           path.Join(basePath, fingerprintToMetricDir),
-		CacheSizeBytes: *fingerprintToMetricCacheSize,
+		CacheSizeBytes: cacheSize,
 	})
 	if err != nil {
 		return nil, err
@@ -161,11 +176,12 @@ func (i *LabelNameLabelValuesIndex) LookupSet(l clientmodel.LabelName) (values m
 }
 
 // NewLabelNameLabelValuesIndex returns a LevelDB-backed
-// LabelNameLabelValuesIndex ready to use.
-func NewLabelNameLabelValuesIndex(basePath string) (*LabelNameLabelValuesIndex, error) {
+// LabelNameLabelValuesIndex ready to use, with a cache of the given size in
+// bytes.
+func NewLabelNameLabelValuesIndex(basePath string, cacheSize int) (*LabelNameLabelValuesIndex, error) {
 	labelNameToLabelValuesDB, err := NewLevelDB(LevelDBOptions{
 		Path:           path.Join(basePath, labelNameToLabelValuesDir),
-		CacheSizeBytes: *labelNameToLabelValuesCacheSize,
+		CacheSizeBytes: cacheSize,
 	})
 	if err != nil {
 		return nil, err
@@ -181,80 +197,6 @@ func DeleteLabelNameLabelValuesIndex(basePath string) error {
 	return os.RemoveAll(path.Join(basePath, labelNameToLabelValuesDir))
 }
 
-// LabelPairFingerprintsMapping is an in-memory map of label pairs to
-// fingerprints.
-type LabelPairFingerprintsMapping map[metric.LabelPair]codable.FingerprintSet
-
-// LabelPairFingerprintIndex is a KeyValueStore that maps existing label pairs
-// to the fingerprints of all metrics containing those label pairs.
-type LabelPairFingerprintIndex struct {
-	KeyValueStore
-}
-
-// IndexBatch indexes a batch of mappings from label pairs to fingerprints. A
-// mapping to an empty slice of fingerprints results in deletion of that mapping
-// from the index.
-//
-// While this method is fundamentally goroutine-safe, note that the order of
-// execution for multiple batches executed concurrently is undefined.
-func (i *LabelPairFingerprintIndex) IndexBatch(m LabelPairFingerprintsMapping) error {
-	batch := i.NewBatch()
-
-	for pair, fps := range m {
-		if len(fps) == 0 {
-			batch.Delete(codable.LabelPair(pair))
-		} else {
-			batch.Put(codable.LabelPair(pair), fps)
-		}
-	}
-
-	return i.Commit(batch)
-}
-
-// Lookup looks up all fingerprints for a given label pair.  Looking up a
-// non-existing label pair is not an error. In that case, (nil, false, nil) is
-// returned.
-//
-// This method is goroutine-safe.
-func (i *LabelPairFingerprintIndex) Lookup(p metric.LabelPair) (fps clientmodel.Fingerprints, ok bool, err error) {
-	ok, err = i.Get((codable.LabelPair)(p), (*codable.Fingerprints)(&fps))
-	return
-}
-
-// LookupSet looks up all fingerprints for a given label pair.  Looking up a
-// non-existing label pair is not an error. In that case, (nil, false, nil) is
-// returned.
-//
-// This method is goroutine-safe.
-func (i *LabelPairFingerprintIndex) LookupSet(p metric.LabelPair) (fps map[clientmodel.Fingerprint]struct{}, ok bool, err error) {
-	ok, err = i.Get((codable.LabelPair)(p), (*codable.FingerprintSet)(&fps))
-	if fps == nil {
-		fps = map[clientmodel.Fingerprint]struct{}{}
-	}
-	return
-}
-
-// NewLabelPairFingerprintIndex returns a LevelDB-backed
-// LabelPairFingerprintIndex ready to use.
-func NewLabelPairFingerprintIndex(basePath string) (*LabelPairFingerprintIndex, error) {
-	labelPairToFingerprintsDB, err := NewLevelDB(LevelDBOptions{
-		Path:           path.Join(basePath, labelPairToFingerprintsDir),
-		CacheSizeBytes: *labelPairToFingerprintsCacheSize,
-	})
-	if err != nil {
-		return nil, err
-	}
-	return &LabelPairFingerprintIndex{
-		KeyValueStore: labelPairToFingerprintsDB,
-	}, nil
-}
-
-// DeleteLabelPairFingerprintIndex deletes the LevelDB-backed
-// LabelPairFingerprintIndex. Use only for a not yet opened index.
-func DeleteLabelPairFingerprintIndex(basePath string) error {
-	return os.RemoveAll(path.Join(basePath, labelPairToFingerprintsDir))
-}
-
 // FingerprintTimeRangeIndex models a database tracking the time ranges
 // of metrics by their fingerprints.
 type FingerprintTimeRangeIndex struct {
@@ -273,11 +215,12 @@ func (i *FingerprintTimeRangeIndex) Lookup(fp clientmodel.Fingerprint) (firstTim
 }
 
 // NewFingerprintTimeRangeIndex returns a LevelDB-backed
-// FingerprintTimeRangeIndex ready to use.
-func NewFingerprintTimeRangeIndex(basePath string) (*FingerprintTimeRangeIndex, error) {
+// FingerprintTimeRangeIndex ready to use, with a cache of the given size in
+// bytes.
+func NewFingerprintTimeRangeIndex(basePath string, cacheSize int) (*FingerprintTimeRangeIndex, error) {
 	fingerprintTimeRangeDB, err := NewLevelDB(LevelDBOptions{
 		Path:           path.Join(basePath, fingerprintTimeRangeDir),
-		CacheSizeBytes: *fingerprintTimeRangeCacheSize,
+		CacheSizeBytes: cacheSize,
 	})
 	if err != nil {
 		return nil, err
@@ -39,6 +39,11 @@ type KeyValueStore interface {
 	// supplied function for each mapping.
 	ForEach(func(kv KeyValueAccessor) error) error
 
+	// Compact reclaims the space taken by deleted and overwritten entries.
+	// It returns the approximate size in bytes of the KeyValueStore before
+	// and after.
+	Compact() (sizeBefore, sizeAfter int64, err error)
+
 	Close() error
 }
 
@@ -74,6 +74,28 @@ func (l *LevelDB) NewBatch() Batch {
 	}
 }
 
+// Compact implements KeyValueStore. Entries still in the journal are flushed
+// to tables first.
+func (l *LevelDB) Compact() (sizeBefore, sizeAfter int64, err error) {
+	if sizeBefore, err = l.size(); err != nil {
+		return 0, 0, err
+	}
+	if err := l.storage.CompactRange(*keyspace); err != nil {
+		return 0, 0, err
+	}
+	sizeAfter, err = l.size()
+	return sizeBefore, sizeAfter, err
+}
+
+// size returns the approximate size in bytes of the tables of the LevelDB.
+func (l *LevelDB) size() (int64, error) {
+	sizes, err := l.storage.SizeOf([]leveldb_util.Range{*keyspace})
+	if err != nil {
+		return 0, err
+	}
+	return int64(sizes.Sum()), nil
+}
+
 // Close implements KeyValueStore.
 func (l *LevelDB) Close() error {
 	return l.storage.Close()
@@ -0,0 +1,783 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package index
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/golang/glog"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/local/codable"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+const (
+	postingsFileName     = "postings.db"
+	postingsTempFileName = "postings.db.tmp"
+	postingsLogFileName  = "postings.log"
+
+	postingsMagicString   = "PrometheusPostings"
+	postingsFormatVersion = 1
+
+	// The log is compacted into the postings file once it has reached
+	// minCompactionLogSize and at least the size of the postings file
+	// divided by compactionLogRatio.
+	minCompactionLogSize = 1024 * 1024
+	compactionLogRatio   = 2
+
+	postingsBufSize = 64 * 1024
+)
+
+var errCorruptPostings = errors.New("corrupt postings data")
+
+// PostingsBatch is a batch of changes to a LabelPairFingerprintIndex. It maps
+// label pairs to the fingerprints to add to (true) or to remove from (false)
+// their posting lists.
+type PostingsBatch map[metric.LabelPair]map[clientmodel.Fingerprint]bool
+
+// Add records that fp is to be added to the posting list of lp, overriding an
+// earlier Remove of the same fingerprint in this batch.
+func (b PostingsBatch) Add(lp metric.LabelPair, fp clientmodel.Fingerprint) {
+	b.set(lp, fp, true)
+}
+
+// Remove records that fp is to be removed from the posting list of lp,
+// overriding an earlier Add of the same fingerprint in this batch.
+func (b PostingsBatch) Remove(lp metric.LabelPair, fp clientmodel.Fingerprint) {
+	b.set(lp, fp, false)
+}
+
+func (b PostingsBatch) set(lp metric.LabelPair, fp clientmodel.Fingerprint, add bool) {
+	fps, ok := b[lp]
+	if !ok {
+		fps = map[clientmodel.Fingerprint]bool{}
+		b[lp] = fps
+	}
+	fps[fp] = add
+}
+
+// postingsRef locates the posting list of a label pair in the postings file.
+type postingsRef struct {
+	offset int // Of the first fingerprint.
+	count  int
+}
+
+// LabelPairFingerprintIndex maps existing label pairs to the fingerprints of
+// all metrics containing those label pairs. It is an in-process inverted
+// index: The posting lists, i.e. the sorted fingerprints per label pair, are
+// kept in a memory-mapped postings file. Changes since the postings file was
+// written are kept in memory and appended to a log, which is replayed upon
+// opening the index. Once the log has grown large enough, the changes are
+// compacted into a new postings file.
+//
+// The index does not sync its files. After a crash, it has to be rebuilt
+// anyway, as the indexing queue in front of it is lost.
+type LabelPairFingerprintIndex struct {
+	dir string
+
+	// writeMtx serializes IndexBatch calls, including compactions. As
+	// only they modify the index, the fields below can be read without
+	// locking mtx while holding writeMtx.
+	writeMtx sync.Mutex
+	log      *os.File
+	logSize  int64
+
+	mtx  sync.RWMutex
+	data []byte // The mapped postings file, nil if there is none.
+	refs map[metric.LabelPair]postingsRef
+	// Changes since the postings file was written. Fingerprints in added
+	// are not in the postings file, fingerprints in removed are.
+	added, removed map[metric.LabelPair]codable.FingerprintSet
+}
+
+// NewLabelPairFingerprintIndex returns a LabelPairFingerprintIndex ready to
+// use. If there is no postings file yet, a LevelDB-backed index left behind
+// by an earlier version is migrated.
+func NewLabelPairFingerprintIndex(basePath string) (*LabelPairFingerprintIndex, error) {
+	i := &LabelPairFingerprintIndex{
+		dir:     path.Join(basePath, labelPairPostingsDir),
+		refs:    map[metric.LabelPair]postingsRef{},
+		added:   map[metric.LabelPair]codable.FingerprintSet{},
+		removed: map[metric.LabelPair]codable.FingerprintSet{},
+	}
+	if err := os.MkdirAll(i.dir, 0700); err != nil {
+		return nil, err
+	}
+	data, refs, err := loadPostingsFile(i.fileName(postingsFileName))
+	if err == nil {
+		i.data, i.refs = data, refs
+	}
+	if os.IsNotExist(err) {
+		err = i.migrateLevelDB(path.Join(basePath, labelPairToFingerprintsDir))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := i.replayLog(); err != nil {
+		i.unmap()
+		return nil, err
+	}
+	if i.log, err = os.OpenFile(i.fileName(postingsLogFileName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640); err != nil {
+		i.unmap()
+		return nil, err
+	}
+	return i, nil
+}
+
+// DeleteLabelPairFingerprintIndex deletes the LabelPairFingerprintIndex
+// (including a LevelDB-backed one left behind by an earlier version). Use only
+// for a not yet opened index.
+func DeleteLabelPairFingerprintIndex(basePath string) error {
+	if err := os.RemoveAll(path.Join(basePath, labelPairToFingerprintsDir)); err != nil {
+		return err
+	}
+	return os.RemoveAll(path.Join(basePath, labelPairPostingsDir))
+}
+
+// IndexBatch applies a batch of changes to the index. It returns the label
+// pairs of the batch whose posting lists are empty afterwards.
+//
+// This method is goroutine-safe. Concurrent batches are applied one after the
+// other in undefined order.
+func (i *LabelPairFingerprintIndex) IndexBatch(b PostingsBatch) ([]metric.LabelPair, error) {
+	i.writeMtx.Lock()
+	defer i.writeMtx.Unlock()
+
+	if err := i.appendToLog(b); err != nil {
+		return nil, err
+	}
+	i.mtx.Lock()
+	emptied := i.apply(b)
+	i.mtx.Unlock()
+
+	if i.logSize >= minCompactionLogSize && i.logSize*compactionLogRatio >= int64(len(i.data)) {
+		if err := i.compact(); err != nil {
+			// The changes are in the log, so the index is still
+			// consistent. Compaction will be retried with the next
+			// batch.
+			glog.Error("Error compacting label pair postings: ", err)
+		}
+	}
+	return emptied, nil
+}
+
+// Lookup looks up all fingerprints for a given label pair and returns them
+// sorted. Looking up a non-existing label pair is not an error. In that case,
+// (nil, false, nil) is returned.
+//
+// This method is goroutine-safe. Concurrent lookups do not block each other.
+func (i *LabelPairFingerprintIndex) Lookup(lp metric.LabelPair) (fps clientmodel.Fingerprints, ok bool, err error) {
+	i.mtx.RLock()
+	defer i.mtx.RUnlock()
+
+	fps = i.postings(lp)
+	return fps, len(fps) > 0, nil
+}
+
+// LookupAll looks up the fingerprints for each of the given label pairs, all
+// from the same state of the index. The fingerprints of lps[n] are returned
+// sorted in the n-th element of the result, which is nil if there are none.
+//
+// This method is goroutine-safe. Concurrent lookups do not block each other.
+func (i *LabelPairFingerprintIndex) LookupAll(lps []metric.LabelPair) ([]clientmodel.Fingerprints, error) {
+	i.mtx.RLock()
+	defer i.mtx.RUnlock()
+
+	result := make([]clientmodel.Fingerprints, len(lps))
+	for n, lp := range lps {
+		result[n] = i.postings(lp)
+	}
+	return result, nil
+}
+
+// ForEach calls fn for each label pair in the index with the number of
+// fingerprints in its posting list. It stops at the first error returned by
+// fn.
+//
+// This method is goroutine-safe. fn is called without holding any lock, so
+// the index might have changed in the meantime.
+func (i *LabelPairFingerprintIndex) ForEach(fn func(lp metric.LabelPair, numFPs int) error) error {
+	i.mtx.RLock()
+	counts := make(map[metric.LabelPair]int, len(i.refs)+len(i.added))
+	for lp := range i.refs {
+		counts[lp] = i.count(lp)
+	}
+	for lp := range i.added {
+		counts[lp] = i.count(lp)
+	}
+	i.mtx.RUnlock()
+
+	for lp, n := range counts {
+		if n == 0 {
+			continue
+		}
+		if err := fn(lp, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compact compacts the changes in the log into a new postings file, even if the
+// log has not grown large enough yet. It returns the size in bytes of the
+// postings file and the log before and after.
+//
+// This method is goroutine-safe.
+func (i *LabelPairFingerprintIndex) Compact() (sizeBefore, sizeAfter int64, err error) {
+	i.writeMtx.Lock()
+	defer i.writeMtx.Unlock()
+
+	sizeBefore = int64(len(i.data)) + i.logSize
+	if i.logSize == 0 {
+		return sizeBefore, sizeBefore, nil
+	}
+	if err := i.compact(); err != nil {
+		return sizeBefore, sizeBefore, err
+	}
+	return sizeBefore, int64(len(i.data)) + i.logSize, nil
+}
+
+// Reset replaces the content of the index by the additions in b and writes it
+// to a new postings file right away, bypassing the log. Removals in b are
+// ignored.
+//
+// This method is goroutine-safe.
+func (i *LabelPairFingerprintIndex) Reset(b PostingsBatch) error {
+	i.writeMtx.Lock()
+	defer i.writeMtx.Unlock()
+
+	i.mtx.Lock()
+	i.unmap()
+	i.refs = map[metric.LabelPair]postingsRef{}
+	i.added = map[metric.LabelPair]codable.FingerprintSet{}
+	i.removed = map[metric.LabelPair]codable.FingerprintSet{}
+	i.apply(b)
+	i.mtx.Unlock()
+	return i.compact()
+}
+
+// Close closes the index. Changes not compacted yet are kept in the log.
+func (i *LabelPairFingerprintIndex) Close() error {
+	i.writeMtx.Lock()
+	defer i.writeMtx.Unlock()
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	i.unmap()
+	return i.log.Close()
+}
+
+func (i *LabelPairFingerprintIndex) fileName(name string) string {
+	return path.Join(i.dir, name)
+}
+
+// fpAt returns the n-th fingerprint of the posting list ref refers to. The
+// caller must hold mtx or writeMtx.
+func (i *LabelPairFingerprintIndex) fpAt(ref postingsRef, n int) clientmodel.Fingerprint {
+	return clientmodel.Fingerprint(binary.BigEndian.Uint64(i.data[ref.offset+8*n:]))
+}
+
+// inPostingsFile returns whether fp is in the posting list of lp in the
+// postings file. The caller must hold mtx or writeMtx.
+func (i *LabelPairFingerprintIndex) inPostingsFile(lp metric.LabelPair, fp clientmodel.Fingerprint) bool {
+	ref, ok := i.refs[lp]
+	if !ok {
+		return false
+	}
+	n := sort.Search(ref.count, func(n int) bool { return i.fpAt(ref, n) >= fp })
+	return n < ref.count && i.fpAt(ref, n) == fp
+}
+
+// count returns the number of fingerprints in the posting list of lp. The
+// caller must hold mtx or writeMtx.
+func (i *LabelPairFingerprintIndex) count(lp metric.LabelPair) int {
+	return i.refs[lp].count - len(i.removed[lp]) + len(i.added[lp])
+}
+
+// postings returns the sorted posting list of lp, or nil if it is empty. The
+// caller must hold mtx or writeMtx.
+func (i *LabelPairFingerprintIndex) postings(lp metric.LabelPair) clientmodel.Fingerprints {
+	n := i.count(lp)
+	if n == 0 {
+		return nil
+	}
+	fps := make(clientmodel.Fingerprints, 0, n)
+	ref := i.refs[lp]
+	removed := i.removed[lp]
+	for j := 0; j < ref.count; j++ {
+		fp := i.fpAt(ref, j)
+		if _, ok := removed[fp]; !ok {
+			fps = append(fps, fp)
+		}
+	}
+	added := i.added[lp]
+	for fp := range added {
+		fps = append(fps, fp)
+	}
+	if len(added) > 0 {
+		sort.Sort(fps)
+	}
+	return fps
+}
+
+// apply applies b to the in-memory changes and returns the label pairs of b
+// whose posting lists are empty afterwards. Applying the same batch again does
+// not change anything. The caller must hold mtx for writing.
+func (i *LabelPairFingerprintIndex) apply(b PostingsBatch) []metric.LabelPair {
+	var emptied []metric.LabelPair
+	for lp, fps := range b {
+		added, removed := i.added[lp], i.removed[lp]
+		for fp, add := range fps {
+			inFile := i.inPostingsFile(lp, fp)
+			switch {
+			case add && inFile:
+				delete(removed, fp)
+			case add:
+				if added == nil {
+					added = codable.FingerprintSet{}
+					i.added[lp] = added
+				}
+				added[fp] = struct{}{}
+			case inFile:
+				if removed == nil {
+					removed = codable.FingerprintSet{}
+					i.removed[lp] = removed
+				}
+				removed[fp] = struct{}{}
+			default:
+				delete(added, fp)
+			}
+		}
+		if len(added) == 0 {
+			delete(i.added, lp)
+		}
+		if len(removed) == 0 {
+			delete(i.removed, lp)
+		}
+		if i.count(lp) == 0 {
+			emptied = append(emptied, lp)
+		}
+	}
+	return emptied
+}
+
+// loadPostingsFile maps the given postings file and reads the location of each
+// posting list. It returns an error satisfying os.IsNotExist if there is no
+// such file.
+//
+// Description of the file format:
+//
+// (1) Magic string (const postingsMagicString).
+//
+// (2) Uvarint-encoded format version (const postingsFormatVersion).
+//
+// (3) Repeated once per label pair, sorted by label name and label value:
+//
+// (3.1) The label name as uvarint-encoded length followed by the bytes.
+//
+// (3.2) The label value, encoded in the same way.
+//
+// (3.3) Uvarint-encoded number of fingerprints.
+//
+// (3.4) The fingerprints in ascending order, each as big-endian uint64.
+func loadPostingsFile(name string) ([]byte, map[metric.LabelPair]postingsRef, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := mapFile(f, int(fi.Size()))
+	if err != nil {
+		return nil, nil, err
+	}
+	refs, err := readPostingsRefs(data)
+	if err != nil {
+		unmapFile(data)
+		return nil, nil, fmt.Errorf("error reading postings file %s: %s", name, err)
+	}
+	return data, refs, nil
+}
+
+func readPostingsRefs(data []byte) (map[metric.LabelPair]postingsRef, error) {
+	if !bytes.HasPrefix(data, []byte(postingsMagicString)) {
+		return nil, fmt.Errorf("unexpected magic string")
+	}
+	d := postingsDecoder{buf: data, pos: len(postingsMagicString)}
+	if version := d.uvarint(); version != postingsFormatVersion {
+		return nil, fmt.Errorf("unknown format version %d, want %d", version, postingsFormatVersion)
+	}
+	refs := map[metric.LabelPair]postingsRef{}
+	for d.err == nil && d.pos < len(data) {
+		lp := d.labelPair()
+		count := int(d.uvarint())
+		ref := postingsRef{offset: d.pos, count: count}
+		d.skip(8 * count)
+		refs[lp] = ref
+	}
+	return refs, d.err
+}
+
+// compact writes a new postings file that includes the in-memory changes and
+// empties the log. The caller must hold writeMtx.
+func (i *LabelPairFingerprintIndex) compact() error {
+	lps := make(labelPairs, 0, len(i.refs)+len(i.added))
+	for lp := range i.refs {
+		lps = append(lps, lp)
+	}
+	for lp := range i.added {
+		if _, ok := i.refs[lp]; !ok {
+			lps = append(lps, lp)
+		}
+	}
+	sort.Sort(lps)
+
+	f, err := os.OpenFile(i.fileName(postingsTempFileName), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(f, postingsBufSize)
+	e := postingsEncoder{}
+	e.buf.WriteString(postingsMagicString)
+	e.uvarint(postingsFormatVersion)
+	for _, lp := range lps {
+		fps := i.postings(lp)
+		if len(fps) == 0 {
+			continue
+		}
+		e.labelPair(lp)
+		e.uvarint(uint64(len(fps)))
+		for _, fp := range fps {
+			e.uint64(uint64(fp))
+		}
+		if e.buf.Len() >= postingsBufSize {
+			if _, err := e.buf.WriteTo(w); err != nil {
+				f.Close()
+				return err
+			}
+		}
+	}
+	if _, err := e.buf.WriteTo(w); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(i.fileName(postingsTempFileName), i.fileName(postingsFileName)); err != nil {
+		return err
+	}
+
+	data, refs, err := loadPostingsFile(i.fileName(postingsFileName))
+	if err != nil {
+		return err
+	}
+	i.mtx.Lock()
+	old := i.data
+	i.data, i.refs = data, refs
+	i.added = map[metric.LabelPair]codable.FingerprintSet{}
+	i.removed = map[metric.LabelPair]codable.FingerprintSet{}
+	i.mtx.Unlock()
+	if old != nil {
+		unmapFile(old)
+	}
+
+	// Replaying the log over the new postings file would not change
+	// anything, so it does not matter if emptying it fails.
+	if i.log != nil {
+		if err := i.log.Truncate(0); err != nil {
+			return err
+		}
+		i.logSize = 0
+	}
+	return nil
+}
+
+// appendToLog appends b to the log. The caller must hold writeMtx.
+//
+// Each batch in the log consists of:
+//
+// (1) The length of the payload as big-endian uint32.
+//
+// (2) The payload: The uvarint-encoded number of label pairs, then per label
+// pair the label name and value (encoded as in the postings file), the
+// uvarint-encoded number of fingerprints, and per fingerprint the fingerprint
+// as big-endian uint64 followed by a byte that is 1 for an addition and 0 for
+// a removal.
+//
+// (3) The CRC32 (IEEE) checksum of the payload as big-endian uint32.
+func (i *LabelPairFingerprintIndex) appendToLog(b PostingsBatch) error {
+	e := postingsEncoder{}
+	e.uint32(0) // Placeholder for the payload length.
+	e.uvarint(uint64(len(b)))
+	for lp, fps := range b {
+		e.labelPair(lp)
+		e.uvarint(uint64(len(fps)))
+		for fp, add := range fps {
+			e.uint64(uint64(fp))
+			if add {
+				e.buf.WriteByte(1)
+			} else {
+				e.buf.WriteByte(0)
+			}
+		}
+	}
+	buf := e.buf.Bytes()
+	binary.BigEndian.PutUint32(buf, uint32(len(buf)-4))
+	e.uint32(crc32.ChecksumIEEE(buf[4:]))
+
+	n, err := e.buf.WriteTo(i.log)
+	i.logSize += n
+	return err
+}
+
+// replayLog applies the batches in the log. A batch that is incomplete or
+// corrupt (after a crash, for example) is cut off together with everything
+// following it.
+func (i *LabelPairFingerprintIndex) replayLog() error {
+	data, err := ioutil.ReadFile(i.fileName(postingsLogFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var (
+		pos        int
+		numBatches int
+	)
+	for pos < len(data) {
+		b, n, err := decodeLogBatch(data[pos:])
+		if err != nil {
+			glog.Warningf("Cutting off label pair postings log after %d batches: %s", numBatches, err)
+			if err := os.Truncate(i.fileName(postingsLogFileName), int64(pos)); err != nil {
+				return err
+			}
+			break
+		}
+		i.apply(b)
+		pos += n
+		numBatches++
+	}
+	i.logSize = int64(pos)
+	return nil
+}
+
+// decodeLogBatch decodes the batch at the beginning of data and returns it
+// together with its length in bytes.
+func decodeLogBatch(data []byte) (PostingsBatch, int, error) {
+	if len(data) < 4 {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	end := 4 + int(binary.BigEndian.Uint32(data))
+	if end+4 > len(data) || end < 4 {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	if crc32.ChecksumIEEE(data[4:end]) != binary.BigEndian.Uint32(data[end:]) {
+		return nil, 0, errors.New("checksum mismatch")
+	}
+	d := postingsDecoder{buf: data[:end], pos: 4}
+	b := PostingsBatch{}
+	for numPairs := d.uvarint(); numPairs > 0 && d.err == nil; numPairs-- {
+		lp := d.labelPair()
+		for numFPs := d.uvarint(); numFPs > 0 && d.err == nil; numFPs-- {
+			fp := clientmodel.Fingerprint(d.uint64())
+			b.set(lp, fp, d.byte() == 1)
+		}
+	}
+	if d.err == nil && d.pos != end {
+		d.err = errCorruptPostings
+	}
+	return b, end + 4, d.err
+}
+
+// migrateLevelDB fills the index from the LevelDB-backed index in dir (if
+// any), writes the postings file, and deletes the LevelDB-backed index.
+func (i *LabelPairFingerprintIndex) migrateLevelDB(dir string) error {
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil
+	}
+	glog.Info("Migrating label pair to fingerprints index from LevelDB to postings file...")
+	db, err := NewLevelDB(LevelDBOptions{Path: dir})
+	if err != nil {
+		return err
+	}
+	var (
+		lp  codable.LabelPair
+		fps codable.Fingerprints
+		b   = PostingsBatch{}
+	)
+	err = db.ForEach(func(kv KeyValueAccessor) error {
+		if err := kv.Key(&lp); err != nil {
+			return err
+		}
+		if err := kv.Value(&fps); err != nil {
+			return err
+		}
+		for _, fp := range fps {
+			b.Add(metric.LabelPair(lp), fp)
+		}
+		return nil
+	})
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	i.apply(b)
+	if err := i.compact(); err != nil {
+		return err
+	}
+	glog.Infof("Migrated posting lists of %d label pairs.", len(b))
+	return os.RemoveAll(dir)
+}
+
+func (i *LabelPairFingerprintIndex) unmap() {
+	if i.data != nil {
+		unmapFile(i.data)
+		i.data = nil
+	}
+}
+
+// labelPairs implements sort.Interface, sorting by label name, then by label
+// value.
+type labelPairs []metric.LabelPair
+
+func (lps labelPairs) Len() int      { return len(lps) }
+func (lps labelPairs) Swap(i, j int) { lps[i], lps[j] = lps[j], lps[i] }
+func (lps labelPairs) Less(i, j int) bool {
+	if lps[i].Name != lps[j].Name {
+		return lps[i].Name < lps[j].Name
+	}
+	return lps[i].Value < lps[j].Value
+}
+
+type postingsEncoder struct {
+	buf bytes.Buffer
+	tmp [binary.MaxVarintLen64]byte
+}
+
+func (e *postingsEncoder) uvarint(u uint64) {
+	e.buf.Write(e.tmp[:binary.PutUvarint(e.tmp[:], u)])
+}
+
+func (e *postingsEncoder) uint64(u uint64) {
+	binary.BigEndian.PutUint64(e.tmp[:], u)
+	e.buf.Write(e.tmp[:8])
+}
+
+func (e *postingsEncoder) uint32(u uint32) {
+	binary.BigEndian.PutUint32(e.tmp[:], u)
+	e.buf.Write(e.tmp[:4])
+}
+
+func (e *postingsEncoder) string(s string) {
+	e.uvarint(uint64(len(s)))
+	e.buf.WriteString(s)
+}
+
+func (e *postingsEncoder) labelPair(lp metric.LabelPair) {
+	e.string(string(lp.Name))
+	e.string(string(lp.Value))
+}
+
+// postingsDecoder decodes from buf, starting at pos. After the first error,
+// all methods return zero values.
+type postingsDecoder struct {
+	buf []byte
+	pos int
+	err error
+}
+
+func (d *postingsDecoder) skip(n int) {
+	if d.err != nil {
+		return
+	}
+	if n < 0 || d.pos+n > len(d.buf) {
+		d.err = errCorruptPostings
+		return
+	}
+	d.pos += n
+}
+
+func (d *postingsDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	u, n := binary.Uvarint(d.buf[d.pos:])
+	if n <= 0 {
+		d.err = errCorruptPostings
+		return 0
+	}
+	d.pos += n
+	return u
+}
+
+func (d *postingsDecoder) uint64() uint64 {
+	start := d.pos
+	d.skip(8)
+	if d.err != nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(d.buf[start:])
+}
+
+func (d *postingsDecoder) byte() byte {
+	start := d.pos
+	d.skip(1)
+	if d.err != nil {
+		return 0
+	}
+	return d.buf[start]
+}
+
+func (d *postingsDecoder) string() string {
+	n := int(d.uvarint())
+	start := d.pos
+	d.skip(n)
+	if d.err != nil {
+		return ""
+	}
+	return string(d.buf[start:d.pos])
+}
+
+func (d *postingsDecoder) labelPair() metric.LabelPair {
+	name := d.string()
+	value := d.string()
+	return metric.LabelPair{
+		Name:  clientmodel.LabelName(name),
+		Value: clientmodel.LabelValue(value),
+	}
+}
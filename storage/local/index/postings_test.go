@@ -0,0 +1,203 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package index
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/local/codable"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/prometheus/prometheus/utility/test"
+)
+
+var (
+	lpJobAPI = metric.LabelPair{Name: "job", Value: "api"}
+	lpJobDB  = metric.LabelPair{Name: "job", Value: "db"}
+	lpName   = metric.LabelPair{Name: clientmodel.MetricNameLabel, Value: "up"}
+)
+
+func checkPostings(t *testing.T, i *LabelPairFingerprintIndex, want map[metric.LabelPair]clientmodel.Fingerprints) {
+	var (
+		lps    []metric.LabelPair
+		allFPs []clientmodel.Fingerprints
+	)
+	for lp, wantFPs := range want {
+		lps = append(lps, lp)
+		allFPs = append(allFPs, wantFPs)
+	}
+	if got, err := i.LookupAll(lps); err != nil || !reflect.DeepEqual(got, allFPs) {
+		t.Errorf("LookupAll(%v): got %v, %v, want %v", lps, got, err, allFPs)
+	}
+
+	for lp, wantFPs := range want {
+		fps, ok, err := i.Lookup(lp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != (len(wantFPs) > 0) {
+			t.Errorf("%v: got ok %v for %v", lp, ok, fps)
+		}
+		if !reflect.DeepEqual(fps, wantFPs) {
+			t.Errorf("%v: got %v, want %v", lp, fps, wantFPs)
+		}
+	}
+
+	counts := map[metric.LabelPair]int{}
+	if err := i.ForEach(func(lp metric.LabelPair, numFPs int) error {
+		counts[lp] = numFPs
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	wantCounts := map[metric.LabelPair]int{}
+	for lp, fps := range want {
+		if len(fps) > 0 {
+			wantCounts[lp] = len(fps)
+		}
+	}
+	if !reflect.DeepEqual(counts, wantCounts) {
+		t.Errorf("got counts %v, want %v", counts, wantCounts)
+	}
+}
+
+func TestLabelPairFingerprintIndex(t *testing.T) {
+	dir := test.NewTemporaryDirectory("test_postings", t)
+	defer dir.Close()
+
+	i, err := NewLabelPairFingerprintIndex(dir.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := PostingsBatch{}
+	b.Add(lpJobAPI, 3)
+	b.Add(lpJobAPI, 1)
+	b.Add(lpJobDB, 2)
+	b.Add(lpName, 1)
+	b.Add(lpName, 2)
+	b.Add(lpName, 3)
+	if emptied, err := i.IndexBatch(b); err != nil || len(emptied) != 0 {
+		t.Fatalf("got emptied %v, error %v", emptied, err)
+	}
+	checkPostings(t, i, map[metric.LabelPair]clientmodel.Fingerprints{
+		lpJobAPI: {1, 3},
+		lpJobDB:  {2},
+		lpName:   {1, 2, 3},
+	})
+
+	// Compact the changes into the postings file, then change it again.
+	if err := i.compact(); err != nil {
+		t.Fatal(err)
+	}
+	b = PostingsBatch{}
+	b.Remove(lpJobDB, 2)
+	b.Remove(lpName, 2)
+	b.Add(lpJobAPI, 2)
+	b.Remove(lpJobAPI, 3)
+	b.Add(lpJobAPI, 3) // Overrides the removal.
+	emptied, err := i.IndexBatch(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []metric.LabelPair{lpJobDB}; !reflect.DeepEqual(emptied, want) {
+		t.Errorf("got emptied %v, want %v", emptied, want)
+	}
+	want := map[metric.LabelPair]clientmodel.Fingerprints{
+		lpJobAPI: {1, 2, 3},
+		lpJobDB:  nil,
+		lpName:   {1, 3},
+	}
+	checkPostings(t, i, want)
+
+	// The changes since the compaction are replayed from the log.
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if i, err = NewLabelPairFingerprintIndex(dir.Path()); err != nil {
+		t.Fatal(err)
+	}
+	checkPostings(t, i, want)
+
+	// Compacting on demand empties the log.
+	sizeBefore, sizeAfter, err := i.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sizeBefore <= int64(len(i.data)) || sizeAfter != int64(len(i.data)) || i.logSize != 0 {
+		t.Errorf("unexpected sizes %d and %d around compaction, postings file %d, log %d", sizeBefore, sizeAfter, len(i.data), i.logSize)
+	}
+	checkPostings(t, i, want)
+
+	// A torn batch at the end of the log is cut off.
+	b = PostingsBatch{}
+	b.Add(lpJobDB, 4)
+	if _, err := i.IndexBatch(b); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+	logFile := path.Join(dir.Path(), labelPairPostingsDir, postingsLogFileName)
+	fi, err := os.Stat(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(logFile, fi.Size()-1); err != nil {
+		t.Fatal(err)
+	}
+	if i, err = NewLabelPairFingerprintIndex(dir.Path()); err != nil {
+		t.Fatal(err)
+	}
+	checkPostings(t, i, want)
+	if err := i.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLabelPairFingerprintIndexMigration(t *testing.T) {
+	dir := test.NewTemporaryDirectory("test_postings_migration", t)
+	defer dir.Close()
+
+	db, err := NewLevelDB(LevelDBOptions{Path: path.Join(dir.Path(), labelPairToFingerprintsDir)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(codable.LabelPair(lpJobAPI), codable.FingerprintSet{1: {}, 3: {}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put(codable.LabelPair(lpJobDB), codable.FingerprintSet{2: {}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	i, err := NewLabelPairFingerprintIndex(dir.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.Close()
+	checkPostings(t, i, map[metric.LabelPair]clientmodel.Fingerprints{
+		lpJobAPI: {1, 3},
+		lpJobDB:  {2},
+	})
+	if _, err := os.Stat(path.Join(dir.Path(), labelPairToFingerprintsDir)); !os.IsNotExist(err) {
+		t.Errorf("LevelDB-backed index not deleted after migration: %v", err)
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// lowLoadCheckInterval is how often index compaction checks whether the
+// storage is in a low-load window once compaction is due.
+const lowLoadCheckInterval = time.Minute
+
+const indexLabel = "index"
+
+// DailyWindow is a time window recurring every day, given by its start and end
+// as offsets from midnight UTC. If End is before Start, the window spans
+// midnight. If both are equal, e.g. for the zero value, the window spans the
+// whole day.
+type DailyWindow struct {
+	Start, End time.Duration
+}
+
+// ParseDailyWindow parses a DailyWindow in the format "15:04-15:04", e.g.
+// "22:00-06:00". Midnight may be given as 24:00. An empty string yields a
+// window spanning the whole day.
+func ParseDailyWindow(s string) (DailyWindow, error) {
+	var w DailyWindow
+	if s == "" {
+		return w, nil
+	}
+	var startH, startM, endH, endM int
+	if n, err := fmt.Sscanf(s, "%d:%d-%d:%d", &startH, &startM, &endH, &endM); err != nil || n != 4 {
+		return w, fmt.Errorf("invalid daily window %q, expected e.g. 22:00-06:00", s)
+	}
+	for _, hm := range [][2]int{{startH, startM}, {endH, endM}} {
+		// 24:00 is midnight, too, but 24:30 does not exist.
+		if hm[0] < 0 || hm[0] > 24 || hm[0] == 24 && hm[1] != 0 {
+			return w, fmt.Errorf("invalid hour %d in daily window %q", hm[0], s)
+		}
+		if hm[1] < 0 || hm[1] > 59 {
+			return w, fmt.Errorf("invalid minute %d in daily window %q", hm[1], s)
+		}
+	}
+	const day = 24 * time.Hour
+	w.Start = (time.Duration(startH)*time.Hour + time.Duration(startM)*time.Minute) % day
+	w.End = (time.Duration(endH)*time.Hour + time.Duration(endM)*time.Minute) % day
+	return w, nil
+}
+
+// contains returns whether t is within the window.
+func (w DailyWindow) contains(t time.Time) bool {
+	if w.Start == w.End {
+		return true
+	}
+	t = t.UTC()
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if w.Start < w.End {
+		return offset >= w.Start && offset < w.End
+	}
+	return offset >= w.Start || offset < w.End
+}
+
+// compactableIndex is an index of the persistence that can be compacted.
+type compactableIndex interface {
+	Compact() (sizeBefore, sizeAfter int64, err error)
+}
+
+// namedIndex is a compactableIndex with the name used as the value of
+// indexLabel.
+type namedIndex struct {
+	name  string
+	index compactableIndex
+}
+
+// indexCompactor compacts the indexes of the persistence. After heavy churn,
+// the LevelDB-backed indexes are full of deleted entries, which LevelDB only
+// reclaims once enough writes have triggered compactions of the affected key
+// ranges.
+type indexCompactor struct {
+	interval time.Duration
+	window   DailyWindow
+
+	duration       *prometheus.GaugeVec
+	tombstoneRatio *prometheus.GaugeVec
+	size           *prometheus.GaugeVec
+	errors         prometheus.Counter
+}
+
+func newIndexCompactor(interval time.Duration, window DailyWindow) *indexCompactor {
+	return &indexCompactor{
+		interval: interval,
+		window:   window,
+
+		duration: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "index_compaction_duration_seconds",
+				Help:      "The duration of the last compaction of an index.",
+			},
+			[]string{indexLabel},
+		),
+		tombstoneRatio: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "index_tombstone_ratio",
+				Help:      "The share of the size of an index taken by deleted and overwritten entries, as reclaimed by its last compaction.",
+			},
+			[]string{indexLabel},
+		),
+		size: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "index_size_bytes",
+				Help:      "The approximate size of an index after its last compaction.",
+			},
+			[]string{indexLabel},
+		),
+		errors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "index_compaction_errors_total",
+			Help:      "The total number of failed compactions of indexes.",
+		}),
+	}
+}
+
+// compactIndexes compacts the indexes periodically until the storage is
+// stopped. Once compaction is due, it waits for a low-load window, i.e. until
+// the time is within the configured daily window and the storage is not
+// rushed to persist chunks. It returns a channel that is closed once it has
+// stopped.
+func (s *memorySeriesStorage) compactIndexes() <-chan struct{} {
+	stopped := make(chan struct{})
+	if s.indexCompactor == nil {
+		close(stopped)
+		return stopped
+	}
+	go func() {
+		defer close(stopped)
+
+		c := s.indexCompactor
+		timer := time.NewTimer(c.interval)
+		defer timer.Stop()
+		for {
+			select {
+			case <-timer.C:
+			case <-s.loopStopping:
+				return
+			}
+			for !c.window.contains(time.Now()) || s.rushed() {
+				select {
+				case <-time.After(lowLoadCheckInterval):
+				case <-s.loopStopping:
+					return
+				}
+			}
+			s.compactAllIndexes()
+			timer.Reset(c.interval)
+		}
+	}()
+	return stopped
+}
+
+// compactAllIndexes compacts the indexes of the persistence and the cold
+// index, if any, one after the other.
+func (s *memorySeriesStorage) compactAllIndexes() {
+	p := s.persistence
+	indexes := []namedIndex{
+		{"archived_fingerprint_to_metric", p.archivedFingerprintToMetrics},
+		{"archived_fingerprint_to_timerange", p.archivedFingerprintToTimeRange},
+		{"labelname_to_labelvalues", p.labelNameToLabelValues},
+		{"labelpair_to_fingerprints", p.labelPairToFingerprints},
+	}
+	if s.coldTier != nil {
+		indexes = append(indexes, namedIndex{"cold_segments", s.coldTier.index})
+	}
+
+	c := s.indexCompactor
+	for _, idx := range indexes {
+		select {
+		case <-s.loopStopping:
+			return
+		default:
+		}
+		begin := time.Now()
+		sizeBefore, sizeAfter, err := idx.index.Compact()
+		if err != nil {
+			c.errors.Inc()
+			glog.Errorf("Error compacting index %s: %v", idx.name, err)
+			continue
+		}
+		c.duration.WithLabelValues(idx.name).Set(time.Since(begin).Seconds())
+		c.size.WithLabelValues(idx.name).Set(float64(sizeAfter))
+		var ratio float64
+		if sizeBefore > 0 && sizeAfter < sizeBefore {
+			ratio = float64(sizeBefore-sizeAfter) / float64(sizeBefore)
+		}
+		c.tombstoneRatio.WithLabelValues(idx.name).Set(ratio)
+		glog.Infof("Compacted index %s from %d to %d bytes in %v.", idx.name, sizeBefore, sizeAfter, time.Since(begin))
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *indexCompactor) Describe(ch chan<- *prometheus.Desc) {
+	c.duration.Describe(ch)
+	c.tombstoneRatio.Describe(ch)
+	c.size.Describe(ch)
+	ch <- c.errors.Desc()
+}
+
+// Collect implements prometheus.Collector.
+func (c *indexCompactor) Collect(ch chan<- prometheus.Metric) {
+	c.duration.Collect(ch)
+	c.tombstoneRatio.Collect(ch)
+	c.size.Collect(ch)
+	ch <- c.errors
+}
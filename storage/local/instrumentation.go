@@ -57,8 +57,13 @@ const (
 	unarchive          = "unarchive"
 	memoryPurge        = "purge_from_memory"
 	archivePurge       = "purge_from_archive"
+	requestedPurge     = "purge_on_request"
+	unqueriedPurge     = "purge_unqueried"
 	memoryMaintenance  = "maintenance_in_memory"
 	archiveMaintenance = "maintenance_in_archive"
+	compaction         = "compaction"
+	backfill           = "backfill"
+	orphanRestore      = "restore_orphaned"
 
 	// Op-types for chunkOps.
 	createAndPin    = "create" // A chunkDesc creation with refCount=1.
@@ -67,7 +72,11 @@ const (
 	unpin           = "unpin" // Excluding the unpin on persisting.
 	clone           = "clone"
 	transcode       = "transcode"
+	reorder         = "reorder" // Re-encoding to insert an out-of-order sample.
 	drop            = "drop"
+	coalesce        = "coalesce" // Chunks saved by compaction.
+	moveCold        = "move_to_cold_tier"
+	fetchCold       = "fetch_from_cold_tier"
 
 	// Op-types for chunkOps and chunkDescOps.
 	evict = "evict"
@@ -75,6 +84,14 @@ const (
 
 	seriesLocationLabel = "location"
 
+	// Outcomes for outOfOrderSamplesCount.
+	outcomeLabel     = "outcome"
+	mergedOutcome    = "merged"
+	discardedOutcome = "discarded"
+
+	// Label for quotaRejectedSamplesCount.
+	quotaLabel = "quota"
+
 	// Maintenance types for maintainSeriesDuration.
 	maintainInMemory = "memory"
 	maintainArchived = "archived"
@@ -33,6 +33,11 @@ type Storage interface {
 	// queryable immediately. (Use WaitForIndexing to wait for complete
 	// processing.)
 	Append(*clientmodel.Sample)
+	// AppendBatch works like calling Append for each of the provided
+	// samples, but more efficiently: Samples of the same series are
+	// appended while locking the series only once. Samples of the same
+	// series must be sorted by time, too.
+	AppendBatch(clientmodel.Samples)
 	// NewPreloader returns a new Preloader which allows preloading and pinning
 	// series data into memory for use within a query.
 	NewPreloader() Preloader
@@ -45,6 +50,48 @@ type Storage interface {
 	GetMetricForFingerprint(clientmodel.Fingerprint) clientmodel.COWMetric
 	// Construct an iterator for a given fingerprint.
 	NewIterator(clientmodel.Fingerprint) SeriesIterator
+	// Get the n series in memory with the highest estimated memory usage
+	// and the n metric names whose series in memory have the highest
+	// summed estimated memory usage, both sorted by descending usage.
+	GetTopMemoryConsumers(n int) (series, metricNames []MemoryConsumer)
+	// Get the disk usage of the series files of all series matching the
+	// provided label matchers (or of all series if there are no
+	// matchers), per metric name and sorted by descending size.
+	GetDiskUsage(metric.LabelMatchers) []DiskUsage
+	// Get the n label names with the most values, the n label pairs
+	// with the most series, and the n metric names with the most series,
+	// according to the label indexes.
+	GetCardinalityStats(n int) (*CardinalityStats, error)
+	// Get the n metric names with the most series created and archived
+	// since the storage was started, sorted by descending sum of both.
+	GetSeriesChurn(n int) []SeriesChurn
+	// Drop all time series associated with the given label matchers,
+	// from memory and from disk, including their index entries. Returns
+	// the number of series dropped.
+	DropMetricsForLabelMatchers(metric.LabelMatchers) int
+	// Backfill writes historical samples directly to the series files,
+	// bypassing the head chunks, and returns the number of samples
+	// written. Samples of a series in memory are only written if they are
+	// older than its chunks in memory. Samples with the timestamp of a
+	// sample already stored are skipped.
+	Backfill(clientmodel.Samples) (int, error)
+	// Snapshot creates a consistent copy of the storage in a new,
+	// timestamped directory below the storage directory, without stopping
+	// ingestion, and returns the path of that directory. The snapshot can be
+	// used as storage directory as is.
+	Snapshot() (string, error)
+	// ListOrphanedSeries returns the series files that crash recovery has
+	// moved into the orphaned directory, sorted by path.
+	ListOrphanedSeries() ([]OrphanedSeries, error)
+	// RestoreOrphanedSeries moves the orphaned series file of the given
+	// fingerprint back into the storage and indexes it as an archived
+	// series of the given metric. If the metric is nil, it is taken from
+	// the label index snapshot.
+	RestoreOrphanedSeries(clientmodel.Fingerprint, clientmodel.Metric) error
+	// CheckSeries performs the pedantic consistency checks of crash
+	// recovery on the series of the given fingerprints, without rectifying
+	// anything, and returns one result per fingerprint.
+	CheckSeries(clientmodel.Fingerprints) []SeriesCheck
 	// Run the various maintenance loops in goroutines. Returns when the
 	// storage is ready to use. Keeps everything running in the background
 	// until Stop is called.
@@ -56,6 +103,20 @@ type Storage interface {
 	// indexed. Indexing is needed for GetFingerprintsForLabelMatchers and
 	// GetLabelValuesForLabelName and may lag behind.
 	WaitForIndexing()
+	// SetRetention changes the retention period while the storage is
+	// running. Samples older than the new period are dropped as the
+	// maintenance sweeps reach their series.
+	SetRetention(time.Duration)
+	// SetMemoryChunks changes how many chunks to keep in memory while the
+	// storage is running. Excess chunks are evicted with the next eviction
+	// run.
+	SetMemoryChunks(int)
+	// Dirty returns whether the storage is inconsistent, e.g. after an
+	// error while persisting chunks, so that crash recovery is required
+	// on the next start.
+	Dirty() bool
+	// Status returns a snapshot of the internal state of the storage.
+	Status() StorageStatus
 }
 
 // SeriesIterator enables efficient access of sample values in a series. All
@@ -75,6 +136,12 @@ type SeriesIterator interface {
 	GetBoundaryValues(metric.Interval) metric.Values
 	// Gets all values contained within a given interval.
 	GetRangeValues(metric.Interval) metric.Values
+	// Gets the rollups of the given resolution (see RollupResolution) for
+	// the complete buckets contained within a given interval, together
+	// with the part of the interval they cover. The remainder of the
+	// interval has to be aggregated from raw values. Returns false if no
+	// rollups are available for the interval.
+	GetRollups(in metric.Interval, res time.Duration) ([]metric.Rollup, metric.Interval, bool)
 }
 
 // A Preloader preloads series data necessary for a query into memory and pins
@@ -86,6 +153,106 @@ type Preloader interface {
 		from clientmodel.Timestamp, through clientmodel.Timestamp,
 		stalenessDelta time.Duration,
 	) error
+	// PreloadRanges preloads the given ranges of many series at once, like
+	// calling PreloadRange for each of them. Chunks to be loaded from disk
+	// are read in one batch, ordered by series file and offset.
+	PreloadRanges(
+		ranges map[clientmodel.Fingerprint]metric.Interval,
+		stalenessDelta time.Duration,
+	) error
+	// PreloadRollupRange preloads the data needed to aggregate over all
+	// ranges of the given duration that end between from and through. Only
+	// the raw values not covered by rollups (see
+	// SeriesIterator.GetRollups) are preloaded.
+	PreloadRollupRange(
+		fp clientmodel.Fingerprint,
+		from clientmodel.Timestamp, through clientmodel.Timestamp,
+		rangeDuration, stalenessDelta time.Duration,
+	) error
+	// NumChunks returns the number of chunks preloaded so far.
+	NumChunks() int
+	// SetDeadline sets the time after which preloading fails with
+	// ErrDeadlineExceeded. Chunks already preloaded stay pinned until
+	// Close is called. The zero time means no deadline.
+	SetDeadline(time.Time)
+	// SetCancel sets a channel whose closing makes preloading fail with
+	// ErrCanceled. A nil channel never cancels preloading.
+	SetCancel(<-chan struct{})
 	// Close unpins any previously requested series data from memory.
 	Close()
 }
+
+// MemoryConsumer describes the estimated memory usage of a single series in
+// memory or, if used to report per metric name, of all series in memory
+// sharing the same metric name. In the latter case, Metric only contains the
+// metric name.
+type MemoryConsumer struct {
+	Metric          clientmodel.Metric `json:"metric"`
+	NumSeries       int                `json:"numSeries"`
+	NumChunkDescs   int                `json:"numChunkDescs"`
+	NumMemoryChunks int                `json:"numMemoryChunks"`
+	Bytes           int                `json:"bytes"`
+}
+
+// LabelCardinality is the number of values of a label name (in which case
+// Value is empty) or the number of series with a label pair.
+type LabelCardinality struct {
+	Name  clientmodel.LabelName  `json:"name"`
+	Value clientmodel.LabelValue `json:"value,omitempty"`
+	Count int                    `json:"count"`
+}
+
+// CardinalityStats reports the label names, label pairs, and metric names with
+// the highest cardinality, each sorted by descending Count.
+type CardinalityStats struct {
+	LabelNames  []LabelCardinality `json:"labelNames"`
+	LabelPairs  []LabelCardinality `json:"labelPairs"`
+	MetricNames []LabelCardinality `json:"metricNames"`
+}
+
+// StorageStatus is a snapshot of the internal state of the local storage.
+type StorageStatus struct {
+	MemorySeries    int `json:"memorySeries"`
+	MemoryChunks    int `json:"memoryChunks"`
+	MaxMemoryChunks int `json:"maxMemoryChunks"`
+	// The heap memory in use as of the last eviction run with heap-based
+	// eviction and the heap size eviction aims for. Both are 0 if chunks
+	// are evicted based on MaxMemoryChunks.
+	HeapSize           uint64 `json:"heapSize"`
+	TargetHeapSize     uint64 `json:"targetHeapSize"`
+	ChunksToPersist    int    `json:"chunksToPersist"`
+	MaxChunksToPersist int    `json:"maxChunksToPersist"`
+	// Whether the storage is in graceful degradation mode, i.e. too far
+	// behind on persisting chunks.
+	Degraded bool `json:"degraded"`
+	// The number of series the maintenance loop changed since the last
+	// checkpoint. A checkpoint is triggered early if the limit is reached.
+	DirtySeries                int `json:"dirtySeries"`
+	CheckpointDirtySeriesLimit int `json:"checkpointDirtySeriesLimit"`
+	// The end and the duration (in seconds) of the last checkpoint. The
+	// time is zero if no checkpoint has been completed yet.
+	LastCheckpoint         time.Time `json:"lastCheckpoint"`
+	LastCheckpointDuration float64   `json:"lastCheckpointDuration"`
+	// Whether the storage is inconsistent and needs crash recovery.
+	Dirty                 bool `json:"dirty"`
+	IndexingQueueLength   int  `json:"indexingQueueLength"`
+	IndexingQueueCapacity int  `json:"indexingQueueCapacity"`
+}
+
+// DiskUsage describes the disk usage of the series files of all series sharing
+// the same metric name. Series without a series file (i.e. with all their
+// chunks still in memory) are not counted.
+type DiskUsage struct {
+	MetricName clientmodel.LabelValue `json:"metricName"`
+	NumSeries  int                    `json:"numSeries"`
+	NumChunks  int                    `json:"numChunks"`
+	Bytes      int64                  `json:"bytes"`
+}
+
+// SeriesChurn is the number of series of a metric name that have been created
+// (i.e. not unarchived) and archived since the storage was started.
+type SeriesChurn struct {
+	MetricName clientmodel.LabelValue `json:"metricName"`
+	Created    int64                  `json:"created"`
+	Archived   int64                  `json:"archived"`
+}
@@ -0,0 +1,349 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang/glog"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/local/codable"
+	"github.com/prometheus/prometheus/storage/local/index"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+const (
+	labelIndexSnapshotFileName      = "labelindex.snapshot"
+	labelIndexSnapshotTempFileName  = "labelindex.snapshot.tmp"
+	labelIndexSnapshotMagicString   = "PrometheusLabelIndexSnapshot"
+	labelIndexSnapshotFormatVersion = 1
+)
+
+// A label index snapshot lists the fingerprints and metrics of all series, in
+// memory and archived, at the time it was written. Upon crash recovery, the
+// label indexes are reset to the content of the snapshot in bulk, and only
+// the difference between the snapshot and the recovered series is queued for
+// indexing. Thus, recovery does not have to push millions of metrics through
+// the indexing queue. As the difference is determined from scratch, the
+// snapshot does not have to be consistent with anything but itself.
+//
+// The snapshot file consists of:
+//
+// (1) Magic string (const labelIndexSnapshotMagicString).
+//
+// (2) Varint-encoded format version (const labelIndexSnapshotFormatVersion).
+//
+// (3) Per series: A byte 1, the fingerprint as big-endian uint64, and the
+// metric as encoded by codable.Metric.
+//
+// (4) A byte 0.
+//
+// (5) The CRC32 (IEEE) checksum of (1) to (4) as big-endian uint32.
+
+// crcReader is a bufio.Reader computing the checksum of all bytes read.
+type crcReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+}
+
+func (r *crcReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.crc.Write(p[:n])
+	return n, err
+}
+
+func (r *crcReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.crc.Write([]byte{b})
+	}
+	return b, err
+}
+
+// writeLabelIndexSnapshot writes a label index snapshot of the series in
+// fingerprintToSeries and the archived series. It returns the number of
+// series written.
+func (p *persistence) writeLabelIndexSnapshot(fingerprintToSeries *seriesMap) (count int, err error) {
+	f, err := os.OpenFile(filepath.Join(p.basePath, labelIndexSnapshotTempFileName), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	crc := crc32.NewIEEE()
+	w := bufio.NewWriter(io.MultiWriter(f, crc))
+	if _, err := w.WriteString(labelIndexSnapshotMagicString); err != nil {
+		return 0, err
+	}
+	if _, err := codable.EncodeVarint(w, labelIndexSnapshotFormatVersion); err != nil {
+		return 0, err
+	}
+	writeSeries := func(fp clientmodel.Fingerprint, m clientmodel.Metric) error {
+		buf, err := codable.Metric(m).MarshalBinary()
+		if err != nil {
+			return err
+		}
+		if err := w.WriteByte(1); err != nil {
+			return err
+		}
+		if err := codable.EncodeUint64(w, uint64(fp)); err != nil {
+			return err
+		}
+		_, err = w.Write(buf)
+		count++
+		return err
+	}
+
+	for fps := range fingerprintToSeries.iter() {
+		if err == nil {
+			err = writeSeries(fps.fp, fps.series.metric)
+		}
+		// Keep draining the iterator after an error.
+	}
+	if err != nil {
+		return 0, err
+	}
+	var (
+		fp codable.Fingerprint
+		m  codable.Metric
+	)
+	if err := p.archivedFingerprintToMetrics.ForEach(func(kv index.KeyValueAccessor) error {
+		if err := kv.Key(&fp); err != nil {
+			return err
+		}
+		if err := kv.Value(&m); err != nil {
+			return err
+		}
+		return writeSeries(clientmodel.Fingerprint(fp), clientmodel.Metric(m))
+	}); err != nil {
+		return 0, err
+	}
+
+	if err := w.WriteByte(0); err != nil {
+		return 0, err
+	}
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+	if err := binary.Write(f, binary.BigEndian, crc.Sum32()); err != nil {
+		return 0, err
+	}
+	if err := p.syncFile(f); err != nil {
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	return count, os.Rename(f.Name(), filepath.Join(p.basePath, labelIndexSnapshotFileName))
+}
+
+// loadLabelIndexSnapshot loads the label index snapshot. If there is none, it
+// returns nil and no error.
+func (p *persistence) loadLabelIndexSnapshot() (map[clientmodel.Fingerprint]clientmodel.Metric, error) {
+	f, err := os.Open(filepath.Join(p.basePath, labelIndexSnapshotFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := &crcReader{r: bufio.NewReader(f), crc: crc32.NewIEEE()}
+	buf := make([]byte, len(labelIndexSnapshotMagicString))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	if string(buf) != labelIndexSnapshotMagicString {
+		return nil, fmt.Errorf("unexpected magic string %q in label index snapshot", buf)
+	}
+	version, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if version != labelIndexSnapshotFormatVersion {
+		return nil, fmt.Errorf("unknown label index snapshot format version %d", version)
+	}
+
+	series := map[clientmodel.Fingerprint]clientmodel.Metric{}
+	for {
+		more, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if more == 0 {
+			break
+		}
+		fp, err := codable.DecodeUint64(r)
+		if err != nil {
+			return nil, err
+		}
+		var m codable.Metric
+		if err := m.UnmarshalFromReader(r); err != nil {
+			return nil, err
+		}
+		series[clientmodel.Fingerprint(fp)] = clientmodel.Metric(m)
+	}
+	sum := r.crc.Sum32()
+	var want uint32
+	if err := binary.Read(r.r, binary.BigEndian, &want); err != nil {
+		return nil, err
+	}
+	if sum != want {
+		return nil, fmt.Errorf("label index snapshot checksum mismatch")
+	}
+	return series, nil
+}
+
+// rebuildLabelIndexesFromSnapshot resets the label indexes to the content of
+// the label index snapshot and queues the difference to the given series and
+// the archived series for indexing. It returns false if there is no snapshot.
+// Same concurrency restrictions as for rebuildLabelIndexes apply.
+func (p *persistence) rebuildLabelIndexesFromSnapshot(
+	fpToSeries map[clientmodel.Fingerprint]*memorySeries,
+) (bool, error) {
+	snapshot, err := p.loadLabelIndexSnapshot()
+	if err != nil || snapshot == nil {
+		return false, err
+	}
+	glog.Infof("Resetting label indexes to the snapshot of %d series.", len(snapshot))
+	// Process pending changes first, so that they do not sneak in after
+	// the reset.
+	p.waitForIndexing()
+
+	pairToFPs := index.PostingsBatch{}
+	nameToValues := index.LabelNameLabelValuesMapping{}
+	for fp, m := range snapshot {
+		for ln, lv := range m {
+			pairToFPs.Add(metric.LabelPair{Name: ln, Value: lv}, fp)
+			values, ok := nameToValues[ln]
+			if !ok {
+				values = codable.LabelValueSet{}
+				nameToValues[ln] = values
+			}
+			values[lv] = struct{}{}
+		}
+	}
+	if err := p.labelPairToFingerprints.Reset(pairToFPs); err != nil {
+		return false, err
+	}
+	// Label names not in the snapshot are deleted by indexing an empty set.
+	var ln codable.LabelName
+	if err := p.labelNameToLabelValues.ForEach(func(kv index.KeyValueAccessor) error {
+		if err := kv.Key(&ln); err != nil {
+			return err
+		}
+		if _, ok := nameToValues[clientmodel.LabelName(ln)]; !ok {
+			nameToValues[clientmodel.LabelName(ln)] = codable.LabelValueSet{}
+		}
+		return nil
+	}); err != nil {
+		return false, err
+	}
+	if err := p.labelNameToLabelValues.IndexBatch(nameToValues); err != nil {
+		return false, err
+	}
+
+	glog.Info("Indexing the difference to the label index snapshot.")
+	indexed, unindexed := 0, 0
+	seen := make(map[clientmodel.Fingerprint]struct{}, len(snapshot))
+	reconcile := func(fp clientmodel.Fingerprint, m clientmodel.Metric) {
+		seen[fp] = struct{}{}
+		old, ok := snapshot[fp]
+		if ok && old.Equal(m) {
+			return
+		}
+		if ok {
+			p.unindexMetric(fp, old)
+			unindexed++
+		}
+		p.indexMetric(fp, m)
+		p.recoveryProgress.metricIndexed()
+		indexed++
+	}
+	for fp, s := range fpToSeries {
+		reconcile(fp, s.metric)
+	}
+	var (
+		fp codable.Fingerprint
+		m  codable.Metric
+	)
+	if err := p.archivedFingerprintToMetrics.ForEach(func(kv index.KeyValueAccessor) error {
+		if err := kv.Key(&fp); err != nil {
+			return err
+		}
+		if err := kv.Value(&m); err != nil {
+			return err
+		}
+		reconcile(clientmodel.Fingerprint(fp), clientmodel.Metric(m))
+		return nil
+	}); err != nil {
+		return false, err
+	}
+	for fp, m := range snapshot {
+		if _, ok := seen[fp]; !ok {
+			p.unindexMetric(fp, m)
+			unindexed++
+		}
+	}
+	glog.Infof("%d metrics queued for indexing, %d for unindexing.", indexed, unindexed)
+	return true, nil
+}
+
+// snapshotLabelIndexes writes a label index snapshot periodically until the
+// storage is stopped. It returns a channel that is closed once it has
+// stopped.
+func (s *memorySeriesStorage) snapshotLabelIndexes() <-chan struct{} {
+	stopped := make(chan struct{})
+	if s.labelIndexSnapshotInterval <= 0 {
+		close(stopped)
+		return stopped
+	}
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(s.labelIndexSnapshotInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-s.loopStopping:
+				return
+			}
+			begin := time.Now()
+			count, err := s.persistence.writeLabelIndexSnapshot(s.fpToSeries)
+			if err != nil {
+				glog.Error("Error writing label index snapshot: ", err)
+				continue
+			}
+			glog.Infof("Wrote label index snapshot of %d series in %v.", count, time.Since(begin))
+		}
+	}()
+	return stopped
+}
@@ -1,43 +1,226 @@
 package local
 
 import (
+	"bytes"
+	"runtime"
+	"strconv"
 	"sync"
+	"time"
+
+	"github.com/golang/glog"
 
 	clientmodel "github.com/prometheus/client_golang/model"
 )
 
-// fingerprintLocker allows locking individual fingerprints. To limit the number
-// of mutexes needed for that, only a fixed number of mutexes are
-// allocated. Fingerprints to be locked are assigned to those pre-allocated
-// mutexes by their value. (Note that fingerprints are calculated by a hash
-// function, so that an approximately equal distribution over the mutexes is
-// expected, even without additional hashing of the fingerprint value.)
-// Collisions are not detected. If two fingerprints get assigned to the same
-// mutex, only one of them can be locked at the same time. As long as the number
-// of pre-allocated mutexes is much larger than the number of goroutines
-// requiring a fingerprint lock concurrently, the loss in efficiency is
-// small. However, a goroutine must never lock more than one fingerprint at the
-// same time. (In that case a collision would try to acquire the same mutex
-// twice).
+// maxFreeFpMutexes is how many unused fpMutexes a stripe of the
+// fingerprintLocker keeps around for reuse.
+const maxFreeFpMutexes = 16
+
+// fingerprintLocker allows locking individual fingerprints. Each fingerprint
+// that is currently locked (or waited for) gets its own mutex, so that
+// unrelated fingerprints never block each other. The mutexes are tracked in a
+// fixed number of stripes, each with a small map protected by its own mutex,
+// which is only held for the bookkeeping, never while waiting for a
+// fingerprint. Fingerprints are assigned to stripes by their value. (Note that
+// fingerprints are calculated by a hash function, so that an approximately
+// equal distribution over the stripes is expected, even without additional
+// hashing of the fingerprint value.)
+//
+// A goroutine may lock more than one fingerprint at the same time, but it must
+// do so in ascending order of the fingerprints to not risk a deadlock. With
+// lock debugging enabled (see enableDebugging), violations of that order and
+// locks held or waited for too long are logged.
 type fingerprintLocker struct {
-	fpMtxs    []sync.Mutex
-	numFpMtxs uint
+	stripes    []lockerStripe
+	numStripes uint
+	debug      *lockDebugger // nil unless lock debugging is enabled.
+}
+
+// lockerStripe tracks the mutexes of the fingerprints assigned to it.
+type lockerStripe struct {
+	mtx    sync.Mutex
+	fpMtxs map[clientmodel.Fingerprint]*fpMutex
+	free   []*fpMutex
+}
+
+// fpMutex is the mutex of a single fingerprint. refs is the number of
+// goroutines holding or waiting for it and is protected by the mutex of the
+// stripe.
+type fpMutex struct {
+	sync.Mutex
+	refs int
 }
 
-// newFingerprintLocker returns a new fingerprintLocker ready for use.
-func newFingerprintLocker(preallocatedMutexes int) *fingerprintLocker {
-	return &fingerprintLocker{
-		make([]sync.Mutex, preallocatedMutexes),
-		uint(preallocatedMutexes),
+// newFingerprintLocker returns a new fingerprintLocker ready for use, with the
+// given number of stripes.
+func newFingerprintLocker(stripes int) *fingerprintLocker {
+	l := &fingerprintLocker{
+		stripes:    make([]lockerStripe, stripes),
+		numStripes: uint(stripes),
+	}
+	for i := range l.stripes {
+		l.stripes[i].fpMtxs = map[clientmodel.Fingerprint]*fpMutex{}
+	}
+	return l
+}
+
+// enableDebugging makes the locker log lock-ordering violations (including a
+// goroutine locking the same fingerprint twice) and fingerprints that are held
+// or waited for longer than threshold. Debugging is expensive as it needs to
+// find out the ID of the calling goroutine on each lock operation. It must be
+// called before the locker is used.
+func (l *fingerprintLocker) enableDebugging(threshold time.Duration) {
+	l.debug = &lockDebugger{
+		threshold: threshold,
+		held:      map[int64][]heldLock{},
 	}
 }
 
 // Lock locks the given fingerprint.
 func (l *fingerprintLocker) Lock(fp clientmodel.Fingerprint) {
-	l.fpMtxs[uint(fp)%l.numFpMtxs].Lock()
+	var begin time.Time
+	if l.debug != nil {
+		l.debug.beforeLock(fp)
+		begin = time.Now()
+	}
+
+	s := &l.stripes[uint(fp)%l.numStripes]
+	s.mtx.Lock()
+	m, ok := s.fpMtxs[fp]
+	if !ok {
+		if n := len(s.free); n > 0 {
+			m = s.free[n-1]
+			s.free = s.free[:n-1]
+		} else {
+			m = &fpMutex{}
+		}
+		s.fpMtxs[fp] = m
+	}
+	m.refs++
+	s.mtx.Unlock()
+
+	m.Lock()
+
+	if l.debug != nil {
+		l.debug.afterLock(fp, begin)
+	}
 }
 
 // Unlock unlocks the given fingerprint.
 func (l *fingerprintLocker) Unlock(fp clientmodel.Fingerprint) {
-	l.fpMtxs[uint(fp)%l.numFpMtxs].Unlock()
+	if l.debug != nil {
+		l.debug.beforeUnlock(fp)
+	}
+
+	s := &l.stripes[uint(fp)%l.numStripes]
+	s.mtx.Lock()
+	m, ok := s.fpMtxs[fp]
+	if !ok {
+		s.mtx.Unlock()
+		panic("tried to unlock a fingerprint that is not locked")
+	}
+	m.Unlock()
+	m.refs--
+	if m.refs == 0 {
+		delete(s.fpMtxs, fp)
+		if len(s.free) < maxFreeFpMutexes {
+			s.free = append(s.free, m)
+		}
+	}
+	s.mtx.Unlock()
+}
+
+// lockDebugger keeps track of the fingerprints each goroutine holds.
+type lockDebugger struct {
+	threshold time.Duration
+
+	mtx  sync.Mutex
+	held map[int64][]heldLock // By goroutine ID.
+}
+
+// heldLock is a fingerprint held by a goroutine since the given time.
+type heldLock struct {
+	fp    clientmodel.Fingerprint
+	since time.Time
+}
+
+// beforeLock logs an error if the calling goroutine already holds fp or a
+// higher fingerprint.
+func (d *lockDebugger) beforeLock(fp clientmodel.Fingerprint) {
+	gid := goroutineID()
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	for _, h := range d.held[gid] {
+		if h.fp == fp {
+			glog.Errorf("Goroutine %d is locking fingerprint %v, which it already holds. This will deadlock.\n%s", gid, fp, goroutineStack())
+			return
+		}
+		if h.fp > fp {
+			glog.Errorf("Goroutine %d is locking fingerprint %v while holding the higher fingerprint %v. This may deadlock.\n%s", gid, fp, h.fp, goroutineStack())
+			return
+		}
+	}
+}
+
+// afterLock records fp as held by the calling goroutine and logs a warning if
+// acquiring it has taken longer than the threshold.
+func (d *lockDebugger) afterLock(fp clientmodel.Fingerprint, begin time.Time) {
+	now := time.Now()
+	if waited := now.Sub(begin); waited > d.threshold {
+		glog.Warningf("Waited %v for the lock of fingerprint %v.\n%s", waited, fp, goroutineStack())
+	}
+	gid := goroutineID()
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	d.held[gid] = append(d.held[gid], heldLock{fp: fp, since: now})
+}
+
+// beforeUnlock removes fp from the fingerprints held by the calling goroutine
+// and logs a warning if it has been held longer than the threshold.
+func (d *lockDebugger) beforeUnlock(fp clientmodel.Fingerprint) {
+	gid := goroutineID()
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	locks := d.held[gid]
+	for i, h := range locks {
+		if h.fp != fp {
+			continue
+		}
+		if held := time.Since(h.since); held > d.threshold {
+			glog.Warningf("Held the lock of fingerprint %v for %v.\n%s", fp, held, goroutineStack())
+		}
+		locks = append(locks[:i], locks[i+1:]...)
+		if len(locks) == 0 {
+			delete(d.held, gid)
+		} else {
+			d.held[gid] = locks
+		}
+		return
+	}
+	glog.Errorf("Goroutine %d is unlocking fingerprint %v, which it does not hold.\n%s", gid, fp, goroutineStack())
+}
+
+// goroutineID returns the ID of the calling goroutine as found in the header
+// of its stack trace.
+func goroutineID() int64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	buf = bytes.TrimPrefix(buf, []byte("goroutine "))
+	if i := bytes.IndexByte(buf, ' '); i >= 0 {
+		buf = buf[:i]
+	}
+	id, err := strconv.ParseInt(string(buf), 10, 64)
+	if err != nil {
+		panic("could not parse goroutine ID: " + err.Error())
+	}
+	return id
+}
+
+// goroutineStack returns the stack trace of the calling goroutine.
+func goroutineStack() []byte {
+	buf := make([]byte, 8192)
+	return buf[:runtime.Stack(buf, false)]
 }
@@ -3,10 +3,66 @@ package local
 import (
 	"sync"
 	"testing"
+	"time"
 
 	clientmodel "github.com/prometheus/client_golang/model"
 )
 
+func TestFingerprintLockerNoCollisions(t *testing.T) {
+	locker := newFingerprintLocker(16)
+	locker.Lock(1)
+
+	// Fingerprint 17 is assigned to the same stripe as fingerprint 1 but
+	// must not be blocked by it.
+	done := make(chan struct{})
+	go func() {
+		locker.Lock(17)
+		locker.Unlock(17)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("locking an unrelated fingerprint blocked")
+	}
+
+	// Fingerprint 1 itself is blocked until unlocked.
+	locked := make(chan struct{})
+	go func() {
+		locker.Lock(1)
+		close(locked)
+		locker.Unlock(1)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("locked fingerprint was locked again")
+	case <-time.After(10 * time.Millisecond):
+	}
+	locker.Unlock(1)
+	<-locked
+}
+
+func TestFingerprintLockerDebugging(t *testing.T) {
+	locker := newFingerprintLocker(16)
+	locker.enableDebugging(time.Hour)
+
+	locker.Lock(2)
+	locker.Lock(1) // Lock-ordering violation, only logged.
+	if n := len(locker.debug.held[goroutineID()]); n != 2 {
+		t.Errorf("want 2 fingerprints held, got %d", n)
+	}
+	locker.Unlock(2)
+	locker.Unlock(1)
+	if len(locker.debug.held) != 0 {
+		t.Errorf("want no fingerprints held, got %v", locker.debug.held)
+	}
+	for i := range locker.stripes {
+		if len(locker.stripes[i].fpMtxs) != 0 {
+			t.Errorf("want no fingerprint mutexes left in stripe %d", i)
+		}
+	}
+}
+
 func BenchmarkFingerprintLockerParallel(b *testing.B) {
 	numGoroutines := 10
 	numFingerprints := 10
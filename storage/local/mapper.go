@@ -0,0 +1,418 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/local/codable"
+	"github.com/prometheus/prometheus/storage/local/index"
+)
+
+const (
+	// Fingerprints up to maxMappedFP are reserved for mapped fingerprints.
+	// Metrics whose original fingerprint falls into that range are always
+	// mapped. The chance for a metric to hit the range is about 1 in 2^44.
+	maxMappedFP = 1 << 20
+
+	mappingsFileName      = "mappings.db"
+	mappingsTempFileName  = "mappings.db.tmp"
+	mappingsMagicString   = "PrometheusMappings"
+	mappingsFormatVersion = 1
+)
+
+var separatorString = string([]byte{clientmodel.SeparatorByte})
+
+// fpMappings maps original fingerprints to a map of unique string
+// representations of metrics (see metricToUniqueString) to the fingerprints
+// those metrics have been mapped to.
+type fpMappings map[clientmodel.Fingerprint]map[string]clientmodel.Fingerprint
+
+// fpMapper maps the fingerprints of metrics whose original fingerprint collides
+// with that of a different metric to fingerprints from the reserved range up to
+// maxMappedFP. Without it, samples of colliding metrics would silently end up
+// in the same series.
+type fpMapper struct {
+	fpToSeries *seriesMap
+	p          *persistence
+
+	mtx             sync.RWMutex // Protects the fields below.
+	mappings        fpMappings
+	highestMappedFP clientmodel.Fingerprint
+
+	mappingsCounter prometheus.Counter
+}
+
+// newFPMapper loads the persisted mappings. If they cannot be loaded, they are
+// rebuilt from the series in memory and in the archive.
+func newFPMapper(fpToSeries *seriesMap, p *persistence) (*fpMapper, error) {
+	m := &fpMapper{
+		fpToSeries: fpToSeries,
+		p:          p,
+		mappingsCounter: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "fingerprint_mappings_total",
+			Help:      "The total number of fingerprints being mapped to avoid collisions.",
+		}),
+	}
+	mappings, highestMappedFP, err := p.loadFPMappings()
+	if err != nil {
+		glog.Error("Error loading fingerprint mappings, rebuilding them: ", err)
+		inMemory := map[clientmodel.Fingerprint]*memorySeries{}
+		for ms := range fpToSeries.iter() {
+			inMemory[ms.fp] = ms.series
+		}
+		if mappings, highestMappedFP, err = p.rebuildFPMappings(inMemory); err != nil {
+			return nil, err
+		}
+	}
+	m.mappings, m.highestMappedFP = mappings, highestMappedFP
+	return m, nil
+}
+
+// mapFP takes the original fingerprint of a metric and the metric itself and
+// returns the fingerprint to use for it, which is the original one unless it
+// collides with the fingerprint of a different metric. The caller must have
+// locked the original fingerprint. If an error is returned, the original
+// fingerprint is returned, too, as the best guess.
+func (m *fpMapper) mapFP(fp clientmodel.Fingerprint, metric clientmodel.Metric) (clientmodel.Fingerprint, error) {
+	// Original fingerprints in the reserved range are always mapped.
+	if fp <= maxMappedFP {
+		return m.maybeAddMapping(fp, metric)
+	}
+
+	// The most likely case: The series is in memory.
+	if s, ok := m.fpToSeries.get(fp); ok {
+		if s.metric.Equal(metric) {
+			return fp, nil
+		}
+		return m.maybeAddMapping(fp, metric)
+	}
+
+	// Before looking up the archive, check for an existing mapping.
+	m.mtx.RLock()
+	mappedFP, ok := m.mappings[fp][metricToUniqueString(metric)]
+	m.mtx.RUnlock()
+	if ok {
+		return mappedFP, nil
+	}
+
+	archivedMetric, err := m.p.getArchivedMetric(fp)
+	if err != nil || archivedMetric == nil {
+		// Either fp is not in use, or we cannot tell. In both cases,
+		// keep it unmapped.
+		return fp, err
+	}
+	if archivedMetric.Equal(metric) {
+		return fp, nil
+	}
+	return m.maybeAddMapping(fp, metric)
+}
+
+// maybeAddMapping returns the mapped fingerprint for the given colliding
+// metric, creating and persisting a new mapping if there is none yet.
+func (m *fpMapper) maybeAddMapping(fp clientmodel.Fingerprint, metric clientmodel.Metric) (clientmodel.Fingerprint, error) {
+	ms := metricToUniqueString(metric)
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if mappedFP, ok := m.mappings[fp][ms]; ok {
+		return mappedFP, nil
+	}
+	if m.highestMappedFP >= maxMappedFP {
+		return fp, fmt.Errorf("no fingerprints left to map colliding fingerprint %v to", fp)
+	}
+	m.highestMappedFP++
+	mappedFP := m.highestMappedFP
+	if _, ok := m.mappings[fp]; !ok {
+		m.mappings[fp] = map[string]clientmodel.Fingerprint{}
+	}
+	m.mappings[fp][ms] = mappedFP
+	m.mappingsCounter.Inc()
+	glog.Infof(
+		"Collision detected for fingerprint %v, metric %v, mapping to new fingerprint %v.",
+		fp, metric, mappedFP,
+	)
+	// Persist the mapping right away. Samples of the mapped metric are
+	// appended to the mapped series from now on, so the mapping must not
+	// get lost.
+	return mappedFP, m.p.checkpointFPMappings(m.mappings)
+}
+
+// Describe implements prometheus.Collector.
+func (m *fpMapper) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.mappingsCounter.Desc()
+}
+
+// Collect implements prometheus.Collector.
+func (m *fpMapper) Collect(ch chan<- prometheus.Metric) {
+	ch <- m.mappingsCounter
+}
+
+// metricToUniqueString turns a metric into a string in a reproducible and
+// unique way, i.e. the same metric will always create the same string, and
+// different metrics will always create different strings.
+func metricToUniqueString(m clientmodel.Metric) string {
+	parts := make([]string, 0, len(m))
+	for ln, lv := range m {
+		parts = append(parts, string(ln)+separatorString+string(lv))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, separatorString)
+}
+
+func (p *persistence) mappingsFileName() string {
+	return path.Join(p.basePath, mappingsFileName)
+}
+
+func (p *persistence) mappingsTempFileName() string {
+	return path.Join(p.basePath, mappingsTempFileName)
+}
+
+// checkpointFPMappings persists the given fingerprint mappings. It writes a
+// temporary file first and renames it, so that the mappings file is always
+// complete. If there are no mappings, no file is written.
+//
+// Description of the file format:
+//
+// (1) Magic string (const mappingsMagicString).
+//
+// (2) Varint-encoded format version (const mappingsFormatVersion).
+//
+// (3) Uvarint-encoded number of original fingerprints with mappings.
+//
+// (4) Repeated once per original fingerprint:
+//
+// (4.1) The original fingerprint as big-endian uint64.
+//
+// (4.2) Uvarint-encoded number of mappings for the original fingerprint.
+//
+// (4.3) Repeated once per mapping:
+//
+// (4.3.1) The unique string of the metric as uvarint-encoded length followed
+// by the bytes.
+//
+// (4.3.2) The mapped fingerprint as big-endian uint64.
+func (p *persistence) checkpointFPMappings(fpm fpMappings) (err error) {
+	if len(fpm) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(p.mappingsTempFileName(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		syncErr := f.Sync()
+		closeErr := f.Close()
+		if err != nil {
+			return
+		}
+		err = syncErr
+		if err != nil {
+			return
+		}
+		err = closeErr
+		if err != nil {
+			return
+		}
+		err = os.Rename(p.mappingsTempFileName(), p.mappingsFileName())
+	}()
+
+	w := bufio.NewWriterSize(f, fileBufSize)
+	if _, err = w.WriteString(mappingsMagicString); err != nil {
+		return
+	}
+	if _, err = codable.EncodeVarint(w, mappingsFormatVersion); err != nil {
+		return
+	}
+	if err = encodeUvarint(w, uint64(len(fpm))); err != nil {
+		return
+	}
+	for fp, mappings := range fpm {
+		if err = codable.EncodeUint64(w, uint64(fp)); err != nil {
+			return
+		}
+		if err = encodeUvarint(w, uint64(len(mappings))); err != nil {
+			return
+		}
+		for ms, mappedFP := range mappings {
+			if err = encodeUvarint(w, uint64(len(ms))); err != nil {
+				return
+			}
+			if _, err = w.WriteString(ms); err != nil {
+				return
+			}
+			if err = codable.EncodeUint64(w, uint64(mappedFP)); err != nil {
+				return
+			}
+		}
+	}
+	err = w.Flush()
+	return
+}
+
+// loadFPMappings loads the fingerprint mappings and returns them together with
+// the highest mapped fingerprint. A missing mappings file is not an error, as
+// it is only written once the first collision has been detected.
+func (p *persistence) loadFPMappings() (fpMappings, clientmodel.Fingerprint, error) {
+	fpm := fpMappings{}
+	var highestMappedFP clientmodel.Fingerprint
+
+	f, err := os.Open(p.mappingsFileName())
+	if os.IsNotExist(err) {
+		return fpm, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	r := bufio.NewReaderSize(f, fileBufSize)
+
+	buf := make([]byte, len(mappingsMagicString))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, 0, err
+	}
+	if magic := string(buf); magic != mappingsMagicString {
+		return nil, 0, fmt.Errorf("unexpected magic string, want %q, got %q", mappingsMagicString, magic)
+	}
+	version, err := binary.ReadVarint(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	if version != mappingsFormatVersion {
+		return nil, 0, fmt.Errorf("unknown fingerprint mappings format version, want %d", mappingsFormatVersion)
+	}
+	numRawFPs, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	for ; numRawFPs > 0; numRawFPs-- {
+		rawFP, err := codable.DecodeUint64(r)
+		if err != nil {
+			return nil, 0, err
+		}
+		numMappings, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, 0, err
+		}
+		mappings := make(map[string]clientmodel.Fingerprint, numMappings)
+		for ; numMappings > 0; numMappings-- {
+			lenMS, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, 0, err
+			}
+			buf := make([]byte, lenMS)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				return nil, 0, err
+			}
+			mappedFP, err := codable.DecodeUint64(r)
+			if err != nil {
+				return nil, 0, err
+			}
+			mfp := clientmodel.Fingerprint(mappedFP)
+			if mfp > maxMappedFP {
+				return nil, 0, fmt.Errorf("mapped fingerprint %v outside of the reserved range", mfp)
+			}
+			if mfp > highestMappedFP {
+				highestMappedFP = mfp
+			}
+			mappings[string(buf)] = mfp
+		}
+		fpm[clientmodel.Fingerprint(rawFP)] = mappings
+	}
+	return fpm, highestMappedFP, nil
+}
+
+// rebuildFPMappings reconstructs the fingerprint mappings from the given series
+// and the archived series, as a series whose fingerprint differs from the
+// original fingerprint of its metric has been mapped. The rebuilt mappings are
+// persisted. Only call during start-up.
+func (p *persistence) rebuildFPMappings(
+	fingerprintToSeries map[clientmodel.Fingerprint]*memorySeries,
+) (fpMappings, clientmodel.Fingerprint, error) {
+	if err := p.commitArchiveBatch(); err != nil {
+		return nil, 0, err
+	}
+	fpm := fpMappings{}
+	var highestMappedFP clientmodel.Fingerprint
+	add := func(fp clientmodel.Fingerprint, m clientmodel.Metric) {
+		if fp > maxMappedFP {
+			return
+		}
+		rawFP := m.Fingerprint()
+		if rawFP == fp {
+			return
+		}
+		if _, ok := fpm[rawFP]; !ok {
+			fpm[rawFP] = map[string]clientmodel.Fingerprint{}
+		}
+		fpm[rawFP][metricToUniqueString(m)] = fp
+		if fp > highestMappedFP {
+			highestMappedFP = fp
+		}
+	}
+
+	for fp, s := range fingerprintToSeries {
+		add(fp, s.metric)
+	}
+	var (
+		fp codable.Fingerprint
+		m  codable.Metric
+	)
+	if err := p.archivedFingerprintToMetrics.ForEach(func(kv index.KeyValueAccessor) error {
+		if err := kv.Key(&fp); err != nil {
+			return err
+		}
+		if clientmodel.Fingerprint(fp) > maxMappedFP {
+			return nil
+		}
+		if err := kv.Value(&m); err != nil {
+			return err
+		}
+		add(clientmodel.Fingerprint(fp), clientmodel.Metric(m))
+		return nil
+	}); err != nil {
+		return nil, 0, err
+	}
+
+	if err := os.Remove(p.mappingsFileName()); err != nil && !os.IsNotExist(err) {
+		return nil, 0, err
+	}
+	if err := p.checkpointFPMappings(fpm); err != nil {
+		return nil, 0, err
+	}
+	glog.Infof("Rebuilt %d fingerprint mappings.", len(fpm))
+	return fpm, highestMappedFP, nil
+}
+
+func encodeUvarint(w io.Writer, u uint64) error {
+	buf := make([]byte, binary.MaxVarintLen64)
+	_, err := w.Write(buf[:binary.PutUvarint(buf, u)])
+	return err
+}
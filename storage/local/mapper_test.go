@@ -0,0 +1,127 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+var (
+	// fp1 and fp2 are outside of the reserved range for mapped
+	// fingerprints, fp3 is inside, so it is mapped in any case.
+	fp1 clientmodel.Fingerprint = 1 << 32
+	fp2 clientmodel.Fingerprint = 2 << 32
+	fp3 clientmodel.Fingerprint = 7
+
+	cm11 = clientmodel.Metric{"foo": "bar", "dings": "bumms"}
+	cm12 = clientmodel.Metric{"bar": "foo"}
+	cm13 = clientmodel.Metric{"foo": "bar"}
+	cm21 = clientmodel.Metric{"foo": "bumms", "dings": "bar"}
+	cm31 = clientmodel.Metric{"bumms": "dings"}
+)
+
+func TestFPMapper(t *testing.T) {
+	s, closer := NewTestStorage(t, 1)
+	defer closer.Close()
+	ms := s.(*memorySeriesStorage)
+	sm := newSeriesMap()
+	p := ms.persistence
+
+	mapper, err := newFPMapper(sm, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectMapping := func(fp clientmodel.Fingerprint, m clientmodel.Metric, want clientmodel.Fingerprint) {
+		got, err := mapper.mapFP(fp, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("mapping %v with metric %v: got %v, want %v", fp, m, got, want)
+		}
+	}
+
+	// Nothing in memory or archived, so no mapping.
+	expectMapping(fp1, cm11, fp1)
+	expectMapping(fp1, cm12, fp1)
+
+	// A series for cm11 in memory leads to mapping cm12 and cm13.
+	sm.put(fp1, newMemorySeries(cm11, true, 0))
+	expectMapping(fp1, cm11, fp1)
+	expectMapping(fp1, cm12, 1)
+	expectMapping(fp1, cm13, 2)
+	expectMapping(fp1, cm12, 1)
+
+	// Other fingerprints are unaffected.
+	expectMapping(fp2, cm21, fp2)
+
+	// Fingerprints in the reserved range are always mapped.
+	expectMapping(fp3, cm31, 3)
+	expectMapping(fp3, cm31, 3)
+
+	// Archived series are taken into account, too.
+	sm.del(fp1)
+	if err := p.archiveMetric(fp1, cm11, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	expectMapping(fp1, cm11, fp1)
+	expectMapping(fp1, cm12, 1)
+	expectMapping(fp1, cm13, 2)
+
+	// The mappings survive a restart.
+	if mapper, err = newFPMapper(sm, p); err != nil {
+		t.Fatal(err)
+	}
+	expectMapping(fp1, cm12, 1)
+	expectMapping(fp1, cm13, 2)
+	expectMapping(fp3, cm31, 3)
+	expectMapping(fp2, cm21, fp2)
+	sm.put(fp2, newMemorySeries(cm21, true, 0))
+	expectMapping(fp2, cm11, 4)
+
+	// If the mappings file is lost, the mappings are rebuilt from the
+	// series with fingerprints in the reserved range, in memory or
+	// archived, whose metrics have a different original fingerprint.
+	if err := os.Remove(p.mappingsFileName()); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.archiveMetric(2, cm13, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	fpm, highestMappedFP, err := p.rebuildFPMappings(map[clientmodel.Fingerprint]*memorySeries{
+		1:   newMemorySeries(cm12, true, 0),
+		fp2: newMemorySeries(cm21, true, 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fpMappings{
+		cm12.Fingerprint(): {metricToUniqueString(cm12): 1},
+		cm13.Fingerprint(): {metricToUniqueString(cm13): 2},
+	}
+	if !reflect.DeepEqual(fpm, want) {
+		t.Errorf("got rebuilt mappings %v, want %v", fpm, want)
+	}
+	if highestMappedFP != 2 {
+		t.Errorf("got highest mapped fingerprint %v, want 2", highestMappedFP)
+	}
+	if loaded, _, err := p.loadFPMappings(); err != nil || !reflect.DeepEqual(loaded, want) {
+		t.Errorf("got loaded mappings %v, %v, want %v", loaded, err, want)
+	}
+}
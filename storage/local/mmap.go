@@ -0,0 +1,118 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+// openChunkFileMapped opens the series file of the given fingerprint and maps
+// it into memory read-only. The returned function unmaps the file and must be
+// called once the data is not needed anymore. If the series file does not
+// exist, an error satisfying os.IsNotExist is returned. An empty series file
+// results in nil data.
+func (p *persistence) openChunkFileMapped(fp clientmodel.Fingerprint) (data []byte, unmap func(), err error) {
+	f, err := p.openChunkFileForReading(fp)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The mapping stays valid after closing the file.
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if fi.Size()%int64(p.chunkRecordLen()) != 0 {
+		p.setDirty(true)
+		return nil, nil, fmt.Errorf(
+			"size of series file for fingerprint %v is %d, which is not a multiple of the chunk length %d",
+			fp, fi.Size(), p.chunkRecordLen(),
+		)
+	}
+	if fi.Size() == 0 {
+		return nil, func() {}, nil
+	}
+	data, err = mmap(f, int(fi.Size()))
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() { munmap(data) }, nil
+}
+
+// loadChunksMapped is the implementation of loadChunks for memory-mapped
+// series files.
+func (p *persistence) loadChunksMapped(fp clientmodel.Fingerprint, indexes []int, indexOffset int) ([]chunk, error) {
+	data, unmap, err := p.openChunkFileMapped(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer unmap()
+
+	recordLen := p.chunkRecordLen()
+	chunks := make([]chunk, 0, len(indexes))
+	for _, idx := range indexes {
+		offset := int(p.offsetForChunkIndex(idx + indexOffset))
+		if offset < 0 || offset+recordLen > len(data) {
+			return nil, fmt.Errorf(
+				"chunk index %d out of range for series file of fingerprint %v with %d chunks",
+				idx+indexOffset, fp, len(data)/recordLen,
+			)
+		}
+		chunk, err := p.unmarshalChunkRecord(data[offset : offset+recordLen])
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, chunk)
+	}
+	chunkOps.WithLabelValues(load).Add(float64(len(chunks)))
+	atomic.AddInt64(&numMemChunks, int64(len(chunks)))
+	return chunks, nil
+}
+
+// loadChunkDescsMapped is the implementation of loadChunkDescs for
+// memory-mapped series files.
+func (p *persistence) loadChunkDescsMapped(fp clientmodel.Fingerprint, beforeTime clientmodel.Timestamp) ([]*chunkDesc, error) {
+	data, unmap, err := p.openChunkFileMapped(fp)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer unmap()
+
+	numChunks := len(data) / p.chunkRecordLen()
+	cds := make([]*chunkDesc, 0, numChunks)
+	for i := 0; i < numChunks; i++ {
+		header := data[p.offsetForChunkIndex(i):]
+		cd := &chunkDesc{
+			chunkFirstTime: clientmodel.Timestamp(binary.LittleEndian.Uint64(header[chunkHeaderFirstTimeOffset:])),
+			chunkLastTime:  clientmodel.Timestamp(binary.LittleEndian.Uint64(header[chunkHeaderLastTimeOffset:])),
+		}
+		if !cd.chunkLastTime.Before(beforeTime) {
+			// From here on, we have chunkDescs in memory already.
+			break
+		}
+		cds = append(cds, cd)
+	}
+	chunkDescOps.WithLabelValues(load).Add(float64(len(cds)))
+	numMemChunkDescs.Add(float64(len(cds)))
+	return cds, nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package objectstore provides the object stores the cold tier of the local
+// storage can be kept in.
+package objectstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Dir is an ObjectStore storing each object as a file in a directory tree,
+// e.g. on a network file system. Slashes in keys separate subdirectories.
+type Dir string
+
+// Put implements local.ObjectStore. The object is written to a temporary file
+// first, so that a partially written object is never visible.
+func (d Dir) Put(key string, data []byte) error {
+	name := d.fileName(key)
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return err
+	}
+	temp := name + ".tmp"
+	if err := ioutil.WriteFile(temp, data, 0640); err != nil {
+		return err
+	}
+	return os.Rename(temp, name)
+}
+
+// Get implements local.ObjectStore.
+func (d Dir) Get(key string) ([]byte, error) {
+	return ioutil.ReadFile(d.fileName(key))
+}
+
+// Delete implements local.ObjectStore.
+func (d Dir) Delete(key string) error {
+	if err := os.Remove(d.fileName(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (d Dir) fileName(key string) string {
+	return filepath.Join(string(d), filepath.FromSlash(key))
+}
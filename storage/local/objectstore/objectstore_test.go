@@ -0,0 +1,142 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package objectstore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type store interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error
+}
+
+func testStore(t *testing.T, s store) {
+	if err := s.Put("00000000000000ab/0000000000001234", []byte("chunks")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put("00000000000000ab/0000000000005678", []byte("more chunks")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := s.Get("00000000000000ab/0000000000001234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "chunks" {
+		t.Errorf("unexpected object: want %q, got %q", "chunks", data)
+	}
+	if err := s.Delete("00000000000000ab/0000000000001234"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("00000000000000ab/0000000000001234"); err == nil {
+		t.Error("expected error getting deleted object")
+	}
+	// Deleting a missing object is not an error.
+	if err := s.Delete("00000000000000ab/0000000000001234"); err != nil {
+		t.Error(err)
+	}
+	data, err = s.Get("00000000000000ab/0000000000005678")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "more chunks" {
+		t.Errorf("unexpected object: want %q, got %q", "more chunks", data)
+	}
+}
+
+func TestDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_objectstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	testStore(t, Dir(dir))
+}
+
+func TestS3(t *testing.T) {
+	var (
+		mtx     sync.Mutex
+		objects = map[string][]byte{}
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") ||
+			!strings.Contains(auth, "/eu-west-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=") {
+			t.Errorf("unexpected authorization header %q", auth)
+		}
+		if !strings.HasPrefix(r.URL.Path, "/bucket/") {
+			t.Errorf("unexpected path %q", r.URL.Path)
+		}
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		switch r.Method {
+		case "PUT":
+			buf, _ := ioutil.ReadAll(r.Body)
+			objects[r.URL.Path] = buf
+		case "GET":
+			buf, ok := objects[r.URL.Path]
+			if !ok {
+				http.Error(w, "NoSuchKey", http.StatusNotFound)
+				return
+			}
+			w.Write(buf)
+		case "DELETE":
+			delete(objects, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	s, err := NewS3(server.URL, "bucket", "eu-west-1", "AKID", "secret", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+}
+
+func TestS3Signature(t *testing.T) {
+	s, err := NewS3("https://examplebucket.s3.amazonaws.com", "bucket", "us-east-1", "AKID", "secret", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("PUT", "https://examplebucket.s3.amazonaws.com/bucket/key", bytes.NewReader([]byte("data")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2015, 5, 24, 0, 0, 0, 0, time.UTC)
+	s.sign(req, []byte("data"), now)
+	first := req.Header.Get("Authorization")
+	s.sign(req, []byte("data"), now)
+	if got := req.Header.Get("Authorization"); got != first {
+		t.Errorf("signature not deterministic: %q != %q", got, first)
+	}
+	s.sign(req, []byte("other data"), now)
+	if got := req.Header.Get("Authorization"); got == first {
+		t.Error("signature does not depend on the payload")
+	}
+	if got, want := req.Header.Get("X-Amz-Date"), "20150524T000000Z"; got != want {
+		t.Errorf("unexpected date header: want %q, got %q", want, got)
+	}
+}
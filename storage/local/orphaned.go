@@ -0,0 +1,222 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+// orphanedDirName is the name of the directory below the storage directory
+// into which crash recovery moves series files it cannot make sense of.
+const orphanedDirName = "orphaned"
+
+// OrphanedSeries describes a file in the orphaned directory.
+type OrphanedSeries struct {
+	Path        string                  `json:"path"`
+	Fingerprint clientmodel.Fingerprint `json:"fingerprint"`
+	// The metric according to the label index snapshot, or nil if
+	// unknown.
+	Metric    clientmodel.Metric    `json:"metric"`
+	Chunks    int                   `json:"chunks"`
+	FirstTime clientmodel.Timestamp `json:"firstTime"`
+	LastTime  clientmodel.Timestamp `json:"lastTime"`
+	// Problem is why the file cannot be restored as is, or empty if it
+	// can.
+	Problem string `json:"problem,omitempty"`
+}
+
+// ListOrphanedSeries implements Storage.
+func (s *memorySeriesStorage) ListOrphanedSeries() ([]OrphanedSeries, error) {
+	known, err := s.persistence.loadLabelIndexSnapshot()
+	if err != nil {
+		glog.Warning("Could not load label index snapshot, metrics of orphaned series will be unknown: ", err)
+	}
+
+	orphanedDir := path.Join(s.persistence.basePath, orphanedDirName)
+	dirs, err := ioutil.ReadDir(orphanedDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var orphaned []OrphanedSeries
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		dirname := path.Join(orphanedDir, dir.Name())
+		fis, err := ioutil.ReadDir(dirname)
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range fis {
+			o := OrphanedSeries{Path: path.Join(dirname, fi.Name())}
+			fp, err := orphanedFingerprint(dir.Name(), fi.Name())
+			if err != nil {
+				o.Problem = err.Error()
+				orphaned = append(orphaned, o)
+				continue
+			}
+			o.Fingerprint = fp
+			o.Metric = known[fp]
+			o.Chunks, o.FirstTime, o.LastTime, err = s.persistence.orphanedTimeRange(o.Path)
+			switch {
+			case err != nil:
+				o.Problem = err.Error()
+			case o.Metric == nil:
+				o.Problem = "metric unknown"
+			default:
+				if err := s.checkRestorable(fp); err != nil {
+					o.Problem = err.Error()
+				}
+			}
+			orphaned = append(orphaned, o)
+		}
+	}
+	sort.Sort(orphanedByPath(orphaned))
+	return orphaned, nil
+}
+
+// RestoreOrphanedSeries implements Storage.
+func (s *memorySeriesStorage) RestoreOrphanedSeries(fp clientmodel.Fingerprint, m clientmodel.Metric) error {
+	if m == nil {
+		known, err := s.persistence.loadLabelIndexSnapshot()
+		if err != nil {
+			return err
+		}
+		if m = known[fp]; m == nil {
+			return fmt.Errorf("metric of orphaned series %v unknown", fp)
+		}
+	} else if m.Fingerprint() != fp {
+		return fmt.Errorf("metric %v does not have fingerprint %v", m, fp)
+	}
+
+	s.fpLocker.Lock(fp)
+	defer s.fpLocker.Unlock(fp)
+
+	if err := s.checkRestorable(fp); err != nil {
+		return err
+	}
+	fpStr := fp.String()
+	filename := path.Join(
+		s.persistence.basePath, orphanedDirName,
+		fpStr[:seriesDirNameLen], fpStr[seriesDirNameLen:]+seriesFileSuffix,
+	)
+	chunks, first, last, err := s.persistence.orphanedTimeRange(filename)
+	if err != nil {
+		return err
+	}
+	// Drop a torn chunk at the end, as crash recovery would have done.
+	if err := os.Truncate(filename, int64(chunks*s.persistence.chunkRecordLen())); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.persistence.dirNameForFingerprint(fp), 0700); err != nil {
+		return err
+	}
+	if err := os.Rename(filename, s.persistence.fileNameForFingerprint(fp)); err != nil {
+		return err
+	}
+
+	s.persistence.indexMetric(fp, m)
+	if err := s.persistence.archiveMetric(fp, m, first, last); err != nil {
+		return err
+	}
+	s.seriesOps.WithLabelValues(orphanRestore).Inc()
+	glog.Infof("Restored orphaned series %v with %d chunks.", m, chunks)
+	return nil
+}
+
+// checkRestorable returns an error if an orphaned series file for the given
+// fingerprint would collide with a series in the storage.
+func (s *memorySeriesStorage) checkRestorable(fp clientmodel.Fingerprint) error {
+	if _, ok := s.fpToSeries.get(fp); ok {
+		return fmt.Errorf("series %v is in memory", fp)
+	}
+	archived, _, _, err := s.persistence.hasArchivedMetric(fp)
+	if err != nil {
+		return err
+	}
+	if archived {
+		return fmt.Errorf("series %v is archived", fp)
+	}
+	if _, err := os.Stat(s.persistence.fileNameForFingerprint(fp)); err == nil {
+		return fmt.Errorf("series file for %v exists", fp)
+	}
+	return nil
+}
+
+// orphanedFingerprint derives the fingerprint from the directory and file name
+// of an orphaned series file.
+func orphanedFingerprint(dirname, filename string) (clientmodel.Fingerprint, error) {
+	var fp clientmodel.Fingerprint
+	if len(dirname) != seriesDirNameLen ||
+		len(filename) != fpLen-seriesDirNameLen+len(seriesFileSuffix) ||
+		!strings.HasSuffix(filename, seriesFileSuffix) {
+		return fp, fmt.Errorf("not a series file name")
+	}
+	if err := fp.LoadFromString(dirname + filename[:fpLen-seriesDirNameLen]); err != nil {
+		return fp, fmt.Errorf("not a series file name: %s", err)
+	}
+	return fp, nil
+}
+
+// orphanedTimeRange returns the number of complete chunks in the given series
+// file and the first and last timestamp according to their headers.
+func (p *persistence) orphanedTimeRange(filename string) (chunks int, first, last clientmodel.Timestamp, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	chunks = int(fi.Size()) / p.chunkRecordLen()
+	if chunks == 0 {
+		return 0, 0, 0, fmt.Errorf("no complete chunk")
+	}
+
+	buf := make([]byte, 16)
+	if _, err := f.ReadAt(buf, chunkHeaderFirstTimeOffset); err != nil {
+		return 0, 0, 0, err
+	}
+	first = clientmodel.Timestamp(binary.LittleEndian.Uint64(buf))
+	if _, err := f.ReadAt(buf, p.offsetForChunkIndex(chunks-1)+chunkHeaderFirstTimeOffset); err != nil {
+		return 0, 0, 0, err
+	}
+	last = clientmodel.Timestamp(binary.LittleEndian.Uint64(buf[8:]))
+	if last.Before(first) {
+		return 0, 0, 0, fmt.Errorf("last chunk ends at %v before first chunk starts at %v", last, first)
+	}
+	return chunks, first, last, nil
+}
+
+// orphanedByPath implements sort.Interface, sorting by Path.
+type orphanedByPath []OrphanedSeries
+
+func (o orphanedByPath) Len() int           { return len(o) }
+func (o orphanedByPath) Less(i, j int) bool { return o[i].Path < o[j].Path }
+func (o orphanedByPath) Swap(i, j int)      { o[i], o[j] = o[j], o[i] }
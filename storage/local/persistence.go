@@ -15,6 +15,7 @@ package local
 
 import (
 	"bufio"
+	"crypto/cipher"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -22,6 +23,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -49,11 +51,16 @@ const (
 	seriesTempFileSuffix = ".db.tmp"
 	seriesDirNameLen     = 2 // How many bytes of the fingerprint in dir name.
 
-	headsFileName            = "heads.db"
-	headsTempFileName        = "heads.db.tmp"
-	headsFormatVersion       = 2
-	headsFormatLegacyVersion = 1 // Can read, but will never write.
-	headsMagicString         = "PrometheusHeads"
+	headsFileName                = "heads.db"
+	headsTempFileName            = "heads.db.tmp"
+	headsFormatVersion           = 2
+	headsFormatLegacyVersion     = 1 // Can read, but will never write.
+	headsFormatCompressedVersion = 3 // Like v2, but with compressed series.
+	headsMagicString             = "PrometheusHeads"
+
+	headsIncrementalFileName      = "heads_incremental.db"
+	headsIncrementalFormatVersion = 1
+	headsIncrementalMagicString   = "PrometheusIncrementalHeads"
 
 	dirtyFileName = "DIRTY"
 
@@ -105,6 +112,8 @@ type persistence struct {
 	archivedFingerprintToTimeRange *index.FingerprintTimeRangeIndex
 	labelPairToFingerprints        *index.LabelPairFingerprintIndex
 	labelNameToLabelValues         *index.LabelNameLabelValuesIndex
+	labelValueTrigrams             *labelValueTrigrams
+	archiveBatch                   *archiveBatch // Changes of the archive indexes not written yet.
 
 	indexingQueue   chan indexingOp
 	indexingStopped chan struct{}
@@ -125,11 +134,55 @@ type persistence struct {
 
 	shouldSync syncStrategy
 
+	mmapSeriesFiles bool             // true if series files are memory-mapped for loading.
+	chunkEncoding   ChunkEncoding    // Of the chunks written by compaction and backfilling.
+	chunkCache      *chunkCache      // nil if chunks loaded from series files are not cached.
+	indexCacheSizes index.CacheSizes // Also used for the archive indexes of snapshots.
+	ioThrottle      *ioThrottle      // Limits the I/O of checkpointing, dropping chunks, and crash recovery.
+	aead            cipher.AEAD      // nil if chunk data, checkpoints, and the WAL are not encrypted.
+
+	checkpointCompression Compression // Of the series in the heads file.
+	dataSync              bool        // true if files are synced with fdatasync instead of fsync.
+	pageCacheEviction     bool        // true if written and scanned files are evicted from the page cache.
+	directIO              bool        // true if chunks are appended to series files with O_DIRECT.
+
+	archivedFilter *fingerprintFilter // nil if lookups in the archive indexes are not filtered.
+
+	replicationJournal *replicationJournal // nil if no replication stream is served to standbys.
+
+	checkpointMtx      sync.Mutex // Serializes checkpoints.
+	fullCheckpointDone bool       // Protected by checkpointMtx. See checkpoint.go.
+
+	// The end (in Unix nanoseconds) and the duration of the last
+	// checkpoint. Accessed atomically.
+	lastCheckpointEnd      int64
+	lastCheckpointDuration int64
+
+	removedMtx sync.Mutex                           // Protects removedFPs.
+	removedFPs map[clientmodel.Fingerprint]struct{} // Series removed from memory since the last checkpoint began.
+
+	wal             *writeAheadLog // nil if the write-ahead log is disabled.
+	walSegments     []int          // Numbers of the WAL segments found on start-up.
+	walFullRecovery bool           // true if crash recovery must not rely on the WAL.
+
+	recoveredFromCrash bool              // true if crash recovery was run on start-up.
+	recoveryProgress   *RecoveryProgress // Progress of the crash recovery, never nil.
+
+	snapshotMtx              sync.Mutex                                 // Protects unarchivedDuringSnapshot.
+	unarchivedDuringSnapshot map[clientmodel.Fingerprint]archivedSeries // nil if no snapshot is in progress.
+	walFlushInterval         time.Duration
+	walStopping              chan struct{}
+	walStopped               chan struct{}
+
 	bufPool sync.Pool
 }
 
-// newPersistence returns a newly allocated persistence backed by local disk storage, ready to use.
-func newPersistence(basePath string, dirty, pedanticChecks bool, shouldSync syncStrategy) (*persistence, error) {
+// newPersistence returns a newly allocated persistence backed by local disk
+// storage, ready to use. If walFlushInterval is 0, no write-ahead log is used.
+func newPersistence(
+	basePath string, dirty, pedanticChecks bool, shouldSync syncStrategy, walFlushInterval time.Duration,
+	indexCacheSizes index.CacheSizes,
+) (*persistence, error) {
 	dirtyPath := filepath.Join(basePath, dirtyFileName)
 	versionPath := filepath.Join(basePath, versionFileName)
 
@@ -172,29 +225,39 @@ func newPersistence(basePath string, dirty, pedanticChecks bool, shouldSync sync
 		glog.Errorf("Could not lock %s, Prometheus already running?", dirtyPath)
 		return nil, err
 	}
-	if dirtyfileExisted {
-		dirty = true
-	}
-
-	archivedFingerprintToMetrics, err := index.NewFingerprintMetricIndex(basePath)
+	archivedFingerprintToMetrics, err := index.NewFingerprintMetricIndex(basePath, indexCacheSizes.FingerprintToMetric)
 	if err != nil {
 		return nil, err
 	}
-	archivedFingerprintToTimeRange, err := index.NewFingerprintTimeRangeIndex(basePath)
+	archivedFingerprintToTimeRange, err := index.NewFingerprintTimeRangeIndex(basePath, indexCacheSizes.FingerprintTimeRange)
 	if err != nil {
 		return nil, err
 	}
 
+	// Crash recovery may only rely on the WAL if the storage is dirty
+	// because of an unclean shutdown, not because a full recovery was
+	// requested explicitly.
+	walFullRecovery := dirty || pedanticChecks
+	if dirtyfileExisted {
+		dirty = true
+	}
+
 	p := &persistence{
 		basePath: basePath,
 
 		archivedFingerprintToMetrics:   archivedFingerprintToMetrics,
 		archivedFingerprintToTimeRange: archivedFingerprintToTimeRange,
+		archiveBatch:                   newArchiveBatch(),
 
 		indexingQueue:   make(chan indexingOp, indexingQueueCapacity),
 		indexingStopped: make(chan struct{}),
 		indexingFlush:   make(chan chan int),
 
+		recoveryProgress: NewRecoveryProgress(),
+
+		removedFPs: map[clientmodel.Fingerprint]struct{}{},
+		ioThrottle: newIOThrottle(0, 0),
+
 		indexingQueueLength: prometheus.NewGauge(prometheus.GaugeOpts{
 			Namespace: namespace,
 			Subsystem: subsystem,
@@ -237,6 +300,13 @@ func newPersistence(basePath string, dirty, pedanticChecks bool, shouldSync sync
 		dirtyFileName:  dirtyPath,
 		fLock:          fLock,
 		shouldSync:     shouldSync,
+
+		indexCacheSizes: indexCacheSizes,
+
+		walFullRecovery:  walFullRecovery,
+		walFlushInterval: walFlushInterval,
+		walStopping:      make(chan struct{}),
+		walStopped:       make(chan struct{}),
 		// Create buffers of length 3*chunkLenWithHeader by default because that is still reasonably small
 		// and at the same time enough for many uses. The contract is to never return buffer smaller than
 		// that to the pool so that callers can rely on a minimum buffer size.
@@ -256,12 +326,28 @@ func newPersistence(basePath string, dirty, pedanticChecks bool, shouldSync sync
 	if err != nil {
 		return nil, err
 	}
-	labelNameToLabelValues, err := index.NewLabelNameLabelValuesIndex(basePath)
+	labelNameToLabelValues, err := index.NewLabelNameLabelValuesIndex(basePath, indexCacheSizes.LabelNameToLabelValues)
 	if err != nil {
 		return nil, err
 	}
 	p.labelPairToFingerprints = labelPairToFingerprints
 	p.labelNameToLabelValues = labelNameToLabelValues
+	p.labelValueTrigrams = newLabelValueTrigrams()
+
+	walDir := filepath.Join(basePath, walDirName)
+	if walFlushInterval > 0 {
+		if p.wal, p.walSegments, err = newWriteAheadLog(walDir); err != nil {
+			return nil, err
+		}
+		go p.flushWALLoop()
+	} else {
+		// Segments left over from an earlier run would be incomplete
+		// by the time the WAL is enabled again.
+		if err := os.RemoveAll(walDir); err != nil {
+			return nil, err
+		}
+		close(p.walStopped)
+	}
 
 	go p.processIndexingQueue()
 	return p, nil
@@ -274,6 +360,14 @@ func (p *persistence) Describe(ch chan<- *prometheus.Desc) {
 	p.indexingBatchSizes.Describe(ch)
 	p.indexingBatchDuration.Describe(ch)
 	ch <- p.checkpointDuration.Desc()
+	p.archiveBatch.Describe(ch)
+	p.ioThrottle.Describe(ch)
+	if p.chunkCache != nil {
+		p.chunkCache.Describe(ch)
+	}
+	if p.archivedFilter != nil {
+		p.archivedFilter.Describe(ch)
+	}
 }
 
 // Collect implements prometheus.Collector.
@@ -285,6 +379,32 @@ func (p *persistence) Collect(ch chan<- prometheus.Metric) {
 	p.indexingBatchSizes.Collect(ch)
 	p.indexingBatchDuration.Collect(ch)
 	ch <- p.checkpointDuration
+	p.archiveBatch.Collect(ch)
+	p.ioThrottle.Collect(ch)
+	if p.chunkCache != nil {
+		p.chunkCache.Collect(ch)
+	}
+	if p.archivedFilter != nil {
+		p.archivedFilter.Collect(ch)
+	}
+}
+
+// invalidateChunkCache removes all cached chunks of the given fingerprint. It
+// has to be called whenever the series file is rewritten or deleted.
+func (p *persistence) invalidateChunkCache(fp clientmodel.Fingerprint) {
+	if p.chunkCache != nil {
+		p.chunkCache.invalidate(fp)
+	}
+}
+
+// lastCheckpoint returns when the last checkpoint was completed and how long it
+// took. The time is zero if no checkpoint was completed yet.
+func (p *persistence) lastCheckpoint() (time.Time, time.Duration) {
+	end := atomic.LoadInt64(&p.lastCheckpointEnd)
+	if end == 0 {
+		return time.Time{}, 0
+	}
+	return time.Unix(0, end), time.Duration(atomic.LoadInt64(&p.lastCheckpointDuration))
 }
 
 // isDirty returns the dirty flag in a goroutine-safe way.
@@ -308,6 +428,59 @@ func (p *persistence) setDirty(dirty bool) {
 	if dirty {
 		p.becameDirty = true
 		glog.Error("The storage is now inconsistent. Restart Prometheus ASAP to initiate recovery.")
+		if p.wal != nil {
+			if err := p.wal.logDirty(); err != nil {
+				glog.Error("Error marking WAL as dirty: ", err)
+			}
+		}
+	}
+}
+
+// logSample appends the given sample to the write-ahead log, if enabled. The
+// caller must have locked the fingerprint.
+func (p *persistence) logSample(fp clientmodel.Fingerprint, m clientmodel.Metric, v *metric.SamplePair) {
+	if p.wal == nil {
+		return
+	}
+	if err := p.wal.logSample(fp, m, v); err != nil {
+		glog.Error("Error writing sample to WAL: ", err)
+		p.setDirty(true)
+	}
+}
+
+// logSeriesChange records in the write-ahead log, if enabled, that the series
+// file or archive index entry for the given fingerprint is about to change, so
+// that crash recovery can restrict itself to the series changed since the
+// last checkpoint. The change is also recorded in the replication journal, if
+// any, so that standbys sync the series.
+func (p *persistence) logSeriesChange(fp clientmodel.Fingerprint) {
+	p.replicationJournal.add(fp)
+	if p.wal == nil {
+		return
+	}
+	if err := p.wal.logSeriesChange(fp); err != nil {
+		glog.Error("Error writing series change to WAL: ", err)
+		p.setDirty(true)
+	}
+}
+
+// flushWALLoop periodically flushes the write-ahead log until the persistence
+// is closed. Whether to sync is decided by the sync strategy.
+func (p *persistence) flushWALLoop() {
+	defer close(p.walStopped)
+
+	ticker := time.NewTicker(p.walFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.walStopping:
+			return
+		case <-ticker.C:
+			if err := p.wal.flush(p.shouldSync()); err != nil {
+				glog.Error("Error flushing WAL: ", err)
+				p.setDirty(true)
+			}
+		}
 	}
 }
 
@@ -323,6 +496,24 @@ func (p *persistence) getFingerprintsForLabelPair(lp metric.LabelPair) (clientmo
 	return fps, nil
 }
 
+// getFingerprintsForLabelPairs returns the union of the fingerprints for the
+// given label pairs, all looked up from the same state of the index. This
+// method is goroutine-safe with the same caveats as
+// getFingerprintsForLabelPair.
+func (p *persistence) getFingerprintsForLabelPairs(lps []metric.LabelPair) (map[clientmodel.Fingerprint]struct{}, error) {
+	fpsPerPair, err := p.labelPairToFingerprints.LookupAll(lps)
+	if err != nil {
+		return nil, err
+	}
+	result := map[clientmodel.Fingerprint]struct{}{}
+	for _, fps := range fpsPerPair {
+		for _, fp := range fps {
+			result[fp] = struct{}{}
+		}
+	}
+	return result, nil
+}
+
 // getLabelValuesForLabelName returns the label values for the given label
 // name. This method is goroutine-safe but take into account that metrics queued
 // for indexing with IndexMetric might not have made it into the index
@@ -349,13 +540,24 @@ func (p *persistence) persistChunks(fp clientmodel.Fingerprint, chunks []chunk)
 		}
 	}()
 
+	p.logSeriesChange(fp)
+	if p.directIO {
+		size, err := p.appendChunksDirect(fp, chunks)
+		if err != nil {
+			return -1, err
+		}
+		if index, err = p.chunkIndexForOffset(size); err != nil {
+			return -1, err
+		}
+		return index - len(chunks), nil
+	}
 	f, err := p.openChunkFileForWriting(fp)
 	if err != nil {
 		return -1, err
 	}
 	defer p.closeChunkFile(f)
 
-	if err := writeChunks(f, chunks); err != nil {
+	if err := p.writeChunks(f, chunks); err != nil {
 		return -1, err
 	}
 
@@ -364,7 +566,7 @@ func (p *persistence) persistChunks(fp clientmodel.Fingerprint, chunks []chunk)
 	if err != nil {
 		return -1, err
 	}
-	index, err = chunkIndexForOffset(offset)
+	index, err = p.chunkIndexForOffset(offset)
 	if err != nil {
 		return -1, err
 	}
@@ -378,6 +580,44 @@ func (p *persistence) persistChunks(fp clientmodel.Fingerprint, chunks []chunk)
 // each index in indexes. It is the caller's responsibility to not persist or
 // drop anything for the same fingerprint concurrently.
 func (p *persistence) loadChunks(fp clientmodel.Fingerprint, indexes []int, indexOffset int) ([]chunk, error) {
+	if p.chunkCache == nil {
+		return p.loadChunksFromFile(fp, indexes, indexOffset)
+	}
+
+	chunks := make([]chunk, len(indexes))
+	missing := []int{}
+	for i, idx := range indexes {
+		if c, ok := p.chunkCache.get(fp, idx+indexOffset); ok {
+			chunks[i] = c
+		} else {
+			missing = append(missing, idx)
+		}
+	}
+	if len(missing) == 0 {
+		atomic.AddInt64(&numMemChunks, int64(len(chunks)))
+		return chunks, nil
+	}
+	loaded, err := p.loadChunksFromFile(fp, missing, indexOffset)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&numMemChunks, int64(len(chunks)-len(loaded)))
+	for i, j := 0, 0; i < len(chunks); i++ {
+		if chunks[i] == nil {
+			chunks[i] = loaded[j]
+			p.chunkCache.put(fp, missing[j]+indexOffset, loaded[j])
+			j++
+		}
+	}
+	return chunks, nil
+}
+
+// loadChunksFromFile loads chunks like loadChunks, but always from the series
+// file, bypassing the chunk cache.
+func (p *persistence) loadChunksFromFile(fp clientmodel.Fingerprint, indexes []int, indexOffset int) ([]chunk, error) {
+	if p.mmapSeriesFiles {
+		return p.loadChunksMapped(fp, indexes, indexOffset)
+	}
 	f, err := p.openChunkFileForReading(fp)
 	if err != nil {
 		return nil, err
@@ -396,7 +636,7 @@ func (p *persistence) loadChunks(fp clientmodel.Fingerprint, indexes []int, inde
 		// This loads chunks in batches. A batch is a streak of
 		// consecutive chunks, read from disk in one go.
 		batchSize := 1
-		if _, err := f.Seek(offsetForChunkIndex(indexes[i]+indexOffset), os.SEEK_SET); err != nil {
+		if _, err := f.Seek(p.offsetForChunkIndex(indexes[i]+indexOffset), os.SEEK_SET); err != nil {
 			return nil, err
 		}
 
@@ -404,7 +644,8 @@ func (p *persistence) loadChunks(fp clientmodel.Fingerprint, indexes []int, inde
 			i+1 < len(indexes) &&
 			indexes[i]+1 == indexes[i+1]; i, batchSize = i+1, batchSize+1 {
 		}
-		readSize := batchSize * chunkLenWithHeader
+		recordLen := p.chunkRecordLen()
+		readSize := batchSize * recordLen
 		if cap(buf) < readSize {
 			buf = make([]byte, readSize)
 		}
@@ -414,8 +655,10 @@ func (p *persistence) loadChunks(fp clientmodel.Fingerprint, indexes []int, inde
 			return nil, err
 		}
 		for c := 0; c < batchSize; c++ {
-			chunk := newChunkForEncoding(chunkEncoding(buf[c*chunkLenWithHeader+chunkHeaderTypeOffset]))
-			chunk.unmarshalFromBuf(buf[c*chunkLenWithHeader+chunkHeaderLen:])
+			chunk, err := p.unmarshalChunkRecord(buf[c*recordLen:])
+			if err != nil {
+				return nil, err
+			}
 			chunks = append(chunks, chunk)
 		}
 	}
@@ -424,10 +667,47 @@ func (p *persistence) loadChunks(fp clientmodel.Fingerprint, indexes []int, inde
 	return chunks, nil
 }
 
+// loadChunksBatch loads the chunks with the given indexes from the series files
+// of many fingerprints at once. In contrast to loadChunks, the indexes are not
+// shifted by an offset. The fingerprints are processed in the order of their
+// series files, and the indexes per fingerprint are sorted in place, so that
+// each file is read front to back, sharing the buffers in bufPool. The
+// returned chunks are in the order of the sorted indexes. It is the caller's
+// responsibility to not persist or drop anything for the same fingerprints
+// concurrently.
+func (p *persistence) loadChunksBatch(fpToIndexes map[clientmodel.Fingerprint][]int) (map[clientmodel.Fingerprint][]chunk, error) {
+	fps := make(clientmodel.Fingerprints, 0, len(fpToIndexes))
+	for fp := range fpToIndexes {
+		fps = append(fps, fp)
+	}
+	// The file name is the hex representation of the fingerprint, so the
+	// numerical order of fingerprints is also the order of their files.
+	sort.Sort(fps)
+
+	fpToChunks := make(map[clientmodel.Fingerprint][]chunk, len(fps))
+	numLoaded := 0
+	for _, fp := range fps {
+		indexes := fpToIndexes[fp]
+		sort.Ints(indexes)
+		chunks, err := p.loadChunks(fp, indexes, 0)
+		if err != nil {
+			// The chunks loaded so far will never be used.
+			atomic.AddInt64(&numMemChunks, int64(-numLoaded))
+			return nil, err
+		}
+		fpToChunks[fp] = chunks
+		numLoaded += len(chunks)
+	}
+	return fpToChunks, nil
+}
+
 // loadChunkDescs loads chunkDescs for a series up until a given time.  It is
 // the caller's responsibility to not persist or drop anything for the same
 // fingerprint concurrently.
 func (p *persistence) loadChunkDescs(fp clientmodel.Fingerprint, beforeTime clientmodel.Timestamp) ([]*chunkDesc, error) {
+	if p.mmapSeriesFiles {
+		return p.loadChunkDescsMapped(fp, beforeTime)
+	}
 	f, err := p.openChunkFileForReading(fp)
 	if os.IsNotExist(err) {
 		return nil, nil
@@ -441,19 +721,19 @@ func (p *persistence) loadChunkDescs(fp clientmodel.Fingerprint, beforeTime clie
 	if err != nil {
 		return nil, err
 	}
-	if fi.Size()%int64(chunkLenWithHeader) != 0 {
+	if fi.Size()%int64(p.chunkRecordLen()) != 0 {
 		p.setDirty(true)
 		return nil, fmt.Errorf(
 			"size of series file for fingerprint %v is %d, which is not a multiple of the chunk length %d",
-			fp, fi.Size(), chunkLenWithHeader,
+			fp, fi.Size(), p.chunkRecordLen(),
 		)
 	}
 
-	numChunks := int(fi.Size()) / chunkLenWithHeader
+	numChunks := int(fi.Size()) / p.chunkRecordLen()
 	cds := make([]*chunkDesc, 0, numChunks)
 	chunkTimesBuf := make([]byte, 16)
 	for i := 0; i < numChunks; i++ {
-		_, err := f.Seek(offsetForChunkIndex(i)+chunkHeaderFirstTimeOffset, os.SEEK_SET)
+		_, err := f.Seek(p.offsetForChunkIndex(i)+chunkHeaderFirstTimeOffset, os.SEEK_SET)
 		if err != nil {
 			return nil, err
 		}
@@ -477,20 +757,78 @@ func (p *persistence) loadChunkDescs(fp clientmodel.Fingerprint, beforeTime clie
 	return cds, nil
 }
 
+// loadChunkDescsFromTail loads chunkDescs for the chunks in the series file
+// preceding the chunk with index endIndex. Going backwards from the most
+// recent of them, it stops after loading the first chunkDesc whose chunk
+// starts at or before the given time. Thus, unlike loadChunkDescs, it does
+// not read the headers of all the older chunks. The chunkDescs are returned in
+// the order of the series file. It is the caller's responsibility to not
+// persist or drop anything for the same fingerprint concurrently.
+func (p *persistence) loadChunkDescsFromTail(fp clientmodel.Fingerprint, endIndex int, from clientmodel.Timestamp) ([]*chunkDesc, error) {
+	f, err := p.openChunkFileForReading(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() < p.offsetForChunkIndex(endIndex) {
+		p.setDirty(true)
+		return nil, fmt.Errorf(
+			"series file for fingerprint %v has %d bytes, too few for %d chunks",
+			fp, fi.Size(), endIndex,
+		)
+	}
+
+	cds := []*chunkDesc{}
+	chunkTimesBuf := make([]byte, 16)
+	for i := endIndex - 1; i >= 0; i-- {
+		if _, err := f.ReadAt(chunkTimesBuf, p.offsetForChunkIndex(i)+chunkHeaderFirstTimeOffset); err != nil {
+			return nil, err
+		}
+		cd := &chunkDesc{
+			chunkFirstTime: clientmodel.Timestamp(binary.LittleEndian.Uint64(chunkTimesBuf)),
+			chunkLastTime:  clientmodel.Timestamp(binary.LittleEndian.Uint64(chunkTimesBuf[8:])),
+		}
+		cds = append(cds, cd)
+		if !cd.chunkFirstTime.After(from) {
+			break
+		}
+	}
+	for i, j := 0, len(cds)-1; i < j; i, j = i+1, j-1 {
+		cds[i], cds[j] = cds[j], cds[i]
+	}
+	chunkDescOps.WithLabelValues(load).Add(float64(len(cds)))
+	numMemChunkDescs.Add(float64(len(cds)))
+	return cds, nil
+}
+
 // checkpointSeriesMapAndHeads persists the fingerprint to memory-series mapping
 // and all non persisted chunks. Do not call concurrently with
-// loadSeriesMapAndHeads. This method will only write heads format v2, but
-// loadSeriesMapAndHeads can also understand v1.
+// loadSeriesMapAndHeads. This method will only write heads format v2 (or v3 if
+// checkpoint compression is enabled), but loadSeriesMapAndHeads can also
+// understand v1.
+//
+// Only the first checkpoint after start-up rewrites the heads file completely.
+// Later checkpoints only append the series changed in the meantime to the
+// incremental heads file (see checkpointIncremental) until that file has grown
+// as large as the heads file, upon which a full checkpoint is written again.
 //
-// Description of the file format (for both, v1 and v2):
+// Description of the file format (for v1, v2, and v3):
 //
 // (1) Magic string (const headsMagicString).
 //
-// (2) Varint-encoded format version (const headsFormatVersion).
+// (2) Varint-encoded format version (const headsFormatVersion or
+// headsFormatCompressedVersion).
 //
 // (3) Number of series in checkpoint as big-endian uint64.
 //
-// (4) Repeated once per series:
+// (3.1) A byte defining the Compression of item (4). (Only present in v3.)
+//
+// (4) Repeated once per series, compressed as a whole in v3:
 //
 // (4.1) A flag byte, see flag constants above. (Present but unused in v2.)
 //
@@ -521,16 +859,47 @@ func (p *persistence) loadChunkDescs(fp clientmodel.Fingerprint, beforeTime clie
 // (4.8.2.1) A byte defining the chunk type.
 // (4.8.2.2) The chunk itself, marshaled with the marshal() method.
 //
+// If the storage is encrypted, each series is instead written as its
+// uvarint-encoded length, followed by a GCM nonce and items (4.1) to (4.8)
+// sealed with the storage key (see writeCheckpointedSeries). In v3, the series
+// are written in plain instead, but the compressed stream of them is sealed in
+// frames (see sealedWriter), so that compression is still effective.
+//
 func (p *persistence) checkpointSeriesMapAndHeads(fingerprintToSeries *seriesMap, fpLocker *fingerprintLocker) (err error) {
+	p.checkpointMtx.Lock()
+	defer p.checkpointMtx.Unlock()
+
+	defer func(begin time.Time) {
+		if err == nil {
+			atomic.StoreInt64(&p.lastCheckpointDuration, int64(time.Since(begin)))
+			atomic.StoreInt64(&p.lastCheckpointEnd, time.Now().UnixNano())
+		}
+	}(time.Now())
+
+	if p.fullCheckpointDone && !p.incrementalCheckpointTooLarge() {
+		return p.checkpointIncremental(fingerprintToSeries, fpLocker)
+	}
+
 	glog.Info("Checkpointing in-memory metrics and chunks...")
 	begin := time.Now()
+	// Start a new WAL segment. Everything logged before is covered by
+	// this checkpoint, so the older segments can go once it is complete.
+	var walSegment int
+	if p.wal != nil {
+		if walSegment, err = p.wal.rotate(); err != nil {
+			return
+		}
+	}
+	// Everything removed so far will be missing from the full checkpoint.
+	p.takeRemovedFPs()
 	f, err := os.OpenFile(p.headsTempFileName(), os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0640)
 	if err != nil {
 		return
 	}
 
 	defer func() {
-		f.Sync()
+		p.syncFile(f)
+		p.evictFromPageCache(f)
 		closeErr := f.Close()
 		if err != nil {
 			return
@@ -540,18 +909,34 @@ func (p *persistence) checkpointSeriesMapAndHeads(fingerprintToSeries *seriesMap
 			return
 		}
 		err = os.Rename(p.headsTempFileName(), p.headsFileName())
+		if err != nil {
+			return
+		}
+		// The incremental checkpoint refers to the previous heads file.
+		if err = os.Remove(p.headsIncrementalFileName()); err != nil && !os.IsNotExist(err) {
+			return
+		}
+		err = nil
+		p.fullCheckpointDone = true
+		if p.wal != nil {
+			err = p.wal.removeSegmentsBefore(walSegment)
+		}
 		duration := time.Since(begin)
 		p.checkpointDuration.Set(float64(duration) / float64(time.Millisecond))
 		glog.Infof("Done checkpointing in-memory metrics and chunks in %v.", duration)
 	}()
 
-	w := bufio.NewWriterSize(f, fileBufSize)
+	w := bufio.NewWriterSize(p.ioThrottle.writer(f), fileBufSize)
 
 	if _, err = w.WriteString(headsMagicString); err != nil {
 		return
 	}
+	version := int64(headsFormatVersion)
+	if p.checkpointCompression != NoCompression {
+		version = headsFormatCompressedVersion
+	}
 	var numberOfSeriesOffset int
-	if numberOfSeriesOffset, err = codable.EncodeVarint(w, headsFormatVersion); err != nil {
+	if numberOfSeriesOffset, err = codable.EncodeVarint(w, version); err != nil {
 		return
 	}
 	numberOfSeriesOffset += len(headsMagicString)
@@ -561,6 +946,21 @@ func (p *persistence) checkpointSeriesMapAndHeads(fingerprintToSeries *seriesMap
 	if err = codable.EncodeUint64(w, numberOfSeriesInHeader); err != nil {
 		return
 	}
+	// The series are written to sw, which compresses them into w if needed.
+	// With encryption, the compressed data is sealed by sealer.
+	sw := w
+	var sealer, cw io.WriteCloser = nopWriteCloser{w}, nopWriteCloser{w}
+	sealedStream := version == headsFormatCompressedVersion && p.aead != nil
+	if version == headsFormatCompressedVersion {
+		if err = w.WriteByte(byte(p.checkpointCompression)); err != nil {
+			return
+		}
+		if sealedStream {
+			sealer = p.newSealedWriter(w)
+		}
+		cw = p.checkpointCompression.newWriter(sealer)
+		sw = bufio.NewWriterSize(cw, fileBufSize)
+	}
 
 	iter := fingerprintToSeries.iter()
 	defer func() {
@@ -580,65 +980,25 @@ func (p *persistence) checkpointSeriesMapAndHeads(fingerprintToSeries *seriesMap
 				return
 			}
 			realNumberOfSeries++
-			// seriesFlags left empty in v2.
-			if err = w.WriteByte(0); err != nil {
-				return
-			}
-			if err = codable.EncodeUint64(w, uint64(m.fp)); err != nil {
-				return
-			}
-			var buf []byte
-			buf, err = codable.Metric(m.series.metric).MarshalBinary()
-			if err != nil {
-				return
-			}
-			w.Write(buf)
-			if _, err = codable.EncodeVarint(w, int64(m.series.persistWatermark)); err != nil {
-				return
-			}
-			if m.series.modTime.IsZero() {
-				if _, err = codable.EncodeVarint(w, -1); err != nil {
-					return
-				}
+			if sealedStream {
+				err = writeSeriesCheckpoint(sw, m.fp, m.series)
 			} else {
-				if _, err = codable.EncodeVarint(w, m.series.modTime.UnixNano()); err != nil {
-					return
-				}
-			}
-			if _, err = codable.EncodeVarint(w, int64(m.series.chunkDescsOffset)); err != nil {
-				return
-			}
-			if _, err = codable.EncodeVarint(w, int64(m.series.savedFirstTime)); err != nil {
-				return
-			}
-			if _, err = codable.EncodeVarint(w, int64(len(m.series.chunkDescs))); err != nil {
-				return
+				err = p.writeCheckpointedSeries(sw, m.fp, m.series)
 			}
-			for i, chunkDesc := range m.series.chunkDescs {
-				if i < m.series.persistWatermark {
-					if _, err = codable.EncodeVarint(w, int64(chunkDesc.firstTime())); err != nil {
-						return
-					}
-					if _, err = codable.EncodeVarint(w, int64(chunkDesc.lastTime())); err != nil {
-						return
-					}
-				} else {
-					// This is the non-persisted head chunk. Fully marshal it.
-					if err = w.WriteByte(byte(chunkDesc.chunk.encoding())); err != nil {
-						return
-					}
-					if err = chunkDesc.chunk.marshal(w); err != nil {
-						return
-					}
-				}
-			}
-			// Series is checkpointed now, so declare it clean.
-			m.series.dirty = false
 		}()
 		if err != nil {
 			return
 		}
 	}
+	if err = sw.Flush(); err != nil {
+		return
+	}
+	if err = cw.Close(); err != nil {
+		return
+	}
+	if err = sealer.Close(); err != nil {
+		return
+	}
 	if err = w.Flush(); err != nil {
 		return
 	}
@@ -655,6 +1015,67 @@ func (p *persistence) checkpointSeriesMapAndHeads(fingerprintToSeries *seriesMap
 	return
 }
 
+// writeSeriesCheckpoint writes the given series in the format described for
+// checkpointSeriesMapAndHeads, items (4.1) to (4.8), and declares the series
+// clean. The caller must have locked the fingerprint.
+func writeSeriesCheckpoint(w *bufio.Writer, fp clientmodel.Fingerprint, series *memorySeries) error {
+	// seriesFlags left empty in v2.
+	if err := w.WriteByte(0); err != nil {
+		return err
+	}
+	if err := codable.EncodeUint64(w, uint64(fp)); err != nil {
+		return err
+	}
+	buf, err := codable.Metric(series.metric).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	w.Write(buf)
+	if _, err := codable.EncodeVarint(w, int64(series.persistWatermark)); err != nil {
+		return err
+	}
+	if series.modTime.IsZero() {
+		if _, err := codable.EncodeVarint(w, -1); err != nil {
+			return err
+		}
+	} else {
+		if _, err := codable.EncodeVarint(w, series.modTime.UnixNano()); err != nil {
+			return err
+		}
+	}
+	if _, err := codable.EncodeVarint(w, int64(series.chunkDescsOffset)); err != nil {
+		return err
+	}
+	if _, err := codable.EncodeVarint(w, int64(series.savedFirstTime)); err != nil {
+		return err
+	}
+	if _, err := codable.EncodeVarint(w, int64(len(series.chunkDescs))); err != nil {
+		return err
+	}
+	for i, chunkDesc := range series.chunkDescs {
+		if i < series.persistWatermark {
+			if _, err := codable.EncodeVarint(w, int64(chunkDesc.firstTime())); err != nil {
+				return err
+			}
+			if _, err := codable.EncodeVarint(w, int64(chunkDesc.lastTime())); err != nil {
+				return err
+			}
+		} else {
+			// This is the non-persisted head chunk. Fully marshal it.
+			if err := w.WriteByte(byte(chunkDesc.chunk.encoding())); err != nil {
+				return err
+			}
+			if err := chunkDesc.chunk.marshal(w); err != nil {
+				return err
+			}
+		}
+	}
+	// Series is checkpointed now, so declare it clean.
+	series.dirty = false
+	series.checkpointed = series.checkpointState()
+	return nil
+}
+
 // loadSeriesMapAndHeads loads the fingerprint to memory-series mapping and all
 // the chunks contained in the checkpoint (and thus not yet persisted to series
 // files). The method is capable of loading the checkpoint format v1 and v2. If
@@ -664,26 +1085,46 @@ func (p *persistence) checkpointSeriesMapAndHeads(fingerprintToSeries *seriesMap
 // start-up while nothing else is running in storage land. This method is
 // utterly goroutine-unsafe.
 func (p *persistence) loadSeriesMapAndHeads() (sm *seriesMap, chunksToPersist int64, err error) {
-	var chunkDescsTotal int64
 	fingerprintToSeries := make(map[clientmodel.Fingerprint]*memorySeries)
-	sm = &seriesMap{m: fingerprintToSeries}
 
-	defer func() {
-		if sm != nil && p.dirty {
-			glog.Warning("Persistence layer appears dirty.")
-			err = p.recoverFromCrash(fingerprintToSeries)
-			if err != nil {
-				sm = nil
+	// headsLoaded is set once the checkpoint has been read completely (or
+	// if there is none), so that the WAL can be applied on top of it.
+	chunksToPersist, chunkDescsTotal, headsLoaded := p.loadHeads(fingerprintToSeries)
+
+	if p.dirty {
+		glog.Warning("Persistence layer appears dirty.")
+		var changedFPs map[clientmodel.Fingerprint]struct{}
+		if headsLoaded {
+			if changedFPs, err = p.seriesChangedInWAL(); err != nil {
+				return nil, chunksToPersist, err
 			}
 		}
-		if err == nil {
-			numMemChunkDescs.Add(float64(chunkDescsTotal))
+		if changedFPs != nil {
+			err = p.recoverFromWAL(fingerprintToSeries, changedFPs)
+		} else {
+			err = p.recoverFromCrash(fingerprintToSeries)
 		}
-	}()
+		if err != nil {
+			return nil, chunksToPersist, err
+		}
+		p.recoveredFromCrash = true
+	}
+	numMemChunkDescs.Add(float64(chunkDescsTotal))
+	return newSeriesMapFrom(fingerprintToSeries), chunksToPersist, nil
+}
 
+// loadHeads reads the checkpoint written by checkpointSeriesMapAndHeads,
+// including the incremental heads file, into the provided map. It returns the
+// number of chunks not persisted yet, the total number of chunkDescs loaded,
+// and whether the checkpoint has been read completely (or there is none). If
+// the checkpoint is unreadable or corrupt, p.dirty is set, and the map contains
+// the series read so far. loadHeads does not modify anything on disk.
+func (p *persistence) loadHeads(
+	fingerprintToSeries map[clientmodel.Fingerprint]*memorySeries,
+) (chunksToPersist, chunkDescsTotal int64, headsLoaded bool) {
 	f, err := os.Open(p.headsFileName())
 	if os.IsNotExist(err) {
-		return sm, 0, nil
+		return 0, 0, true
 	}
 	if err != nil {
 		glog.Warning("Could not open heads file:", err)
@@ -697,7 +1138,7 @@ func (p *persistence) loadSeriesMapAndHeads() (sm *seriesMap, chunksToPersist in
 	if _, err := io.ReadFull(r, buf); err != nil {
 		glog.Warning("Could not read from heads file:", err)
 		p.dirty = true
-		return sm, 0, nil
+		return
 	}
 	magic := string(buf)
 	if magic != headsMagicString {
@@ -709,134 +1150,162 @@ func (p *persistence) loadSeriesMapAndHeads() (sm *seriesMap, chunksToPersist in
 		return
 	}
 	version, err := binary.ReadVarint(r)
-	if (version != headsFormatVersion && version != headsFormatLegacyVersion) || err != nil {
+	if (version != headsFormatVersion && version != headsFormatLegacyVersion && version != headsFormatCompressedVersion) || err != nil {
 		glog.Warningf("unknown heads format version, want %d", headsFormatVersion)
 		p.dirty = true
-		return sm, 0, nil
+		return
 	}
 	numSeries, err := codable.DecodeUint64(r)
 	if err != nil {
 		glog.Warning("Could not decode number of series:", err)
 		p.dirty = true
-		return sm, 0, nil
+		return
 	}
-
-	for ; numSeries > 0; numSeries-- {
-		seriesFlags, err := r.ReadByte()
+	sealedStream := version == headsFormatCompressedVersion && p.aead != nil
+	if version == headsFormatCompressedVersion {
+		compression, err := r.ReadByte()
 		if err != nil {
-			glog.Warning("Could not read series flags:", err)
+			glog.Warning("Could not read heads compression:", err)
 			p.dirty = true
-			return sm, chunksToPersist, nil
+			return
 		}
-		headChunkPersisted := seriesFlags&flagHeadChunkPersisted != 0
-		fp, err := codable.DecodeUint64(r)
-		if err != nil {
-			glog.Warning("Could not decode fingerprint:", err)
-			p.dirty = true
-			return sm, chunksToPersist, nil
+		var sr io.Reader = r
+		if sealedStream {
+			sr = p.newSealedReader(r)
 		}
-		var metric codable.Metric
-		if err := metric.UnmarshalFromReader(r); err != nil {
-			glog.Warning("Could not decode metric:", err)
+		cr, err := Compression(compression).newReader(sr)
+		if err != nil {
+			glog.Warning("Could not decompress heads file:", err)
 			p.dirty = true
-			return sm, chunksToPersist, nil
+			return
 		}
-		var persistWatermark int64
-		var modTime time.Time
-		if version != headsFormatLegacyVersion {
-			// persistWatermark only present in v2.
-			persistWatermark, err = binary.ReadVarint(r)
-			if err != nil {
-				glog.Warning("Could not decode persist watermark:", err)
-				p.dirty = true
-				return sm, chunksToPersist, nil
-			}
-			modTimeNano, err := binary.ReadVarint(r)
-			if err != nil {
-				glog.Warning("Could not decode modification time:", err)
-				p.dirty = true
-				return sm, chunksToPersist, nil
-			}
-			if modTimeNano != -1 {
-				modTime = time.Unix(0, modTimeNano)
-			}
+		r = bufio.NewReaderSize(cr, fileBufSize)
+	}
+
+	for ; numSeries > 0; numSeries-- {
+		var (
+			fp     clientmodel.Fingerprint
+			series *memorySeries
+			err    error
+		)
+		if sealedStream {
+			fp, series, err = readSeriesCheckpoint(r, version)
+		} else {
+			fp, series, err = p.readCheckpointedSeries(r, version)
 		}
-		chunkDescsOffset, err := binary.ReadVarint(r)
 		if err != nil {
-			glog.Warning("Could not decode chunk descriptor offset:", err)
+			glog.Warning(err)
 			p.dirty = true
-			return sm, chunksToPersist, nil
+			return
 		}
-		savedFirstTime, err := binary.ReadVarint(r)
+		chunkDescsTotal += int64(series.persistWatermark)
+		chunksToPersist += int64(len(series.chunkDescs) - series.persistWatermark)
+		fingerprintToSeries[fp] = series
+	}
+	headsLoaded = true
+
+	fi, err := f.Stat()
+	if err != nil {
+		glog.Warning("Could not stat heads file:", err)
+		p.dirty = true
+		return
+	}
+	incChunksToPersist, incChunkDescsTotal := p.loadHeadsIncremental(fingerprintToSeries, fi)
+	chunksToPersist += incChunksToPersist
+	chunkDescsTotal += incChunkDescsTotal
+	return
+}
+
+// readSeriesCheckpoint reads a series written in the given heads format
+// version, see checkpointSeriesMapAndHeads, items (4.1) to (4.8).
+func readSeriesCheckpoint(r *bufio.Reader, version int64) (clientmodel.Fingerprint, *memorySeries, error) {
+	seriesFlags, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, fmt.Errorf("could not read series flags: %s", err)
+	}
+	headChunkPersisted := seriesFlags&flagHeadChunkPersisted != 0
+	fp, err := codable.DecodeUint64(r)
+	if err != nil {
+		return 0, nil, fmt.Errorf("could not decode fingerprint: %s", err)
+	}
+	var metric codable.Metric
+	if err := metric.UnmarshalFromReader(r); err != nil {
+		return 0, nil, fmt.Errorf("could not decode metric: %s", err)
+	}
+	var persistWatermark int64
+	var modTime time.Time
+	if version != headsFormatLegacyVersion {
+		// persistWatermark only present in v2.
+		persistWatermark, err = binary.ReadVarint(r)
 		if err != nil {
-			glog.Warning("Could not decode saved first time:", err)
-			p.dirty = true
-			return sm, chunksToPersist, nil
+			return 0, nil, fmt.Errorf("could not decode persist watermark: %s", err)
 		}
-		numChunkDescs, err := binary.ReadVarint(r)
+		modTimeNano, err := binary.ReadVarint(r)
 		if err != nil {
-			glog.Warning("Could not decode number of chunk descriptors:", err)
-			p.dirty = true
-			return sm, chunksToPersist, nil
+			return 0, nil, fmt.Errorf("could not decode modification time: %s", err)
 		}
-		chunkDescs := make([]*chunkDesc, numChunkDescs)
-		if version == headsFormatLegacyVersion {
-			if headChunkPersisted {
-				persistWatermark = numChunkDescs
-			} else {
-				persistWatermark = numChunkDescs - 1
-			}
+		if modTimeNano != -1 {
+			modTime = time.Unix(0, modTimeNano)
 		}
-
-		for i := int64(0); i < numChunkDescs; i++ {
-			if i < persistWatermark {
-				firstTime, err := binary.ReadVarint(r)
-				if err != nil {
-					glog.Warning("Could not decode first time:", err)
-					p.dirty = true
-					return sm, chunksToPersist, nil
-				}
-				lastTime, err := binary.ReadVarint(r)
-				if err != nil {
-					glog.Warning("Could not decode last time:", err)
-					p.dirty = true
-					return sm, chunksToPersist, nil
-				}
-				chunkDescs[i] = &chunkDesc{
-					chunkFirstTime: clientmodel.Timestamp(firstTime),
-					chunkLastTime:  clientmodel.Timestamp(lastTime),
-				}
-				chunkDescsTotal++
-			} else {
-				// Non-persisted chunk.
-				encoding, err := r.ReadByte()
-				if err != nil {
-					glog.Warning("Could not decode chunk type:", err)
-					p.dirty = true
-					return sm, chunksToPersist, nil
-				}
-				chunk := newChunkForEncoding(chunkEncoding(encoding))
-				if err := chunk.unmarshal(r); err != nil {
-					glog.Warning("Could not decode chunk:", err)
-					p.dirty = true
-					return sm, chunksToPersist, nil
-				}
-				chunkDescs[i] = newChunkDesc(chunk)
-				chunksToPersist++
-			}
+	}
+	chunkDescsOffset, err := binary.ReadVarint(r)
+	if err != nil {
+		return 0, nil, fmt.Errorf("could not decode chunk descriptor offset: %s", err)
+	}
+	savedFirstTime, err := binary.ReadVarint(r)
+	if err != nil {
+		return 0, nil, fmt.Errorf("could not decode saved first time: %s", err)
+	}
+	numChunkDescs, err := binary.ReadVarint(r)
+	if err != nil {
+		return 0, nil, fmt.Errorf("could not decode number of chunk descriptors: %s", err)
+	}
+	chunkDescs := make([]*chunkDesc, numChunkDescs)
+	if version == headsFormatLegacyVersion {
+		if headChunkPersisted {
+			persistWatermark = numChunkDescs
+		} else {
+			persistWatermark = numChunkDescs - 1
 		}
+	}
 
-		fingerprintToSeries[clientmodel.Fingerprint(fp)] = &memorySeries{
-			metric:           clientmodel.Metric(metric),
-			chunkDescs:       chunkDescs,
-			persistWatermark: int(persistWatermark),
-			modTime:          modTime,
-			chunkDescsOffset: int(chunkDescsOffset),
-			savedFirstTime:   clientmodel.Timestamp(savedFirstTime),
-			headChunkClosed:  persistWatermark >= numChunkDescs,
+	for i := int64(0); i < numChunkDescs; i++ {
+		if i < persistWatermark {
+			firstTime, err := binary.ReadVarint(r)
+			if err != nil {
+				return 0, nil, fmt.Errorf("could not decode first time: %s", err)
+			}
+			lastTime, err := binary.ReadVarint(r)
+			if err != nil {
+				return 0, nil, fmt.Errorf("could not decode last time: %s", err)
+			}
+			chunkDescs[i] = &chunkDesc{
+				chunkFirstTime: clientmodel.Timestamp(firstTime),
+				chunkLastTime:  clientmodel.Timestamp(lastTime),
+			}
+		} else {
+			// Non-persisted chunk.
+			encoding, err := r.ReadByte()
+			if err != nil {
+				return 0, nil, fmt.Errorf("could not decode chunk type: %s", err)
+			}
+			chunk := newChunkForEncoding(ChunkEncoding(encoding))
+			if err := chunk.unmarshal(r); err != nil {
+				return 0, nil, fmt.Errorf("could not decode chunk: %s", err)
+			}
+			chunkDescs[i] = newChunkDesc(chunk)
 		}
 	}
-	return sm, chunksToPersist, nil
+
+	return clientmodel.Fingerprint(fp), &memorySeries{
+		metric:           clientmodel.Metric(metric),
+		chunkDescs:       chunkDescs,
+		persistWatermark: int(persistWatermark),
+		modTime:          modTime,
+		chunkDescsOffset: int(chunkDescsOffset),
+		savedFirstTime:   clientmodel.Timestamp(savedFirstTime),
+		headChunkClosed:  persistWatermark >= numChunkDescs,
+	}, nil
 }
 
 // dropAndPersistChunks deletes all chunks from a series file whose last sample
@@ -856,17 +1325,43 @@ func (p *persistence) dropAndPersistChunks(
 	numDropped int,
 	allDropped bool,
 	err error,
+) {
+	return p.dropAndPersistChunksKeepingRollups(fp, beforeTime, beforeTime, chunks)
+}
+
+// dropAndPersistChunksKeepingRollups works like dropAndPersistChunks but only
+// drops the rollups before rollupsBefore, which must not be after beforeTime.
+// That is needed if chunks are dropped because they have been moved to the
+// cold tier, while their rollups are still within the retention period.
+func (p *persistence) dropAndPersistChunksKeepingRollups(
+	fp clientmodel.Fingerprint, beforeTime, rollupsBefore clientmodel.Timestamp, chunks []chunk,
+) (
+	firstTimeNotDropped clientmodel.Timestamp,
+	offset int,
+	numDropped int,
+	allDropped bool,
+	err error,
 ) {
 	// Style note: With the many return values, it was decided to use naked
 	// returns in this method. They make the method more readable, but
 	// please handle with care!
 	defer func() {
+		if err == nil && (numDropped > 0 || allDropped) {
+			// Rollups are not needed for crash recovery, so failing
+			// to drop them does not render the storage dirty.
+			if rollupErr := p.dropRollupsBefore(fp, rollupsBefore); rollupErr != nil {
+				glog.Errorf("Error dropping rollups for fingerprint %v: %v", fp, rollupErr)
+			}
+		}
 		if err != nil {
 			glog.Error("Error dropping and/or persisting chunks: ", err)
 			p.setDirty(true)
 		}
 	}()
 
+	p.logSeriesChange(fp)
+	// Dropping chunks changes the index of the remaining ones.
+	defer p.invalidateChunkCache(fp)
 	if len(chunks) > 0 {
 		// We have chunks to persist. First check if those are already
 		// too old. If that's the case, the chunks in the series file
@@ -913,7 +1408,7 @@ func (p *persistence) dropAndPersistChunks(
 
 	// Find the first chunk in the file that should be kept.
 	for ; ; numDropped++ {
-		_, err = f.Seek(offsetForChunkIndex(numDropped), os.SEEK_SET)
+		_, err = f.Seek(p.offsetForChunkIndex(numDropped), os.SEEK_SET)
 		if err != nil {
 			return
 		}
@@ -974,20 +1469,33 @@ func (p *persistence) dropAndPersistChunks(
 		}
 	}()
 
-	written, err := io.Copy(temp, f)
+	written, err := io.Copy(p.ioThrottle.writer(temp), p.ioThrottle.reader(f))
 	if err != nil {
 		return
 	}
-	offset = int(written / chunkLenWithHeader)
+	offset = int(written / int64(p.chunkRecordLen()))
 
 	if len(chunks) > 0 {
-		if err = writeChunks(temp, chunks); err != nil {
+		if err = p.writeChunks(p.ioThrottle.writer(temp), chunks); err != nil {
 			return
 		}
 	}
 	return
 }
 
+// seriesFileSize returns the size of the series file of the given fingerprint,
+// or 0 if there is none.
+func (p *persistence) seriesFileSize(fp clientmodel.Fingerprint) (int64, error) {
+	fi, err := os.Stat(p.fileNameForFingerprint(fp))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
 // deleteSeriesFile deletes a series file belonging to the provided
 // fingerprint. It returns the number of chunks that were contained in the
 // deleted file.
@@ -1001,7 +1509,9 @@ func (p *persistence) deleteSeriesFile(fp clientmodel.Fingerprint) (int, error)
 	if err != nil {
 		return -1, err
 	}
-	numChunks := int(fi.Size() / chunkLenWithHeader)
+	numChunks := int(fi.Size() / int64(p.chunkRecordLen()))
+	p.logSeriesChange(fp)
+	p.invalidateChunkCache(fp)
 	if err := os.Remove(fname); err != nil {
 		return -1, err
 	}
@@ -1039,10 +1549,10 @@ func (p *persistence) unindexMetric(fp clientmodel.Fingerprint, m clientmodel.Me
 	p.indexingQueue <- indexingOp{fp, m, remove}
 }
 
-// waitForIndexing waits until all items in the indexing queue are processed. If
-// queue processing is currently on hold (to gather more ops for batching), this
-// method will trigger an immediate start of processing. This method is
-// goroutine-safe.
+// waitForIndexing waits until all items in the indexing queue are processed and
+// all pending changes of the archive indexes are committed. If queue processing
+// is currently on hold (to gather more ops for batching), this method will
+// trigger an immediate start of processing. This method is goroutine-safe.
 func (p *persistence) waitForIndexing() {
 	wait := make(chan int)
 	for {
@@ -1053,20 +1563,18 @@ func (p *persistence) waitForIndexing() {
 	}
 }
 
-// archiveMetric persists the mapping of the given fingerprint to the given
-// metric, together with the first and last timestamp of the series belonging to
-// the metric. The caller must have locked the fingerprint.
+// archiveMetric queues the mapping of the given fingerprint to the given metric,
+// together with the first and last timestamp of the series belonging to the
+// metric, for persisting with the next archive batch. Lookups take it into
+// account right away. The caller must have locked the fingerprint.
 func (p *persistence) archiveMetric(
 	fp clientmodel.Fingerprint, m clientmodel.Metric, first, last clientmodel.Timestamp,
 ) error {
-	if err := p.archivedFingerprintToMetrics.Put(codable.Fingerprint(fp), codable.Metric(m)); err != nil {
-		p.setDirty(true)
-		return err
-	}
-	if err := p.archivedFingerprintToTimeRange.Put(codable.Fingerprint(fp), codable.TimeRange{First: first, Last: last}); err != nil {
-		p.setDirty(true)
-		return err
+	p.logSeriesChange(fp)
+	if p.archivedFilter != nil {
+		p.archivedFilter.add(fp)
 	}
+	p.archiveBatch.put(fp, archiveOp{hasMetric: true, metric: m, first: first, last: last})
 	return nil
 }
 
@@ -1076,23 +1584,58 @@ func (p *persistence) archiveMetric(
 func (p *persistence) hasArchivedMetric(fp clientmodel.Fingerprint) (
 	hasMetric bool, firstTime, lastTime clientmodel.Timestamp, err error,
 ) {
+	if !p.mayBeArchived(fp) {
+		return
+	}
+	if first, last, has, ok := p.archiveBatch.timeRange(fp); ok {
+		return has, first, last, nil
+	}
 	firstTime, lastTime, hasMetric, err = p.archivedFingerprintToTimeRange.Lookup(fp)
 	return
 }
 
+// mayBeArchived returns false if the given fingerprint is definitely not
+// archived, according to the bloom filter over archived fingerprints (if
+// enabled). Looking it up in the archive indexes can then be skipped. This
+// method is goroutine-safe.
+func (p *persistence) mayBeArchived(fp clientmodel.Fingerprint) bool {
+	return p.archivedFilter == nil || p.archivedFilter.mayContain(fp)
+}
+
+// loadArchivedFilter enables the bloom filter over archived fingerprints with
+// the given size in bytes and fills it from the archive indexes. Call it
+// during start-up before anything is archived or looked up.
+func (p *persistence) loadArchivedFilter(sizeBytes int) error {
+	if err := p.commitArchiveBatch(); err != nil {
+		return err
+	}
+	f := newFingerprintFilter(sizeBytes)
+	count, err := f.addFromIndex(p.archivedFingerprintToTimeRange)
+	if err != nil {
+		return err
+	}
+	glog.Infof("Added %d archived fingerprints to the bloom filter.", count)
+	p.archivedFilter = f
+	return nil
+}
+
 // updateArchivedTimeRange updates an archived time range. The caller must make
 // sure that the fingerprint is currently archived (the time range will
 // otherwise be added without the corresponding metric in the archive).
 func (p *persistence) updateArchivedTimeRange(
 	fp clientmodel.Fingerprint, first, last clientmodel.Timestamp,
 ) error {
-	return p.archivedFingerprintToTimeRange.Put(codable.Fingerprint(fp), codable.TimeRange{First: first, Last: last})
+	p.archiveBatch.put(fp, archiveOp{first: first, last: last})
+	return nil
 }
 
 // getFingerprintsModifiedBefore returns the fingerprints of archived timeseries
 // that have live samples before the provided timestamp. This method is
 // goroutine-safe.
 func (p *persistence) getFingerprintsModifiedBefore(beforeTime clientmodel.Timestamp) ([]clientmodel.Fingerprint, error) {
+	if err := p.commitArchiveBatch(); err != nil {
+		return nil, err
+	}
 	var fp codable.Fingerprint
 	var tr codable.TimeRange
 	fps := []clientmodel.Fingerprint{}
@@ -1114,6 +1657,12 @@ func (p *persistence) getFingerprintsModifiedBefore(beforeTime clientmodel.Times
 // getArchivedMetric retrieves the archived metric with the given
 // fingerprint. This method is goroutine-safe.
 func (p *persistence) getArchivedMetric(fp clientmodel.Fingerprint) (clientmodel.Metric, error) {
+	if !p.mayBeArchived(fp) {
+		return nil, nil
+	}
+	if metric, ok := p.archiveBatch.metric(fp); ok {
+		return metric, nil
+	}
 	metric, _, err := p.archivedFingerprintToMetrics.Lookup(fp)
 	return metric, err
 }
@@ -1133,20 +1682,8 @@ func (p *persistence) purgeArchivedMetric(fp clientmodel.Fingerprint) (err error
 	if err != nil || metric == nil {
 		return err
 	}
-	deleted, err := p.archivedFingerprintToMetrics.Delete(codable.Fingerprint(fp))
-	if err != nil {
-		return err
-	}
-	if !deleted {
-		glog.Errorf("Tried to delete non-archived fingerprint %s from archivedFingerprintToMetrics index. This should never happen.", fp)
-	}
-	deleted, err = p.archivedFingerprintToTimeRange.Delete(codable.Fingerprint(fp))
-	if err != nil {
-		return err
-	}
-	if !deleted {
-		glog.Errorf("Tried to delete non-archived fingerprint %s from archivedFingerprintToTimeRange index. This should never happen.", fp)
-	}
+	p.logSeriesChange(fp)
+	p.archiveBatch.put(fp, archiveOp{remove: true})
 	p.unindexMetric(fp, metric)
 	return nil
 }
@@ -1166,24 +1703,18 @@ func (p *persistence) unarchiveMetric(fp clientmodel.Fingerprint) (
 		}
 	}()
 
-	firstTime, _, has, err := p.archivedFingerprintToTimeRange.Lookup(fp)
+	if !p.mayBeArchived(fp) {
+		return false, 0, nil
+	}
+	has, firstTime, lastTime, err := p.hasArchivedMetric(fp)
 	if err != nil || !has {
 		return false, firstTime, err
 	}
-	deleted, err := p.archivedFingerprintToMetrics.Delete(codable.Fingerprint(fp))
-	if err != nil {
+	if err := p.rememberUnarchived(fp, firstTime, lastTime); err != nil {
 		return false, firstTime, err
 	}
-	if !deleted {
-		glog.Errorf("Tried to delete non-archived fingerprint %s from archivedFingerprintToMetrics index. This should never happen.", fp)
-	}
-	deleted, err = p.archivedFingerprintToTimeRange.Delete(codable.Fingerprint(fp))
-	if err != nil {
-		return false, firstTime, err
-	}
-	if !deleted {
-		glog.Errorf("Tried to delete non-archived fingerprint %s from archivedFingerprintToTimeRange index. This should never happen.", fp)
-	}
+	p.logSeriesChange(fp)
+	p.archiveBatch.put(fp, archiveOp{remove: true})
 	return true, firstTime, nil
 }
 
@@ -1193,8 +1724,16 @@ func (p *persistence) unarchiveMetric(fp clientmodel.Fingerprint) (
 func (p *persistence) close() error {
 	close(p.indexingQueue)
 	<-p.indexingStopped
+	close(p.walStopping)
+	<-p.walStopped
 
 	var lastError, dirtyFileRemoveError error
+	if p.wal != nil {
+		if err := p.wal.close(); err != nil {
+			lastError = err
+			glog.Error("Error closing WAL: ", err)
+		}
+	}
 	if err := p.archivedFingerprintToMetrics.Close(); err != nil {
 		lastError = err
 		glog.Error("Error closing archivedFingerprintToMetric index DB: ", err)
@@ -1257,15 +1796,38 @@ func (p *persistence) openChunkFileForWriting(fp clientmodel.Fingerprint) (*os.F
 // strategy. Then it closes the file. Errors are logged.
 func (p *persistence) closeChunkFile(f *os.File) {
 	if p.shouldSync() {
-		if err := f.Sync(); err != nil {
+		if err := p.syncFile(f); err != nil {
 			glog.Error("Error syncing file:", err)
 		}
 	}
+	p.evictFromPageCache(f)
 	if err := f.Close(); err != nil {
 		glog.Error("Error closing chunk file:", err)
 	}
 }
 
+// syncFile syncs f with fdatasync if configured (and supported by the
+// platform), or with fsync otherwise.
+func (p *persistence) syncFile(f *os.File) error {
+	if p.dataSync {
+		return fdatasync(f)
+	}
+	return f.Sync()
+}
+
+// evictFromPageCache advises the kernel to drop the cached pages of f if
+// configured, so that persistence and maintenance traffic does not displace
+// the data hot for queries from the page cache. Only clean pages are dropped,
+// i.e. pages written since the last sync stay. Errors are logged.
+func (p *persistence) evictFromPageCache(f *os.File) {
+	if !p.pageCacheEviction {
+		return
+	}
+	if err := fadviseDontNeed(f); err != nil {
+		glog.Error("Error evicting file from page cache:", err)
+	}
+}
+
 func (p *persistence) openChunkFileForReading(fp clientmodel.Fingerprint) (*os.File, error) {
 	return os.Open(p.fileNameForFingerprint(fp))
 }
@@ -1278,10 +1840,14 @@ func (p *persistence) headsTempFileName() string {
 	return path.Join(p.basePath, headsTempFileName)
 }
 
+func (p *persistence) headsIncrementalFileName() string {
+	return path.Join(p.basePath, headsIncrementalFileName)
+}
+
 func (p *persistence) processIndexingQueue() {
 	batchSize := 0
 	nameToValues := index.LabelNameLabelValuesMapping{}
-	pairToFPs := index.LabelPairFingerprintsMapping{}
+	pairToFPs := index.PostingsBatch{}
 	batchTimeout := time.NewTimer(indexingBatchTimeout)
 	defer batchTimeout.Stop()
 
@@ -1293,18 +1859,48 @@ func (p *persistence) processIndexingQueue() {
 			)
 		}(time.Now())
 
-		if err := p.labelPairToFingerprints.IndexBatch(pairToFPs); err != nil {
+		emptied, err := p.labelPairToFingerprints.IndexBatch(pairToFPs)
+		if err != nil {
 			glog.Error("Error indexing label pair to fingerprints batch: ", err)
 		}
+		// Label values whose last fingerprint is gone have to be
+		// removed, too.
+		for _, lp := range emptied {
+			values, ok := nameToValues[lp.Name]
+			if !ok {
+				if values, _, err = p.labelNameToLabelValues.LookupSet(lp.Name); err != nil {
+					glog.Errorf("Error looking up label name %v: %s", lp.Name, err)
+					continue
+				}
+				nameToValues[lp.Name] = values
+			}
+			delete(values, lp.Value)
+		}
 		if err := p.labelNameToLabelValues.IndexBatch(nameToValues); err != nil {
 			glog.Error("Error indexing label name to label values batch: ", err)
 		}
+		var added []metric.LabelPair
+		for lp, fps := range pairToFPs {
+			for _, add := range fps {
+				if add {
+					added = append(added, lp)
+					break
+				}
+			}
+		}
+		p.labelValueTrigrams.update(added, emptied)
 		batchSize = 0
 		nameToValues = index.LabelNameLabelValuesMapping{}
-		pairToFPs = index.LabelPairFingerprintsMapping{}
+		pairToFPs = index.PostingsBatch{}
 		batchTimeout.Reset(indexingBatchTimeout)
 	}
 
+	commitArchiveBatch := func() {
+		if err := p.commitArchiveBatch(); err != nil {
+			glog.Error("Error committing archive index batch: ", err)
+		}
+	}
+
 	var flush chan chan int
 loop:
 	for {
@@ -1325,31 +1921,38 @@ loop:
 			} else {
 				batchTimeout.Reset(indexingBatchTimeout)
 			}
+			commitArchiveBatch()
+		case <-p.archiveBatch.full:
+			commitArchiveBatch()
 		case r := <-flush:
 			if batchSize > 0 {
 				commitBatch()
 			}
+			commitArchiveBatch()
 			r <- len(p.indexingQueue)
 		case op, ok := <-p.indexingQueue:
 			if !ok {
 				if batchSize > 0 {
 					commitBatch()
 				}
+				commitArchiveBatch()
 				break loop
 			}
 
 			batchSize++
 			for ln, lv := range op.metric {
 				lp := metric.LabelPair{Name: ln, Value: lv}
-				baseFPs, ok := pairToFPs[lp]
-				if !ok {
-					var err error
-					baseFPs, _, err = p.labelPairToFingerprints.LookupSet(lp)
-					if err != nil {
-						glog.Errorf("Error looking up label pair %v: %s", lp, err)
-						continue
-					}
-					pairToFPs[lp] = baseFPs
+				switch op.opType {
+				case add:
+					pairToFPs.Add(lp, op.fingerprint)
+				case remove:
+					// Whether the label value has to be
+					// removed, too, is only known once the
+					// batch is committed.
+					pairToFPs.Remove(lp, op.fingerprint)
+					continue
+				default:
+					panic("unknown op type")
 				}
 				baseValues, ok := nameToValues[ln]
 				if !ok {
@@ -1361,18 +1964,7 @@ loop:
 					}
 					nameToValues[ln] = baseValues
 				}
-				switch op.opType {
-				case add:
-					baseFPs[op.fingerprint] = struct{}{}
-					baseValues[lv] = struct{}{}
-				case remove:
-					delete(baseFPs, op.fingerprint)
-					if len(baseFPs) == 0 {
-						delete(baseValues, lv)
-					}
-				default:
-					panic("unknown op type")
-				}
+				baseValues[lv] = struct{}{}
 			}
 
 			if batchSize >= indexingMaxBatchSize {
@@ -1383,37 +1975,37 @@ loop:
 	close(p.indexingStopped)
 }
 
-func offsetForChunkIndex(i int) int64 {
-	return int64(i * chunkLenWithHeader)
+func (p *persistence) offsetForChunkIndex(i int) int64 {
+	return int64(i * p.chunkRecordLen())
 }
 
-func chunkIndexForOffset(offset int64) (int, error) {
-	if int(offset)%chunkLenWithHeader != 0 {
+func (p *persistence) chunkIndexForOffset(offset int64) (int, error) {
+	if int(offset)%p.chunkRecordLen() != 0 {
 		return -1, fmt.Errorf(
 			"offset %d is not a multiple of on-disk chunk length %d",
-			offset, chunkLenWithHeader,
+			offset, p.chunkRecordLen(),
 		)
 	}
-	return int(offset) / chunkLenWithHeader, nil
+	return int(offset) / p.chunkRecordLen(), nil
 }
 
-func writeChunkHeader(w io.Writer, c chunk) error {
+func chunkHeader(c chunk) []byte {
 	header := make([]byte, chunkHeaderLen)
 	header[chunkHeaderTypeOffset] = byte(c.encoding())
 	binary.LittleEndian.PutUint64(header[chunkHeaderFirstTimeOffset:], uint64(c.firstTime()))
 	binary.LittleEndian.PutUint64(header[chunkHeaderLastTimeOffset:], uint64(c.lastTime()))
-	_, err := w.Write(header)
-	return err
+	return header
 }
 
-func writeChunks(w io.Writer, chunks []chunk) error {
-	b := bufio.NewWriterSize(w, len(chunks)*chunkLenWithHeader)
+func (p *persistence) writeChunks(w io.Writer, chunks []chunk) error {
+	b := bufio.NewWriterSize(w, len(chunks)*p.chunkRecordLen())
 	for _, chunk := range chunks {
-		if err := writeChunkHeader(b, chunk); err != nil {
+		header := chunkHeader(chunk)
+		if _, err := b.Write(header); err != nil {
 			return err
 		}
 
-		if err := chunk.marshal(b); err != nil {
+		if err := p.writeChunkPayload(b, header, chunk); err != nil {
 			return err
 		}
 	}
@@ -14,9 +14,19 @@
 package local
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	clientmodel "github.com/prometheus/client_golang/model"
 
@@ -34,21 +44,21 @@ var (
 	m5 = clientmodel.Metric{"label": "value5"}
 )
 
-func newTestPersistence(t *testing.T, encoding chunkEncoding) (*persistence, test.Closer) {
-	*defaultChunkEncoding = int(encoding)
+func newTestPersistence(t *testing.T, encoding ChunkEncoding) (*persistence, test.Closer) {
 	dir := test.NewTemporaryDirectory("test_persistence", t)
-	p, err := newPersistence(dir.Path(), false, false, func() bool { return false })
+	p, err := newPersistence(dir.Path(), false, false, func() bool { return false }, 0, index.DefaultCacheSizes)
 	if err != nil {
 		dir.Close()
 		t.Fatal(err)
 	}
+	p.chunkEncoding = encoding
 	return p, test.NewCallbackCloser(func() {
 		p.close()
 		dir.Close()
 	})
 }
 
-func buildTestChunks(encoding chunkEncoding) map[clientmodel.Fingerprint][]chunk {
+func buildTestChunks(encoding ChunkEncoding) map[clientmodel.Fingerprint][]chunk {
 	fps := clientmodel.Fingerprints{
 		m1.Fingerprint(),
 		m2.Fingerprint(),
@@ -69,17 +79,26 @@ func buildTestChunks(encoding chunkEncoding) map[clientmodel.Fingerprint][]chunk
 }
 
 func chunksEqual(c1, c2 chunk) bool {
-	values2 := c2.values()
-	for v1 := range c1.values() {
-		v2 := <-values2
-		if !v1.Equal(v2) {
+	var values1, values2 metric.Values
+	it1, it2 := c1.newIterator(), c2.newIterator()
+	for batch := it1.nextBatch(); batch != nil; batch = it1.nextBatch() {
+		values1 = append(values1, batch...)
+	}
+	for batch := it2.nextBatch(); batch != nil; batch = it2.nextBatch() {
+		values2 = append(values2, batch...)
+	}
+	if len(values1) != len(values2) {
+		return false
+	}
+	for i := range values1 {
+		if !values1[i].Equal(&values2[i]) {
 			return false
 		}
 	}
 	return true
 }
 
-func testPersistLoadDropChunks(t *testing.T, encoding chunkEncoding) {
+func testPersistLoadDropChunks(t *testing.T, encoding ChunkEncoding) {
 	p, closer := newTestPersistence(t, encoding)
 	defer closer.Close()
 
@@ -147,6 +166,25 @@ func testPersistLoadDropChunks(t *testing.T, encoding chunkEncoding) {
 			}
 
 		}
+		// Load chunk descs from the tail, i.e. those of chunks 3 to 7.
+		actualChunkDescs, err = p.loadChunkDescsFromTail(fp, 8, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(actualChunkDescs) != 5 {
+			t.Errorf("Got %d chunkDescs, want %d.", len(actualChunkDescs), 5)
+		}
+		for i, cd := range actualChunkDescs {
+			if cd.firstTime() != clientmodel.Timestamp(i+3) || cd.lastTime() != clientmodel.Timestamp(i+3) {
+				t.Errorf(
+					"Want ts=%v, got firstTime=%v, lastTime=%v.",
+					i+3, cd.firstTime(), cd.lastTime(),
+				)
+			}
+		}
+		if _, err := p.loadChunkDescsFromTail(fp, 11, clientmodel.Earliest); err == nil {
+			t.Error("expected error loading chunk descs beyond end of file")
+		}
 	}
 	// Drop half of the chunks.
 	for fp, expectedChunks := range fpToChunks {
@@ -347,7 +385,11 @@ func TestPersistLoadDropChunksType1(t *testing.T) {
 	testPersistLoadDropChunks(t, 1)
 }
 
-func testCheckpointAndLoadSeriesMapAndHeads(t *testing.T, encoding chunkEncoding) {
+func TestPersistLoadDropChunksType2(t *testing.T) {
+	testPersistLoadDropChunks(t, 2)
+}
+
+func testCheckpointAndLoadSeriesMapAndHeads(t *testing.T, encoding ChunkEncoding) {
 	p, closer := newTestPersistence(t, encoding)
 	defer closer.Close()
 
@@ -358,19 +400,19 @@ func testCheckpointAndLoadSeriesMapAndHeads(t *testing.T, encoding chunkEncoding
 	s3 := newMemorySeries(m3, false, 0)
 	s4 := newMemorySeries(m4, true, 0)
 	s5 := newMemorySeries(m5, true, 0)
-	s1.add(&metric.SamplePair{Timestamp: 1, Value: 3.14})
-	s3.add(&metric.SamplePair{Timestamp: 2, Value: 2.7})
+	s1.add(&metric.SamplePair{Timestamp: 1, Value: 3.14}, encoding)
+	s3.add(&metric.SamplePair{Timestamp: 2, Value: 2.7}, encoding)
 	s3.headChunkClosed = true
 	s3.persistWatermark = 1
 	for i := 0; i < 10000; i++ {
 		s4.add(&metric.SamplePair{
 			Timestamp: clientmodel.Timestamp(i),
 			Value:     clientmodel.SampleValue(i) / 2,
-		})
+		}, encoding)
 		s5.add(&metric.SamplePair{
 			Timestamp: clientmodel.Timestamp(i),
 			Value:     clientmodel.SampleValue(i * i),
-		})
+		}, encoding)
 	}
 	s5.persistWatermark = 3
 	chunkCountS4 := len(s4.chunkDescs)
@@ -484,7 +526,282 @@ func TestCheckpointAndLoadSeriesMapAndHeadsChunkType1(t *testing.T) {
 	testCheckpointAndLoadSeriesMapAndHeads(t, 1)
 }
 
-func testGetFingerprintsModifiedBefore(t *testing.T, encoding chunkEncoding) {
+func TestCheckpointAndLoadSeriesMapAndHeadsChunkType2(t *testing.T) {
+	testCheckpointAndLoadSeriesMapAndHeads(t, 2)
+}
+
+func testCheckpointCompression(t *testing.T, encrypted bool) {
+	keyDir := test.NewTemporaryDirectory("test_encryption_keys", t)
+	defer keyDir.Close()
+	keyFile := filepath.Join(keyDir.Path(), "key")
+	if err := ioutil.WriteFile(keyFile, []byte(strings.Repeat("0123456789abcdef", 4)), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var uncompressedSize int64
+	for _, compression := range []Compression{NoCompression, Snappy, Gzip} {
+		func() {
+			p, closer := newTestPersistence(t, 1)
+			defer closer.Close()
+			if encrypted {
+				if err := p.setupEncryption(KeyFile(keyFile)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			p.checkpointCompression = compression
+
+			fpLocker := newFingerprintLocker(10)
+			sm := newSeriesMap()
+			for _, m := range []clientmodel.Metric{m1, m2, m3} {
+				s := newMemorySeries(m, true, 0)
+				for i := 0; i < 1000; i++ {
+					s.add(&metric.SamplePair{
+						Timestamp: clientmodel.Timestamp(i),
+						Value:     clientmodel.SampleValue(i % 10),
+					}, 1)
+				}
+				sm.put(m.Fingerprint(), s)
+			}
+			if err := p.checkpointSeriesMapAndHeads(sm, fpLocker); err != nil {
+				t.Fatal(err)
+			}
+
+			fi, err := os.Stat(p.headsFileName())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if compression == NoCompression {
+				uncompressedSize = fi.Size()
+			} else if fi.Size() >= uncompressedSize {
+				t.Errorf("%v: heads file has %d bytes, uncompressed %d bytes", compression, fi.Size(), uncompressedSize)
+			}
+			if encrypted {
+				heads, err := ioutil.ReadFile(p.headsFileName())
+				if err != nil {
+					t.Fatal(err)
+				}
+				if bytes.Contains(heads, []byte("value1")) {
+					t.Errorf("%v: checkpoint contains unencrypted metric", compression)
+				}
+			}
+
+			loadedSM, _, err := p.loadSeriesMapAndHeads()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p.dirty {
+				t.Fatalf("%v: loading the heads file failed", compression)
+			}
+			if loadedSM.length() != 3 {
+				t.Fatalf("%v: want 3 series in map, got %d", compression, loadedSM.length())
+			}
+			for _, m := range []clientmodel.Metric{m1, m2, m3} {
+				s, _ := sm.get(m.Fingerprint())
+				loaded, ok := loadedSM.get(m.Fingerprint())
+				if !ok {
+					t.Fatalf("%v: couldn't find %v in loaded map", compression, m)
+				}
+				if len(loaded.chunkDescs) != len(s.chunkDescs) {
+					t.Fatalf("%v: want %d chunk descs, got %d", compression, len(s.chunkDescs), len(loaded.chunkDescs))
+				}
+				for i, cd := range loaded.chunkDescs {
+					if !chunksEqual(cd.chunk, s.chunkDescs[i].chunk) {
+						t.Errorf("%v: %d. chunks not equal", compression, i)
+					}
+				}
+			}
+		}()
+	}
+}
+
+func TestCheckpointCompression(t *testing.T) {
+	testCheckpointCompression(t, false)
+}
+
+func TestCheckpointCompressionEncrypted(t *testing.T) {
+	testCheckpointCompression(t, true)
+}
+
+func TestSealedWriterAndReader(t *testing.T) {
+	p := &persistence{}
+	block, err := aes.NewCipher([]byte("0123456789abcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.aead, err = cipher.NewGCM(block); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 3*sealedFrameLen+42)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	var buf bytes.Buffer
+	sw := p.newSealedWriter(&buf)
+	// Write in odd pieces to exercise frames spanning several writes.
+	for i := 0; i < len(data); i += 1000 {
+		end := i + 1000
+		if end > len(data) {
+			end = len(data)
+		}
+		if _, err := sw.Write(data[i:end]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if want := len(data) + 4*encryptionOverhead; buf.Len() < want {
+		t.Errorf("want at least %d bytes for 4 frames, got %d", want, buf.Len())
+	}
+
+	got, err := ioutil.ReadAll(p.newSealedReader(bufio.NewReader(&buf)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("data read differs from data written")
+	}
+}
+
+func testIncrementalCheckpoint(t *testing.T, encoding ChunkEncoding) {
+	p, closer := newTestPersistence(t, encoding)
+	defer closer.Close()
+
+	fpLocker := newFingerprintLocker(10)
+	sm := newSeriesMap()
+	s1 := newMemorySeries(m1, true, 0)
+	s2 := newMemorySeries(m2, true, 0)
+	s4 := newMemorySeries(m4, true, 0)
+	s1.add(&metric.SamplePair{Timestamp: 1, Value: 3.14}, encoding)
+	s2.add(&metric.SamplePair{Timestamp: 1, Value: 2.7}, encoding)
+	for i := 0; i < 10000; i++ {
+		s4.add(&metric.SamplePair{
+			Timestamp: clientmodel.Timestamp(i),
+			Value:     clientmodel.SampleValue(i) / 2,
+		}, encoding)
+	}
+	sm.put(m1.Fingerprint(), s1)
+	sm.put(m2.Fingerprint(), s2)
+	sm.put(m4.Fingerprint(), s4)
+
+	if err := p.checkpointSeriesMapAndHeads(sm, fpLocker); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(p.headsIncrementalFileName()); !os.IsNotExist(err) {
+		t.Fatalf("want no incremental heads file after full checkpoint, got error %v", err)
+	}
+
+	// Change s1, remove s2, add s3. s4 stays untouched.
+	s1.add(&metric.SamplePair{Timestamp: 2, Value: 6.28}, encoding)
+	sm.del(m2.Fingerprint())
+	p.seriesRemoved(m2.Fingerprint())
+	s3 := newMemorySeries(m3, true, 0)
+	s3.add(&metric.SamplePair{Timestamp: 3, Value: 1.41}, encoding)
+	sm.put(m3.Fingerprint(), s3)
+
+	if err := p.checkpointSeriesMapAndHeads(sm, fpLocker); err != nil {
+		t.Fatal(err)
+	}
+	headsInfo, err := os.Stat(p.headsFileName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	incInfo, err := os.Stat(p.headsIncrementalFileName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if incInfo.Size() >= headsInfo.Size()/2 {
+		t.Errorf("incremental heads file has %d bytes, heads file %d bytes, want unchanged series left out", incInfo.Size(), headsInfo.Size())
+	}
+
+	// Remove s3 again in a second incremental checkpoint.
+	sm.del(m3.Fingerprint())
+	p.seriesRemoved(m3.Fingerprint())
+	if err := p.checkpointSeriesMapAndHeads(sm, fpLocker); err != nil {
+		t.Fatal(err)
+	}
+
+	loadedSM, chunksToPersist, err := p.loadSeriesMapAndHeads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.dirty {
+		t.Error("persistence dirty after loading incremental checkpoints")
+	}
+	if got, want := loadedSM.length(), 2; got != want {
+		t.Errorf("got %d series in map, want %d", got, want)
+	}
+	if got, want := chunksToPersist, int64(len(s1.chunkDescs)+len(s4.chunkDescs)); got != want {
+		t.Errorf("got %d chunks to persist, want %d", got, want)
+	}
+	if loadedS1, ok := loadedSM.get(m1.Fingerprint()); ok {
+		if !reflect.DeepEqual(loadedS1.head().chunk, s1.head().chunk) {
+			t.Error("head chunks of s1 differ")
+		}
+	} else {
+		t.Errorf("couldn't find %v in loaded map", m1)
+	}
+	if loadedS4, ok := loadedSM.get(m4.Fingerprint()); ok {
+		if got, want := len(loadedS4.chunkDescs), len(s4.chunkDescs); got != want {
+			t.Errorf("got %d chunkDescs for s4, want %d", got, want)
+		}
+	} else {
+		t.Errorf("couldn't find %v in loaded map", m4)
+	}
+	for _, m := range []clientmodel.Metric{m2, m3} {
+		if _, ok := loadedSM.get(m.Fingerprint()); ok {
+			t.Errorf("removed series %v found in loaded map", m)
+		}
+	}
+
+	// A torn batch renders the persistence dirty but keeps the batches
+	// before.
+	f, err := os.OpenFile(p.headsIncrementalFileName(), os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	fpToSeries := map[clientmodel.Fingerprint]*memorySeries{}
+	if _, _, headsLoaded := p.loadHeads(fpToSeries); !headsLoaded {
+		t.Error("heads not loaded")
+	}
+	if !p.dirty {
+		t.Error("persistence not dirty after loading torn incremental checkpoint")
+	}
+	if got, want := len(fpToSeries), 2; got != want {
+		t.Errorf("got %d series after loading torn incremental checkpoint, want %d", got, want)
+	}
+
+	// Once the incremental heads file is as large as the heads file, a
+	// full checkpoint is written again.
+	if err := os.Truncate(p.headsIncrementalFileName(), headsInfo.Size()); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.checkpointSeriesMapAndHeads(sm, fpLocker); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(p.headsIncrementalFileName()); !os.IsNotExist(err) {
+		t.Errorf("want no incremental heads file after full checkpoint, got error %v", err)
+	}
+}
+
+func TestIncrementalCheckpointChunkType0(t *testing.T) {
+	testIncrementalCheckpoint(t, 0)
+}
+
+func TestIncrementalCheckpointChunkType1(t *testing.T) {
+	testIncrementalCheckpoint(t, 1)
+}
+
+func TestIncrementalCheckpointChunkType2(t *testing.T) {
+	testIncrementalCheckpoint(t, 2)
+}
+
+func testGetFingerprintsModifiedBefore(t *testing.T, encoding ChunkEncoding) {
 	p, closer := newTestPersistence(t, encoding)
 	defer closer.Close()
 
@@ -562,7 +879,11 @@ func TestGetFingerprintsModifiedBeforeChunkType1(t *testing.T) {
 	testGetFingerprintsModifiedBefore(t, 1)
 }
 
-func testDropArchivedMetric(t *testing.T, encoding chunkEncoding) {
+func TestGetFingerprintsModifiedBeforeChunkType2(t *testing.T) {
+	testGetFingerprintsModifiedBefore(t, 2)
+}
+
+func testDropArchivedMetric(t *testing.T, encoding ChunkEncoding) {
 	p, closer := newTestPersistence(t, encoding)
 	defer closer.Close()
 
@@ -638,117 +959,864 @@ func TestDropArchivedMetricChunkType1(t *testing.T) {
 	testDropArchivedMetric(t, 1)
 }
 
-type incrementalBatch struct {
-	fpToMetric      index.FingerprintMetricMapping
-	expectedLnToLvs index.LabelNameLabelValuesMapping
-	expectedLpToFps index.LabelPairFingerprintsMapping
+func TestDropArchivedMetricChunkType2(t *testing.T) {
+	testDropArchivedMetric(t, 2)
 }
 
-func testIndexing(t *testing.T, encoding chunkEncoding) {
-	batches := []incrementalBatch{
-		{
-			fpToMetric: index.FingerprintMetricMapping{
-				0: {
-					clientmodel.MetricNameLabel: "metric_0",
-					"label_1":                   "value_1",
-				},
-				1: {
-					clientmodel.MetricNameLabel: "metric_0",
-					"label_2":                   "value_2",
-					"label_3":                   "value_3",
-				},
-				2: {
-					clientmodel.MetricNameLabel: "metric_1",
-					"label_1":                   "value_2",
-				},
-			},
-			expectedLnToLvs: index.LabelNameLabelValuesMapping{
-				clientmodel.MetricNameLabel: codable.LabelValueSet{
-					"metric_0": struct{}{},
-					"metric_1": struct{}{},
-				},
-				"label_1": codable.LabelValueSet{
-					"value_1": struct{}{},
-					"value_2": struct{}{},
-				},
-				"label_2": codable.LabelValueSet{
-					"value_2": struct{}{},
-				},
-				"label_3": codable.LabelValueSet{
-					"value_3": struct{}{},
-				},
-			},
-			expectedLpToFps: index.LabelPairFingerprintsMapping{
-				metric.LabelPair{
-					Name:  clientmodel.MetricNameLabel,
-					Value: "metric_0",
-				}: codable.FingerprintSet{0: struct{}{}, 1: struct{}{}},
-				metric.LabelPair{
-					Name:  clientmodel.MetricNameLabel,
-					Value: "metric_1",
-				}: codable.FingerprintSet{2: struct{}{}},
-				metric.LabelPair{
-					Name:  "label_1",
-					Value: "value_1",
-				}: codable.FingerprintSet{0: struct{}{}},
-				metric.LabelPair{
-					Name:  "label_1",
-					Value: "value_2",
-				}: codable.FingerprintSet{2: struct{}{}},
-				metric.LabelPair{
-					Name:  "label_2",
-					Value: "value_2",
-				}: codable.FingerprintSet{1: struct{}{}},
-				metric.LabelPair{
-					Name:  "label_3",
-					Value: "value_3",
-				}: codable.FingerprintSet{1: struct{}{}},
-			},
-		}, {
-			fpToMetric: index.FingerprintMetricMapping{
-				3: {
-					clientmodel.MetricNameLabel: "metric_0",
-					"label_1":                   "value_3",
-				},
-				4: {
-					clientmodel.MetricNameLabel: "metric_2",
-					"label_2":                   "value_2",
-					"label_3":                   "value_1",
-				},
-				5: {
-					clientmodel.MetricNameLabel: "metric_1",
-					"label_1":                   "value_3",
-				},
-			},
-			expectedLnToLvs: index.LabelNameLabelValuesMapping{
-				clientmodel.MetricNameLabel: codable.LabelValueSet{
-					"metric_0": struct{}{},
-					"metric_1": struct{}{},
-					"metric_2": struct{}{},
-				},
-				"label_1": codable.LabelValueSet{
-					"value_1": struct{}{},
-					"value_2": struct{}{},
-					"value_3": struct{}{},
-				},
-				"label_2": codable.LabelValueSet{
-					"value_2": struct{}{},
-				},
-				"label_3": codable.LabelValueSet{
-					"value_1": struct{}{},
-					"value_3": struct{}{},
-				},
-			},
-			expectedLpToFps: index.LabelPairFingerprintsMapping{
-				metric.LabelPair{
-					Name:  clientmodel.MetricNameLabel,
-					Value: "metric_0",
-				}: codable.FingerprintSet{0: struct{}{}, 1: struct{}{}, 3: struct{}{}},
-				metric.LabelPair{
-					Name:  clientmodel.MetricNameLabel,
-					Value: "metric_1",
-				}: codable.FingerprintSet{2: struct{}{}, 5: struct{}{}},
-				metric.LabelPair{
+func testCompactSeriesFile(t *testing.T, encoding ChunkEncoding) {
+	p, closer := newTestPersistence(t, encoding)
+	defer closer.Close()
+
+	fp := m1.Fingerprint()
+	if _, err := p.persistChunks(fp, buildTestChunks(encoding)[fp]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Coalesce the first four single-sample chunks, keep the rest.
+	before, after, err := p.compactSeriesFile(fp, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before != 4 || after != 1 {
+		t.Errorf("want 4 chunks compacted into 1, got %d into %d", before, after)
+	}
+	cds, err := p.loadChunkDescs(fp, clientmodel.Latest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cds) != 7 {
+		t.Fatalf("want 7 chunks after compaction, got %d", len(cds))
+	}
+	if cds[0].firstTime() != 0 || cds[0].lastTime() != 3 || cds[1].firstTime() != 4 {
+		t.Errorf("unexpected chunks after compaction: %v, %v", cds[0], cds[1])
+	}
+
+	// Coalesce everything.
+	if before, after, err = p.compactSeriesFile(fp, -1); err != nil {
+		t.Fatal(err)
+	}
+	if before != 7 || after != 1 {
+		t.Errorf("want 7 chunks compacted into 1, got %d into %d", before, after)
+	}
+	chunks, err := p.loadChunks(fp, []int{0}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := clientmodel.Timestamp(0)
+	for v := range chunks[0].values() {
+		if v.Timestamp != want || v.Value != clientmodel.SampleValue(fp) {
+			t.Errorf("want sample at %v, got %v", want, v)
+		}
+		want++
+	}
+	if want != 10 {
+		t.Errorf("want 10 samples after compaction, got %d", want)
+	}
+
+	// Nothing left to save.
+	if before, after, err = p.compactSeriesFile(fp, -1); err != nil || before != 1 || after != 1 {
+		t.Errorf("want file left alone, got %d into %d, %v", before, after, err)
+	}
+}
+
+func TestCompactSeriesFileChunkType0(t *testing.T) {
+	testCompactSeriesFile(t, 0)
+}
+
+func TestCompactSeriesFileChunkType1(t *testing.T) {
+	testCompactSeriesFile(t, 1)
+}
+
+func TestCompactSeriesFileChunkType2(t *testing.T) {
+	testCompactSeriesFile(t, 2)
+}
+
+func testLoadMapped(t *testing.T, encoding ChunkEncoding) {
+	p, closer := newTestPersistence(t, encoding)
+	defer closer.Close()
+	if !mmapSupported {
+		t.Skip("memory-mapped files not supported on this platform")
+	}
+
+	fpToChunks := buildTestChunks(encoding)
+	for fp, chunks := range fpToChunks {
+		if _, err := p.persistChunks(fp, chunks); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for fp, expectedChunks := range fpToChunks {
+		p.mmapSeriesFiles = true
+		actualChunks, err := p.loadChunks(fp, []int{1, 2, 5, 9}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, idx := range []int{1, 2, 5, 9} {
+			if !chunksEqual(expectedChunks[idx], actualChunks[i]) {
+				t.Errorf("%d. Chunks not equal.", idx)
+			}
+		}
+		if _, err := p.loadChunks(fp, []int{10}, 0); err == nil {
+			t.Error("expected error loading chunk beyond end of file")
+		}
+		mapped, err := p.loadChunkDescs(fp, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.mmapSeriesFiles = false
+		read, err := p.loadChunkDescs(fp, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(mapped) != 5 || len(mapped) != len(read) {
+			t.Fatalf("want 5 chunk descs, got %d mapped and %d read", len(mapped), len(read))
+		}
+		for i := range mapped {
+			if mapped[i].firstTime() != read[i].firstTime() || mapped[i].lastTime() != read[i].lastTime() {
+				t.Errorf("%d. Chunk descs not equal.", i)
+			}
+		}
+	}
+
+	p.mmapSeriesFiles = true
+	if cds, err := p.loadChunkDescs(m4.Fingerprint(), clientmodel.Latest); err != nil || cds != nil {
+		t.Errorf("want no chunk descs for missing series file, got %v, %v", cds, err)
+	}
+}
+
+func TestLoadMappedChunkType0(t *testing.T) {
+	testLoadMapped(t, 0)
+}
+
+func TestLoadMappedChunkType1(t *testing.T) {
+	testLoadMapped(t, 1)
+}
+
+func TestLoadMappedChunkType2(t *testing.T) {
+	testLoadMapped(t, 2)
+}
+
+func TestDataSyncAndPageCacheEviction(t *testing.T) {
+	p, closer := newTestPersistence(t, 1)
+	defer closer.Close()
+	p.shouldSync = func() bool { return true }
+	p.dataSync = true
+	p.pageCacheEviction = true
+
+	fpToChunks := buildTestChunks(1)
+	for fp, chunks := range fpToChunks {
+		if _, err := p.persistChunks(fp, chunks); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for fp, expectedChunks := range fpToChunks {
+		actualChunks, err := p.loadChunks(fp, []int{0, 9}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, idx := range []int{0, 9} {
+			if !chunksEqual(expectedChunks[idx], actualChunks[i]) {
+				t.Errorf("%d. Chunks not equal.", idx)
+			}
+		}
+	}
+	if p.isDirty() {
+		t.Error("persistence is dirty")
+	}
+
+	f, err := p.openChunkFileForReading(m1.Fingerprint())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := fdatasync(f); err != nil {
+		t.Error("error syncing series file: ", err)
+	}
+	if err := fadviseDontNeed(f); err != nil {
+		t.Error("error evicting series file from page cache: ", err)
+	}
+}
+
+func TestDirectIO(t *testing.T) {
+	p, closer := newTestPersistence(t, 1)
+	defer closer.Close()
+	if err := p.checkDirectIO(); err != nil {
+		t.Skip(err)
+	}
+	p.directIO = true
+
+	// Append in uneven batches so that most appends start and end within
+	// a disk block.
+	fpToChunks := buildTestChunks(1)
+	for fp, chunks := range fpToChunks {
+		for i, batch := range [][]chunk{chunks[:1], chunks[1:5], chunks[5:]} {
+			want := []int{0, 1, 5}[i]
+			if index, err := p.persistChunks(fp, batch); err != nil {
+				t.Fatal(err)
+			} else if index != want {
+				t.Errorf("%d. want index %d, got %d", i, want, index)
+			}
+		}
+	}
+	if p.isDirty() {
+		t.Error("persistence is dirty")
+	}
+	for fp, expectedChunks := range fpToChunks {
+		fi, err := os.Stat(p.fileNameForFingerprint(fp))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := int64(10 * p.chunkRecordLen()); fi.Size() != want {
+			t.Errorf("want series file of %d bytes, got %d", want, fi.Size())
+		}
+		indexes := []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+		actualChunks, err := p.loadChunks(fp, indexes, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, idx := range indexes {
+			if !chunksEqual(expectedChunks[idx], actualChunks[idx]) {
+				t.Errorf("%d. Chunks not equal.", idx)
+			}
+		}
+	}
+}
+
+func testLoadChunksBatch(t *testing.T, encoding ChunkEncoding) {
+	p, closer := newTestPersistence(t, encoding)
+	defer closer.Close()
+
+	fpToChunks := buildTestChunks(encoding)
+	for fp, chunks := range fpToChunks {
+		if _, err := p.persistChunks(fp, chunks); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fpToIndexes := map[clientmodel.Fingerprint][]int{
+		m1.Fingerprint(): {9, 0, 4, 5},
+		m2.Fingerprint(): {3},
+		m3.Fingerprint(): {},
+	}
+	fpToLoaded, err := p.loadChunksBatch(fpToIndexes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fpToLoaded) != len(fpToIndexes) {
+		t.Fatalf("want chunks for %d fingerprints, got %d", len(fpToIndexes), len(fpToLoaded))
+	}
+	for fp, indexes := range fpToIndexes {
+		if !sort.IntsAreSorted(indexes) {
+			t.Errorf("indexes for %v not sorted: %v", fp, indexes)
+		}
+		loaded := fpToLoaded[fp]
+		if len(loaded) != len(indexes) {
+			t.Fatalf("want %d chunks for %v, got %d", len(indexes), fp, len(loaded))
+		}
+		for i, idx := range indexes {
+			if !chunksEqual(fpToChunks[fp][idx], loaded[i]) {
+				t.Errorf("%v, %d. Chunks not equal.", fp, idx)
+			}
+		}
+	}
+
+	if _, err := p.loadChunksBatch(map[clientmodel.Fingerprint][]int{
+		m1.Fingerprint(): {0},
+		m4.Fingerprint(): {0},
+	}); err == nil {
+		t.Error("expected error loading chunks of a series without series file")
+	}
+}
+
+func TestLoadChunksBatchChunkType0(t *testing.T) {
+	testLoadChunksBatch(t, 0)
+}
+
+func TestLoadChunksBatchChunkType1(t *testing.T) {
+	testLoadChunksBatch(t, 1)
+}
+
+func TestLoadChunksBatchChunkType2(t *testing.T) {
+	testLoadChunksBatch(t, 2)
+}
+
+func testChunkCache(t *testing.T, encoding ChunkEncoding) {
+	p, closer := newTestPersistence(t, encoding)
+	defer closer.Close()
+	// Room for 3 chunks only.
+	p.chunkCache = newChunkCache(3 * chunkLen)
+
+	fpToChunks := buildTestChunks(encoding)
+	fp := m1.Fingerprint()
+	if _, err := p.persistChunks(fp, fpToChunks[fp]); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.loadChunks(fp, []int{1, 2}, 3); err != nil {
+		t.Fatal(err)
+	}
+	for _, idx := range []int{4, 5} {
+		if _, ok := p.chunkCache.get(fp, idx); !ok {
+			t.Errorf("chunk %d not cached", idx)
+		}
+	}
+	// Mixing cached and uncached chunks evicts the least recently used.
+	actualChunks, err := p.loadChunks(fp, []int{5, 6, 7}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, idx := range []int{5, 6, 7} {
+		if !chunksEqual(fpToChunks[fp][idx], actualChunks[i]) {
+			t.Errorf("%d. Chunks not equal.", idx)
+		}
+	}
+	if _, ok := p.chunkCache.get(fp, 4); ok {
+		t.Error("chunk 4 not evicted")
+	}
+
+	// Dropping chunks shifts the indexes and must invalidate the cache.
+	if _, _, _, _, err := p.dropAndPersistChunks(fp, 5, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.chunkCache.get(fp, 5); ok {
+		t.Error("cache not invalidated after dropping chunks")
+	}
+	actualChunks, err = p.loadChunks(fp, []int{0}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !chunksEqual(fpToChunks[fp][5], actualChunks[0]) {
+		t.Error("Chunks not equal after dropping chunks.")
+	}
+}
+
+func TestChunkCacheChunkType0(t *testing.T) {
+	testChunkCache(t, 0)
+}
+
+func TestChunkCacheChunkType1(t *testing.T) {
+	testChunkCache(t, 1)
+}
+
+func TestChunkCacheChunkType2(t *testing.T) {
+	testChunkCache(t, 2)
+}
+
+func TestIOThrottle(t *testing.T) {
+	now := time.Now()
+	b := tokenBucket{rate: 100, tokens: 100, last: now}
+	if got := b.take(60, now); got != 0 {
+		t.Errorf("got delay %v within budget, want 0", got)
+	}
+	if got, want := b.utilization(now), 0.6; got != want {
+		t.Errorf("got utilization %v, want %v", got, want)
+	}
+	if got, want := b.take(90, now), 500*time.Millisecond; got != want {
+		t.Errorf("got delay %v, want %v", got, want)
+	}
+	if got, want := b.utilization(now), 1.0; got != want {
+		t.Errorf("got utilization %v, want %v", got, want)
+	}
+	// After paying off the debt, the bucket refills to one second worth
+	// of tokens, but not beyond.
+	now = now.Add(2 * time.Second)
+	if got, want := b.utilization(now), 0.0; got != want {
+		t.Errorf("got utilization %v, want %v", got, want)
+	}
+	if got, want := b.take(200, now), time.Second; got != want {
+		t.Errorf("got delay %v, want %v", got, want)
+	}
+
+	unlimited := newIOThrottle(0, 0)
+	begin := time.Now()
+	for i := 0; i < 1000; i++ {
+		unlimited.wait(1 << 20)
+	}
+	if d := time.Since(begin); d > time.Second {
+		t.Errorf("unlimited throttle took %v", d)
+	}
+}
+
+func testArchivedFilter(t *testing.T, encoding ChunkEncoding) {
+	p, closer := newTestPersistence(t, encoding)
+	defer closer.Close()
+
+	m1 := clientmodel.Metric{"n1": "v1"}
+	m2 := clientmodel.Metric{"n2": "v2"}
+	m3 := clientmodel.Metric{"n3": "v3"}
+	p.archiveMetric(1, m1, 2, 4)
+	p.archiveMetric(2, m2, 1, 6)
+
+	// Fingerprints archived before the filter is loaded must be found.
+	if err := p.loadArchivedFilter(1024); err != nil {
+		t.Fatal(err)
+	}
+	for _, fp := range []clientmodel.Fingerprint{1, 2} {
+		if archived, _, _, err := p.hasArchivedMetric(fp); err != nil || !archived {
+			t.Errorf("want FP %v archived", fp)
+		}
+	}
+	if archived, _, _, err := p.hasArchivedMetric(3); err != nil || archived {
+		t.Error("want FP 3 not archived")
+	}
+	if m, err := p.getArchivedMetric(3); err != nil || m != nil {
+		t.Errorf("want no archived metric for FP 3, got %v, %v", m, err)
+	}
+	if unarchived, _, err := p.unarchiveMetric(3); err != nil || unarchived {
+		t.Error("want FP 3 not unarchived")
+	}
+
+	// Fingerprints archived later must be found, too.
+	p.archiveMetric(3, m3, 5, 5)
+	if m, err := p.getArchivedMetric(3); err != nil || !m.Equal(m3) {
+		t.Errorf("want archived metric %v for FP 3, got %v, %v", m3, m, err)
+	}
+	if unarchived, firstTime, err := p.unarchiveMetric(1); err != nil || !unarchived || firstTime != 2 {
+		t.Errorf("want FP 1 unarchived with first time 2, got %v, %v, %v", unarchived, firstTime, err)
+	}
+
+	// Fingerprints that were archived once might still pass the filter,
+	// but must not be reported as archived.
+	if archived, _, _, err := p.hasArchivedMetric(1); err != nil || archived {
+		t.Error("want FP 1 not archived")
+	}
+
+	// Most fingerprints never archived must be ruled out by the filter
+	// without a lookup.
+	var ruledOut int
+	for fp := clientmodel.Fingerprint(1000); fp < 2000; fp++ {
+		if !p.archivedFilter.mayContain(fp * 0x9E3779B97F4A7C15) {
+			ruledOut++
+		}
+	}
+	if ruledOut < 950 {
+		t.Errorf("want at least 950 of 1000 fingerprints ruled out, got %d", ruledOut)
+	}
+}
+
+func TestArchivedFilterChunkType0(t *testing.T) {
+	testArchivedFilter(t, 0)
+}
+
+func TestArchivedFilterChunkType1(t *testing.T) {
+	testArchivedFilter(t, 1)
+}
+
+func TestArchivedFilterChunkType2(t *testing.T) {
+	testArchivedFilter(t, 2)
+}
+
+func testArchiveBatch(t *testing.T, encoding ChunkEncoding) {
+	p, closer := newTestPersistence(t, encoding)
+	defer closer.Close()
+
+	m1 := clientmodel.Metric{"n1": "v1"}
+	m2 := clientmodel.Metric{"n2": "v2"}
+	p.archiveMetric(1, m1, 2, 4)
+	p.archiveMetric(2, m2, 1, 6)
+	p.updateArchivedTimeRange(1, 3, 5)
+	if unarchived, _, err := p.unarchiveMetric(2); err != nil || !unarchived {
+		t.Fatalf("unarchiving fingerprint 2: got %v, %v", unarchived, err)
+	}
+
+	// Lookups see the changes whether they are committed yet or not.
+	check := func() {
+		if has, first, last, err := p.hasArchivedMetric(1); err != nil || !has || first != 3 || last != 5 {
+			t.Errorf("fingerprint 1: got %v, %v, %v, %v", has, first, last, err)
+		}
+		if m, err := p.getArchivedMetric(1); err != nil || !reflect.DeepEqual(m, m1) {
+			t.Errorf("fingerprint 1: got metric %v, %v", m, err)
+		}
+		if has, _, _, err := p.hasArchivedMetric(2); err != nil || has {
+			t.Errorf("fingerprint 2: got %v, %v", has, err)
+		}
+		if m, err := p.getArchivedMetric(2); err != nil || m != nil {
+			t.Errorf("fingerprint 2: got metric %v, %v", m, err)
+		}
+	}
+	check()
+	p.waitForIndexing()
+	check()
+
+	// Once committed, the changes are in the archive indexes.
+	if first, last, ok, err := p.archivedFingerprintToTimeRange.Lookup(1); err != nil || !ok || first != 3 || last != 5 {
+		t.Errorf("time range index: got %v, %v, %v, %v", first, last, ok, err)
+	}
+	if m, ok, err := p.archivedFingerprintToMetrics.Lookup(1); err != nil || !ok || !reflect.DeepEqual(m, m1) {
+		t.Errorf("metric index: got %v, %v, %v", m, ok, err)
+	}
+	if _, _, ok, err := p.archivedFingerprintToTimeRange.Lookup(2); err != nil || ok {
+		t.Errorf("time range index: got %v, %v for unarchived fingerprint", ok, err)
+	}
+
+	// A time range update after the commit does not lose the metric.
+	p.updateArchivedTimeRange(1, 3, 7)
+	if m, err := p.getArchivedMetric(1); err != nil || !reflect.DeepEqual(m, m1) {
+		t.Errorf("fingerprint 1: got metric %v, %v", m, err)
+	}
+	if err := p.purgeArchivedMetric(1); err != nil {
+		t.Fatal(err)
+	}
+	fps, err := p.getFingerprintsModifiedBefore(clientmodel.Latest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fps) != 0 {
+		t.Errorf("got archived fingerprints %v after purging", fps)
+	}
+}
+
+func TestArchiveBatchChunkType0(t *testing.T) {
+	testArchiveBatch(t, 0)
+}
+
+func TestArchiveBatchChunkType1(t *testing.T) {
+	testArchiveBatch(t, 1)
+}
+
+func TestArchiveBatchChunkType2(t *testing.T) {
+	testArchiveBatch(t, 2)
+}
+
+func testEncryption(t *testing.T, encoding ChunkEncoding) {
+	p, closer := newTestPersistence(t, encoding)
+	defer closer.Close()
+	keyDir := test.NewTemporaryDirectory("test_encryption_keys", t)
+	defer keyDir.Close()
+
+	keyFile := filepath.Join(keyDir.Path(), "key")
+	if err := ioutil.WriteFile(keyFile, []byte(strings.Repeat("0123456789abcdef", 4)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	wrongKeyFile := filepath.Join(keyDir.Path(), "wrong")
+	if err := ioutil.WriteFile(wrongKeyFile, []byte(strings.Repeat("fedcba9876543210", 2)), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.setupEncryption(KeyFile(keyFile)); err != nil {
+		t.Fatal(err)
+	}
+
+	fpToChunks := buildTestChunks(encoding)
+	for fp, chunks := range fpToChunks {
+		if _, err := p.persistChunks(fp, chunks); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, mapped := range []bool{false, mmapSupported} {
+		p.mmapSeriesFiles = mapped
+		for fp, expectedChunks := range fpToChunks {
+			actualChunks, err := p.loadChunks(fp, []int{0, 1, 2, 5, 9}, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, idx := range []int{0, 1, 2, 5, 9} {
+				if !chunksEqual(expectedChunks[idx], actualChunks[i]) {
+					t.Errorf("%d. Chunks not equal (mapped: %t).", idx, mapped)
+				}
+			}
+			cds, err := p.loadChunkDescs(fp, 5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(cds) != 5 {
+				t.Errorf("want 5 chunk descs, got %d (mapped: %t)", len(cds), mapped)
+			}
+		}
+	}
+
+	// The chunk data must not be in the series file in plain.
+	var plain bytes.Buffer
+	if err := fpToChunks[m1.Fingerprint()][3].marshal(&plain); err != nil {
+		t.Fatal(err)
+	}
+	seriesFile, err := ioutil.ReadFile(p.fileNameForFingerprint(m1.Fingerprint()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seriesFile) != 10*(chunkLenWithHeader+encryptionOverhead) {
+		t.Errorf("want series file of %d bytes, got %d", 10*(chunkLenWithHeader+encryptionOverhead), len(seriesFile))
+	}
+	if bytes.Contains(seriesFile, plain.Bytes()) {
+		t.Error("series file contains unencrypted chunk")
+	}
+
+	fpLocker := newFingerprintLocker(10)
+	sm := newSeriesMap()
+	s := newMemorySeries(m1, true, 0)
+	s.add(&metric.SamplePair{Timestamp: 1, Value: 3.14}, encoding)
+	sm.put(m1.Fingerprint(), s)
+	if err := p.checkpointSeriesMapAndHeads(sm, fpLocker); err != nil {
+		t.Fatal(err)
+	}
+	heads, err := ioutil.ReadFile(p.headsFileName())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(heads, []byte("value1")) {
+		t.Error("checkpoint contains unencrypted metric")
+	}
+	loadedSM, _, err := p.loadSeriesMapAndHeads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loadedS, ok := loadedSM.get(m1.Fingerprint()); !ok {
+		t.Errorf("couldn't find %v in loaded map", m1)
+	} else if !reflect.DeepEqual(loadedS.head().chunk, s.head().chunk) {
+		t.Error("head chunks differ")
+	}
+
+	reopened := &persistence{basePath: p.basePath}
+	if err := reopened.setupEncryption(KeyFile(keyFile)); err != nil {
+		t.Errorf("error reopening with the same key: %s", err)
+	}
+	if err := reopened.setupEncryption(KeyFile(wrongKeyFile)); err == nil {
+		t.Error("expected error opening with the wrong key")
+	}
+	if err := reopened.setupEncryption(nil); err == nil {
+		t.Error("expected error opening without a key")
+	}
+
+	unencrypted, unencryptedCloser := newTestPersistence(t, encoding)
+	defer unencryptedCloser.Close()
+	if _, err := unencrypted.persistChunks(m1.Fingerprint(), fpToChunks[m1.Fingerprint()]); err != nil {
+		t.Fatal(err)
+	}
+	if err := unencrypted.setupEncryption(KeyFile(keyFile)); err == nil {
+		t.Error("expected error enabling encryption for existing storage")
+	}
+	if unencrypted.aead != nil {
+		t.Error("encryption enabled despite error")
+	}
+}
+
+func TestEncryptionChunkType0(t *testing.T) {
+	testEncryption(t, 0)
+}
+
+func TestEncryptionChunkType1(t *testing.T) {
+	testEncryption(t, 1)
+}
+
+func TestEncryptionChunkType2(t *testing.T) {
+	testEncryption(t, 2)
+}
+
+func TestRecoveryProgress(t *testing.T) {
+	p, closer := newTestPersistence(t, 1)
+	defer closer.Close()
+
+	fpToChunks := buildTestChunks(1)
+	for fp, chunks := range fpToChunks {
+		if _, err := p.persistChunks(fp, chunks); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Archive m1 and m2 but not m3, whose series file is thus orphaned.
+	for _, m := range []clientmodel.Metric{m1, m2} {
+		if err := p.archiveMetric(m.Fingerprint(), m, 0, 9); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if s := p.recoveryProgress.Status(); s.Started {
+		t.Fatalf("recovery unexpectedly started: %+v", s)
+	}
+	if err := p.recoverFromCrash(map[clientmodel.Fingerprint]*memorySeries{}); err != nil {
+		t.Fatal(err)
+	}
+
+	s := p.recoveryProgress.Status()
+	if !s.Started || s.InProgress {
+		t.Errorf("want recovery started and finished, got %+v", s)
+	}
+	if s.Phase != recoveryPhaseComplete {
+		t.Errorf("want phase %q, got %q", recoveryPhaseComplete, s.Phase)
+	}
+	if s.FilesScanned != 3 || s.FilesEstimated != 3 {
+		t.Errorf("want 3 files scanned and estimated, got %d and %d", s.FilesScanned, s.FilesEstimated)
+	}
+	if s.SeriesSanitized != 2 {
+		t.Errorf("want 2 series sanitized, got %d", s.SeriesSanitized)
+	}
+	if s.SeriesOrphaned != 1 {
+		t.Errorf("want 1 series orphaned, got %d", s.SeriesOrphaned)
+	}
+	if s.MetricsIndexed != 2 {
+		t.Errorf("want 2 metrics indexed, got %d", s.MetricsIndexed)
+	}
+	if s.ETA != 0 {
+		t.Errorf("want ETA 0 after recovery, got %v", s.ETA)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	dir := test.NewTemporaryDirectory("test_verify", t)
+	defer dir.Close()
+	p, err := newPersistence(dir.Path(), false, false, func() bool { return false }, 0, index.DefaultCacheSizes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fpToChunks := buildTestChunks(1)
+	for fp, chunks := range fpToChunks {
+		if _, err := p.persistChunks(fp, chunks); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Archive m1 and m2 but not m3, whose series file is thus orphaned.
+	for _, m := range []clientmodel.Metric{m1, m2} {
+		if err := p.archiveMetric(m.Fingerprint(), m, 0, 9); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Verify(dir.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ArchivedSeries != 2 || r.SeriesFiles != 3 || r.ChunksChecked != 30 {
+		t.Errorf("unexpected report:\n%s", r)
+	}
+	if len(r.Problems) != 1 {
+		t.Fatalf("want 1 problem, got:\n%s", r)
+	}
+
+	// Corrupt the encoding of the first chunk of m1.
+	f, err := os.OpenFile(p.fileNameForFingerprint(m1.Fingerprint()), os.O_WRONLY, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0xff}, chunkHeaderTypeOffset); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if r, err = Verify(dir.Path()); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Problems) != 2 {
+		t.Fatalf("want 2 problems, got:\n%s", r)
+	}
+	// Nothing must have been orphaned.
+	if _, err := os.Stat(p.fileNameForFingerprint(m3.Fingerprint())); err != nil {
+		t.Error(err)
+	}
+}
+
+type incrementalBatch struct {
+	fpToMetric      index.FingerprintMetricMapping
+	expectedLnToLvs index.LabelNameLabelValuesMapping
+	expectedLpToFps map[metric.LabelPair]codable.FingerprintSet
+}
+
+func testIndexing(t *testing.T, encoding ChunkEncoding) {
+	batches := []incrementalBatch{
+		{
+			fpToMetric: index.FingerprintMetricMapping{
+				0: {
+					clientmodel.MetricNameLabel: "metric_0",
+					"label_1":                   "value_1",
+				},
+				1: {
+					clientmodel.MetricNameLabel: "metric_0",
+					"label_2":                   "value_2",
+					"label_3":                   "value_3",
+				},
+				2: {
+					clientmodel.MetricNameLabel: "metric_1",
+					"label_1":                   "value_2",
+				},
+			},
+			expectedLnToLvs: index.LabelNameLabelValuesMapping{
+				clientmodel.MetricNameLabel: codable.LabelValueSet{
+					"metric_0": struct{}{},
+					"metric_1": struct{}{},
+				},
+				"label_1": codable.LabelValueSet{
+					"value_1": struct{}{},
+					"value_2": struct{}{},
+				},
+				"label_2": codable.LabelValueSet{
+					"value_2": struct{}{},
+				},
+				"label_3": codable.LabelValueSet{
+					"value_3": struct{}{},
+				},
+			},
+			expectedLpToFps: map[metric.LabelPair]codable.FingerprintSet{
+				metric.LabelPair{
+					Name:  clientmodel.MetricNameLabel,
+					Value: "metric_0",
+				}: codable.FingerprintSet{0: struct{}{}, 1: struct{}{}},
+				metric.LabelPair{
+					Name:  clientmodel.MetricNameLabel,
+					Value: "metric_1",
+				}: codable.FingerprintSet{2: struct{}{}},
+				metric.LabelPair{
+					Name:  "label_1",
+					Value: "value_1",
+				}: codable.FingerprintSet{0: struct{}{}},
+				metric.LabelPair{
+					Name:  "label_1",
+					Value: "value_2",
+				}: codable.FingerprintSet{2: struct{}{}},
+				metric.LabelPair{
+					Name:  "label_2",
+					Value: "value_2",
+				}: codable.FingerprintSet{1: struct{}{}},
+				metric.LabelPair{
+					Name:  "label_3",
+					Value: "value_3",
+				}: codable.FingerprintSet{1: struct{}{}},
+			},
+		}, {
+			fpToMetric: index.FingerprintMetricMapping{
+				3: {
+					clientmodel.MetricNameLabel: "metric_0",
+					"label_1":                   "value_3",
+				},
+				4: {
+					clientmodel.MetricNameLabel: "metric_2",
+					"label_2":                   "value_2",
+					"label_3":                   "value_1",
+				},
+				5: {
+					clientmodel.MetricNameLabel: "metric_1",
+					"label_1":                   "value_3",
+				},
+			},
+			expectedLnToLvs: index.LabelNameLabelValuesMapping{
+				clientmodel.MetricNameLabel: codable.LabelValueSet{
+					"metric_0": struct{}{},
+					"metric_1": struct{}{},
+					"metric_2": struct{}{},
+				},
+				"label_1": codable.LabelValueSet{
+					"value_1": struct{}{},
+					"value_2": struct{}{},
+					"value_3": struct{}{},
+				},
+				"label_2": codable.LabelValueSet{
+					"value_2": struct{}{},
+				},
+				"label_3": codable.LabelValueSet{
+					"value_1": struct{}{},
+					"value_3": struct{}{},
+				},
+			},
+			expectedLpToFps: map[metric.LabelPair]codable.FingerprintSet{
+				metric.LabelPair{
+					Name:  clientmodel.MetricNameLabel,
+					Value: "metric_0",
+				}: codable.FingerprintSet{0: struct{}{}, 1: struct{}{}, 3: struct{}{}},
+				metric.LabelPair{
+					Name:  clientmodel.MetricNameLabel,
+					Value: "metric_1",
+				}: codable.FingerprintSet{2: struct{}{}, 5: struct{}{}},
+				metric.LabelPair{
 					Name:  clientmodel.MetricNameLabel,
 					Value: "metric_2",
 				}: codable.FingerprintSet{4: struct{}{}},
@@ -823,6 +1891,10 @@ func TestIndexingChunkType1(t *testing.T) {
 	testIndexing(t, 1)
 }
 
+func TestIndexingChunkType2(t *testing.T) {
+	testIndexing(t, 2)
+}
+
 func verifyIndexedState(i int, t *testing.T, b incrementalBatch, indexedFpsToMetrics index.FingerprintMetricMapping, p *persistence) {
 	p.waitForIndexing()
 	for fp, m := range indexedFpsToMetrics {
@@ -958,3 +2030,75 @@ func BenchmarkLoadChunkDescs(b *testing.B) {
 		}
 	}
 }
+
+func TestLabelIndexSnapshot(t *testing.T) {
+	p, closer := newTestPersistence(t, 1)
+	defer closer.Close()
+
+	// m1 and m2 are in memory, m3 is archived.
+	sm := newSeriesMap()
+	sm.put(m1.Fingerprint(), newMemorySeries(m1, true, 0))
+	sm.put(m2.Fingerprint(), newMemorySeries(m2, true, 0))
+	for _, m := range []clientmodel.Metric{m1, m2, m3} {
+		p.indexMetric(m.Fingerprint(), m)
+	}
+	if err := p.archiveMetric(m3.Fingerprint(), m3, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	p.waitForIndexing()
+	if n, err := p.writeLabelIndexSnapshot(sm); err != nil || n != 3 {
+		t.Fatalf("wrote %d series to snapshot, error %v", n, err)
+	}
+
+	// After the snapshot, m2 is gone and m4 is created. Then the label
+	// indexes are lost in a crash.
+	sm.del(m2.Fingerprint())
+	sm.put(m4.Fingerprint(), newMemorySeries(m4, true, 0))
+	if err := p.labelPairToFingerprints.Reset(index.PostingsBatch{}); err != nil {
+		t.Fatal(err)
+	}
+	p.indexMetric(m5.Fingerprint(), m5)
+	p.waitForIndexing()
+
+	fpToSeries := map[clientmodel.Fingerprint]*memorySeries{}
+	for fps := range sm.iter() {
+		fpToSeries[fps.fp] = fps.series
+	}
+	ok, err := p.rebuildLabelIndexesFromSnapshot(fpToSeries)
+	if err != nil || !ok {
+		t.Fatalf("rebuilt from snapshot: %v, error %v", ok, err)
+	}
+	p.waitForIndexing()
+
+	for _, m := range []clientmodel.Metric{m1, m3, m4} {
+		fps, err := p.getFingerprintsForLabelPair(metric.LabelPair{Name: "label", Value: m["label"]})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fps) != 1 || fps[0] != m.Fingerprint() {
+			t.Errorf("got fingerprints %v for %v, want %v", fps, m, m.Fingerprint())
+		}
+	}
+	values, err := p.getLabelValuesForLabelName("label")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Sort(values)
+	if want := (clientmodel.LabelValues{"value1", "value3", "value4"}); !reflect.DeepEqual(values, want) {
+		t.Errorf("got label values %v, want %v", values, want)
+	}
+
+	// A corrupt snapshot is rejected.
+	fileName := filepath.Join(p.basePath, labelIndexSnapshotFileName)
+	buf, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[len(buf)-5] ^= 0xff
+	if err := ioutil.WriteFile(fileName, buf, 0640); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.loadLabelIndexSnapshot(); err == nil {
+		t.Error("expected error loading corrupt snapshot")
+	}
+}
@@ -14,15 +14,28 @@
 package local
 
 import (
+	"errors"
 	"time"
 
 	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/metric"
 )
 
+// ErrDeadlineExceeded is returned by a Preloader after its deadline has
+// passed.
+var ErrDeadlineExceeded = errors.New("deadline exceeded while preloading chunks")
+
+// ErrCanceled is returned by a Preloader after its cancel channel has been
+// closed.
+var ErrCanceled = errors.New("canceled while preloading chunks")
+
 // memorySeriesPreloader is a Preloader for the memorySeriesStorage.
 type memorySeriesPreloader struct {
 	storage          *memorySeriesStorage
 	pinnedChunkDescs []*chunkDesc
+	pinnedCold       []*coldCacheEntry
+	abort            preloadAbort
 }
 
 // PreloadRange implements Preloader.
@@ -31,11 +44,59 @@ func (p *memorySeriesPreloader) PreloadRange(
 	from clientmodel.Timestamp, through clientmodel.Timestamp,
 	stalenessDelta time.Duration,
 ) error {
-	cds, err := p.storage.preloadChunksForRange(fp, from, through, stalenessDelta)
+	cds, err := p.storage.preloadChunksForRange(fp, from, through, stalenessDelta, p.abort)
+	if err != nil {
+		return err
+	}
+	p.pinnedChunkDescs = append(p.pinnedChunkDescs, cds...)
+	return p.preloadCold(fp, from, through, stalenessDelta)
+}
+
+// PreloadRanges implements Preloader.
+func (p *memorySeriesPreloader) PreloadRanges(
+	ranges map[clientmodel.Fingerprint]metric.Interval,
+	stalenessDelta time.Duration,
+) error {
+	cds, err := p.storage.preloadChunksForRanges(ranges, stalenessDelta, p.abort)
 	if err != nil {
 		return err
 	}
 	p.pinnedChunkDescs = append(p.pinnedChunkDescs, cds...)
+	for fp, in := range ranges {
+		if err := p.preloadCold(fp, in.OldestInclusive, in.NewestInclusive, stalenessDelta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// preloadCold fetches the chunks of the given range from the cold tier, if
+// any. It is called after preloading the local chunks, so that chunks moved to
+// the cold tier in the meantime are not missed.
+func (p *memorySeriesPreloader) preloadCold(
+	fp clientmodel.Fingerprint,
+	from clientmodel.Timestamp, through clientmodel.Timestamp,
+	stalenessDelta time.Duration,
+) error {
+	entries, err := p.storage.coldTier.preload(fp, from.Add(-stalenessDelta), through.Add(stalenessDelta), p.abort)
+	if err != nil {
+		return err
+	}
+	p.pinnedCold = append(p.pinnedCold, entries...)
+	return nil
+}
+
+// PreloadRollupRange implements Preloader.
+func (p *memorySeriesPreloader) PreloadRollupRange(
+	fp clientmodel.Fingerprint,
+	from clientmodel.Timestamp, through clientmodel.Timestamp,
+	rangeDuration, stalenessDelta time.Duration,
+) error {
+	for _, in := range p.storage.rawIntervalsForRollups(fp, from, through, rangeDuration) {
+		if err := p.PreloadRange(fp, in.OldestInclusive, in.NewestInclusive, stalenessDelta); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -97,11 +158,31 @@ func (p *memorySeriesPreloader) GetMetricRangeAtInterval(fp clientmodel.Fingerpr
 }
 */
 
+// NumChunks implements Preloader.
+func (p *memorySeriesPreloader) NumChunks() int {
+	n := len(p.pinnedChunkDescs)
+	for _, e := range p.pinnedCold {
+		n += len(e.chunks)
+	}
+	return n
+}
+
+// SetDeadline implements Preloader.
+func (p *memorySeriesPreloader) SetDeadline(deadline time.Time) {
+	p.abort.deadline = deadline
+}
+
+// SetCancel implements Preloader.
+func (p *memorySeriesPreloader) SetCancel(canceled <-chan struct{}) {
+	p.abort.canceled = canceled
+}
+
 // Close implements Preloader.
 func (p *memorySeriesPreloader) Close() {
 	for _, cd := range p.pinnedChunkDescs {
 		cd.unpin(p.storage.evictRequests)
 	}
 	chunkOps.WithLabelValues(unpin).Add(float64(len(p.pinnedChunkDescs)))
+	p.storage.coldTier.unpin(p.pinnedCold)
 
 }
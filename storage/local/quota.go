@@ -0,0 +1,115 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"sync"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+// SeriesQuota limits how many series with the same value of a label may be in
+// memory at the same time, e.g. per metric name or per job. Series without the
+// label are not limited.
+type SeriesQuota struct {
+	LabelName clientmodel.LabelName
+	MaxSeries int
+}
+
+// seriesQuotas keeps track of the number of series in memory per value of the
+// label of each quota. A nil *seriesQuotas enforces no quotas. All methods are
+// goroutine-safe.
+type seriesQuotas struct {
+	mtx    sync.Mutex
+	quotas []SeriesQuota
+	counts []map[clientmodel.LabelValue]int // Parallel to quotas.
+}
+
+// newSeriesQuotas returns a seriesQuotas enforcing the given quotas, or nil if
+// there are none.
+func newSeriesQuotas(quotas []SeriesQuota) *seriesQuotas {
+	if len(quotas) == 0 {
+		return nil
+	}
+	q := &seriesQuotas{
+		quotas: quotas,
+		counts: make([]map[clientmodel.LabelValue]int, len(quotas)),
+	}
+	for i := range q.counts {
+		q.counts[i] = map[clientmodel.LabelValue]int{}
+	}
+	return q
+}
+
+// tryAdd counts a new series with the given metric if that does not exceed any
+// quota. Otherwise, it returns false and the label name of the first exceeded
+// quota.
+func (q *seriesQuotas) tryAdd(m clientmodel.Metric) (clientmodel.LabelName, bool) {
+	if q == nil {
+		return "", true
+	}
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	for i, quota := range q.quotas {
+		if v, ok := m[quota.LabelName]; ok && q.counts[i][v] >= quota.MaxSeries {
+			return quota.LabelName, false
+		}
+	}
+	q.addLocked(m)
+	return "", true
+}
+
+// add counts a new series with the given metric, even if that exceeds a quota.
+// It is used for series that have to be in memory anyway, like those loaded
+// on startup or those unarchived for a query.
+func (q *seriesQuotas) add(m clientmodel.Metric) {
+	if q == nil {
+		return
+	}
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	q.addLocked(m)
+}
+
+func (q *seriesQuotas) addLocked(m clientmodel.Metric) {
+	for i, quota := range q.quotas {
+		if v, ok := m[quota.LabelName]; ok {
+			q.counts[i][v]++
+		}
+	}
+}
+
+// remove stops counting a series with the given metric, which has been removed
+// from memory.
+func (q *seriesQuotas) remove(m clientmodel.Metric) {
+	if q == nil {
+		return
+	}
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	for i, quota := range q.quotas {
+		v, ok := m[quota.LabelName]
+		if !ok {
+			continue
+		}
+		if q.counts[i][v] <= 1 {
+			delete(q.counts[i], v)
+		} else {
+			q.counts[i][v]--
+		}
+	}
+}
@@ -0,0 +1,249 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Phases of a crash recovery as reported by RecoveryProgress.
+const (
+	recoveryPhaseScanningFiles      = "scanning series files"
+	recoveryPhaseCheckingChanged    = "checking series changed since last checkpoint"
+	recoveryPhaseCheckingCheckpoint = "checking series without series file"
+	recoveryPhaseCleaningArchive    = "cleaning up archive indexes"
+	recoveryPhaseRebuildingIndexes  = "rebuilding label indexes"
+	recoveryPhaseComplete           = "complete"
+)
+
+var (
+	recoveryInProgressDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "crash_recovery_in_progress"),
+		"1 if a crash recovery of the local storage is in progress, 0 otherwise.",
+		nil, nil,
+	)
+	recoveryFilesScannedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "crash_recovery_files_scanned"),
+		"The number of series files scanned during the most recent crash recovery.",
+		nil, nil,
+	)
+	recoveryFilesEstimatedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "crash_recovery_files_estimated"),
+		"The estimated total number of series files to scan during the most recent crash recovery.",
+		nil, nil,
+	)
+	recoverySeriesSanitizedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "crash_recovery_series_sanitized"),
+		"The number of series sanitized during the most recent crash recovery.",
+		nil, nil,
+	)
+	recoverySeriesOrphanedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "crash_recovery_series_orphaned"),
+		"The number of series files moved to the orphaned directory during the most recent crash recovery.",
+		nil, nil,
+	)
+	recoveryMetricsIndexedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "crash_recovery_metrics_indexed"),
+		"The number of metrics queued for label indexing during the most recent crash recovery.",
+		nil, nil,
+	)
+	recoveryETADesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "crash_recovery_eta_seconds"),
+		"The estimated time in seconds until the file scan of a running crash recovery is complete, -1 if unknown.",
+		nil, nil,
+	)
+)
+
+// RecoveryStatus is a point-in-time view of a crash recovery, as returned by
+// RecoveryProgress.Status.
+type RecoveryStatus struct {
+	Started, InProgress bool
+	Phase               string
+	Begin               time.Time
+	Duration            time.Duration
+	FilesScanned        int
+	FilesEstimated      int // Total number of files to scan, 0 if unknown.
+	SeriesSanitized     int
+	SeriesOrphaned      int
+	MetricsIndexed      int
+	ETA                 time.Duration // Remaining time of the file scan, -1 if unknown.
+}
+
+// RecoveryProgress tracks the progress of a crash recovery of the local
+// storage. As crash recovery happens while the storage is created, a
+// RecoveryProgress can be handed in via MemorySeriesStorageOptions and be
+// inspected concurrently. It implements prometheus.Collector. All methods are
+// goroutine-safe.
+type RecoveryProgress struct {
+	mtx sync.Mutex
+
+	phase      string
+	begin, end time.Time
+
+	// The file scan iterates over a fixed number of series directories.
+	// As fingerprints are evenly distributed over those, the fraction of
+	// directories done is a good estimate of the fraction of files done.
+	dirsTotal, dirsScanned int
+	filesScanned           int
+	// If the number of files to scan is known upfront (as in WAL-based
+	// recovery), filesTotal is set and used instead of the directories.
+	filesTotal int
+
+	seriesSanitized, seriesOrphaned, metricsIndexed int
+}
+
+// NewRecoveryProgress returns a RecoveryProgress for a recovery that has not
+// started yet.
+func NewRecoveryProgress() *RecoveryProgress {
+	return &RecoveryProgress{}
+}
+
+func (rp *RecoveryProgress) start(phase string, dirsTotal, filesTotal int) {
+	rp.mtx.Lock()
+	defer rp.mtx.Unlock()
+
+	rp.phase = phase
+	rp.begin, rp.end = time.Now(), time.Time{}
+	rp.dirsTotal, rp.dirsScanned = dirsTotal, 0
+	rp.filesTotal, rp.filesScanned = filesTotal, 0
+	rp.seriesSanitized, rp.seriesOrphaned, rp.metricsIndexed = 0, 0, 0
+}
+
+func (rp *RecoveryProgress) setPhase(phase string) {
+	rp.mtx.Lock()
+	defer rp.mtx.Unlock()
+
+	rp.phase = phase
+	if phase == recoveryPhaseComplete {
+		rp.end = time.Now()
+	}
+}
+
+func (rp *RecoveryProgress) dirScanned() {
+	rp.mtx.Lock()
+	defer rp.mtx.Unlock()
+
+	rp.dirsScanned++
+}
+
+func (rp *RecoveryProgress) fileScanned(sanitized bool) {
+	rp.mtx.Lock()
+	defer rp.mtx.Unlock()
+
+	rp.filesScanned++
+	if sanitized {
+		rp.seriesSanitized++
+	}
+}
+
+func (rp *RecoveryProgress) seriesSanitizedWithoutFile() {
+	rp.mtx.Lock()
+	defer rp.mtx.Unlock()
+
+	rp.seriesSanitized++
+}
+
+func (rp *RecoveryProgress) fileOrphaned() {
+	rp.mtx.Lock()
+	defer rp.mtx.Unlock()
+
+	rp.seriesOrphaned++
+}
+
+func (rp *RecoveryProgress) metricIndexed() {
+	rp.mtx.Lock()
+	defer rp.mtx.Unlock()
+
+	rp.metricsIndexed++
+}
+
+// Status returns the current status of the recovery.
+func (rp *RecoveryProgress) Status() RecoveryStatus {
+	rp.mtx.Lock()
+	defer rp.mtx.Unlock()
+
+	s := RecoveryStatus{
+		Started:         !rp.begin.IsZero(),
+		InProgress:      !rp.begin.IsZero() && rp.end.IsZero(),
+		Phase:           rp.phase,
+		Begin:           rp.begin,
+		FilesScanned:    rp.filesScanned,
+		SeriesSanitized: rp.seriesSanitized,
+		SeriesOrphaned:  rp.seriesOrphaned,
+		MetricsIndexed:  rp.metricsIndexed,
+		ETA:             -1,
+	}
+	if !s.Started {
+		return s
+	}
+	if s.InProgress {
+		s.Duration = time.Since(rp.begin)
+	} else {
+		s.Duration = rp.end.Sub(rp.begin)
+	}
+
+	// Estimate the fraction of the file scan done.
+	var done float64
+	switch {
+	case rp.filesTotal > 0:
+		s.FilesEstimated = rp.filesTotal
+		done = float64(rp.filesScanned) / float64(rp.filesTotal)
+	case rp.dirsTotal > 0 && rp.dirsScanned > 0:
+		done = float64(rp.dirsScanned) / float64(rp.dirsTotal)
+		s.FilesEstimated = int(float64(rp.filesScanned) / done)
+	}
+	switch {
+	case rp.phase != recoveryPhaseScanningFiles && rp.phase != recoveryPhaseCheckingChanged:
+		// File scan is over (or has not happened at all).
+		s.ETA = 0
+	case done > 0:
+		s.ETA = time.Duration(float64(s.Duration) * (1 - done) / done)
+	}
+	return s
+}
+
+// Describe implements prometheus.Collector.
+func (rp *RecoveryProgress) Describe(ch chan<- *prometheus.Desc) {
+	ch <- recoveryInProgressDesc
+	ch <- recoveryFilesScannedDesc
+	ch <- recoveryFilesEstimatedDesc
+	ch <- recoverySeriesSanitizedDesc
+	ch <- recoverySeriesOrphanedDesc
+	ch <- recoveryMetricsIndexedDesc
+	ch <- recoveryETADesc
+}
+
+// Collect implements prometheus.Collector.
+func (rp *RecoveryProgress) Collect(ch chan<- prometheus.Metric) {
+	s := rp.Status()
+
+	inProgress := 0.
+	if s.InProgress {
+		inProgress = 1
+	}
+	eta := -1.
+	if s.ETA >= 0 {
+		eta = s.ETA.Seconds()
+	}
+	ch <- prometheus.MustNewConstMetric(recoveryInProgressDesc, prometheus.GaugeValue, inProgress)
+	ch <- prometheus.MustNewConstMetric(recoveryFilesScannedDesc, prometheus.GaugeValue, float64(s.FilesScanned))
+	ch <- prometheus.MustNewConstMetric(recoveryFilesEstimatedDesc, prometheus.GaugeValue, float64(s.FilesEstimated))
+	ch <- prometheus.MustNewConstMetric(recoverySeriesSanitizedDesc, prometheus.GaugeValue, float64(s.SeriesSanitized))
+	ch <- prometheus.MustNewConstMetric(recoverySeriesOrphanedDesc, prometheus.GaugeValue, float64(s.SeriesOrphaned))
+	ch <- prometheus.MustNewConstMetric(recoveryMetricsIndexedDesc, prometheus.GaugeValue, float64(s.MetricsIndexed))
+	ch <- prometheus.MustNewConstMetric(recoveryETADesc, prometheus.GaugeValue, eta)
+}
@@ -0,0 +1,602 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/utility"
+)
+
+// Replication ships the series files of a primary storage to standby storages
+// by chunk records, together with the metrics of the series, so that a
+// standby has the same persisted chunks and indexes as its primary and can take
+// over reads. Chunks not yet persisted on the primary are not replicated.
+//
+// The primary records the fingerprint of each series whose series file or
+// archive index entry changes in its replicationJournal. A standby polls the
+// changes since the sequence number it has last seen and then syncs each
+// changed series: It tells the primary how many chunks it has and the hash of
+// its most recent chunk record. The primary looks for that record in its own
+// series file and returns the records following it, and how many records the
+// standby has to drop from the beginning of its file (as the primary has
+// dropped them in the meantime). If the record is not found (e.g. because the
+// series file has been compacted), the whole file is returned.
+//
+// After a restart of the primary (which starts a new journal epoch), after the
+// journal has overflowed, and after a restart of the standby, the standby
+// catches up by syncing all series the primary has and purging those it does
+// not have anymore. As syncing a series only transfers the chunks the standby
+// is missing, catching up is cheap for series that have not changed.
+
+const (
+	replicationChangesPath = "changes"
+	replicationSeriesPath  = "series"
+)
+
+// replicationJournal records the fingerprints of changed series with
+// consecutive sequence numbers. A nil *replicationJournal records nothing. All
+// methods are goroutine-safe.
+type replicationJournal struct {
+	epoch  uint64 // Random, so that standbys notice a restart of the primary.
+	maxLen int
+
+	mtx     sync.Mutex
+	first   uint64                    // The sequence number of changes[0].
+	changes []clientmodel.Fingerprint // Ordered by sequence number.
+}
+
+// newReplicationJournal returns a replicationJournal keeping up to maxLen
+// changes. Once full, the older half of the changes is forgotten, so that
+// standbys behind by more than that have to catch up with a full sync.
+func newReplicationJournal(maxLen int) *replicationJournal {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return &replicationJournal{
+		epoch:  binary.LittleEndian.Uint64(buf),
+		maxLen: maxLen,
+		first:  1,
+	}
+}
+
+// add records a change of the series with the given fingerprint.
+func (j *replicationJournal) add(fp clientmodel.Fingerprint) {
+	if j == nil {
+		return
+	}
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	if len(j.changes) >= j.maxLen {
+		n := len(j.changes) / 2
+		j.changes = append(j.changes[:0], j.changes[n:]...)
+		j.first += uint64(n)
+	}
+	j.changes = append(j.changes, fp)
+}
+
+// since returns the distinct fingerprints changed after the given sequence
+// number and the sequence number of the latest change. If the changes are not
+// known anymore, ok is false.
+func (j *replicationJournal) since(seq uint64) (fps []clientmodel.Fingerprint, latest uint64, ok bool) {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	latest = j.first + uint64(len(j.changes)) - 1
+	if seq+1 < j.first || seq > latest {
+		return nil, latest, false
+	}
+	seen := map[clientmodel.Fingerprint]struct{}{}
+	for _, fp := range j.changes[seq+1-j.first:] {
+		if _, ok := seen[fp]; !ok {
+			seen[fp] = struct{}{}
+			fps = append(fps, fp)
+		}
+	}
+	return fps, latest, true
+}
+
+// replicationChanges is the response of the primary to a request for changes.
+type replicationChanges struct {
+	Epoch uint64 `json:"epoch"`
+	Seq   uint64 `json:"seq"`
+	// If Full is true, Fingerprints are all series of the primary, and the
+	// standby has to purge all other series.
+	Full         bool     `json:"full"`
+	RecordLen    int      `json:"recordLen"`
+	Fingerprints []string `json:"fingerprints"`
+}
+
+// replicatedSeries is the response of the primary to a request to sync a
+// series. If Deleted is true, the primary has no series file for the
+// fingerprint anymore.
+type replicatedSeries struct {
+	Deleted bool               `json:"deleted"`
+	Metric  clientmodel.Metric `json:"metric"`
+	// The standby has to drop that many chunk records from the beginning
+	// of its series file and then append Records.
+	Drop    int    `json:"drop"`
+	Records []byte `json:"records"`
+	// The hash of the first chunk record of the primary, for the standby to
+	// check the result.
+	FirstHash string `json:"firstHash"`
+}
+
+// recordHash returns the hex-encoded SHA-256 hash of a chunk record.
+func recordHash(record []byte) string {
+	h := sha256.Sum256(record)
+	return hex.EncodeToString(h[:])
+}
+
+// NewReplicationHandler returns an http.Handler serving the replication stream
+// of the given storage to standbys. It responds with 404 Not Found if the
+// storage keeps no replication journal.
+func NewReplicationHandler(s Storage) http.Handler {
+	ms, ok := s.(*memorySeriesStorage)
+	if !ok || ms.persistence.replicationJournal == nil {
+		return http.NotFoundHandler()
+	}
+	return &replicationHandler{storage: ms}
+}
+
+type replicationHandler struct {
+	storage *memorySeriesStorage
+}
+
+func (h *replicationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var (
+		resp interface{}
+		err  error
+	)
+	switch strings.TrimPrefix(r.URL.Path, "/") {
+	case replicationChangesPath:
+		resp, err = h.changes(r.Form)
+	case replicationSeriesPath:
+		resp, err = h.series(r.Form)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		glog.Error("Error sending replication response: ", err)
+	}
+}
+
+// changes returns the series changed since the epoch and sequence number in
+// the request, or all series if those changes are not known.
+func (h *replicationHandler) changes(form url.Values) (*replicationChanges, error) {
+	epoch, _ := strconv.ParseUint(form.Get("epoch"), 10, 64)
+	seq, _ := strconv.ParseUint(form.Get("since"), 10, 64)
+
+	p := h.storage.persistence
+	j := p.replicationJournal
+	changes := &replicationChanges{
+		Epoch:     j.epoch,
+		RecordLen: p.chunkRecordLen(),
+	}
+	fps, latest, ok := j.since(seq)
+	changes.Seq = latest
+	if epoch != j.epoch || !ok {
+		// The journal is read before listing the series, so that changes
+		// during the listing are not missed by the next request.
+		changes.Full = true
+		fps = fps[:0]
+		for fp := range h.storage.fpToSeries.fpIter() {
+			fps = append(fps, fp)
+		}
+		archived, err := p.getFingerprintsModifiedBefore(clientmodel.Latest)
+		if err != nil {
+			return nil, err
+		}
+		fps = append(fps, archived...)
+	}
+	changes.Fingerprints = make([]string, len(fps))
+	for i, fp := range fps {
+		changes.Fingerprints[i] = fp.String()
+	}
+	return changes, nil
+}
+
+// series returns what the standby needs to sync the series with the
+// fingerprint in the request, given the number of chunks it has and the hash
+// of its last chunk record.
+func (h *replicationHandler) series(form url.Values) (*replicatedSeries, error) {
+	var fp clientmodel.Fingerprint
+	if err := fp.LoadFromString(form.Get("fp")); err != nil {
+		return nil, err
+	}
+	numStandbyChunks, _ := strconv.Atoi(form.Get("chunks"))
+	lastHash := form.Get("last")
+
+	s := h.storage
+	p := s.persistence
+	s.fpLocker.Lock(fp)
+	defer s.fpLocker.Unlock(fp)
+
+	var m clientmodel.Metric
+	if series, ok := s.fpToSeries.get(fp); ok {
+		m = series.metric
+	} else {
+		var err error
+		if m, err = p.getArchivedMetric(fp); err != nil {
+			return nil, err
+		}
+	}
+	buf, err := ioutil.ReadFile(p.fileNameForFingerprint(fp))
+	if os.IsNotExist(err) || (err == nil && len(buf) == 0) || m == nil {
+		return &replicatedSeries{Deleted: true}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	recordLen := p.chunkRecordLen()
+	numChunks := len(buf) / recordLen
+	buf = buf[:numChunks*recordLen]
+
+	rs := &replicatedSeries{
+		Metric:    m,
+		Drop:      numStandbyChunks,
+		Records:   buf,
+		FirstHash: recordHash(buf[:recordLen]),
+	}
+	if numStandbyChunks == 0 {
+		return rs, nil
+	}
+	// Look for the last record of the standby, most likely close to the end.
+	for i := numChunks - 1; i >= 0; i-- {
+		if recordHash(buf[i*recordLen:(i+1)*recordLen]) != lastHash {
+			continue
+		}
+		if drop := numStandbyChunks - i - 1; drop >= 0 {
+			rs.Drop = drop
+			rs.Records = buf[(i+1)*recordLen:]
+		}
+		break
+	}
+	return rs, nil
+}
+
+// replicaSync keeps a standby storage in sync with its primary.
+type replicaSync struct {
+	storage  *memorySeriesStorage
+	url      string // Of the replication endpoint of the primary.
+	interval time.Duration
+	client   *http.Client
+
+	mtx        sync.Mutex // Protects epoch and seq, and serializes syncs.
+	epoch, seq uint64     // Of the changes synced so far. 0 if nothing has been synced.
+
+	syncedSeries, droppedSamples prometheus.Counter
+	errors                       prometheus.Counter
+}
+
+// newReplicaSync returns a replicaSync polling the replication endpoint at the
+// given URL with the given interval.
+func newReplicaSync(s *memorySeriesStorage, url string, interval time.Duration) *replicaSync {
+	return &replicaSync{
+		storage:  s,
+		url:      strings.TrimSuffix(url, "/"),
+		interval: interval,
+		client:   utility.NewDeadlineClient(time.Minute),
+
+		syncedSeries: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "replication_synced_series_total",
+			Help:      "The total number of series synced from the replication primary.",
+		}),
+		droppedSamples: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "replication_standby_dropped_samples_total",
+			Help:      "The total number of samples appended to the storage and dropped because it is a replication standby.",
+		}),
+		errors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "replication_errors_total",
+			Help:      "The total number of failed requests to the replication primary and failed syncs of series.",
+		}),
+	}
+}
+
+// syncReplica syncs a standby storage with its primary periodically until the
+// storage is stopped. It returns a channel that is closed once it has stopped.
+func (s *memorySeriesStorage) syncReplica() <-chan struct{} {
+	stopped := make(chan struct{})
+	if s.replica == nil {
+		close(stopped)
+		return stopped
+	}
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(s.replica.interval)
+		defer ticker.Stop()
+		for {
+			if err := s.replica.sync(s.loopStopping); err != nil {
+				s.replica.errors.Inc()
+				glog.Error("Error syncing with the replication primary: ", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-s.loopStopping:
+				return
+			}
+		}
+	}()
+	return stopped
+}
+
+// sync syncs the series changed on the primary since the last sync. It is
+// goroutine-safe.
+func (r *replicaSync) sync(stopping <-chan struct{}) error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	var changes replicationChanges
+	if err := r.get(replicationChangesPath, url.Values{
+		"epoch": {strconv.FormatUint(r.epoch, 10)},
+		"since": {strconv.FormatUint(r.seq, 10)},
+	}, &changes); err != nil {
+		return err
+	}
+	if changes.RecordLen != r.storage.persistence.chunkRecordLen() {
+		return fmt.Errorf(
+			"chunk records of the primary have %d bytes, %d expected; standby and primary must both be encrypted or unencrypted",
+			changes.RecordLen, r.storage.persistence.chunkRecordLen(),
+		)
+	}
+	if changes.Full {
+		glog.Infof("Catching up with the replication primary, syncing all %d series...", len(changes.Fingerprints))
+	}
+
+	fps := make(map[clientmodel.Fingerprint]struct{}, len(changes.Fingerprints))
+	failed := 0
+	for _, s := range changes.Fingerprints {
+		select {
+		case <-stopping:
+			return nil
+		default:
+		}
+		var fp clientmodel.Fingerprint
+		if err := fp.LoadFromString(s); err != nil {
+			return err
+		}
+		fps[fp] = struct{}{}
+		if err := r.syncSeries(fp); err != nil {
+			r.errors.Inc()
+			glog.Errorf("Error syncing series %v from the replication primary: %v", fp, err)
+			failed++
+		}
+	}
+	if changes.Full {
+		purged := r.purgeAllBut(fps)
+		glog.Infof("Caught up with the replication primary, %d series synced, %d failed, %d purged.", len(fps)-failed, failed, purged)
+	}
+	if failed == 0 {
+		// Otherwise, retry with the same changes next time.
+		r.epoch, r.seq = changes.Epoch, changes.Seq
+	}
+	return nil
+}
+
+// syncSeries syncs the series with the given fingerprint.
+func (r *replicaSync) syncSeries(fp clientmodel.Fingerprint) error {
+	s := r.storage
+	p := s.persistence
+	recordLen := p.chunkRecordLen()
+
+	buf, err := ioutil.ReadFile(p.fileNameForFingerprint(fp))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	numChunks := len(buf) / recordLen
+	params := url.Values{
+		"fp":     {fp.String()},
+		"chunks": {strconv.Itoa(numChunks)},
+	}
+	if numChunks > 0 {
+		params.Set("last", recordHash(buf[(numChunks-1)*recordLen:numChunks*recordLen]))
+	}
+	var rs replicatedSeries
+	if err := r.get(replicationSeriesPath, params, &rs); err != nil {
+		return err
+	}
+	if rs.Deleted {
+		if numChunks > 0 || s.hasSeries(fp) {
+			s.purgeSeries(fp)
+		}
+		r.syncedSeries.Inc()
+		return nil
+	}
+	if rs.Drop > numChunks || len(rs.Records)%recordLen != 0 {
+		return fmt.Errorf("invalid response, dropping %d of %d chunks, receiving %d bytes", rs.Drop, numChunks, len(rs.Records))
+	}
+	records := append(buf[rs.Drop*recordLen:numChunks*recordLen], rs.Records...)
+	if len(records) == 0 || recordHash(records[:recordLen]) != rs.FirstHash {
+		if numChunks == 0 {
+			return fmt.Errorf("received inconsistent chunks")
+		}
+		// The series file has changed on the primary in the
+		// meantime. Start over with all its chunks.
+		if err := os.Remove(p.fileNameForFingerprint(fp)); err != nil {
+			return err
+		}
+		return r.syncSeries(fp)
+	}
+	if rs.Drop == 0 && len(rs.Records) == 0 {
+		r.syncedSeries.Inc()
+		return nil
+	}
+	if err := s.applyReplicatedSeries(fp, rs.Metric, records); err != nil {
+		return err
+	}
+	r.syncedSeries.Inc()
+	return nil
+}
+
+// get sends a request to the replication endpoint of the primary and decodes
+// the JSON response into v.
+func (r *replicaSync) get(path string, params url.Values, v interface{}) error {
+	resp, err := r.client.Get(r.url + "/" + path + "?" + params.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		buf, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("replication primary returned %s: %s", resp.Status, bytes.TrimSpace(buf))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// purgeAllBut purges all series except the given ones and returns how many
+// series have been purged.
+func (r *replicaSync) purgeAllBut(keep map[clientmodel.Fingerprint]struct{}) int {
+	s := r.storage
+	var fps []clientmodel.Fingerprint
+	for fp := range s.fpToSeries.fpIter() {
+		fps = append(fps, fp)
+	}
+	archived, err := s.persistence.getFingerprintsModifiedBefore(clientmodel.Latest)
+	if err != nil {
+		glog.Error("Error looking up archived series: ", err)
+	}
+	fps = append(fps, archived...)
+	purged := 0
+	for _, fp := range fps {
+		if _, ok := keep[fp]; !ok {
+			s.purgeSeries(fp)
+			purged++
+		}
+	}
+	return purged
+}
+
+// hasSeries returns whether the series with the given fingerprint is in memory
+// or archived.
+func (s *memorySeriesStorage) hasSeries(fp clientmodel.Fingerprint) bool {
+	if _, ok := s.fpToSeries.get(fp); ok {
+		return true
+	}
+	has, _, _, err := s.persistence.hasArchivedMetric(fp)
+	return err == nil && has
+}
+
+// applyReplicatedSeries replaces the series file of the series with the given
+// fingerprint by the given chunk records and archives the series with the
+// given metric. A series unarchived by a query in the meantime is archived
+// again, which is safe as a standby has no chunks that are not persisted.
+func (s *memorySeriesStorage) applyReplicatedSeries(fp clientmodel.Fingerprint, m clientmodel.Metric, records []byte) error {
+	s.fpLocker.Lock(fp)
+	defer s.fpLocker.Unlock(fp)
+
+	p := s.persistence
+	p.logSeriesChange(fp)
+	if err := os.MkdirAll(p.dirNameForFingerprint(fp), 0700); err != nil {
+		return err
+	}
+	temp, err := os.OpenFile(p.tempFileNameForFingerprint(fp), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	if _, err := temp.Write(records); err != nil {
+		temp.Close()
+		return err
+	}
+	p.closeChunkFile(temp)
+	if err := os.Rename(p.tempFileNameForFingerprint(fp), p.fileNameForFingerprint(fp)); err != nil {
+		return err
+	}
+	p.invalidateChunkCache(fp)
+
+	first := clientmodel.Timestamp(binary.LittleEndian.Uint64(records[chunkHeaderFirstTimeOffset:]))
+	lastRecord := records[len(records)-p.chunkRecordLen():]
+	last := clientmodel.Timestamp(binary.LittleEndian.Uint64(lastRecord[chunkHeaderLastTimeOffset:]))
+
+	if series, ok := s.fpToSeries.get(fp); ok {
+		s.fpToSeries.del(fp)
+		p.seriesRemoved(fp)
+		s.numSeries.Dec()
+		s.seriesQuotas.remove(series.metric)
+		numMemChunkDescs.Sub(float64(len(series.chunkDescs)))
+		return p.archiveMetric(fp, m, first, last)
+	}
+	has, _, _, err := p.hasArchivedMetric(fp)
+	if err != nil {
+		return err
+	}
+	if has {
+		p.updateArchivedTimeRange(fp, first, last)
+		return nil
+	}
+	p.indexMetric(fp, m)
+	return p.archiveMetric(fp, m, first, last)
+}
+
+// dropStandbySamples counts samples appended to a standby storage, which are
+// dropped as the standby only serves what it replicates. It returns false if
+// the storage is not a standby.
+func (s *memorySeriesStorage) dropStandbySamples(n int) bool {
+	if s.replica == nil {
+		return false
+	}
+	s.replica.droppedSamples.Add(float64(n))
+	return true
+}
+
+// Describe implements prometheus.Collector.
+func (r *replicaSync) Describe(ch chan<- *prometheus.Desc) {
+	ch <- r.syncedSeries.Desc()
+	ch <- r.droppedSamples.Desc()
+	ch <- r.errors.Desc()
+}
+
+// Collect implements prometheus.Collector.
+func (r *replicaSync) Collect(ch chan<- prometheus.Metric) {
+	ch <- r.syncedSeries
+	ch <- r.droppedSamples
+	ch <- r.errors
+}
@@ -0,0 +1,150 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+// diskUsageCheckInterval is how often the size of the storage is measured if
+// size-based retention is enabled.
+const diskUsageCheckInterval = time.Minute
+
+// dropBefore returns the time before which chunks are dropped by the
+// maintenance of series. It is determined by the retention period or, if the
+// storage has grown beyond its retention size, by the size cutoff, whichever
+// is later. A replication standby drops nothing by itself but only what its
+// primary drops.
+func (s *memorySeriesStorage) dropBefore() clientmodel.Timestamp {
+	if s.replica != nil {
+		return clientmodel.Earliest
+	}
+	t := clientmodel.TimestampFromTime(time.Now()).Add(-s.retention())
+	if c := clientmodel.Timestamp(atomic.LoadInt64(&s.sizeCutoff)); c.After(t) {
+		return c
+	}
+	return t
+}
+
+// SetRetention implements Storage.
+func (s *memorySeriesStorage) SetRetention(d time.Duration) {
+	if old := time.Duration(atomic.SwapInt64(&s.dropAfter, int64(d))); old != d {
+		glog.Infof("Retention period changed from %v to %v.", old, d)
+	}
+}
+
+// retention returns the current retention period.
+func (s *memorySeriesStorage) retention() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.dropAfter))
+}
+
+// checkDiskUsage measures the size of the storage periodically and advances
+// the size cutoff if required, until s.loopStopping is closed. It returns
+// immediately if size-based retention is disabled. The returned channel is
+// closed once checking has stopped.
+func (s *memorySeriesStorage) checkDiskUsage() <-chan struct{} {
+	stopped := make(chan struct{})
+	if s.retentionSize <= 0 {
+		close(stopped)
+		return stopped
+	}
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(diskUsageCheckInterval)
+		defer ticker.Stop()
+		for {
+			usage, err := s.persistence.diskUsage()
+			if err != nil {
+				glog.Error("Error measuring size of local storage: ", err)
+			} else {
+				s.diskUsage.Set(float64(usage))
+				s.maybeAdvanceSizeCutoff(usage, time.Now())
+			}
+			select {
+			case <-ticker.C:
+			case <-s.loopStopping:
+				return
+			}
+		}
+	}()
+	return stopped
+}
+
+// maybeAdvanceSizeCutoff moves the size cutoff forward if the given disk usage
+// exceeds the retention size. Assuming the data is evenly distributed over
+// time, the cutoff is advanced by the fraction of the retained time range
+// that corresponds to the excess bytes. As space is only reclaimed by the
+// maintenance sweeps, the cutoff is not advanced again before a complete
+// sweep through both memory and archived series has started after the
+// previous advance. Otherwise, more data than necessary would be dropped.
+func (s *memorySeriesStorage) maybeAdvanceSizeCutoff(usage int64, now time.Time) {
+	if usage <= s.retentionSize {
+		return
+	}
+	advanced := atomic.LoadInt64(&s.sizeCutoffAdvanced)
+	if advanced != 0 &&
+		(atomic.LoadInt64(&s.memorySweepBegin) < advanced ||
+			atomic.LoadInt64(&s.archivedSweepBegin) < advanced) {
+		return
+	}
+
+	cutoff := s.dropBefore()
+	retained := clientmodel.TimestampFromTime(now).Sub(cutoff)
+	if retained <= 0 {
+		return
+	}
+	excess := float64(usage-s.retentionSize) / float64(usage)
+	newCutoff := cutoff.Add(time.Duration(float64(retained) * excess))
+	atomic.StoreInt64(&s.sizeCutoff, int64(newCutoff))
+	atomic.StoreInt64(&s.sizeCutoffAdvanced, now.UnixNano())
+	glog.Warningf(
+		"Local storage uses %d bytes, exceeding the retention size of %d bytes. Dropping chunks older than %v.",
+		usage, s.retentionSize, newCutoff.Time(),
+	)
+}
+
+// diskUsage returns the number of bytes used by the files of the persistence,
+// excluding snapshots (which are hard links) and orphaned files (which cannot
+// be reclaimed by retention).
+func (p *persistence) diskUsage() (int64, error) {
+	var size int64
+	err := filepath.Walk(p.basePath, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Removed while walking.
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() && path != p.basePath {
+			switch fi.Name() {
+			case snapshotsDirName, "orphaned":
+				return filepath.SkipDir
+			}
+		}
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
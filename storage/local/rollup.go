@@ -0,0 +1,623 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+// Rollups aggregate the samples of a series into consecutive buckets of a
+// fixed resolution. They are stored in one file per series and resolution
+// below the rollups directory. A rollup file starts with a header containing
+// the start of the first bucket and the end of the last valid bucket (the
+// watermark), followed by one record per bucket without gaps. Records beyond
+// the watermark are left over from an interrupted append and are ignored.
+const (
+	rollupsDirName = "rollups"
+
+	rollupHeaderLen             = 16
+	rollupHeaderFirstOffset     = 0
+	rollupHeaderWatermarkOffset = 8
+
+	rollupRecordLen         = 32
+	rollupRecordMinOffset   = 0
+	rollupRecordMaxOffset   = 8
+	rollupRecordSumOffset   = 16
+	rollupRecordCountOffset = 24
+
+	rollupTempFileSuffix = ".db.tmp"
+
+	// A rollup resolution is only used for ranges spanning at least that
+	// many buckets. Otherwise, the raw samples at the edges of the range
+	// would dominate the work anyway.
+	rollupMinBucketsPerRange = 10
+
+	// How often the persisted chunks are checked for samples to roll up.
+	downsampleInterval = time.Hour
+)
+
+// rollupResolutions are the resolutions of the rollups maintained for each
+// series, coarsest first.
+var rollupResolutions = []time.Duration{time.Hour, 5 * time.Minute}
+
+// RollupResolution returns the resolution of the rollups to use when
+// aggregating over a range of the given duration, or 0 if the range is too
+// short to profit from rollups.
+func RollupResolution(rangeDuration time.Duration) time.Duration {
+	for _, res := range rollupResolutions {
+		if rangeDuration >= rollupMinBucketsPerRange*res {
+			return res
+		}
+	}
+	return 0
+}
+
+// alignDown returns the start of the bucket of resolution res containing t.
+func alignDown(t clientmodel.Timestamp, res time.Duration) clientmodel.Timestamp {
+	r := clientmodel.Timestamp(res / time.Millisecond)
+	aligned := t / r * r
+	if aligned > t {
+		// Division truncates towards zero for negative timestamps.
+		aligned -= r
+	}
+	return aligned
+}
+
+// alignUp returns the start of the first bucket of resolution res that does
+// not start before t.
+func alignUp(t clientmodel.Timestamp, res time.Duration) clientmodel.Timestamp {
+	aligned := alignDown(t, res)
+	if aligned < t {
+		aligned = aligned.Add(res)
+	}
+	return aligned
+}
+
+// rollupCoverage returns the part [from, through) of the given interval that
+// is made up of complete buckets of resolution res between first and
+// watermark. If no complete bucket is contained in the interval, from is not
+// before through.
+func rollupCoverage(
+	in metric.Interval, res time.Duration, first, watermark clientmodel.Timestamp,
+) (from, through clientmodel.Timestamp) {
+	from = alignUp(in.OldestInclusive, res)
+	if from.Before(first) {
+		from = first
+	}
+	through = alignDown(in.NewestInclusive+1, res)
+	if through.After(watermark) {
+		through = watermark
+	}
+	return from, through
+}
+
+func rollupDirName(res time.Duration) string {
+	return fmt.Sprintf("%dm", res/time.Minute)
+}
+
+func (p *persistence) rollupFileName(fp clientmodel.Fingerprint, res time.Duration) string {
+	fpStr := fp.String()
+	return path.Join(
+		p.basePath, rollupsDirName, rollupDirName(res),
+		fpStr[0:seriesDirNameLen], fpStr[seriesDirNameLen:]+seriesFileSuffix,
+	)
+}
+
+func (p *persistence) tempRollupFileName(fp clientmodel.Fingerprint, res time.Duration) string {
+	fpStr := fp.String()
+	return path.Join(
+		p.basePath, rollupsDirName, rollupDirName(res),
+		fpStr[0:seriesDirNameLen], fpStr[seriesDirNameLen:]+rollupTempFileSuffix,
+	)
+}
+
+func readRollupHeader(r io.ReaderAt) (first, watermark clientmodel.Timestamp, err error) {
+	buf := make([]byte, rollupHeaderLen)
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		return 0, 0, err
+	}
+	first = clientmodel.Timestamp(binary.LittleEndian.Uint64(buf[rollupHeaderFirstOffset:]))
+	watermark = clientmodel.Timestamp(binary.LittleEndian.Uint64(buf[rollupHeaderWatermarkOffset:]))
+	return first, watermark, nil
+}
+
+func writeRollupHeader(w io.WriterAt, first, watermark clientmodel.Timestamp) error {
+	buf := make([]byte, rollupHeaderLen)
+	binary.LittleEndian.PutUint64(buf[rollupHeaderFirstOffset:], uint64(first))
+	binary.LittleEndian.PutUint64(buf[rollupHeaderWatermarkOffset:], uint64(watermark))
+	_, err := w.WriteAt(buf, 0)
+	return err
+}
+
+// readRollups reads n rollups of resolution res from a rollup file, starting
+// with the bucket starting at from.
+func readRollups(
+	r io.ReaderAt, res time.Duration, first, from clientmodel.Timestamp, n int,
+) ([]metric.Rollup, error) {
+	buf := make([]byte, n*rollupRecordLen)
+	offset := rollupHeaderLen + int64(from.Sub(first)/res)*rollupRecordLen
+	if _, err := r.ReadAt(buf, offset); err != nil {
+		return nil, err
+	}
+	rollups := make([]metric.Rollup, n)
+	for i := range rollups {
+		rec := buf[i*rollupRecordLen:]
+		rollups[i] = metric.Rollup{
+			Timestamp: from.Add(time.Duration(i) * res),
+			Min:       clientmodel.SampleValue(math.Float64frombits(binary.LittleEndian.Uint64(rec[rollupRecordMinOffset:]))),
+			Max:       clientmodel.SampleValue(math.Float64frombits(binary.LittleEndian.Uint64(rec[rollupRecordMaxOffset:]))),
+			Sum:       clientmodel.SampleValue(math.Float64frombits(binary.LittleEndian.Uint64(rec[rollupRecordSumOffset:]))),
+			Count:     int(binary.LittleEndian.Uint64(rec[rollupRecordCountOffset:])),
+		}
+	}
+	return rollups, nil
+}
+
+func marshalRollups(rollups []metric.Rollup) []byte {
+	buf := make([]byte, len(rollups)*rollupRecordLen)
+	for i, r := range rollups {
+		rec := buf[i*rollupRecordLen:]
+		binary.LittleEndian.PutUint64(rec[rollupRecordMinOffset:], math.Float64bits(float64(r.Min)))
+		binary.LittleEndian.PutUint64(rec[rollupRecordMaxOffset:], math.Float64bits(float64(r.Max)))
+		binary.LittleEndian.PutUint64(rec[rollupRecordSumOffset:], math.Float64bits(float64(r.Sum)))
+		binary.LittleEndian.PutUint64(rec[rollupRecordCountOffset:], uint64(r.Count))
+	}
+	return buf
+}
+
+// rollupBounds returns the start of the first bucket and the watermark of the
+// rollups of resolution res stored for the series with the given
+// fingerprint. If no rollups are stored, ok is false. The caller must have
+// locked the fingerprint.
+func (p *persistence) rollupBounds(
+	fp clientmodel.Fingerprint, res time.Duration,
+) (first, watermark clientmodel.Timestamp, ok bool, err error) {
+	f, err := os.Open(p.rollupFileName(fp, res))
+	if os.IsNotExist(err) {
+		return 0, 0, false, nil
+	}
+	if err != nil {
+		return 0, 0, false, err
+	}
+	defer f.Close()
+
+	first, watermark, err = readRollupHeader(f)
+	if err == io.EOF {
+		// Creation of the file was interrupted.
+		return 0, 0, false, nil
+	}
+	if err != nil {
+		return 0, 0, false, err
+	}
+	return first, watermark, watermark.After(first), nil
+}
+
+// loadRollupsForInterval loads the rollups of resolution res covering the
+// given interval, as determined by rollupCoverage. The covered part of the
+// interval is returned as [from, through). If no rollups are stored or none of
+// them is contained in the interval, from is not before through. The caller
+// must have locked the fingerprint.
+func (p *persistence) loadRollupsForInterval(
+	fp clientmodel.Fingerprint, in metric.Interval, res time.Duration,
+) (rollups []metric.Rollup, from, through clientmodel.Timestamp, err error) {
+	f, err := os.Open(p.rollupFileName(fp, res))
+	if os.IsNotExist(err) {
+		return nil, 0, 0, nil
+	}
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer f.Close()
+
+	first, watermark, err := readRollupHeader(f)
+	if err == io.EOF {
+		return nil, 0, 0, nil
+	}
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	from, through = rollupCoverage(in, res, first, watermark)
+	if !from.Before(through) {
+		return nil, from, through, nil
+	}
+	rollups, err = readRollups(f, res, first, from, int(through.Sub(from)/res))
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return rollups, from, through, nil
+}
+
+// appendRollups appends the provided rollups of resolution res, which must be
+// consecutive buckets, to the rollup file of the series with the given
+// fingerprint. If the file exists, the first rollup must start at its
+// watermark. The caller must have locked the fingerprint.
+func (p *persistence) appendRollups(
+	fp clientmodel.Fingerprint, res time.Duration, rollups []metric.Rollup,
+) error {
+	if len(rollups) == 0 {
+		return nil
+	}
+	fname := p.rollupFileName(fp, res)
+	if err := os.MkdirAll(path.Dir(fname), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fname, os.O_RDWR|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	defer p.closeChunkFile(f)
+
+	first, watermark, err := readRollupHeader(f)
+	switch {
+	case err == io.EOF:
+		// New file.
+		first, watermark = rollups[0].Timestamp, rollups[0].Timestamp
+	case err != nil:
+		return err
+	case rollups[0].Timestamp != watermark:
+		return fmt.Errorf(
+			"rollups of resolution %v for fingerprint %v start at %v, expected %v",
+			res, fp, rollups[0].Timestamp, watermark,
+		)
+	}
+
+	offset := rollupHeaderLen + int64(watermark.Sub(first)/res)*rollupRecordLen
+	if _, err := f.WriteAt(marshalRollups(rollups), offset); err != nil {
+		return err
+	}
+	// Only advance the watermark once the records are written.
+	return writeRollupHeader(f, first, watermark.Add(time.Duration(len(rollups))*res))
+}
+
+// dropRollupsBefore drops all rollup buckets of the series with the given
+// fingerprint that end before or at beforeTime. Rollup files without any
+// remaining bucket are removed. The caller must have locked the fingerprint.
+func (p *persistence) dropRollupsBefore(fp clientmodel.Fingerprint, beforeTime clientmodel.Timestamp) error {
+	for _, res := range rollupResolutions {
+		first, watermark, ok, err := p.rollupBounds(fp, res)
+		if err != nil {
+			return err
+		}
+		keepFrom := alignDown(beforeTime, res)
+		if !ok || !keepFrom.After(first) {
+			continue
+		}
+		if !keepFrom.Before(watermark) {
+			if err := os.Remove(p.rollupFileName(fp, res)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := p.rewriteRollups(fp, res, first, keepFrom, watermark); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewriteRollups replaces the rollup file of resolution res by one containing
+// only the buckets in [from, watermark).
+func (p *persistence) rewriteRollups(
+	fp clientmodel.Fingerprint, res time.Duration, first, from, watermark clientmodel.Timestamp,
+) error {
+	f, err := os.Open(p.rollupFileName(fp, res))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rollups, err := readRollups(f, res, first, from, int(watermark.Sub(from)/res))
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.OpenFile(p.tempRollupFileName(fp, res), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	if err := writeRollupHeader(temp, from, watermark); err != nil {
+		temp.Close()
+		return err
+	}
+	if _, err := temp.WriteAt(marshalRollups(rollups), rollupHeaderLen); err != nil {
+		temp.Close()
+		return err
+	}
+	p.closeChunkFile(temp)
+	return os.Rename(p.tempRollupFileName(fp, res), p.rollupFileName(fp, res))
+}
+
+// deleteRollups deletes all rollup files of the series with the given
+// fingerprint. The caller must have locked the fingerprint.
+func (p *persistence) deleteRollups(fp clientmodel.Fingerprint) error {
+	for _, res := range rollupResolutions {
+		if err := os.Remove(p.rollupFileName(fp, res)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollUp aggregates the samples in the series file of the given fingerprint
+// into rollups of resolution res and appends them to the rollup file. Only
+// buckets after the current watermark are rolled up, and only if they end
+// before beforeTime and all their samples are persisted. It returns the
+// number of rollups appended. The caller must have locked the fingerprint.
+func (p *persistence) rollUp(
+	fp clientmodel.Fingerprint, res time.Duration, beforeTime clientmodel.Timestamp,
+) (int, error) {
+	f, err := p.openChunkFileForReading(fp)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	defer p.evictFromPageCache(f)
+
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	numChunks := int(fi.Size() / int64(p.chunkRecordLen()))
+	if numChunks == 0 {
+		return 0, nil
+	}
+	headerBuf := make([]byte, chunkHeaderLen)
+	readHeader := func(i int) (firstTime, lastTime clientmodel.Timestamp, err error) {
+		if _, err := f.ReadAt(headerBuf, p.offsetForChunkIndex(i)); err != nil {
+			return 0, 0, err
+		}
+		firstTime = clientmodel.Timestamp(binary.LittleEndian.Uint64(headerBuf[chunkHeaderFirstTimeOffset:]))
+		lastTime = clientmodel.Timestamp(binary.LittleEndian.Uint64(headerBuf[chunkHeaderLastTimeOffset:]))
+		return firstTime, lastTime, nil
+	}
+
+	// Samples are persisted in order, so all samples up to the last time
+	// of the last persisted chunk are in the series file.
+	_, lastPersisted, err := readHeader(numChunks - 1)
+	if err != nil {
+		return 0, err
+	}
+	end := lastPersisted + 1
+	if beforeTime.Before(end) {
+		end = beforeTime
+	}
+	end = alignDown(end, res)
+
+	_, start, ok, err := p.rollupBounds(fp, res)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		firstTime, _, err := readHeader(0)
+		if err != nil {
+			return 0, err
+		}
+		start = alignDown(firstTime, res)
+	}
+	if !start.Before(end) {
+		return 0, nil
+	}
+
+	// Find the first chunk that is not completely before start.
+	i := sort.Search(numChunks, func(i int) bool {
+		if err != nil {
+			return true
+		}
+		var lastTime clientmodel.Timestamp
+		_, lastTime, err = readHeader(i)
+		return !lastTime.Before(start)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	rollups := make([]metric.Rollup, int(end.Sub(start)/res))
+	for j := range rollups {
+		rollups[j].Timestamp = start.Add(time.Duration(j) * res)
+	}
+	in := metric.Interval{OldestInclusive: start, NewestInclusive: end - 1}
+	buf := make([]byte, p.chunkRecordLen())
+	for ; i < numChunks; i++ {
+		if _, err := f.ReadAt(buf, p.offsetForChunkIndex(i)); err != nil {
+			return 0, err
+		}
+		c, err := p.unmarshalChunkRecord(buf)
+		if err != nil {
+			return 0, err
+		}
+		if !c.firstTime().Before(end) {
+			break
+		}
+		for _, v := range c.newIterator().getRangeValues(in) {
+			rollups[v.Timestamp.Sub(start)/res].Add(v.Value)
+		}
+	}
+	if err := p.appendRollups(fp, res, rollups); err != nil {
+		return 0, err
+	}
+	return len(rollups), nil
+}
+
+// downsample rolls up the persisted samples of all series older than
+// s.downsampleAfter periodically, until s.loopStopping is closed. It returns
+// immediately if downsampling is disabled. The returned channel is closed
+// once downsampling has stopped.
+func (s *memorySeriesStorage) downsample() <-chan struct{} {
+	stopped := make(chan struct{})
+	if s.downsampleAfter <= 0 {
+		close(stopped)
+		return stopped
+	}
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(downsampleInterval)
+		defer ticker.Stop()
+		for {
+			beforeTime := clientmodel.TimestampFromTime(time.Now()).Add(-s.downsampleAfter)
+			s.downsampleAll(beforeTime)
+			select {
+			case <-ticker.C:
+			case <-s.loopStopping:
+				return
+			}
+		}
+	}()
+	return stopped
+}
+
+// downsampleAll rolls up the samples before beforeTime of all series in memory
+// and of all archived series with samples before beforeTime.
+func (s *memorySeriesStorage) downsampleAll(beforeTime clientmodel.Timestamp) {
+	stopping := false
+	for fp := range s.fpToSeries.fpIter() {
+		// Keep draining the iterator when stopping.
+		if stopping {
+			continue
+		}
+		select {
+		case <-s.loopStopping:
+			stopping = true
+			continue
+		default:
+		}
+		s.downsampleSeries(fp, beforeTime)
+	}
+	if stopping {
+		return
+	}
+	archivedFPs, err := s.persistence.getFingerprintsModifiedBefore(beforeTime)
+	if err != nil {
+		glog.Error("Failed to lookup archived fingerprint ranges: ", err)
+		return
+	}
+	for _, fp := range archivedFPs {
+		select {
+		case <-s.loopStopping:
+			return
+		default:
+		}
+		s.downsampleSeries(fp, beforeTime)
+	}
+}
+
+// downsampleSeries rolls up the persisted samples before beforeTime of the
+// series with the given fingerprint in all rollup resolutions.
+func (s *memorySeriesStorage) downsampleSeries(fp clientmodel.Fingerprint, beforeTime clientmodel.Timestamp) {
+	s.fpLocker.Lock(fp)
+	defer s.fpLocker.Unlock(fp)
+
+	for _, res := range rollupResolutions {
+		n, err := s.persistence.rollUp(fp, res, beforeTime)
+		if err != nil {
+			glog.Errorf("Error rolling up samples of fingerprint %v with resolution %v: %v", fp, res, err)
+			continue
+		}
+		s.rollupsWritten.Add(float64(n))
+	}
+}
+
+// rawIntervalsForRollups returns the intervals of raw samples needed in
+// addition to the rollups of the series with the given fingerprint to
+// aggregate over all ranges of the given duration that end between from and
+// through.
+func (s *memorySeriesStorage) rawIntervalsForRollups(
+	fp clientmodel.Fingerprint,
+	from, through clientmodel.Timestamp,
+	rangeDuration time.Duration,
+) []metric.Interval {
+	all := []metric.Interval{{OldestInclusive: from.Add(-rangeDuration), NewestInclusive: through}}
+	res := RollupResolution(rangeDuration)
+	if res == 0 {
+		return all
+	}
+
+	s.fpLocker.Lock(fp)
+	first, watermark, ok, err := s.persistence.rollupBounds(fp, res)
+	s.fpLocker.Unlock(fp)
+	if err != nil {
+		glog.Errorf("Error reading rollups of fingerprint %v: %v", fp, err)
+		return all
+	}
+	if !ok {
+		return all
+	}
+
+	// The latest range leaves the longest stretch at its beginning not
+	// covered by rollups, the earliest range the longest stretch at its
+	// end. See rollupCoverage.
+	leftEnd := alignUp(through.Add(-rangeDuration), res)
+	if leftEnd.Before(first) {
+		leftEnd = first
+	}
+	rightStart := alignDown(from+1, res)
+	if rightStart.After(watermark) {
+		rightStart = watermark
+	}
+	if !leftEnd.Before(rightStart) {
+		return all
+	}
+	intervals := make([]metric.Interval, 0, 2)
+	for _, in := range []metric.Interval{
+		{OldestInclusive: from.Add(-rangeDuration), NewestInclusive: leftEnd - 1},
+		{OldestInclusive: rightStart, NewestInclusive: through},
+	} {
+		if !in.NewestInclusive.Before(in.OldestInclusive) {
+			intervals = append(intervals, in)
+		}
+	}
+	return intervals
+}
+
+// rollupReader provides the rollups of a series to a SeriesIterator. The zero
+// value never returns any rollups.
+type rollupReader struct {
+	fp          clientmodel.Fingerprint
+	persistence *persistence
+	fpLocker    *fingerprintLocker
+}
+
+// GetRollups implements SeriesIterator.
+func (r rollupReader) GetRollups(in metric.Interval, res time.Duration) ([]metric.Rollup, metric.Interval, bool) {
+	if r.persistence == nil {
+		return nil, metric.Interval{}, false
+	}
+	r.fpLocker.Lock(r.fp)
+	defer r.fpLocker.Unlock(r.fp)
+
+	rollups, from, through, err := r.persistence.loadRollupsForInterval(r.fp, in, res)
+	if err != nil {
+		glog.Errorf("Error loading rollups of fingerprint %v: %v", r.fp, err)
+		return nil, metric.Interval{}, false
+	}
+	if !from.Before(through) {
+		return nil, metric.Interval{}, false
+	}
+	return rollups, metric.Interval{OldestInclusive: from, NewestInclusive: through - 1}, true
+}
@@ -16,6 +16,7 @@ package local
 import (
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	clientmodel "github.com/prometheus/client_golang/model"
@@ -32,6 +33,10 @@ const (
 	chunkDescEvictionFactor = 10
 
 	headChunkTimeout = time.Hour // Close head chunk if not touched for that long.
+
+	// chunkDescSize is a rough estimate of the memory taken by a chunkDesc,
+	// including the pointer to it in the chunkDescs slice of a series.
+	chunkDescSize = 64
 )
 
 // fingerprintSeriesPair pairs a fingerprint with a memorySeries pointer.
@@ -40,55 +45,116 @@ type fingerprintSeriesPair struct {
 	series *memorySeries
 }
 
+// seriesMapShards is the number of shards of a seriesMap. Like with the
+// fingerprintLocker, fingerprints are assigned to shards by their value.
+const seriesMapShards = 256
+
 // seriesMap maps fingerprints to memory series. All its methods are
 // goroutine-safe. A SeriesMap is effectively is a goroutine-safe version of
-// map[clientmodel.Fingerprint]*memorySeries.
+// map[clientmodel.Fingerprint]*memorySeries. To not serialize all appends and
+// queries on one mutex, the mappings are split into seriesMapShards shards,
+// each protected by its own mutex. Acquisitions of a shard mutex that had to
+// wait for another goroutine are counted as contentions.
 type seriesMap struct {
+	contentions int64 // Accessed atomically. Leading for 64-bit alignment.
+	shards      [seriesMapShards]seriesMapShard
+}
+
+// seriesMapShard is one shard of a seriesMap.
+type seriesMapShard struct {
 	mtx sync.RWMutex
 	m   map[clientmodel.Fingerprint]*memorySeries
 }
 
-// newSeriesMap returns a newly allocated empty seriesMap. To create a seriesMap
-// based on a prefilled map, use an explicit initializer.
+// newSeriesMap returns a newly allocated empty seriesMap.
 func newSeriesMap() *seriesMap {
-	return &seriesMap{m: make(map[clientmodel.Fingerprint]*memorySeries)}
+	sm := &seriesMap{}
+	for i := range sm.shards {
+		sm.shards[i].m = map[clientmodel.Fingerprint]*memorySeries{}
+	}
+	return sm
+}
+
+// newSeriesMapFrom returns a newly allocated seriesMap prefilled with the
+// mappings of the given map.
+func newSeriesMapFrom(m map[clientmodel.Fingerprint]*memorySeries) *seriesMap {
+	sm := newSeriesMap()
+	for fp, s := range m {
+		sm.shard(fp).m[fp] = s
+	}
+	return sm
+}
+
+// shard returns the shard the given fingerprint is assigned to.
+func (sm *seriesMap) shard(fp clientmodel.Fingerprint) *seriesMapShard {
+	return &sm.shards[uint(fp)%seriesMapShards]
+}
+
+// lock locks the given shard for writing, counting a contention if it has to
+// wait.
+func (sm *seriesMap) lock(sh *seriesMapShard) {
+	if !sh.mtx.TryLock() {
+		atomic.AddInt64(&sm.contentions, 1)
+		sh.mtx.Lock()
+	}
+}
+
+// rLock locks the given shard for reading, counting a contention if it has to
+// wait.
+func (sm *seriesMap) rLock(sh *seriesMapShard) {
+	if !sh.mtx.TryRLock() {
+		atomic.AddInt64(&sm.contentions, 1)
+		sh.mtx.RLock()
+	}
+}
+
+// numContentions returns how often acquiring a shard mutex had to wait so far.
+func (sm *seriesMap) numContentions() int64 {
+	return atomic.LoadInt64(&sm.contentions)
 }
 
 // length returns the number of mappings in the seriesMap.
 func (sm *seriesMap) length() int {
-	sm.mtx.RLock()
-	defer sm.mtx.RUnlock()
-
-	return len(sm.m)
+	n := 0
+	for i := range sm.shards {
+		sh := &sm.shards[i]
+		sm.rLock(sh)
+		n += len(sh.m)
+		sh.mtx.RUnlock()
+	}
+	return n
 }
 
 // get returns a memorySeries for a fingerprint. Return values have the same
 // semantics as the native Go map.
 func (sm *seriesMap) get(fp clientmodel.Fingerprint) (s *memorySeries, ok bool) {
-	sm.mtx.RLock()
-	defer sm.mtx.RUnlock()
+	sh := sm.shard(fp)
+	sm.rLock(sh)
+	defer sh.mtx.RUnlock()
 
-	s, ok = sm.m[fp]
+	s, ok = sh.m[fp]
 	return
 }
 
 // put adds a mapping to the seriesMap. It panics if s == nil.
 func (sm *seriesMap) put(fp clientmodel.Fingerprint, s *memorySeries) {
-	sm.mtx.Lock()
-	defer sm.mtx.Unlock()
-
 	if s == nil {
 		panic("tried to add nil pointer to seriesMap")
 	}
-	sm.m[fp] = s
+	sh := sm.shard(fp)
+	sm.lock(sh)
+	defer sh.mtx.Unlock()
+
+	sh.m[fp] = s
 }
 
 // del removes a mapping from the series Map.
 func (sm *seriesMap) del(fp clientmodel.Fingerprint) {
-	sm.mtx.Lock()
-	defer sm.mtx.Unlock()
+	sh := sm.shard(fp)
+	sm.lock(sh)
+	defer sh.mtx.Unlock()
 
-	delete(sm.m, fp)
+	delete(sh.m, fp)
 }
 
 // iter returns a channel that produces all mappings in the seriesMap. The
@@ -101,13 +167,16 @@ func (sm *seriesMap) del(fp clientmodel.Fingerprint) {
 func (sm *seriesMap) iter() <-chan fingerprintSeriesPair {
 	ch := make(chan fingerprintSeriesPair)
 	go func() {
-		sm.mtx.RLock()
-		for fp, s := range sm.m {
-			sm.mtx.RUnlock()
-			ch <- fingerprintSeriesPair{fp, s}
-			sm.mtx.RLock()
+		for i := range sm.shards {
+			sh := &sm.shards[i]
+			sm.rLock(sh)
+			for fp, s := range sh.m {
+				sh.mtx.RUnlock()
+				ch <- fingerprintSeriesPair{fp, s}
+				sm.rLock(sh)
+			}
+			sh.mtx.RUnlock()
 		}
-		sm.mtx.RUnlock()
 		close(ch)
 	}()
 	return ch
@@ -123,13 +192,16 @@ func (sm *seriesMap) iter() <-chan fingerprintSeriesPair {
 func (sm *seriesMap) fpIter() <-chan clientmodel.Fingerprint {
 	ch := make(chan clientmodel.Fingerprint)
 	go func() {
-		sm.mtx.RLock()
-		for fp := range sm.m {
-			sm.mtx.RUnlock()
-			ch <- fp
-			sm.mtx.RLock()
+		for i := range sm.shards {
+			sh := &sm.shards[i]
+			sm.rLock(sh)
+			for fp := range sh.m {
+				sh.mtx.RUnlock()
+				ch <- fp
+				sm.rLock(sh)
+			}
+			sh.mtx.RUnlock()
 		}
-		sm.mtx.RUnlock()
 		close(ch)
 	}()
 	return ch
@@ -162,6 +234,10 @@ type memorySeries struct {
 	// first chunk before its chunk desc is evicted. In doubt, this field is
 	// just set to the oldest possible timestamp.
 	savedFirstTime clientmodel.Timestamp
+	// When chunks of the series were last requested by a query. The zero
+	// value means the series has not been queried since it was created or
+	// unarchived. Used to evict the chunkDescs of idle series.
+	lastQueried time.Time
 	// Whether the current head chunk has already been finished.  If true,
 	// the current head chunk must not be modified anymore.
 	headChunkClosed bool
@@ -172,6 +248,21 @@ type memorySeries struct {
 	// Whether the series is inconsistent with the last checkpoint in a way
 	// that would require a disk seek during crash recovery.
 	dirty bool
+	// The state of the series as of the last checkpoint it was written
+	// to. Used to decide which series an incremental checkpoint has to
+	// include.
+	checkpointed seriesCheckpointState
+}
+
+// seriesCheckpointState captures everything of a memorySeries that ends up in a
+// checkpoint and may change without the series becoming dirty.
+type seriesCheckpointState struct {
+	numChunkDescs    int
+	persistWatermark int
+	chunkDescsOffset int
+	headLastTime     clientmodel.Timestamp
+	modTime          time.Time
+	savedFirstTime   clientmodel.Timestamp
 }
 
 // newMemorySeries returns a pointer to a newly allocated memorySeries for the
@@ -200,12 +291,14 @@ func newMemorySeries(
 }
 
 // add adds a sample pair to the series. It returns the number of newly
-// completed chunks (which are now eligible for persistence).
+// completed chunks (which are now eligible for persistence). The sample must
+// not be older than the last sample of the series. Use insert for that. If a
+// new head chunk has to be created, it uses the given encoding.
 //
 // The caller must have locked the fingerprint of the series.
-func (s *memorySeries) add(v *metric.SamplePair) int {
+func (s *memorySeries) add(v *metric.SamplePair, encoding ChunkEncoding) int {
 	if len(s.chunkDescs) == 0 || s.headChunkClosed {
-		newHead := newChunkDesc(newChunk())
+		newHead := newChunkDesc(newChunkForEncoding(encoding))
 		s.chunkDescs = append(s.chunkDescs, newHead)
 		s.headChunkClosed = false
 	} else if s.headChunkUsedByIterator && s.head().getRefCount() > 1 {
@@ -234,6 +327,46 @@ func (s *memorySeries) add(v *metric.SamplePair) int {
 	return len(chunks) - 1
 }
 
+// insert merges a sample older than the last sample of the series into the
+// open head chunk by re-encoding it. It returns the number of newly completed
+// chunks and whether the sample could be merged, which is not the case if the
+// head chunk is closed, if the sample is older than the first sample of the head
+// chunk, or if the head chunk already contains a sample with the same
+// timestamp.
+//
+// The caller must have locked the fingerprint of the series.
+func (s *memorySeries) insert(v *metric.SamplePair) (int, bool) {
+	if len(s.chunkDescs) == 0 || s.headChunkClosed || v.Timestamp.Before(s.head().firstTime()) {
+		return 0, false
+	}
+	// The head chunk is re-encoded into a new chunk, so iterators using
+	// the current version are not affected.
+	chunks := insertAndReencode(s.head().chunk, v)
+	if chunks == nil {
+		return 0, false
+	}
+	s.head().chunk = chunks[0]
+	s.headChunkUsedByIterator = false
+
+	for _, c := range chunks[1:] {
+		s.chunkDescs = append(s.chunkDescs, newChunkDesc(c))
+	}
+	return len(chunks) - 1, true
+}
+
+// headHasSampleAt returns whether the open head chunk contains a sample with
+// the given timestamp. It returns false if the head chunk is closed (and might
+// therefore be evicted).
+//
+// The caller must have locked the fingerprint of the series.
+func (s *memorySeries) headHasSampleAt(t clientmodel.Timestamp) bool {
+	if len(s.chunkDescs) == 0 || s.headChunkClosed {
+		return false
+	}
+	values := s.head().chunk.newIterator().getValueAtTime(t)
+	return len(values) == 1 && values[0].Timestamp == t
+}
+
 // maybeCloseHeadChunk closes the head chunk if it has not been touched for the
 // duration of headChunkTimeout. It returns whether the head chunk was closed.
 // If the head chunk is already closed, the method is a no-op and returns false.
@@ -253,11 +386,12 @@ func (s *memorySeries) maybeCloseHeadChunk() bool {
 	return false
 }
 
-// evictChunkDescs evicts chunkDescs if there are chunkDescEvictionFactor times
-// more than non-evicted chunks. iOldestNotEvicted is the index within the
-// current chunkDescs of the oldest chunk that is not evicted.
-func (s *memorySeries) evictChunkDescs(iOldestNotEvicted int) {
-	lenToKeep := chunkDescEvictionFactor * (len(s.chunkDescs) - iOldestNotEvicted)
+// evictChunkDescs evicts chunkDescs if there are evictionFactor times more than
+// non-evicted chunks (usually, evictionFactor is chunkDescEvictionFactor).
+// iOldestNotEvicted is the index within the current chunkDescs of the oldest
+// chunk that is not evicted.
+func (s *memorySeries) evictChunkDescs(iOldestNotEvicted, evictionFactor int) {
+	lenToKeep := evictionFactor * (len(s.chunkDescs) - iOldestNotEvicted)
 	if lenToKeep < len(s.chunkDescs) {
 		s.savedFirstTime = s.firstTime()
 		lenEvicted := len(s.chunkDescs) - lenToKeep
@@ -301,24 +435,14 @@ func (s *memorySeries) dropChunks(t clientmodel.Timestamp) {
 }
 
 // preloadChunks is an internal helper method.
-func (s *memorySeries) preloadChunks(indexes []int, mss *memorySeriesStorage) ([]*chunkDesc, error) {
-	loadIndexes := []int{}
-	pinnedChunkDescs := make([]*chunkDesc, 0, len(indexes))
-	for _, idx := range indexes {
-		cd := s.chunkDescs[idx]
-		pinnedChunkDescs = append(pinnedChunkDescs, cd)
-		cd.pin(mss.evictRequests) // Have to pin everything first to prevent immediate eviction on chunk loading.
-		if cd.isEvicted() {
-			loadIndexes = append(loadIndexes, idx)
-		}
-	}
-	chunkOps.WithLabelValues(pin).Add(float64(len(pinnedChunkDescs)))
-
+func (s *memorySeries) preloadChunks(
+	indexes []int, fp clientmodel.Fingerprint, mss *memorySeriesStorage,
+) ([]*chunkDesc, error) {
+	pinnedChunkDescs, loadIndexes := s.pinChunks(indexes, mss)
 	if len(loadIndexes) > 0 {
 		if s.chunkDescsOffset == -1 {
 			panic("requested loading chunks from persistence in a situation where we must not have persisted data for chunk descriptors in memory")
 		}
-		fp := s.metric.Fingerprint()
 		chunks, err := mss.loadChunks(fp, loadIndexes, s.chunkDescsOffset)
 		if err != nil {
 			// Unpin the chunks since we won't return them as pinned chunks now.
@@ -335,6 +459,23 @@ func (s *memorySeries) preloadChunks(indexes []int, mss *memorySeriesStorage) ([
 	return pinnedChunkDescs, nil
 }
 
+// pinChunks pins the chunkDescs with the given indexes without loading their
+// chunks. It returns the pinned chunkDescs and the indexes of those among them
+// that are evicted. The caller must have locked the fingerprint of the series.
+func (s *memorySeries) pinChunks(indexes []int, mss *memorySeriesStorage) (pinnedChunkDescs []*chunkDesc, evictedIndexes []int) {
+	pinnedChunkDescs = make([]*chunkDesc, 0, len(indexes))
+	for _, idx := range indexes {
+		cd := s.chunkDescs[idx]
+		pinnedChunkDescs = append(pinnedChunkDescs, cd)
+		cd.pin(mss.evictRequests) // Have to pin everything first to prevent immediate eviction on chunk loading.
+		if cd.isEvicted() {
+			evictedIndexes = append(evictedIndexes, idx)
+		}
+	}
+	chunkOps.WithLabelValues(pin).Add(float64(len(pinnedChunkDescs)))
+	return pinnedChunkDescs, evictedIndexes
+}
+
 /*
 func (s *memorySeries) preloadChunksAtTime(t clientmodel.Timestamp, p *persistence) (chunkDescs, error) {
 	s.mtx.Lock()
@@ -372,11 +513,35 @@ func (s *memorySeries) preloadChunksForRange(
 	from clientmodel.Timestamp, through clientmodel.Timestamp,
 	fp clientmodel.Fingerprint, mss *memorySeriesStorage,
 ) ([]*chunkDesc, error) {
+	indexes, err := s.indexesForRange(from, through, fp, mss)
+	if err != nil || len(indexes) == 0 {
+		return nil, err
+	}
+	return s.preloadChunks(indexes, fp, mss)
+}
+
+// indexesForRange returns the indexes of the chunkDescs covering the given
+// range, loading chunkDescs from the persistence if needed. The caller must
+// have locked the fingerprint of the series.
+func (s *memorySeries) indexesForRange(
+	from clientmodel.Timestamp, through clientmodel.Timestamp,
+	fp clientmodel.Fingerprint, mss *memorySeriesStorage,
+) ([]int, error) {
+	s.lastQueried = time.Now()
 	firstChunkDescTime := clientmodel.Latest
 	if len(s.chunkDescs) > 0 {
 		firstChunkDescTime = s.chunkDescs[0].firstTime()
 	}
-	if s.chunkDescsOffset != 0 && from.Before(firstChunkDescTime) {
+	if s.chunkDescsOffset > 0 && from.Before(firstChunkDescTime) {
+		// Only load the chunkDescs back to the one covering "from".
+		cds, err := mss.persistence.loadChunkDescsFromTail(fp, s.chunkDescsOffset, from)
+		if err != nil {
+			return nil, err
+		}
+		s.chunkDescs = append(cds, s.chunkDescs...)
+		s.chunkDescsOffset -= len(cds)
+		s.persistWatermark += len(cds)
+	} else if s.chunkDescsOffset != 0 && from.Before(firstChunkDescTime) {
 		cds, err := mss.loadChunkDescs(fp, firstChunkDescTime)
 		if err != nil {
 			return nil, err
@@ -409,12 +574,13 @@ func (s *memorySeries) preloadChunksForRange(
 	for i := fromIdx; i <= throughIdx; i++ {
 		pinIndexes = append(pinIndexes, i)
 	}
-	return s.preloadChunks(pinIndexes, mss)
+	return pinIndexes, nil
 }
 
-// newIterator returns a new SeriesIterator. The caller must have locked the
-// fingerprint of the memorySeries.
-func (s *memorySeries) newIterator(lockFunc, unlockFunc func()) SeriesIterator {
+// newIterator returns a new SeriesIterator, which provides rollups via the
+// given rollupReader. The caller must have locked the fingerprint of the
+// memorySeries.
+func (s *memorySeries) newIterator(lockFunc, unlockFunc func(), rr rollupReader) SeriesIterator {
 	chunks := make([]chunk, 0, len(s.chunkDescs))
 	for i, cd := range s.chunkDescs {
 		if chunk := cd.getChunk(); chunk != nil {
@@ -426,9 +592,10 @@ func (s *memorySeries) newIterator(lockFunc, unlockFunc func()) SeriesIterator {
 	}
 
 	return &memorySeriesIterator{
-		lock:   lockFunc,
-		unlock: unlockFunc,
-		chunks: chunks,
+		rollupReader: rr,
+		lock:         lockFunc,
+		unlock:       unlockFunc,
+		chunks:       chunks,
 	}
 }
 
@@ -439,6 +606,23 @@ func (s *memorySeries) head() *chunkDesc {
 	return s.chunkDescs[len(s.chunkDescs)-1]
 }
 
+// checkpointState returns the current checkpoint state of the series. The
+// caller must have locked the fingerprint of the memorySeries.
+func (s *memorySeries) checkpointState() seriesCheckpointState {
+	state := seriesCheckpointState{
+		numChunkDescs:    len(s.chunkDescs),
+		persistWatermark: s.persistWatermark,
+		chunkDescsOffset: s.chunkDescsOffset,
+		modTime:          s.modTime,
+		savedFirstTime:   s.savedFirstTime,
+	}
+	if s.persistWatermark < len(s.chunkDescs) {
+		// Only a non-persisted head chunk can still receive samples.
+		state.headLastTime = s.head().chunk.lastTime()
+	}
+	return state
+}
+
 // firstTime returns the timestamp of the first sample in the series. The caller
 // must have locked the fingerprint of the memorySeries.
 func (s *memorySeries) firstTime() clientmodel.Timestamp {
@@ -448,6 +632,20 @@ func (s *memorySeries) firstTime() clientmodel.Timestamp {
 	return s.savedFirstTime
 }
 
+// memoryUsage returns the number of chunkDescs, the number of chunks in memory,
+// and the estimated number of bytes taken by both. Chunks always occupy their
+// full capacity of chunkLen bytes, no matter how much of it is used. The caller
+// must have locked the fingerprint of the memorySeries.
+func (s *memorySeries) memoryUsage() (numChunkDescs, numMemoryChunks, bytes int) {
+	numChunkDescs = len(s.chunkDescs)
+	for _, cd := range s.chunkDescs {
+		if !cd.isEvicted() {
+			numMemoryChunks++
+		}
+	}
+	return numChunkDescs, numMemoryChunks, numChunkDescs*chunkDescSize + numMemoryChunks*chunkLen
+}
+
 // getChunksToPersist returns a slice of chunkDescs eligible for
 // persistence. It's the caller's responsibility to actually persist the
 // returned chunks afterwards. The method sets the persistWatermark and the
@@ -470,6 +668,7 @@ func (s *memorySeries) getChunksToPersist() []*chunkDesc {
 
 // memorySeriesIterator implements SeriesIterator.
 type memorySeriesIterator struct {
+	rollupReader
 	lock, unlock func()
 	chunkIt      chunkIterator
 	chunks       []chunk
@@ -600,8 +799,11 @@ func (it *memorySeriesIterator) GetRangeValues(in metric.Interval) metric.Values
 	return values
 }
 
-// nopSeriesIterator implements Series Iterator. It never returns any values.
-type nopSeriesIterator struct{}
+// nopSeriesIterator implements Series Iterator. It never returns any values,
+// but it returns the rollups of the embedded rollupReader.
+type nopSeriesIterator struct {
+	rollupReader
+}
 
 // GetValueAtTime implements SeriesIterator.
 func (_ nopSeriesIterator) GetValueAtTime(t clientmodel.Timestamp) metric.Values {
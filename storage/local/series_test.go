@@ -0,0 +1,90 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"sync"
+	"testing"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+func TestSeriesMap(t *testing.T) {
+	sm := newSeriesMap()
+	for fp := clientmodel.Fingerprint(0); fp < 1000; fp++ {
+		sm.put(fp, &memorySeries{})
+	}
+	if sm.length() != 1000 {
+		t.Fatalf("want 1000 series, got %d", sm.length())
+	}
+	for fp := clientmodel.Fingerprint(0); fp < 1000; fp += 2 {
+		sm.del(fp)
+	}
+	if _, ok := sm.get(2); ok {
+		t.Error("want deleted series to be gone")
+	}
+	if _, ok := sm.get(3); !ok {
+		t.Error("want series to be present")
+	}
+
+	seen := map[clientmodel.Fingerprint]bool{}
+	for pair := range sm.iter() {
+		if pair.fp%2 == 0 || seen[pair.fp] {
+			t.Errorf("unexpected fingerprint %v", pair.fp)
+		}
+		seen[pair.fp] = true
+	}
+	if len(seen) != 500 {
+		t.Errorf("want 500 series iterated, got %d", len(seen))
+	}
+	n := 0
+	for range sm.fpIter() {
+		n++
+	}
+	if n != 500 {
+		t.Errorf("want 500 fingerprints iterated, got %d", n)
+	}
+
+	loaded := newSeriesMapFrom(map[clientmodel.Fingerprint]*memorySeries{1: {}, 257: {}})
+	if loaded.length() != 2 {
+		t.Errorf("want 2 series, got %d", loaded.length())
+	}
+}
+
+func BenchmarkSeriesMapParallel(b *testing.B) {
+	numGoroutines := 10
+	numFingerprints := 1000
+	sm := newSeriesMap()
+	for i := 0; i < numFingerprints; i++ {
+		sm.put(clientmodel.Fingerprint(i), &memorySeries{})
+	}
+
+	wg := sync.WaitGroup{}
+	b.ResetTimer()
+	for i := 0; i < numGoroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			for j := 0; j < b.N; j++ {
+				fp := clientmodel.Fingerprint((i + j) % numFingerprints)
+				if _, ok := sm.get(fp); !ok {
+					b.Errorf("series for %v not found", fp)
+				}
+				sm.put(fp, &memorySeries{})
+			}
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+	b.ReportMetric(float64(sm.numContentions())/float64(b.N), "contentions/op")
+}
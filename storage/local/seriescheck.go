@@ -0,0 +1,201 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+// States of a series in a SeriesCheck.
+const (
+	SeriesInMemory = "memory"
+	SeriesArchived = "archived"
+	SeriesUnknown  = "unknown"
+)
+
+// SeriesCheck is the result of checking a single series for consistency
+// between its series file, its state in memory, and the indexes, as the
+// pedantic checks during crash recovery do for all series.
+type SeriesCheck struct {
+	Fingerprint  clientmodel.Fingerprint `json:"fingerprint"`
+	Metric       clientmodel.Metric      `json:"metric"`
+	State        string                  `json:"state"`
+	ChunksInFile int                     `json:"chunksInFile"`
+	// Problems lists the inconsistencies found. It is empty if the series
+	// is consistent.
+	Problems []string `json:"problems"`
+}
+
+func (c *SeriesCheck) problemf(format string, args ...interface{}) {
+	c.Problems = append(c.Problems, fmt.Sprintf(format, args...))
+}
+
+// CheckSeries implements Storage.
+func (s *memorySeriesStorage) CheckSeries(fps clientmodel.Fingerprints) []SeriesCheck {
+	// Pending index changes would show up as missing index entries.
+	s.persistence.waitForIndexing()
+
+	checks := make([]SeriesCheck, 0, len(fps))
+	for _, fp := range fps {
+		checks = append(checks, s.checkSeries(fp))
+	}
+	return checks
+}
+
+// checkSeries checks the series of the given fingerprint. It only reads, so
+// unlike crash recovery, it does not rectify anything it finds.
+func (s *memorySeriesStorage) checkSeries(fp clientmodel.Fingerprint) SeriesCheck {
+	s.fpLocker.Lock(fp)
+	defer s.fpLocker.Unlock(fp)
+
+	c := SeriesCheck{Fingerprint: fp, State: SeriesUnknown, Problems: []string{}}
+	headers, trailing, fi, err := s.persistence.readChunkHeaders(fp)
+	if err != nil {
+		c.problemf("error reading series file: %s", err)
+	}
+	c.ChunksInFile = len(headers)
+	if trailing != 0 {
+		c.problemf("series file has %d extraneous bytes after its last chunk", trailing)
+	}
+	for i := 1; i < len(headers); i++ {
+		if headers[i].firstTime().Before(headers[i-1].lastTime()) {
+			c.problemf("chunk %d in series file starts at %v before chunk %d ends at %v", i, headers[i].firstTime(), i-1, headers[i-1].lastTime())
+		}
+	}
+
+	archived, archivedFirst, archivedLast, err := s.persistence.hasArchivedMetric(fp)
+	if err != nil {
+		c.problemf("error looking up archived time range: %s", err)
+	}
+
+	if series, ok := s.fpToSeries.get(fp); ok {
+		c.State = SeriesInMemory
+		c.Metric = series.metric
+		if archived {
+			c.problemf("series is in memory but also archived")
+		}
+		s.checkMemorySeries(&c, series, headers, fi)
+	} else if archived {
+		c.State = SeriesArchived
+		if c.Metric, err = s.persistence.getArchivedMetric(fp); err != nil {
+			c.problemf("error looking up archived metric: %s", err)
+		}
+		switch {
+		case len(headers) == 0:
+			c.problemf("series is archived but has no chunks in its series file")
+		case headers[0].firstTime().Before(archivedFirst):
+			c.problemf("series file starts at %v before archived time range %v-%v", headers[0].firstTime(), archivedFirst, archivedLast)
+		case headers[len(headers)-1].lastTime() != archivedLast:
+			c.problemf("series file ends at %v, but archived time range is %v-%v", headers[len(headers)-1].lastTime(), archivedFirst, archivedLast)
+		}
+	} else if len(headers) > 0 {
+		c.problemf("series file exists for a series neither in memory nor archived")
+	}
+
+	if c.Metric != nil {
+		for ln, lv := range c.Metric {
+			fps, err := s.persistence.getFingerprintsForLabelPair(metric.LabelPair{Name: ln, Value: lv})
+			if err != nil {
+				c.problemf("error looking up label pair %s=%q: %s", ln, lv, err)
+				continue
+			}
+			indexed := false
+			for _, indexedFP := range fps {
+				if indexedFP == fp {
+					indexed = true
+					break
+				}
+			}
+			if !indexed {
+				c.problemf("label pair %s=%q is not indexed", ln, lv)
+			}
+		}
+	}
+	return c
+}
+
+// checkMemorySeries checks a series in memory against the chunk headers of its
+// series file. The caller must have locked the fingerprint.
+func (s *memorySeriesStorage) checkMemorySeries(c *SeriesCheck, series *memorySeries, headers []*chunkDesc, fi os.FileInfo) {
+	if series.chunkDescsOffset == -1 {
+		// Nothing is known about the chunks on disk.
+		return
+	}
+	if want := series.chunkDescsOffset + series.persistWatermark; len(headers) != want {
+		c.problemf(
+			"series file has %d chunks, want %d (chunkDescsOffset %d + persistWatermark %d)",
+			len(headers), want, series.chunkDescsOffset, series.persistWatermark,
+		)
+		return
+	}
+	if fi != nil && !series.modTime.IsZero() && !fi.ModTime().Equal(series.modTime) {
+		c.problemf("series file modified at %v, but series was last persisted at %v", fi.ModTime(), series.modTime)
+	}
+	for i, cd := range series.chunkDescs[:series.persistWatermark] {
+		h := headers[series.chunkDescsOffset+i]
+		if cd.firstTime() != h.firstTime() || cd.lastTime() != h.lastTime() {
+			c.problemf(
+				"chunk %d in memory spans %v-%v, but %v-%v in series file",
+				i, cd.firstTime(), cd.lastTime(), h.firstTime(), h.lastTime(),
+			)
+		}
+	}
+	if len(headers) > 0 && series.persistWatermark < len(series.chunkDescs) {
+		last := headers[len(headers)-1].lastTime()
+		if first := series.chunkDescs[series.persistWatermark].firstTime(); first.Before(last) {
+			c.problemf("first chunk not yet persisted starts at %v before series file ends at %v", first, last)
+		}
+	}
+}
+
+// readChunkHeaders returns chunkDescs with the time ranges of all chunks in the
+// series file of the given fingerprint, the number of extraneous bytes after
+// the last complete chunk, and the FileInfo of the file. A missing series file
+// is not an error. Unlike loadChunkDescs, the chunkDescs are not accounted for
+// as they are not meant to be kept.
+func (p *persistence) readChunkHeaders(fp clientmodel.Fingerprint) ([]*chunkDesc, int64, os.FileInfo, error) {
+	f, err := os.Open(p.fileNameForFingerprint(fp))
+	if os.IsNotExist(err) {
+		return nil, 0, nil, nil
+	}
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	defer f.Close()
+	defer p.evictFromPageCache(f)
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	numChunks := int(fi.Size()) / p.chunkRecordLen()
+	cds := make([]*chunkDesc, 0, numChunks)
+	buf := make([]byte, 16)
+	for i := 0; i < numChunks; i++ {
+		if _, err := f.ReadAt(buf, p.offsetForChunkIndex(i)+chunkHeaderFirstTimeOffset); err != nil {
+			return cds, 0, fi, err
+		}
+		cds = append(cds, &chunkDesc{
+			chunkFirstTime: clientmodel.Timestamp(binary.LittleEndian.Uint64(buf)),
+			chunkLastTime:  clientmodel.Timestamp(binary.LittleEndian.Uint64(buf[8:])),
+		})
+	}
+	return cds, fi.Size() % int64(p.chunkRecordLen()), fi, nil
+}
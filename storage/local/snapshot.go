@@ -0,0 +1,266 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/local/codable"
+	"github.com/prometheus/prometheus/storage/local/index"
+)
+
+const snapshotsDirName = "snapshots"
+
+// archivedSeries is the content of the archive indexes for a single
+// fingerprint.
+type archivedSeries struct {
+	metric      clientmodel.Metric
+	first, last clientmodel.Timestamp
+}
+
+// startSnapshot prepares the persistence for taking a snapshot. From now on,
+// unarchived metrics are remembered so that they can be added to the snapshot
+// later (as they are still archived in the checkpoint the snapshot is based
+// on). Only one snapshot can be in progress at a time.
+func (p *persistence) startSnapshot() error {
+	p.snapshotMtx.Lock()
+	defer p.snapshotMtx.Unlock()
+
+	if p.unarchivedDuringSnapshot != nil {
+		return errors.New("another snapshot is in progress")
+	}
+	p.unarchivedDuringSnapshot = map[clientmodel.Fingerprint]archivedSeries{}
+	return nil
+}
+
+// endSnapshot ends the snapshot started with startSnapshot.
+func (p *persistence) endSnapshot() {
+	p.snapshotMtx.Lock()
+	defer p.snapshotMtx.Unlock()
+
+	p.unarchivedDuringSnapshot = nil
+}
+
+// rememberUnarchived records the given archived series if a snapshot is in
+// progress. The caller must have locked the fingerprint.
+func (p *persistence) rememberUnarchived(fp clientmodel.Fingerprint, first, last clientmodel.Timestamp) error {
+	p.snapshotMtx.Lock()
+	defer p.snapshotMtx.Unlock()
+
+	if p.unarchivedDuringSnapshot == nil {
+		return nil
+	}
+	m, err := p.getArchivedMetric(fp)
+	if err != nil || m == nil {
+		return err
+	}
+	p.unarchivedDuringSnapshot[fp] = archivedSeries{metric: m, first: first, last: last}
+	return nil
+}
+
+// snapshot creates a snapshot of the storage in the given directory, which
+// must not exist yet and must be on the same file system as the storage. The
+// caller has to call startSnapshot and create a checkpoint before, and
+// endSnapshot afterwards.
+//
+// The heads file and the series files are hard-linked into the snapshot, the
+// incremental heads file and the archive indexes are copied. As series files are appended to in place, chunks
+// persisted after the checkpoint might show up in the snapshot, too. The
+// snapshot is therefore marked as dirty, so that starting a storage from it
+// runs crash recovery, which reconciles series files with the checkpoint and
+// rebuilds the label indexes.
+func (p *persistence) snapshot(dir string) (err error) {
+	glog.Infof("Creating snapshot in %s...", dir)
+	defer func() {
+		if err != nil {
+			glog.Errorf("Error creating snapshot in %s, removing it: %s", dir, err)
+			os.RemoveAll(dir)
+		}
+	}()
+
+	if _, err = os.Stat(dir); err == nil {
+		return fmt.Errorf("snapshot directory %s already exists", dir)
+	}
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err = copyFile(filepath.Join(p.basePath, versionFileName), filepath.Join(dir, versionFileName)); err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(dir, dirtyFileName))
+	if err != nil {
+		return err
+	}
+	f.Close()
+	if err = p.snapshotHeads(dir); err != nil {
+		return err
+	}
+	if err = p.snapshotArchiveIndexes(dir); err != nil {
+		return err
+	}
+	numFiles, err := p.snapshotSeriesFiles(dir)
+	if err != nil {
+		return err
+	}
+	glog.Infof("Done creating snapshot in %s, %d series files linked.", dir, numFiles)
+	return nil
+}
+
+// snapshotHeads hard-links the heads file into the snapshot directory. The
+// incremental heads file is copied, as it is appended to in place. The
+// checkpoint mutex is held so that both files are consistent with each other.
+func (p *persistence) snapshotHeads(dir string) error {
+	p.checkpointMtx.Lock()
+	defer p.checkpointMtx.Unlock()
+
+	if err := os.Link(p.headsFileName(), path.Join(dir, headsFileName)); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	err := copyFile(p.headsIncrementalFileName(), path.Join(dir, headsIncrementalFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// snapshotArchiveIndexes copies the archive indexes into new indexes in the
+// snapshot directory, adding the series unarchived since the snapshot was
+// started.
+func (p *persistence) snapshotArchiveIndexes(dir string) error {
+	fpToMetric, err := index.NewFingerprintMetricIndex(dir, p.indexCacheSizes.FingerprintToMetric)
+	if err != nil {
+		return err
+	}
+	defer fpToMetric.Close()
+	fpToTimeRange, err := index.NewFingerprintTimeRangeIndex(dir, p.indexCacheSizes.FingerprintTimeRange)
+	if err != nil {
+		return err
+	}
+	defer fpToTimeRange.Close()
+
+	if err := p.commitArchiveBatch(); err != nil {
+		return err
+	}
+	var (
+		fp codable.Fingerprint
+		m  codable.Metric
+		tr codable.TimeRange
+	)
+	if err := p.archivedFingerprintToMetrics.ForEach(func(kv index.KeyValueAccessor) error {
+		if err := kv.Key(&fp); err != nil {
+			return err
+		}
+		if err := kv.Value(&m); err != nil {
+			return err
+		}
+		return fpToMetric.Put(fp, m)
+	}); err != nil {
+		return err
+	}
+	if err := p.archivedFingerprintToTimeRange.ForEach(func(kv index.KeyValueAccessor) error {
+		if err := kv.Key(&fp); err != nil {
+			return err
+		}
+		if err := kv.Value(&tr); err != nil {
+			return err
+		}
+		return fpToTimeRange.Put(fp, tr)
+	}); err != nil {
+		return err
+	}
+
+	p.snapshotMtx.Lock()
+	defer p.snapshotMtx.Unlock()
+	for fp, s := range p.unarchivedDuringSnapshot {
+		if err := fpToMetric.Put(codable.Fingerprint(fp), codable.Metric(s.metric)); err != nil {
+			return err
+		}
+		if err := fpToTimeRange.Put(codable.Fingerprint(fp), codable.TimeRange{First: s.first, Last: s.last}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshotSeriesFiles hard-links all series files into the snapshot directory
+// and returns the number of files linked.
+func (p *persistence) snapshotSeriesFiles(dir string) (int, error) {
+	count := 0
+	seriesDirNameFmt := fmt.Sprintf("%%0%dx", seriesDirNameLen)
+	for i := 0; i < 1<<(seriesDirNameLen*4); i++ {
+		seriesDirName := fmt.Sprintf(seriesDirNameFmt, i)
+		srcDir := path.Join(p.basePath, seriesDirName)
+		d, err := os.Open(srcDir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return count, err
+		}
+		names, err := d.Readdirnames(-1)
+		d.Close()
+		if err != nil {
+			return count, err
+		}
+		dstDir := path.Join(dir, seriesDirName)
+		if err := os.MkdirAll(dstDir, 0700); err != nil {
+			return count, err
+		}
+		for _, name := range names {
+			if !strings.HasSuffix(name, seriesFileSuffix) {
+				// Most notably, skip temporary files.
+				continue
+			}
+			if err := os.Link(path.Join(srcDir, name), path.Join(dstDir, name)); err != nil {
+				if os.IsNotExist(err) {
+					// Series file deleted in the meantime.
+					continue
+				}
+				return count, err
+			}
+			count++
+		}
+	}
+	return count, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
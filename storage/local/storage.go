@@ -16,6 +16,11 @@ package local
 
 import (
 	"container/list"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -24,6 +29,7 @@ import (
 
 	clientmodel "github.com/prometheus/client_golang/model"
 
+	"github.com/prometheus/prometheus/storage/local/index"
 	"github.com/prometheus/prometheus/storage/metric"
 )
 
@@ -43,6 +49,12 @@ const (
 	// checkpoint anymore based on the dirty series count, and we do not
 	// sync series files anymore if using the adaptive sync strategy.
 	percentChunksToPersistForDegradation = 80
+	// If numChunksToPersist is this percentage of maxChunksToPersist,
+	// appending samples is delayed, increasingly with the number of chunks
+	// waiting for persistence, up to maxIngestionThrottleDelay per sample
+	// just before ingestion stops completely at maxChunksToPersist.
+	percentChunksToPersistForThrottling = 90
+	maxIngestionThrottleDelay           = time.Millisecond
 )
 
 var (
@@ -56,6 +68,16 @@ var (
 		"The maximum number of chunks that can be waiting for persistence before sample ingestion will stop.",
 		nil, nil,
 	)
+	seriesMapContentionsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "series_map_lock_contentions_total"),
+		"The total number of times looking up, adding, or removing a memory series had to wait for the lock of its series map shard.",
+		nil, nil,
+	)
+	rushedModeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, subsystem, "rushed_mode"),
+		"1 if the storage is in rushed mode (graceful degradation mode) because too many chunks are waiting for persistence, 0 otherwise.",
+		nil, nil,
+	)
 )
 
 type evictRequest struct {
@@ -81,17 +103,67 @@ type syncStrategy func() bool
 type memorySeriesStorage struct {
 	fpLocker   *fingerprintLocker
 	fpToSeries *seriesMap
+	mapper     *fpMapper
 
 	loopStopping, loopStopped  chan struct{}
-	maxMemoryChunks            int
-	dropAfter                  time.Duration
-	checkpointInterval         time.Duration
+	minCheckpointInterval      time.Duration
+	maxCheckpointInterval      time.Duration
 	checkpointDirtySeriesLimit int
+	checkpointInterval         prometheus.Gauge
+	numDirtySeries             int64 // Series changed since the last checkpoint. Accessed atomically.
+
+	// Limits that can be changed at runtime, see SetMemoryChunks and
+	// SetRetention. Accessed atomically.
+	maxMemoryChunks int64
+	dropAfter       int64 // A time.Duration.
+
+	// Heap-based eviction, see numChunksToEvict. If targetHeapSize is 0,
+	// maxMemoryChunks applies instead. heapSize and heapOverBudget are
+	// accessed atomically, lastEvictionNumGC is only accessed by
+	// handleEvictList.
+	targetHeapSize    uint64
+	heapSize          uint64 // HeapInuse as last read from runtime.MemStats.
+	heapOverBudget    int32  // 1 if heapSize exceeded targetHeapSize.
+	lastEvictionNumGC uint32
+
+	chunkDescIdleTimeout time.Duration // 0 if chunkDescs of idle series are not evicted.
 
 	numChunksToPersist int64 // The number of chunks waiting for persistence.
 	maxChunksToPersist int   // If numChunksToPersist reaches this threshold, ingestion will stall.
 	degraded           bool
 
+	// Size-based retention, see retention.go. The int64 fields are
+	// accessed atomically.
+	retentionSize      int64 // 0 if size-based retention is disabled.
+	sizeCutoff         int64 // Chunks older than that are dropped because of size-based retention.
+	sizeCutoffAdvanced int64 // When sizeCutoff was last advanced, in Unix nanoseconds.
+	memorySweepBegin   int64 // Begin of the last complete sweep through memory series, in Unix nanoseconds.
+	archivedSweepBegin int64 // Begin of the last complete sweep through archived series, in Unix nanoseconds.
+	diskUsage          prometheus.Gauge
+
+	downsampleAfter time.Duration // 0 if downsampling is disabled. See rollup.go.
+	rollupsWritten  prometheus.Counter
+
+	outOfOrderTolerance time.Duration // How much older than the last sample of its series a sample may be.
+
+	chunkEncoding ChunkEncoding // Of newly created chunks.
+
+	seriesQuotas *seriesQuotas // nil if no series quotas are enforced.
+	seriesChurn  *seriesChurn
+
+	purgeUnqueriedAfter time.Duration // 0 if archived series are never purged for not being queried.
+	queryLog            *queryLog     // nil if purgeUnqueriedAfter is 0.
+
+	compactionInterval time.Duration // 0 if compaction is disabled. See compaction.go.
+
+	coldTier *coldTier // nil if there is no cold tier. See coldtier.go.
+
+	replica *replicaSync // nil if the storage is not a replication standby. See replication.go.
+
+	indexCompactor *indexCompactor // nil if indexes are not compacted periodically. See indexcompaction.go.
+
+	labelIndexSnapshotInterval time.Duration // 0 if no label index snapshots are written. See labelsnapshot.go.
+
 	persistence *persistence
 
 	evictList                   *list.List
@@ -102,6 +174,10 @@ type memorySeriesStorage struct {
 	numSeries                   prometheus.Gauge
 	seriesOps                   *prometheus.CounterVec
 	ingestedSamplesCount        prometheus.Counter
+	ingestionThrottledDuration  prometheus.Counter
+	outOfOrderSamplesCount      *prometheus.CounterVec
+	duplicateSamplesCount       prometheus.Counter
+	quotaRejectedSamplesCount   *prometheus.CounterVec
 	invalidPreloadRequestsCount prometheus.Counter
 	maintainSeriesDuration      *prometheus.SummaryVec
 }
@@ -110,28 +186,93 @@ type memorySeriesStorage struct {
 // NewMemorySeriesStorage. It is not safe to leave any of those at their zero
 // values.
 type MemorySeriesStorageOptions struct {
-	MemoryChunks               int           // How many chunks to keep in memory.
-	MaxChunksToPersist         int           // Max number of chunks waiting to be persisted.
-	PersistenceStoragePath     string        // Location of persistence files.
-	PersistenceRetentionPeriod time.Duration // Chunks at least that old are dropped.
-	CheckpointInterval         time.Duration // How often to checkpoint the series map and head chunks.
-	CheckpointDirtySeriesLimit int           // How many dirty series will trigger an early checkpoint.
-	Dirty                      bool          // Force the storage to consider itself dirty on startup.
-	PedanticChecks             bool          // If dirty, perform crash-recovery checks on each series file.
-	SyncStrategy               SyncStrategy  // Which sync strategy to apply to series files.
+	MemoryChunks               int               // How many chunks to keep in memory.
+	TargetHeapSize             uint64            // If not 0, evict chunks to keep the heap below that many bytes instead of obeying MemoryChunks.
+	ChunkDescIdleTimeout       time.Duration     // Evict the chunkDescs of evicted chunks of series not queried for that long. 0 disables it.
+	LockDebugThreshold         time.Duration     // If not 0, log fingerprint lock-ordering violations and fingerprint locks held or waited for longer than that.
+	MaxChunksToPersist         int               // Max number of chunks waiting to be persisted.
+	ChunkEncoding              ChunkEncoding     // Encoding of newly created chunks, including those written by compaction and backfilling.
+	PersistenceStoragePath     string            // Location of persistence files.
+	PersistenceRetentionPeriod time.Duration     // Chunks at least that old are dropped.
+	PersistenceRetentionSize   int64             // If the storage is larger, the oldest chunks are dropped. 0 disables it.
+	MinCheckpointInterval      time.Duration     // Checkpoint the series map and head chunks at most that often...
+	MaxCheckpointInterval      time.Duration     // ...and at least that often.
+	CheckpointDirtySeriesLimit int               // How many dirty series will trigger an early checkpoint.
+	Dirty                      bool              // Force the storage to consider itself dirty on startup.
+	PedanticChecks             bool              // If dirty, perform crash-recovery checks on each series file.
+	SyncStrategy               SyncStrategy      // Which sync strategy to apply to series files.
+	WALFlushInterval           time.Duration     // How often to flush the write-ahead log. 0 disables it.
+	RecoveryProgress           *RecoveryProgress // Optional. Tracks the progress of crash recovery on startup.
+	DownsampleAfter            time.Duration     // Persisted samples at least that old are rolled up. 0 disables it.
+	CompactionInterval         time.Duration     // How often to compact series files. 0 disables it.
+	ChunkCacheSize             int               // Size in bytes of the cache for chunks loaded from series files. 0 disables it.
+	IndexCacheSizes            index.CacheSizes  // Sizes in bytes of the caches of the indexes. 0 selects the LevelDB default.
+	MmapSeriesFiles            bool              // Memory-map series files for loading, if supported by the platform.
+	ArchivedFilterSize         int               // Size in bytes of the bloom filter over archived fingerprints. 0 disables it.
+	MaintenanceIOBytes         int               // Max bytes per second read or written by checkpointing, dropping chunks, and crash recovery. 0 means no limit.
+	MaintenanceIOOps           int               // Max I/O operations per second of the same. 0 means no limit.
+	OutOfOrderTolerance        time.Duration     // Samples at most that much older than the last sample of their series are merged. 0 discards all out-of-order samples.
+	SeriesQuotas               []SeriesQuota     // Samples of new series exceeding any of these quotas are rejected.
+	PurgeUnqueriedAfter        time.Duration     // Archived series not queried for that long are purged, even within the retention period. 0 disables it.
+	EncryptionKey              KeyProvider       // If set, chunk data, checkpoints, and the write-ahead log are encrypted with AES-GCM.
+	CheckpointCompression      Compression       // Compression of the series in the heads file. The incremental heads file is never compressed.
+	DataSync                   bool              // Sync series files and checkpoints with fdatasync instead of fsync, if supported by the platform.
+	EvictFromPageCache         bool              // Evict written series files, checkpoints, and files scanned by maintenance from the page cache, if supported by the platform.
+	DirectIO                   bool              // Append chunks to series files with O_DIRECT. Only supported on 64-bit Linux.
+	ColdTier                   ObjectStore       // If set, persisted chunks older than ColdTierAfter are moved there.
+	ColdTierAfter              time.Duration     // Chunks ending that long ago are moved to the cold tier.
+	ColdCacheSize              int               // Size in bytes of the cache for chunks fetched from the cold tier.
+	ReplicationJournalLength   int               // How many series changes to keep for standbys. 0 disables serving replication.
+	ReplicateFrom              string            // If set, the URL of the replication endpoint of the primary this storage is a standby of.
+	ReplicationInterval        time.Duration     // How often a standby syncs with its primary.
+	IndexCompactionInterval    time.Duration     // How often to compact the indexes. 0 disables it.
+	IndexCompactionWindow      DailyWindow       // Compaction of the indexes is delayed until within this window.
+	LabelIndexSnapshotInterval time.Duration     // How often to write a snapshot of the label indexes for crash recovery. 0 disables it.
 }
 
 // NewMemorySeriesStorage returns a newly allocated Storage. Storage.Serve still
 // has to be called to start the storage.
 func NewMemorySeriesStorage(o *MemorySeriesStorageOptions) (Storage, error) {
+	if !o.ChunkEncoding.valid() {
+		return nil, fmt.Errorf("unknown chunk encoding: %v", o.ChunkEncoding)
+	}
+	if !o.CheckpointCompression.valid() {
+		return nil, fmt.Errorf("unknown checkpoint compression: %v", o.CheckpointCompression)
+	}
+	if o.ColdTier != nil && o.ColdTierAfter <= 0 {
+		return nil, fmt.Errorf("invalid cold tier period: %v", o.ColdTierAfter)
+	}
+	if o.ReplicateFrom != "" {
+		if o.ReplicationInterval <= 0 {
+			return nil, fmt.Errorf("invalid replication interval: %v", o.ReplicationInterval)
+		}
+		if o.ColdTier != nil || o.CompactionInterval > 0 {
+			// Both would change series files of the standby behind the
+			// back of the primary.
+			return nil, fmt.Errorf("a replication standby supports neither a cold tier nor compaction")
+		}
+	}
 	s := &memorySeriesStorage{
 		fpLocker: newFingerprintLocker(1024),
 
 		loopStopping:               make(chan struct{}),
 		loopStopped:                make(chan struct{}),
-		maxMemoryChunks:            o.MemoryChunks,
-		dropAfter:                  o.PersistenceRetentionPeriod,
-		checkpointInterval:         o.CheckpointInterval,
+		maxMemoryChunks:            int64(o.MemoryChunks),
+		targetHeapSize:             o.TargetHeapSize,
+		chunkDescIdleTimeout:       o.ChunkDescIdleTimeout,
+		dropAfter:                  int64(o.PersistenceRetentionPeriod),
+		retentionSize:              o.PersistenceRetentionSize,
+		sizeCutoff:                 int64(clientmodel.Earliest),
+		downsampleAfter:            o.DownsampleAfter,
+		outOfOrderTolerance:        o.OutOfOrderTolerance,
+		chunkEncoding:              o.ChunkEncoding,
+		seriesQuotas:               newSeriesQuotas(o.SeriesQuotas),
+		seriesChurn:                newSeriesChurn(),
+		purgeUnqueriedAfter:        o.PurgeUnqueriedAfter,
+		compactionInterval:         o.CompactionInterval,
+		labelIndexSnapshotInterval: o.LabelIndexSnapshotInterval,
+		minCheckpointInterval:      o.MinCheckpointInterval,
+		maxCheckpointInterval:      o.MaxCheckpointInterval,
 		checkpointDirtySeriesLimit: o.CheckpointDirtySeriesLimit,
 
 		maxChunksToPersist: o.MaxChunksToPersist,
@@ -168,6 +309,36 @@ func NewMemorySeriesStorage(o *MemorySeriesStorageOptions) (Storage, error) {
 			Name:      "ingested_samples_total",
 			Help:      "The total number of samples ingested.",
 		}),
+		ingestionThrottledDuration: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "ingestion_throttled_seconds_total",
+			Help:      "The total time appending samples was delayed or suspended because too many chunks were waiting for persistence.",
+		}),
+		outOfOrderSamplesCount: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "out_of_order_samples_total",
+				Help:      "The total number of samples older than the last sample of their series, by whether they were merged or discarded.",
+			},
+			[]string{outcomeLabel},
+		),
+		duplicateSamplesCount: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "duplicate_samples_total",
+			Help:      "The total number of samples discarded because their series already had a sample with the same timestamp.",
+		}),
+		quotaRejectedSamplesCount: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: subsystem,
+				Name:      "series_quota_rejected_samples_total",
+				Help:      "The total number of samples rejected because creating their series would have exceeded a series quota, by the label name of the quota.",
+			},
+			[]string{quotaLabel},
+		),
 		invalidPreloadRequestsCount: prometheus.NewCounter(prometheus.CounterOpts{
 			Namespace: namespace,
 			Subsystem: subsystem,
@@ -183,6 +354,27 @@ func NewMemorySeriesStorage(o *MemorySeriesStorageOptions) (Storage, error) {
 			},
 			[]string{seriesLocationLabel},
 		),
+		diskUsage: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "disk_usage_bytes",
+			Help:      "The size of the local storage on disk as last measured for size-based retention.",
+		}),
+		rollupsWritten: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "rollups_written_total",
+			Help:      "The total number of rollup buckets written by downsampling.",
+		}),
+		checkpointInterval: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "checkpoint_interval_seconds",
+			Help:      "The current interval between checkpoints, adapted to the rate at which series become dirty.",
+		}),
+	}
+	if o.LockDebugThreshold > 0 {
+		s.fpLocker.enableDebugging(o.LockDebugThreshold)
 	}
 
 	var syncStrategy syncStrategy
@@ -197,11 +389,59 @@ func NewMemorySeriesStorage(o *MemorySeriesStorageOptions) (Storage, error) {
 		panic("unknown sync strategy")
 	}
 
-	p, err := newPersistence(o.PersistenceStoragePath, o.Dirty, o.PedanticChecks, syncStrategy)
+	p, err := newPersistence(
+		o.PersistenceStoragePath, o.Dirty, o.PedanticChecks, syncStrategy, o.WALFlushInterval,
+		o.IndexCacheSizes,
+	)
 	if err != nil {
 		return nil, err
 	}
 	s.persistence = p
+	if err := p.setupEncryption(o.EncryptionKey); err != nil {
+		return nil, err
+	}
+	p.mmapSeriesFiles = o.MmapSeriesFiles && mmapSupported
+	p.chunkEncoding = o.ChunkEncoding
+	p.checkpointCompression = o.CheckpointCompression
+	p.dataSync = o.DataSync
+	p.pageCacheEviction = o.EvictFromPageCache
+	if o.DirectIO {
+		if err := p.checkDirectIO(); err != nil {
+			return nil, err
+		}
+		p.directIO = true
+	}
+	if o.RecoveryProgress != nil {
+		p.recoveryProgress = o.RecoveryProgress
+	}
+	if o.ChunkCacheSize > 0 {
+		p.chunkCache = newChunkCache(o.ChunkCacheSize)
+	}
+	p.ioThrottle = newIOThrottle(o.MaintenanceIOBytes, o.MaintenanceIOOps)
+	if o.ArchivedFilterSize > 0 {
+		if err := p.loadArchivedFilter(o.ArchivedFilterSize); err != nil {
+			return nil, err
+		}
+	}
+	if s.purgeUnqueriedAfter > 0 {
+		if s.queryLog, err = loadQueryLog(filepath.Join(p.basePath, queryLogFileName)); err != nil {
+			return nil, err
+		}
+	}
+	if o.ColdTier != nil {
+		if s.coldTier, err = newColdTier(o.ColdTier, o.ColdTierAfter, o.ColdCacheSize, p); err != nil {
+			return nil, err
+		}
+	}
+	if o.ReplicationJournalLength > 0 {
+		p.replicationJournal = newReplicationJournal(o.ReplicationJournalLength)
+	}
+	if o.ReplicateFrom != "" {
+		s.replica = newReplicaSync(s, o.ReplicateFrom, o.ReplicationInterval)
+	}
+	if o.IndexCompactionInterval > 0 {
+		s.indexCompactor = newIndexCompactor(o.IndexCompactionInterval, o.IndexCompactionWindow)
+	}
 
 	glog.Info("Loading series map and head chunks...")
 	s.fpToSeries, s.numChunksToPersist, err = p.loadSeriesMapAndHeads()
@@ -209,11 +449,128 @@ func NewMemorySeriesStorage(o *MemorySeriesStorageOptions) (Storage, error) {
 		return nil, err
 	}
 	glog.Infof("%d series loaded.", s.fpToSeries.length())
+	if s.seriesQuotas != nil {
+		for fps := range s.fpToSeries.iter() {
+			s.seriesQuotas.add(fps.series.metric)
+		}
+	}
+	if s.mapper, err = newFPMapper(s.fpToSeries, p); err != nil {
+		return nil, err
+	}
+	if err := s.replayWAL(); err != nil {
+		return nil, err
+	}
 	s.numSeries.Set(float64(s.fpToSeries.length()))
 
 	return s, nil
 }
 
+// replayWAL appends the samples from the WAL segments found on start-up to the
+// series they belong to, skipping those already contained in the checkpoint or
+// in series files. If anything had to be replayed or crash recovery was run, a
+// checkpoint is created right away, which also removes the replayed
+// segments. Only call during start-up.
+func (s *memorySeriesStorage) replayWAL() error {
+	p := s.persistence
+	if p.wal == nil || len(p.walSegments) == 0 {
+		return nil
+	}
+	glog.Info("Replaying WAL...")
+	var replayed, skipped int
+	lastTimes := map[clientmodel.Fingerprint]clientmodel.Timestamp{}
+	for _, n := range p.walSegments {
+		if err := p.wal.readSegment(n, func(rec *walRecord) {
+			if rec.recordType != walRecordSample {
+				return
+			}
+			lastTime, ok := lastTimes[rec.fp]
+			if !ok {
+				var err error
+				if lastTime, err = s.lastSampleTime(rec.fp); err != nil {
+					// Leave the series alone rather than
+					// appending to it blindly.
+					glog.Errorf("Skipping WAL samples of fingerprint %v: %v", rec.fp, err)
+					lastTime = clientmodel.Latest
+				}
+				lastTimes[rec.fp] = lastTime
+			}
+			if !rec.sample.Timestamp.After(lastTime) {
+				// The sample might have been merged out of
+				// order into the head chunk.
+				if series, ok := s.fpToSeries.get(rec.fp); ok {
+					sample := rec.sample
+					if n, ok := series.insert(&sample); ok {
+						s.incNumChunksToPersist(n)
+						replayed++
+						return
+					}
+				}
+				skipped++
+				return
+			}
+			series := s.getOrCreateSeries(rec.fp, rec.metric)
+			sample := rec.sample
+			s.incNumChunksToPersist(series.add(&sample, s.chunkEncoding))
+			lastTimes[rec.fp] = sample.Timestamp
+			replayed++
+		}); err == errWALCorrupted {
+			// Later records might depend on the corrupted one.
+			glog.Error("Stopping WAL replay at corrupted record, samples after it are lost.")
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	glog.Infof("Replayed %d samples from WAL, skipped %d samples already stored.", replayed, skipped)
+	if replayed > 0 || p.recoveredFromCrash {
+		if err := p.checkpointSeriesMapAndHeads(s.fpToSeries, s.fpLocker); err != nil {
+			glog.Error("Error checkpointing after WAL replay: ", err)
+		}
+	}
+	return nil
+}
+
+// lastSampleTime returns the timestamp of the most recent sample stored for
+// the given fingerprint, or clientmodel.Earliest if there is none. If all
+// chunkDescs of an in-memory series have been evicted, they are loaded from the
+// series file. If that fails, the series is left unchanged. Only call during
+// start-up.
+func (s *memorySeriesStorage) lastSampleTime(fp clientmodel.Fingerprint) (clientmodel.Timestamp, error) {
+	series, ok := s.fpToSeries.get(fp)
+	if !ok {
+		has, _, lastTime, err := s.persistence.hasArchivedMetric(fp)
+		if err != nil {
+			return 0, fmt.Errorf("error looking up archived time range: %s", err)
+		}
+		if !has {
+			return clientmodel.Earliest, nil
+		}
+		return lastTime, nil
+	}
+	if len(series.chunkDescs) == 0 && series.chunkDescsOffset > 0 {
+		// Only the most recent chunkDesc is needed.
+		cds, err := s.persistence.loadChunkDescsFromTail(fp, series.chunkDescsOffset, clientmodel.Latest)
+		if err != nil {
+			return 0, fmt.Errorf("error loading chunk descs: %s", err)
+		}
+		series.chunkDescs = cds
+		series.chunkDescsOffset -= len(cds)
+		series.persistWatermark = len(cds)
+	} else if len(series.chunkDescs) == 0 && series.chunkDescsOffset != 0 {
+		cds, err := s.loadChunkDescs(fp, clientmodel.Latest)
+		if err != nil {
+			return 0, fmt.Errorf("error loading chunk descs: %s", err)
+		}
+		series.chunkDescs = cds
+		series.chunkDescsOffset = 0
+		series.persistWatermark = len(cds)
+	}
+	if len(series.chunkDescs) == 0 {
+		return clientmodel.Earliest, nil
+	}
+	return series.head().lastTime(), nil
+}
+
 // Start implements Storage.
 func (s *memorySeriesStorage) Start() {
 	go s.handleEvictList()
@@ -237,6 +594,9 @@ func (s *memorySeriesStorage) Stop() error {
 		return err
 	}
 
+	if err := s.coldTier.close(); err != nil {
+		return err
+	}
 	if err := s.persistence.close(); err != nil {
 		return err
 	}
@@ -249,24 +609,85 @@ func (s *memorySeriesStorage) WaitForIndexing() {
 	s.persistence.waitForIndexing()
 }
 
+// SetMemoryChunks implements Storage.
+func (s *memorySeriesStorage) SetMemoryChunks(n int) {
+	if old := atomic.SwapInt64(&s.maxMemoryChunks, int64(n)); old != int64(n) {
+		glog.Infof("Number of chunks to keep in memory changed from %d to %d.", old, n)
+	}
+}
+
+// Dirty implements Storage.
+func (s *memorySeriesStorage) Dirty() bool {
+	return s.persistence.isDirty()
+}
+
+// Status implements Storage.
+func (s *memorySeriesStorage) Status() StorageStatus {
+	lastCheckpoint, lastCheckpointDuration := s.persistence.lastCheckpoint()
+	return StorageStatus{
+		MemorySeries:               s.fpToSeries.length(),
+		MemoryChunks:               int(atomic.LoadInt64(&numMemChunks)),
+		MaxMemoryChunks:            s.memoryChunksLimit(),
+		HeapSize:                   atomic.LoadUint64(&s.heapSize),
+		TargetHeapSize:             s.targetHeapSize,
+		ChunksToPersist:            s.getNumChunksToPersist(),
+		MaxChunksToPersist:         s.maxChunksToPersist,
+		Degraded:                   s.rushed(),
+		DirtySeries:                int(atomic.LoadInt64(&s.numDirtySeries)),
+		CheckpointDirtySeriesLimit: s.checkpointDirtySeriesLimit,
+		LastCheckpoint:             lastCheckpoint,
+		LastCheckpointDuration:     lastCheckpointDuration.Seconds(),
+		Dirty:                      s.persistence.isDirty(),
+		IndexingQueueLength:        len(s.persistence.indexingQueue),
+		IndexingQueueCapacity:      cap(s.persistence.indexingQueue),
+	}
+}
+
+// memoryChunksLimit returns how many chunks to keep in memory.
+func (s *memorySeriesStorage) memoryChunksLimit() int {
+	return int(atomic.LoadInt64(&s.maxMemoryChunks))
+}
+
 // NewIterator implements storage.
 func (s *memorySeriesStorage) NewIterator(fp clientmodel.Fingerprint) SeriesIterator {
 	s.fpLocker.Lock(fp)
 	defer s.fpLocker.Unlock(fp)
 
+	rr := rollupReader{
+		fp:          fp,
+		persistence: s.persistence,
+		fpLocker:    s.fpLocker,
+	}
 	series, ok := s.fpToSeries.get(fp)
 	if !ok {
 		// Oops, no series for fp found. That happens if, after
 		// preloading is done, the whole series is identified as old
-		// enough for purging and hence purged for good. As there is no
-		// data left to iterate over, return an iterator that will never
-		// return any values.
-		return nopSeriesIterator{}
+		// enough for purging and hence purged for good, or if only
+		// rollups or chunks from the cold tier were needed for the
+		// preloaded range. If there are no cold chunks either, return
+		// an iterator that will never return any values (but possibly
+		// rollups).
+		if cold := s.coldTier.chunksBefore(fp, clientmodel.Latest); len(cold) > 0 {
+			return &memorySeriesIterator{
+				rollupReader: rr,
+				lock:         func() { s.fpLocker.Lock(fp) },
+				unlock:       func() { s.fpLocker.Unlock(fp) },
+				chunks:       cold,
+			}
+		}
+		return nopSeriesIterator{rr}
 	}
-	return series.newIterator(
+	it := series.newIterator(
 		func() { s.fpLocker.Lock(fp) },
 		func() { s.fpLocker.Unlock(fp) },
-	)
+		rr,
+	).(*memorySeriesIterator)
+	// Chunks fetched from the cold tier precede the chunks of the series.
+	// Those that have not been dropped locally yet are left out.
+	if cold := s.coldTier.chunksBefore(fp, series.firstTime()); len(cold) > 0 {
+		it.chunks = append(cold, it.chunks...)
+	}
+	return it
 }
 
 // NewPreloader implements Storage.
@@ -278,59 +699,44 @@ func (s *memorySeriesStorage) NewPreloader() Preloader {
 
 // GetFingerprintsForLabelMatchers implements Storage.
 func (s *memorySeriesStorage) GetFingerprintsForLabelMatchers(labelMatchers metric.LabelMatchers) clientmodel.Fingerprints {
-	var result map[clientmodel.Fingerprint]struct{}
-	for _, matcher := range labelMatchers {
-		intersection := map[clientmodel.Fingerprint]struct{}{}
-		switch matcher.Type {
-		case metric.Equal:
-			fps, err := s.persistence.getFingerprintsForLabelPair(
-				metric.LabelPair{
-					Name:  matcher.Name,
-					Value: matcher.Value,
-				},
-			)
-			if err != nil {
-				glog.Error("Error getting fingerprints for label pair: ", err)
-			}
-			if len(fps) == 0 {
-				return nil
-			}
-			for _, fp := range fps {
-				if _, ok := result[fp]; ok || result == nil {
-					intersection[fp] = struct{}{}
-				}
-			}
-		default:
-			values, err := s.persistence.getLabelValuesForLabelName(matcher.Name)
-			if err != nil {
-				glog.Errorf("Error getting label values for label name %q: %v", matcher.Name, err)
-			}
-			matches := matcher.Filter(values)
-			if len(matches) == 0 {
-				return nil
-			}
-			for _, v := range matches {
-				fps, err := s.persistence.getFingerprintsForLabelPair(
-					metric.LabelPair{
-						Name:  matcher.Name,
-						Value: v,
-					},
-				)
-				if err != nil {
-					glog.Error("Error getting fingerprints for label pair: ", err)
-				}
-				for _, fp := range fps {
-					if _, ok := result[fp]; ok || result == nil {
-						intersection[fp] = struct{}{}
-					}
-				}
-			}
+	// Resolve the matchers concurrently. The index lookups of one matcher
+	// do not block those of the others.
+	sets := make([]map[clientmodel.Fingerprint]struct{}, len(labelMatchers))
+	if len(labelMatchers) == 1 {
+		sets[0] = s.getFingerprintsForLabelMatcher(labelMatchers[0])
+	} else {
+		var wg sync.WaitGroup
+		wg.Add(len(labelMatchers))
+		for i, matcher := range labelMatchers {
+			go func(i int, matcher *metric.LabelMatcher) {
+				defer wg.Done()
+				sets[i] = s.getFingerprintsForLabelMatcher(matcher)
+			}(i, matcher)
+		}
+		wg.Wait()
+	}
+	if len(sets) == 0 {
+		return nil
+	}
+
+	// Intersect, starting with the smallest set.
+	sort.Sort(fingerprintSetsBySize(sets))
+	result := sets[0]
+	for _, set := range sets[1:] {
+		if len(result) == 0 {
+			break
 		}
-		if len(intersection) == 0 {
-			return nil
+		intersection := make(map[clientmodel.Fingerprint]struct{}, len(result))
+		for fp := range result {
+			if _, ok := set[fp]; ok {
+				intersection[fp] = struct{}{}
+			}
 		}
 		result = intersection
 	}
+	if len(result) == 0 {
+		return nil
+	}
 
 	fps := make(clientmodel.Fingerprints, 0, len(result))
 	for fp := range result {
@@ -339,6 +745,37 @@ func (s *memorySeriesStorage) GetFingerprintsForLabelMatchers(labelMatchers metr
 	return fps
 }
 
+// getFingerprintsForLabelMatcher returns the set of fingerprints matching the
+// given matcher. It is goroutine-safe.
+func (s *memorySeriesStorage) getFingerprintsForLabelMatcher(matcher *metric.LabelMatcher) map[clientmodel.Fingerprint]struct{} {
+	var lps []metric.LabelPair
+	if matcher.Type == metric.Equal {
+		lps = []metric.LabelPair{{Name: matcher.Name, Value: matcher.Value}}
+	} else {
+		values, err := s.persistence.getLabelValuesForLabelMatcher(matcher)
+		if err != nil {
+			glog.Errorf("Error getting label values for label name %q: %v", matcher.Name, err)
+		}
+		lps = make([]metric.LabelPair, 0, len(values))
+		for _, v := range values {
+			lps = append(lps, metric.LabelPair{Name: matcher.Name, Value: v})
+		}
+	}
+	fps, err := s.persistence.getFingerprintsForLabelPairs(lps)
+	if err != nil {
+		glog.Error("Error getting fingerprints for label pairs: ", err)
+	}
+	return fps
+}
+
+// fingerprintSetsBySize implements sort.Interface, sorting fingerprint sets by
+// ascending size.
+type fingerprintSetsBySize []map[clientmodel.Fingerprint]struct{}
+
+func (s fingerprintSetsBySize) Len() int           { return len(s) }
+func (s fingerprintSetsBySize) Less(i, j int) bool { return len(s[i]) < len(s[j]) }
+func (s fingerprintSetsBySize) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
 // GetLabelValuesForLabelName implements Storage.
 func (s *memorySeriesStorage) GetLabelValuesForLabelName(labelName clientmodel.LabelName) clientmodel.LabelValues {
 	lvs, err := s.persistence.getLabelValuesForLabelName(labelName)
@@ -370,80 +807,587 @@ func (s *memorySeriesStorage) GetMetricForFingerprint(fp clientmodel.Fingerprint
 	}
 }
 
+// GetTopMemoryConsumers implements Storage.
+func (s *memorySeriesStorage) GetTopMemoryConsumers(n int) (series, metricNames []MemoryConsumer) {
+	byName := map[clientmodel.LabelValue]*MemoryConsumer{}
+	for m := range s.fpToSeries.iter() {
+		s.fpLocker.Lock(m.fp)
+		numChunkDescs, numMemoryChunks, bytes := m.series.memoryUsage()
+		metric := m.series.metric
+		s.fpLocker.Unlock(m.fp)
+
+		series = append(series, MemoryConsumer{
+			Metric:          metric,
+			NumSeries:       1,
+			NumChunkDescs:   numChunkDescs,
+			NumMemoryChunks: numMemoryChunks,
+			Bytes:           bytes,
+		})
+
+		name := metric[clientmodel.MetricNameLabel]
+		mc, ok := byName[name]
+		if !ok {
+			mc = &MemoryConsumer{
+				Metric: clientmodel.Metric{clientmodel.MetricNameLabel: name},
+			}
+			byName[name] = mc
+		}
+		mc.NumSeries++
+		mc.NumChunkDescs += numChunkDescs
+		mc.NumMemoryChunks += numMemoryChunks
+		mc.Bytes += bytes
+	}
+
+	metricNames = make([]MemoryConsumer, 0, len(byName))
+	for _, mc := range byName {
+		metricNames = append(metricNames, *mc)
+	}
+	return topMemoryConsumers(series, n), topMemoryConsumers(metricNames, n)
+}
+
+// topMemoryConsumers sorts the provided MemoryConsumers by descending Bytes and
+// returns at most the first n of them.
+func topMemoryConsumers(mcs []MemoryConsumer, n int) []MemoryConsumer {
+	sort.Sort(memoryConsumersByBytes(mcs))
+	if n >= 0 && len(mcs) > n {
+		mcs = mcs[:n]
+	}
+	return mcs
+}
+
+// memoryConsumersByBytes implements sort.Interface, sorting by descending Bytes.
+type memoryConsumersByBytes []MemoryConsumer
+
+func (m memoryConsumersByBytes) Len() int           { return len(m) }
+func (m memoryConsumersByBytes) Less(i, j int) bool { return m[i].Bytes > m[j].Bytes }
+func (m memoryConsumersByBytes) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+
+// GetDiskUsage implements Storage.
+func (s *memorySeriesStorage) GetDiskUsage(matchers metric.LabelMatchers) []DiskUsage {
+	var fps clientmodel.Fingerprints
+	if len(matchers) > 0 {
+		fps = s.GetFingerprintsForLabelMatchers(matchers)
+	} else {
+		for _, name := range s.GetLabelValuesForLabelName(clientmodel.MetricNameLabel) {
+			fps = append(fps, s.GetFingerprintsForLabelMatchers(metric.LabelMatchers{
+				&metric.LabelMatcher{Type: metric.Equal, Name: clientmodel.MetricNameLabel, Value: name},
+			})...)
+		}
+	}
+
+	byName := map[clientmodel.LabelValue]*DiskUsage{}
+	for _, fp := range fps {
+		size, err := s.persistence.seriesFileSize(fp)
+		if err != nil {
+			glog.Errorf("Error determining size of series file for fingerprint %v: %v", fp, err)
+			continue
+		}
+		if size == 0 {
+			continue
+		}
+		name := s.GetMetricForFingerprint(fp).Metric[clientmodel.MetricNameLabel]
+		du, ok := byName[name]
+		if !ok {
+			du = &DiskUsage{MetricName: name}
+			byName[name] = du
+		}
+		du.NumSeries++
+		du.NumChunks += int(size / int64(s.persistence.chunkRecordLen()))
+		du.Bytes += size
+	}
+
+	usage := make([]DiskUsage, 0, len(byName))
+	for _, du := range byName {
+		usage = append(usage, *du)
+	}
+	sort.Sort(diskUsageByBytes(usage))
+	return usage
+}
+
+// diskUsageByBytes implements sort.Interface, sorting by descending Bytes.
+type diskUsageByBytes []DiskUsage
+
+func (d diskUsageByBytes) Len() int           { return len(d) }
+func (d diskUsageByBytes) Less(i, j int) bool { return d[i].Bytes > d[j].Bytes }
+func (d diskUsageByBytes) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// DropMetricsForLabelMatchers implements Storage.
+func (s *memorySeriesStorage) DropMetricsForLabelMatchers(matchers metric.LabelMatchers) int {
+	fps := s.GetFingerprintsForLabelMatchers(matchers)
+	for _, fp := range fps {
+		s.purgeSeries(fp)
+	}
+	return len(fps)
+}
+
+// purgeSeries removes all traces of the series with the given fingerprint,
+// whether it is in memory or archived: its chunks in memory, its series file,
+// and its entries in the archive and label indexes.
+func (s *memorySeriesStorage) purgeSeries(fp clientmodel.Fingerprint) {
+	s.fpLocker.Lock(fp)
+	defer s.fpLocker.Unlock(fp)
+
+	if series, ok := s.fpToSeries.get(fp); ok {
+		s.fpToSeries.del(fp)
+		s.persistence.seriesRemoved(fp)
+		s.numSeries.Dec()
+		s.seriesQuotas.remove(series.metric)
+		// Chunks not yet persisted are pinned. Unpin them so that they
+		// get evicted in due course.
+		numChunksToPersist := len(series.chunkDescs) - series.persistWatermark
+		for _, cd := range series.chunkDescs[series.persistWatermark:] {
+			cd.unpin(s.evictRequests)
+		}
+		if !series.headChunkClosed {
+			numChunksToPersist--
+		}
+		s.incNumChunksToPersist(-numChunksToPersist)
+		numMemChunkDescs.Sub(float64(len(series.chunkDescs)))
+		s.persistence.unindexMetric(fp, series.metric)
+	} else if err := s.persistence.purgeArchivedMetric(fp); err != nil {
+		glog.Errorf("Error purging archived metric for fingerprint %v: %v", fp, err)
+	}
+
+	if _, err := s.persistence.deleteSeriesFile(fp); err != nil {
+		glog.Errorf("Error deleting series file for fingerprint %v: %v", fp, err)
+	}
+	if err := s.persistence.deleteRollups(fp); err != nil {
+		glog.Errorf("Error deleting rollups for fingerprint %v: %v", fp, err)
+	}
+	s.coldTier.purge(fp)
+	s.queryLog.forget(fp)
+	s.seriesOps.WithLabelValues(requestedPurge).Inc()
+}
+
+// Snapshot implements Storage.
+func (s *memorySeriesStorage) Snapshot() (string, error) {
+	dir := filepath.Join(
+		s.persistence.basePath, snapshotsDirName,
+		time.Now().UTC().Format("20060102T150405.000Z"),
+	)
+	if err := s.persistence.startSnapshot(); err != nil {
+		return "", err
+	}
+	defer s.persistence.endSnapshot()
+
+	if err := s.persistence.checkpointSeriesMapAndHeads(s.fpToSeries, s.fpLocker); err != nil {
+		return "", err
+	}
+	if err := s.persistence.snapshot(dir); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
 // Append implements Storage.
 func (s *memorySeriesStorage) Append(sample *clientmodel.Sample) {
-	if s.getNumChunksToPersist() >= s.maxChunksToPersist {
-		glog.Warningf(
-			"%d chunks waiting for persistence, sample ingestion suspended.",
-			s.getNumChunksToPersist(),
-		)
-		for s.getNumChunksToPersist() >= s.maxChunksToPersist {
-			time.Sleep(time.Second)
+	if s.dropStandbySamples(1) {
+		return
+	}
+	s.throttleIngestion()
+	ingested, completedChunksCount := s.appendSameFP(
+		sample.Metric.Fingerprint(), []*clientmodel.Sample{sample},
+	)
+	s.ingestedSamplesCount.Add(float64(ingested))
+	s.incNumChunksToPersist(completedChunksCount)
+}
+
+// AppendBatch implements Storage.
+func (s *memorySeriesStorage) AppendBatch(samples clientmodel.Samples) {
+	if s.dropStandbySamples(len(samples)) {
+		return
+	}
+	s.throttleIngestion()
+	// Group the samples by fingerprint by sorting them, keeping their order
+	// within each group.
+	fps := make([]clientmodel.Fingerprint, len(samples))
+	for i, sample := range samples {
+		fps[i] = sample.Metric.Fingerprint()
+	}
+	sorted := make(clientmodel.Samples, len(samples))
+	copy(sorted, samples)
+	sort.Stable(samplesByFingerprint{sorted, fps})
+
+	var ingested, completedChunksCount int
+	for len(sorted) > 0 {
+		n := 1
+		for n < len(sorted) && fps[n] == fps[0] {
+			n++
 		}
-		glog.Warning("Sample ingestion resumed.")
+		i, c := s.appendSameFP(fps[0], sorted[:n])
+		ingested += i
+		completedChunksCount += c
+		sorted, fps = sorted[n:], fps[n:]
 	}
-	fp := sample.Metric.Fingerprint()
-	s.fpLocker.Lock(fp)
-	series := s.getOrCreateSeries(fp, sample.Metric)
-	completedChunksCount := series.add(&metric.SamplePair{
-		Value:     sample.Value,
-		Timestamp: sample.Timestamp,
-	})
-	s.fpLocker.Unlock(fp)
-	s.ingestedSamplesCount.Inc()
+	s.ingestedSamplesCount.Add(float64(ingested))
 	s.incNumChunksToPersist(completedChunksCount)
 }
 
+// samplesByFingerprint sorts samples by the fingerprints of their metrics,
+// which are provided at the same indexes in fps.
+type samplesByFingerprint struct {
+	samples clientmodel.Samples
+	fps     []clientmodel.Fingerprint
+}
+
+func (s samplesByFingerprint) Len() int           { return len(s.samples) }
+func (s samplesByFingerprint) Less(i, j int) bool { return s.fps[i] < s.fps[j] }
+func (s samplesByFingerprint) Swap(i, j int) {
+	s.samples[i], s.samples[j] = s.samples[j], s.samples[i]
+	s.fps[i], s.fps[j] = s.fps[j], s.fps[i]
+}
+
+// appendSameFP appends samples whose metrics all have the fingerprint rawFP,
+// locking the fingerprint and mapping it to the fingerprint of the series only
+// once for all samples of the same metric. It returns the number of ingested
+// samples and of chunks completed in the process.
+func (s *memorySeriesStorage) appendSameFP(
+	rawFP clientmodel.Fingerprint, samples []*clientmodel.Sample,
+) (ingested, completedChunksCount int) {
+	s.fpLocker.Lock(rawFP)
+	locked := rawFP
+	var (
+		fp         clientmodel.Fingerprint
+		series     *memorySeries
+		duplicates int
+	)
+	for _, sample := range samples {
+		if series == nil || !sample.Metric.Equal(series.metric) {
+			// A different metric with the same raw fingerprint, which
+			// can only be mapped with the raw fingerprint locked.
+			if locked != rawFP {
+				s.fpLocker.Unlock(locked)
+				s.fpLocker.Lock(rawFP)
+				locked = rawFP
+			}
+			var err error
+			fp, err = s.mapper.mapFP(rawFP, sample.Metric)
+			if err != nil {
+				glog.Errorf("Error while mapping fingerprint %v: %v", rawFP, err)
+				s.persistence.setDirty(true)
+			}
+			if fp != locked {
+				// Switch locks.
+				s.fpLocker.Unlock(locked)
+				s.fpLocker.Lock(fp)
+				locked = fp
+			}
+			var quota clientmodel.LabelName
+			if series, quota = s.getOrCreateSeriesWithinQuotas(fp, sample.Metric); series == nil {
+				s.quotaRejectedSamplesCount.WithLabelValues(string(quota)).Inc()
+				continue
+			}
+		}
+		v := &metric.SamplePair{
+			Value:     sample.Value,
+			Timestamp: sample.Timestamp,
+		}
+		if s.isDuplicate(series, v.Timestamp) {
+			duplicates++
+			continue
+		}
+		if len(series.chunkDescs) > 0 && v.Timestamp.Before(series.head().lastTime()) {
+			completed, merged := 0, false
+			if !v.Timestamp.Before(series.head().lastTime().Add(-s.outOfOrderTolerance)) {
+				completed, merged = series.insert(v)
+			}
+			if !merged {
+				s.outOfOrderSamplesCount.WithLabelValues(discardedOutcome).Inc()
+				continue
+			}
+			s.outOfOrderSamplesCount.WithLabelValues(mergedOutcome).Inc()
+			completedChunksCount += completed
+		} else {
+			completedChunksCount += series.add(v, s.chunkEncoding)
+		}
+		s.persistence.logSample(fp, sample.Metric, v)
+		ingested++
+	}
+	s.fpLocker.Unlock(locked)
+	if duplicates > 0 {
+		s.duplicateSamplesCount.Add(float64(duplicates))
+	}
+	return ingested, completedChunksCount
+}
+
+// isDuplicate returns whether the series already has a sample with the given
+// timestamp, e.g. because the same target is scraped twice, by two
+// misconfigured scrape jobs or both members of a pair of servers sharing a
+// storage. Appending duplicates would corrupt rates and waste chunk space.
+// Apart from the last sample of the series, only samples within the
+// out-of-order tolerance in the open head chunk are checked. The caller must
+// have locked the fingerprint of the series.
+func (s *memorySeriesStorage) isDuplicate(series *memorySeries, t clientmodel.Timestamp) bool {
+	if len(series.chunkDescs) == 0 {
+		return false
+	}
+	lastTime := series.head().lastTime()
+	if t == lastTime {
+		return true
+	}
+	if !t.Before(lastTime) || t.Before(lastTime.Add(-s.outOfOrderTolerance)) {
+		return false
+	}
+	return series.headHasSampleAt(t)
+}
+
+// getOrCreateSeries returns the series with the given fingerprint, unarchiving
+// or creating it if it is not in memory. The series counts towards the series
+// quotas, even if it exceeds them. The caller must have locked the fingerprint.
 func (s *memorySeriesStorage) getOrCreateSeries(fp clientmodel.Fingerprint, m clientmodel.Metric) *memorySeries {
 	series, ok := s.fpToSeries.get(fp)
 	if !ok {
-		unarchived, firstTime, err := s.persistence.unarchiveMetric(fp)
-		if err != nil {
-			glog.Errorf("Error unarchiving fingerprint %v: %v", fp, err)
-		}
-		if unarchived {
-			s.seriesOps.WithLabelValues(unarchive).Inc()
-		} else {
-			// This was a genuinely new series, so index the metric.
-			s.persistence.indexMetric(fp, m)
-			s.seriesOps.WithLabelValues(create).Inc()
+		s.seriesQuotas.add(m)
+		series = s.createSeries(fp, m)
+	}
+	return series
+}
+
+// getOrCreateSeriesWithinQuotas is like getOrCreateSeries, but if the series
+// is not in memory and bringing it into memory would exceed a series quota, it
+// returns nil and the label name of the exceeded quota instead.
+func (s *memorySeriesStorage) getOrCreateSeriesWithinQuotas(fp clientmodel.Fingerprint, m clientmodel.Metric) (*memorySeries, clientmodel.LabelName) {
+	series, ok := s.fpToSeries.get(fp)
+	if !ok {
+		if quota, ok := s.seriesQuotas.tryAdd(m); !ok {
+			return nil, quota
 		}
-		series = newMemorySeries(m, !unarchived, firstTime)
-		s.fpToSeries.put(fp, series)
-		s.numSeries.Inc()
+		series = s.createSeries(fp, m)
+	}
+	return series, ""
+}
+
+// createSeries unarchives the series with the given fingerprint or, if it is
+// not archived, creates and indexes it. The caller must have locked the
+// fingerprint and counted the series towards the series quotas.
+func (s *memorySeriesStorage) createSeries(fp clientmodel.Fingerprint, m clientmodel.Metric) *memorySeries {
+	unarchived, firstTime, err := s.persistence.unarchiveMetric(fp)
+	if err != nil {
+		glog.Errorf("Error unarchiving fingerprint %v: %v", fp, err)
 	}
+	if unarchived {
+		s.seriesOps.WithLabelValues(unarchive).Inc()
+	} else {
+		// This was a genuinely new series, so index the metric.
+		s.persistence.indexMetric(fp, m)
+		s.seriesOps.WithLabelValues(create).Inc()
+		s.seriesChurn.created(m)
+	}
+	series := newMemorySeries(m, !unarchived, firstTime)
+	s.fpToSeries.put(fp, series)
+	s.numSeries.Inc()
 	return series
 }
 
+// preloadChunksForRange pins the chunks of the series covering the given
+// range and loads those that are evicted. It fails if preloading has been
+// aborted.
 func (s *memorySeriesStorage) preloadChunksForRange(
 	fp clientmodel.Fingerprint,
 	from clientmodel.Timestamp, through clientmodel.Timestamp,
-	stalenessDelta time.Duration,
+	stalenessDelta time.Duration, abort preloadAbort,
 ) ([]*chunkDesc, error) {
+	if err := abort.err(); err != nil {
+		return nil, err
+	}
 	s.fpLocker.Lock(fp)
 	defer s.fpLocker.Unlock(fp)
 
+	series, err := s.seriesForPreload(fp, from, through, stalenessDelta)
+	if err != nil || series == nil {
+		return nil, err
+	}
+	return series.preloadChunksForRange(from, through, fp, s)
+}
+
+// preloadAbort holds the conditions under which preloading is aborted.
+type preloadAbort struct {
+	deadline time.Time       // Never exceeded if zero.
+	canceled <-chan struct{} // Never closed if nil.
+}
+
+// err returns ErrDeadlineExceeded if the deadline has passed, ErrCanceled if
+// the canceled channel is closed, and nil otherwise.
+func (a preloadAbort) err() error {
+	if !a.deadline.IsZero() && time.Now().After(a.deadline) {
+		return ErrDeadlineExceeded
+	}
+	select {
+	case <-a.canceled:
+		return ErrCanceled
+	default:
+		return nil
+	}
+}
+
+// seriesForPreload returns the series to preload the given range from,
+// unarchiving it if needed. It returns nil if there is nothing to preload. The
+// caller must have locked the fingerprint.
+func (s *memorySeriesStorage) seriesForPreload(
+	fp clientmodel.Fingerprint,
+	from clientmodel.Timestamp, through clientmodel.Timestamp,
+	stalenessDelta time.Duration,
+) (*memorySeries, error) {
+	s.queryLog.touch(fp, time.Now())
 	series, ok := s.fpToSeries.get(fp)
-	if !ok {
-		has, first, last, err := s.persistence.hasArchivedMetric(fp)
+	if ok {
+		return series, nil
+	}
+	has, first, last, err := s.persistence.hasArchivedMetric(fp)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		s.invalidPreloadRequestsCount.Inc()
+		return nil, nil
+	}
+	if from.Add(-stalenessDelta).Before(last) && through.Add(stalenessDelta).After(first) {
+		metric, err := s.persistence.getArchivedMetric(fp)
 		if err != nil {
 			return nil, err
 		}
-		if !has {
-			s.invalidPreloadRequestsCount.Inc()
-			return nil, nil
+		return s.getOrCreateSeries(fp, metric), nil
+	}
+	return nil, nil
+}
+
+// pendingChunkLoad describes the evicted chunks of a series that have been
+// pinned for a batched preload but not loaded yet.
+type pendingChunkLoad struct {
+	series  *memorySeries
+	cds     []*chunkDesc
+	indexes []int // Indexes of the chunks in the series file.
+}
+
+// preloadChunksForRanges works like preloadChunksForRange, but for many series
+// at once. The chunks of all series are pinned first, each under the lock of
+// its fingerprint. Then, the evicted chunks are loaded in one batch without
+// holding any lock. Finally, the loaded chunks are handed to their chunkDescs,
+// again under the respective lock. If a series file has changed in the
+// meantime, the range of that series is preloaded again as usual. Whether
+// preloading has been aborted is checked before each series is pinned and
+// before the batch is loaded.
+func (s *memorySeriesStorage) preloadChunksForRanges(
+	ranges map[clientmodel.Fingerprint]metric.Interval,
+	stalenessDelta time.Duration, abort preloadAbort,
+) ([]*chunkDesc, error) {
+	var pinnedChunkDescs []*chunkDesc
+	unpinAll := func() {
+		for _, cd := range pinnedChunkDescs {
+			cd.unpin(s.evictRequests)
 		}
-		if from.Add(-stalenessDelta).Before(last) && through.Add(stalenessDelta).After(first) {
-			metric, err := s.persistence.getArchivedMetric(fp)
-			if err != nil {
-				return nil, err
-			}
-			series = s.getOrCreateSeries(fp, metric)
-		} else {
-			return nil, nil
+		chunkOps.WithLabelValues(unpin).Add(float64(len(pinnedChunkDescs)))
+	}
+
+	loads := map[clientmodel.Fingerprint]*pendingChunkLoad{}
+	fpToIndexes := map[clientmodel.Fingerprint][]int{}
+	for fp, in := range ranges {
+		if err := abort.err(); err != nil {
+			unpinAll()
+			return nil, err
+		}
+		cds, load, err := s.pinChunksForRange(fp, in.OldestInclusive, in.NewestInclusive, stalenessDelta)
+		if err != nil {
+			unpinAll()
+			return nil, err
+		}
+		pinnedChunkDescs = append(pinnedChunkDescs, cds...)
+		if load != nil {
+			loads[fp] = load
+			fpToIndexes[fp] = load.indexes
 		}
 	}
-	return series.preloadChunksForRange(from, through, fp, s)
+	if len(loads) == 0 {
+		return pinnedChunkDescs, nil
+	}
+	if err := abort.err(); err != nil {
+		unpinAll()
+		return nil, err
+	}
+
+	fpToChunks, err := s.persistence.loadChunksBatch(fpToIndexes)
+	if err != nil {
+		unpinAll()
+		return nil, err
+	}
+	for fp, load := range loads {
+		if s.setLoadedChunks(fp, load, fpToChunks[fp]) {
+			continue
+		}
+		in := ranges[fp]
+		cds, err := s.preloadChunksForRange(fp, in.OldestInclusive, in.NewestInclusive, stalenessDelta, abort)
+		if err != nil {
+			unpinAll()
+			return nil, err
+		}
+		pinnedChunkDescs = append(pinnedChunkDescs, cds...)
+	}
+	return pinnedChunkDescs, nil
+}
+
+// pinChunksForRange pins the chunks for the given range like
+// preloadChunksForRange, but doesn't load evicted chunks. Instead, it returns
+// a pendingChunkLoad for them, or nil if all chunks are in memory.
+func (s *memorySeriesStorage) pinChunksForRange(
+	fp clientmodel.Fingerprint,
+	from clientmodel.Timestamp, through clientmodel.Timestamp,
+	stalenessDelta time.Duration,
+) ([]*chunkDesc, *pendingChunkLoad, error) {
+	s.fpLocker.Lock(fp)
+	defer s.fpLocker.Unlock(fp)
+
+	series, err := s.seriesForPreload(fp, from, through, stalenessDelta)
+	if err != nil || series == nil {
+		return nil, nil, err
+	}
+	indexes, err := series.indexesForRange(from, through, fp, s)
+	if err != nil {
+		return nil, nil, err
+	}
+	pinnedChunkDescs, evictedIndexes := series.pinChunks(indexes, s)
+	if len(evictedIndexes) == 0 {
+		return pinnedChunkDescs, nil, nil
+	}
+	if series.chunkDescsOffset == -1 {
+		panic("requested loading chunks from persistence in a situation where we must not have persisted data for chunk descriptors in memory")
+	}
+	load := &pendingChunkLoad{series: series}
+	for _, idx := range evictedIndexes {
+		load.cds = append(load.cds, series.chunkDescs[idx])
+		load.indexes = append(load.indexes, idx+series.chunkDescsOffset)
+	}
+	return pinnedChunkDescs, load, nil
+}
+
+// setLoadedChunks hands the chunks loaded for the given pendingChunkLoad to
+// their chunkDescs. Chunks loaded concurrently by another preload are
+// discarded. It returns false, discarding all chunks, if any of the chunkDescs
+// is no longer found at its position in the series, i.e. the series file has
+// changed since the chunks were pinned.
+func (s *memorySeriesStorage) setLoadedChunks(fp clientmodel.Fingerprint, load *pendingChunkLoad, chunks []chunk) bool {
+	s.fpLocker.Lock(fp)
+	defer s.fpLocker.Unlock(fp)
+
+	series, ok := s.fpToSeries.get(fp)
+	valid := ok && series == load.series
+	for i := 0; valid && i < len(load.cds); i++ {
+		idx := load.indexes[i] - series.chunkDescsOffset
+		valid = series.chunkDescsOffset != -1 &&
+			idx >= 0 && idx < len(series.chunkDescs) &&
+			series.chunkDescs[idx] == load.cds[i]
+	}
+	if !valid {
+		atomic.AddInt64(&numMemChunks, int64(-len(chunks)))
+		return false
+	}
+	for i, cd := range load.cds {
+		if !cd.isEvicted() {
+			atomic.AddInt64(&numMemChunks, -1)
+			continue
+		}
+		cd.setChunk(chunks[i])
+	}
+	return true
 }
 
 func (s *memorySeriesStorage) handleEvictList() {
@@ -454,13 +1398,18 @@ func (s *memorySeriesStorage) handleEvictList() {
 		// To batch up evictions a bit, this tries evictions at least
 		// once per evict interval, but earlier if the number of evict
 		// requests with evict==true that have happened since the last
-		// evict run is more than maxMemoryChunks/1000.
+		// evict run is more than maxMemoryChunks/1000 (or, with
+		// heap-based eviction, the number of chunks in memory/1000).
 		select {
 		case req := <-s.evictRequests:
 			if req.evict {
 				req.cd.evictListElement = s.evictList.PushBack(req.cd)
 				count++
-				if count > s.maxMemoryChunks/1000 {
+				limit := s.memoryChunksLimit()
+				if s.targetHeapSize > 0 {
+					limit = int(atomic.LoadInt64(&numMemChunks))
+				}
+				if count > limit/1000 {
 					s.maybeEvict()
 					count = 0
 				}
@@ -492,7 +1441,7 @@ func (s *memorySeriesStorage) handleEvictList() {
 
 // maybeEvict is a local helper method. Must only be called by handleEvictList.
 func (s *memorySeriesStorage) maybeEvict() {
-	numChunksToEvict := int(atomic.LoadInt64(&numMemChunks)) - s.maxMemoryChunks
+	numChunksToEvict := s.numChunksToEvict()
 	if numChunksToEvict <= 0 {
 		return
 	}
@@ -529,9 +1478,52 @@ func (s *memorySeriesStorage) maybeEvict() {
 	}()
 }
 
+// numChunksToEvict returns how many chunks have to be evicted to obey the
+// memory limit. Without a target heap size, that's the number of chunks in
+// memory exceeding maxMemoryChunks. Otherwise, it's the number of chunks whose
+// eviction frees the heap memory in use beyond targetHeapSize. As evicted
+// chunks are only freed by the next garbage collection, chunks are evicted
+// only once per garbage collection cycle. Must only be called by
+// handleEvictList.
+func (s *memorySeriesStorage) numChunksToEvict() int {
+	if s.targetHeapSize == 0 {
+		return int(atomic.LoadInt64(&numMemChunks)) - s.memoryChunksLimit()
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	atomic.StoreUint64(&s.heapSize, ms.HeapInuse)
+	if ms.HeapInuse <= s.targetHeapSize {
+		atomic.StoreInt32(&s.heapOverBudget, 0)
+		return 0
+	}
+	atomic.StoreInt32(&s.heapOverBudget, 1)
+	if ms.NumGC == s.lastEvictionNumGC {
+		return 0
+	}
+	s.lastEvictionNumGC = ms.NumGC
+	return int((ms.HeapInuse - s.targetHeapSize + chunkLen - 1) / chunkLen)
+}
+
+// chunkDescEvictionFactor returns the factor to pass to
+// series.evictChunkDescs. While the heap exceeds the target heap size, or if
+// the series has not been queried for chunkDescIdleTimeout, chunkDescs are
+// evicted down to the chunks still in memory, as chunkDescs dominate memory
+// usage if there are many series with few samples each. Evicted chunkDescs are
+// loaded again once a query needs them. The caller must have locked the
+// fingerprint of the series.
+func (s *memorySeriesStorage) chunkDescEvictionFactor(series *memorySeries) int {
+	if atomic.LoadInt32(&s.heapOverBudget) == 1 {
+		return 1
+	}
+	if s.chunkDescIdleTimeout > 0 && time.Since(series.lastQueried) > s.chunkDescIdleTimeout {
+		return 1
+	}
+	return chunkDescEvictionFactor
+}
+
 // waitForNextFP waits an estimated duration, after which we want to process
 // another fingerprint so that we will process all fingerprints in a tenth of
-// s.dropAfter assuming that the system is doing nothing else, e.g. if we want
+// the retention period assuming that the system is doing nothing else, e.g. if we want
 // to drop chunks after 40h, we want to cycle through all fingerprints within
 // 4h.  The estimation is based on the total number of fingerprints as passed
 // in. However, the maximum sweep time is capped at fpMaxSweepTime. Also, the
@@ -546,7 +1538,7 @@ func (s *memorySeriesStorage) maybeEvict() {
 func (s *memorySeriesStorage) waitForNextFP(numberOfFPs int, maxWaitDurationFactor float64) bool {
 	d := fpMaxWaitDuration
 	if numberOfFPs != 0 {
-		sweepTime := s.dropAfter / 10
+		sweepTime := s.retention() / 10
 		if sweepTime > fpMaxSweepTime {
 			sweepTime = fpMaxSweepTime
 		}
@@ -602,6 +1594,7 @@ func (s *memorySeriesStorage) cycleThroughMemoryFingerprints() chan clientmodel.
 				s.waitForNextFP(s.fpToSeries.length(), s.persistenceBacklogScore())
 				count++
 			}
+			atomic.StoreInt64(&s.memorySweepBegin, begin.UnixNano())
 			if count > 0 {
 				glog.Infof(
 					"Completed maintenance sweep through %d in-memory fingerprints in %v.",
@@ -623,8 +1616,9 @@ func (s *memorySeriesStorage) cycleThroughArchivedFingerprints() chan clientmode
 		defer close(archivedFingerprints)
 
 		for {
+			sweepBegin := time.Now()
 			archivedFPs, err := s.persistence.getFingerprintsModifiedBefore(
-				clientmodel.TimestampFromTime(time.Now()).Add(-s.dropAfter),
+				s.dropBefore(),
 			)
 			if err != nil {
 				glog.Error("Failed to lookup archived fingerprint ranges: ", err)
@@ -645,6 +1639,7 @@ func (s *memorySeriesStorage) cycleThroughArchivedFingerprints() chan clientmode
 				// Never speed up maintenance of archived FPs.
 				s.waitForNextFP(len(archivedFPs), 1)
 			}
+			atomic.StoreInt64(&s.archivedSweepBegin, sweepBegin.UnixNano())
 			if len(archivedFPs) > 0 {
 				glog.Infof(
 					"Completed maintenance sweep through %d archived fingerprints in %v.",
@@ -657,7 +1652,9 @@ func (s *memorySeriesStorage) cycleThroughArchivedFingerprints() chan clientmode
 }
 
 func (s *memorySeriesStorage) loop() {
-	checkpointTimer := time.NewTimer(s.checkpointInterval)
+	checkpointTimer := time.NewTimer(s.maxCheckpointInterval)
+	s.checkpointInterval.Set(s.maxCheckpointInterval.Seconds())
+	lastCheckpoint := time.Now()
 
 	dirtySeriesCount := 0
 
@@ -669,6 +1666,14 @@ func (s *memorySeriesStorage) loop() {
 
 	memoryFingerprints := s.cycleThroughMemoryFingerprints()
 	archivedFingerprints := s.cycleThroughArchivedFingerprints()
+	diskUsageChecked := s.checkDiskUsage()
+	downsampled := s.downsample()
+	compacted := s.compact()
+	unqueriedPurged := s.purgeUnqueried()
+	coldExpired := s.expireColdSegments()
+	replicaSynced := s.syncReplica()
+	indexesCompacted := s.compactIndexes()
+	labelIndexesSnapshotted := s.snapshotLabelIndexes()
 
 loop:
 	for {
@@ -677,11 +1682,16 @@ loop:
 			break loop
 		case <-checkpointTimer.C:
 			s.persistence.checkpointSeriesMapAndHeads(s.fpToSeries, s.fpLocker)
+			interval := s.nextCheckpointInterval(dirtySeriesCount, time.Since(lastCheckpoint))
+			s.checkpointInterval.Set(interval.Seconds())
 			dirtySeriesCount = 0
-			checkpointTimer.Reset(s.checkpointInterval)
+			atomic.StoreInt64(&s.numDirtySeries, 0)
+			lastCheckpoint = time.Now()
+			checkpointTimer.Reset(interval)
 		case fp := <-memoryFingerprints:
-			if s.maintainMemorySeries(fp, clientmodel.TimestampFromTime(time.Now()).Add(-s.dropAfter)) {
+			if s.maintainMemorySeries(fp, s.dropBefore()) {
 				dirtySeriesCount++
+				atomic.StoreInt64(&s.numDirtySeries, int64(dirtySeriesCount))
 				// Check if we have enough "dirty" series so that we need an early checkpoint.
 				// However, if we are already behind persisting chunks, creating a checkpoint
 				// would be counterproductive, as it would slow down chunk persisting even more,
@@ -694,7 +1704,7 @@ loop:
 				}
 			}
 		case fp := <-archivedFingerprints:
-			s.maintainArchivedSeries(fp, clientmodel.TimestampFromTime(time.Now()).Add(-s.dropAfter))
+			s.maintainArchivedSeries(fp, s.dropBefore())
 		}
 	}
 	// Wait until both channels are closed.
@@ -702,6 +1712,36 @@ loop:
 	}
 	for range archivedFingerprints {
 	}
+	<-diskUsageChecked
+	<-downsampled
+	<-compacted
+	<-unqueriedPurged
+	<-coldExpired
+	<-replicaSynced
+	<-indexesCompacted
+	<-labelIndexesSnapshotted
+}
+
+// nextCheckpointInterval returns how long to wait for the next checkpoint,
+// given how many series have become dirty during the given time since the last
+// checkpoint. Assuming series keep becoming dirty at the same rate, the interval
+// is chosen so that checkpointDirtySeriesLimit is reached just when the next
+// checkpoint is due. Thus, checkpoints happen more often under heavy churn and
+// less often when things are quiet, within the limits of minCheckpointInterval
+// and maxCheckpointInterval. In graceful degradation mode, checkpointing would
+// only slow down persisting chunks further, so maxCheckpointInterval is used.
+func (s *memorySeriesStorage) nextCheckpointInterval(dirtySeriesCount int, sinceLastCheckpoint time.Duration) time.Duration {
+	if dirtySeriesCount <= 0 || s.isDegraded() {
+		return s.maxCheckpointInterval
+	}
+	interval := time.Duration(float64(sinceLastCheckpoint) * float64(s.checkpointDirtySeriesLimit) / float64(dirtySeriesCount))
+	if interval < s.minCheckpointInterval {
+		return s.minCheckpointInterval
+	}
+	if interval > s.maxCheckpointInterval {
+		return s.maxCheckpointInterval
+	}
+	return interval
 }
 
 // maintainMemorySeries maintains a series that is in memory (i.e. not
@@ -777,7 +1817,9 @@ func (s *memorySeriesStorage) maintainMemorySeries(
 	// Archive if all chunks are evicted.
 	if iOldestNotEvicted == -1 {
 		s.fpToSeries.del(fp)
+		s.persistence.seriesRemoved(fp)
 		s.numSeries.Dec()
+		s.seriesQuotas.remove(series.metric)
 		// Make sure we have a head chunk descriptor (a freshly
 		// unarchived series has none).
 		if len(series.chunkDescs) == 0 {
@@ -798,11 +1840,15 @@ func (s *memorySeriesStorage) maintainMemorySeries(
 			return
 		}
 		s.seriesOps.WithLabelValues(archive).Inc()
+		s.seriesChurn.archived(series.metric)
+		if !series.lastQueried.IsZero() {
+			s.queryLog.touch(fp, series.lastQueried)
+		}
 		return
 	}
 	// If we are here, the series is not archived, so check for chunkDesc
 	// eviction next
-	series.evictChunkDescs(iOldestNotEvicted)
+	series.evictChunkDescs(iOldestNotEvicted, s.chunkDescEvictionFactor(series))
 
 	return series.dirty && !seriesWasDirty
 }
@@ -813,7 +1859,8 @@ func (s *memorySeriesStorage) maintainMemorySeries(
 // written series file. If no chunks need to be purged, but chunksToPersist is
 // not empty, those chunks are simply appended to the series file. If the series
 // contains no chunks after dropping old chunks, it is purged entirely. In that
-// case, the method returns true.
+// case, the method returns true. Persisted chunks old enough for the cold tier
+// are moved there first and then dropped like chunks older than beforeTime.
 //
 // The caller must have locked the fp.
 func (s *memorySeriesStorage) writeMemorySeries(
@@ -835,6 +1882,15 @@ func (s *memorySeriesStorage) writeMemorySeries(
 		chunks[i] = cd.chunk
 	}
 
+	// Chunks moved to the cold tier are dropped locally, but their rollups
+	// are kept. Chunks not persisted yet cannot be moved.
+	rollupsBefore := beforeTime
+	notAfter := clientmodel.Latest
+	if len(chunks) > 0 {
+		notAfter = chunks[0].firstTime()
+	}
+	beforeTime = s.coldTier.moveChunks(fp, series.firstTime(), beforeTime, notAfter)
+
 	if !series.firstTime().Before(beforeTime) {
 		// Oldest sample not old enough, just append chunks, if any.
 		if len(cds) == 0 {
@@ -855,7 +1911,7 @@ func (s *memorySeriesStorage) writeMemorySeries(
 	}
 
 	newFirstTime, offset, numDroppedFromPersistence, allDroppedFromPersistence, err :=
-		s.persistence.dropAndPersistChunks(fp, beforeTime, chunks)
+		s.persistence.dropAndPersistChunksKeepingRollups(fp, beforeTime, rollupsBefore, chunks)
 	if err != nil {
 		s.persistErrors.Inc()
 		return false
@@ -864,7 +1920,9 @@ func (s *memorySeriesStorage) writeMemorySeries(
 	if len(series.chunkDescs) == 0 && allDroppedFromPersistence {
 		// All chunks dropped from both memory and persistence. Delete the series for good.
 		s.fpToSeries.del(fp)
+		s.persistence.seriesRemoved(fp)
 		s.numSeries.Dec()
+		s.seriesQuotas.remove(series.metric)
 		s.seriesOps.WithLabelValues(memoryPurge).Inc()
 		s.persistence.unindexMetric(fp, series.metric)
 		return true
@@ -884,7 +1942,8 @@ func (s *memorySeriesStorage) writeMemorySeries(
 }
 
 // maintainArchivedSeries drops chunks older than beforeTime from an archived
-// series. If the series contains no chunks after that, it is purged entirely.
+// series and moves old enough chunks to the cold tier. If the series contains
+// no chunks after that, it is purged entirely.
 func (s *memorySeriesStorage) maintainArchivedSeries(fp clientmodel.Fingerprint, beforeTime clientmodel.Timestamp) {
 	defer func(begin time.Time) {
 		s.maintainSeriesDuration.WithLabelValues(maintainArchived).Observe(
@@ -900,14 +1959,20 @@ func (s *memorySeriesStorage) maintainArchivedSeries(fp clientmodel.Fingerprint,
 		glog.Error("Error looking up archived time range: ", err)
 		return
 	}
-	if !has || !firstTime.Before(beforeTime) {
-		// Oldest sample not old enough, or metric purged or unarchived in the meantime.
+	if !has {
+		// Metric purged or unarchived in the meantime.
+		return
+	}
+	rollupsBefore := beforeTime
+	beforeTime = s.coldTier.moveChunks(fp, firstTime, beforeTime, clientmodel.Latest)
+	if !firstTime.Before(beforeTime) {
+		// Oldest sample not old enough.
 		return
 	}
 
 	defer s.seriesOps.WithLabelValues(archiveMaintenance).Inc()
 
-	newFirstTime, _, _, allDropped, err := s.persistence.dropAndPersistChunks(fp, beforeTime, nil)
+	newFirstTime, _, _, allDropped, err := s.persistence.dropAndPersistChunksKeepingRollups(fp, beforeTime, rollupsBefore, nil)
 	if err != nil {
 		glog.Error("Error dropping persisted chunks: ", err)
 	}
@@ -943,6 +2008,39 @@ func (s *memorySeriesStorage) incNumChunksToPersist(by int) {
 	atomic.AddInt64(&s.numChunksToPersist, int64(by))
 }
 
+// throttleIngestion applies backpressure to the producers of samples if chunks
+// are persisted too slowly: Beyond percentChunksToPersistForThrottling of
+// maxChunksToPersist, it delays appending a sample increasingly with the number
+// of chunks waiting for persistence, and at maxChunksToPersist, it suspends
+// ingestion until the backlog has shrunk. The time spent is counted in
+// ingestionThrottledDuration.
+func (s *memorySeriesStorage) throttleIngestion() {
+	throttleAt := s.maxChunksToPersist * percentChunksToPersistForThrottling / 100
+	numChunksToPersist := s.getNumChunksToPersist()
+	if numChunksToPersist < throttleAt {
+		return
+	}
+	begin := time.Now()
+	defer func() {
+		s.ingestionThrottledDuration.Add(time.Since(begin).Seconds())
+	}()
+
+	if numChunksToPersist < s.maxChunksToPersist {
+		time.Sleep(time.Duration(
+			int64(maxIngestionThrottleDelay) * int64(numChunksToPersist-throttleAt+1) / int64(s.maxChunksToPersist-throttleAt+1),
+		))
+		return
+	}
+	glog.Warningf(
+		"%d chunks waiting for persistence, sample ingestion suspended.",
+		numChunksToPersist,
+	)
+	for s.getNumChunksToPersist() >= s.maxChunksToPersist {
+		time.Sleep(time.Second)
+	}
+	glog.Warning("Sample ingestion resumed.")
+}
+
 // isDegraded returns whether the storage is in "graceful degradation mode",
 // which is the case if the number of chunks waiting for persistence has reached
 // a percentage of maxChunksToPersist that exceeds
@@ -950,7 +2048,7 @@ func (s *memorySeriesStorage) incNumChunksToPersist(by int) {
 // only ever called from the goroutine dealing with series maintenance).
 // Changes of degradation mode are logged.
 func (s *memorySeriesStorage) isDegraded() bool {
-	nowDegraded := s.getNumChunksToPersist() > s.maxChunksToPersist*percentChunksToPersistForDegradation/100
+	nowDegraded := s.rushed()
 	if s.degraded && !nowDegraded {
 		glog.Warning("Storage has left graceful degradation mode. Things are back to normal.")
 	} else if !s.degraded && nowDegraded {
@@ -959,12 +2057,19 @@ func (s *memorySeriesStorage) isDegraded() bool {
 			s.getNumChunksToPersist(),
 			s.getNumChunksToPersist()*100/s.maxChunksToPersist,
 			s.maxChunksToPersist,
-			s.checkpointInterval)
+			s.maxCheckpointInterval)
 	}
 	s.degraded = nowDegraded
 	return s.degraded
 }
 
+// rushed returns whether the storage is in graceful degradation mode, also
+// called rushed mode, like isDegraded, but without logging changes. It is
+// goroutine-safe.
+func (s *memorySeriesStorage) rushed() bool {
+	return s.getNumChunksToPersist() > s.maxChunksToPersist*percentChunksToPersistForDegradation/100
+}
+
 // persistenceBacklogScore works similar to isDegraded, but returns a score
 // about how close we are to degradation. This score is 1.0 if no chunks are
 // waiting for persistence and 0.0 if we are at or above the degradation
@@ -980,21 +2085,42 @@ func (s *memorySeriesStorage) persistenceBacklogScore() float64 {
 // Describe implements prometheus.Collector.
 func (s *memorySeriesStorage) Describe(ch chan<- *prometheus.Desc) {
 	s.persistence.Describe(ch)
+	s.mapper.Describe(ch)
 
 	ch <- s.persistErrors.Desc()
 	ch <- maxChunksToPersistDesc
 	ch <- numChunksToPersistDesc
+	ch <- rushedModeDesc
+	ch <- seriesMapContentionsDesc
+	ch <- seriesChurnDesc
 	ch <- s.numSeries.Desc()
 	s.seriesOps.Describe(ch)
 	ch <- s.ingestedSamplesCount.Desc()
+	ch <- s.ingestionThrottledDuration.Desc()
+	s.outOfOrderSamplesCount.Describe(ch)
+	ch <- s.duplicateSamplesCount.Desc()
+	s.quotaRejectedSamplesCount.Describe(ch)
 	ch <- s.invalidPreloadRequestsCount.Desc()
 	ch <- numMemChunksDesc
 	s.maintainSeriesDuration.Describe(ch)
+	ch <- s.diskUsage.Desc()
+	ch <- s.rollupsWritten.Desc()
+	ch <- s.checkpointInterval.Desc()
+	if s.coldTier != nil {
+		s.coldTier.Describe(ch)
+	}
+	if s.replica != nil {
+		s.replica.Describe(ch)
+	}
+	if s.indexCompactor != nil {
+		s.indexCompactor.Describe(ch)
+	}
 }
 
 // Collect implements prometheus.Collector.
 func (s *memorySeriesStorage) Collect(ch chan<- prometheus.Metric) {
 	s.persistence.Collect(ch)
+	s.mapper.Collect(ch)
 
 	ch <- s.persistErrors
 	ch <- prometheus.MustNewConstMetric(
@@ -1007,9 +2133,24 @@ func (s *memorySeriesStorage) Collect(ch chan<- prometheus.Metric) {
 		prometheus.GaugeValue,
 		float64(s.getNumChunksToPersist()),
 	)
+	var rushed float64
+	if s.rushed() {
+		rushed = 1
+	}
+	ch <- prometheus.MustNewConstMetric(rushedModeDesc, prometheus.GaugeValue, rushed)
+	ch <- prometheus.MustNewConstMetric(
+		seriesMapContentionsDesc,
+		prometheus.CounterValue,
+		float64(s.fpToSeries.numContentions()),
+	)
+	s.seriesChurn.collect(ch)
 	ch <- s.numSeries
 	s.seriesOps.Collect(ch)
 	ch <- s.ingestedSamplesCount
+	ch <- s.ingestionThrottledDuration
+	s.outOfOrderSamplesCount.Collect(ch)
+	ch <- s.duplicateSamplesCount
+	s.quotaRejectedSamplesCount.Collect(ch)
 	ch <- s.invalidPreloadRequestsCount
 	ch <- prometheus.MustNewConstMetric(
 		numMemChunksDesc,
@@ -1017,4 +2158,16 @@ func (s *memorySeriesStorage) Collect(ch chan<- prometheus.Metric) {
 		float64(atomic.LoadInt64(&numMemChunks)),
 	)
 	s.maintainSeriesDuration.Collect(ch)
+	ch <- s.diskUsage
+	ch <- s.rollupsWritten
+	ch <- s.checkpointInterval
+	if s.coldTier != nil {
+		s.coldTier.Collect(ch)
+	}
+	if s.replica != nil {
+		s.replica.Collect(ch)
+	}
+	if s.indexCompactor != nil {
+		s.indexCompactor.Collect(ch)
+	}
 }
@@ -14,8 +14,18 @@
 package local
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"math/rand"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"testing/quick"
 	"time"
@@ -23,7 +33,9 @@ import (
 	"github.com/golang/glog"
 
 	clientmodel "github.com/prometheus/client_golang/model"
+	dto "github.com/prometheus/client_model/go"
 
+	"github.com/prometheus/prometheus/storage/local/objectstore"
 	"github.com/prometheus/prometheus/storage/metric"
 	"github.com/prometheus/prometheus/utility/test"
 )
@@ -118,6 +130,22 @@ func TestGetFingerprintsForLabelMatchers(t *testing.T) {
 			},
 			expected: append(append(clientmodel.Fingerprints{}, fingerprints[30:35]...), fingerprints[45:60]...),
 		},
+		{
+			matchers: metric.LabelMatchers{newMatcher(metric.RegexMatch, "label1", `(test_1|test_8)`)},
+			expected: append(append(clientmodel.Fingerprints{}, fingerprints[10:20]...), fingerprints[80:90]...),
+		},
+		{
+			matchers: metric.LabelMatchers{newMatcher(metric.RegexMatch, "label1", `st_9`)},
+			expected: fingerprints[90:],
+		},
+		{
+			matchers: metric.LabelMatchers{newMatcher(metric.RegexMatch, "label1", `(?i)TEST_2`)},
+			expected: fingerprints[20:30],
+		},
+		{
+			matchers: metric.LabelMatchers{newMatcher(metric.RegexMatch, "label1", `xyz.*`)},
+			expected: fingerprints[:0],
+		},
 	}
 
 	for _, mt := range matcherTests {
@@ -140,8 +168,421 @@ func TestGetFingerprintsForLabelMatchers(t *testing.T) {
 	}
 }
 
+func TestGetFingerprintsForLabelMatchersConcurrently(t *testing.T) {
+	storage, closer := NewTestStorage(t, 1)
+	defer closer.Close()
+
+	newMatcher := func(matchType metric.MatchType, name clientmodel.LabelName, value clientmodel.LabelValue) *metric.LabelMatcher {
+		lm, err := metric.NewLabelMatcher(matchType, name, value)
+		if err != nil {
+			t.Fatalf("error creating label matcher: %s", err)
+		}
+		return lm
+	}
+	matchers := metric.LabelMatchers{
+		newMatcher(metric.Equal, "job", "api"),
+		newMatcher(metric.RegexMatch, "instance", "web-.*"),
+		newMatcher(metric.NotEqual, "instance", "web-0"),
+	}
+
+	// Query while series are being indexed.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			storage.GetFingerprintsForLabelMatchers(matchers)
+		}
+	}()
+	want := map[clientmodel.Fingerprint]struct{}{}
+	for i := 0; i < 20; i++ {
+		m := clientmodel.Metric{
+			clientmodel.MetricNameLabel: "up",
+			"job":                       "api",
+			"instance":                  clientmodel.LabelValue(fmt.Sprintf("web-%d", i)),
+		}
+		storage.Append(&clientmodel.Sample{Metric: m, Timestamp: 1, Value: 1})
+		if i > 0 {
+			want[m.Fingerprint()] = struct{}{}
+		}
+	}
+	<-done
+	storage.WaitForIndexing()
+
+	got := map[clientmodel.Fingerprint]struct{}{}
+	for _, fp := range storage.GetFingerprintsForLabelMatchers(matchers) {
+		got[fp] = struct{}{}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %d fingerprints, want %d", len(got), len(want))
+	}
+}
+
+func TestGetTopMemoryConsumers(t *testing.T) {
+	storage, closer := NewTestStorage(t, 1)
+	defer closer.Close()
+
+	// Series of metric "big" get many more samples (and thus chunks) than
+	// those of metric "small".
+	for i := 0; i < 3; i++ {
+		m := clientmodel.Metric{
+			clientmodel.MetricNameLabel: "small",
+			"instance":                  clientmodel.LabelValue(fmt.Sprint(i)),
+		}
+		storage.Append(&clientmodel.Sample{Metric: m, Timestamp: 1, Value: 1})
+	}
+	big := clientmodel.Metric{clientmodel.MetricNameLabel: "big"}
+	for i := 0; i < 10000; i++ {
+		storage.Append(&clientmodel.Sample{
+			Metric:    big,
+			Timestamp: clientmodel.Timestamp(i),
+			Value:     clientmodel.SampleValue(rand.Float64()),
+		})
+	}
+	storage.WaitForIndexing()
+
+	series, metricNames := storage.GetTopMemoryConsumers(2)
+	if len(series) != 2 {
+		t.Fatalf("expected 2 series, got %d", len(series))
+	}
+	if !series[0].Metric.Equal(big) {
+		t.Errorf("expected top series %v, got %v", big, series[0].Metric)
+	}
+	if series[0].NumMemoryChunks < 2 || series[0].Bytes < series[0].NumMemoryChunks*chunkLen {
+		t.Errorf("unexpected memory usage of top series: %+v", series[0])
+	}
+	if series[0].Bytes <= series[1].Bytes {
+		t.Errorf("series not sorted by memory usage: %+v", series)
+	}
+
+	if len(metricNames) != 2 {
+		t.Fatalf("expected 2 metric names, got %d", len(metricNames))
+	}
+	if got := metricNames[0].Metric[clientmodel.MetricNameLabel]; got != "big" {
+		t.Errorf("expected top metric name big, got %s", got)
+	}
+	if metricNames[1].NumSeries != 3 {
+		t.Errorf("expected 3 series for metric name small, got %d", metricNames[1].NumSeries)
+	}
+
+	series, metricNames = storage.GetTopMemoryConsumers(10)
+	if len(series) != 4 || len(metricNames) != 2 {
+		t.Errorf("expected 4 series and 2 metric names, got %d and %d", len(series), len(metricNames))
+	}
+}
+
+func TestGetDiskUsage(t *testing.T) {
+	s, closer := NewTestStorage(t, 1)
+	defer closer.Close()
+	ms := s.(*memorySeriesStorage)
+
+	big1 := clientmodel.Metric{clientmodel.MetricNameLabel: "big", "instance": "1"}
+	big2 := clientmodel.Metric{clientmodel.MetricNameLabel: "big", "instance": "2"}
+	small := clientmodel.Metric{clientmodel.MetricNameLabel: "small"}
+	inMemory := clientmodel.Metric{clientmodel.MetricNameLabel: "in_memory"}
+	for _, m := range []clientmodel.Metric{big1, big2, small} {
+		n := 10000
+		if m.Equal(small) {
+			n = 2000
+		}
+		for i := 0; i < n; i++ {
+			s.Append(&clientmodel.Sample{
+				Metric:    m,
+				Timestamp: clientmodel.Timestamp(i),
+				Value:     clientmodel.SampleValue(rand.Float64()),
+			})
+		}
+		ms.maintainMemorySeries(m.Fingerprint(), 0)
+	}
+	s.Append(&clientmodel.Sample{Metric: inMemory, Timestamp: 1, Value: 1})
+	s.WaitForIndexing()
+
+	usage := s.GetDiskUsage(nil)
+	if len(usage) != 2 {
+		t.Fatalf("want disk usage of 2 metric names, got %+v", usage)
+	}
+	if usage[0].MetricName != "big" || usage[0].NumSeries != 2 {
+		t.Errorf("want 2 series of metric big first, got %+v", usage[0])
+	}
+	if usage[1].MetricName != "small" || usage[1].NumSeries != 1 {
+		t.Errorf("want 1 series of metric small second, got %+v", usage[1])
+	}
+	for _, du := range usage {
+		if du.NumChunks == 0 || du.Bytes != int64(du.NumChunks*chunkLenWithHeader) {
+			t.Errorf("inconsistent disk usage %+v", du)
+		}
+	}
+
+	usage = s.GetDiskUsage(metric.LabelMatchers{
+		&metric.LabelMatcher{Type: metric.Equal, Name: "instance", Value: "1"},
+	})
+	if len(usage) != 1 || usage[0].MetricName != "big" || usage[0].NumSeries != 1 {
+		t.Errorf("want 1 series of metric big, got %+v", usage)
+	}
+}
+
+func TestGetCardinalityStats(t *testing.T) {
+	s, closer := NewTestStorage(t, 1)
+	defer closer.Close()
+
+	for i := 0; i < 5; i++ {
+		s.Append(&clientmodel.Sample{
+			Metric: clientmodel.Metric{
+				clientmodel.MetricNameLabel: "many",
+				"instance":                  clientmodel.LabelValue(fmt.Sprint(i)),
+				"job":                       "api",
+			},
+			Timestamp: 1,
+		})
+	}
+	for i := 0; i < 2; i++ {
+		s.Append(&clientmodel.Sample{
+			Metric: clientmodel.Metric{
+				clientmodel.MetricNameLabel: "few",
+				"instance":                  clientmodel.LabelValue(fmt.Sprint(i)),
+				"job":                       "api",
+			},
+			Timestamp: 1,
+		})
+	}
+	s.WaitForIndexing()
+
+	stats, err := s.GetCardinalityStats(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &CardinalityStats{
+		LabelNames: []LabelCardinality{
+			{Name: "instance", Count: 5},
+			{Name: clientmodel.MetricNameLabel, Count: 2},
+		},
+		LabelPairs: []LabelCardinality{
+			{Name: "job", Value: "api", Count: 7},
+			{Name: clientmodel.MetricNameLabel, Value: "many", Count: 5},
+		},
+		MetricNames: []LabelCardinality{
+			{Name: clientmodel.MetricNameLabel, Value: "many", Count: 5},
+			{Name: clientmodel.MetricNameLabel, Value: "few", Count: 2},
+		},
+	}
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("want cardinality stats %+v, got %+v", want, stats)
+	}
+}
+
+func TestAppendBatch(t *testing.T) {
+	s, closer := NewTestStorage(t, 1)
+	defer closer.Close()
+
+	var samples clientmodel.Samples
+	for ts := 0; ts < 10; ts++ {
+		for i := 0; i < 3; i++ {
+			samples = append(samples, &clientmodel.Sample{
+				Metric: clientmodel.Metric{
+					clientmodel.MetricNameLabel: "test",
+					"instance":                  clientmodel.LabelValue(fmt.Sprint(i)),
+				},
+				Timestamp: clientmodel.Timestamp(ts),
+				Value:     clientmodel.SampleValue(ts * i),
+			})
+		}
+	}
+	// An out-of-order sample is discarded like with Append.
+	samples = append(samples, &clientmodel.Sample{
+		Metric:    samples[0].Metric,
+		Timestamp: 0,
+		Value:     42,
+	})
+	s.AppendBatch(samples)
+	s.WaitForIndexing()
+
+	fps := s.GetFingerprintsForLabelMatchers(metric.LabelMatchers{
+		{Type: metric.Equal, Name: clientmodel.MetricNameLabel, Value: "test"},
+	})
+	if len(fps) != 3 {
+		t.Fatalf("want 3 series, got %d", len(fps))
+	}
+	for _, fp := range fps {
+		m := s.GetMetricForFingerprint(fp)
+		var i int
+		fmt.Sscan(string(m.Metric["instance"]), &i)
+		values := s.NewIterator(fp).GetRangeValues(metric.Interval{
+			OldestInclusive: 0,
+			NewestInclusive: 9,
+		})
+		if len(values) != 10 {
+			t.Fatalf("want 10 samples for instance %d, got %d", i, len(values))
+		}
+		for ts, v := range values {
+			if v.Timestamp != clientmodel.Timestamp(ts) || v.Value != clientmodel.SampleValue(ts*i) {
+				t.Errorf("unexpected sample %d of instance %d: %v", ts, i, v)
+			}
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	s, closer := NewTestStorage(t, 1)
+	defer closer.Close()
+	ms := s.(*memorySeriesStorage)
+
+	status := s.Status()
+	if status.MemorySeries != 0 || !status.LastCheckpoint.IsZero() {
+		t.Fatalf("unexpected status of empty storage: %+v", status)
+	}
+
+	for i := 0; i < 3; i++ {
+		s.Append(&clientmodel.Sample{
+			Metric: clientmodel.Metric{
+				clientmodel.MetricNameLabel: "test",
+				"instance":                  clientmodel.LabelValue(fmt.Sprint(i)),
+			},
+			Timestamp: 1,
+		})
+	}
+	s.WaitForIndexing()
+	if err := ms.persistence.checkpointSeriesMapAndHeads(ms.fpToSeries, ms.fpLocker); err != nil {
+		t.Fatal(err)
+	}
+
+	status = s.Status()
+	if status.MemorySeries != 3 {
+		t.Errorf("want 3 series in memory, got %d", status.MemorySeries)
+	}
+	if status.MemoryChunks < 3 {
+		t.Errorf("want at least 3 chunks in memory, got %d", status.MemoryChunks)
+	}
+	if status.LastCheckpoint.IsZero() {
+		t.Errorf("want time of last checkpoint to be set")
+	}
+	if status.Dirty {
+		t.Errorf("want storage not to be dirty")
+	}
+	if status.IndexingQueueCapacity != indexingQueueCapacity {
+		t.Errorf("want indexing queue capacity %d, got %d", indexingQueueCapacity, status.IndexingQueueCapacity)
+	}
+}
+
+func TestNumChunksToEvictByHeapSize(t *testing.T) {
+	// Without any chunks, the eviction loop never calls numChunksToEvict.
+	ms, closer := newTestStorageWithOptions(t, 1, func(o *MemorySeriesStorageOptions) {
+		o.TargetHeapSize = math.MaxUint64
+	})
+	if n := ms.numChunksToEvict(); n != 0 {
+		t.Errorf("want no chunks to evict below target heap size, got %d", n)
+	}
+	if ms.chunkDescEvictionFactor(&memorySeries{lastQueried: time.Now()}) != chunkDescEvictionFactor {
+		t.Error("want regular chunkDesc eviction below target heap size")
+	}
+	closer.Close()
+
+	ms, closer = newTestStorageWithOptions(t, 1, func(o *MemorySeriesStorageOptions) {
+		o.TargetHeapSize = 1
+	})
+	defer closer.Close()
+	runtime.GC()
+	if n := ms.numChunksToEvict(); n <= 0 {
+		t.Errorf("want chunks to evict above target heap size, got %d", n)
+	}
+	if n := ms.numChunksToEvict(); n != 0 {
+		t.Errorf("want no further eviction before the next garbage collection, got %d", n)
+	}
+	if ms.chunkDescEvictionFactor(&memorySeries{lastQueried: time.Now()}) != 1 {
+		t.Error("want aggressive chunkDesc eviction above target heap size")
+	}
+	if status := ms.Status(); status.HeapSize == 0 || status.TargetHeapSize != 1 {
+		t.Errorf("unexpected heap sizes in status: %+v", status)
+	}
+}
+
+func TestThrottleIngestion(t *testing.T) {
+	ms, closer := newTestStorageWithOptions(t, 1, func(o *MemorySeriesStorageOptions) {
+		o.MaxChunksToPersist = 100
+	})
+	defer closer.Close()
+
+	ms.incNumChunksToPersist(50)
+	ms.throttleIngestion()
+	if ms.rushed() {
+		t.Error("want storage not to be in rushed mode")
+	}
+	m := &dto.Metric{}
+	ms.ingestionThrottledDuration.Write(m)
+	if got := m.GetCounter().GetValue(); got != 0 {
+		t.Errorf("want no throttling below threshold, got %v seconds", got)
+	}
+
+	ms.incNumChunksToPersist(45)
+	if !ms.rushed() {
+		t.Error("want storage to be in rushed mode")
+	}
+	ms.throttleIngestion()
+	ms.ingestionThrottledDuration.Write(m)
+	if got := m.GetCounter().GetValue(); got == 0 {
+		t.Error("want throttling beyond threshold")
+	}
+	ms.incNumChunksToPersist(-95)
+}
+
 // TestLoop is just a smoke test for the loop method, if we can switch it on and
 // off without disaster.
+func TestDropMetrics(t *testing.T) {
+	s, closer := NewTestStorage(t, 1)
+	defer closer.Close()
+	ms := s.(*memorySeriesStorage)
+
+	m1 := clientmodel.Metric{clientmodel.MetricNameLabel: "test", "n1": "v1"}
+	m2 := clientmodel.Metric{clientmodel.MetricNameLabel: "test", "n1": "v2"}
+	N := 120000
+	for j, m := range []clientmodel.Metric{m1, m2} {
+		for i := 0; i < N; i++ {
+			s.Append(&clientmodel.Sample{
+				Metric:    m,
+				Timestamp: clientmodel.Timestamp(2 * i),
+				Value:     clientmodel.SampleValue(float64(i) * float64(j)),
+			})
+		}
+	}
+	s.WaitForIndexing()
+	fp1, fp2 := m1.Fingerprint(), m2.Fingerprint()
+	// Persist the completed chunks of both series.
+	ms.maintainMemorySeries(fp1, 0)
+	ms.maintainMemorySeries(fp2, 0)
+	if _, err := os.Stat(ms.persistence.fileNameForFingerprint(fp1)); err != nil {
+		t.Fatalf("series file not created: %s", err)
+	}
+
+	lm, err := metric.NewLabelMatcher(metric.Equal, "n1", "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := s.DropMetricsForLabelMatchers(metric.LabelMatchers{lm}); n != 1 {
+		t.Errorf("want 1 series dropped, got %d", n)
+	}
+	s.WaitForIndexing()
+
+	fps := s.GetFingerprintsForLabelMatchers(metric.LabelMatchers{
+		&metric.LabelMatcher{Type: metric.Equal, Name: clientmodel.MetricNameLabel, Value: "test"},
+	})
+	if len(fps) != 1 || fps[0] != fp2 {
+		t.Errorf("unexpected fingerprints after dropping: %v", fps)
+	}
+	if _, ok := ms.fpToSeries.get(fp1); ok {
+		t.Error("dropped series still in memory")
+	}
+	if _, err := os.Stat(ms.persistence.fileNameForFingerprint(fp1)); !os.IsNotExist(err) {
+		t.Errorf("series file of dropped series still exists: %v", err)
+	}
+	if _, err := os.Stat(ms.persistence.fileNameForFingerprint(fp2)); err != nil {
+		t.Errorf("series file of remaining series gone: %s", err)
+	}
+	if vals := s.NewIterator(fp1).GetValueAtTime(0); len(vals) != 0 {
+		t.Errorf("dropped series still has values: %v", vals)
+	}
+	if vals := s.NewIterator(fp2).GetValueAtTime(2); len(vals) != 1 {
+		t.Errorf("remaining series lost its values: %v", vals)
+	}
+}
+
 func TestLoop(t *testing.T) {
 	if testing.Short() {
 		t.Skip("Skipping test in short mode.")
@@ -160,7 +601,8 @@ func TestLoop(t *testing.T) {
 		MaxChunksToPersist:         1000000,
 		PersistenceRetentionPeriod: 24 * 7 * time.Hour,
 		PersistenceStoragePath:     directory.Path(),
-		CheckpointInterval:         250 * time.Millisecond,
+		MinCheckpointInterval:      250 * time.Millisecond,
+		MaxCheckpointInterval:      250 * time.Millisecond,
 		SyncStrategy:               Adaptive,
 	}
 	storage, err := NewMemorySeriesStorage(o)
@@ -185,7 +627,806 @@ func TestLoop(t *testing.T) {
 	}
 }
 
-func testChunk(t *testing.T, encoding chunkEncoding) {
+func TestChunkEncodingPerStorage(t *testing.T) {
+	m := clientmodel.Metric{clientmodel.MetricNameLabel: "test"}
+	encodings := []ChunkEncoding{Delta, DoubleDelta, Varbit}
+	storages := make([]*memorySeriesStorage, len(encodings))
+	for i, encoding := range encodings {
+		s, closer := NewTestStorage(t, encoding)
+		defer closer.Close()
+		storages[i] = s.(*memorySeriesStorage)
+	}
+	// Each storage creates chunks with its own encoding, no matter which
+	// storage has been created last.
+	for i, s := range storages {
+		s.Append(&clientmodel.Sample{Metric: m, Timestamp: 1, Value: 1})
+		series, ok := s.fpToSeries.get(m.Fingerprint())
+		if !ok {
+			t.Fatalf("%d. series not found", i)
+		}
+		if got := series.head().chunk.encoding(); got != encodings[i] {
+			t.Errorf("%d. want chunk encoding %v, got %v", i, encodings[i], got)
+		}
+	}
+
+	directory := test.NewTemporaryDirectory("test_storage", t)
+	defer directory.Close()
+	if _, err := NewMemorySeriesStorage(&MemorySeriesStorageOptions{
+		ChunkEncoding:          Varbit + 1,
+		PersistenceStoragePath: directory.Path(),
+		SyncStrategy:           Adaptive,
+	}); err == nil {
+		t.Error("expected error for unknown chunk encoding")
+	}
+}
+
+func TestNextCheckpointInterval(t *testing.T) {
+	s := &memorySeriesStorage{
+		minCheckpointInterval:      time.Minute,
+		maxCheckpointInterval:      15 * time.Minute,
+		checkpointDirtySeriesLimit: 1000,
+		maxChunksToPersist:         1000,
+	}
+	for i, scenario := range []struct {
+		dirtySeriesCount    int
+		sinceLastCheckpoint time.Duration
+		want                time.Duration
+	}{
+		{0, 5 * time.Minute, 15 * time.Minute},
+		{100, 5 * time.Minute, 15 * time.Minute},
+		{500, 5 * time.Minute, 10 * time.Minute},
+		{1000, 5 * time.Minute, 5 * time.Minute},
+		{1000, 30 * time.Second, time.Minute},
+		{100000, 5 * time.Minute, time.Minute},
+	} {
+		if got := s.nextCheckpointInterval(scenario.dirtySeriesCount, scenario.sinceLastCheckpoint); got != scenario.want {
+			t.Errorf("%d. want interval %v, got %v", i, scenario.want, got)
+		}
+	}
+
+	// In graceful degradation mode, always use the maximum interval.
+	s.numChunksToPersist = 1000
+	if got := s.nextCheckpointInterval(100000, 5*time.Minute); got != 15*time.Minute {
+		t.Errorf("want interval %v when degraded, got %v", 15*time.Minute, got)
+	}
+}
+
+func testWALReplay(t *testing.T, encrypted bool) {
+	samples := createRandomSamples("test_wal_replay", 10000)
+	directory := test.NewTemporaryDirectory("test_storage", t)
+	defer directory.Close()
+	o := &MemorySeriesStorageOptions{
+		MemoryChunks:               1000000,
+		MaxChunksToPersist:         1000000,
+		PersistenceRetentionPeriod: 24 * time.Hour * 365 * 100, // Enough to never trigger purging.
+		PersistenceStoragePath:     directory.Path(),
+		MinCheckpointInterval:      time.Hour,
+		MaxCheckpointInterval:      time.Hour,
+		SyncStrategy:               Adaptive,
+		WALFlushInterval:           time.Hour, // Flushed explicitly below.
+	}
+	if encrypted {
+		keyDir := test.NewTemporaryDirectory("test_encryption_keys", t)
+		defer keyDir.Close()
+		keyFile := filepath.Join(keyDir.Path(), "key")
+		if err := ioutil.WriteFile(keyFile, []byte(strings.Repeat("0123456789abcdef", 4)), 0600); err != nil {
+			t.Fatal(err)
+		}
+		o.EncryptionKey = KeyFile(keyFile)
+	}
+	s, err := NewMemorySeriesStorage(o)
+	if err != nil {
+		t.Fatalf("Error creating storage: %s", err)
+	}
+	ms := s.(*memorySeriesStorage)
+	half := len(samples) / 2
+	for _, sample := range samples[:half] {
+		s.Append(sample)
+	}
+	if err := ms.persistence.checkpointSeriesMapAndHeads(ms.fpToSeries, ms.fpLocker); err != nil {
+		t.Fatal(err)
+	}
+	for _, sample := range samples[half:] {
+		s.Append(sample)
+	}
+	s.WaitForIndexing()
+
+	// Simulate a crash: No final checkpoint, and the dirty file stays.
+	if err := ms.persistence.close(); err != nil {
+		t.Fatal(err)
+	}
+	if encrypted {
+		segments, err := walSegments(ms.persistence.wal.dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range segments {
+			buf, err := ioutil.ReadFile(ms.persistence.wal.segmentFileName(n))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(buf, []byte("test_wal_replay")) {
+				t.Errorf("WAL segment %d contains unencrypted metric", n)
+			}
+		}
+	}
+	f, err := os.Create(ms.persistence.dirtyFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	s, err = NewMemorySeriesStorage(o)
+	if err != nil {
+		t.Fatalf("Error re-creating storage: %s", err)
+	}
+	s.Start()
+	defer s.Stop()
+	ms = s.(*memorySeriesStorage)
+	if !ms.persistence.recoveredFromCrash {
+		t.Error("expected crash recovery to have run")
+	}
+	if ms.persistence.isDirty() {
+		t.Error("storage still dirty after crash recovery")
+	}
+	segments, err := walSegments(ms.persistence.wal.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 1 {
+		t.Errorf("expected replayed WAL segments to be removed, got segments %v", segments)
+	}
+	if !verifyStorage(t, s, samples, 24*7*time.Hour) {
+		t.Error("not all samples recovered from WAL")
+	}
+}
+
+func TestWALReplay(t *testing.T) {
+	testWALReplay(t, false)
+}
+
+func TestWALReplayEncrypted(t *testing.T) {
+	testWALReplay(t, true)
+}
+
+func TestWALTruncatedSegment(t *testing.T) {
+	dir := test.NewTemporaryDirectory("test_wal", t)
+	defer dir.Close()
+
+	wal, segments, err := newWriteAheadLog(dir.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 0 {
+		t.Fatalf("expected no segments in new WAL, got %v", segments)
+	}
+	m := clientmodel.Metric{clientmodel.MetricNameLabel: "test"}
+	fp := m.Fingerprint()
+	for i := 0; i < 10; i++ {
+		if err := wal.logSample(fp, m, &metric.SamplePair{
+			Timestamp: clientmodel.Timestamp(i),
+			Value:     clientmodel.SampleValue(i),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := wal.logSeriesChange(fp); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.close(); err != nil {
+		t.Fatal(err)
+	}
+	// Cut off the last sample and the series change record.
+	filename := wal.segmentFileName(1)
+	fi, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The series change record takes 14 bytes, the last sample 23.
+	if err := os.Truncate(filename, fi.Size()-20); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []metric.SamplePair
+	if err := wal.readSegment(1, func(rec *walRecord) {
+		if rec.recordType != walRecordSample {
+			t.Errorf("unexpected record type %d", rec.recordType)
+			return
+		}
+		if !rec.metric.Equal(m) {
+			t.Errorf("want metric %v, got %v", m, rec.metric)
+		}
+		got = append(got, rec.sample)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 9 {
+		t.Fatalf("want 9 samples, got %d", len(got))
+	}
+	for i, sp := range got {
+		if sp.Timestamp != clientmodel.Timestamp(i) || sp.Value != clientmodel.SampleValue(i) {
+			t.Errorf("%d. unexpected sample %v", i, sp)
+		}
+	}
+}
+
+func TestWALCorruptedRecord(t *testing.T) {
+	dir := test.NewTemporaryDirectory("test_wal", t)
+	defer dir.Close()
+
+	wal, _, err := newWriteAheadLog(dir.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := clientmodel.Metric{clientmodel.MetricNameLabel: "test"}
+	fp := m.Fingerprint()
+	for i := 0; i < 10; i++ {
+		if err := wal.logSample(fp, m, &metric.SamplePair{
+			Timestamp: clientmodel.Timestamp(i),
+			Value:     clientmodel.SampleValue(i),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := wal.close(); err != nil {
+		t.Fatal(err)
+	}
+	// Flip a bit in the value of the 8th sample. Each sample record takes
+	// 23 bytes.
+	filename := wal.segmentFileName(1)
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf[len(buf)-2*23-5] ^= 1
+	if err := ioutil.WriteFile(filename, buf, 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	var got int
+	if err := wal.readSegment(1, func(rec *walRecord) {
+		got++
+	}); err != errWALCorrupted {
+		t.Errorf("want error %v, got %v", errWALCorrupted, err)
+	}
+	if got != 7 {
+		t.Errorf("want 7 samples before the corrupted record, got %d", got)
+	}
+}
+
+func TestSetRetentionAndMemoryChunks(t *testing.T) {
+	s, closer := NewTestStorage(t, 1)
+	defer closer.Close()
+	ms := s.(*memorySeriesStorage)
+
+	s.SetRetention(time.Hour)
+	want := clientmodel.Now().Add(-time.Hour)
+	if d := ms.dropBefore().Sub(want); d < -time.Minute || d > time.Minute {
+		t.Errorf("want cutoff %v, got %v", want, ms.dropBefore())
+	}
+	s.SetMemoryChunks(42)
+	if got, want := ms.memoryChunksLimit(), 42; got != want {
+		t.Errorf("got memory chunks limit %d, want %d", got, want)
+	}
+}
+
+func TestRetentionSize(t *testing.T) {
+	// The budget is large enough to never be exceeded by the actual disk
+	// usage measured in the background.
+	const budget = 1 << 40
+	ms, closer := newTestStorageWithOptions(t, 1, func(o *MemorySeriesStorageOptions) {
+		o.PersistenceRetentionSize = budget
+	})
+	defer closer.Close()
+
+	now := time.Now()
+	ageCutoff := clientmodel.TimestampFromTime(now).Add(-ms.retention())
+	approx := func(got, want clientmodel.Timestamp) bool {
+		d := got.Sub(want)
+		return d > -time.Minute && d < time.Minute
+	}
+
+	// Within budget, nothing happens.
+	ms.maybeAdvanceSizeCutoff(budget, now)
+	if got := ms.dropBefore(); !approx(got, ageCutoff) {
+		t.Fatalf("want cutoff %v, got %v", ageCutoff, got)
+	}
+
+	// Twice the budget drops the older half of the retained data.
+	ms.maybeAdvanceSizeCutoff(2*budget, now)
+	want := ageCutoff.Add(ms.retention() / 2)
+	if got := ms.dropBefore(); !approx(got, want) {
+		t.Fatalf("want cutoff %v, got %v", want, got)
+	}
+
+	// No further advance before the maintenance has swept all series.
+	ms.maybeAdvanceSizeCutoff(2*budget, now.Add(time.Second))
+	if got := ms.dropBefore(); !approx(got, want) {
+		t.Fatalf("want cutoff %v, got %v", want, got)
+	}
+
+	atomic.StoreInt64(&ms.memorySweepBegin, now.Add(time.Second).UnixNano())
+	atomic.StoreInt64(&ms.archivedSweepBegin, now.Add(time.Second).UnixNano())
+	ms.maybeAdvanceSizeCutoff(2*budget, now.Add(2*time.Second))
+	want = want.Add(ms.retention() / 4)
+	if got := ms.dropBefore(); !approx(got, want) {
+		t.Fatalf("want cutoff %v, got %v", want, got)
+	}
+
+	for _, sample := range createRandomSamples("test", 1000) {
+		ms.Append(sample)
+	}
+	ms.WaitForIndexing()
+	usage, err := ms.persistence.diskUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage <= 0 {
+		t.Errorf("want positive disk usage, got %d", usage)
+	}
+}
+
+func TestRollups(t *testing.T) {
+	s, closer := NewTestStorage(t, 1)
+	defer closer.Close()
+	ms := s.(*memorySeriesStorage)
+
+	// One sample per minute for five hours.
+	m := clientmodel.Metric{clientmodel.MetricNameLabel: "test_rollups"}
+	for i := 0; i < 300; i++ {
+		s.Append(&clientmodel.Sample{
+			Metric:    m,
+			Timestamp: clientmodel.Timestamp(i * 60000),
+			Value:     clientmodel.SampleValue(i % 7),
+		})
+	}
+	s.WaitForIndexing()
+	fp := m.Fingerprint()
+	ms.maintainMemorySeries(fp, clientmodel.Earliest)
+	ms.downsampleSeries(fp, clientmodel.Latest)
+
+	// Buckets are rolled up only up to the last persisted sample.
+	for res, want := range map[time.Duration]clientmodel.Timestamp{
+		time.Hour:       clientmodel.Timestamp(4 * 3600000),
+		5 * time.Minute: clientmodel.Timestamp(295 * 60000),
+	} {
+		first, watermark, ok, err := ms.persistence.rollupBounds(fp, res)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok || first != 0 || watermark != want {
+			t.Errorf("resolution %v: want rollups from 0 to %v, got %v from %v to %v", res, want, ok, first, watermark)
+		}
+	}
+	// Nothing new to roll up.
+	if n, err := ms.persistence.rollUp(fp, time.Hour, clientmodel.Latest); err != nil || n != 0 {
+		t.Errorf("want no new rollups, got %d, %v", n, err)
+	}
+
+	// Rollups plus raw values at the edges yield the same aggregate as the
+	// raw values alone.
+	it := s.NewIterator(fp)
+	for _, in := range []metric.Interval{
+		{OldestInclusive: 17 * 60000, NewestInclusive: 283 * 60000},
+		{OldestInclusive: 0, NewestInclusive: 300 * 60000},
+		{OldestInclusive: 3 * 60000, NewestInclusive: 50 * 60000},
+	} {
+		var want metric.Rollup
+		for _, v := range it.GetRangeValues(in) {
+			want.Add(v.Value)
+		}
+		for _, res := range rollupResolutions {
+			var got metric.Rollup
+			rollups, covered, ok := it.GetRollups(in, res)
+			if !ok {
+				covered = metric.Interval{OldestInclusive: in.NewestInclusive + 1, NewestInclusive: in.NewestInclusive}
+			}
+			for _, r := range rollups {
+				got.Merge(&r)
+			}
+			for _, edge := range []metric.Interval{
+				{OldestInclusive: in.OldestInclusive, NewestInclusive: covered.OldestInclusive - 1},
+				{OldestInclusive: covered.NewestInclusive + 1, NewestInclusive: in.NewestInclusive},
+			} {
+				if edge.NewestInclusive.Before(edge.OldestInclusive) {
+					continue
+				}
+				for _, v := range it.GetRangeValues(edge) {
+					got.Add(v.Value)
+				}
+			}
+			if got.Min != want.Min || got.Max != want.Max || got.Sum != want.Sum || got.Count != want.Count {
+				t.Errorf("interval %v, resolution %v: want %v, got %v", in, res, want, got)
+			}
+		}
+	}
+
+	// A 3h range ending at 5h only needs raw values after the last 5m bucket.
+	intervals := ms.rawIntervalsForRollups(fp, 300*60000, 300*60000, 3*time.Hour)
+	want := []metric.Interval{{OldestInclusive: 295 * 60000, NewestInclusive: 300 * 60000}}
+	if len(intervals) != 1 || intervals[0] != want[0] {
+		t.Errorf("want raw intervals %v, got %v", want, intervals)
+	}
+
+	if err := ms.persistence.dropRollupsBefore(fp, 90*60000); err != nil {
+		t.Fatal(err)
+	}
+	if first, _, _, _ := ms.persistence.rollupBounds(fp, time.Hour); first != 3600000 {
+		t.Errorf("want hourly rollups from 1h, got from %v", first)
+	}
+	if first, _, _, _ := ms.persistence.rollupBounds(fp, 5*time.Minute); first != 90*60000 {
+		t.Errorf("want 5m rollups from 90m, got from %v", first)
+	}
+
+	lm, err := metric.NewLabelMatcher(metric.Equal, clientmodel.MetricNameLabel, "test_rollups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.DropMetricsForLabelMatchers(metric.LabelMatchers{lm})
+	for _, res := range rollupResolutions {
+		if _, _, ok, _ := ms.persistence.rollupBounds(fp, res); ok {
+			t.Errorf("resolution %v: rollups not deleted with series", res)
+		}
+	}
+}
+
+func TestPreloadRanges(t *testing.T) {
+	s, closer := NewTestStorage(t, 1)
+	defer closer.Close()
+	ms := s.(*memorySeriesStorage)
+
+	metrics := []clientmodel.Metric{m1, m2, m3}
+	for i := 0; i < 1000; i++ {
+		for _, m := range metrics {
+			s.Append(&clientmodel.Sample{
+				Metric:    m,
+				Timestamp: clientmodel.Timestamp(2 * i),
+				Value:     clientmodel.SampleValue(i),
+			})
+		}
+	}
+	s.WaitForIndexing()
+
+	// Persist everything and evict all chunks but the head chunks.
+	ranges := map[clientmodel.Fingerprint]metric.Interval{}
+	for _, m := range metrics {
+		fp := m.Fingerprint()
+		ms.maintainMemorySeries(fp, 0)
+		series, ok := ms.fpToSeries.get(fp)
+		if !ok {
+			t.Fatal("could not find series")
+		}
+		evicted := 0
+		for _, cd := range series.chunkDescs[:len(series.chunkDescs)-1] {
+			if cd.maybeEvict() {
+				evicted++
+			}
+		}
+		if evicted == 0 {
+			t.Fatal("no chunks evicted")
+		}
+		ranges[fp] = metric.Interval{OldestInclusive: 100, NewestInclusive: 1500}
+	}
+	ranges[m4.Fingerprint()] = metric.Interval{OldestInclusive: 100, NewestInclusive: 1500}
+
+	p := s.NewPreloader()
+	defer p.Close()
+	if err := p.PreloadRanges(ranges, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range metrics {
+		fp := m.Fingerprint()
+		values := s.NewIterator(fp).GetRangeValues(ranges[fp])
+		if len(values) != 701 {
+			t.Fatalf("%v: want 701 values, got %d", m, len(values))
+		}
+		for _, v := range values {
+			if want := clientmodel.SampleValue(v.Timestamp / 2); v.Value != want {
+				t.Errorf("%v: value at %v: want %v, got %v", m, v.Timestamp, want, v.Value)
+			}
+		}
+	}
+}
+
+func TestPreloadDeadline(t *testing.T) {
+	s, closer := NewTestStorage(t, 1)
+	defer closer.Close()
+
+	for i := 0; i < 10; i++ {
+		s.Append(&clientmodel.Sample{
+			Metric:    m1,
+			Timestamp: clientmodel.Timestamp(i),
+			Value:     clientmodel.SampleValue(i),
+		})
+	}
+	s.WaitForIndexing()
+	fp := m1.Fingerprint()
+	in := metric.Interval{OldestInclusive: 0, NewestInclusive: 9}
+
+	p := s.NewPreloader()
+	defer p.Close()
+	p.SetDeadline(time.Now().Add(time.Hour))
+	if err := p.PreloadRange(fp, in.OldestInclusive, in.NewestInclusive, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	p.SetDeadline(time.Now().Add(-time.Second))
+	if err := p.PreloadRange(fp, in.OldestInclusive, in.NewestInclusive, time.Minute); err != ErrDeadlineExceeded {
+		t.Errorf("want ErrDeadlineExceeded from PreloadRange, got %v", err)
+	}
+	if err := p.PreloadRanges(map[clientmodel.Fingerprint]metric.Interval{fp: in}, time.Minute); err != ErrDeadlineExceeded {
+		t.Errorf("want ErrDeadlineExceeded from PreloadRanges, got %v", err)
+	}
+	// The chunks preloaded before the deadline stay usable.
+	if values := s.NewIterator(fp).GetRangeValues(in); len(values) != 10 {
+		t.Errorf("want 10 values, got %d", len(values))
+	}
+}
+
+func TestPreloadCancel(t *testing.T) {
+	s, closer := NewTestStorage(t, 1)
+	defer closer.Close()
+
+	s.Append(&clientmodel.Sample{Metric: m1, Timestamp: 0, Value: 0})
+	s.WaitForIndexing()
+	fp := m1.Fingerprint()
+
+	canceled := make(chan struct{})
+	p := s.NewPreloader()
+	defer p.Close()
+	p.SetCancel(canceled)
+	if err := p.PreloadRange(fp, 0, 0, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	close(canceled)
+	if err := p.PreloadRange(fp, 0, 0, time.Minute); err != ErrCanceled {
+		t.Errorf("want ErrCanceled from PreloadRange, got %v", err)
+	}
+	if err := p.PreloadRanges(map[clientmodel.Fingerprint]metric.Interval{fp: {}}, time.Minute); err != ErrCanceled {
+		t.Errorf("want ErrCanceled from PreloadRanges, got %v", err)
+	}
+}
+
+func TestPreloadEvictedChunkDescs(t *testing.T) {
+	s, closer := NewTestStorage(t, 1)
+	defer closer.Close()
+	ms := s.(*memorySeriesStorage)
+
+	for i := 0; i < 100000; i++ {
+		s.Append(&clientmodel.Sample{
+			Metric:    m1,
+			Timestamp: clientmodel.Timestamp(i),
+			Value:     clientmodel.SampleValue(i),
+		})
+	}
+	s.WaitForIndexing()
+
+	fp := m1.Fingerprint()
+	ms.maintainMemorySeries(fp, 0)
+	series, ok := ms.fpToSeries.get(fp)
+	if !ok {
+		t.Fatal("could not find series")
+	}
+	numChunkDescs := len(series.chunkDescs)
+	for _, cd := range series.chunkDescs[:numChunkDescs-1] {
+		cd.maybeEvict()
+	}
+	series.evictChunkDescs(numChunkDescs-1, chunkDescEvictionFactor)
+	if series.chunkDescsOffset == 0 {
+		t.Fatal("no chunk descs evicted")
+	}
+
+	// Preloading the recent past must only load the chunk descs needed.
+	from := series.chunkDescs[0].firstTime() - 1
+	p := s.NewPreloader()
+	defer p.Close()
+	if err := p.PreloadRange(fp, from, from, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if series.chunkDescsOffset <= 0 {
+		t.Errorf("want some chunk descs still evicted, got offset %d", series.chunkDescsOffset)
+	}
+	if got := series.chunkDescsOffset + len(series.chunkDescs); got != numChunkDescs {
+		t.Errorf("want %d chunks, got %d", numChunkDescs, got)
+	}
+	values := s.NewIterator(fp).GetValueAtTime(from)
+	if len(values) != 1 || values[0].Timestamp != from || values[0].Value != clientmodel.SampleValue(from) {
+		t.Errorf("unexpected values at %v: %v", from, values)
+	}
+
+	// Preloading from the beginning loads all chunk descs.
+	if err := p.PreloadRange(fp, 0, 0, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if series.chunkDescsOffset != 0 || len(series.chunkDescs) != numChunkDescs {
+		t.Errorf("want all %d chunk descs loaded, got %d at offset %d", numChunkDescs, len(series.chunkDescs), series.chunkDescsOffset)
+	}
+}
+
+func TestEvictChunkDescsOfIdleSeries(t *testing.T) {
+	ms, closer := newTestStorageWithOptions(t, 1, func(o *MemorySeriesStorageOptions) {
+		o.ChunkDescIdleTimeout = time.Hour
+	})
+	defer closer.Close()
+
+	for i := 0; i < 100000; i++ {
+		ms.Append(&clientmodel.Sample{
+			Metric:    m1,
+			Timestamp: clientmodel.Timestamp(i),
+			Value:     clientmodel.SampleValue(i),
+		})
+	}
+	ms.WaitForIndexing()
+
+	fp := m1.Fingerprint()
+	ms.maintainMemorySeries(fp, 0)
+	series, ok := ms.fpToSeries.get(fp)
+	if !ok {
+		t.Fatal("could not find series")
+	}
+	numChunkDescs := len(series.chunkDescs)
+	for _, cd := range series.chunkDescs[:numChunkDescs-1] {
+		cd.maybeEvict()
+	}
+
+	// A recently queried series keeps the chunk descs of some evicted chunks.
+	series.lastQueried = time.Now()
+	ms.maintainMemorySeries(fp, 0)
+	if len(series.chunkDescs) < 2 {
+		t.Fatalf("want chunk descs of evicted chunks kept, got %d chunk descs", len(series.chunkDescs))
+	}
+
+	// An idle series only keeps the chunk descs of chunks in memory.
+	series.lastQueried = time.Now().Add(-2 * time.Hour)
+	ms.maintainMemorySeries(fp, 0)
+	if len(series.chunkDescs) != 1 || series.chunkDescsOffset != numChunkDescs-1 {
+		t.Fatalf("want only the head chunk desc kept, got %d chunk descs at offset %d", len(series.chunkDescs), series.chunkDescsOffset)
+	}
+
+	// Querying the series loads the chunk descs again.
+	p := ms.NewPreloader()
+	defer p.Close()
+	if err := p.PreloadRange(fp, 0, 0, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if series.chunkDescsOffset != 0 || len(series.chunkDescs) != numChunkDescs {
+		t.Errorf("want all %d chunk descs loaded, got %d at offset %d", numChunkDescs, len(series.chunkDescs), series.chunkDescsOffset)
+	}
+	if time.Since(series.lastQueried) > time.Minute {
+		t.Errorf("want series marked as queried, last queried at %v", series.lastQueried)
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	s, closer := NewTestStorage(t, 1)
+	defer closer.Close()
+	ms := s.(*memorySeriesStorage)
+
+	mInMemory := clientmodel.Metric{clientmodel.MetricNameLabel: "backfill", "series": "in_memory"}
+	mNew := clientmodel.Metric{clientmodel.MetricNameLabel: "backfill", "series": "new"}
+	for i := 1000; i < 2000; i++ {
+		s.Append(&clientmodel.Sample{
+			Metric:    mInMemory,
+			Timestamp: clientmodel.Timestamp(i),
+			Value:     clientmodel.SampleValue(i),
+		})
+	}
+	s.WaitForIndexing()
+
+	var samples clientmodel.Samples
+	for i := 999; i >= 0; i-- {
+		samples = append(samples,
+			&clientmodel.Sample{Metric: mInMemory, Timestamp: clientmodel.Timestamp(i), Value: clientmodel.SampleValue(-i)},
+			&clientmodel.Sample{Metric: mNew, Timestamp: clientmodel.Timestamp(i), Value: clientmodel.SampleValue(i)},
+		)
+	}
+	// Too new for the series in memory, and a duplicate.
+	samples = append(samples,
+		&clientmodel.Sample{Metric: mInMemory, Timestamp: 1500, Value: 0},
+		&clientmodel.Sample{Metric: mNew, Timestamp: 500, Value: 0},
+	)
+	if n, err := s.Backfill(samples); err != nil || n != 2000 {
+		t.Fatalf("got %d samples written, error %v, want 2000", n, err)
+	}
+
+	// The new series is archived and indexed.
+	s.WaitForIndexing()
+	lm, err := metric.NewLabelMatcher(metric.Equal, "series", "new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fps := s.GetFingerprintsForLabelMatchers(metric.LabelMatchers{lm}); len(fps) != 1 || fps[0] != mNew.Fingerprint() {
+		t.Errorf("got fingerprints %v for new series", fps)
+	}
+	if has, first, last, err := ms.persistence.hasArchivedMetric(mNew.Fingerprint()); err != nil || !has || first != 0 || last != 999 {
+		t.Errorf("got archived %v, time range %v-%v, error %v for new series", has, first, last, err)
+	}
+
+	// Backfilling an archived series extends its time range.
+	if n, err := s.Backfill(clientmodel.Samples{
+		{Metric: mNew, Timestamp: -10, Value: 10},
+		{Metric: mNew, Timestamp: 2000, Value: 2000},
+	}); err != nil || n != 2 {
+		t.Fatalf("got %d samples written, error %v, want 2", n, err)
+	}
+	if has, first, last, err := ms.persistence.hasArchivedMetric(mNew.Fingerprint()); err != nil || !has || first != -10 || last != 2000 {
+		t.Errorf("got archived %v, time range %v-%v, error %v for new series", has, first, last, err)
+	}
+
+	for m, want := range map[*clientmodel.Metric]int{&mInMemory: 2000, &mNew: 1002} {
+		fp := m.Fingerprint()
+		p := s.NewPreloader()
+		if err := p.PreloadRange(fp, -10, 2000, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		values := s.NewIterator(fp).GetRangeValues(metric.Interval{OldestInclusive: -10, NewestInclusive: 2000})
+		p.Close()
+		if len(values) != want {
+			t.Errorf("%v: got %d values, want %d", *m, len(values), want)
+		}
+		for i := 1; i < len(values); i++ {
+			if !values[i].Timestamp.After(values[i-1].Timestamp) {
+				t.Fatalf("%v: values out of order at index %d", *m, i)
+			}
+		}
+	}
+	series, ok := ms.fpToSeries.get(mInMemory.Fingerprint())
+	if !ok {
+		t.Fatal("could not find series")
+	}
+	if first := series.firstTime(); first != 0 {
+		t.Errorf("got first time %v of the series in memory, want 0", first)
+	}
+	values := s.NewIterator(mInMemory.Fingerprint()).GetValueAtTime(500)
+	if len(values) != 1 || values[0].Value != -500 {
+		t.Errorf("got values %v at 500", values)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	samples := createRandomSamples("test", 1000)
+	s, closer := NewTestStorage(t, 1)
+	defer closer.Close()
+	for _, sample := range samples {
+		s.Append(sample)
+	}
+	s.WaitForIndexing()
+
+	dir, err := s.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Ingestion continues undisturbed.
+	after := clientmodel.Metric{clientmodel.MetricNameLabel: "after_snapshot"}
+	s.Append(&clientmodel.Sample{Metric: after, Timestamp: clientmodel.Now()})
+
+	o := &MemorySeriesStorageOptions{
+		MemoryChunks:               1000000,
+		MaxChunksToPersist:         1000000,
+		PersistenceRetentionPeriod: 24 * time.Hour * 365 * 100,
+		PersistenceStoragePath:     dir,
+		MinCheckpointInterval:      time.Hour,
+		MaxCheckpointInterval:      time.Hour,
+		SyncStrategy:               Adaptive,
+	}
+	restored, err := NewMemorySeriesStorage(o)
+	if err != nil {
+		t.Fatalf("Error creating storage from snapshot: %s", err)
+	}
+	restored.Start()
+	defer restored.Stop()
+	if !verifyStorage(t, restored, samples, 24*7*time.Hour) {
+		t.Error("snapshot does not contain all samples")
+	}
+	if _, ok := restored.(*memorySeriesStorage).fpToSeries.get(after.Fingerprint()); ok {
+		t.Error("snapshot contains series appended to afterwards")
+	}
+
+	if _, err := s.Snapshot(); err != nil {
+		t.Errorf("second snapshot failed: %s", err)
+	}
+}
+
+func testChunk(t *testing.T, encoding ChunkEncoding) {
 	samples := make(clientmodel.Samples, 500000)
 	for i := range samples {
 		samples[i] = &clientmodel.Sample{
@@ -209,9 +1450,36 @@ func testChunk(t *testing.T, encoding chunkEncoding) {
 			if cd.isEvicted() {
 				continue
 			}
+			var chunkValues metric.Values
 			for sample := range cd.chunk.values() {
-				values = append(values, *sample)
+				chunkValues = append(chunkValues, *sample)
+			}
+			i := len(chunkValues)
+			for sample := range cd.chunk.newIterator().reverseValues() {
+				i--
+				if i < 0 || !sample.Equal(&chunkValues[i]) {
+					t.Fatalf("Reverse values of chunk differ from values at index %d.", i)
+				}
 			}
+			if i != 0 {
+				t.Errorf("Got %d reverse values, want %d.", len(chunkValues)-i, len(chunkValues))
+			}
+			it := cd.chunk.newIterator()
+			for batch := it.nextBatch(); batch != nil; batch = it.nextBatch() {
+				if len(batch) > chunkIteratorBatchSize {
+					t.Fatalf("Got batch of %d values, want at most %d.", len(batch), chunkIteratorBatchSize)
+				}
+				for j := range batch {
+					if i >= len(chunkValues) || !batch[j].Equal(&chunkValues[i]) {
+						t.Fatalf("Batched values of chunk differ from values at index %d.", i)
+					}
+					i++
+				}
+			}
+			if i != len(chunkValues) {
+				t.Errorf("Got %d batched values, want %d.", i, len(chunkValues))
+			}
+			values = append(values, chunkValues...)
 		}
 
 		for i, v := range values {
@@ -227,6 +1495,41 @@ func testChunk(t *testing.T, encoding chunkEncoding) {
 	glog.Info("test done, closing")
 }
 
+func testChunkIteratorAllocs(t *testing.T, encoding ChunkEncoding) {
+	c := newChunkForEncoding(encoding)
+	for i := 0; i < 100; i++ {
+		cs := c.add(&metric.SamplePair{
+			Timestamp: clientmodel.Timestamp(i * 1000),
+			Value:     clientmodel.SampleValue(i) * 0.5,
+		})
+		if len(cs) != 1 {
+			t.Fatal("chunk overflowed")
+		}
+		c = cs[0]
+	}
+	it := c.newIterator()
+	in := metric.Interval{OldestInclusive: 10000, NewestInclusive: 60000}
+
+	// Only the result slice may be allocated, not the individual samples.
+	if allocs := testing.AllocsPerRun(100, func() { it.getRangeValues(in) }); allocs > 1 {
+		t.Errorf("getRangeValues: want at most 1 allocation, got %v", allocs)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { it.getValueAtTime(15500) }); allocs > 1 {
+		t.Errorf("getValueAtTime: want at most 1 allocation, got %v", allocs)
+	}
+	if values := it.getRangeValues(in); len(values) != 51 || values[0].Value != 5 {
+		t.Errorf("unexpected range values %v", values)
+	}
+}
+
+func TestChunkIteratorAllocsChunkType0(t *testing.T) {
+	testChunkIteratorAllocs(t, 0)
+}
+
+func TestChunkIteratorAllocsChunkType1(t *testing.T) {
+	testChunkIteratorAllocs(t, 1)
+}
+
 func TestChunkType0(t *testing.T) {
 	testChunk(t, 0)
 }
@@ -235,7 +1538,11 @@ func TestChunkType1(t *testing.T) {
 	testChunk(t, 1)
 }
 
-func testGetValueAtTime(t *testing.T, encoding chunkEncoding) {
+func TestChunkType2(t *testing.T) {
+	testChunk(t, 2)
+}
+
+func testGetValueAtTime(t *testing.T, encoding ChunkEncoding) {
 	samples := make(clientmodel.Samples, 1000)
 	for i := range samples {
 		samples[i] = &clientmodel.Sample{
@@ -328,7 +1635,11 @@ func TestGetValueAtTimeChunkType1(t *testing.T) {
 	testGetValueAtTime(t, 1)
 }
 
-func testGetRangeValues(t *testing.T, encoding chunkEncoding) {
+func TestGetValueAtTimeChunkType2(t *testing.T) {
+	testGetValueAtTime(t, 2)
+}
+
+func testGetRangeValues(t *testing.T, encoding ChunkEncoding) {
 	samples := make(clientmodel.Samples, 1000)
 	for i := range samples {
 		samples[i] = &clientmodel.Sample{
@@ -373,114 +1684,632 @@ func testGetRangeValues(t *testing.T, encoding chunkEncoding) {
 			NewestInclusive: expected.Timestamp + 1,
 		})
 
-		if len(actual) != 0 {
-			t.Fatalf("2.%d. Expected no result, got %d.", i, len(actual))
-		}
+		if len(actual) != 0 {
+			t.Fatalf("2.%d. Expected no result, got %d.", i, len(actual))
+		}
+	}
+
+	// #3 2sec interval around sample.
+	for i, expected := range samples {
+		actual := it.GetRangeValues(metric.Interval{
+			OldestInclusive: expected.Timestamp - 1,
+			NewestInclusive: expected.Timestamp + 1,
+		})
+
+		if len(actual) != 1 {
+			t.Fatalf("3.%d. Expected exactly one result, got %d.", i, len(actual))
+		}
+		if expected.Timestamp != actual[0].Timestamp {
+			t.Errorf("3.%d. Got %v; want %v.", i, actual[0].Timestamp, expected.Timestamp)
+		}
+		if expected.Value != actual[0].Value {
+			t.Errorf("3.%d. Got %v; want %v.", i, actual[0].Value, expected.Value)
+		}
+	}
+
+	// #4 2sec interval sample to sample.
+	for i, expected1 := range samples {
+		if i == len(samples)-1 {
+			continue
+		}
+		expected2 := samples[i+1]
+		actual := it.GetRangeValues(metric.Interval{
+			OldestInclusive: expected1.Timestamp,
+			NewestInclusive: expected1.Timestamp + 2,
+		})
+
+		if len(actual) != 2 {
+			t.Fatalf("4.%d. Expected exactly 2 results, got %d.", i, len(actual))
+		}
+		if expected1.Timestamp != actual[0].Timestamp {
+			t.Errorf("4.%d. Got %v for 1st result; want %v.", i, actual[0].Timestamp, expected1.Timestamp)
+		}
+		if expected1.Value != actual[0].Value {
+			t.Errorf("4.%d. Got %v for 1st result; want %v.", i, actual[0].Value, expected1.Value)
+		}
+		if expected2.Timestamp != actual[1].Timestamp {
+			t.Errorf("4.%d. Got %v for 2nd result; want %v.", i, actual[1].Timestamp, expected2.Timestamp)
+		}
+		if expected2.Value != actual[1].Value {
+			t.Errorf("4.%d. Got %v for 2nd result; want %v.", i, actual[1].Value, expected2.Value)
+		}
+	}
+
+	// #5 corner cases: Interval ends at first sample, interval starts
+	// at last sample, interval entirely before/after samples.
+	expected := samples[0]
+	actual := it.GetRangeValues(metric.Interval{
+		OldestInclusive: expected.Timestamp - 2,
+		NewestInclusive: expected.Timestamp,
+	})
+	if len(actual) != 1 {
+		t.Fatalf("5.1. Expected exactly one result, got %d.", len(actual))
+	}
+	if expected.Timestamp != actual[0].Timestamp {
+		t.Errorf("5.1. Got %v; want %v.", actual[0].Timestamp, expected.Timestamp)
+	}
+	if expected.Value != actual[0].Value {
+		t.Errorf("5.1. Got %v; want %v.", actual[0].Value, expected.Value)
+	}
+	expected = samples[len(samples)-1]
+	actual = it.GetRangeValues(metric.Interval{
+		OldestInclusive: expected.Timestamp,
+		NewestInclusive: expected.Timestamp + 2,
+	})
+	if len(actual) != 1 {
+		t.Fatalf("5.2. Expected exactly one result, got %d.", len(actual))
+	}
+	if expected.Timestamp != actual[0].Timestamp {
+		t.Errorf("5.2. Got %v; want %v.", actual[0].Timestamp, expected.Timestamp)
+	}
+	if expected.Value != actual[0].Value {
+		t.Errorf("5.2. Got %v; want %v.", actual[0].Value, expected.Value)
+	}
+	firstSample := samples[0]
+	actual = it.GetRangeValues(metric.Interval{
+		OldestInclusive: firstSample.Timestamp - 4,
+		NewestInclusive: firstSample.Timestamp - 2,
+	})
+	if len(actual) != 0 {
+		t.Fatalf("5.3. Expected no results, got %d.", len(actual))
+	}
+	lastSample := samples[len(samples)-1]
+	actual = it.GetRangeValues(metric.Interval{
+		OldestInclusive: lastSample.Timestamp + 2,
+		NewestInclusive: lastSample.Timestamp + 4,
+	})
+	if len(actual) != 0 {
+		t.Fatalf("5.3. Expected no results, got %d.", len(actual))
+	}
+}
+
+func TestGetRangeValuesChunkType0(t *testing.T) {
+	testGetRangeValues(t, 0)
+}
+
+func TestGetRangeValuesChunkType1(t *testing.T) {
+	testGetRangeValues(t, 1)
+}
+
+func TestGetRangeValuesChunkType2(t *testing.T) {
+	testGetRangeValues(t, 2)
+}
+
+func testOutOfOrderSamples(t *testing.T, encoding ChunkEncoding) {
+	ms, closer := newTestStorageWithOptions(t, encoding, func(o *MemorySeriesStorageOptions) {
+		o.OutOfOrderTolerance = 100 * time.Millisecond
+	})
+	defer closer.Close()
+
+	want := metric.Values{}
+	for i := 0; i < 20; i++ {
+		sample := &clientmodel.Sample{
+			Timestamp: clientmodel.Timestamp(10 * i),
+			Value:     clientmodel.SampleValue(i),
+		}
+		ms.Append(sample)
+		want = append(want, metric.SamplePair{Timestamp: sample.Timestamp, Value: sample.Value})
+	}
+
+	for _, sample := range []*clientmodel.Sample{
+		{Timestamp: 185, Value: -1}, // Merged.
+		{Timestamp: 180, Value: -2}, // Discarded, timestamp already taken.
+		{Timestamp: 85, Value: -3},  // Discarded, older than the tolerance.
+		{Timestamp: 95, Value: -4},  // Merged.
+	} {
+		ms.Append(sample)
+	}
+	want = append(want[:10], append(metric.Values{{Timestamp: 95, Value: -4}}, want[10:]...)...)
+	want = append(want[:20], metric.SamplePair{Timestamp: 185, Value: -1}, want[20])
+
+	fp := clientmodel.Metric{}.Fingerprint()
+	series, ok := ms.fpToSeries.get(fp)
+	if !ok {
+		t.Fatal("could not find series")
+	}
+	var got metric.Values
+	for _, cd := range series.chunkDescs {
+		for sample := range cd.chunk.values() {
+			got = append(got, *sample)
+		}
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d samples, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !got[i].Equal(&want[i]) {
+			t.Errorf("%d. got %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestOutOfOrderSamplesChunkType0(t *testing.T) {
+	testOutOfOrderSamples(t, 0)
+}
+
+func TestOutOfOrderSamplesChunkType1(t *testing.T) {
+	testOutOfOrderSamples(t, 1)
+}
+
+func TestOutOfOrderSamplesChunkType2(t *testing.T) {
+	testOutOfOrderSamples(t, 2)
+}
+
+func TestDuplicateSamples(t *testing.T) {
+	ms, closer := newTestStorageWithOptions(t, 1, func(o *MemorySeriesStorageOptions) {
+		o.OutOfOrderTolerance = 100 * time.Millisecond
+	})
+	defer closer.Close()
+
+	for i := 0; i < 5; i++ {
+		ms.Append(&clientmodel.Sample{
+			Timestamp: clientmodel.Timestamp(10 * i),
+			Value:     clientmodel.SampleValue(i),
+		})
+	}
+	ms.AppendBatch(clientmodel.Samples{
+		{Timestamp: 40, Value: 4}, // Duplicate of the last sample.
+		{Timestamp: 20, Value: 2}, // Duplicate within the tolerance.
+		{Timestamp: 50, Value: 5}, // Appended.
+		{Timestamp: 50, Value: 5}, // Duplicate within the same batch.
+	})
+
+	m := &dto.Metric{}
+	ms.duplicateSamplesCount.Write(m)
+	if got := m.GetCounter().GetValue(); got != 3 {
+		t.Errorf("want 3 duplicate samples, got %v", got)
+	}
+	series, ok := ms.fpToSeries.get(clientmodel.Metric{}.Fingerprint())
+	if !ok {
+		t.Fatal("could not find series")
+	}
+	var got metric.Values
+	for sample := range series.head().chunk.values() {
+		got = append(got, *sample)
+	}
+	if len(got) != 6 {
+		t.Errorf("want 6 samples, got %v", got)
+	}
+}
+
+func TestSeriesQuotas(t *testing.T) {
+	ms, closer := newTestStorageWithOptions(t, 1, func(o *MemorySeriesStorageOptions) {
+		o.SeriesQuotas = []SeriesQuota{{LabelName: clientmodel.JobLabel, MaxSeries: 2}}
+	})
+	defer closer.Close()
+
+	metricFor := func(job, instance clientmodel.LabelValue) clientmodel.Metric {
+		return clientmodel.Metric{
+			clientmodel.MetricNameLabel: "test",
+			clientmodel.JobLabel:        job,
+			"instance":                  instance,
+		}
+	}
+	samples := clientmodel.Samples{
+		{Metric: metricFor("a", "1"), Timestamp: 1, Value: 1},
+		{Metric: metricFor("a", "2"), Timestamp: 1, Value: 1},
+		{Metric: metricFor("a", "3"), Timestamp: 1, Value: 1}, // Exceeds the quota.
+		{Metric: metricFor("b", "1"), Timestamp: 1, Value: 1},
+		{Metric: clientmodel.Metric{clientmodel.MetricNameLabel: "no_job"}, Timestamp: 1, Value: 1},
+	}
+	// Appended one by one as AppendBatch does not preserve the order of
+	// series.
+	for _, sample := range samples {
+		ms.Append(sample)
+	}
+	// Existing series are not affected by the quota.
+	ms.Append(&clientmodel.Sample{Metric: metricFor("a", "1"), Timestamp: 2, Value: 2})
+	ms.Append(&clientmodel.Sample{Metric: metricFor("a", "3"), Timestamp: 2, Value: 2}) // Exceeds the quota.
+
+	if got := ms.fpToSeries.length(); got != 4 {
+		t.Errorf("want 4 series in memory, got %d", got)
+	}
+	if _, ok := ms.fpToSeries.get(metricFor("a", "3").Fingerprint()); ok {
+		t.Error("series exceeding the quota was created")
+	}
+	m := &dto.Metric{}
+	ms.quotaRejectedSamplesCount.WithLabelValues(string(clientmodel.JobLabel)).Write(m)
+	if got := m.GetCounter().GetValue(); got != 2 {
+		t.Errorf("want 2 rejected samples, got %v", got)
+	}
+
+	// Once a series of the job is gone, a new one fits into the quota.
+	ms.purgeSeries(metricFor("a", "1").Fingerprint())
+	ms.Append(&clientmodel.Sample{Metric: metricFor("a", "3"), Timestamp: 3, Value: 3})
+	if _, ok := ms.fpToSeries.get(metricFor("a", "3").Fingerprint()); !ok {
+		t.Error("series within the quota was not created")
+	}
+}
+
+func TestSeriesChurn(t *testing.T) {
+	s, closer := NewTestStorage(t, 1)
+	defer closer.Close()
+	ms := s.(*memorySeriesStorage)
+
+	for i := 0; i < 3; i++ {
+		s.Append(&clientmodel.Sample{
+			Metric:    clientmodel.Metric{clientmodel.MetricNameLabel: "churning", "request_id": clientmodel.LabelValue(fmt.Sprint(i))},
+			Timestamp: clientmodel.Timestamp(i),
+			Value:     1,
+		})
+	}
+	stable := clientmodel.Metric{clientmodel.MetricNameLabel: "stable"}
+	s.Append(&clientmodel.Sample{Metric: stable, Timestamp: 0, Value: 1})
+	s.WaitForIndexing()
+
+	// Archive the series of the stable metric.
+	fp := stable.Fingerprint()
+	series, ok := ms.fpToSeries.get(fp)
+	if !ok {
+		t.Fatal("could not find series")
+	}
+	series.headChunkClosed = true
+	ms.maintainMemorySeries(fp, clientmodel.Earliest)
+	for _, cd := range series.chunkDescs {
+		cd.maybeEvict()
+	}
+	ms.maintainMemorySeries(fp, clientmodel.Earliest)
+	if _, ok := ms.fpToSeries.get(fp); ok {
+		t.Fatal("series not archived")
+	}
+	// Unarchiving does not count as creation.
+	s.Append(&clientmodel.Sample{Metric: stable, Timestamp: 1, Value: 1})
+
+	want := []SeriesChurn{
+		{MetricName: "churning", Created: 3},
+		{MetricName: "stable", Created: 1, Archived: 1},
+	}
+	if got := s.GetSeriesChurn(10); !reflect.DeepEqual(got, want) {
+		t.Errorf("want series churn %v, got %v", want, got)
+	}
+	if got := s.GetSeriesChurn(1); !reflect.DeepEqual(got, want[:1]) {
+		t.Errorf("want series churn %v, got %v", want[:1], got)
+	}
+}
+
+func TestPurgeUnqueriedArchivedSeries(t *testing.T) {
+	ms, closer := newTestStorageWithOptions(t, 1, func(o *MemorySeriesStorageOptions) {
+		o.PurgeUnqueriedAfter = 24 * time.Hour
+	})
+	defer closer.Close()
+
+	queried := clientmodel.Metric{clientmodel.MetricNameLabel: "queried"}
+	unqueried := clientmodel.Metric{clientmodel.MetricNameLabel: "unqueried"}
+	for _, m := range []clientmodel.Metric{queried, unqueried} {
+		ms.Append(&clientmodel.Sample{Metric: m, Timestamp: 0, Value: 1})
+	}
+	ms.WaitForIndexing()
+	for _, m := range []clientmodel.Metric{queried, unqueried} {
+		fp := m.Fingerprint()
+		series, _ := ms.fpToSeries.get(fp)
+		series.headChunkClosed = true
+		ms.maintainMemorySeries(fp, clientmodel.Earliest)
+		for _, cd := range series.chunkDescs {
+			cd.maybeEvict()
+		}
+		ms.maintainMemorySeries(fp, clientmodel.Earliest)
+		if _, ok := ms.fpToSeries.get(fp); ok {
+			t.Fatalf("series %v not archived", m)
+		}
+	}
+	ms.WaitForIndexing()
+
+	isArchived := func(m clientmodel.Metric) bool {
+		has, _, _, err := ms.persistence.hasArchivedMetric(m.Fingerprint())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return has
+	}
+
+	// The first sweep only records the archived series as queried.
+	ms.purgeUnqueriedArchivedSeries()
+	if !isArchived(queried) || !isArchived(unqueried) {
+		t.Fatal("archived series purged although the policy was just enabled")
+	}
+
+	// Let a long time pass, and query one of the series.
+	ms.queryLog.mtx.Lock()
+	for fp := range ms.queryLog.hours {
+		ms.queryLog.hours[fp] -= 48
+	}
+	ms.queryLog.mtx.Unlock()
+	p := ms.NewPreloader()
+	if err := p.PreloadRange(queried.Fingerprint(), 1000, 2000, 0); err != nil {
+		t.Fatal(err)
+	}
+	p.Close()
+
+	ms.purgeUnqueriedArchivedSeries()
+	ms.WaitForIndexing()
+	if !isArchived(queried) {
+		t.Error("queried series purged")
+	}
+	if isArchived(unqueried) {
+		t.Error("unqueried series not purged")
+	}
+	if fps := ms.GetFingerprintsForLabelMatchers(metric.LabelMatchers{{
+		Type: metric.Equal, Name: clientmodel.MetricNameLabel, Value: "unqueried",
+	}}); len(fps) != 0 {
+		t.Errorf("unqueried series still indexed: %v", fps)
+	}
+}
+
+func TestColdTier(t *testing.T) {
+	directory := test.NewTemporaryDirectory("test_storage", t)
+	defer directory.Close()
+	coldDir := test.NewTemporaryDirectory("test_cold_tier", t)
+	defer coldDir.Close()
+	store := objectstore.Dir(coldDir.Path())
+	o := &MemorySeriesStorageOptions{
+		MemoryChunks:               1000000,
+		MaxChunksToPersist:         1000000,
+		PersistenceRetentionPeriod: 24 * time.Hour * 365 * 100, // Enough to never trigger purging.
+		PersistenceStoragePath:     directory.Path(),
+		MinCheckpointInterval:      time.Hour,
+		MaxCheckpointInterval:      time.Hour,
+		SyncStrategy:               Adaptive,
+		ColdTier:                   store,
+		ColdTierAfter:              time.Hour,
+		ColdCacheSize:              1024 * 1024,
+	}
+	s, err := NewMemorySeriesStorage(o)
+	if err != nil {
+		t.Fatalf("Error creating storage: %s", err)
+	}
+	s.Start()
+	ms := s.(*memorySeriesStorage)
+
+	m := clientmodel.Metric{clientmodel.MetricNameLabel: "cold"}
+	fp := m.Fingerprint()
+	for i := 0; i < 10000; i++ {
+		s.Append(&clientmodel.Sample{
+			Metric:    m,
+			Timestamp: clientmodel.Timestamp(i * 1000),
+			Value:     clientmodel.SampleValue(rand.Float64()),
+		})
+	}
+	s.WaitForIndexing()
+
+	series, _ := ms.fpToSeries.get(fp)
+	series.headChunkClosed = true
+	numChunks := len(series.chunkDescs)
+	if numChunks < 3 {
+		t.Fatalf("expected more than %d chunks", numChunks)
 	}
+	// The first maintenance persists all chunks, the second moves all but
+	// the last one to the cold tier.
+	ms.maintainMemorySeries(fp, clientmodel.Earliest)
+	ms.maintainMemorySeries(fp, clientmodel.Earliest)
 
-	// #3 2sec interval around sample.
-	for i, expected := range samples {
-		actual := it.GetRangeValues(metric.Interval{
-			OldestInclusive: expected.Timestamp - 1,
-			NewestInclusive: expected.Timestamp + 1,
-		})
+	if len(series.chunkDescs) != 1 {
+		t.Errorf("expected 1 chunk left in memory, got %d", len(series.chunkDescs))
+	}
+	segs := ms.coldTier.segments[fp]
+	if len(segs) != 1 || segs[0].numChunks != numChunks-1 || segs[0].firstTime != 0 {
+		t.Fatalf("unexpected cold segments %v", segs)
+	}
+	if _, err := store.Get(segs[0].key(fp)); err != nil {
+		t.Fatal(err)
+	}
+	cds, err := ms.loadChunkDescs(fp, clientmodel.Latest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cds) != 1 {
+		t.Errorf("expected 1 chunk left in series file, got %d", len(cds))
+	}
 
-		if len(actual) != 1 {
-			t.Fatalf("3.%d. Expected exactly one result, got %d.", i, len(actual))
-		}
-		if expected.Timestamp != actual[0].Timestamp {
-			t.Errorf("3.%d. Got %v; want %v.", i, actual[0].Timestamp, expected.Timestamp)
-		}
-		if expected.Value != actual[0].Value {
-			t.Errorf("3.%d. Got %v; want %v.", i, actual[0].Value, expected.Value)
+	// Queries fetch the cold chunks.
+	p := s.NewPreloader()
+	if err := p.PreloadRange(fp, 0, 10000*1000, 0); err != nil {
+		t.Fatal(err)
+	}
+	if p.NumChunks() != numChunks {
+		t.Errorf("expected %d preloaded chunks, got %d", numChunks, p.NumChunks())
+	}
+	values := s.NewIterator(fp).GetRangeValues(metric.Interval{OldestInclusive: 0, NewestInclusive: 10000 * 1000})
+	p.Close()
+	if len(values) != 10000 {
+		t.Fatalf("expected 10000 values, got %d", len(values))
+	}
+	for i, v := range values {
+		if v.Timestamp != clientmodel.Timestamp(i*1000) {
+			t.Fatalf("%d. unexpected timestamp %v", i, v.Timestamp)
 		}
 	}
 
-	// #4 2sec interval sample to sample.
-	for i, expected1 := range samples {
-		if i == len(samples)-1 {
-			continue
-		}
-		expected2 := samples[i+1]
-		actual := it.GetRangeValues(metric.Interval{
-			OldestInclusive: expected1.Timestamp,
-			NewestInclusive: expected1.Timestamp + 2,
-		})
+	// The cold index survives a restart.
+	if err := s.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = NewMemorySeriesStorage(o); err != nil {
+		t.Fatalf("Error re-creating storage: %s", err)
+	}
+	s.Start()
+	defer s.Stop()
+	ms = s.(*memorySeriesStorage)
+	if !reflect.DeepEqual(ms.coldTier.segments[fp], segs) {
+		t.Errorf("unexpected cold segments after reloading: want %v, got %v", segs, ms.coldTier.segments[fp])
+	}
 
-		if len(actual) != 2 {
-			t.Fatalf("4.%d. Expected exactly 2 results, got %d.", i, len(actual))
+	// Purging the series deletes its cold segments.
+	ms.purgeSeries(fp)
+	if len(ms.coldTier.segments[fp]) != 0 {
+		t.Error("cold segments not purged")
+	}
+	if _, err := store.Get(segs[0].key(fp)); !os.IsNotExist(err) {
+		t.Error("expected cold segment to be deleted, got: ", err)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	pms, primaryCloser := newTestStorageWithOptions(t, 1, func(o *MemorySeriesStorageOptions) {
+		o.ReplicationJournalLength = 100
+	})
+	defer primaryCloser.Close()
+	server := httptest.NewServer(NewReplicationHandler(pms))
+	defer server.Close()
+
+	// Syncs are triggered explicitly below, apart from the one when the
+	// standby starts.
+	sms, standbyCloser := newTestStorageWithOptions(t, 1, func(o *MemorySeriesStorageOptions) {
+		o.ReplicateFrom = server.URL + "/"
+		o.ReplicationInterval = time.Hour
+	})
+	defer standbyCloser.Close()
+
+	m := clientmodel.Metric{clientmodel.MetricNameLabel: "replicated"}
+	fp := m.Fingerprint()
+	persist := func(from, to int) {
+		for i := from; i < to; i++ {
+			pms.Append(&clientmodel.Sample{
+				Metric:    m,
+				Timestamp: clientmodel.Timestamp(i * 1000),
+				Value:     clientmodel.SampleValue(i),
+			})
 		}
-		if expected1.Timestamp != actual[0].Timestamp {
-			t.Errorf("4.%d. Got %v for 1st result; want %v.", i, actual[0].Timestamp, expected1.Timestamp)
+		pms.WaitForIndexing()
+		series, _ := pms.fpToSeries.get(fp)
+		series.headChunkClosed = true
+		pms.maintainMemorySeries(fp, clientmodel.Earliest)
+	}
+	sync := func() {
+		if err := sms.replica.sync(nil); err != nil {
+			t.Fatal(err)
 		}
-		if expected1.Value != actual[0].Value {
-			t.Errorf("4.%d. Got %v for 1st result; want %v.", i, actual[0].Value, expected1.Value)
+	}
+	expectSameFile := func() {
+		want, err := ioutil.ReadFile(pms.persistence.fileNameForFingerprint(fp))
+		if err != nil {
+			t.Fatal(err)
 		}
-		if expected2.Timestamp != actual[1].Timestamp {
-			t.Errorf("4.%d. Got %v for 2nd result; want %v.", i, actual[1].Timestamp, expected2.Timestamp)
+		got, err := ioutil.ReadFile(sms.persistence.fileNameForFingerprint(fp))
+		if err != nil {
+			t.Fatal(err)
 		}
-		if expected2.Value != actual[1].Value {
-			t.Errorf("4.%d. Got %v for 2nd result; want %v.", i, actual[1].Value, expected2.Value)
+		if !bytes.Equal(got, want) {
+			t.Fatalf("standby has %d bytes in its series file, primary %d", len(got), len(want))
 		}
 	}
 
-	// #5 corner cases: Interval ends at first sample, interval starts
-	// at last sample, interval entirely before/after samples.
-	expected := samples[0]
-	actual := it.GetRangeValues(metric.Interval{
-		OldestInclusive: expected.Timestamp - 2,
-		NewestInclusive: expected.Timestamp,
-	})
-	if len(actual) != 1 {
-		t.Fatalf("5.1. Expected exactly one result, got %d.", len(actual))
-	}
-	if expected.Timestamp != actual[0].Timestamp {
-		t.Errorf("5.1. Got %v; want %v.", actual[0].Timestamp, expected.Timestamp)
-	}
-	if expected.Value != actual[0].Value {
-		t.Errorf("5.1. Got %v; want %v.", actual[0].Value, expected.Value)
-	}
-	expected = samples[len(samples)-1]
-	actual = it.GetRangeValues(metric.Interval{
-		OldestInclusive: expected.Timestamp,
-		NewestInclusive: expected.Timestamp + 2,
-	})
-	if len(actual) != 1 {
-		t.Fatalf("5.2. Expected exactly one result, got %d.", len(actual))
+	// The first sync is a full one.
+	persist(0, 5000)
+	sync()
+	expectSameFile()
+	archived, err := sms.persistence.getArchivedMetric(fp)
+	if err != nil {
+		t.Fatal(err)
 	}
-	if expected.Timestamp != actual[0].Timestamp {
-		t.Errorf("5.2. Got %v; want %v.", actual[0].Timestamp, expected.Timestamp)
+	if !archived.Equal(m) {
+		t.Errorf("expected archived metric %v, got %v", m, archived)
 	}
-	if expected.Value != actual[0].Value {
-		t.Errorf("5.2. Got %v; want %v.", actual[0].Value, expected.Value)
+	p := sms.NewPreloader()
+	if err := p.PreloadRange(fp, 0, 5000*1000, 0); err != nil {
+		t.Fatal(err)
 	}
-	firstSample := samples[0]
-	actual = it.GetRangeValues(metric.Interval{
-		OldestInclusive: firstSample.Timestamp - 4,
-		NewestInclusive: firstSample.Timestamp - 2,
-	})
-	if len(actual) != 0 {
-		t.Fatalf("5.3. Expected no results, got %d.", len(actual))
+	values := sms.NewIterator(fp).GetRangeValues(metric.Interval{OldestInclusive: 0, NewestInclusive: 5000 * 1000})
+	p.Close()
+	if len(values) != 5000 {
+		t.Fatalf("expected 5000 values on the standby, got %d", len(values))
+	}
+
+	// Later syncs only transfer the changed series, and within them the new
+	// chunks, also after the primary has dropped chunks.
+	sms.replica.mtx.Lock()
+	seq := sms.replica.seq
+	sms.replica.mtx.Unlock()
+	fps, _, ok := pms.persistence.replicationJournal.since(seq)
+	if !ok || len(fps) != 0 {
+		t.Fatalf("expected no changes, got %v", fps)
+	}
+	persist(5000, 10000)
+	pms.maintainMemorySeries(fp, 2000*1000)
+	sync()
+	expectSameFile()
+
+	// Appending to a standby drops the samples.
+	sms.Append(&clientmodel.Sample{Metric: m, Timestamp: 20000 * 1000})
+	if _, ok := sms.fpToSeries.get(fp); ok {
+		t.Error("sample appended to standby")
+	}
+
+	// Purged series are purged on the standby, too.
+	pms.purgeSeries(fp)
+	sync()
+	if sms.hasSeries(fp) {
+		t.Error("purged series still on standby")
+	}
+
+	// A restarted standby catches up with a full sync, purging series
+	// unknown to the pms.
+	persist(0, 5000)
+	sms.replica.mtx.Lock()
+	sms.replica.epoch, sms.replica.seq = 0, 0
+	sms.replica.mtx.Unlock()
+	unknown := clientmodel.Metric{clientmodel.MetricNameLabel: "unknown"}
+	sms.persistence.indexMetric(unknown.Fingerprint(), unknown)
+	if err := sms.persistence.archiveMetric(unknown.Fingerprint(), unknown, 0, 0); err != nil {
+		t.Fatal(err)
 	}
-	lastSample := samples[len(samples)-1]
-	actual = it.GetRangeValues(metric.Interval{
-		OldestInclusive: lastSample.Timestamp + 2,
-		NewestInclusive: lastSample.Timestamp + 4,
-	})
-	if len(actual) != 0 {
-		t.Fatalf("5.3. Expected no results, got %d.", len(actual))
+	sync()
+	expectSameFile()
+	if sms.hasSeries(unknown.Fingerprint()) {
+		t.Error("series unknown to the primary still on standby")
 	}
 }
 
-func TestGetRangeValuesChunkType0(t *testing.T) {
-	testGetRangeValues(t, 0)
-}
+func TestQueryLogSaveAndLoad(t *testing.T) {
+	directory := test.NewTemporaryDirectory("test_query_log", t)
+	defer directory.Close()
+	fileName := filepath.Join(directory.Path(), queryLogFileName)
 
-func TestGetRangeValuesChunkType1(t *testing.T) {
-	testGetRangeValues(t, 1)
+	l, err := loadQueryLog(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	l.touch(1, now)
+	l.touch(2, now.Add(-2*time.Hour))
+	l.touch(2, now.Add(-3*time.Hour)) // Older than the recorded query.
+	if err := l.save(fileName); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadQueryLog(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.hours, l.hours) {
+		t.Errorf("want %v, got %v", l.hours, loaded.hours)
+	}
+	last, ok := loaded.lastQueried(2)
+	if !ok || now.Add(-2*time.Hour).Sub(last) >= queryLogResolution || last.After(now.Add(-2*time.Hour)) {
+		t.Errorf("unexpected last query time %v, %v", last, ok)
+	}
 }
 
-func testEvictAndPurgeSeries(t *testing.T, encoding chunkEncoding) {
+func testEvictAndPurgeSeries(t *testing.T, encoding ChunkEncoding) {
 	samples := make(clientmodel.Samples, 1000)
 	for i := range samples {
 		samples[i] = &clientmodel.Sample{
@@ -646,7 +2475,11 @@ func TestEvictAndPurgeSeriesChunkType1(t *testing.T) {
 	testEvictAndPurgeSeries(t, 1)
 }
 
-func benchmarkAppend(b *testing.B, encoding chunkEncoding) {
+func TestEvictAndPurgeSeriesChunkType2(t *testing.T) {
+	testEvictAndPurgeSeries(t, 2)
+}
+
+func benchmarkAppend(b *testing.B, encoding ChunkEncoding) {
 	samples := make(clientmodel.Samples, b.N)
 	for i := range samples {
 		samples[i] = &clientmodel.Sample{
@@ -676,9 +2509,41 @@ func BenchmarkAppendType1(b *testing.B) {
 	benchmarkAppend(b, 1)
 }
 
+func BenchmarkAppendType2(b *testing.B) {
+	benchmarkAppend(b, 2)
+}
+
+func BenchmarkAppendBatch(b *testing.B) {
+	samples := make(clientmodel.Samples, b.N)
+	for i := range samples {
+		samples[i] = &clientmodel.Sample{
+			Metric: clientmodel.Metric{
+				clientmodel.MetricNameLabel: clientmodel.LabelValue(fmt.Sprintf("test_metric_%d", i%10)),
+				"label1":                    clientmodel.LabelValue(fmt.Sprintf("test_metric_%d", i%10)),
+				"label2":                    clientmodel.LabelValue(fmt.Sprintf("test_metric_%d", i%10)),
+			},
+			Timestamp: clientmodel.Timestamp(i),
+			Value:     clientmodel.SampleValue(i),
+		}
+	}
+	b.ResetTimer()
+	s, closer := NewTestStorage(b, 1)
+	defer closer.Close()
+
+	// Batches of the size of a typical scrape.
+	for len(samples) > 0 {
+		n := 1000
+		if n > len(samples) {
+			n = len(samples)
+		}
+		s.AppendBatch(samples[:n])
+		samples = samples[n:]
+	}
+}
+
 // Append a large number of random samples and then check if we can get them out
 // of the storage alright.
-func testFuzz(t *testing.T, encoding chunkEncoding) {
+func testFuzz(t *testing.T, encoding ChunkEncoding) {
 	if testing.Short() {
 		t.Skip("Skipping test in short mode.")
 	}
@@ -708,6 +2573,10 @@ func TestFuzzChunkType1(t *testing.T) {
 	testFuzz(t, 1)
 }
 
+func TestFuzzChunkType2(t *testing.T) {
+	testFuzz(t, 2)
+}
+
 // benchmarkFuzz is the benchmark version of testFuzz. The storage options are
 // set such that evictions, checkpoints, and purging will happen concurrently,
 // too. This benchmark will have a very long runtime (up to minutes). You can
@@ -719,8 +2588,7 @@ func TestFuzzChunkType1(t *testing.T) {
 // make things even slower):
 //
 // go test -race -cpu 8 -short -bench BenchmarkFuzzChunkType
-func benchmarkFuzz(b *testing.B, encoding chunkEncoding) {
-	*defaultChunkEncoding = int(encoding)
+func benchmarkFuzz(b *testing.B, encoding ChunkEncoding) {
 	const samplesPerRun = 100000
 	rand.Seed(42)
 	directory := test.NewTemporaryDirectory("test_storage", b)
@@ -728,9 +2596,11 @@ func benchmarkFuzz(b *testing.B, encoding chunkEncoding) {
 	o := &MemorySeriesStorageOptions{
 		MemoryChunks:               100,
 		MaxChunksToPersist:         1000000,
+		ChunkEncoding:              encoding,
 		PersistenceRetentionPeriod: time.Hour,
 		PersistenceStoragePath:     directory.Path(),
-		CheckpointInterval:         time.Second,
+		MinCheckpointInterval:      time.Second,
+		MaxCheckpointInterval:      time.Second,
 		SyncStrategy:               Adaptive,
 	}
 	s, err := NewMemorySeriesStorage(o)
@@ -767,6 +2637,10 @@ func BenchmarkFuzzChunkType1(b *testing.B) {
 	benchmarkFuzz(b, 1)
 }
 
+func BenchmarkFuzzChunkType2(b *testing.B) {
+	benchmarkFuzz(b, 2)
+}
+
 func createRandomSamples(metricName string, minLen int) clientmodel.Samples {
 	type valueCreator func() clientmodel.SampleValue
 	type deltaApplier func(clientmodel.SampleValue) clientmodel.SampleValue
@@ -919,3 +2793,243 @@ func verifyStorage(t testing.TB, s Storage, samples clientmodel.Samples, maxAge
 	}
 	return result
 }
+
+func TestDailyWindow(t *testing.T) {
+	scenarios := []struct {
+		window string
+		hour   int
+		want   bool
+	}{
+		{window: "", hour: 12, want: true},
+		{window: "02:00-05:30", hour: 1, want: false},
+		{window: "02:00-05:30", hour: 2, want: true},
+		{window: "02:00-05:30", hour: 5, want: true},
+		{window: "02:00-05:30", hour: 6, want: false},
+		{window: "22:00-06:00", hour: 23, want: true},
+		{window: "22:00-06:00", hour: 3, want: true},
+		{window: "22:00-06:00", hour: 12, want: false},
+		{window: "20:00-24:00", hour: 23, want: true},
+		{window: "20:00-24:00", hour: 0, want: false},
+		{window: "24:00-06:00", hour: 0, want: true},
+		{window: "00:00-24:00", hour: 12, want: true},
+	}
+	for i, s := range scenarios {
+		w, err := ParseDailyWindow(s.window)
+		if err != nil {
+			t.Fatalf("%d. %v", i, err)
+		}
+		if got := w.contains(time.Date(2015, 6, 1, s.hour, 0, 0, 0, time.UTC)); got != s.want {
+			t.Errorf("%d. window %q contains %d:00: got %v, want %v", i, s.window, s.hour, got, s.want)
+		}
+	}
+	for _, s := range []string{"2-5", "25:00-05:00", "02:60-05:00", "24:30-06:00", "22:00-24:01"} {
+		if _, err := ParseDailyWindow(s); err == nil {
+			t.Errorf("expected error parsing daily window %q", s)
+		}
+	}
+}
+
+func TestCompactAllIndexes(t *testing.T) {
+	// Compaction is only triggered explicitly below.
+	ms, closer := newTestStorageWithOptions(t, 1, func(o *MemorySeriesStorageOptions) {
+		o.IndexCompactionInterval = time.Hour
+	})
+	defer closer.Close()
+	p := ms.persistence
+
+	// Archive many series and purge all but one of them again.
+	var kept clientmodel.Metric
+	for i := 0; i < 1000; i++ {
+		m := clientmodel.Metric{clientmodel.MetricNameLabel: "churn", "instance": clientmodel.LabelValue(fmt.Sprint(i))}
+		fp := m.Fingerprint()
+		p.indexMetric(fp, m)
+		if err := p.archiveMetric(fp, m, 0, 1000); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			kept = m
+			continue
+		}
+		if err := p.purgeArchivedMetric(fp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ms.WaitForIndexing()
+
+	ms.compactAllIndexes()
+
+	for _, name := range []string{
+		"archived_fingerprint_to_metric", "archived_fingerprint_to_timerange",
+		"labelname_to_labelvalues", "labelpair_to_fingerprints",
+	} {
+		m := &dto.Metric{}
+		if err := ms.indexCompactor.duration.WithLabelValues(name).Write(m); err != nil {
+			t.Fatal(err)
+		}
+		if m.GetGauge().GetValue() <= 0 {
+			t.Errorf("index %s not compacted", name)
+		}
+	}
+	m := &dto.Metric{}
+	ms.indexCompactor.errors.Write(m)
+	if got := m.GetCounter().GetValue(); got != 0 {
+		t.Errorf("got %v compaction errors", got)
+	}
+	archived, err := p.getArchivedMetric(kept.Fingerprint())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !archived.Equal(kept) {
+		t.Errorf("expected archived metric %v after compaction, got %v", kept, archived)
+	}
+	if fps := ms.GetFingerprintsForLabelMatchers(metric.LabelMatchers{
+		&metric.LabelMatcher{Type: metric.Equal, Name: clientmodel.MetricNameLabel, Value: "churn"},
+	}); len(fps) != 1 {
+		t.Errorf("expected 1 series after compaction, got %d", len(fps))
+	}
+}
+
+func TestRestoreOrphanedSeries(t *testing.T) {
+	s, closer := NewTestStorage(t, 1)
+	defer closer.Close()
+	ms := s.(*memorySeriesStorage)
+
+	m := clientmodel.Metric{clientmodel.MetricNameLabel: "orphan"}
+	fp := m.Fingerprint()
+	var samples clientmodel.Samples
+	for i := 0; i < 1000; i++ {
+		samples = append(samples, &clientmodel.Sample{Metric: m, Timestamp: clientmodel.Timestamp(i), Value: clientmodel.SampleValue(i)})
+	}
+	if _, err := s.Backfill(samples); err != nil {
+		t.Fatal(err)
+	}
+	s.WaitForIndexing()
+
+	// Orphan the series file the way crash recovery would, and drop the
+	// series.
+	fpStr := fp.String()
+	orphanedDir := filepath.Join(ms.persistence.basePath, orphanedDirName, fpStr[:seriesDirNameLen])
+	if err := os.MkdirAll(orphanedDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	orphanedFile := filepath.Join(orphanedDir, fpStr[seriesDirNameLen:]+seriesFileSuffix)
+	buf, err := ioutil.ReadFile(ms.persistence.fileNameForFingerprint(fp))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Append a torn chunk.
+	buf = append(buf, make([]byte, 10)...)
+	if err := ioutil.WriteFile(orphanedFile, buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(orphanedDir, "garbage"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	lm, err := metric.NewLabelMatcher(metric.Equal, clientmodel.MetricNameLabel, "orphan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := s.DropMetricsForLabelMatchers(metric.LabelMatchers{lm}); n != 1 {
+		t.Fatalf("got %d series dropped, want 1", n)
+	}
+	s.WaitForIndexing()
+
+	orphaned, err := s.ListOrphanedSeries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orphaned) != 2 {
+		t.Fatalf("got %d orphaned files, want 2: %+v", len(orphaned), orphaned)
+	}
+	if o := orphaned[0]; o.Path != orphanedFile || o.Fingerprint != fp || o.FirstTime != 0 || o.LastTime != 999 || o.Chunks == 0 || o.Problem != "metric unknown" {
+		t.Errorf("got unexpected orphaned series %+v", o)
+	}
+	if o := orphaned[1]; o.Problem == "" {
+		t.Errorf("got no problem for orphaned file %+v", o)
+	}
+
+	if err := s.RestoreOrphanedSeries(fp, nil); err == nil {
+		t.Error("expected error restoring series of unknown metric")
+	}
+	if err := s.RestoreOrphanedSeries(fp, clientmodel.Metric{clientmodel.MetricNameLabel: "other"}); err == nil {
+		t.Error("expected error restoring series with mismatching metric")
+	}
+	if err := s.RestoreOrphanedSeries(fp, m); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RestoreOrphanedSeries(fp, m); err == nil {
+		t.Error("expected error restoring series twice")
+	}
+	s.WaitForIndexing()
+
+	if fps := s.GetFingerprintsForLabelMatchers(metric.LabelMatchers{lm}); len(fps) != 1 || fps[0] != fp {
+		t.Errorf("got fingerprints %v for restored series", fps)
+	}
+	p := s.NewPreloader()
+	if err := p.PreloadRange(fp, 0, 999, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	values := s.NewIterator(fp).GetRangeValues(metric.Interval{OldestInclusive: 0, NewestInclusive: 999})
+	p.Close()
+	if len(values) != 1000 {
+		t.Errorf("got %d values of restored series, want 1000", len(values))
+	}
+}
+
+func TestCheckSeries(t *testing.T) {
+	s, closer := NewTestStorage(t, 1)
+	defer closer.Close()
+	ms := s.(*memorySeriesStorage)
+
+	mInMemory := clientmodel.Metric{clientmodel.MetricNameLabel: "check", "series": "in_memory"}
+	mArchived := clientmodel.Metric{clientmodel.MetricNameLabel: "check", "series": "archived"}
+	var samples clientmodel.Samples
+	for i := 0; i < 1000; i++ {
+		s.Append(&clientmodel.Sample{Metric: mInMemory, Timestamp: clientmodel.Timestamp(i), Value: clientmodel.SampleValue(i)})
+		samples = append(samples, &clientmodel.Sample{Metric: mArchived, Timestamp: clientmodel.Timestamp(i), Value: clientmodel.SampleValue(i)})
+	}
+	if _, err := s.Backfill(samples); err != nil {
+		t.Fatal(err)
+	}
+	s.WaitForIndexing()
+
+	unknownFP := clientmodel.Metric{clientmodel.MetricNameLabel: "unknown"}.Fingerprint()
+	checks := s.CheckSeries(clientmodel.Fingerprints{mInMemory.Fingerprint(), mArchived.Fingerprint(), unknownFP})
+	if len(checks) != 3 {
+		t.Fatalf("got %d checks, want 3", len(checks))
+	}
+	for i, want := range []string{SeriesInMemory, SeriesArchived, SeriesUnknown} {
+		if c := checks[i]; c.State != want || len(c.Problems) != 0 {
+			t.Errorf("%d. got check %+v, want state %s without problems", i, c, want)
+		}
+	}
+	if c := checks[1]; !c.Metric.Equal(mArchived) || c.ChunksInFile == 0 {
+		t.Errorf("got check %+v for archived series", c)
+	}
+
+	// Break all three series.
+	series, _ := ms.fpToSeries.get(mInMemory.Fingerprint())
+	series.chunkDescsOffset = 5
+	buf, err := ioutil.ReadFile(ms.persistence.fileNameForFingerprint(mArchived.Fingerprint()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(ms.persistence.dirNameForFingerprint(unknownFP), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(ms.persistence.fileNameForFingerprint(unknownFP), buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+	buf = append(buf, 1, 2, 3)
+	if err := ioutil.WriteFile(ms.persistence.fileNameForFingerprint(mArchived.Fingerprint()), buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	checks = s.CheckSeries(clientmodel.Fingerprints{mInMemory.Fingerprint(), mArchived.Fingerprint(), unknownFP})
+	for i, c := range checks {
+		if len(c.Problems) != 1 {
+			t.Errorf("%d. got problems %q, want 1", i, c.Problems)
+		}
+	}
+	series.chunkDescsOffset = 0
+}
@@ -37,17 +37,29 @@ func (t *testStorageCloser) Close() {
 // NewTestStorage creates a storage instance backed by files in a temporary
 // directory. The returned storage is already in serving state. Upon closing the
 // returned test.Closer, the temporary directory is cleaned up.
-func NewTestStorage(t test.T, encoding chunkEncoding) (Storage, test.Closer) {
-	*defaultChunkEncoding = int(encoding)
+func NewTestStorage(t test.T, encoding ChunkEncoding) (Storage, test.Closer) {
+	return newTestStorageWithOptions(t, encoding, nil)
+}
+
+// newTestStorageWithOptions works like NewTestStorage but lets setOptions, if
+// not nil, modify the options before the storage is created and started.
+func newTestStorageWithOptions(
+	t test.T, encoding ChunkEncoding, setOptions func(*MemorySeriesStorageOptions),
+) (*memorySeriesStorage, test.Closer) {
 	directory := test.NewTemporaryDirectory("test_storage", t)
 	o := &MemorySeriesStorageOptions{
 		MemoryChunks:               1000000,
 		MaxChunksToPersist:         1000000,
+		ChunkEncoding:              encoding,
 		PersistenceRetentionPeriod: 24 * time.Hour * 365 * 100, // Enough to never trigger purging.
 		PersistenceStoragePath:     directory.Path(),
-		CheckpointInterval:         time.Hour,
+		MinCheckpointInterval:      time.Hour,
+		MaxCheckpointInterval:      time.Hour,
 		SyncStrategy:               Adaptive,
 	}
+	if setOptions != nil {
+		setOptions(o)
+	}
 	storage, err := NewMemorySeriesStorage(o)
 	if err != nil {
 		directory.Close()
@@ -61,5 +73,5 @@ func NewTestStorage(t test.T, encoding chunkEncoding) (Storage, test.Closer) {
 		directory: directory,
 	}
 
-	return storage, closer
+	return storage.(*memorySeriesStorage), closer
 }
@@ -0,0 +1,154 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// tokenBucket holds up to one second worth of tokens, refilled at the given
+// rate. Taking more tokens than available puts the bucket into debt, which has
+// to be paid off before tokens are available again. That way, requests larger
+// than the bucket are possible, and concurrent requests are served in order.
+type tokenBucket struct {
+	rate   float64 // Tokens per second. 0 means unlimited.
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += b.rate * now.Sub(b.last).Seconds()
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+}
+
+// take takes n tokens and returns how long to wait until they are paid for.
+func (b *tokenBucket) take(n float64, now time.Time) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	b.refill(now)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// utilization returns the fraction of the bucket that is used up.
+func (b *tokenBucket) utilization(now time.Time) float64 {
+	if b.rate <= 0 {
+		return 0
+	}
+	b.refill(now)
+	if b.tokens <= 0 {
+		return 1
+	}
+	return 1 - b.tokens/b.rate
+}
+
+// ioThrottle limits the disk I/O of maintenance work (checkpointing, rewriting
+// series files upon dropping chunks, and crash recovery) to a number of bytes
+// and a number of operations per second, so that it does not starve queries
+// on a shared disk. A limit of 0 means no limit. All methods are
+// goroutine-safe.
+type ioThrottle struct {
+	mtx        sync.Mutex
+	bytes, ops tokenBucket
+
+	utilizationDesc *prometheus.Desc
+}
+
+func newIOThrottle(bytesPerSecond, opsPerSecond int) *ioThrottle {
+	now := time.Now()
+	return &ioThrottle{
+		bytes: tokenBucket{rate: float64(bytesPerSecond), tokens: float64(bytesPerSecond), last: now},
+		ops:   tokenBucket{rate: float64(opsPerSecond), tokens: float64(opsPerSecond), last: now},
+		utilizationDesc: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, subsystem, "maintenance_io_throttle_utilization"),
+			"The fraction of the maintenance I/O budget currently used up, for whichever of bytes and operations is used up more. 1 means maintenance is being throttled.",
+			nil, nil,
+		),
+	}
+}
+
+// wait blocks until an I/O operation of n bytes is within the limits.
+func (t *ioThrottle) wait(n int) {
+	t.mtx.Lock()
+	now := time.Now()
+	delay := t.bytes.take(float64(n), now)
+	if d := t.ops.take(1, now); d > delay {
+		delay = d
+	}
+	t.mtx.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// writer returns an io.Writer that throttles each write to w.
+func (t *ioThrottle) writer(w io.Writer) io.Writer {
+	return throttledWriter{w: w, t: t}
+}
+
+// reader returns an io.Reader that throttles each read from r.
+func (t *ioThrottle) reader(r io.Reader) io.Reader {
+	return throttledReader{r: r, t: t}
+}
+
+// Describe implements prometheus.Collector.
+func (t *ioThrottle) Describe(ch chan<- *prometheus.Desc) {
+	ch <- t.utilizationDesc
+}
+
+// Collect implements prometheus.Collector.
+func (t *ioThrottle) Collect(ch chan<- prometheus.Metric) {
+	t.mtx.Lock()
+	now := time.Now()
+	utilization := t.bytes.utilization(now)
+	if u := t.ops.utilization(now); u > utilization {
+		utilization = u
+	}
+	t.mtx.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(t.utilizationDesc, prometheus.GaugeValue, utilization)
+}
+
+type throttledWriter struct {
+	w io.Writer
+	t *ioThrottle
+}
+
+func (tw throttledWriter) Write(p []byte) (int, error) {
+	tw.t.wait(len(p))
+	return tw.w.Write(p)
+}
+
+type throttledReader struct {
+	r io.Reader
+	t *ioThrottle
+}
+
+func (tr throttledReader) Read(p []byte) (int, error) {
+	n, err := tr.r.Read(p)
+	tr.t.wait(n)
+	return n, err
+}
@@ -0,0 +1,318 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"regexp/syntax"
+	"sync"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+// maxTrigramAlternatives limits the number of alternatives in a trigramQuery.
+// Regexes resulting in more alternatives are not narrowed down by literals.
+const maxTrigramAlternatives = 64
+
+type trigram [3]byte
+
+// trigramQuery is a disjunction of conjunctions of trigrams: A label value can
+// only match the regex the query was derived from if it contains all trigrams
+// of at least one alternative. A nil trigramQuery rules out nothing.
+type trigramQuery [][]trigram
+
+// newTrigramQuery derives a trigramQuery from the given regex. It returns nil
+// if the regex cannot be parsed or does not require any literal of at least
+// three bytes to be contained in a match.
+func newTrigramQuery(regex string) trigramQuery {
+	re, err := syntax.Parse(regex, syntax.Perl)
+	if err != nil {
+		return nil
+	}
+	alts := requiredLiterals(re.Simplify())
+	if alts == nil {
+		return nil
+	}
+	q := make(trigramQuery, 0, len(alts))
+	for _, lits := range alts {
+		var tgs []trigram
+		for _, lit := range lits {
+			tgs = append(tgs, trigramsOf(lit)...)
+		}
+		if len(tgs) == 0 {
+			// This alternative rules out nothing, so the whole
+			// query rules out nothing.
+			return nil
+		}
+		q = append(q, tgs)
+	}
+	return q
+}
+
+// requiredLiterals returns the literals contained in any match of re as a
+// disjunction of conjunctions. nil means no literal is required.
+func requiredLiterals(re *syntax.Regexp) [][]string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return nil
+		}
+		return [][]string{{string(re.Rune)}}
+	case syntax.OpCapture, syntax.OpPlus:
+		return requiredLiterals(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min < 1 {
+			return nil
+		}
+		return requiredLiterals(re.Sub[0])
+	case syntax.OpConcat:
+		var result [][]string
+		for _, sub := range re.Sub {
+			alts := requiredLiterals(sub)
+			switch {
+			case alts == nil:
+				continue
+			case result == nil:
+				result = alts
+			case len(result)*len(alts) <= maxTrigramAlternatives:
+				product := make([][]string, 0, len(result)*len(alts))
+				for _, r := range result {
+					for _, a := range alts {
+						lits := make([]string, 0, len(r)+len(a))
+						lits = append(append(lits, r...), a...)
+						product = append(product, lits)
+					}
+				}
+				result = product
+			}
+		}
+		return result
+	case syntax.OpAlternate:
+		var result [][]string
+		for _, sub := range re.Sub {
+			alts := requiredLiterals(sub)
+			if alts == nil || len(result)+len(alts) > maxTrigramAlternatives {
+				return nil
+			}
+			result = append(result, alts...)
+		}
+		return result
+	default:
+		return nil
+	}
+}
+
+func trigramsOf(s string) []trigram {
+	if len(s) < 3 {
+		return nil
+	}
+	tgs := make([]trigram, 0, len(s)-2)
+	for i := 0; i+3 <= len(s); i++ {
+		tgs = append(tgs, trigram{s[i], s[i+1], s[i+2]})
+	}
+	return tgs
+}
+
+// trigramIndex indexes the label values of one label name by their trigrams.
+// It is not goroutine-safe.
+type trigramIndex struct {
+	values   clientmodel.LabelValues // Indexed by ID.
+	ids      map[clientmodel.LabelValue]uint32
+	removed  map[uint32]struct{}
+	trigrams map[trigram][]uint32 // IDs in ascending order.
+}
+
+func newTrigramIndex(values clientmodel.LabelValues) *trigramIndex {
+	idx := &trigramIndex{
+		values:   make(clientmodel.LabelValues, 0, len(values)),
+		ids:      make(map[clientmodel.LabelValue]uint32, len(values)),
+		removed:  map[uint32]struct{}{},
+		trigrams: map[trigram][]uint32{},
+	}
+	for _, v := range values {
+		idx.add(v)
+	}
+	return idx
+}
+
+// add adds v to the index if it is not in it already.
+func (idx *trigramIndex) add(v clientmodel.LabelValue) {
+	if _, ok := idx.ids[v]; ok {
+		return
+	}
+	id := uint32(len(idx.values))
+	idx.values = append(idx.values, v)
+	idx.ids[v] = id
+	seen := map[trigram]struct{}{}
+	for _, tg := range trigramsOf(string(v)) {
+		if _, ok := seen[tg]; ok {
+			continue
+		}
+		seen[tg] = struct{}{}
+		idx.trigrams[tg] = append(idx.trigrams[tg], id)
+	}
+}
+
+// remove removes v from the index. Once more values have been removed than are
+// left, the index is rebuilt to free the space.
+func (idx *trigramIndex) remove(v clientmodel.LabelValue) {
+	id, ok := idx.ids[v]
+	if !ok {
+		return
+	}
+	delete(idx.ids, v)
+	idx.removed[id] = struct{}{}
+	if len(idx.removed) > len(idx.ids) {
+		live := make(clientmodel.LabelValues, 0, len(idx.ids))
+		for v := range idx.ids {
+			live = append(live, v)
+		}
+		*idx = *newTrigramIndex(live)
+	}
+}
+
+// candidates returns the label values that contain all trigrams of at least
+// one alternative of q.
+func (idx *trigramIndex) candidates(q trigramQuery) clientmodel.LabelValues {
+	ids := map[uint32]struct{}{}
+	for _, tgs := range q {
+		var result []uint32
+		for i, tg := range tgs {
+			list := idx.trigrams[tg]
+			if i == 0 {
+				result = list
+			} else {
+				result = intersectIDs(result, list)
+			}
+			if len(result) == 0 {
+				break
+			}
+		}
+		for _, id := range result {
+			ids[id] = struct{}{}
+		}
+	}
+	values := make(clientmodel.LabelValues, 0, len(ids))
+	for id := range ids {
+		if _, ok := idx.removed[id]; !ok {
+			values = append(values, idx.values[id])
+		}
+	}
+	return values
+}
+
+func intersectIDs(a, b []uint32) []uint32 {
+	result := make([]uint32, 0, len(a))
+	for len(a) > 0 && len(b) > 0 {
+		switch {
+		case a[0] < b[0]:
+			a = a[1:]
+		case a[0] > b[0]:
+			b = b[1:]
+		default:
+			result = append(result, a[0])
+			a, b = a[1:], b[1:]
+		}
+	}
+	return result
+}
+
+// labelValueTrigrams holds the trigramIndexes of the label names that have
+// been queried with a regex matcher. It is goroutine-safe.
+type labelValueTrigrams struct {
+	mtx     sync.RWMutex
+	indexes map[clientmodel.LabelName]*trigramIndex
+}
+
+func newLabelValueTrigrams() *labelValueTrigrams {
+	return &labelValueTrigrams{indexes: map[clientmodel.LabelName]*trigramIndex{}}
+}
+
+// candidates returns the label values of ln that might match a regex from
+// which q was derived. If there is no trigramIndex for ln yet, it is built from
+// the label values returned by load.
+func (t *labelValueTrigrams) candidates(
+	ln clientmodel.LabelName, q trigramQuery, load func() (clientmodel.LabelValues, error),
+) (clientmodel.LabelValues, error) {
+	t.mtx.RLock()
+	idx, ok := t.indexes[ln]
+	if ok {
+		defer t.mtx.RUnlock()
+		return idx.candidates(q), nil
+	}
+	t.mtx.RUnlock()
+
+	// Building the index while holding the write lock ensures that no
+	// update gets lost between loading the values and storing the index.
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if idx, ok = t.indexes[ln]; !ok {
+		values, err := load()
+		if err != nil {
+			return nil, err
+		}
+		idx = newTrigramIndex(values)
+		t.indexes[ln] = idx
+	}
+	return idx.candidates(q), nil
+}
+
+// update adds and removes label values for the label names that have a
+// trigramIndex. Label pairs are applied in the given order, and adding or
+// removing a label value twice does not change anything.
+func (t *labelValueTrigrams) update(added, removed []metric.LabelPair) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	for _, lp := range added {
+		if idx, ok := t.indexes[lp.Name]; ok {
+			idx.add(lp.Value)
+		}
+	}
+	for _, lp := range removed {
+		if idx, ok := t.indexes[lp.Name]; ok {
+			idx.remove(lp.Value)
+		}
+	}
+}
+
+// getLabelValuesForLabelMatcher returns the label values of the matcher's label
+// name that the matcher matches. For regex matchers that require a literal of
+// at least three bytes, only label values containing the trigrams of that
+// literal are matched against the regex. This method is goroutine-safe but
+// take into account that metrics queued for indexing with IndexMetric might not
+// have made it into the index yet. (Same applies correspondingly to
+// UnindexMetric.)
+func (p *persistence) getLabelValuesForLabelMatcher(m *metric.LabelMatcher) (clientmodel.LabelValues, error) {
+	var (
+		values clientmodel.LabelValues
+		err    error
+	)
+	q := trigramQuery(nil)
+	if m.Type == metric.RegexMatch {
+		q = newTrigramQuery(string(m.Value))
+	}
+	if q == nil {
+		values, err = p.getLabelValuesForLabelName(m.Name)
+	} else {
+		values, err = p.labelValueTrigrams.candidates(m.Name, q, func() (clientmodel.LabelValues, error) {
+			return p.getLabelValuesForLabelName(m.Name)
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m.Filter(values), nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+func TestNewTrigramQuery(t *testing.T) {
+	var scenarios = []struct {
+		regex    string
+		expected trigramQuery
+	}{
+		{
+			regex:    `web-1.*`,
+			expected: trigramQuery{{{'w', 'e', 'b'}, {'e', 'b', '-'}, {'b', '-', '1'}}},
+		},
+		{
+			regex:    `^(web|db)-[0-9]+\.example$`,
+			expected: trigramQuery{{{'w', 'e', 'b'}, {'.', 'e', 'x'}, {'e', 'x', 'a'}, {'x', 'a', 'm'}, {'a', 'm', 'p'}, {'m', 'p', 'l'}, {'p', 'l', 'e'}}, {{'.', 'e', 'x'}, {'e', 'x', 'a'}, {'x', 'a', 'm'}, {'a', 'm', 'p'}, {'m', 'p', 'l'}, {'p', 'l', 'e'}}},
+		},
+		{
+			// An alternative without any trigram rules out nothing.
+			regex: `web|db`,
+		},
+		{
+			regex: `.*`,
+		},
+		{
+			regex: `(?i)web-1`,
+		},
+		{
+			regex: `(web)?-1`,
+		},
+		{
+			regex: `[`,
+		},
+	}
+
+	for i, s := range scenarios {
+		if got := newTrigramQuery(s.regex); !reflect.DeepEqual(got, s.expected) {
+			t.Errorf("%d. %q: got %v, want %v", i, s.regex, got, s.expected)
+		}
+	}
+}
+
+func TestLabelValueTrigrams(t *testing.T) {
+	trigrams := newLabelValueTrigrams()
+	loads := 0
+	load := func() (clientmodel.LabelValues, error) {
+		loads++
+		return clientmodel.LabelValues{"web-1", "web-12", "db-1", "xweb-1x", "we"}, nil
+	}
+	candidates := func(regex string) clientmodel.LabelValues {
+		values, err := trigrams.candidates("instance", newTrigramQuery(regex), load)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Sort(values)
+		return values
+	}
+
+	if got, want := candidates(`web-1`), (clientmodel.LabelValues{"web-1", "web-12", "xweb-1x"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got candidates %v, want %v", got, want)
+	}
+	if got, want := candidates(`(web|xweb)-1`), (clientmodel.LabelValues{"web-1", "web-12", "xweb-1x"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got candidates %v, want %v", got, want)
+	}
+
+	trigrams.update(
+		[]metric.LabelPair{{Name: "instance", Value: "web-2"}, {Name: "other", Value: "web-3"}},
+		[]metric.LabelPair{{Name: "instance", Value: "web-12"}, {Name: "instance", Value: "xweb-1x"}},
+	)
+	if got, want := candidates(`web-`), (clientmodel.LabelValues{"web-1", "web-2"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got candidates %v, want %v", got, want)
+	}
+
+	// Removing more values than are left rebuilds the index.
+	trigrams.update(nil, []metric.LabelPair{{Name: "instance", Value: "web-1"}, {Name: "instance", Value: "db-1"}})
+	if got, want := len(trigrams.indexes["instance"].removed), 0; got != want {
+		t.Errorf("got %d removed values after rebuild, want %d", got, want)
+	}
+	if got, want := candidates(`web-`), (clientmodel.LabelValues{"web-2"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got candidates %v, want %v", got, want)
+	}
+	if loads != 1 {
+		t.Errorf("label values loaded %d times, want 1", loads)
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+const (
+	// queryLogFileName is the file in the storage directory the queryLog
+	// is saved to.
+	queryLogFileName     = "last_queried.db"
+	queryLogTempFileName = "last_queried.db.tmp"
+
+	// queryLogResolution is the resolution of the recorded query times.
+	queryLogResolution = time.Hour
+	// unqueriedPurgeInterval is how often archived series are checked
+	// for having been queried.
+	unqueriedPurgeInterval = time.Hour
+
+	queryLogEntryLen = 12 // 8 bytes fingerprint, 4 bytes hours since the epoch.
+)
+
+// queryLog records when series were last queried, in whole hours to be cheap
+// to keep up to date and to save. A nil *queryLog records nothing. All methods
+// are goroutine-safe.
+type queryLog struct {
+	mtx   sync.Mutex
+	hours map[clientmodel.Fingerprint]uint32 // Since the epoch.
+}
+
+// loadQueryLog loads the queryLog saved in the given file. A missing file
+// results in an empty queryLog.
+func loadQueryLog(fileName string) (*queryLog, error) {
+	l := &queryLog{hours: map[clientmodel.Fingerprint]uint32{}}
+	f, err := os.Open(fileName)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	buf := make([]byte, queryLogEntryLen)
+	for {
+		if _, err := io.ReadFull(r, buf); err == io.EOF {
+			return l, nil
+		} else if err != nil {
+			return nil, err
+		}
+		fp := clientmodel.Fingerprint(binary.LittleEndian.Uint64(buf))
+		l.hours[fp] = binary.LittleEndian.Uint32(buf[8:])
+	}
+}
+
+func queryLogHours(t time.Time) uint32 {
+	return uint32(t.Unix() / int64(queryLogResolution/time.Second))
+}
+
+// touch records that the series with the given fingerprint has been queried at
+// time t.
+func (l *queryLog) touch(fp clientmodel.Fingerprint, t time.Time) {
+	if l == nil {
+		return
+	}
+	h := queryLogHours(t)
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.hours[fp] < h {
+		l.hours[fp] = h
+	}
+}
+
+// lastQueried returns when the series with the given fingerprint has been
+// queried last, rounded down to the resolution of the queryLog, and false if
+// nothing has been recorded for it.
+func (l *queryLog) lastQueried(fp clientmodel.Fingerprint) (time.Time, bool) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	h, ok := l.hours[fp]
+	return time.Unix(int64(h)*int64(queryLogResolution/time.Second), 0), ok
+}
+
+// forget removes the series with the given fingerprint from the queryLog.
+func (l *queryLog) forget(fp clientmodel.Fingerprint) {
+	if l == nil {
+		return
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	delete(l.hours, fp)
+}
+
+// save writes the queryLog to the given file, via a temporary file in the same
+// directory so that a crash never leaves a partial file behind.
+func (l *queryLog) save(fileName string) error {
+	tempFileName := filepath.Join(filepath.Dir(fileName), queryLogTempFileName)
+	f, err := os.Create(tempFileName)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	buf := make([]byte, queryLogEntryLen)
+
+	l.mtx.Lock()
+	for fp, h := range l.hours {
+		binary.LittleEndian.PutUint64(buf, uint64(fp))
+		binary.LittleEndian.PutUint32(buf[8:], h)
+		if _, err = w.Write(buf); err != nil {
+			break
+		}
+	}
+	l.mtx.Unlock()
+
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempFileName)
+		return err
+	}
+	return os.Rename(tempFileName, fileName)
+}
+
+// purgeUnqueried purges archived series not queried for s.purgeUnqueriedAfter
+// once per unqueriedPurgeInterval, until s.loopStopping is closed. It returns
+// immediately if the policy is disabled. The returned channel is closed once
+// purging has stopped and the queryLog has been saved.
+func (s *memorySeriesStorage) purgeUnqueried() <-chan struct{} {
+	stopped := make(chan struct{})
+	if s.queryLog == nil {
+		close(stopped)
+		return stopped
+	}
+	go func() {
+		defer close(stopped)
+		defer s.saveQueryLog()
+
+		ticker := time.NewTicker(unqueriedPurgeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-s.loopStopping:
+				return
+			}
+			s.purgeUnqueriedArchivedSeries()
+			s.saveQueryLog()
+		}
+	}()
+	return stopped
+}
+
+func (s *memorySeriesStorage) saveQueryLog() {
+	if err := s.queryLog.save(filepath.Join(s.persistence.basePath, queryLogFileName)); err != nil {
+		glog.Error("Error saving the last query times of series: ", err)
+	}
+}
+
+// purgeUnqueriedArchivedSeries purges all archived series not queried for
+// s.purgeUnqueriedAfter. Archived series without a recorded query time are
+// considered queried now, so that enabling the policy never purges anything
+// right away.
+func (s *memorySeriesStorage) purgeUnqueriedArchivedSeries() {
+	archivedFPs, err := s.persistence.getFingerprintsModifiedBefore(clientmodel.Latest)
+	if err != nil {
+		glog.Error("Failed to lookup archived fingerprint ranges: ", err)
+		return
+	}
+	purged := 0
+	for _, fp := range archivedFPs {
+		select {
+		case <-s.loopStopping:
+			return
+		default:
+		}
+		last, ok := s.queryLog.lastQueried(fp)
+		if !ok {
+			s.queryLog.touch(fp, time.Now())
+			continue
+		}
+		if time.Since(last) > s.purgeUnqueriedAfter && s.purgeUnqueriedArchivedSeriesIfIdle(fp) {
+			purged++
+		}
+	}
+	if purged > 0 {
+		glog.Infof("Purged %d archived series not queried for %v.", purged, s.purgeUnqueriedAfter)
+	}
+}
+
+// purgeUnqueriedArchivedSeriesIfIdle purges the series with the given
+// fingerprint if it is still archived and has not been queried in the
+// meantime. It returns whether the series has been purged.
+func (s *memorySeriesStorage) purgeUnqueriedArchivedSeriesIfIdle(fp clientmodel.Fingerprint) bool {
+	s.fpLocker.Lock(fp)
+	defer s.fpLocker.Unlock(fp)
+
+	if last, _ := s.queryLog.lastQueried(fp); time.Since(last) <= s.purgeUnqueriedAfter {
+		return false
+	}
+	if has, _, _, err := s.persistence.hasArchivedMetric(fp); err != nil || !has {
+		return false
+	}
+	if err := s.persistence.purgeArchivedMetric(fp); err != nil {
+		glog.Errorf("Error purging archived metric for fingerprint %v: %v", fp, err)
+		return false
+	}
+	if _, err := s.persistence.deleteSeriesFile(fp); err != nil {
+		glog.Errorf("Error deleting series file for fingerprint %v: %v", fp, err)
+	}
+	if err := s.persistence.deleteRollups(fp); err != nil {
+		glog.Errorf("Error deleting rollups for fingerprint %v: %v", fp, err)
+	}
+	s.coldTier.purge(fp)
+	s.queryLog.forget(fp)
+	s.seriesOps.WithLabelValues(unqueriedPurge).Inc()
+	return true
+}
@@ -0,0 +1,524 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+// The 46-byte header of a varbit-encoded chunk looks like:
+//
+// - number of samples:          2 bytes
+// - used payload bits:          2 bytes
+// - first time:                 8 bytes
+// - first value:                8 bytes
+// - last time:                  8 bytes
+// - last value:                 8 bytes
+// - last time delta:            8 bytes
+// - leading zeros of window:    1 byte
+// - significant bits of window: 1 byte
+//
+// The last time, value, time delta, and XOR window are only needed to append
+// further samples. Storing them in the header allows to append to a chunk that
+// has been unmarshaled.
+const (
+	varbitHeaderBytes = 46
+
+	varbitHeaderNumSamplesOffset      = 0
+	varbitHeaderPayloadBitsOffset     = 2
+	varbitHeaderFirstTimeOffset       = 4
+	varbitHeaderFirstValueOffset      = 12
+	varbitHeaderLastTimeOffset        = 20
+	varbitHeaderLastValueOffset       = 28
+	varbitHeaderLastTimeDeltaOffset   = 36
+	varbitHeaderLeadingZerosOffset    = 44
+	varbitHeaderSignificantBitsOffset = 45
+)
+
+// Bit widths and value ranges of the timestamp double-delta buckets. The
+// control bit prefixes of the buckets are '10', '110', '1110', and '1111'. A
+// double-delta of zero is encoded as a single '0' bit.
+const (
+	varbitDoubleDeltaBits1 = 7
+	varbitDoubleDeltaBits2 = 9
+	varbitDoubleDeltaBits3 = 12
+	varbitDoubleDeltaBits4 = 64
+
+	// The number of leading zeros of a value XOR is saved in 5 bits.
+	varbitMaxLeadingZeros = 31
+)
+
+// A varbitEncodedChunk stores sample timestamps and values with the bit-wise
+// compression scheme described in the paper "Gorilla: A Fast, Scalable,
+// In-Memory Time Series Database" (Pelkonen et al., VLDB 2015). Timestamps are
+// saved as double-deltas in variable-width buckets. Values are saved as the XOR
+// with the previous value, of which only the significant bits are stored
+// (reusing the previous window of significant bits whenever possible). This is
+// particularly efficient for regularly scraped, slowly changing series.
+//
+// Other than the delta encodings, a varbitEncodedChunk always has a length
+// equal to its capacity. The number of samples and the used payload bits are
+// kept in the header. varbitEncodedChunk implements the chunk interface.
+type varbitEncodedChunk []byte
+
+// newVarbitEncodedChunk returns a newly allocated varbitEncodedChunk.
+func newVarbitEncodedChunk(length int) *varbitEncodedChunk {
+	if length < varbitHeaderBytes+16 {
+		panic(fmt.Errorf(
+			"chunk length %d bytes is insufficient, need at least %d",
+			length, varbitHeaderBytes+16,
+		))
+	}
+	c := make(varbitEncodedChunk, length)
+	return &c
+}
+
+// add implements chunk.
+func (c varbitEncodedChunk) add(s *metric.SamplePair) []chunk {
+	if c.len() == 0 {
+		c.addFirstSample(s)
+		return []chunk{&c}
+	}
+
+	delta := s.Timestamp - c.lastTime()
+	dod := int64(delta - c.lastTimeDelta())
+	xor := math.Float64bits(float64(s.Value)) ^ math.Float64bits(float64(c.lastValue()))
+	leading, significant := c.window()
+	newLeading, newSignificant, reuseWindow := varbitXORWindow(xor, leading, significant)
+
+	// Do we have space for another sample in this chunk? If not, overflow
+	// into a new one.
+	neededBits := varbitBitsForDoubleDelta(dod) + varbitBitsForXOR(xor, newSignificant, reuseWindow)
+	if c.payloadBits()+neededBits > (len(c)-varbitHeaderBytes)*8 {
+		overflowChunks := newChunkForEncoding(Varbit).add(s)
+		return []chunk{&c, overflowChunks[0]}
+	}
+
+	offset := c.payloadBits()
+	offset = c.writeDoubleDelta(offset, dod)
+	offset = c.writeXOR(offset, xor, newLeading, newSignificant, reuseWindow)
+
+	binary.LittleEndian.PutUint16(c[varbitHeaderNumSamplesOffset:], uint16(c.len()+1))
+	binary.LittleEndian.PutUint16(c[varbitHeaderPayloadBitsOffset:], uint16(offset))
+	binary.LittleEndian.PutUint64(c[varbitHeaderLastTimeOffset:], uint64(s.Timestamp))
+	binary.LittleEndian.PutUint64(c[varbitHeaderLastValueOffset:], math.Float64bits(float64(s.Value)))
+	binary.LittleEndian.PutUint64(c[varbitHeaderLastTimeDeltaOffset:], uint64(delta))
+	c[varbitHeaderLeadingZerosOffset] = byte(newLeading)
+	c[varbitHeaderSignificantBitsOffset] = byte(newSignificant)
+	return []chunk{&c}
+}
+
+// clone implements chunk.
+func (c varbitEncodedChunk) clone() chunk {
+	clone := make(varbitEncodedChunk, len(c))
+	copy(clone, c)
+	return &clone
+}
+
+// firstTime implements chunk.
+func (c varbitEncodedChunk) firstTime() clientmodel.Timestamp {
+	return clientmodel.Timestamp(binary.LittleEndian.Uint64(c[varbitHeaderFirstTimeOffset:]))
+}
+
+// lastTime implements chunk.
+func (c varbitEncodedChunk) lastTime() clientmodel.Timestamp {
+	return clientmodel.Timestamp(binary.LittleEndian.Uint64(c[varbitHeaderLastTimeOffset:]))
+}
+
+// newIterator implements chunk.
+func (c *varbitEncodedChunk) newIterator() chunkIterator {
+	return &varbitEncodedChunkIterator{
+		chunk:     c,
+		n:         c.len(),
+		firstTime: c.firstTime(),
+		lastTime:  c.lastTime(),
+	}
+}
+
+// marshal implements chunk.
+func (c varbitEncodedChunk) marshal(w io.Writer) error {
+	n, err := w.Write(c)
+	if err != nil {
+		return err
+	}
+	if n != len(c) {
+		return fmt.Errorf("wanted to write %d bytes, wrote %d", len(c), n)
+	}
+	return nil
+}
+
+// unmarshal implements chunk.
+func (c *varbitEncodedChunk) unmarshal(r io.Reader) error {
+	*c = (*c)[:cap(*c)]
+	_, err := io.ReadFull(r, *c)
+	return err
+}
+
+// unmarshalFromBuf implements chunk.
+func (c *varbitEncodedChunk) unmarshalFromBuf(buf []byte) {
+	*c = (*c)[:cap(*c)]
+	copy(*c, buf)
+}
+
+// values implements chunk.
+func (c varbitEncodedChunk) values() <-chan *metric.SamplePair {
+	values := c.decode(c.len())
+	valuesChan := make(chan *metric.SamplePair)
+	go func() {
+		for i := range values {
+			valuesChan <- &values[i]
+		}
+		close(valuesChan)
+	}()
+	return valuesChan
+}
+
+// encoding implements chunk.
+func (c varbitEncodedChunk) encoding() ChunkEncoding { return Varbit }
+
+func (c varbitEncodedChunk) len() int {
+	return int(binary.LittleEndian.Uint16(c[varbitHeaderNumSamplesOffset:]))
+}
+
+func (c varbitEncodedChunk) payloadBits() int {
+	return int(binary.LittleEndian.Uint16(c[varbitHeaderPayloadBitsOffset:]))
+}
+
+func (c varbitEncodedChunk) firstValue() clientmodel.SampleValue {
+	return clientmodel.SampleValue(math.Float64frombits(
+		binary.LittleEndian.Uint64(c[varbitHeaderFirstValueOffset:]),
+	))
+}
+
+func (c varbitEncodedChunk) lastValue() clientmodel.SampleValue {
+	return clientmodel.SampleValue(math.Float64frombits(
+		binary.LittleEndian.Uint64(c[varbitHeaderLastValueOffset:]),
+	))
+}
+
+func (c varbitEncodedChunk) lastTimeDelta() clientmodel.Timestamp {
+	return clientmodel.Timestamp(binary.LittleEndian.Uint64(c[varbitHeaderLastTimeDeltaOffset:]))
+}
+
+// window returns the leading zeros and significant bits of the current XOR
+// window. If no window has been set yet, significant is 0.
+func (c varbitEncodedChunk) window() (leading, significant int) {
+	return int(c[varbitHeaderLeadingZerosOffset]), int(c[varbitHeaderSignificantBitsOffset])
+}
+
+// addFirstSample is a helper method only used by c.add(). It saves timestamp
+// and value in the header.
+func (c varbitEncodedChunk) addFirstSample(s *metric.SamplePair) {
+	binary.LittleEndian.PutUint16(c[varbitHeaderNumSamplesOffset:], 1)
+	binary.LittleEndian.PutUint64(c[varbitHeaderFirstTimeOffset:], uint64(s.Timestamp))
+	binary.LittleEndian.PutUint64(c[varbitHeaderFirstValueOffset:], math.Float64bits(float64(s.Value)))
+	binary.LittleEndian.PutUint64(c[varbitHeaderLastTimeOffset:], uint64(s.Timestamp))
+	binary.LittleEndian.PutUint64(c[varbitHeaderLastValueOffset:], math.Float64bits(float64(s.Value)))
+}
+
+// writeDoubleDelta writes the timestamp double-delta dod at the given payload
+// bit offset and returns the offset after the written bits.
+func (c varbitEncodedChunk) writeDoubleDelta(offset int, dod int64) int {
+	switch {
+	case dod == 0:
+		return c.writeBits(offset, 0, 1)
+	case fitsInBits(dod, varbitDoubleDeltaBits1):
+		offset = c.writeBits(offset, 2, 2) // '10'
+		return c.writeBits(offset, uint64(dod), varbitDoubleDeltaBits1)
+	case fitsInBits(dod, varbitDoubleDeltaBits2):
+		offset = c.writeBits(offset, 6, 3) // '110'
+		return c.writeBits(offset, uint64(dod), varbitDoubleDeltaBits2)
+	case fitsInBits(dod, varbitDoubleDeltaBits3):
+		offset = c.writeBits(offset, 14, 4) // '1110'
+		return c.writeBits(offset, uint64(dod), varbitDoubleDeltaBits3)
+	default:
+		offset = c.writeBits(offset, 15, 4) // '1111'
+		return c.writeBits(offset, uint64(dod), varbitDoubleDeltaBits4)
+	}
+}
+
+// writeXOR writes the value XOR at the given payload bit offset and returns
+// the offset after the written bits. leading and significant describe the
+// window to use, reuseWindow whether it is the same as the current one.
+func (c varbitEncodedChunk) writeXOR(offset int, xor uint64, leading, significant int, reuseWindow bool) int {
+	if xor == 0 {
+		return c.writeBits(offset, 0, 1)
+	}
+	trailing := 64 - leading - significant
+	if reuseWindow {
+		offset = c.writeBits(offset, 2, 2) // '10'
+		return c.writeBits(offset, xor>>uint(trailing), significant)
+	}
+	offset = c.writeBits(offset, 3, 2) // '11'
+	offset = c.writeBits(offset, uint64(leading), 5)
+	// 64 significant bits are saved as 0, as 1 to 63 are the only other
+	// possible values.
+	offset = c.writeBits(offset, uint64(significant%64), 6)
+	return c.writeBits(offset, xor>>uint(trailing), significant)
+}
+
+// writeBits writes the n least significant bits of v (most significant first)
+// at the given payload bit offset and returns the offset after the written
+// bits. The bits to write to must be zero.
+func (c varbitEncodedChunk) writeBits(offset int, v uint64, n int) int {
+	for i := n - 1; i >= 0; i-- {
+		if v&(1<<uint(i)) != 0 {
+			c[varbitHeaderBytes+offset/8] |= 1 << uint(7-offset%8)
+		}
+		offset++
+	}
+	return offset
+}
+
+// readBits reads n bits at the given payload bit offset and returns them as
+// the n least significant bits of the result, together with the offset after
+// the read bits.
+func (c varbitEncodedChunk) readBits(offset int, n int) (uint64, int) {
+	var v uint64
+	for i := 0; i < n; i++ {
+		v <<= 1
+		if c[varbitHeaderBytes+offset/8]&(1<<uint(7-offset%8)) != 0 {
+			v |= 1
+		}
+		offset++
+	}
+	return v, offset
+}
+
+// decode decodes the first n samples of the chunk.
+func (c varbitEncodedChunk) decode(n int) metric.Values {
+	if n == 0 {
+		return nil
+	}
+	values := make(metric.Values, 0, n)
+	t, v := c.firstTime(), c.firstValue()
+	values = append(values, metric.SamplePair{Timestamp: t, Value: v})
+
+	var (
+		delta                clientmodel.Timestamp
+		leading, significant int
+		offset               int
+		bit, bits            uint64
+	)
+	for i := 1; i < n; i++ {
+		// Timestamp.
+		dodBits := 0
+		for prefix := 0; prefix < 4; prefix++ {
+			bit, offset = c.readBits(offset, 1)
+			if bit == 0 {
+				dodBits = []int{0, varbitDoubleDeltaBits1, varbitDoubleDeltaBits2, varbitDoubleDeltaBits3}[prefix]
+				break
+			}
+			dodBits = varbitDoubleDeltaBits4
+		}
+		if dodBits > 0 {
+			bits, offset = c.readBits(offset, dodBits)
+			delta += clientmodel.Timestamp(signExtend(bits, dodBits))
+		}
+		t += delta
+
+		// Value.
+		bit, offset = c.readBits(offset, 1)
+		if bit == 1 {
+			bit, offset = c.readBits(offset, 1)
+			if bit == 1 {
+				bits, offset = c.readBits(offset, 5)
+				leading = int(bits)
+				bits, offset = c.readBits(offset, 6)
+				significant = int(bits)
+				if significant == 0 {
+					significant = 64
+				}
+			}
+			bits, offset = c.readBits(offset, significant)
+			xor := bits << uint(64-leading-significant)
+			v = clientmodel.SampleValue(math.Float64frombits(math.Float64bits(float64(v)) ^ xor))
+		}
+		values = append(values, metric.SamplePair{Timestamp: t, Value: v})
+	}
+	return values
+}
+
+// varbitXORWindow returns the window of significant bits to use for encoding
+// xor, given the current window. If the current window can be reused,
+// reuseWindow is true and the current window is returned.
+func varbitXORWindow(xor uint64, leading, significant int) (newLeading, newSignificant int, reuseWindow bool) {
+	if xor == 0 {
+		return leading, significant, false
+	}
+	lz, tz := leadingZeros(xor), trailingZeros(xor)
+	if significant > 0 && lz >= leading && tz >= 64-leading-significant {
+		return leading, significant, true
+	}
+	if lz > varbitMaxLeadingZeros {
+		lz = varbitMaxLeadingZeros
+	}
+	return lz, 64 - lz - tz, false
+}
+
+// varbitBitsForDoubleDelta returns the number of bits needed to encode the
+// timestamp double-delta dod.
+func varbitBitsForDoubleDelta(dod int64) int {
+	switch {
+	case dod == 0:
+		return 1
+	case fitsInBits(dod, varbitDoubleDeltaBits1):
+		return 2 + varbitDoubleDeltaBits1
+	case fitsInBits(dod, varbitDoubleDeltaBits2):
+		return 3 + varbitDoubleDeltaBits2
+	case fitsInBits(dod, varbitDoubleDeltaBits3):
+		return 4 + varbitDoubleDeltaBits3
+	default:
+		return 4 + varbitDoubleDeltaBits4
+	}
+}
+
+// varbitBitsForXOR returns the number of bits needed to encode the value XOR
+// with the given window.
+func varbitBitsForXOR(xor uint64, significant int, reuseWindow bool) int {
+	switch {
+	case xor == 0:
+		return 1
+	case reuseWindow:
+		return 2 + significant
+	default:
+		return 2 + 5 + 6 + significant
+	}
+}
+
+// fitsInBits returns whether v can be represented as a signed integer with n
+// bits.
+func fitsInBits(v int64, n int) bool {
+	return v >= -(1<<uint(n-1)) && v < 1<<uint(n-1)
+}
+
+// signExtend interprets the n least significant bits of v as a signed integer.
+func signExtend(v uint64, n int) int64 {
+	return int64(v<<uint(64-n)) >> uint(64-n)
+}
+
+func leadingZeros(v uint64) int {
+	n := 0
+	for i := 63; i >= 0 && v&(1<<uint(i)) == 0; i-- {
+		n++
+	}
+	return n
+}
+
+func trailingZeros(v uint64) int {
+	n := 0
+	for i := 0; i < 64 && v&(1<<uint(i)) == 0; i++ {
+		n++
+	}
+	return n
+}
+
+// varbitEncodedChunkIterator implements chunkIterator. Samples are decoded
+// lazily upon first access. Only the samples present in the chunk at the time
+// the iterator was created are considered.
+type varbitEncodedChunkIterator struct {
+	chunk               *varbitEncodedChunk
+	n                   int
+	firstTime, lastTime clientmodel.Timestamp
+	decoded             metric.Values
+	batchIdx            int // The index of the next sample returned by nextBatch.
+}
+
+// values returns the decoded samples of the chunk.
+func (it *varbitEncodedChunkIterator) values() metric.Values {
+	if it.decoded == nil {
+		it.decoded = it.chunk.decode(it.n)
+	}
+	return it.decoded
+}
+
+// getValueAtTime implements chunkIterator.
+func (it *varbitEncodedChunkIterator) getValueAtTime(t clientmodel.Timestamp) metric.Values {
+	values := it.values()
+	i := sort.Search(len(values), func(i int) bool {
+		return !values[i].Timestamp.Before(t)
+	})
+
+	switch i {
+	case 0:
+		return metric.Values{values[0]}
+	case len(values):
+		return metric.Values{values[len(values)-1]}
+	default:
+		if values[i].Timestamp.Equal(t) {
+			return metric.Values{values[i]}
+		}
+		return metric.Values{values[i-1], values[i]}
+	}
+}
+
+// getRangeValues implements chunkIterator.
+func (it *varbitEncodedChunkIterator) getRangeValues(in metric.Interval) metric.Values {
+	values := it.values()
+	oldest := sort.Search(len(values), func(i int) bool {
+		return !values[i].Timestamp.Before(in.OldestInclusive)
+	})
+	newest := sort.Search(len(values), func(i int) bool {
+		return values[i].Timestamp.After(in.NewestInclusive)
+	})
+	if oldest == len(values) {
+		return nil
+	}
+
+	result := make(metric.Values, newest-oldest)
+	copy(result, values[oldest:newest])
+	return result
+}
+
+// contains implements chunkIterator.
+func (it *varbitEncodedChunkIterator) contains(t clientmodel.Timestamp) bool {
+	return !t.Before(it.firstTime) && !t.After(it.lastTime)
+}
+
+// nextBatch implements chunkIterator. The batches are slices of the decoded
+// samples, so no copying is involved.
+func (it *varbitEncodedChunkIterator) nextBatch() metric.Values {
+	values := it.values()
+	if it.batchIdx >= len(values) {
+		return nil
+	}
+	end := it.batchIdx + chunkIteratorBatchSize
+	if end > len(values) {
+		end = len(values)
+	}
+	batch := values[it.batchIdx:end:end]
+	it.batchIdx = end
+	return batch
+}
+
+// reverseValues implements chunkIterator. Samples can only be decoded in
+// order, so all of them are decoded first.
+func (it *varbitEncodedChunkIterator) reverseValues() <-chan *metric.SamplePair {
+	values := it.values()
+	valuesChan := make(chan *metric.SamplePair, len(values))
+	for i := len(values) - 1; i >= 0; i-- {
+		v := values[i]
+		valuesChan <- &v
+	}
+	close(valuesChan)
+	return valuesChan
+}
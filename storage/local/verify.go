@@ -0,0 +1,396 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/local/codable"
+	"github.com/prometheus/prometheus/storage/local/index"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+// VerifyReport is the result of Verify. Each problem found is described in
+// Problems, phrased in terms of what crash recovery would do about it.
+type VerifyReport struct {
+	Dirty              bool // The DIRTY file exists, i.e. unclean shutdown or storage in use.
+	CheckpointComplete bool // The checkpoint could be read completely (or there is none).
+	SeriesInCheckpoint int
+	ArchivedSeries     int
+	SeriesFiles        int
+	ChunksChecked      int
+	Problems           []string
+}
+
+// OK returns true if no problems have been found.
+func (r *VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *VerifyReport) problemf(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+// String returns a human-readable version of the report.
+func (r *VerifyReport) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "Dirty:                 %t\n", r.Dirty)
+	fmt.Fprintf(&buf, "Checkpoint complete:   %t\n", r.CheckpointComplete)
+	fmt.Fprintf(&buf, "Series in checkpoint:  %d\n", r.SeriesInCheckpoint)
+	fmt.Fprintf(&buf, "Archived series:       %d\n", r.ArchivedSeries)
+	fmt.Fprintf(&buf, "Series files:          %d\n", r.SeriesFiles)
+	fmt.Fprintf(&buf, "Chunks checked:        %d\n", r.ChunksChecked)
+	fmt.Fprintf(&buf, "Problems found:        %d\n", len(r.Problems))
+	for _, p := range r.Problems {
+		fmt.Fprintf(&buf, "  - %s\n", p)
+	}
+	return buf.String()
+}
+
+// Verify checks the local storage in the given directory for consistency
+// without modifying it. It performs the checks crash recovery would perform
+// (reading the checkpoint, sanitizing each series file, and cross-checking the
+// archive indexes) and additionally decodes every persisted chunk. As chunks
+// do not carry checksums, a chunk is considered valid if it can be decoded,
+// its samples are in order, and its first and last sample times match the
+// chunk header.
+//
+// The archive indexes are opened from a temporary copy, as LevelDB writes to
+// its directory even when only reading. The storage must not be in use while
+// it is verified. An error is returned if the verification could not be
+// performed at all.
+func Verify(basePath string) (*VerifyReport, error) {
+	versionData, err := ioutil.ReadFile(filepath.Join(basePath, versionFileName))
+	if err != nil {
+		return nil, err
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(string(versionData)))
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse content of %s: %s", versionFileName, versionData)
+	}
+	if version != Version {
+		return nil, fmt.Errorf("found storage version %d on disk, can only verify version %d", version, Version)
+	}
+
+	if _, err := os.Stat(filepath.Join(basePath, encryptionFileName)); err == nil {
+		return nil, fmt.Errorf("cannot verify encrypted storage")
+	}
+
+	r := &VerifyReport{}
+	if _, err := os.Stat(filepath.Join(basePath, dirtyFileName)); err == nil {
+		r.Dirty = true
+		r.problemf("storage is dirty (unclean shutdown or in use), crash recovery would run on start-up")
+	}
+
+	p := &persistence{basePath: basePath}
+	fpToSeries := map[clientmodel.Fingerprint]*memorySeries{}
+	_, _, r.CheckpointComplete = p.loadHeads(fpToSeries)
+	if !r.CheckpointComplete {
+		r.problemf("checkpoint %s is unreadable or truncated, %d series could be read from it", headsFileName, len(fpToSeries))
+	}
+	r.SeriesInCheckpoint = len(fpToSeries)
+
+	archived, err := readArchiveIndexes(basePath)
+	if err != nil {
+		return nil, err
+	}
+	for fp, as := range archived {
+		if as.metric == nil {
+			r.problemf("fingerprint %v has a time range but no metric in the archive indexes, would be removed from the archive", fp)
+		}
+		if !as.hasTimeRange {
+			r.problemf("fingerprint %v has a metric but no time range in the archive indexes, would be removed from the archive", fp)
+		}
+		if _, ok := fpToSeries[fp]; ok {
+			r.problemf("fingerprint %v is both in the checkpoint and archived, would be removed from the archive", fp)
+		}
+	}
+	r.ArchivedSeries = len(archived)
+
+	fpsSeen := map[clientmodel.Fingerprint]struct{}{}
+	seriesDirNameFmt := fmt.Sprintf("%%0%dx", seriesDirNameLen)
+	for i := 0; i < 1<<(seriesDirNameLen*4); i++ {
+		dirname := path.Join(basePath, fmt.Sprintf(seriesDirNameFmt, i))
+		fis, err := ioutil.ReadDir(dirname)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range fis {
+			r.SeriesFiles++
+			if fp, ok := verifySeriesFile(r, dirname, fi, fpToSeries, archived); ok {
+				fpsSeen[fp] = struct{}{}
+			}
+		}
+	}
+
+	for fp, s := range fpToSeries {
+		if _, ok := fpsSeen[fp]; ok {
+			continue
+		}
+		if s.headChunkClosed {
+			r.problemf("series %v, fingerprint %v, is fully persisted according to the checkpoint but has no series file, series is lost", s.metric, fp)
+		} else if s.persistWatermark > 0 || s.chunkDescsOffset != 0 {
+			r.problemf("series %v, fingerprint %v, has persisted chunks according to the checkpoint but no series file, chunks are lost", s.metric, fp)
+		}
+	}
+	for fp, as := range archived {
+		if _, ok := fpsSeen[fp]; !ok {
+			r.problemf("archived series %v, fingerprint %v, has no series file, would be removed from the archive", as.metric, fp)
+		}
+	}
+	return r, nil
+}
+
+// archiveEntry is what the archive indexes contain about a fingerprint.
+type archiveEntry struct {
+	metric       clientmodel.Metric // nil if not in the metric index.
+	first, last  clientmodel.Timestamp
+	hasTimeRange bool
+}
+
+// readArchiveIndexes reads the archive indexes from a temporary copy.
+func readArchiveIndexes(basePath string) (map[clientmodel.Fingerprint]*archiveEntry, error) {
+	tmpDir, err := ioutil.TempDir("", "prometheus_verify")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+	for _, d := range index.ArchiveIndexDirs() {
+		if err := copyDir(filepath.Join(basePath, d), filepath.Join(tmpDir, d)); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	fpToMetric, err := index.NewFingerprintMetricIndex(tmpDir, index.DefaultCacheSizes.FingerprintToMetric)
+	if err != nil {
+		return nil, err
+	}
+	defer fpToMetric.Close()
+	fpToTimeRange, err := index.NewFingerprintTimeRangeIndex(tmpDir, index.DefaultCacheSizes.FingerprintTimeRange)
+	if err != nil {
+		return nil, err
+	}
+	defer fpToTimeRange.Close()
+
+	archived := map[clientmodel.Fingerprint]*archiveEntry{}
+	get := func(fp codable.Fingerprint) *archiveEntry {
+		as, ok := archived[clientmodel.Fingerprint(fp)]
+		if !ok {
+			as = &archiveEntry{}
+			archived[clientmodel.Fingerprint(fp)] = as
+		}
+		return as
+	}
+	var (
+		fp codable.Fingerprint
+		m  codable.Metric
+		tr codable.TimeRange
+	)
+	if err := fpToMetric.ForEach(func(kv index.KeyValueAccessor) error {
+		if err := kv.Key(&fp); err != nil {
+			return err
+		}
+		m = codable.Metric{}
+		if err := kv.Value(&m); err != nil {
+			return err
+		}
+		get(fp).metric = clientmodel.Metric(m)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err := fpToTimeRange.ForEach(func(kv index.KeyValueAccessor) error {
+		if err := kv.Key(&fp); err != nil {
+			return err
+		}
+		if err := kv.Value(&tr); err != nil {
+			return err
+		}
+		as := get(fp)
+		as.first, as.last, as.hasTimeRange = tr.First, tr.Last, true
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return archived, nil
+}
+
+// verifySeriesFile is the read-only counterpart of sanitizeSeries. It records
+// all problems with the given series file in the report and returns the
+// fingerprint of the file and whether crash recovery would keep it.
+func verifySeriesFile(
+	r *VerifyReport,
+	dirname string,
+	fi os.FileInfo,
+	fpToSeries map[clientmodel.Fingerprint]*memorySeries,
+	archived map[clientmodel.Fingerprint]*archiveEntry,
+) (clientmodel.Fingerprint, bool) {
+	filename := path.Join(dirname, fi.Name())
+
+	var fp clientmodel.Fingerprint
+	if len(fi.Name()) != fpLen-seriesDirNameLen+len(seriesFileSuffix) ||
+		!strings.HasSuffix(fi.Name(), seriesFileSuffix) {
+		r.problemf("unexpected series file name %s, would be orphaned", filename)
+		return fp, false
+	}
+	if err := fp.LoadFromString(path.Base(dirname) + fi.Name()[:fpLen-seriesDirNameLen]); err != nil {
+		r.problemf("error parsing file name %s, would be orphaned: %s", filename, err)
+		return fp, false
+	}
+
+	bytesToTrim := fi.Size() % int64(chunkLenWithHeader)
+	chunksInFile := int(fi.Size()) / chunkLenWithHeader
+	if bytesToTrim != 0 {
+		r.problemf("series file %s would be truncated by %d extraneous bytes", filename, bytesToTrim)
+	}
+	if chunksInFile == 0 {
+		r.problemf("no chunks in series file %s, would be orphaned", filename)
+		return fp, false
+	}
+	first, last, ok := verifyChunks(r, filename, chunksInFile)
+	if !ok {
+		return fp, false
+	}
+
+	if s, ok := fpToSeries[fp]; ok {
+		if s.chunkDescsOffset == -1 ||
+			chunksInFile != s.chunkDescsOffset+s.persistWatermark ||
+			!fi.ModTime().Equal(s.modTime) {
+			r.problemf("series file %s is inconsistent with the checkpoint, would be reconciled", filename)
+		}
+		return fp, true
+	}
+	as, ok := archived[fp]
+	if !ok || as.metric == nil {
+		r.problemf("series file %s belongs neither to a series in the checkpoint nor to an archived one, would be orphaned", filename)
+		return fp, false
+	}
+	if as.first != first || as.last != last {
+		r.problemf(
+			"archived time range of fingerprint %v is %v to %v, but series file %s covers %v to %v",
+			fp, as.first, as.last, filename, first, last,
+		)
+	}
+	return fp, true
+}
+
+// verifyChunks decodes all chunks in the given series file. It returns the
+// first and last sample time of the file and whether the file could be read.
+// Problems with individual chunks are recorded in the report.
+func verifyChunks(r *VerifyReport, filename string, numChunks int) (first, last clientmodel.Timestamp, ok bool) {
+	f, err := os.Open(filename)
+	if err != nil {
+		r.problemf("could not open series file %s: %s", filename, err)
+		return 0, 0, false
+	}
+	defer f.Close()
+
+	buf := make([]byte, chunkLenWithHeader)
+	prevLast := clientmodel.Earliest
+	for i := 0; i < numChunks; i++ {
+		if _, err := io.ReadFull(f, buf); err != nil {
+			r.problemf("could not read chunk %d of series file %s: %s", i, filename, err)
+			return 0, 0, false
+		}
+		r.ChunksChecked++
+		headerFirst := clientmodel.Timestamp(binary.LittleEndian.Uint64(buf[chunkHeaderFirstTimeOffset:]))
+		headerLast := clientmodel.Timestamp(binary.LittleEndian.Uint64(buf[chunkHeaderLastTimeOffset:]))
+		if i == 0 {
+			first = headerFirst
+		}
+		last = headerLast
+		if err := verifyChunk(buf, headerFirst, headerLast); err != nil {
+			r.problemf("chunk %d of series file %s is corrupt: %s", i, filename, err)
+			continue
+		}
+		if headerFirst < prevLast {
+			r.problemf("chunk %d of series file %s overlaps with the previous chunk", i, filename)
+		}
+		prevLast = headerLast
+	}
+	return first, last, true
+}
+
+// verifyChunk decodes a single chunk including its header. Decoding a corrupt
+// chunk might panic, which is turned into an error.
+func verifyChunk(buf []byte, headerFirst, headerLast clientmodel.Timestamp) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("decoding failed: %v", r)
+		}
+	}()
+
+	encoding := ChunkEncoding(buf[chunkHeaderTypeOffset])
+	if !encoding.valid() {
+		return fmt.Errorf("unknown chunk encoding %d", encoding)
+	}
+	if headerFirst > headerLast {
+		return fmt.Errorf("first time %v after last time %v in chunk header", headerFirst, headerLast)
+	}
+	c := newChunkForEncoding(encoding)
+	c.unmarshalFromBuf(buf[chunkHeaderLen:])
+	if c.firstTime() != headerFirst || c.lastTime() != headerLast {
+		return fmt.Errorf(
+			"chunk covers %v to %v, but header says %v to %v",
+			c.firstTime(), c.lastTime(), headerFirst, headerLast,
+		)
+	}
+	values := c.newIterator().getRangeValues(metric.Interval{
+		OldestInclusive: headerFirst,
+		NewestInclusive: headerLast,
+	})
+	if len(values) == 0 {
+		return fmt.Errorf("no samples in chunk")
+	}
+	for i := 1; i < len(values); i++ {
+		if values[i].Timestamp < values[i-1].Timestamp {
+			return fmt.Errorf("samples out of order at index %d", i)
+		}
+	}
+	return nil
+}
+
+// copyDir copies the regular files in src into the newly created directory
+// dst.
+func copyDir(src, dst string) error {
+	fis, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dst, 0700); err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if !fi.Mode().IsRegular() || fi.Name() == "LOCK" {
+			continue
+		}
+		if err := copyFile(filepath.Join(src, fi.Name()), filepath.Join(dst, fi.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,453 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package local
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/glog"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/local/codable"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+const (
+	walDirName           = "wal"
+	walSegmentSuffix     = ".db"
+	walSegmentNameFormat = "%08d" + walSegmentSuffix
+	walMagicString       = "PrometheusWAL"
+	walFormatVersion     = 2
+	// walMaxRecordLen limits the length of a single record so that a
+	// corrupted length does not trigger a huge allocation on reading.
+	walMaxRecordLen = 1 << 24
+)
+
+// errWALCorrupted is returned by readSegment if a record is corrupted, usually
+// detected by a checksum mismatch. Unlike a truncated record at the end of a
+// segment, this is not expected after a crash, and nothing after it can be
+// trusted.
+var errWALCorrupted = errors.New("corrupted WAL record")
+
+// Record types of the write-ahead log.
+const (
+	// walRecordMetric maps a fingerprint to its metric. It is written
+	// before the first sample of a fingerprint in each segment so that
+	// each segment can be replayed on its own.
+	walRecordMetric byte = iota + 1
+	// walRecordSample is a single sample appended to a series.
+	walRecordSample
+	// walRecordSeriesChange marks a fingerprint whose series file or
+	// archive index entry is about to be modified.
+	walRecordSeriesChange
+	// walRecordDirty marks the storage as inconsistent in a way that
+	// requires a full crash recovery.
+	walRecordDirty
+)
+
+// Each record is written as the uvarint-encoded length of its payload, the
+// payload itself, and the big-endian CRC32 (IEEE) of the payload. The payload
+// starts with the record type, followed by the fingerprint (except for
+// walRecordDirty) and the type-specific data. If the storage is encrypted, the
+// payload is sealed as a whole, and the checksum covers the sealed payload.
+
+// walRecord is a decoded record of the write-ahead log.
+type walRecord struct {
+	recordType byte
+	fp         clientmodel.Fingerprint
+	metric     clientmodel.Metric
+	sample     metric.SamplePair
+}
+
+// writeAheadLog is an append-only log of all samples ingested and all series
+// files modified since the last checkpoint. The log is split into numbered
+// segments. A new segment is started whenever a checkpoint begins, and all
+// older segments are removed once the checkpoint has completed
+// successfully. Thus, the oldest segment on disk always started before the
+// latest complete checkpoint, and replaying all segments on top of that
+// checkpoint restores all samples logged.
+//
+// Samples are buffered in memory and only written out upon flush. Series
+// changes, on the other hand, are written out (but not sync'd) before
+// returning so that they are on disk before the series file is touched.
+//
+// All methods are goroutine-safe.
+type writeAheadLog struct {
+	dir  string
+	aead cipher.AEAD // nil if the log is not encrypted. Only set before use.
+
+	mtx       sync.Mutex // Protects all fields below.
+	segment   int
+	f         *os.File
+	w         *bufio.Writer
+	loggedFPs map[clientmodel.Fingerprint]struct{} // Fingerprints whose metric is in the current segment.
+	dirty     bool                                 // If true, every new segment starts with a walRecordDirty.
+	rec       []byte                               // Payload of the record being written.
+	buf       [binary.MaxVarintLen64]byte
+}
+
+// newWriteAheadLog opens the write-ahead log in the given directory and
+// starts a new segment. It returns the numbers of the segments already
+// existing, in ascending order.
+func newWriteAheadLog(dir string) (*writeAheadLog, []int, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, nil, err
+	}
+	segments, err := walSegments(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	wal := &writeAheadLog{dir: dir}
+	next := 1
+	if len(segments) > 0 {
+		next = segments[len(segments)-1] + 1
+	}
+	if err := wal.openSegment(next); err != nil {
+		return nil, nil, err
+	}
+	return wal, segments, nil
+}
+
+// walSegments returns the numbers of the segments in the given directory, in
+// ascending order.
+func walSegments(dir string) ([]int, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	segments := []int{}
+	for _, fi := range fis {
+		if !strings.HasSuffix(fi.Name(), walSegmentSuffix) {
+			continue
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(fi.Name(), walSegmentSuffix))
+		if err != nil {
+			glog.Warningf("Ignoring unexpected file %s in WAL directory.", fi.Name())
+			continue
+		}
+		segments = append(segments, n)
+	}
+	sort.Ints(segments)
+	return segments, nil
+}
+
+func (wal *writeAheadLog) segmentFileName(n int) string {
+	return path.Join(wal.dir, fmt.Sprintf(walSegmentNameFormat, n))
+}
+
+// openSegment creates segment n and makes it the current segment. The caller
+// must have locked wal.mtx (or have exclusive access otherwise).
+func (wal *writeAheadLog) openSegment(n int) error {
+	f, err := os.OpenFile(wal.segmentFileName(n), os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	wal.segment = n
+	wal.f = f
+	wal.w = bufio.NewWriterSize(f, fileBufSize)
+	wal.loggedFPs = map[clientmodel.Fingerprint]struct{}{}
+	if _, err := wal.w.WriteString(walMagicString); err != nil {
+		return err
+	}
+	if _, err := codable.EncodeVarint(wal.w, walFormatVersion); err != nil {
+		return err
+	}
+	if wal.dirty {
+		if err := wal.writeRecord(append(wal.rec[:0], walRecordDirty)); err != nil {
+			return err
+		}
+	}
+	return wal.w.Flush()
+}
+
+// logSample appends a sample for the series with the given fingerprint and
+// metric to the log. The sample is buffered until the next flush.
+func (wal *writeAheadLog) logSample(fp clientmodel.Fingerprint, m clientmodel.Metric, v *metric.SamplePair) error {
+	wal.mtx.Lock()
+	defer wal.mtx.Unlock()
+
+	if _, ok := wal.loggedFPs[fp]; !ok {
+		buf, err := codable.Metric(m).MarshalBinary()
+		if err != nil {
+			return err
+		}
+		if err := wal.writeRecord(append(wal.header(walRecordMetric, fp), buf...)); err != nil {
+			return err
+		}
+		wal.loggedFPs[fp] = struct{}{}
+	}
+	rec := wal.header(walRecordSample, fp)
+	n := binary.PutVarint(wal.buf[:], int64(v.Timestamp))
+	rec = append(rec, wal.buf[:n]...)
+	rec = append(rec, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(rec[len(rec)-8:], math.Float64bits(float64(v.Value)))
+	return wal.writeRecord(rec)
+}
+
+// logSeriesChange records that the series file or the archive index entry of
+// the given fingerprint is about to be modified. The record (and everything
+// logged before it) is handed to the OS before the method returns.
+func (wal *writeAheadLog) logSeriesChange(fp clientmodel.Fingerprint) error {
+	wal.mtx.Lock()
+	defer wal.mtx.Unlock()
+
+	if err := wal.writeRecord(wal.header(walRecordSeriesChange, fp)); err != nil {
+		return err
+	}
+	return wal.w.Flush()
+}
+
+// logDirty records that the storage has become inconsistent. From now on,
+// every segment will carry that mark so that it cannot be lost by
+// checkpointing.
+func (wal *writeAheadLog) logDirty() error {
+	wal.mtx.Lock()
+	defer wal.mtx.Unlock()
+
+	if wal.dirty {
+		return nil
+	}
+	wal.dirty = true
+	if err := wal.writeRecord(append(wal.rec[:0], walRecordDirty)); err != nil {
+		return err
+	}
+	return wal.w.Flush()
+}
+
+// setAEAD makes the log seal each record written from now on, and open each
+// record read. It must be called before anything is logged or read.
+func (wal *writeAheadLog) setAEAD(aead cipher.AEAD) {
+	wal.mtx.Lock()
+	defer wal.mtx.Unlock()
+
+	wal.aead = aead
+}
+
+// header starts the payload of a new record in wal.rec and returns it.
+func (wal *writeAheadLog) header(recordType byte, fp clientmodel.Fingerprint) []byte {
+	rec := append(wal.rec[:0], recordType, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(rec[1:], uint64(fp))
+	return rec
+}
+
+// writeRecord frames the given payload with its length and checksum and
+// writes it to the buffer of the current segment.
+func (wal *writeAheadLog) writeRecord(rec []byte) error {
+	wal.rec = rec // Keep the possibly grown buffer for reuse.
+	if wal.aead != nil {
+		sealed, err := seal(wal.aead, rec, nil)
+		if err != nil {
+			return err
+		}
+		rec = sealed
+	}
+	n := binary.PutUvarint(wal.buf[:], uint64(len(rec)))
+	if _, err := wal.w.Write(wal.buf[:n]); err != nil {
+		return err
+	}
+	if _, err := wal.w.Write(rec); err != nil {
+		return err
+	}
+	binary.BigEndian.PutUint32(wal.buf[:], crc32.ChecksumIEEE(rec))
+	_, err := wal.w.Write(wal.buf[:4])
+	return err
+}
+
+// flush writes all buffered records to the current segment. If sync is true,
+// the segment is sync'd to disk afterwards.
+func (wal *writeAheadLog) flush(sync bool) error {
+	wal.mtx.Lock()
+	defer wal.mtx.Unlock()
+
+	if err := wal.w.Flush(); err != nil {
+		return err
+	}
+	if sync {
+		return wal.f.Sync()
+	}
+	return nil
+}
+
+// rotate flushes and closes the current segment and starts a new one. It
+// returns the number of the new segment.
+func (wal *writeAheadLog) rotate() (int, error) {
+	wal.mtx.Lock()
+	defer wal.mtx.Unlock()
+
+	if err := wal.closeSegment(); err != nil {
+		return 0, err
+	}
+	next := wal.segment + 1
+	return next, wal.openSegment(next)
+}
+
+// removeSegmentsBefore deletes all segments with a number lower than n.
+func (wal *writeAheadLog) removeSegmentsBefore(n int) error {
+	segments, err := walSegments(wal.dir)
+	if err != nil {
+		return err
+	}
+	for _, s := range segments {
+		if s >= n {
+			break
+		}
+		if err := os.Remove(wal.segmentFileName(s)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close flushes, syncs, and closes the current segment.
+func (wal *writeAheadLog) close() error {
+	wal.mtx.Lock()
+	defer wal.mtx.Unlock()
+
+	return wal.closeSegment()
+}
+
+func (wal *writeAheadLog) closeSegment() error {
+	if err := wal.w.Flush(); err != nil {
+		wal.f.Close()
+		return err
+	}
+	if err := wal.f.Sync(); err != nil {
+		wal.f.Close()
+		return err
+	}
+	return wal.f.Close()
+}
+
+// readSegment calls fn for each record in segment n. Metric records are
+// resolved and not passed to fn. Instead, sample records are handed over with
+// their metric filled in. A truncated record ends the reading of the segment
+// with a warning, as this is expected after a crash. A corrupted record ends
+// the reading with errWALCorrupted.
+func (wal *writeAheadLog) readSegment(n int, fn func(*walRecord)) error {
+	filename := wal.segmentFileName(n)
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReaderSize(f, fileBufSize)
+
+	buf := make([]byte, len(walMagicString))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		glog.Warningf("Could not read header of WAL segment %s: %s", filename, err)
+		return nil
+	}
+	if string(buf) != walMagicString {
+		return fmt.Errorf("unexpected magic string in WAL segment %s, want %q, got %q", filename, walMagicString, buf)
+	}
+	if version, err := binary.ReadVarint(r); version != walFormatVersion || err != nil {
+		return fmt.Errorf("unknown format version of WAL segment %s, want %d", filename, walFormatVersion)
+	}
+
+	metrics := map[clientmodel.Fingerprint]clientmodel.Metric{}
+	rec := &walRecord{}
+	for {
+		l, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			glog.Warningf("Error reading WAL segment %s: %s", filename, err)
+			return nil
+		}
+		if l == 0 || l > walMaxRecordLen {
+			glog.Errorf("Invalid record length %d in WAL segment %s.", l, filename)
+			return errWALCorrupted
+		}
+		if uint64(cap(buf)) < l+4 {
+			buf = make([]byte, l+4)
+		}
+		buf = buf[:l+4]
+		if _, err := io.ReadFull(r, buf); err != nil {
+			glog.Warningf("Truncated record in WAL segment %s: %s", filename, err)
+			return nil
+		}
+		payload := buf[:l]
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(buf[l:]) {
+			glog.Errorf("Checksum mismatch in WAL segment %s.", filename)
+			return errWALCorrupted
+		}
+		if wal.aead != nil {
+			if payload, err = open(wal.aead, payload, nil); err != nil || len(payload) == 0 {
+				glog.Errorf("Cannot decrypt record in WAL segment %s: %v", filename, err)
+				return errWALCorrupted
+			}
+		}
+
+		rec.recordType = payload[0]
+		if rec.recordType == walRecordDirty {
+			fn(rec)
+			continue
+		}
+		if len(payload) < 9 {
+			glog.Errorf("Short record of type %d in WAL segment %s.", rec.recordType, filename)
+			return errWALCorrupted
+		}
+		rec.fp = clientmodel.Fingerprint(binary.BigEndian.Uint64(payload[1:]))
+		data := payload[9:]
+
+		switch rec.recordType {
+		case walRecordMetric:
+			var m codable.Metric
+			if err := m.UnmarshalFromReader(bytes.NewReader(data)); err != nil {
+				glog.Errorf("Error decoding metric record in WAL segment %s: %s", filename, err)
+				return errWALCorrupted
+			}
+			metrics[rec.fp] = clientmodel.Metric(m)
+			continue
+		case walRecordSample:
+			ts, n := binary.Varint(data)
+			if n <= 0 || len(data) != n+8 {
+				glog.Errorf("Malformed sample record in WAL segment %s.", filename)
+				return errWALCorrupted
+			}
+			m, ok := metrics[rec.fp]
+			if !ok {
+				glog.Warningf("Sample for unknown fingerprint %v in WAL segment %s, skipping.", rec.fp, filename)
+				continue
+			}
+			rec.metric = m
+			rec.sample = metric.SamplePair{
+				Timestamp: clientmodel.Timestamp(ts),
+				Value:     clientmodel.SampleValue(math.Float64frombits(binary.BigEndian.Uint64(data[n:]))),
+			}
+		case walRecordSeriesChange:
+		default:
+			glog.Warningf("Unknown record type %d in WAL segment %s.", rec.recordType, filename)
+			return nil
+		}
+		fn(rec)
+	}
+}
@@ -14,7 +14,9 @@
 package metric
 
 import (
+	"encoding/json"
 	"fmt"
+	"math"
 	"strconv"
 
 	clientmodel "github.com/prometheus/client_golang/model"
@@ -25,6 +27,34 @@ func (s SamplePair) MarshalJSON() ([]byte, error) {
 	return []byte(fmt.Sprintf("[%s, \"%s\"]", s.Timestamp.String(), strconv.FormatFloat(float64(s.Value), 'f', -1, 64))), nil
 }
 
+// UnmarshalJSON implements json.Unmarshaler. It accepts the format written by
+// MarshalJSON, i.e. the timestamp in seconds followed by the value as a string.
+// The timestamp is rounded to milliseconds.
+func (s *SamplePair) UnmarshalJSON(b []byte) error {
+	var pair []json.RawMessage
+	if err := json.Unmarshal(b, &pair); err != nil {
+		return err
+	}
+	if len(pair) != 2 {
+		return fmt.Errorf("sample pair must have 2 elements, got %d", len(pair))
+	}
+	var t float64
+	if err := json.Unmarshal(pair[0], &t); err != nil {
+		return fmt.Errorf("invalid timestamp %s: %s", pair[0], err)
+	}
+	var v string
+	if err := json.Unmarshal(pair[1], &v); err != nil {
+		return fmt.Errorf("invalid sample value %s: %s", pair[1], err)
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return err
+	}
+	s.Timestamp = clientmodel.Timestamp(math.Floor(t*1000 + 0.5))
+	s.Value = clientmodel.SampleValue(f)
+	return nil
+}
+
 // SamplePair pairs a SampleValue with a Timestamp.
 type SamplePair struct {
 	Timestamp clientmodel.Timestamp
@@ -53,3 +83,46 @@ type Interval struct {
 	OldestInclusive clientmodel.Timestamp
 	NewestInclusive clientmodel.Timestamp
 }
+
+// Rollup aggregates all sample values of a series within a time bucket that
+// starts at Timestamp. A Rollup with a Count of 0 is empty, and its Min and Max
+// are meaningless.
+type Rollup struct {
+	Timestamp clientmodel.Timestamp
+	Min, Max  clientmodel.SampleValue
+	Sum       clientmodel.SampleValue
+	Count     int
+}
+
+// Add adds a single sample value to the Rollup.
+func (r *Rollup) Add(v clientmodel.SampleValue) {
+	if r.Count == 0 {
+		r.Min, r.Max = v, v
+	} else {
+		r.Min = clientmodel.SampleValue(math.Min(float64(r.Min), float64(v)))
+		r.Max = clientmodel.SampleValue(math.Max(float64(r.Max), float64(v)))
+	}
+	r.Sum += v
+	r.Count++
+}
+
+// Merge adds all sample values aggregated in o to the Rollup. The Timestamp of
+// the Rollup is not changed.
+func (r *Rollup) Merge(o *Rollup) {
+	if o.Count == 0 {
+		return
+	}
+	if r.Count == 0 {
+		r.Min, r.Max = o.Min, o.Max
+	} else {
+		r.Min = clientmodel.SampleValue(math.Min(float64(r.Min), float64(o.Min)))
+		r.Max = clientmodel.SampleValue(math.Max(float64(r.Max), float64(o.Max)))
+	}
+	r.Sum += o.Sum
+	r.Count += o.Count
+}
+
+// Avg returns the average of the sample values aggregated in the Rollup.
+func (r *Rollup) Avg() clientmodel.SampleValue {
+	return r.Sum / clientmodel.SampleValue(r.Count)
+}
@@ -0,0 +1,70 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ewmaRate tracks an exponentially weighted moving average of a per-second
+// rate of events. Events may be added concurrently, while tick has to be
+// called once per interval to update the rate.
+type ewmaRate struct {
+	newEvents int64 // Accessed atomically, keep 64-bit aligned.
+	alpha     float64
+	interval  time.Duration
+
+	mtx      sync.Mutex
+	lastRate float64
+	init     bool
+}
+
+// newEWMARate returns an ewmaRate with the given smoothing factor between 0
+// and 1, ticked once per interval.
+func newEWMARate(alpha float64, interval time.Duration) *ewmaRate {
+	return &ewmaRate{
+		alpha:    alpha,
+		interval: interval,
+	}
+}
+
+// rate returns the current per-second rate.
+func (r *ewmaRate) rate() float64 {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.lastRate
+}
+
+// tick folds the events added since the last tick into the rate.
+func (r *ewmaRate) tick() {
+	newEvents := atomic.SwapInt64(&r.newEvents, 0)
+	instantRate := float64(newEvents) / r.interval.Seconds()
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.init {
+		r.lastRate += r.alpha * (instantRate - r.lastRate)
+	} else {
+		r.init = true
+		r.lastRate = instantRate
+	}
+}
+
+// incr adds events.
+func (r *ewmaRate) incr(incr int64) {
+	atomic.AddInt64(&r.newEvents, incr)
+}
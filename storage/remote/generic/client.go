@@ -0,0 +1,212 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package generic
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/gosnappy/snappy"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/prometheus/prometheus/storage/remote"
+	"github.com/prometheus/prometheus/utility"
+)
+
+const (
+	contentTypeProtobuf = "application/x-protobuf"
+	contentEncoding     = "snappy"
+
+	// The maximum number of bytes of an error response body to include in
+	// the returned error.
+	maxErrorBodyLen = 256
+)
+
+// Client allows sending batches of Prometheus samples to any HTTP endpoint
+// accepting the generic remote storage protocol: a POST request whose body is
+// a snappy-compressed WriteRequest protocol buffer. The endpoint has to reply
+// with a 2xx status code on success. A Client for an endpoint accepting
+// snappy-compressed ReadRequest protocol buffers instead, and replying with a
+// snappy-compressed ReadResponse, reads series from the remote storage.
+type Client struct {
+	url        string
+	httpClient *http.Client
+}
+
+// NewClient creates a new Client.
+func NewClient(url string, timeout time.Duration) *Client {
+	return &Client{
+		url:        url,
+		httpClient: utility.NewDeadlineClient(timeout),
+	}
+}
+
+// requestFromSamples groups the samples by time series, in order of their
+// first appearance, keeping the order of samples within each series.
+func requestFromSamples(samples clientmodel.Samples) *WriteRequest {
+	req := &WriteRequest{}
+	series := map[clientmodel.Fingerprint]*TimeSeries{}
+	for _, s := range samples {
+		fp := s.Metric.Fingerprint()
+		ts, ok := series[fp]
+		if !ok {
+			ts = &TimeSeries{
+				Name:   proto.String(string(s.Metric[clientmodel.MetricNameLabel])),
+				Labels: make([]*LabelPair, 0, len(s.Metric)),
+			}
+			for ln, lv := range s.Metric {
+				if ln == clientmodel.MetricNameLabel {
+					continue
+				}
+				ts.Labels = append(ts.Labels, &LabelPair{
+					Name:  proto.String(string(ln)),
+					Value: proto.String(string(lv)),
+				})
+			}
+			sort.Sort(labelPairsByName(ts.Labels))
+			series[fp] = ts
+			req.Timeseries = append(req.Timeseries, ts)
+		}
+		ts.Samples = append(ts.Samples, &Sample{
+			Value:       proto.Float64(float64(s.Value)),
+			TimestampMs: proto.Int64(int64(s.Timestamp)),
+		})
+	}
+	return req
+}
+
+// Store sends a batch of samples to the HTTP endpoint.
+func (c *Client) Store(samples clientmodel.Samples) error {
+	_, err := c.post(requestFromSamples(samples))
+	return err
+}
+
+// matchTypes maps the match types of label matchers to their protocol buffer
+// equivalents.
+var matchTypes = map[metric.MatchType]MatchType{
+	metric.Equal:        MatchType_EQUAL,
+	metric.NotEqual:     MatchType_NOT_EQUAL,
+	metric.RegexMatch:   MatchType_REGEX_MATCH,
+	metric.RegexNoMatch: MatchType_REGEX_NO_MATCH,
+}
+
+// Read reads the series matching the label matchers within the interval from
+// the HTTP endpoint. It implements remote.StorageReader.
+func (c *Client) Read(matchers metric.LabelMatchers, in metric.Interval) ([]remote.Series, error) {
+	req := &ReadRequest{
+		Matchers:         make([]*LabelMatcher, 0, len(matchers)),
+		StartTimestampMs: proto.Int64(int64(in.OldestInclusive)),
+		EndTimestampMs:   proto.Int64(int64(in.NewestInclusive)),
+	}
+	for _, m := range matchers {
+		req.Matchers = append(req.Matchers, &LabelMatcher{
+			Type:  matchTypes[m.Type].Enum(),
+			Name:  proto.String(string(m.Name)),
+			Value: proto.String(string(m.Value)),
+		})
+	}
+	compressed, err := c.post(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, err
+	}
+	resp := &ReadResponse{}
+	if err := proto.Unmarshal(body, resp); err != nil {
+		return nil, err
+	}
+
+	series := make([]remote.Series, 0, len(resp.Timeseries))
+	for _, ts := range resp.Timeseries {
+		s := remote.Series{
+			Metric: make(clientmodel.Metric, len(ts.Labels)+1),
+			Values: make(metric.Values, 0, len(ts.Samples)),
+		}
+		if ts.Name != nil {
+			s.Metric[clientmodel.MetricNameLabel] = clientmodel.LabelValue(ts.GetName())
+		}
+		for _, lp := range ts.Labels {
+			s.Metric[clientmodel.LabelName(lp.GetName())] = clientmodel.LabelValue(lp.GetValue())
+		}
+		for _, sample := range ts.Samples {
+			s.Values = append(s.Values, metric.SamplePair{
+				Timestamp: clientmodel.Timestamp(sample.GetTimestampMs()),
+				Value:     clientmodel.SampleValue(sample.GetValue()),
+			})
+		}
+		sort.Sort(valuesByTimestamp(s.Values))
+		series = append(series, s)
+	}
+	return series, nil
+}
+
+// post sends the snappy-compressed message to the HTTP endpoint and returns
+// the response body.
+func (c *Client) post(msg proto.Message) ([]byte, error) {
+	buf, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+	compressed, err := snappy.Encode(nil, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", c.url, bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentTypeProtobuf)
+	req.Header.Set("Content-Encoding", contentEncoding)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodyLen))
+		return nil, fmt.Errorf("server returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Name identifies the client as a generic client.
+func (c Client) Name() string {
+	return "generic"
+}
+
+// labelPairsByName implements sort.Interface, sorting by label name.
+type labelPairsByName []*LabelPair
+
+func (l labelPairsByName) Len() int           { return len(l) }
+func (l labelPairsByName) Less(i, j int) bool { return l[i].GetName() < l[j].GetName() }
+func (l labelPairsByName) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// valuesByTimestamp implements sort.Interface, sorting by ascending Timestamp.
+type valuesByTimestamp metric.Values
+
+func (v valuesByTimestamp) Len() int           { return len(v) }
+func (v valuesByTimestamp) Less(i, j int) bool { return v[i].Timestamp.Before(v[j].Timestamp) }
+func (v valuesByTimestamp) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
@@ -0,0 +1,167 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package generic
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/gosnappy/snappy"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+func TestStore(t *testing.T) {
+	m1 := clientmodel.Metric{clientmodel.MetricNameLabel: "up", "job": "api", "instance": "a"}
+	m2 := clientmodel.Metric{clientmodel.MetricNameLabel: "up", "job": "db"}
+	samples := clientmodel.Samples{
+		{Metric: m1, Value: 1, Timestamp: 1000},
+		{Metric: m2, Value: 0, Timestamp: 1000},
+		{Metric: m1, Value: 0.5, Timestamp: 2000},
+	}
+	want := &WriteRequest{
+		Timeseries: []*TimeSeries{
+			{
+				Name: proto.String("up"),
+				Labels: []*LabelPair{
+					{Name: proto.String("instance"), Value: proto.String("a")},
+					{Name: proto.String("job"), Value: proto.String("api")},
+				},
+				Samples: []*Sample{
+					{Value: proto.Float64(1), TimestampMs: proto.Int64(1000)},
+					{Value: proto.Float64(0.5), TimestampMs: proto.Int64(2000)},
+				},
+			},
+			{
+				Name: proto.String("up"),
+				Labels: []*LabelPair{
+					{Name: proto.String("job"), Value: proto.String("db")},
+				},
+				Samples: []*Sample{
+					{Value: proto.Float64(0), TimestampMs: proto.Int64(1000)},
+				},
+			},
+		},
+	}
+
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != contentTypeProtobuf || r.Header.Get("Content-Encoding") != contentEncoding {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+		compressed, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := &WriteRequest{}
+		if err := proto.Unmarshal(buf, got); err != nil {
+			t.Fatal(err)
+		}
+		if !proto.Equal(got, want) {
+			t.Errorf("got request %v, want %v", got, want)
+		}
+		w.WriteHeader(status)
+		w.Write([]byte("storage full\n"))
+	}))
+	defer server.Close()
+
+	c := NewClient(server.URL, time.Minute)
+	if err := c.Store(samples); err != nil {
+		t.Fatal(err)
+	}
+	status = http.StatusServiceUnavailable
+	if err := c.Store(samples); err == nil {
+		t.Error("expected error for HTTP status 503")
+	}
+}
+
+func TestRead(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		compressed, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := &ReadRequest{}
+		if err := proto.Unmarshal(buf, req); err != nil {
+			t.Fatal(err)
+		}
+		want := &ReadRequest{
+			Matchers: []*LabelMatcher{
+				{Type: MatchType_REGEX_MATCH.Enum(), Name: proto.String("job"), Value: proto.String("a.*")},
+			},
+			StartTimestampMs: proto.Int64(1000),
+			EndTimestampMs:   proto.Int64(2000),
+		}
+		if !proto.Equal(req, want) {
+			t.Errorf("got request %v, want %v", req, want)
+		}
+
+		buf, err = proto.Marshal(&ReadResponse{
+			Timeseries: []*TimeSeries{
+				{
+					Name:   proto.String("up"),
+					Labels: []*LabelPair{{Name: proto.String("job"), Value: proto.String("api")}},
+					Samples: []*Sample{
+						{Value: proto.Float64(0), TimestampMs: proto.Int64(2000)},
+						{Value: proto.Float64(1), TimestampMs: proto.Int64(1000)},
+					},
+				},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		compressed, err = snappy.Encode(nil, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(compressed)
+	}))
+	defer server.Close()
+
+	matcher, err := metric.NewLabelMatcher(metric.RegexMatch, "job", "a.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(server.URL, time.Minute)
+	got, err := c.Read(metric.LabelMatchers{matcher}, metric.Interval{OldestInclusive: 1000, NewestInclusive: 2000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []remote.Series{
+		{
+			Metric: clientmodel.Metric{clientmodel.MetricNameLabel: "up", "job": "api"},
+			Values: metric.Values{{Timestamp: 1000, Value: 1}, {Timestamp: 2000, Value: 0}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got series %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,259 @@
+// Code generated by protoc-gen-go.
+// source: generic.proto
+// DO NOT EDIT!
+
+/*
+Package generic is a generated protocol buffer package.
+
+It is generated from these files:
+	generic.proto
+
+It has these top-level messages:
+	LabelPair
+	Sample
+	TimeSeries
+	WriteRequest
+	LabelMatcher
+	ReadRequest
+	ReadResponse
+*/
+package generic
+
+import proto "github.com/golang/protobuf/proto"
+import math "math"
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = math.Inf
+
+// The type of a label matcher.
+type MatchType int32
+
+const (
+	MatchType_EQUAL          MatchType = 0
+	MatchType_NOT_EQUAL      MatchType = 1
+	MatchType_REGEX_MATCH    MatchType = 2
+	MatchType_REGEX_NO_MATCH MatchType = 3
+)
+
+var MatchType_name = map[int32]string{
+	0: "EQUAL",
+	1: "NOT_EQUAL",
+	2: "REGEX_MATCH",
+	3: "REGEX_NO_MATCH",
+}
+var MatchType_value = map[string]int32{
+	"EQUAL":          0,
+	"NOT_EQUAL":      1,
+	"REGEX_MATCH":    2,
+	"REGEX_NO_MATCH": 3,
+}
+
+func (x MatchType) Enum() *MatchType {
+	p := new(MatchType)
+	*p = x
+	return p
+}
+func (x MatchType) String() string {
+	return proto.EnumName(MatchType_name, int32(x))
+}
+func (x *MatchType) UnmarshalJSON(data []byte) error {
+	value, err := proto.UnmarshalJSONEnum(MatchType_value, data, "MatchType")
+	if err != nil {
+		return err
+	}
+	*x = MatchType(value)
+	return nil
+}
+
+// A label/value pair of a time series.
+type LabelPair struct {
+	Name             *string `protobuf:"bytes,1,opt,name=name" json:"name,omitempty"`
+	Value            *string `protobuf:"bytes,2,opt,name=value" json:"value,omitempty"`
+	XXX_unrecognized []byte  `json:"-"`
+}
+
+func (m *LabelPair) Reset()         { *m = LabelPair{} }
+func (m *LabelPair) String() string { return proto.CompactTextString(m) }
+func (*LabelPair) ProtoMessage()    {}
+
+func (m *LabelPair) GetName() string {
+	if m != nil && m.Name != nil {
+		return *m.Name
+	}
+	return ""
+}
+
+func (m *LabelPair) GetValue() string {
+	if m != nil && m.Value != nil {
+		return *m.Value
+	}
+	return ""
+}
+
+// A sample of a time series.
+type Sample struct {
+	Value *float64 `protobuf:"fixed64,1,opt,name=value" json:"value,omitempty"`
+	// Milliseconds since the Unix epoch.
+	TimestampMs      *int64 `protobuf:"varint,2,opt,name=timestamp_ms" json:"timestamp_ms,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *Sample) Reset()         { *m = Sample{} }
+func (m *Sample) String() string { return proto.CompactTextString(m) }
+func (*Sample) ProtoMessage()    {}
+
+func (m *Sample) GetValue() float64 {
+	if m != nil && m.Value != nil {
+		return *m.Value
+	}
+	return 0
+}
+
+func (m *Sample) GetTimestampMs() int64 {
+	if m != nil && m.TimestampMs != nil {
+		return *m.TimestampMs
+	}
+	return 0
+}
+
+// A time series, identified by its metric name and labels, with samples in
+// ascending order of their timestamps.
+type TimeSeries struct {
+	Name             *string      `protobuf:"bytes,1,opt,name=name" json:"name,omitempty"`
+	Labels           []*LabelPair `protobuf:"bytes,2,rep,name=labels" json:"labels,omitempty"`
+	Samples          []*Sample    `protobuf:"bytes,3,rep,name=samples" json:"samples,omitempty"`
+	XXX_unrecognized []byte       `json:"-"`
+}
+
+func (m *TimeSeries) Reset()         { *m = TimeSeries{} }
+func (m *TimeSeries) String() string { return proto.CompactTextString(m) }
+func (*TimeSeries) ProtoMessage()    {}
+
+func (m *TimeSeries) GetName() string {
+	if m != nil && m.Name != nil {
+		return *m.Name
+	}
+	return ""
+}
+
+func (m *TimeSeries) GetLabels() []*LabelPair {
+	if m != nil {
+		return m.Labels
+	}
+	return nil
+}
+
+func (m *TimeSeries) GetSamples() []*Sample {
+	if m != nil {
+		return m.Samples
+	}
+	return nil
+}
+
+// The body of a write request, encoded with snappy's block format.
+type WriteRequest struct {
+	Timeseries       []*TimeSeries `protobuf:"bytes,1,rep,name=timeseries" json:"timeseries,omitempty"`
+	XXX_unrecognized []byte        `json:"-"`
+}
+
+func (m *WriteRequest) Reset()         { *m = WriteRequest{} }
+func (m *WriteRequest) String() string { return proto.CompactTextString(m) }
+func (*WriteRequest) ProtoMessage()    {}
+
+func (m *WriteRequest) GetTimeseries() []*TimeSeries {
+	if m != nil {
+		return m.Timeseries
+	}
+	return nil
+}
+
+// A matcher for the value of a label.
+type LabelMatcher struct {
+	Type             *MatchType `protobuf:"varint,1,opt,name=type,enum=generic.MatchType" json:"type,omitempty"`
+	Name             *string    `protobuf:"bytes,2,opt,name=name" json:"name,omitempty"`
+	Value            *string    `protobuf:"bytes,3,opt,name=value" json:"value,omitempty"`
+	XXX_unrecognized []byte     `json:"-"`
+}
+
+func (m *LabelMatcher) Reset()         { *m = LabelMatcher{} }
+func (m *LabelMatcher) String() string { return proto.CompactTextString(m) }
+func (*LabelMatcher) ProtoMessage()    {}
+
+func (m *LabelMatcher) GetType() MatchType {
+	if m != nil && m.Type != nil {
+		return *m.Type
+	}
+	return MatchType_EQUAL
+}
+
+func (m *LabelMatcher) GetName() string {
+	if m != nil && m.Name != nil {
+		return *m.Name
+	}
+	return ""
+}
+
+func (m *LabelMatcher) GetValue() string {
+	if m != nil && m.Value != nil {
+		return *m.Value
+	}
+	return ""
+}
+
+// The body of a read request, encoded with snappy's block format. It selects
+// the samples within the time range of all series matching all matchers.
+type ReadRequest struct {
+	Matchers []*LabelMatcher `protobuf:"bytes,1,rep,name=matchers" json:"matchers,omitempty"`
+	// Milliseconds since the Unix epoch, both inclusive.
+	StartTimestampMs *int64 `protobuf:"varint,2,opt,name=start_timestamp_ms" json:"start_timestamp_ms,omitempty"`
+	EndTimestampMs   *int64 `protobuf:"varint,3,opt,name=end_timestamp_ms" json:"end_timestamp_ms,omitempty"`
+	XXX_unrecognized []byte `json:"-"`
+}
+
+func (m *ReadRequest) Reset()         { *m = ReadRequest{} }
+func (m *ReadRequest) String() string { return proto.CompactTextString(m) }
+func (*ReadRequest) ProtoMessage()    {}
+
+func (m *ReadRequest) GetMatchers() []*LabelMatcher {
+	if m != nil {
+		return m.Matchers
+	}
+	return nil
+}
+
+func (m *ReadRequest) GetStartTimestampMs() int64 {
+	if m != nil && m.StartTimestampMs != nil {
+		return *m.StartTimestampMs
+	}
+	return 0
+}
+
+func (m *ReadRequest) GetEndTimestampMs() int64 {
+	if m != nil && m.EndTimestampMs != nil {
+		return *m.EndTimestampMs
+	}
+	return 0
+}
+
+// The body of the response to a read request, encoded with snappy's block
+// format. Series without samples in the requested time range are omitted.
+type ReadResponse struct {
+	Timeseries       []*TimeSeries `protobuf:"bytes,1,rep,name=timeseries" json:"timeseries,omitempty"`
+	XXX_unrecognized []byte        `json:"-"`
+}
+
+func (m *ReadResponse) Reset()         { *m = ReadResponse{} }
+func (m *ReadResponse) String() string { return proto.CompactTextString(m) }
+func (*ReadResponse) ProtoMessage()    {}
+
+func (m *ReadResponse) GetTimeseries() []*TimeSeries {
+	if m != nil {
+		return m.Timeseries
+	}
+	return nil
+}
+
+func init() {
+	proto.RegisterEnum("generic.MatchType", MatchType_name, MatchType_value)
+}
@@ -0,0 +1,153 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package generic
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/gosnappy/snappy"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+// readHandler serves ReadRequests from a local storage.
+type readHandler struct {
+	storage local.Storage
+}
+
+// NewReadHandler returns an http.Handler serving snappy-compressed ReadRequest
+// protocol buffers from the provided storage, so that a Client can read from
+// it. Pass the local storage rather than one merging remote series into query
+// results, so that two Prometheus servers reading from each other do not
+// recurse.
+func NewReadHandler(s local.Storage) http.Handler {
+	return &readHandler{storage: s}
+}
+
+func (h *readHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "read requests have to be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	compressed, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	buf, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req := &ReadRequest{}
+	if err := proto.Unmarshal(buf, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp, err := h.read(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if buf, err = proto.Marshal(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if compressed, err = snappy.Encode(nil, buf); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentTypeProtobuf)
+	w.Header().Set("Content-Encoding", contentEncoding)
+	w.Write(compressed)
+}
+
+// read returns the samples of the series selected by the request.
+func (h *readHandler) read(req *ReadRequest) (*ReadResponse, error) {
+	matchers := make(metric.LabelMatchers, 0, len(req.Matchers))
+	for _, m := range req.Matchers {
+		var mt metric.MatchType
+		switch m.GetType() {
+		case MatchType_EQUAL:
+			mt = metric.Equal
+		case MatchType_NOT_EQUAL:
+			mt = metric.NotEqual
+		case MatchType_REGEX_MATCH:
+			mt = metric.RegexMatch
+		case MatchType_REGEX_NO_MATCH:
+			mt = metric.RegexNoMatch
+		default:
+			return nil, fmt.Errorf("unknown match type %v", m.GetType())
+		}
+		matcher, err := metric.NewLabelMatcher(mt, clientmodel.LabelName(m.GetName()), clientmodel.LabelValue(m.GetValue()))
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, matcher)
+	}
+	in := metric.Interval{
+		OldestInclusive: clientmodel.Timestamp(req.GetStartTimestampMs()),
+		NewestInclusive: clientmodel.Timestamp(req.GetEndTimestampMs()),
+	}
+
+	fps := h.storage.GetFingerprintsForLabelMatchers(matchers)
+	ranges := make(map[clientmodel.Fingerprint]metric.Interval, len(fps))
+	for _, fp := range fps {
+		ranges[fp] = in
+	}
+	p := h.storage.NewPreloader()
+	defer p.Close()
+	if err := p.PreloadRanges(ranges, 0); err != nil {
+		return nil, err
+	}
+
+	resp := &ReadResponse{}
+	for _, fp := range fps {
+		values := h.storage.NewIterator(fp).GetRangeValues(in)
+		if len(values) == 0 {
+			continue
+		}
+		m := h.storage.GetMetricForFingerprint(fp).Metric
+		ts := &TimeSeries{
+			Name:    proto.String(string(m[clientmodel.MetricNameLabel])),
+			Labels:  make([]*LabelPair, 0, len(m)),
+			Samples: make([]*Sample, 0, len(values)),
+		}
+		for ln, lv := range m {
+			if ln == clientmodel.MetricNameLabel {
+				continue
+			}
+			ts.Labels = append(ts.Labels, &LabelPair{
+				Name:  proto.String(string(ln)),
+				Value: proto.String(string(lv)),
+			})
+		}
+		sort.Sort(labelPairsByName(ts.Labels))
+		for _, v := range values {
+			ts.Samples = append(ts.Samples, &Sample{
+				Value:       proto.Float64(float64(v.Value)),
+				TimestampMs: proto.Int64(int64(v.Timestamp)),
+			})
+		}
+		resp.Timeseries = append(resp.Timeseries, ts)
+	}
+	return resp, nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package generic
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/prometheus/prometheus/storage/remote"
+)
+
+func TestReadHandler(t *testing.T) {
+	s, closer := local.NewTestStorage(t, 1)
+	defer closer.Close()
+
+	api := clientmodel.Metric{clientmodel.MetricNameLabel: "up", "job": "api"}
+	db := clientmodel.Metric{clientmodel.MetricNameLabel: "up", "job": "db"}
+	for ts := clientmodel.Timestamp(1000); ts <= 3000; ts += 1000 {
+		s.Append(&clientmodel.Sample{Metric: api, Value: 1, Timestamp: ts})
+		s.Append(&clientmodel.Sample{Metric: db, Value: 0, Timestamp: ts})
+	}
+	s.WaitForIndexing()
+
+	server := httptest.NewServer(NewReadHandler(s))
+	defer server.Close()
+
+	matcher, err := metric.NewLabelMatcher(metric.RegexMatch, "job", "a.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewClient(server.URL, time.Minute)
+	got, err := c.Read(metric.LabelMatchers{matcher}, metric.Interval{OldestInclusive: 1500, NewestInclusive: 3000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []remote.Series{
+		{
+			Metric: api,
+			Values: metric.Values{{Timestamp: 2000, Value: 1}, {Timestamp: 3000, Value: 1}},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got series %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+// The protocols understood by the Graphite carbon daemon.
+const (
+	ProtocolPlaintext = "plaintext"
+	ProtocolPickle    = "pickle"
+)
+
+// Client allows sending batches of Prometheus samples to Graphite's carbon
+// daemon over a persistent TCP connection, using either the plaintext or the
+// pickle protocol. The connection is opened on demand and reopened on the next
+// send after an error.
+type Client struct {
+	address  string
+	protocol string
+	prefix   string
+	template *PathTemplate
+	timeout  time.Duration
+
+	mtx  sync.Mutex
+	conn net.Conn
+}
+
+// NewClient creates a new Client. The prefix is prepended to the metric paths
+// built with the template, see ParsePathTemplate.
+func NewClient(address, protocol, prefix, template string, timeout time.Duration) (*Client, error) {
+	if protocol != ProtocolPlaintext && protocol != ProtocolPickle {
+		return nil, fmt.Errorf("invalid Graphite protocol %q", protocol)
+	}
+	t, err := ParsePathTemplate(template)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		address:  address,
+		protocol: protocol,
+		prefix:   prefix,
+		template: t,
+		timeout:  timeout,
+	}, nil
+}
+
+// Store sends a batch of samples to Graphite.
+func (c *Client) Store(samples clientmodel.Samples) error {
+	var buf []byte
+	if c.protocol == ProtocolPickle {
+		buf = c.encodePickle(samples)
+	} else {
+		buf = c.encodePlaintext(samples)
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.conn == nil {
+		conn, err := net.DialTimeout("tcp", c.address, c.timeout)
+		if err != nil {
+			return err
+		}
+		c.conn = conn
+	}
+	if err := c.conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+		c.closeConn()
+		return err
+	}
+	if _, err := c.conn.Write(buf); err != nil {
+		c.closeConn()
+		return err
+	}
+	return nil
+}
+
+// closeConn closes the connection, so that the next send reconnects. It has to
+// be called with mtx locked.
+func (c *Client) closeConn() {
+	if err := c.conn.Close(); err != nil {
+		glog.Warningf("Error closing connection to Graphite: %s", err)
+	}
+	c.conn = nil
+}
+
+// encodePlaintext encodes the samples as lines of the plaintext protocol:
+// "<path> <value> <timestamp in seconds>".
+func (c *Client) encodePlaintext(samples clientmodel.Samples) []byte {
+	var buf bytes.Buffer
+	for _, s := range samples {
+		fmt.Fprintf(&buf, "%s %s %d\n", c.template.Path(c.prefix, s.Metric), s.Value, s.Timestamp.Unix())
+	}
+	return buf.Bytes()
+}
+
+// Opcodes of version 2 of the Python pickle protocol.
+const (
+	pickleProto      = 0x80
+	pickleEmptyList  = ']'
+	pickleMark       = '('
+	pickleAppends    = 'e'
+	pickleBinUnicode = 'X'
+	pickleBinFloat   = 'G'
+	pickleTuple2     = 0x86
+	pickleStop       = '.'
+)
+
+// encodePickle encodes the samples as a message of the pickle protocol: a
+// 4-byte big-endian length followed by a pickled list of
+// (path, (timestamp, value)) tuples.
+func (c *Client) encodePickle(samples clientmodel.Samples) []byte {
+	buf := []byte{0, 0, 0, 0, pickleProto, 2, pickleEmptyList, pickleMark}
+	var b [8]byte
+	for _, s := range samples {
+		path := c.template.Path(c.prefix, s.Metric)
+		buf = append(buf, pickleBinUnicode)
+		binary.LittleEndian.PutUint32(b[:4], uint32(len(path)))
+		buf = append(buf, b[:4]...)
+		buf = append(buf, path...)
+
+		buf = append(buf, pickleBinFloat)
+		binary.BigEndian.PutUint64(b[:], math.Float64bits(float64(s.Timestamp.Unix())))
+		buf = append(buf, b[:]...)
+		buf = append(buf, pickleBinFloat)
+		binary.BigEndian.PutUint64(b[:], math.Float64bits(float64(s.Value)))
+		buf = append(buf, b[:]...)
+		buf = append(buf, pickleTuple2, pickleTuple2)
+	}
+	buf = append(buf, pickleAppends, pickleStop)
+	binary.BigEndian.PutUint32(buf, uint32(len(buf)-4))
+	return buf
+}
+
+// Name identifies the client as a Graphite client.
+func (c *Client) Name() string {
+	return "graphite"
+}
@@ -0,0 +1,132 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+var testSamples = clientmodel.Samples{
+	{
+		Metric:    clientmodel.Metric{clientmodel.MetricNameLabel: "up", "job": "api"},
+		Value:     1,
+		Timestamp: 1234567890123,
+	},
+	{
+		Metric:    clientmodel.Metric{clientmodel.MetricNameLabel: "up", "job": "db"},
+		Value:     0.5,
+		Timestamp: 1234567891000,
+	},
+}
+
+// receive stores the samples with a client of the protocol and returns what
+// a carbon server received on a single connection.
+func receive(t *testing.T, protocol string) []byte {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan []byte)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			close(received)
+			return
+		}
+		buf, err := ioutil.ReadAll(conn)
+		if err != nil {
+			t.Error(err)
+		}
+		received <- buf
+	}()
+
+	c, err := NewClient(l.Addr().String(), protocol, "prometheus", "{job}.{__name__}", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both batches are sent over the same connection.
+	if err := c.Store(testSamples[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Store(testSamples[1:]); err != nil {
+		t.Fatal(err)
+	}
+	c.mtx.Lock()
+	c.closeConn()
+	c.mtx.Unlock()
+	return <-received
+}
+
+func TestStorePlaintext(t *testing.T) {
+	want := "prometheus.api.up 1 1234567890\nprometheus.db.up 0.5 1234567891\n"
+	if got := string(receive(t, ProtocolPlaintext)); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestStorePickle(t *testing.T) {
+	message := func(path string, ts, value []byte) []byte {
+		b := []byte{0x80, 2, ']', '(', 'X', byte(len(path)), 0, 0, 0}
+		b = append(b, path...)
+		b = append(append(b, 'G'), ts...)
+		b = append(append(b, 'G'), value...)
+		b = append(b, 0x86, 0x86, 'e', '.')
+		return append([]byte{0, 0, 0, byte(len(b))}, b...)
+	}
+	want := append(
+		message("prometheus.api.up",
+			[]byte{0x41, 0xd2, 0x65, 0x80, 0xb4, 0x80, 0x00, 0x00}, // 1234567890.0
+			[]byte{0x3f, 0xf0, 0, 0, 0, 0, 0, 0},                   // 1.0
+		),
+		message("prometheus.db.up",
+			[]byte{0x41, 0xd2, 0x65, 0x80, 0xb4, 0xc0, 0x00, 0x00}, // 1234567891.0
+			[]byte{0x3f, 0xe0, 0, 0, 0, 0, 0, 0},                   // 0.5
+		)...,
+	)
+	if got := receive(t, ProtocolPickle); !bytes.Equal(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+}
+
+func TestStoreUnreachable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	c, err := NewClient(addr, ProtocolPlaintext, "", "", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Store(testSamples); err == nil {
+		t.Error("expected error sending to closed port")
+	}
+	if c.conn != nil {
+		t.Error("expected no connection after failed dial")
+	}
+
+	if _, err := NewClient(addr, "udp", "", "", time.Second); err == nil {
+		t.Error("expected error for invalid protocol")
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+var (
+	illegalCharsRE = regexp.MustCompile(`[^a-zA-Z0-9_\-:]`)
+	labelNameRE    = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// escape makes a label value usable as a single node of a Graphite metric
+// path by replacing all characters but letters, digits, '_', '-', and ':' by
+// '_'.
+func escape(v clientmodel.LabelValue) string {
+	return illegalCharsRE.ReplaceAllString(string(v), "_")
+}
+
+// PathTemplate builds Graphite metric paths from the labels of a metric. A
+// template is a dot-separated path in which "{label}" is replaced by the
+// escaped value of the label, e.g. "prometheus.{job}.{instance}.{__name__}".
+// Nodes that expand to the empty string are left out.
+type PathTemplate struct {
+	// The alternating literal parts and label names, starting and ending
+	// with a literal.
+	literals []string
+	labels   []clientmodel.LabelName
+}
+
+// ParsePathTemplate parses a path template. An empty template is valid and
+// builds paths from the metric name, followed by the names and values of all
+// other labels, sorted by label name.
+func ParsePathTemplate(s string) (*PathTemplate, error) {
+	t := &PathTemplate{}
+	for {
+		begin := strings.IndexAny(s, "{}")
+		if begin < 0 {
+			t.literals = append(t.literals, s)
+			return t, nil
+		}
+		if s[begin] == '}' {
+			return nil, fmt.Errorf("unexpected '}' in path template")
+		}
+		end := strings.IndexByte(s[begin:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated '{' in path template")
+		}
+		name := s[begin+1 : begin+end]
+		if !labelNameRE.MatchString(name) {
+			return nil, fmt.Errorf("invalid label name %q in path template", name)
+		}
+		t.literals = append(t.literals, s[:begin])
+		t.labels = append(t.labels, clientmodel.LabelName(name))
+		s = s[begin+end+1:]
+	}
+}
+
+// Path returns the Graphite metric path of the metric, with prefix prepended
+// as the first nodes.
+func (t *PathTemplate) Path(prefix string, m clientmodel.Metric) string {
+	var buf bytes.Buffer
+	buf.WriteString(prefix)
+	buf.WriteByte('.')
+	if len(t.labels) == 0 && t.literals[0] == "" {
+		buf.WriteString(escape(m[clientmodel.MetricNameLabel]))
+		names := make(clientmodel.LabelNames, 0, len(m))
+		for ln := range m {
+			if ln != clientmodel.MetricNameLabel {
+				names = append(names, ln)
+			}
+		}
+		sort.Sort(names)
+		for _, ln := range names {
+			buf.WriteByte('.')
+			buf.WriteString(escape(clientmodel.LabelValue(ln)))
+			buf.WriteByte('.')
+			buf.WriteString(escape(m[ln]))
+		}
+	} else {
+		for i, ln := range t.labels {
+			buf.WriteString(t.literals[i])
+			buf.WriteString(escape(m[ln]))
+		}
+		buf.WriteString(t.literals[len(t.literals)-1])
+	}
+
+	// Drop empty nodes.
+	nodes := strings.Split(buf.String(), ".")
+	path := nodes[:0]
+	for _, n := range nodes {
+		if n != "" {
+			path = append(path, n)
+		}
+	}
+	return strings.Join(path, ".")
+}
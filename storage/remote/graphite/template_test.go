@@ -0,0 +1,71 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package graphite
+
+import (
+	"testing"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+func TestPathTemplate(t *testing.T) {
+	m := clientmodel.Metric{
+		clientmodel.MetricNameLabel: "http_requests_total",
+		"job":                       "api",
+		"instance":                  "host.example.org:8080",
+		"method":                    "GET",
+	}
+
+	scenarios := []struct {
+		template, prefix, want string
+	}{
+		{
+			template: "",
+			want:     "http_requests_total.instance.host_example_org:8080.job.api.method.GET",
+		},
+		{
+			template: "",
+			prefix:   "prometheus",
+			want:     "prometheus.http_requests_total.instance.host_example_org:8080.job.api.method.GET",
+		},
+		{
+			template: "{job}.{instance}.{__name__}",
+			prefix:   "prometheus.eu",
+			want:     "prometheus.eu.api.host_example_org:8080.http_requests_total",
+		},
+		{
+			template: "{job}.{handler}.{__name__}_by_{method}",
+			want:     "api.http_requests_total_by_GET",
+		},
+		{
+			template: "static.path",
+			want:     "static.path",
+		},
+	}
+	for i, s := range scenarios {
+		tmpl, err := ParsePathTemplate(s.template)
+		if err != nil {
+			t.Fatalf("%d. %s", i, err)
+		}
+		if got := tmpl.Path(s.prefix, m); got != s.want {
+			t.Errorf("%d. got path %q, want %q", i, got, s.want)
+		}
+	}
+
+	for _, invalid := range []string{"{job", "job}", "{job}.{}", "{job-name}", "{job}}"} {
+		if _, err := ParsePathTemplate(invalid); err == nil {
+			t.Errorf("expected error parsing path template %q", invalid)
+		}
+	}
+}
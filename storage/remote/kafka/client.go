@@ -0,0 +1,335 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kafka
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+const (
+	clientID = "prometheus"
+	// Wait for the partition leader to write the messages to its log, but
+	// not for the replicas.
+	requiredAcks int16 = 1
+	// Responses larger than this are treated as corrupt.
+	maxResponseSize = 64 * 1024 * 1024
+)
+
+// Client allows publishing batches of Prometheus samples to a Kafka topic.
+// Each sample is published as a JSON message, keyed by the fingerprint of its
+// metric. Samples of the same series always go to the same partition, chosen
+// by the fingerprint. Message sets are snappy-compressed.
+//
+// Store is goroutine-safe. A failed Store may have published some of the
+// samples, which are published again if the send is retried.
+type Client struct {
+	addrs   []string
+	topic   string
+	timeout time.Duration
+
+	correlationID int32 // Accessed atomically.
+
+	mtx sync.Mutex
+	// The connections to the brokers by address.
+	brokers map[string]*broker
+	// The partitions of the topic, sorted by ID, and their leaders. nil if
+	// the metadata has to be fetched again.
+	partitions []int32
+	leaders    map[int32]*broker
+}
+
+// NewClient creates a new Client publishing to the topic. The metadata of the
+// topic is fetched from the first of the bootstrap brokers that responds.
+func NewClient(addrs []string, topic string, timeout time.Duration) *Client {
+	return &Client{
+		addrs:   addrs,
+		topic:   topic,
+		timeout: timeout,
+		brokers: map[string]*broker{},
+	}
+}
+
+// sampleMessage is the JSON value of a published message.
+type sampleMessage struct {
+	Metric    clientmodel.Metric      `json:"metric"`
+	Value     clientmodel.SampleValue `json:"value"`
+	Timestamp clientmodel.Timestamp   `json:"timestamp"`
+}
+
+// Store publishes a batch of samples to the Kafka topic.
+func (c *Client) Store(samples clientmodel.Samples) error {
+	partitions, leaders, err := c.metadata()
+	if err != nil {
+		return err
+	}
+
+	sets := map[*broker]map[int32][]message{}
+	for _, s := range samples {
+		fp := s.Metric.Fingerprint()
+		value, err := json.Marshal(sampleMessage{
+			Metric:    s.Metric,
+			Value:     s.Value,
+			Timestamp: s.Timestamp,
+		})
+		if err != nil {
+			return err
+		}
+		p := partitions[uint64(fp)%uint64(len(partitions))]
+		b := leaders[p]
+		if sets[b] == nil {
+			sets[b] = map[int32][]message{}
+		}
+		sets[b][p] = append(sets[b][p], message{key: []byte(fp.String()), value: value})
+	}
+
+	for b, set := range sets {
+		if err := c.produce(b, set); err != nil {
+			// The leaders may have moved.
+			c.mtx.Lock()
+			c.partitions, c.leaders = nil, nil
+			c.mtx.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// Name identifies the client as a Kafka client.
+func (c *Client) Name() string {
+	return "kafka"
+}
+
+// metadata returns the partitions of the topic and their leaders, fetching
+// them if necessary.
+func (c *Client) metadata() ([]int32, map[int32]*broker, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.partitions != nil {
+		return c.partitions, c.leaders, nil
+	}
+	var lastErr error
+	for _, addr := range c.addrs {
+		partitions, leaders, err := c.fetchMetadata(c.broker(addr))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		c.partitions, c.leaders = partitions, leaders
+		return partitions, leaders, nil
+	}
+	return nil, nil, fmt.Errorf("error fetching metadata of topic %q: %s", c.topic, lastErr)
+}
+
+// broker returns the broker with the address, creating it if necessary. It
+// has to be called with mtx locked.
+func (c *Client) broker(addr string) *broker {
+	b, ok := c.brokers[addr]
+	if !ok {
+		b = &broker{addr: addr}
+		c.brokers[addr] = b
+	}
+	return b
+}
+
+// fetchMetadata requests the metadata of the topic from the broker. It has to
+// be called with mtx locked.
+func (c *Client) fetchMetadata(b *broker) ([]int32, map[int32]*broker, error) {
+	var e encoder
+	e.putInt32(1)
+	e.putString(c.topic)
+	d, err := b.request(apiKeyMetadata, c.nextCorrelationID(), e.buf, c.timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	addrs := map[int32]string{}
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		id := d.int32()
+		host := d.string()
+		port := d.int32()
+		addrs[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+
+	var partitions []int32
+	leaders := map[int32]*broker{}
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		topicErr := brokerError(d.int16())
+		topic := d.string()
+		for m := d.int32(); m > 0 && d.err == nil; m-- {
+			partitionErr := brokerError(d.int16())
+			id := d.int32()
+			leader := d.int32()
+			d.skipInt32Array() // Replicas.
+			d.skipInt32Array() // In-sync replicas.
+
+			if topic != c.topic {
+				continue
+			}
+			// A partition whose replicas are not all available can
+			// still be written to.
+			if partitionErr != 0 && partitionErr != 9 {
+				return nil, nil, fmt.Errorf("partition %d: %s", id, partitionErr)
+			}
+			addr, ok := addrs[leader]
+			if !ok {
+				return nil, nil, fmt.Errorf("partition %d: unknown leader %d", id, leader)
+			}
+			partitions = append(partitions, id)
+			leaders[id] = c.broker(addr)
+		}
+		if topic == c.topic && topicErr != 0 {
+			return nil, nil, topicErr
+		}
+	}
+	if d.err != nil {
+		return nil, nil, d.err
+	}
+	if len(partitions) == 0 {
+		return nil, nil, fmt.Errorf("no partitions found")
+	}
+	sort.Sort(int32Slice(partitions))
+	return partitions, leaders, nil
+}
+
+// produce publishes the messages to the partitions led by the broker.
+func (c *Client) produce(b *broker, set map[int32][]message) error {
+	var e encoder
+	e.putInt16(requiredAcks)
+	e.putInt32(int32(c.timeout / time.Millisecond))
+	e.putInt32(1)
+	e.putString(c.topic)
+	e.putInt32(int32(len(set)))
+	for p, msgs := range set {
+		ms, err := compressMessageSet(msgs)
+		if err != nil {
+			return err
+		}
+		e.putInt32(p)
+		e.putBytes(ms)
+	}
+
+	d, err := b.request(apiKeyProduce, c.nextCorrelationID(), e.buf, c.timeout)
+	if err != nil {
+		return err
+	}
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		d.string()
+		for m := d.int32(); m > 0 && d.err == nil; m-- {
+			p := d.int32()
+			code := brokerError(d.int16())
+			d.int64() // Offset.
+			if code != 0 && err == nil {
+				err = fmt.Errorf("error producing to partition %d of topic %q: %s", p, c.topic, code)
+			}
+		}
+	}
+	if d.err != nil {
+		return d.err
+	}
+	return err
+}
+
+func (c *Client) nextCorrelationID() int32 {
+	return atomic.AddInt32(&c.correlationID, 1)
+}
+
+// broker is a connection to a Kafka broker, opened on demand. Requests to the
+// same broker are serialized.
+type broker struct {
+	addr string
+
+	mtx  sync.Mutex
+	conn net.Conn
+}
+
+// request sends a request and returns a decoder for the response body after
+// the correlation ID. The connection is closed on any error, so that the next
+// request opens a new one.
+func (b *broker) request(apiKey int16, correlationID int32, body []byte, timeout time.Duration) (*decoder, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	resp, err := b.roundTrip(apiKey, correlationID, body, timeout)
+	if err != nil {
+		if b.conn != nil {
+			b.conn.Close()
+			b.conn = nil
+		}
+		return nil, fmt.Errorf("broker %s: %s", b.addr, err)
+	}
+	return &decoder{buf: resp}, nil
+}
+
+func (b *broker) roundTrip(apiKey int16, correlationID int32, body []byte, timeout time.Duration) ([]byte, error) {
+	if b.conn == nil {
+		conn, err := net.DialTimeout("tcp", b.addr, timeout)
+		if err != nil {
+			return nil, err
+		}
+		b.conn = conn
+	}
+	if err := b.conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	var e encoder
+	e.putInt32(0) // Placeholder for the size.
+	e.putInt16(apiKey)
+	e.putInt16(apiVersion)
+	e.putInt32(correlationID)
+	e.putString(clientID)
+	e.buf = append(e.buf, body...)
+	size := len(e.buf) - 4
+	e.buf[0], e.buf[1], e.buf[2], e.buf[3] = byte(size>>24), byte(size>>16), byte(size>>8), byte(size)
+	if _, err := b.conn.Write(e.buf); err != nil {
+		return nil, err
+	}
+
+	sizeBuf := make([]byte, 4)
+	if _, err := io.ReadFull(b.conn, sizeBuf); err != nil {
+		return nil, err
+	}
+	d := decoder{buf: sizeBuf}
+	respSize := d.int32()
+	if respSize < 4 || respSize > maxResponseSize {
+		return nil, fmt.Errorf("invalid response size %d", respSize)
+	}
+	resp := make([]byte, respSize)
+	if _, err := io.ReadFull(b.conn, resp); err != nil {
+		return nil, err
+	}
+	d = decoder{buf: resp}
+	if id := d.int32(); id != correlationID {
+		return nil, fmt.Errorf("got response with correlation ID %d, want %d", id, correlationID)
+	}
+	return d.buf, nil
+}
+
+// int32Slice implements sort.Interface.
+type int32Slice []int32
+
+func (s int32Slice) Len() int           { return len(s) }
+func (s int32Slice) Less(i, j int) bool { return s[i] < s[j] }
+func (s int32Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,281 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kafka
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/syndtr/gosnappy/snappy"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+// fakeBroker is a single Kafka broker leading all partitions of a topic. It
+// records the decoded messages it receives by partition.
+type fakeBroker struct {
+	t          *testing.T
+	listener   net.Listener
+	topic      string
+	partitions int32
+	// The error code to return for produce requests.
+	produceErr int16
+
+	mtx      sync.Mutex
+	received map[int32][]decodedMessage
+}
+
+func newFakeBroker(t *testing.T, topic string, partitions int32) *fakeBroker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{
+		t:          t,
+		listener:   l,
+		topic:      topic,
+		partitions: partitions,
+		received:   map[int32][]decodedMessage{},
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *fakeBroker) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		sizeBuf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, sizeBuf); err != nil {
+			return
+		}
+		req := make([]byte, binary.BigEndian.Uint32(sizeBuf))
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return
+		}
+		d := &decoder{buf: req}
+		apiKey := d.int16()
+		if version := d.int16(); version != apiVersion {
+			b.t.Errorf("got API version %d", version)
+		}
+		correlationID := d.int32()
+		if id := d.string(); id != clientID {
+			b.t.Errorf("got client ID %q", id)
+		}
+
+		var e encoder
+		e.putInt32(0) // Placeholder for the size.
+		e.putInt32(correlationID)
+		switch apiKey {
+		case apiKeyMetadata:
+			b.writeMetadata(&e)
+		case apiKeyProduce:
+			b.handleProduce(d, &e)
+		default:
+			b.t.Errorf("unexpected API key %d", apiKey)
+			return
+		}
+		binary.BigEndian.PutUint32(e.buf, uint32(len(e.buf)-4))
+		if _, err := conn.Write(e.buf); err != nil {
+			return
+		}
+	}
+}
+
+func (b *fakeBroker) writeMetadata(e *encoder) {
+	host, port, _ := net.SplitHostPort(b.listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	e.putInt32(1)
+	e.putInt32(42)
+	e.putString(host)
+	e.putInt32(int32(portNum))
+
+	e.putInt32(1)
+	e.putInt16(0)
+	e.putString(b.topic)
+	e.putInt32(b.partitions)
+	// Report the partitions in reverse order.
+	for p := b.partitions - 1; p >= 0; p-- {
+		e.putInt16(0)
+		e.putInt32(p)
+		e.putInt32(42)
+		e.putInt32(1)
+		e.putInt32(42)
+		e.putInt32(1)
+		e.putInt32(42)
+	}
+}
+
+func (b *fakeBroker) handleProduce(d *decoder, e *encoder) {
+	if acks := d.int16(); acks != requiredAcks {
+		b.t.Errorf("got required acks %d", acks)
+	}
+	d.int32() // Timeout.
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	e.putInt32(d.int32())
+	topic := d.string()
+	e.putString(topic)
+	n := d.int32()
+	e.putInt32(n)
+	for ; n > 0; n-- {
+		p := d.int32()
+		for _, outer := range decodeMessageSet(b.t, d.bytes()) {
+			if outer.attributes != compressionSnappy {
+				b.t.Errorf("got uncompressed message set")
+			}
+			b.received[p] = append(b.received[p], decodeMessageSet(b.t, xerialDecode(b.t, outer.value))...)
+		}
+		e.putInt32(p)
+		e.putInt16(b.produceErr)
+		e.putInt64(0)
+	}
+	if d.err != nil {
+		b.t.Error(d.err)
+	}
+}
+
+type decodedMessage struct {
+	message
+	attributes int8
+}
+
+func decodeMessageSet(t *testing.T, buf []byte) []decodedMessage {
+	var msgs []decodedMessage
+	d := &decoder{buf: buf}
+	for i := int64(0); len(d.buf) > 0; i++ {
+		if offset := d.int64(); offset != i {
+			t.Errorf("got offset %d, want %d", offset, i)
+		}
+		md := &decoder{buf: d.bytes()}
+		if crc := uint32(md.int32()); crc != crc32.ChecksumIEEE(md.buf) {
+			t.Errorf("got CRC %x, want %x", crc, crc32.ChecksumIEEE(md.buf))
+		}
+		md.int8() // Magic byte.
+		m := decodedMessage{attributes: md.int8()}
+		m.key = md.bytes()
+		m.value = md.bytes()
+		if md.err != nil {
+			t.Error(md.err)
+		}
+		msgs = append(msgs, m)
+	}
+	if d.err != nil {
+		t.Error(d.err)
+	}
+	return msgs
+}
+
+func xerialDecode(t *testing.T, buf []byte) []byte {
+	if !bytes.HasPrefix(buf, xerialHeader) {
+		t.Fatalf("missing xerial header")
+	}
+	d := &decoder{buf: buf[len(xerialHeader):]}
+	var result []byte
+	for len(d.buf) > 0 {
+		block, err := snappy.Decode(nil, d.bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		result = append(result, block...)
+	}
+	return result
+}
+
+func TestStore(t *testing.T) {
+	b := newFakeBroker(t, "samples", 3)
+	defer b.listener.Close()
+
+	var samples clientmodel.Samples
+	for i := 0; i < 100; i++ {
+		samples = append(samples, &clientmodel.Sample{
+			Metric: clientmodel.Metric{
+				clientmodel.MetricNameLabel: "test_metric",
+				"series":                    clientmodel.LabelValue(strconv.Itoa(i % 7)),
+			},
+			Value:     clientmodel.SampleValue(i),
+			Timestamp: clientmodel.Timestamp(1000 * i),
+		})
+	}
+
+	c := NewClient([]string{"127.0.0.1:1", b.listener.Addr().String()}, "samples", time.Minute)
+	if err := c.Store(samples); err != nil {
+		t.Fatal(err)
+	}
+
+	type jsonSample struct {
+		Metric    clientmodel.Metric `json:"metric"`
+		Value     string             `json:"value"`
+		Timestamp float64            `json:"timestamp"`
+	}
+	partitionOf := map[string]int32{}
+	values := map[string][]jsonSample{}
+	for p, msgs := range b.received {
+		for _, m := range msgs {
+			var s jsonSample
+			if err := json.Unmarshal(m.value, &s); err != nil {
+				t.Fatal(err)
+			}
+			key := string(m.key)
+			if key != s.Metric.Fingerprint().String() {
+				t.Errorf("got key %s for metric %v", key, s.Metric)
+			}
+			if prev, ok := partitionOf[key]; ok && prev != p {
+				t.Errorf("series %v published to partitions %d and %d", s.Metric, prev, p)
+			}
+			partitionOf[key] = p
+			values[key] = append(values[key], s)
+		}
+	}
+	if len(values) != 7 {
+		t.Fatalf("got %d series, want 7", len(values))
+	}
+	for _, s := range samples[:7] {
+		got := values[s.Metric.Fingerprint().String()]
+		if len(got) != 15 && len(got) != 14 {
+			t.Errorf("got %d samples of %v", len(got), s.Metric)
+			continue
+		}
+		// Samples of a series are published in order.
+		want := jsonSample{Metric: s.Metric, Value: s.Value.String(), Timestamp: float64(s.Timestamp) / 1000}
+		if !got[0].Metric.Equal(want.Metric) || got[0].Value != want.Value || got[0].Timestamp != want.Timestamp {
+			t.Errorf("got first sample %v, want %v", got[0], want)
+		}
+	}
+
+	b.produceErr = 6
+	if err := c.Store(samples); err == nil {
+		t.Error("expected error for NOT_LEADER_FOR_PARTITION")
+	}
+	if c.partitions != nil {
+		t.Error("metadata not invalidated after produce error")
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kafka
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/syndtr/gosnappy/snappy"
+)
+
+// This file implements the subset of version 0 of the Kafka wire protocol
+// needed to look up the partition leaders of a topic and to produce messages
+// to them. See https://kafka.apache.org/protocol.html for the protocol.
+
+const (
+	apiKeyProduce  int16 = 0
+	apiKeyMetadata int16 = 3
+	apiVersion     int16 = 0
+
+	// The attributes of a message whose value is a snappy-compressed
+	// message set.
+	compressionSnappy int8 = 2
+
+	// The uncompressed size of the blocks in the xerial snappy framing.
+	xerialBlockSize = 32 * 1024
+)
+
+// xerialHeader starts a snappy-compressed message set. Kafka expects the
+// framing of the xerial snappy-java library, followed by length-prefixed
+// snappy blocks.
+var xerialHeader = []byte{0x82, 'S', 'N', 'A', 'P', 'P', 'Y', 0, 0, 0, 0, 1, 0, 0, 0, 1}
+
+var errShortBuffer = errors.New("response truncated")
+
+// brokerError is an error code returned by a Kafka broker.
+type brokerError int16
+
+// brokerErrorNames are the names of the error codes most likely to be
+// returned by brokers.
+var brokerErrorNames = map[brokerError]string{
+	1:  "OFFSET_OUT_OF_RANGE",
+	2:  "CORRUPT_MESSAGE",
+	3:  "UNKNOWN_TOPIC_OR_PARTITION",
+	5:  "LEADER_NOT_AVAILABLE",
+	6:  "NOT_LEADER_FOR_PARTITION",
+	7:  "REQUEST_TIMED_OUT",
+	9:  "REPLICA_NOT_AVAILABLE",
+	10: "MESSAGE_TOO_LARGE",
+}
+
+func (e brokerError) Error() string {
+	if name, ok := brokerErrorNames[e]; ok {
+		return fmt.Sprintf("broker returned error %s", name)
+	}
+	return fmt.Sprintf("broker returned error code %d", int16(e))
+}
+
+// encoder appends big-endian protocol primitives to a buffer.
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) putInt8(v int8) {
+	e.buf = append(e.buf, byte(v))
+}
+
+func (e *encoder) putInt16(v int16) {
+	e.buf = append(e.buf, byte(v>>8), byte(v))
+}
+
+func (e *encoder) putInt32(v int32) {
+	e.buf = append(e.buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (e *encoder) putInt64(v int64) {
+	e.putInt32(int32(v >> 32))
+	e.putInt32(int32(v))
+}
+
+func (e *encoder) putString(s string) {
+	e.putInt16(int16(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+// putBytes encodes nil as a null byte array.
+func (e *encoder) putBytes(b []byte) {
+	if b == nil {
+		e.putInt32(-1)
+		return
+	}
+	e.putInt32(int32(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// decoder consumes big-endian protocol primitives from a buffer. After the
+// buffer is exhausted, all methods return zero values and err is set.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.buf) < n {
+		d.err = errShortBuffer
+		d.buf = nil
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) int8() int8 {
+	if b := d.next(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *decoder) int16() int16 {
+	if b := d.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *decoder) int32() int32 {
+	if b := d.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *decoder) int64() int64 {
+	if b := d.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *decoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+// bytes returns nil for a null byte array.
+func (d *decoder) bytes() []byte {
+	n := d.int32()
+	if n < 0 {
+		return nil
+	}
+	return d.next(int(n))
+}
+
+// skipInt32Array skips an array of int32 values.
+func (d *decoder) skipInt32Array() {
+	n := d.int32()
+	d.next(4 * int(n))
+}
+
+// message is a Kafka message. A nil key or value is encoded as null.
+type message struct {
+	key, value []byte
+}
+
+// encodeMessageSet encodes the messages as a message set with consecutive
+// offsets starting at 0, as required for the inner messages of a compressed
+// message. The broker assigns the actual offsets.
+func encodeMessageSet(msgs []message, attributes int8) []byte {
+	var e encoder
+	for i, m := range msgs {
+		var me encoder
+		me.putInt32(0) // Placeholder for the CRC.
+		me.putInt8(0)  // Magic byte.
+		me.putInt8(attributes)
+		me.putBytes(m.key)
+		me.putBytes(m.value)
+		binary.BigEndian.PutUint32(me.buf, crc32.ChecksumIEEE(me.buf[4:]))
+
+		e.putInt64(int64(i))
+		e.putBytes(me.buf)
+	}
+	return e.buf
+}
+
+// compressMessageSet returns a message set consisting of a single message
+// whose value is the snappy-compressed message set of the messages.
+func compressMessageSet(msgs []message) ([]byte, error) {
+	compressed, err := xerialEncode(encodeMessageSet(msgs, 0))
+	if err != nil {
+		return nil, err
+	}
+	return encodeMessageSet([]message{{value: compressed}}, compressionSnappy), nil
+}
+
+// xerialEncode snappy-compresses src in the xerial framing.
+func xerialEncode(src []byte) ([]byte, error) {
+	buf := append([]byte(nil), xerialHeader...)
+	for len(src) > 0 {
+		n := len(src)
+		if n > xerialBlockSize {
+			n = xerialBlockSize
+		}
+		block, err := snappy.Encode(nil, src[:n])
+		if err != nil {
+			return nil, err
+		}
+		var e encoder
+		e.putInt32(int32(len(block)))
+		buf = append(append(buf, e.buf...), block...)
+		src = src[n:]
+	}
+	return buf, nil
+}
@@ -14,22 +14,45 @@
 package remote
 
 import (
+	"math"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
 
 	clientmodel "github.com/prometheus/client_golang/model"
 	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/relabel"
 )
 
 const (
-	// The maximum number of concurrent send requests to the remote storage.
-	maxConcurrentSends = 10
+	// The minimum and maximum number of shards sending samples to the remote
+	// storage in parallel. Each shard has at most one send request in
+	// flight.
+	minShards = 1
+	maxShards = 100
+	// The interval at which the number of shards is adjusted to the rate of
+	// incoming samples and the observed send latency.
+	shardUpdateDuration = 10 * time.Second
+	// The number of shards is only changed if the desired number deviates
+	// by more than this fraction from the current one, to avoid resharding
+	// all the time.
+	shardToleranceFraction = 0.3
+	// The smoothing factor for the sample and send duration rates.
+	ewmaWeight = 0.2
 	// The maximum number of samples to fit into a single request to the remote storage.
 	maxSamplesPerSend = 100
 	// The deadline after which to send queued samples even if the maximum batch
 	// size has not been reached.
 	batchSendDeadline = 5 * time.Second
+	// The maximum number of times a failed send request is retried before
+	// its samples are dropped.
+	maxRetries = 3
+	// The delay before the first retry of a failed send request. It doubles
+	// with each further retry.
+	initialRetryBackoff = time.Second
 )
 
 // String constants for instrumentation.
@@ -53,32 +76,59 @@ type StorageClient interface {
 }
 
 // StorageQueueManager manages a queue of samples to be sent to the Storage
-// indicated by the provided StorageClient.
+// indicated by the provided StorageClient. The queue is split into shards,
+// each sending its samples in batches. The number of shards adapts to the rate
+// of incoming samples and the time it takes to send them, so that a slow
+// remote storage gets more parallel requests instead of making the queue fill
+// up. Samples of the same series always go to the same shard, so they are sent
+// in order, except around a change of the number of shards.
 type StorageQueueManager struct {
-	tsdb           StorageClient
-	queue          chan *clientmodel.Sample
-	pendingSamples clientmodel.Samples
-	sendSemaphore  chan bool
-	drained        chan bool
+	tsdb         StorageClient
+	capacity     int
+	retryBackoff time.Duration
+
+	relabelMtx     sync.RWMutex
+	relabelConfigs []*config.RelabelConfig
+
+	// The shards currently receiving appended samples. Only replaced by
+	// Run, under the write lock.
+	shardsMtx sync.RWMutex
+	shards    *shards
+
+	quit chan struct{}
+	done chan struct{}
+
+	samplesIn          *ewmaRate
+	samplesOut         *ewmaRate
+	samplesOutDuration *ewmaRate
 
 	samplesCount  *prometheus.CounterVec
 	sendLatency   prometheus.Summary
 	sendErrors    prometheus.Counter
 	queueLength   prometheus.Gauge
 	queueCapacity prometheus.Metric
+	numShards     prometheus.Gauge
+	desiredShards prometheus.Gauge
 }
 
-// NewStorageQueueManager builds a new StorageQueueManager.
+// NewStorageQueueManager builds a new StorageQueueManager. The queue capacity
+// is split evenly across all shards.
 func NewStorageQueueManager(tsdb StorageClient, queueCapacity int) *StorageQueueManager {
 	constLabels := prometheus.Labels{
 		"type": tsdb.Name(),
 	}
 
-	return &StorageQueueManager{
-		tsdb:          tsdb,
-		queue:         make(chan *clientmodel.Sample, queueCapacity),
-		sendSemaphore: make(chan bool, maxConcurrentSends),
-		drained:       make(chan bool),
+	t := &StorageQueueManager{
+		tsdb:         tsdb,
+		capacity:     queueCapacity,
+		retryBackoff: initialRetryBackoff,
+
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+
+		samplesIn:          newEWMARate(ewmaWeight, shardUpdateDuration),
+		samplesOut:         newEWMARate(ewmaWeight, shardUpdateDuration),
+		samplesOutDuration: newEWMARate(ewmaWeight, shardUpdateDuration),
 
 		samplesCount: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
@@ -101,7 +151,7 @@ func NewStorageQueueManager(tsdb StorageClient, queueCapacity int) *StorageQueue
 			Namespace:   namespace,
 			Subsystem:   subsystem,
 			Name:        "sent_errors_total",
-			Help:        "Total number of errors sending sample batches to the remote storage.",
+			Help:        "Total number of errors sending sample batches to the remote storage, including errors of retried sends.",
 			ConstLabels: constLabels,
 		}),
 		queueLength: prometheus.NewGauge(prometheus.GaugeOpts{
@@ -121,30 +171,75 @@ func NewStorageQueueManager(tsdb StorageClient, queueCapacity int) *StorageQueue
 			prometheus.GaugeValue,
 			float64(queueCapacity),
 		),
+		numShards: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			Name:        "shards",
+			Help:        "The number of shards sending samples to the remote storage in parallel.",
+			ConstLabels: constLabels,
+		}),
+		desiredShards: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			Name:        "shards_desired",
+			Help:        "The number of shards the observed sample rate and send latency call for, before rounding and limiting.",
+			ConstLabels: constLabels,
+		}),
 	}
+	t.shards = t.newShards(minShards)
+	t.numShards.Set(minShards)
+	return t
 }
 
-// Append queues a sample to be sent to the remote storage. It drops the
-// sample on the floor if the queue is full. It implements
-// storage.SampleAppender.
+// Name identifies the remote storage the samples are sent to.
+func (t *StorageQueueManager) Name() string {
+	return t.tsdb.Name()
+}
+
+// SetRelabelConfigs sets the relabel configurations applied to the metric of
+// each appended sample before it is queued. It is goroutine-safe.
+func (t *StorageQueueManager) SetRelabelConfigs(rcs []*config.RelabelConfig) {
+	t.relabelMtx.Lock()
+	defer t.relabelMtx.Unlock()
+	t.relabelConfigs = rcs
+}
+
+// Append queues a sample to be sent to the remote storage. Samples of series
+// dropped by relabeling are discarded. It drops the sample on the floor if the
+// queue of its shard is full. It implements storage.SampleAppender.
 func (t *StorageQueueManager) Append(s *clientmodel.Sample) {
-	select {
-	case t.queue <- s:
-	default:
+	t.relabelMtx.RLock()
+	rcs := t.relabelConfigs
+	t.relabelMtx.RUnlock()
+
+	if len(rcs) > 0 {
+		m := relabel.Relabel(s.Metric, rcs)
+		if m == nil {
+			return
+		}
+		s = &clientmodel.Sample{
+			Metric:    m,
+			Value:     s.Value,
+			Timestamp: s.Timestamp,
+		}
+	}
+
+	t.samplesIn.incr(1)
+	t.shardsMtx.RLock()
+	ok := t.shards.enqueue(s)
+	t.shardsMtx.RUnlock()
+	if !ok {
 		t.samplesCount.WithLabelValues(dropped).Inc()
 		glog.Warning("Remote storage queue full, discarding sample.")
 	}
 }
 
-// Stop stops sending samples to the remote storage and waits for pending
-// sends to complete.
+// Stop stops sending samples to the remote storage and waits for the queued
+// samples to be sent. No samples must be appended after calling Stop.
 func (t *StorageQueueManager) Stop() {
 	glog.Infof("Stopping remote storage...")
-	close(t.queue)
-	<-t.drained
-	for i := 0; i < maxConcurrentSends; i++ {
-		t.sendSemaphore <- true
-	}
+	close(t.quit)
+	<-t.done
 	glog.Info("Remote storage stopped.")
 }
 
@@ -152,77 +247,226 @@ func (t *StorageQueueManager) Stop() {
 func (t *StorageQueueManager) Describe(ch chan<- *prometheus.Desc) {
 	t.samplesCount.Describe(ch)
 	t.sendLatency.Describe(ch)
+	t.sendErrors.Describe(ch)
 	ch <- t.queueLength.Desc()
 	ch <- t.queueCapacity.Desc()
+	ch <- t.numShards.Desc()
+	ch <- t.desiredShards.Desc()
 }
 
 // Collect implements prometheus.Collector.
 func (t *StorageQueueManager) Collect(ch chan<- prometheus.Metric) {
 	t.samplesCount.Collect(ch)
 	t.sendLatency.Collect(ch)
-	t.queueLength.Set(float64(len(t.queue)))
+	t.sendErrors.Collect(ch)
+	t.queueLength.Set(float64(t.queueLen()))
 	ch <- t.queueLength
 	ch <- t.queueCapacity
+	ch <- t.numShards
+	ch <- t.desiredShards
+}
+
+// queueLen returns the number of samples queued in the current shards.
+func (t *StorageQueueManager) queueLen() int {
+	t.shardsMtx.RLock()
+	defer t.shardsMtx.RUnlock()
+	return t.shards.len()
 }
 
 func (t *StorageQueueManager) sendSamples(s clientmodel.Samples) {
-	t.sendSemaphore <- true
-	defer func() {
-		<-t.sendSemaphore
-	}()
-
-	// Samples are sent to the remote storage on a best-effort basis. If a
-	// sample isn't sent correctly the first time, it's simply dropped on the
-	// floor.
-	begin := time.Now()
-	err := t.tsdb.Store(s)
-	duration := time.Since(begin) / time.Millisecond
-
-	labelValue := success
-	if err != nil {
-		glog.Warningf("error sending %d samples to remote storage: %s", len(s), err)
-		labelValue = failure
+	// Samples are sent to the remote storage on a best-effort basis. A
+	// failed send is retried up to maxRetries times with exponential
+	// backoff, while blocking its shard. After that, the samples are
+	// dropped on the floor.
+	backoff := t.retryBackoff
+	for try := 0; ; try++ {
+		begin := time.Now()
+		err := t.tsdb.Store(s)
+		duration := time.Since(begin)
+		t.sendLatency.Observe(float64(duration / time.Millisecond))
+
+		if err == nil {
+			t.samplesCount.WithLabelValues(success).Add(float64(len(s)))
+			t.samplesOut.incr(int64(len(s)))
+			t.samplesOutDuration.incr(int64(duration))
+			return
+		}
 		t.sendErrors.Inc()
+		if try == maxRetries {
+			glog.Warningf("error sending %d samples to remote storage, dropping them after %d retries: %s", len(s), maxRetries, err)
+			t.samplesCount.WithLabelValues(failure).Add(float64(len(s)))
+			return
+		}
+		glog.Warningf("error sending %d samples to remote storage, retrying in %v: %s", len(s), backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
 	}
-	t.samplesCount.WithLabelValues(labelValue).Add(float64(len(s)))
-	t.sendLatency.Observe(float64(duration))
 }
 
-// Run continuously sends samples to the remote storage.
+// Run continuously sends samples to the remote storage and adjusts the number
+// of shards until Stop is called.
 func (t *StorageQueueManager) Run() {
-	defer func() {
-		close(t.drained)
-	}()
+	defer close(t.done)
+
+	t.shards.start()
+	ticker := time.NewTicker(shardUpdateDuration)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if n := t.calculateDesiredShards(); n != len(t.shards.queues) {
+				t.reshard(n)
+			}
+		case <-t.quit:
+			glog.Infof("Flushing %d samples to remote storage...", t.queueLen())
+			t.shards.stop()
+			glog.Infof("Done flushing.")
+			return
+		}
+	}
+}
 
-	// Send batches of at most maxSamplesPerSend samples to the remote storage.
-	// If we have fewer samples than that, flush them out after a deadline
-	// anyways.
+// calculateDesiredShards updates the sample and send duration rates and
+// returns the number of shards needed to keep up with the incoming samples and
+// to work off the queued ones within the next update interval.
+func (t *StorageQueueManager) calculateDesiredShards() int {
+	t.samplesIn.tick()
+	t.samplesOut.tick()
+	t.samplesOutDuration.tick()
+
+	current := len(t.shards.queues)
+	samplesOutRate := t.samplesOut.rate()
+	if samplesOutRate == 0 {
+		// Nothing was sent successfully recently, so the send latency
+		// is unknown.
+		return current
+	}
+	// The time in seconds a single shard needs to send a sample.
+	timePerSample := t.samplesOutDuration.rate() / samplesOutRate / float64(time.Second)
+	backlogRate := float64(t.queueLen()) / shardUpdateDuration.Seconds()
+	desired := timePerSample * (t.samplesIn.rate() + backlogRate)
+	t.desiredShards.Set(desired)
+
+	lowerBound := float64(current) * (1 - shardToleranceFraction)
+	upperBound := float64(current) * (1 + shardToleranceFraction)
+	if lowerBound <= desired && desired <= upperBound {
+		return current
+	}
+	n := int(math.Ceil(desired))
+	if n < minShards {
+		n = minShards
+	}
+	if n > maxShards {
+		n = maxShards
+	}
+	return n
+}
+
+// reshard replaces the current shards by n new ones and waits for the samples
+// queued in the old shards to be sent. Samples can be appended all the while.
+func (t *StorageQueueManager) reshard(n int) {
+	glog.Infof("Resharding remote storage queue from %d to %d shards.", len(t.shards.queues), n)
+	newShards := t.newShards(n)
+	newShards.start()
+
+	t.shardsMtx.Lock()
+	oldShards := t.shards
+	t.shards = newShards
+	t.shardsMtx.Unlock()
+
+	t.numShards.Set(float64(n))
+	oldShards.stop()
+}
+
+// shards is a fixed number of queues, each sending its samples to the remote
+// storage in its own goroutine.
+type shards struct {
+	qm     *StorageQueueManager
+	queues []chan *clientmodel.Sample
+	wg     sync.WaitGroup
+}
+
+// newShards creates n shards with queues sharing the queue capacity. They do
+// not send samples before start is called.
+func (t *StorageQueueManager) newShards(n int) *shards {
+	capacity := t.capacity / n
+	if capacity < 1 {
+		capacity = 1
+	}
+	s := &shards{
+		qm:     t,
+		queues: make([]chan *clientmodel.Sample, n),
+	}
+	for i := range s.queues {
+		s.queues[i] = make(chan *clientmodel.Sample, capacity)
+	}
+	return s
+}
+
+// start starts sending the queued samples.
+func (s *shards) start() {
+	s.wg.Add(len(s.queues))
+	for _, q := range s.queues {
+		go s.runShard(q)
+	}
+}
+
+// stop closes the queues and waits for the queued samples to be sent.
+func (s *shards) stop() {
+	for _, q := range s.queues {
+		close(q)
+	}
+	s.wg.Wait()
+}
+
+// enqueue queues the sample in the shard of its series. It returns false if
+// the queue of the shard is full.
+func (s *shards) enqueue(sample *clientmodel.Sample) bool {
+	q := s.queues[uint64(sample.Metric.Fingerprint())%uint64(len(s.queues))]
+	select {
+	case q <- sample:
+		return true
+	default:
+		return false
+	}
+}
+
+// len returns the number of queued samples.
+func (s *shards) len() int {
+	n := 0
+	for _, q := range s.queues {
+		n += len(q)
+	}
+	return n
+}
+
+// runShard sends batches of at most maxSamplesPerSend samples from the queue
+// to the remote storage until the queue is closed. If there are fewer samples
+// than that, they are flushed out after a deadline anyways.
+func (s *shards) runShard(queue chan *clientmodel.Sample) {
+	defer s.wg.Done()
+
+	pendingSamples := make(clientmodel.Samples, 0, maxSamplesPerSend)
 	for {
 		select {
-		case s, ok := <-t.queue:
+		case sample, ok := <-queue:
 			if !ok {
-				glog.Infof("Flushing %d samples to remote storage...", len(t.pendingSamples))
-				t.flush()
-				glog.Infof("Done flushing.")
+				if len(pendingSamples) > 0 {
+					s.qm.sendSamples(pendingSamples)
+				}
 				return
 			}
 
-			t.pendingSamples = append(t.pendingSamples, s)
-
-			for len(t.pendingSamples) >= maxSamplesPerSend {
-				go t.sendSamples(t.pendingSamples[:maxSamplesPerSend])
-				t.pendingSamples = t.pendingSamples[maxSamplesPerSend:]
+			pendingSamples = append(pendingSamples, sample)
+			if len(pendingSamples) >= maxSamplesPerSend {
+				s.qm.sendSamples(pendingSamples)
+				pendingSamples = pendingSamples[:0]
 			}
 		case <-time.After(batchSendDeadline):
-			t.flush()
+			if len(pendingSamples) > 0 {
+				s.qm.sendSamples(pendingSamples)
+				pendingSamples = pendingSamples[:0]
+			}
 		}
 	}
 }
-
-// Flush flushes remaining queued samples.
-func (t *StorageQueueManager) flush() {
-	if len(t.pendingSamples) > 0 {
-		go t.sendSamples(t.pendingSamples)
-	}
-	t.pendingSamples = t.pendingSamples[:0]
-}
@@ -14,10 +14,15 @@
 package remote
 
 import (
+	"errors"
+	"fmt"
 	"sync"
 	"testing"
+	"time"
 
 	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/config"
 )
 
 type TestStorageClient struct {
@@ -82,3 +87,177 @@ func TestSampleDelivery(t *testing.T) {
 
 	c.waitForExpectedSamples(t)
 }
+
+// FailingStorageClient fails the first failures calls of Store.
+type FailingStorageClient struct {
+	TestStorageClient
+	mtx      sync.Mutex
+	failures int
+}
+
+func (c *FailingStorageClient) Store(s clientmodel.Samples) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.failures > 0 {
+		c.failures--
+		return errors.New("remote storage unavailable")
+	}
+	return c.TestStorageClient.Store(s)
+}
+
+func TestSampleDeliveryRetries(t *testing.T) {
+	samples := make(clientmodel.Samples, 0, maxSamplesPerSend)
+	for i := 0; i < maxSamplesPerSend; i++ {
+		samples = append(samples, &clientmodel.Sample{
+			Metric: clientmodel.Metric{
+				clientmodel.MetricNameLabel: "test_metric",
+			},
+			Value: clientmodel.SampleValue(i),
+		})
+	}
+
+	c := &FailingStorageClient{failures: maxRetries}
+	c.expectSamples(samples)
+	m := NewStorageQueueManager(c, len(samples))
+	m.retryBackoff = time.Millisecond
+
+	for _, s := range samples {
+		m.Append(s)
+	}
+	go m.Run()
+	defer m.Stop()
+
+	c.waitForExpectedSamples(t)
+	if c.failures != 0 {
+		t.Errorf("expected all %d failures to be retried, %d left", maxRetries, c.failures)
+	}
+}
+
+// CountingStorageClient counts the received samples by metric and takes
+// sendDuration for each call of Store. It is goroutine-safe.
+type CountingStorageClient struct {
+	mtx          sync.Mutex
+	received     map[string]int
+	sendDuration time.Duration
+}
+
+func (c *CountingStorageClient) Store(s clientmodel.Samples) error {
+	time.Sleep(c.sendDuration)
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, sample := range s {
+		c.received[sample.Metric.String()]++
+	}
+	return nil
+}
+
+func (c *CountingStorageClient) Name() string {
+	return "countingstorageclient"
+}
+
+func TestReshard(t *testing.T) {
+	c := &CountingStorageClient{received: map[string]int{}}
+	m := NewStorageQueueManager(c, 1000)
+	// Drive the shards directly, as Run would reshard concurrently.
+	m.shards.start()
+
+	appendSamples := func(n int) {
+		for i := 0; i < n; i++ {
+			m.Append(&clientmodel.Sample{
+				Metric: clientmodel.Metric{
+					clientmodel.MetricNameLabel: "test_metric",
+					"series":                    clientmodel.LabelValue(fmt.Sprint(i % 10)),
+				},
+				Value: clientmodel.SampleValue(i),
+			})
+		}
+	}
+	appendSamples(200)
+	m.reshard(4)
+	if got := len(m.shards.queues); got != 4 {
+		t.Fatalf("got %d shards, want 4", got)
+	}
+	appendSamples(200)
+	m.shards.stop()
+
+	if len(c.received) != 10 {
+		t.Fatalf("got %d series, want 10", len(c.received))
+	}
+	for metric, n := range c.received {
+		if n != 40 {
+			t.Errorf("got %d samples of %s, want 40", n, metric)
+		}
+	}
+}
+
+func TestCalculateDesiredShards(t *testing.T) {
+	m := NewStorageQueueManager(&TestStorageClient{}, 1000)
+
+	scenarios := []struct {
+		samplesIn, samplesOut int64
+		sendDuration          time.Duration
+		want                  int
+	}{
+		// Nothing sent yet.
+		{samplesIn: 1000, want: 1},
+		// 10ms per sample, 10 samples/s: 0.1 shards.
+		{samplesIn: 100, samplesOut: 100, sendDuration: time.Second, want: 1},
+		// 10ms per sample, 1000 samples/s: 10 shards.
+		{samplesIn: 10000, samplesOut: 100, sendDuration: time.Second, want: 10},
+		// Limited to maxShards.
+		{samplesIn: 1000000, samplesOut: 100, sendDuration: time.Second, want: maxShards},
+	}
+	for i, s := range scenarios {
+		// Reset the rates so that each scenario starts from scratch.
+		m.samplesIn = newEWMARate(ewmaWeight, shardUpdateDuration)
+		m.samplesOut = newEWMARate(ewmaWeight, shardUpdateDuration)
+		m.samplesOutDuration = newEWMARate(ewmaWeight, shardUpdateDuration)
+
+		m.samplesIn.incr(s.samplesIn)
+		m.samplesOut.incr(s.samplesOut)
+		m.samplesOutDuration.incr(int64(s.sendDuration))
+		if got := m.calculateDesiredShards(); got != s.want {
+			t.Errorf("%d. got %d desired shards, want %d", i, got, s.want)
+		}
+	}
+}
+
+func relabelConfigs(t *testing.T, rules string) []*config.RelabelConfig {
+	conf, err := config.LoadFromString(`
+		global <
+			scrape_interval: "30s"
+			evaluation_interval: "30s"
+		>
+		remote_write <
+			type: "generic"
+			` + rules + `
+		>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conf.RemoteWriteRelabelConfigs("generic")
+}
+
+func TestAppendRelabeled(t *testing.T) {
+	c := &TestStorageClient{}
+	m := NewStorageQueueManager(c, 10)
+	m.SetRelabelConfigs(relabelConfigs(t, `
+		write_relabel_config < source_label: "__name__" regex: "go_.*" action: DROP >
+		write_relabel_config < source_label: "__name__" regex: ".*" target_label: "source" replacement: "prometheus" >`))
+
+	up := clientmodel.Metric{clientmodel.MetricNameLabel: "up"}
+	m.Append(&clientmodel.Sample{Metric: clientmodel.Metric{clientmodel.MetricNameLabel: "go_goroutines"}, Value: 10})
+	m.Append(&clientmodel.Sample{Metric: up, Value: 1})
+
+	if m.queueLen() != 1 {
+		t.Fatalf("got %d queued samples, want 1", m.queueLen())
+	}
+	want := clientmodel.Metric{clientmodel.MetricNameLabel: "up", "source": "prometheus"}
+	if got := (<-m.shards.queues[0]).Metric; !got.Equal(want) {
+		t.Errorf("got queued metric %v, want %v", got, want)
+	}
+	if len(up) != 1 {
+		t.Errorf("appended metric modified to %v", up)
+	}
+}
@@ -0,0 +1,362 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+// Series is a time series read from a remote storage.
+type Series struct {
+	Metric clientmodel.Metric
+	Values metric.Values
+}
+
+// StorageReader defines an interface for reading samples from an external
+// timeseries database.
+type StorageReader interface {
+	// Read returns the series matching all label matchers, with their
+	// samples within the interval in ascending order of their
+	// timestamps. Series without samples in the interval are omitted.
+	Read(metric.LabelMatchers, metric.Interval) ([]Series, error)
+	// Name identifies the remote storage implementation.
+	Name() string
+}
+
+// MergingStorage is a local.Storage that merges series read from a remote
+// storage into the results of queries. All methods but ForInterval are
+// handled by the local storage alone.
+type MergingStorage struct {
+	local.Storage
+	reader StorageReader
+	minGap time.Duration // 0 if remote samples do not fill gaps between local samples.
+
+	readLatency prometheus.Summary
+	readErrors  prometheus.Counter
+}
+
+// NewMergingStorage returns a MergingStorage for the local storage and the
+// remote storage read by the provided StorageReader.
+func NewMergingStorage(s local.Storage, reader StorageReader) *MergingStorage {
+	constLabels := prometheus.Labels{
+		"type": reader.Name(),
+	}
+
+	return &MergingStorage{
+		Storage: s,
+		reader:  reader,
+
+		readLatency: prometheus.NewSummary(prometheus.SummaryOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			Name:        "read_latency_milliseconds",
+			Help:        "Latency quantiles for reading series from the remote storage.",
+			ConstLabels: constLabels,
+		}),
+		readErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			Name:        "read_errors_total",
+			Help:        "Total number of errors reading series from the remote storage.",
+			ConstLabels: constLabels,
+		}),
+	}
+}
+
+// NewPeerMergingStorage returns a MergingStorage for the local storage and the
+// local storage of the other Prometheus server of an HA pair, read by the
+// provided StorageReader. Series of both are deduplicated by their metrics. In
+// addition to what NewMergingStorage does, samples of the peer fill gaps of at
+// least minGap between local samples, so that queries are not affected by the
+// local server having been down, e.g. while restarting and replaying its
+// checkpoint.
+func NewPeerMergingStorage(s local.Storage, peer StorageReader, minGap time.Duration) *MergingStorage {
+	ms := NewMergingStorage(s, peer)
+	ms.minGap = minGap
+	return ms
+}
+
+// ForInterval returns the storage to use for a query needing samples within
+// the interval. Each series selected by the query is also read from the remote
+// storage. Remote samples are merged into a local series with the same metric
+// only where they are older or newer than all local samples within the
+// interval or, for a MergingStorage created by NewPeerMergingStorage, within
+// gaps between local samples, so that local samples are preferred where both
+// overlap. If reading from the remote storage fails, the query only sees local
+// series.
+func (s *MergingStorage) ForInterval(in metric.Interval) local.Storage {
+	return &mergedView{
+		Storage:    s.Storage,
+		ms:         s,
+		in:         in,
+		remote:     map[clientmodel.Fingerprint]metric.Values{},
+		remoteOnly: map[clientmodel.Fingerprint]clientmodel.Metric{},
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (s *MergingStorage) Describe(ch chan<- *prometheus.Desc) {
+	s.readLatency.Describe(ch)
+	s.readErrors.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (s *MergingStorage) Collect(ch chan<- prometheus.Metric) {
+	s.readLatency.Collect(ch)
+	s.readErrors.Collect(ch)
+}
+
+// mergedView is the storage for a single query returned by
+// MergingStorage.ForInterval. It is not goroutine-safe.
+type mergedView struct {
+	local.Storage
+	ms *MergingStorage
+	in metric.Interval
+
+	// The remote values of all series read so far, by the fingerprint
+	// under which the query sees them.
+	remote map[clientmodel.Fingerprint]metric.Values
+	// The metrics of the series only present in the remote storage.
+	remoteOnly map[clientmodel.Fingerprint]clientmodel.Metric
+}
+
+// GetFingerprintsForLabelMatchers implements local.Storage.
+func (v *mergedView) GetFingerprintsForLabelMatchers(matchers metric.LabelMatchers) clientmodel.Fingerprints {
+	fps := v.Storage.GetFingerprintsForLabelMatchers(matchers)
+
+	begin := time.Now()
+	series, err := v.ms.reader.Read(matchers, v.in)
+	v.ms.readLatency.Observe(float64(time.Since(begin) / time.Millisecond))
+	if err != nil {
+		glog.Warningf("Error reading series for %v from remote storage, using local series only: %s", matchers, err)
+		v.ms.readErrors.Inc()
+		return fps
+	}
+	if len(series) == 0 {
+		return fps
+	}
+
+	// Local fingerprints may be mapped to resolve collisions, so look up
+	// local series by the fingerprints of their metrics.
+	localFPs := make(map[clientmodel.Fingerprint]clientmodel.Fingerprint, len(fps))
+	for _, fp := range fps {
+		localFPs[v.Storage.GetMetricForFingerprint(fp).Metric.Fingerprint()] = fp
+	}
+	for _, s := range series {
+		fp := s.Metric.Fingerprint()
+		if localFP, ok := localFPs[fp]; ok && v.Storage.GetMetricForFingerprint(localFP).Metric.Equal(s.Metric) {
+			v.remote[localFP] = s.Values
+			continue
+		}
+		if m := v.Storage.GetMetricForFingerprint(fp).Metric; m != nil && !m.Equal(s.Metric) {
+			glog.Warningf("Fingerprint of remote series %v collides with local series %v, skipping remote series.", s.Metric, m)
+			continue
+		}
+		if _, ok := v.remoteOnly[fp]; !ok {
+			v.remoteOnly[fp] = s.Metric
+			v.remote[fp] = s.Values
+		}
+		fps = append(fps, fp)
+	}
+	return fps
+}
+
+// GetMetricForFingerprint implements local.Storage.
+func (v *mergedView) GetMetricForFingerprint(fp clientmodel.Fingerprint) clientmodel.COWMetric {
+	if m, ok := v.remoteOnly[fp]; ok {
+		return clientmodel.COWMetric{Metric: m}
+	}
+	return v.Storage.GetMetricForFingerprint(fp)
+}
+
+// NewPreloader implements local.Storage.
+func (v *mergedView) NewPreloader() local.Preloader {
+	return &mergedPreloader{
+		Preloader:  v.Storage.NewPreloader(),
+		remoteOnly: v.remoteOnly,
+	}
+}
+
+// NewIterator implements local.Storage. It has to be called after preloading.
+func (v *mergedView) NewIterator(fp clientmodel.Fingerprint) local.SeriesIterator {
+	remoteValues, ok := v.remote[fp]
+	if _, remoteOnly := v.remoteOnly[fp]; remoteOnly {
+		return valuesIterator(remoteValues)
+	}
+	it := v.Storage.NewIterator(fp)
+	if !ok {
+		return it
+	}
+	localValues := it.GetRangeValues(v.in)
+	if len(localValues) == 0 {
+		return mergingIterator{valuesIterator(remoteValues), it}
+	}
+	first, last := localValues[0].Timestamp, localValues[len(localValues)-1].Timestamp
+	before := sort.Search(len(remoteValues), func(i int) bool {
+		return !remoteValues[i].Timestamp.Before(first)
+	})
+	after := sort.Search(len(remoteValues), func(i int) bool {
+		return remoteValues[i].Timestamp.After(last)
+	})
+	values := make(metric.Values, 0, len(localValues)+len(remoteValues))
+	values = append(values, remoteValues[:before]...)
+	values = v.ms.fillGaps(values, localValues, remoteValues[before:after])
+	values = append(values, remoteValues[after:]...)
+	return mergingIterator{valuesIterator(values), it}
+}
+
+// fillGaps appends the local values to values, with the remote values inserted
+// into each gap of at least minGap between consecutive local values.
+func (s *MergingStorage) fillGaps(values, localValues, remoteValues metric.Values) metric.Values {
+	if s.minGap <= 0 || len(remoteValues) == 0 {
+		return append(values, localValues...)
+	}
+	r := 0
+	for i, lv := range localValues {
+		values = append(values, lv)
+		if i+1 == len(localValues) {
+			break
+		}
+		next := localValues[i+1].Timestamp
+		for r < len(remoteValues) && !remoteValues[r].Timestamp.After(lv.Timestamp) {
+			r++
+		}
+		if next.Sub(lv.Timestamp) < s.minGap {
+			continue
+		}
+		for ; r < len(remoteValues) && remoteValues[r].Timestamp.Before(next); r++ {
+			values = append(values, remoteValues[r])
+		}
+	}
+	return values
+}
+
+// mergedPreloader is a local.Preloader that skips series only present in the
+// remote storage.
+type mergedPreloader struct {
+	local.Preloader
+	remoteOnly map[clientmodel.Fingerprint]clientmodel.Metric
+}
+
+// PreloadRange implements local.Preloader.
+func (p *mergedPreloader) PreloadRange(
+	fp clientmodel.Fingerprint,
+	from clientmodel.Timestamp, through clientmodel.Timestamp,
+	stalenessDelta time.Duration,
+) error {
+	if _, ok := p.remoteOnly[fp]; ok {
+		return nil
+	}
+	return p.Preloader.PreloadRange(fp, from, through, stalenessDelta)
+}
+
+// PreloadRanges implements local.Preloader.
+func (p *mergedPreloader) PreloadRanges(
+	ranges map[clientmodel.Fingerprint]metric.Interval,
+	stalenessDelta time.Duration,
+) error {
+	localRanges := make(map[clientmodel.Fingerprint]metric.Interval, len(ranges))
+	for fp, in := range ranges {
+		if _, ok := p.remoteOnly[fp]; !ok {
+			localRanges[fp] = in
+		}
+	}
+	return p.Preloader.PreloadRanges(localRanges, stalenessDelta)
+}
+
+// PreloadRollupRange implements local.Preloader.
+func (p *mergedPreloader) PreloadRollupRange(
+	fp clientmodel.Fingerprint,
+	from clientmodel.Timestamp, through clientmodel.Timestamp,
+	rangeDuration, stalenessDelta time.Duration,
+) error {
+	if _, ok := p.remoteOnly[fp]; ok {
+		return nil
+	}
+	return p.Preloader.PreloadRollupRange(fp, from, through, rangeDuration, stalenessDelta)
+}
+
+// valuesIterator is a local.SeriesIterator over values sorted by timestamp. It
+// has no rollups.
+type valuesIterator metric.Values
+
+// GetValueAtTime implements local.SeriesIterator.
+func (it valuesIterator) GetValueAtTime(t clientmodel.Timestamp) metric.Values {
+	if len(it) == 0 {
+		return nil
+	}
+	i := sort.Search(len(it), func(i int) bool {
+		return !it[i].Timestamp.Before(t)
+	})
+	switch {
+	case i == 0:
+		return metric.Values{it[0]}
+	case i == len(it):
+		return metric.Values{it[i-1]}
+	case it[i].Timestamp.Equal(t):
+		return metric.Values{it[i]}
+	default:
+		return metric.Values{it[i-1], it[i]}
+	}
+}
+
+// GetBoundaryValues implements local.SeriesIterator.
+func (it valuesIterator) GetBoundaryValues(in metric.Interval) metric.Values {
+	values := it.GetRangeValues(in)
+	if len(values) <= 1 {
+		return values
+	}
+	return metric.Values{values[0], values[len(values)-1]}
+}
+
+// GetRangeValues implements local.SeriesIterator.
+func (it valuesIterator) GetRangeValues(in metric.Interval) metric.Values {
+	from := sort.Search(len(it), func(i int) bool {
+		return !it[i].Timestamp.Before(in.OldestInclusive)
+	})
+	through := sort.Search(len(it), func(i int) bool {
+		return it[i].Timestamp.After(in.NewestInclusive)
+	})
+	if from >= through {
+		return metric.Values{}
+	}
+	return metric.Values(it[from:through])
+}
+
+// GetRollups implements local.SeriesIterator.
+func (it valuesIterator) GetRollups(in metric.Interval, res time.Duration) ([]metric.Rollup, metric.Interval, bool) {
+	return nil, metric.Interval{}, false
+}
+
+// mergingIterator is a local.SeriesIterator over the merged values of a local
+// and a remote series. Rollups are only taken from the local series, as local
+// samples are preferred anyway.
+type mergingIterator struct {
+	valuesIterator
+	local local.SeriesIterator
+}
+
+// GetRollups implements local.SeriesIterator.
+func (it mergingIterator) GetRollups(in metric.Interval, res time.Duration) ([]metric.Rollup, metric.Interval, bool) {
+	return it.local.GetRollups(in, res)
+}
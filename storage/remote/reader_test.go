@@ -0,0 +1,197 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package remote
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+type testStorageReader struct {
+	series []Series
+	err    error
+}
+
+func (r *testStorageReader) Read(matchers metric.LabelMatchers, in metric.Interval) ([]Series, error) {
+	var result []Series
+	for _, s := range r.series {
+		matches := true
+		for _, m := range matchers {
+			matches = matches && m.Match(s.Metric[m.Name])
+		}
+		if matches {
+			result = append(result, s)
+		}
+	}
+	return result, r.err
+}
+
+func (r *testStorageReader) Name() string {
+	return "teststoragereader"
+}
+
+func valuesFromTo(from, to, step clientmodel.Timestamp, value clientmodel.SampleValue) metric.Values {
+	var values metric.Values
+	for t := from; !t.After(to); t += step {
+		values = append(values, metric.SamplePair{Timestamp: t, Value: value})
+	}
+	return values
+}
+
+func TestMergingStorage(t *testing.T) {
+	s, closer := local.NewTestStorage(t, 1)
+	defer closer.Close()
+
+	both := clientmodel.Metric{clientmodel.MetricNameLabel: "up", "job": "both"}
+	localOnly := clientmodel.Metric{clientmodel.MetricNameLabel: "up", "job": "local"}
+	remoteOnly := clientmodel.Metric{clientmodel.MetricNameLabel: "up", "job": "remote"}
+
+	localValues := valuesFromTo(1000, 2000, 100, 1)
+	for _, v := range localValues {
+		s.Append(&clientmodel.Sample{Metric: both, Value: v.Value, Timestamp: v.Timestamp})
+		s.Append(&clientmodel.Sample{Metric: localOnly, Value: v.Value, Timestamp: v.Timestamp})
+	}
+	s.WaitForIndexing()
+
+	reader := &testStorageReader{
+		series: []Series{
+			{Metric: both, Values: valuesFromTo(0, 3000, 250, 2)},
+			{Metric: remoteOnly, Values: valuesFromTo(0, 500, 250, 3)},
+		},
+	}
+	ms := NewMergingStorage(s, reader)
+
+	matcher, err := metric.NewLabelMatcher(metric.Equal, clientmodel.MetricNameLabel, "up")
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := metric.Interval{OldestInclusive: 0, NewestInclusive: 3000}
+
+	query := func() map[clientmodel.Fingerprint]metric.Values {
+		view := ms.ForInterval(in)
+		fps := view.GetFingerprintsForLabelMatchers(metric.LabelMatchers{matcher})
+		ranges := map[clientmodel.Fingerprint]metric.Interval{}
+		for _, fp := range fps {
+			ranges[fp] = in
+		}
+		p := view.NewPreloader()
+		defer p.Close()
+		if err := p.PreloadRanges(ranges, 0); err != nil {
+			t.Fatal(err)
+		}
+		result := map[clientmodel.Fingerprint]metric.Values{}
+		for _, fp := range fps {
+			m := view.GetMetricForFingerprint(fp).Metric
+			result[m.Fingerprint()] = view.NewIterator(fp).GetRangeValues(in)
+		}
+		return result
+	}
+
+	// Local samples are preferred within their time range.
+	wantBoth := append(append(valuesFromTo(0, 750, 250, 2), localValues...), valuesFromTo(2250, 3000, 250, 2)...)
+	want := map[clientmodel.Fingerprint]metric.Values{
+		both.Fingerprint():       wantBoth,
+		localOnly.Fingerprint():  localValues,
+		remoteOnly.Fingerprint(): valuesFromTo(0, 500, 250, 3),
+	}
+	if got := query(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got merged series %v, want %v", got, want)
+	}
+
+	// If the remote storage fails, only local series are returned.
+	reader.err = errors.New("remote storage unavailable")
+	want = map[clientmodel.Fingerprint]metric.Values{
+		both.Fingerprint():      localValues,
+		localOnly.Fingerprint(): localValues,
+	}
+	if got := query(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got series %v with failing remote storage, want %v", got, want)
+	}
+}
+
+func TestPeerMergingStorage(t *testing.T) {
+	s, closer := local.NewTestStorage(t, 1)
+	defer closer.Close()
+
+	m := clientmodel.Metric{clientmodel.MetricNameLabel: "up", "job": "ha"}
+	// The local server was down between 1200 and 1800.
+	localValues := append(valuesFromTo(1000, 1200, 100, 1), valuesFromTo(1800, 2000, 100, 1)...)
+	for _, v := range localValues {
+		s.Append(&clientmodel.Sample{Metric: m, Value: v.Value, Timestamp: v.Timestamp})
+	}
+	s.WaitForIndexing()
+
+	peer := &testStorageReader{
+		series: []Series{{Metric: m, Values: valuesFromTo(0, 3000, 250, 2)}},
+	}
+	ms := NewPeerMergingStorage(s, peer, 500)
+
+	in := metric.Interval{OldestInclusive: 0, NewestInclusive: 3000}
+	view := ms.ForInterval(in)
+	fps := view.GetFingerprintsForLabelMatchers(metric.LabelMatchers{
+		&metric.LabelMatcher{Type: metric.Equal, Name: "job", Value: "ha"},
+	})
+	if len(fps) != 1 {
+		t.Fatalf("expected 1 deduplicated series, got %d", len(fps))
+	}
+	p := view.NewPreloader()
+	defer p.Close()
+	if err := p.PreloadRange(fps[0], in.OldestInclusive, in.NewestInclusive, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var want metric.Values
+	want = append(want, valuesFromTo(0, 750, 250, 2)...)
+	want = append(want, valuesFromTo(1000, 1200, 100, 1)...)
+	want = append(want, valuesFromTo(1250, 1750, 250, 2)...)
+	want = append(want, valuesFromTo(1800, 2000, 100, 1)...)
+	want = append(want, valuesFromTo(2250, 3000, 250, 2)...)
+	if got := view.NewIterator(fps[0]).GetRangeValues(in); !reflect.DeepEqual(got, want) {
+		t.Errorf("got merged values %v, want %v", got, want)
+	}
+}
+
+func TestValuesIterator(t *testing.T) {
+	it := valuesIterator(valuesFromTo(100, 300, 100, 1))
+
+	scenarios := []struct {
+		t    clientmodel.Timestamp
+		want metric.Values
+	}{
+		{t: 50, want: metric.Values{{Timestamp: 100, Value: 1}}},
+		{t: 200, want: metric.Values{{Timestamp: 200, Value: 1}}},
+		{t: 250, want: metric.Values{{Timestamp: 200, Value: 1}, {Timestamp: 300, Value: 1}}},
+		{t: 350, want: metric.Values{{Timestamp: 300, Value: 1}}},
+	}
+	for i, s := range scenarios {
+		if got := it.GetValueAtTime(s.t); !reflect.DeepEqual(got, s.want) {
+			t.Errorf("%d. got values %v at %v, want %v", i, got, s.t, s.want)
+		}
+	}
+
+	got := it.GetBoundaryValues(metric.Interval{OldestInclusive: 50, NewestInclusive: 250})
+	want := metric.Values{{Timestamp: 100, Value: 1}, {Timestamp: 200, Value: 1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got boundary values %v, want %v", got, want)
+	}
+	if got := it.GetRangeValues(metric.Interval{OldestInclusive: 310, NewestInclusive: 400}); len(got) != 0 {
+		t.Errorf("got unexpected range values %v", got)
+	}
+}
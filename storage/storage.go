@@ -14,6 +14,8 @@
 package storage
 
 import (
+	"sync"
+
 	clientmodel "github.com/prometheus/client_golang/model"
 )
 
@@ -23,6 +25,25 @@ type SampleAppender interface {
 	Append(*clientmodel.Sample)
 }
 
+// BatchAppender is a SampleAppender that appends many samples at once more
+// efficiently than one by one.
+type BatchAppender interface {
+	SampleAppender
+	AppendBatch(clientmodel.Samples)
+}
+
+// AppendBatch appends the provided samples to app, as one batch if app is a
+// BatchAppender, and one by one otherwise.
+func AppendBatch(app SampleAppender, samples clientmodel.Samples) {
+	if ba, ok := app.(BatchAppender); ok {
+		ba.AppendBatch(samples)
+		return
+	}
+	for _, s := range samples {
+		app.Append(s)
+	}
+}
+
 // Fanout is a SampleAppender that appends every sample to a list of other
 // SampleAppenders.
 type Fanout []SampleAppender
@@ -35,3 +56,74 @@ func (f Fanout) Append(s *clientmodel.Sample) {
 		a.Append(s)
 	}
 }
+
+// AppendBatch implements BatchAppender. It appends the provided samples to all
+// SampleAppenders in the Fanout slice, in one batch where supported.
+func (f Fanout) AppendBatch(samples clientmodel.Samples) {
+	for _, a := range f {
+		AppendBatch(a, samples)
+	}
+}
+
+// Gate is a SampleAppender that appends samples to another SampleAppender
+// until it is closed. Samples appended after closing are dropped, so that the
+// other SampleAppender can be shut down while producers of samples may still
+// be running.
+type Gate struct {
+	mtx     sync.RWMutex
+	app     SampleAppender
+	closed  bool
+	dropped int
+}
+
+// NewGate returns an open Gate that appends samples to app.
+func NewGate(app SampleAppender) *Gate {
+	return &Gate{app: app}
+}
+
+// Append implements SampleAppender.
+func (g *Gate) Append(s *clientmodel.Sample) {
+	g.mtx.RLock()
+	if !g.closed {
+		g.app.Append(s)
+		g.mtx.RUnlock()
+		return
+	}
+	g.mtx.RUnlock()
+
+	g.mtx.Lock()
+	g.dropped++
+	g.mtx.Unlock()
+}
+
+// AppendBatch implements BatchAppender.
+func (g *Gate) AppendBatch(samples clientmodel.Samples) {
+	g.mtx.RLock()
+	if !g.closed {
+		AppendBatch(g.app, samples)
+		g.mtx.RUnlock()
+		return
+	}
+	g.mtx.RUnlock()
+
+	g.mtx.Lock()
+	g.dropped += len(samples)
+	g.mtx.Unlock()
+}
+
+// Close waits for appends in progress to complete and makes the Gate drop all
+// samples appended afterwards.
+func (g *Gate) Close() {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+
+	g.closed = true
+}
+
+// Dropped returns the number of samples dropped since the Gate was closed.
+func (g *Gate) Dropped() int {
+	g.mtx.RLock()
+	defer g.mtx.RUnlock()
+
+	return g.dropped
+}
@@ -0,0 +1,74 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"testing"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+type countingAppender int
+
+func (a *countingAppender) Append(*clientmodel.Sample) {
+	*a++
+}
+
+type batchCountingAppender struct {
+	countingAppender
+	batches int
+}
+
+func (a *batchCountingAppender) AppendBatch(samples clientmodel.Samples) {
+	a.batches++
+	a.countingAppender += countingAppender(len(samples))
+}
+
+func TestAppendBatch(t *testing.T) {
+	var app countingAppender
+	batchApp := &batchCountingAppender{}
+	g := NewGate(Fanout{&app, batchApp})
+	samples := clientmodel.Samples{{}, {}, {}}
+
+	AppendBatch(g, samples)
+	if app != 3 {
+		t.Errorf("expected 3 samples appended one by one, got %d", app)
+	}
+	if batchApp.batches != 1 || batchApp.countingAppender != 3 {
+		t.Errorf("expected 3 samples appended in 1 batch, got %d in %d", batchApp.countingAppender, batchApp.batches)
+	}
+
+	g.Close()
+	AppendBatch(g, samples)
+	if g.Dropped() != 3 {
+		t.Errorf("expected 3 samples dropped after closing, got %d", g.Dropped())
+	}
+}
+
+func TestGate(t *testing.T) {
+	var app countingAppender
+	g := NewGate(&app)
+
+	g.Append(&clientmodel.Sample{})
+	g.Append(&clientmodel.Sample{})
+	g.Close()
+	g.Append(&clientmodel.Sample{})
+
+	if app != 2 {
+		t.Errorf("expected 2 samples appended before closing, got %d", app)
+	}
+	if g.Dropped() != 1 {
+		t.Errorf("expected 1 sample dropped after closing, got %d", g.Dropped())
+	}
+}
@@ -13,7 +13,9 @@
 
 // Rule-Checker allows checking the validity of a Prometheus rule file. It
 // prints an error if the specified rule file is invalid, while it prints a
-// string representation of the parsed rules otherwise.
+// string representation of the parsed rules otherwise. Its test command runs
+// unit tests of rule files, which feed input series into a temporary storage
+// and check the outputs of the rules and the states of alerts over time.
 package main
 
 import (
@@ -48,6 +50,7 @@ func checkRules(filename string, in io.Reader, out io.Writer) error {
 
 func usage() {
 	fmt.Fprintf(os.Stderr, "usage: rule_checker [path ...]\n")
+	fmt.Fprintf(os.Stderr, "       rule_checker test test-file ...\n")
 
 	flagset.PrintDefaults()
 	os.Exit(2)
@@ -57,6 +60,10 @@ func main() {
 	flagset.Usage = usage
 	flagset.Parse(os.Args[1:])
 
+	if flagset.Arg(0) == "test" {
+		testRules(flagset.Args()[1:])
+	}
+
 	if flagset.NArg() == 0 && *ruleFile == "" {
 		if err := checkRules("<stdin>", os.Stdin, os.Stdout); err != nil {
 			fmt.Fprintf(os.Stderr, "error checking standard input: %s\n", err)
@@ -98,3 +105,23 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// testRules runs the rule unit tests in the given test files and exits.
+func testRules(paths []string) {
+	if len(paths) == 0 {
+		usage()
+	}
+	failed := false
+	for _, path := range paths {
+		if err := runRuleTests(path, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: FAILED: %s\n", path, err)
+			failed = true
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "%s: SUCCESS\n", path)
+	}
+	if failed {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,462 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/rules"
+	"github.com/prometheus/prometheus/rules/ast"
+	"github.com/prometheus/prometheus/stats"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/prometheus/prometheus/utility"
+)
+
+// expandingValueRE matches the "a+bxn" and "axn" notations of input series
+// values.
+var expandingValueRE = regexp.MustCompile(`^([-+]?(?:\d+\.?\d*|\.\d+)(?:[eE][-+]?\d+)?)([-+](?:\d+\.?\d*|\.\d+)(?:[eE][-+]?\d+)?)?x(\d+)$`)
+
+// A ruleTestFile describes unit tests of rule files. The rules are evaluated
+// sequentially in the order of the rule files, every evaluation interval,
+// starting at time 0, against a fresh storage for each test.
+//
+// Example of a test file:
+//
+//	{
+//		"rule_files": ["api.rules"],
+//		"evaluation_interval": "1m",
+//		"tests": [{
+//			"interval": "1m",
+//			"input_series": [
+//				{"series": "up{job=\"api\", instance=\"0\"}", "values": "1 1 0x10"}
+//			],
+//			"expr_tests": [
+//				{"eval_time": "5m", "expr": "sum(up) by (job)", "exp_samples": [
+//					{"labels": "{job=\"api\"}", "value": 0}
+//				]}
+//			],
+//			"alert_tests": [
+//				{"eval_time": "10m", "alertname": "InstanceDown", "exp_alerts": [
+//					{"labels": {"job": "api", "instance": "0", "severity": "page"}}
+//				]}
+//			]
+//		}]
+//	}
+type ruleTestFile struct {
+	// RuleFiles are the rule files to test, relative to the test file.
+	RuleFiles []string `json:"rule_files"`
+	// EvaluationInterval is the interval at which the rules are evaluated.
+	// Defaults to 1m.
+	EvaluationInterval string      `json:"evaluation_interval"`
+	Tests              []*ruleTest `json:"tests"`
+}
+
+// A ruleTest feeds input series into a storage and checks expression results
+// and alerts at given times.
+type ruleTest struct {
+	// Interval is the time between two samples of the input series.
+	// Defaults to 1m.
+	Interval    string         `json:"interval"`
+	InputSeries []*inputSeries `json:"input_series"`
+	ExprTests   []*exprTest    `json:"expr_tests"`
+	AlertTests  []*alertTest   `json:"alert_tests"`
+}
+
+// An inputSeries is a series of samples, one per interval starting at time 0.
+type inputSeries struct {
+	// Series is the metric of the series, e.g. `up{job="api"}`.
+	Series string `json:"series"`
+	// Values is a space-separated list of sample values. "_" denotes a
+	// missing sample. "a+bxn" expands to the n+1 values a, a+b, ...,
+	// a+n*b, and "a-bxn" works alike. "axn" repeats a n+1 times.
+	Values string `json:"values"`
+}
+
+// An exprTest checks the result of an expression evaluated after the rules
+// at the given time.
+type exprTest struct {
+	EvalTime   string       `json:"eval_time"`
+	Expr       string       `json:"expr"`
+	ExpSamples []*expSample `json:"exp_samples"`
+}
+
+// An expSample is an expected sample of an expression result.
+type expSample struct {
+	// Labels is the metric of the sample, e.g. `job:up:sum{job="api"}`.
+	Labels string  `json:"labels"`
+	Value  float64 `json:"value"`
+}
+
+// An alertTest checks the active alerts of an alerting rule after the rules
+// have been evaluated at the given time.
+type alertTest struct {
+	EvalTime  string      `json:"eval_time"`
+	Alertname string      `json:"alertname"`
+	ExpAlerts []*expAlert `json:"exp_alerts"`
+}
+
+// An expAlert is an expected active alert.
+type expAlert struct {
+	// Labels are the labels of the alert, without the alert name.
+	Labels map[string]string `json:"labels"`
+	// State is "pending" or "firing". Defaults to "firing".
+	State string `json:"state"`
+}
+
+// runRuleTests runs the unit tests in the given test file and reports
+// failures to out. It returns an error if the tests could not be run or
+// failed.
+func runRuleTests(filename string, out io.Writer) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tf := &ruleTestFile{}
+	if err := json.NewDecoder(f).Decode(tf); err != nil {
+		return fmt.Errorf("error parsing test file: %s", err)
+	}
+
+	evalInterval, err := parseDurationOrDefault(tf.EvaluationInterval, time.Minute)
+	if err != nil {
+		return fmt.Errorf("invalid evaluation interval: %s", err)
+	}
+
+	failures := 0
+	for i, test := range tf.Tests {
+		// Rules keep alert state, so they are loaded anew for each test.
+		var testRules []rules.Rule
+		for _, rf := range tf.RuleFiles {
+			if !filepath.IsAbs(rf) {
+				rf = filepath.Join(filepath.Dir(filename), rf)
+			}
+			fileRules, err := rules.LoadRulesFromFile(rf)
+			if err != nil {
+				return fmt.Errorf("%s: %s", rf, err)
+			}
+			testRules = append(testRules, fileRules...)
+		}
+
+		errs, err := test.run(testRules, evalInterval)
+		if err != nil {
+			return fmt.Errorf("test %d: %s", i, err)
+		}
+		for _, e := range errs {
+			fmt.Fprintf(out, "%s: test %d: %s\n", filename, i, e)
+		}
+		failures += len(errs)
+	}
+	if failures > 0 {
+		return fmt.Errorf("%d assertions failed", failures)
+	}
+	return nil
+}
+
+// run evaluates the rules against the input series of the test and returns
+// the failed assertions.
+func (test *ruleTest) run(testRules []rules.Rule, evalInterval time.Duration) ([]error, error) {
+	interval, err := parseDurationOrDefault(test.Interval, time.Minute)
+	if err != nil {
+		return nil, fmt.Errorf("invalid interval: %s", err)
+	}
+
+	dir, err := ioutil.TempDir("", "rule_test")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	storage, err := local.NewMemorySeriesStorage(&local.MemorySeriesStorageOptions{
+		MemoryChunks:               1024 * 1024,
+		MaxChunksToPersist:         1024 * 1024,
+		PersistenceStoragePath:     dir,
+		PersistenceRetentionPeriod: 24 * time.Hour * 365 * 100, // Never purge test samples.
+		MinCheckpointInterval:      time.Hour,
+		MaxCheckpointInterval:      time.Hour,
+		SyncStrategy:               local.Never,
+	})
+	if err != nil {
+		return nil, err
+	}
+	storage.Start()
+	defer storage.Stop()
+
+	for _, is := range test.InputSeries {
+		m, err := parseMetric(is.Series)
+		if err != nil {
+			return nil, fmt.Errorf("invalid input series %q: %s", is.Series, err)
+		}
+		values, err := parseValues(is.Values)
+		if err != nil {
+			return nil, fmt.Errorf("invalid values of input series %q: %s", is.Series, err)
+		}
+		for i, v := range values {
+			if v == nil {
+				continue
+			}
+			storage.Append(&clientmodel.Sample{
+				Metric:    m,
+				Value:     *v,
+				Timestamp: clientmodel.Timestamp(0).Add(time.Duration(i) * interval),
+			})
+		}
+	}
+	storage.WaitForIndexing()
+
+	// Sort the assertions by evaluation time.
+	exprTests := map[time.Duration][]*exprTest{}
+	alertTests := map[time.Duration][]*alertTest{}
+	var maxEvalTime time.Duration
+	evalTime := func(s string) (time.Duration, error) {
+		t, err := utility.StringToDuration(s)
+		if err != nil {
+			return 0, fmt.Errorf("invalid evaluation time: %s", err)
+		}
+		if t%evalInterval != 0 {
+			return 0, fmt.Errorf("evaluation time %s is not a multiple of the evaluation interval", s)
+		}
+		if t > maxEvalTime {
+			maxEvalTime = t
+		}
+		return t, nil
+	}
+	for _, et := range test.ExprTests {
+		t, err := evalTime(et.EvalTime)
+		if err != nil {
+			return nil, err
+		}
+		exprTests[t] = append(exprTests[t], et)
+	}
+	for _, at := range test.AlertTests {
+		t, err := evalTime(at.EvalTime)
+		if err != nil {
+			return nil, err
+		}
+		alertTests[t] = append(alertTests[t], at)
+	}
+
+	var errs []error
+	for t := time.Duration(0); t <= maxEvalTime; t += evalInterval {
+		ts := clientmodel.Timestamp(0).Add(t)
+		for _, rule := range testRules {
+			vector, err := rule.Eval(ts, storage)
+			if err != nil {
+				return nil, fmt.Errorf("error evaluating rule %q at %s: %s", rule, utility.DurationToString(t), err)
+			}
+			for _, s := range vector {
+				storage.Append(&clientmodel.Sample{
+					Metric:    s.Metric.Metric,
+					Value:     s.Value,
+					Timestamp: s.Timestamp,
+				})
+			}
+			storage.WaitForIndexing()
+		}
+
+		for _, et := range exprTests[t] {
+			if err := et.check(ts, storage); err != nil {
+				errs = append(errs, fmt.Errorf("expression %q at %s: %s", et.Expr, et.EvalTime, err))
+			}
+		}
+		for _, at := range alertTests[t] {
+			if err := at.check(testRules); err != nil {
+				errs = append(errs, fmt.Errorf("alert %s at %s: %s", at.Alertname, at.EvalTime, err))
+			}
+		}
+	}
+	return errs, nil
+}
+
+// check compares the result of the expression with the expected samples.
+func (et *exprTest) check(ts clientmodel.Timestamp, storage local.Storage) error {
+	expr, err := rules.LoadExprFromString(et.Expr)
+	if err != nil {
+		return err
+	}
+	vectorExpr, ok := expr.(ast.VectorNode)
+	if !ok {
+		return fmt.Errorf("expression does not evaluate to vector type")
+	}
+	vector, err := ast.EvalVectorInstant(vectorExpr, ts, storage, stats.NewTimerGroup())
+	if err != nil {
+		return err
+	}
+
+	got := map[clientmodel.Fingerprint]clientmodel.SampleValue{}
+	for _, s := range vector {
+		got[s.Metric.Metric.Fingerprint()] = s.Value
+	}
+	var problems []string
+	for _, es := range et.ExpSamples {
+		m, err := parseMetric(es.Labels)
+		if err != nil {
+			return fmt.Errorf("invalid expected labels %q: %s", es.Labels, err)
+		}
+		fp := m.Fingerprint()
+		v, ok := got[fp]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("missing %s => %v", m, es.Value))
+		case !almostEqual(float64(v), es.Value):
+			problems = append(problems, fmt.Sprintf("got %s => %v, want %v", m, v, es.Value))
+		}
+		delete(got, fp)
+	}
+	for _, s := range vector {
+		if _, ok := got[s.Metric.Metric.Fingerprint()]; ok {
+			problems = append(problems, fmt.Sprintf("unexpected %s => %v", s.Metric.Metric, s.Value))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// check compares the active alerts of the alerting rule with the expected
+// alerts.
+func (at *alertTest) check(testRules []rules.Rule) error {
+	var rule *rules.AlertingRule
+	for _, r := range testRules {
+		if ar, ok := r.(*rules.AlertingRule); ok && ar.Name() == at.Alertname {
+			rule = ar
+			break
+		}
+	}
+	if rule == nil {
+		return fmt.Errorf("no alerting rule of that name")
+	}
+
+	got := map[string]bool{}
+	for _, a := range rule.ActiveAlerts() {
+		got[alertString(a.Labels, a.State.String())] = true
+	}
+	var problems []string
+	for _, ea := range at.ExpAlerts {
+		labels := clientmodel.LabelSet{}
+		for k, v := range ea.Labels {
+			labels[clientmodel.LabelName(k)] = clientmodel.LabelValue(v)
+		}
+		state := ea.State
+		if state == "" {
+			state = rules.Firing.String()
+		}
+		s := alertString(labels, state)
+		if !got[s] {
+			problems = append(problems, "missing "+s)
+		}
+		delete(got, s)
+	}
+	for s := range got {
+		problems = append(problems, "unexpected "+s)
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("%s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func alertString(labels clientmodel.LabelSet, state string) string {
+	return fmt.Sprintf("%s alert %s", state, labels)
+}
+
+// parseMetric parses a metric in selector notation, e.g. `up{job="api"}`.
+func parseMetric(s string) (clientmodel.Metric, error) {
+	expr, err := rules.LoadExprFromString(s)
+	if err != nil {
+		return nil, err
+	}
+	selector, ok := expr.(*ast.VectorSelector)
+	if !ok {
+		return nil, fmt.Errorf("not a metric")
+	}
+	m := clientmodel.Metric{}
+	for _, matcher := range selector.LabelMatchers() {
+		if matcher.Type != metric.Equal {
+			return nil, fmt.Errorf("only equality matchers allowed")
+		}
+		m[matcher.Name] = matcher.Value
+	}
+	return m, nil
+}
+
+// parseValues parses the values of an input series. Missing samples are
+// returned as nil.
+func parseValues(s string) ([]*clientmodel.SampleValue, error) {
+	var values []*clientmodel.SampleValue
+	for _, item := range strings.Fields(s) {
+		if item == "_" {
+			values = append(values, nil)
+			continue
+		}
+		if m := expandingValueRE.FindStringSubmatch(item); m != nil {
+			start, _ := strconv.ParseFloat(m[1], 64)
+			var step float64
+			if m[2] != "" {
+				step, _ = strconv.ParseFloat(m[2], 64)
+			}
+			n, err := strconv.Atoi(m[3])
+			if err != nil {
+				return nil, err
+			}
+			for i := 0; i <= n; i++ {
+				v := clientmodel.SampleValue(start + float64(i)*step)
+				values = append(values, &v)
+			}
+			continue
+		}
+		f, err := strconv.ParseFloat(item, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q", item)
+		}
+		v := clientmodel.SampleValue(f)
+		values = append(values, &v)
+	}
+	return values, nil
+}
+
+func parseDurationOrDefault(s string, d time.Duration) (time.Duration, error) {
+	if s == "" {
+		return d, nil
+	}
+	return utility.StringToDuration(s)
+}
+
+// almostEqual compares two sample values, treating NaNs as equal and allowing
+// for small rounding errors.
+func almostEqual(a, b float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+	if a == b {
+		return true
+	}
+	return math.Abs(a-b) <= 1e-9*math.Max(math.Abs(a), math.Abs(b))
+}
@@ -0,0 +1,124 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/utility/test"
+)
+
+const testRuleFile = `
+job:up:sum = sum(up) by (job)
+
+ALERT InstanceDown IF up == 0 FOR 2m WITH {
+    severity = "page"
+  }
+  SUMMARY "Instance {{$labels.instance}} down"
+  DESCRIPTION "{{$labels.instance}} of job {{$labels.job}} is down."
+`
+
+const testTestFile = `{
+	"rule_files": ["test.rules"],
+	"evaluation_interval": "1m",
+	"tests": [{
+		"interval": "1m",
+		"input_series": [
+			{"series": "up{job=\"api\", instance=\"0\"}", "values": "1 1 0x5"},
+			{"series": "up{job=\"api\", instance=\"1\"}", "values": "1+0x7"}
+		],
+		"expr_tests": [
+			{"eval_time": "1m", "expr": "job:up:sum", "exp_samples": [
+				{"labels": "job:up:sum{job=\"api\"}", "value": 2}
+			]},
+			{"eval_time": "5m", "expr": "job:up:sum", "exp_samples": [
+				{"labels": "job:up:sum{job=\"api\"}", "value": %s}
+			]}
+		],
+		"alert_tests": [
+			{"eval_time": "3m", "alertname": "InstanceDown", "exp_alerts": [
+				{"labels": {"job": "api", "instance": "0", "severity": "page"}, "state": "pending"}
+			]},
+			{"eval_time": "4m", "alertname": "InstanceDown", "exp_alerts": [
+				{"labels": {"job": "api", "instance": "0", "severity": "page"}}
+			]}
+		]
+	}]
+}`
+
+func TestRunRuleTests(t *testing.T) {
+	dir := test.NewTemporaryDirectory("rule_test", t)
+	defer dir.Close()
+
+	if err := ioutil.WriteFile(filepath.Join(dir.Path(), "test.rules"), []byte(testRuleFile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	testFile := filepath.Join(dir.Path(), "test.json")
+
+	// Passing tests.
+	if err := ioutil.WriteFile(testFile, []byte(strings.Replace(testTestFile, "%s", "1", 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := runRuleTests(testFile, &out); err != nil {
+		t.Fatalf("unexpected error: %s, output: %s", err, out.String())
+	}
+
+	// Failing tests.
+	if err := ioutil.WriteFile(testFile, []byte(strings.Replace(testTestFile, "%s", "2", 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := runRuleTests(testFile, &out); err == nil {
+		t.Fatal("expected failing tests")
+	}
+	want := testFile + `: test 0: expression "job:up:sum" at 5m: got job:up:sum{job="api"} => 1, want 2` + "\n"
+	if out.String() != want {
+		t.Errorf("got output %q, want %q", out.String(), want)
+	}
+}
+
+func TestParseValues(t *testing.T) {
+	values, err := parseValues("1 _ 2+1.5x2 10-5x1 7x1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []interface{}
+	for _, v := range values {
+		if v == nil {
+			got = append(got, nil)
+			continue
+		}
+		got = append(got, *v)
+	}
+	want := []interface{}{
+		clientmodel.SampleValue(1), nil, clientmodel.SampleValue(2), clientmodel.SampleValue(3.5),
+		clientmodel.SampleValue(5), clientmodel.SampleValue(10), clientmodel.SampleValue(5),
+		clientmodel.SampleValue(7), clientmodel.SampleValue(7),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got values %v, want %v", got, want)
+	}
+
+	if _, err := parseValues("1 x"); err == nil {
+		t.Error("expected error for invalid value")
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/matttproud/golang_protobuf_extensions/pbutil"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/prometheus/rules"
+	"github.com/prometheus/prometheus/rules/ast"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+const (
+	jsonFormat     = "json"
+	csvFormat      = "csv"
+	protobufFormat = "protobuf"
+)
+
+var (
+	dumpFlags   = flag.NewFlagSet("dump", flag.ExitOnError)
+	dumpMatch   = dumpFlags.String("match", "", "A series selector (e.g. 'http_requests_total{job=\"api\"}') selecting the series to dump.")
+	dumpFrom    = dumpFlags.String("from", "0", "The start of the time range to dump, as a Unix timestamp in seconds.")
+	dumpThrough = dumpFlags.String("through", "", "The end of the time range to dump, as a Unix timestamp in seconds. Defaults to now.")
+	dumpFormat  = dumpFlags.String("format", jsonFormat, "The output format. Possible values: 'json' (one JSON object per series and line, with the \"metric\" and the \"values\" as in range query results), 'csv' (one line per sample with metric, timestamp in seconds, and value), 'protobuf' (one length-delimited MetricFamily protocol buffer per series, with one untyped metric per sample).")
+)
+
+// A seriesWriter writes the samples of series in one of the dump formats.
+type seriesWriter interface {
+	writeSeries(m clientmodel.Metric, values metric.Values) error
+	// flush writes any buffered data.
+	flush() error
+}
+
+// newSeriesWriter returns a seriesWriter for the given format writing to w.
+func newSeriesWriter(format string, w io.Writer) (seriesWriter, error) {
+	switch format {
+	case jsonFormat:
+		return jsonSeriesWriter{json.NewEncoder(w)}, nil
+	case csvFormat:
+		cw := csv.NewWriter(w)
+		if err := cw.Write([]string{"metric", "timestamp", "value"}); err != nil {
+			return nil, err
+		}
+		return csvSeriesWriter{cw}, nil
+	case protobufFormat:
+		return protobufSeriesWriter{w}, nil
+	default:
+		return nil, fmt.Errorf("invalid format %q", format)
+	}
+}
+
+type jsonSeriesWriter struct {
+	enc *json.Encoder
+}
+
+func (w jsonSeriesWriter) writeSeries(m clientmodel.Metric, values metric.Values) error {
+	return w.enc.Encode(struct {
+		Metric clientmodel.Metric `json:"metric"`
+		Values metric.Values      `json:"values"`
+	}{
+		Metric: m,
+		Values: values,
+	})
+}
+
+func (w jsonSeriesWriter) flush() error { return nil }
+
+type csvSeriesWriter struct {
+	w *csv.Writer
+}
+
+func (w csvSeriesWriter) writeSeries(m clientmodel.Metric, values metric.Values) error {
+	name := m.String()
+	for _, v := range values {
+		if err := w.w.Write([]string{name, v.Timestamp.String(), v.Value.String()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w csvSeriesWriter) flush() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+type protobufSeriesWriter struct {
+	w io.Writer
+}
+
+func (w protobufSeriesWriter) writeSeries(m clientmodel.Metric, values metric.Values) error {
+	labels := make([]*dto.LabelPair, 0, len(m))
+	for ln, lv := range m {
+		if ln == clientmodel.MetricNameLabel {
+			continue
+		}
+		labels = append(labels, &dto.LabelPair{
+			Name:  proto.String(string(ln)),
+			Value: proto.String(string(lv)),
+		})
+	}
+	sort.Sort(labelPairsByName(labels))
+
+	mf := &dto.MetricFamily{
+		Name:   proto.String(string(m[clientmodel.MetricNameLabel])),
+		Type:   dto.MetricType_UNTYPED.Enum(),
+		Metric: make([]*dto.Metric, 0, len(values)),
+	}
+	for _, v := range values {
+		mf.Metric = append(mf.Metric, &dto.Metric{
+			Label:       labels,
+			Untyped:     &dto.Untyped{Value: proto.Float64(float64(v.Value))},
+			TimestampMs: proto.Int64(int64(v.Timestamp)),
+		})
+	}
+	_, err := pbutil.WriteDelimited(w.w, mf)
+	return err
+}
+
+func (w protobufSeriesWriter) flush() error { return nil }
+
+// labelPairsByName implements sort.Interface, sorting by label name.
+type labelPairsByName []*dto.LabelPair
+
+func (l labelPairsByName) Len() int           { return len(l) }
+func (l labelPairsByName) Less(i, j int) bool { return l[i].GetName() < l[j].GetName() }
+func (l labelPairsByName) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+
+// dump writes the samples within the interval of all series in s matching the
+// label matchers to w, one series at a time, and returns the number of samples
+// written. Series without samples in the interval are skipped.
+func dump(s local.Storage, matchers metric.LabelMatchers, in metric.Interval, w seriesWriter) (int, error) {
+	fps := s.GetFingerprintsForLabelMatchers(matchers)
+	sort.Sort(fps)
+
+	written := 0
+	for _, fp := range fps {
+		// Preload only one series at a time so that dumping a large
+		// selection does not pin all of its chunks in memory.
+		p := s.NewPreloader()
+		if err := p.PreloadRange(fp, in.OldestInclusive, in.NewestInclusive, 0); err != nil {
+			p.Close()
+			return written, err
+		}
+		values := s.NewIterator(fp).GetRangeValues(in)
+		m := s.GetMetricForFingerprint(fp).Metric
+		p.Close()
+
+		if len(values) == 0 {
+			continue
+		}
+		if err := w.writeSeries(m, values); err != nil {
+			return written, err
+		}
+		written += len(values)
+	}
+	return written, w.flush()
+}
+
+// parseTimestamp parses a Unix timestamp in seconds with optional decimal
+// places.
+func parseTimestamp(s string) (clientmodel.Timestamp, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return clientmodel.TimestampFromUnixNano(int64(f * float64(time.Second/time.Nanosecond))), nil
+}
+
+// runDump writes the selected samples from the local storage to stdout.
+func runDump(args []string) error {
+	if len(args) != 0 || *dumpMatch == "" {
+		dumpFlags.Usage()
+	}
+	exprNode, err := rules.LoadExprFromString(*dumpMatch)
+	if err != nil {
+		return err
+	}
+	selector, ok := exprNode.(*ast.VectorSelector)
+	if !ok {
+		return fmt.Errorf("%q is not a series selector", *dumpMatch)
+	}
+	in := metric.Interval{NewestInclusive: clientmodel.Now()}
+	if in.OldestInclusive, err = parseTimestamp(*dumpFrom); err != nil {
+		return fmt.Errorf("invalid start of time range: %s", err)
+	}
+	if *dumpThrough != "" {
+		if in.NewestInclusive, err = parseTimestamp(*dumpThrough); err != nil {
+			return fmt.Errorf("invalid end of time range: %s", err)
+		}
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	w, err := newSeriesWriter(*dumpFormat, out)
+	if err != nil {
+		return err
+	}
+
+	storage, err := openStorage()
+	if err != nil {
+		return err
+	}
+	n, err := dump(storage, selector.LabelMatchers(), in, w)
+	if err == nil {
+		err = out.Flush()
+	}
+	if stopErr := storage.Stop(); err == nil {
+		err = stopErr
+	}
+	fmt.Fprintf(os.Stderr, "dumped %d samples\n", n)
+	return err
+}
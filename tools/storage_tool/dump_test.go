@@ -0,0 +1,105 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/matttproud/golang_protobuf_extensions/pbutil"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+func TestDump(t *testing.T) {
+	storage, closer := local.NewTestStorage(t, 1)
+	defer closer.Close()
+
+	m1 := clientmodel.Metric{clientmodel.MetricNameLabel: "up", "job": "api"}
+	m2 := clientmodel.Metric{clientmodel.MetricNameLabel: "up", "job": "db"}
+	for i := 0; i < 4; i++ {
+		ts := clientmodel.TimestampFromUnix(int64(1000 + 10*i))
+		storage.Append(&clientmodel.Sample{Metric: m1, Value: clientmodel.SampleValue(i), Timestamp: ts})
+		storage.Append(&clientmodel.Sample{Metric: m2, Value: 1, Timestamp: ts})
+	}
+	storage.WaitForIndexing()
+
+	matcher, err := metric.NewLabelMatcher(metric.Equal, "job", "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := metric.Interval{
+		OldestInclusive: clientmodel.TimestampFromUnix(1010),
+		NewestInclusive: clientmodel.TimestampFromUnix(1020),
+	}
+
+	scenarios := map[string]string{
+		jsonFormat: `{"metric":{"__name__":"up","job":"api"},"values":[[1010,"1"],[1020,"2"]]}` + "\n",
+		csvFormat:  "metric,timestamp,value\n" + `"up{job=""api""}",1010,1` + "\n" + `"up{job=""api""}",1020,2` + "\n",
+	}
+	for format, want := range scenarios {
+		var buf bytes.Buffer
+		w, err := newSeriesWriter(format, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := dump(storage, metric.LabelMatchers{matcher}, in, w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 2 {
+			t.Errorf("%s: got %d samples dumped, want 2", format, n)
+		}
+		if got := buf.String(); got != want {
+			t.Errorf("%s: got output %q, want %q", format, got, want)
+		}
+	}
+
+	var buf bytes.Buffer
+	w, err := newSeriesWriter(protobufFormat, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := dump(storage, metric.LabelMatchers{matcher}, in, w); err != nil {
+		t.Fatal(err)
+	}
+	mf := &dto.MetricFamily{}
+	if _, err := pbutil.ReadDelimited(&buf, mf); err != nil {
+		t.Fatal(err)
+	}
+	labels := []*dto.LabelPair{{Name: proto.String("job"), Value: proto.String("api")}}
+	want := &dto.MetricFamily{
+		Name: proto.String("up"),
+		Type: dto.MetricType_UNTYPED.Enum(),
+		Metric: []*dto.Metric{
+			{Label: labels, Untyped: &dto.Untyped{Value: proto.Float64(1)}, TimestampMs: proto.Int64(1010000)},
+			{Label: labels, Untyped: &dto.Untyped{Value: proto.Float64(2)}, TimestampMs: proto.Int64(1020000)},
+		},
+	}
+	if !proto.Equal(mf, want) {
+		t.Errorf("got metric family %v, want %v", mf, want)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("got %d unexpected bytes after metric family", buf.Len())
+	}
+
+	if _, err := newSeriesWriter("xml", &buf); err == nil {
+		t.Error("expected error for invalid format")
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+const (
+	whisperFormat  = "whisper"
+	openTSDBFormat = "opentsdb"
+)
+
+var (
+	importFlags  = flag.NewFlagSet("import", flag.ExitOnError)
+	importFormat = importFlags.String("format", whisperFormat, "The format of the imported files. Possible values: 'whisper' (Whisper files or directories containing them, named by their Graphite paths), 'opentsdb' (results of the OpenTSDB /api/query endpoint in JSON format).")
+	mappingFile  = importFlags.String("mapping", "", "The path to a JSON file mapping the dot-separated names of imported series to metric names and labels.")
+)
+
+// importSeries backfills the given values for the metric into s and returns
+// the number of samples written.
+func importSeries(s local.Storage, m clientmodel.Metric, values metric.Values) (int, error) {
+	samples := make(clientmodel.Samples, 0, len(values))
+	for _, v := range values {
+		samples = append(samples, &clientmodel.Sample{
+			Metric:    m,
+			Value:     v.Value,
+			Timestamp: v.Timestamp,
+		})
+	}
+	return s.Backfill(samples)
+}
+
+// importWhisper imports the Whisper files at or below root.
+func importWhisper(s local.Storage, m *mapping, root string) (int, error) {
+	files, err := whisperFiles(root)
+	if err != nil {
+		return 0, err
+	}
+	written := 0
+	for path, name := range files {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return written, err
+		}
+		values, err := parseWhisper(buf)
+		if err != nil {
+			return written, fmt.Errorf("%s: %s", path, err)
+		}
+		n, err := importSeries(s, m.metricFor(name, nil), values)
+		written += n
+		if err != nil {
+			return written, fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	return written, nil
+}
+
+// importOpenTSDB imports the OpenTSDB export at path.
+func importOpenTSDB(s local.Storage, m *mapping, path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	series, values, err := parseOpenTSDB(f)
+	if err != nil {
+		return 0, err
+	}
+	written := 0
+	for i, ts := range series {
+		n, err := importSeries(s, m.metricFor(ts.Metric, ts.Tags), values[i])
+		written += n
+		if err != nil {
+			return written, fmt.Errorf("series %q: %s", ts.Metric, err)
+		}
+	}
+	return written, nil
+}
+
+// runImport imports the files at the given paths into the local storage.
+func runImport(paths []string) error {
+	if len(paths) == 0 {
+		importFlags.Usage()
+	}
+	var importPath func(local.Storage, *mapping, string) (int, error)
+	switch *importFormat {
+	case whisperFormat:
+		importPath = importWhisper
+	case openTSDBFormat:
+		importPath = importOpenTSDB
+	default:
+		return fmt.Errorf("invalid format %q", *importFormat)
+	}
+
+	m := &mapping{}
+	if *mappingFile != "" {
+		f, err := os.Open(*mappingFile)
+		if err != nil {
+			return err
+		}
+		m, err = loadMapping(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %s", *mappingFile, err)
+		}
+	}
+
+	storage, err := openStorage()
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, path := range paths {
+		n, err := importPath(storage, m, path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: error importing: %s\n", path, err)
+			failed++
+		}
+		fmt.Fprintf(os.Stderr, "%s: imported %d samples\n", path, n)
+	}
+	if err := storage.Stop(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d paths failed", failed, len(paths))
+	}
+	return nil
+}
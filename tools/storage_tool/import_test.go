@@ -0,0 +1,155 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+func TestMapping(t *testing.T) {
+	m, err := loadMapping(strings.NewReader(`{"rules": [
+		{"match": "servers.*.cpu.*", "name": "node_cpu", "labels": {"instance": "$1", "mode": "$2"}},
+		{"match": "servers.*.*", "name": "node_$2"}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scenarios := []struct {
+		name string
+		tags map[string]string
+		want clientmodel.Metric
+	}{
+		{
+			name: "servers.web1.cpu.idle",
+			want: clientmodel.Metric{clientmodel.MetricNameLabel: "node_cpu", "instance": "web1", "mode": "idle"},
+		},
+		{
+			name: "servers.web1.load",
+			want: clientmodel.Metric{clientmodel.MetricNameLabel: "node_load"},
+		},
+		{
+			name: "1min.load-avg",
+			tags: map[string]string{"host": "web1", "data-center": "eu"},
+			want: clientmodel.Metric{clientmodel.MetricNameLabel: "_1min_load_avg", "host": "web1", "data_center": "eu"},
+		},
+	}
+	for i, s := range scenarios {
+		if got := m.metricFor(s.name, s.tags); !reflect.DeepEqual(got, s.want) {
+			t.Errorf("%d. got metric %v for %q, want %v", i, got, s.name, s.want)
+		}
+	}
+
+	for _, invalid := range []string{
+		`{"rules": [{"match": "a.*", "name": "b_$2"}]}`,
+		`{"rules": [{"match": "a.*", "name": "b", "labels": {"in-valid": "$1"}}]}`,
+		`{"rules": [{"match": "", "name": "b"}]}`,
+	} {
+		if _, err := loadMapping(strings.NewReader(invalid)); err == nil {
+			t.Errorf("expected error loading mapping %s", invalid)
+		}
+	}
+}
+
+func TestParseWhisper(t *testing.T) {
+	type point struct {
+		t uint32
+		v float64
+	}
+	archives := []struct {
+		secondsPerPoint uint32
+		points          []point
+	}{
+		// 10s precision for 4 points as a ring buffer that wrapped
+		// around, with one point left over from the previous round.
+		{10, []point{{1040, 4}, {1010, 1}, {1020, 2}, {990, -1}}},
+		// 60s precision for 3 points, of which the newest is covered
+		// by the archive above.
+		{60, []point{{900, 10}, {960, 11}, {1020, 12}}},
+	}
+
+	var buf bytes.Buffer
+	write := func(v interface{}) {
+		if err := binary.Write(&buf, binary.BigEndian, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write([]uint32{1, 240}) // Aggregation type, max retention.
+	write(float32(0.5))     // xFilesFactor.
+	write(uint32(len(archives)))
+	offset := uint32(whisperMetadataLen + len(archives)*whisperArchiveInfoLen)
+	for _, a := range archives {
+		write([]uint32{offset, a.secondsPerPoint, uint32(len(a.points))})
+		offset += uint32(len(a.points)) * whisperPointLen
+	}
+	for _, a := range archives {
+		for _, p := range a.points {
+			write(p.t)
+			write(math.Float64bits(p.v))
+		}
+	}
+
+	got, err := parseWhisper(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := metric.Values{
+		{Timestamp: clientmodel.TimestampFromUnix(900), Value: 10},
+		{Timestamp: clientmodel.TimestampFromUnix(960), Value: 11},
+		{Timestamp: clientmodel.TimestampFromUnix(1010), Value: 1},
+		{Timestamp: clientmodel.TimestampFromUnix(1020), Value: 2},
+		{Timestamp: clientmodel.TimestampFromUnix(1040), Value: 4},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got values %v, want %v", got, want)
+	}
+
+	if _, err := parseWhisper(buf.Bytes()[:40]); err == nil {
+		t.Error("expected error parsing truncated whisper file")
+	}
+}
+
+func TestParseOpenTSDB(t *testing.T) {
+	series, values, err := parseOpenTSDB(strings.NewReader(`[
+		{"metric": "sys.cpu.user", "tags": {"host": "web1"}, "dps": {"1435781460": 2, "1435781400": 1}},
+		{"metric": "sys.cpu.nice", "tags": {}, "dps": {"1435781400500": 3}}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(series) != 2 || series[0].Metric != "sys.cpu.user" || series[0].Tags["host"] != "web1" {
+		t.Fatalf("unexpected series %v", series)
+	}
+	want := []metric.Values{
+		{
+			{Timestamp: clientmodel.TimestampFromUnix(1435781400), Value: 1},
+			{Timestamp: clientmodel.TimestampFromUnix(1435781460), Value: 2},
+		},
+		{
+			{Timestamp: clientmodel.TimestampFromUnixNano(1435781400500 * 1e6), Value: 3},
+		},
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("got values %v, want %v", values, want)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Storage-Tool works on the local storage of a Prometheus server that is not
+// running. Its import command converts Graphite Whisper files and OpenTSDB
+// HTTP API exports into series of the local storage. The names of imported
+// series are mapped to metric names and labels as described in the mapping
+// file, if any. Its dump command writes the samples of the series matching a
+// selector as JSON lines, CSV, or a stream of length-delimited protocol
+// buffers, e.g. for migrating to other systems or for offline analysis. Its
+// orphaned-list command shows the series files that crash recovery has moved
+// into the orphaned directory, and its orphaned-restore command moves them
+// back into the storage and indexes them again.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/prometheus/prometheus/storage/local"
+)
+
+var storagePath = flag.String("storage.local.path", "/tmp/metrics", "Base path for metrics storage.")
+
+// A command is one of the commands of storage_tool, with its own flags. The
+// flags of the local storage are added to every command.
+type command struct {
+	synopsis string
+	flags    *flag.FlagSet
+	run      func(args []string) error
+}
+
+var commands = map[string]*command{
+	"import": {
+		synopsis: "import [flags] path ...",
+		flags:    importFlags,
+		run:      runImport,
+	},
+	"dump": {
+		synopsis: "dump [flags]",
+		flags:    dumpFlags,
+		run:      runDump,
+	},
+	"orphaned-list": {
+		synopsis: "orphaned-list [flags]",
+		flags:    orphanedListFlags,
+		run:      runOrphanedList,
+	},
+	"orphaned-restore": {
+		synopsis: "orphaned-restore [flags] [fingerprint ...]",
+		flags:    orphanedRestoreFlags,
+		run:      runOrphanedRestore,
+	},
+}
+
+func usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		prefix := "usage:"
+		if i > 0 {
+			prefix = "      "
+		}
+		fmt.Fprintf(os.Stderr, "%s storage_tool %s\n", prefix, commands[name].synopsis)
+	}
+	os.Exit(2)
+}
+
+// openStorage opens and starts the local storage at -storage.local.path. It
+// has to be stopped by the caller.
+func openStorage() (local.Storage, error) {
+	storage, err := local.NewMemorySeriesStorage(&local.MemorySeriesStorageOptions{
+		MemoryChunks:               1024 * 1024,
+		MaxChunksToPersist:         1024 * 1024,
+		PersistenceStoragePath:     *storagePath,
+		PersistenceRetentionPeriod: 24 * time.Hour * 365 * 100, // Never purge imported samples.
+		MinCheckpointInterval:      time.Hour,
+		MaxCheckpointInterval:      time.Hour,
+		SyncStrategy:               local.Adaptive,
+	})
+	if err != nil {
+		return nil, err
+	}
+	storage.Start()
+	return storage, nil
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		cmd.flags.Var(f.Value, f.Name, f.Usage)
+	})
+	cmd.flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: storage_tool %s\n", cmd.synopsis)
+
+		cmd.flags.PrintDefaults()
+		os.Exit(2)
+	}
+	cmd.flags.Parse(os.Args[2:])
+
+	if err := cmd.run(cmd.flags.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "error running %s: %s\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+)
+
+var (
+	labelNameRE    = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+	invalidCharsRE = regexp.MustCompile("[^a-zA-Z0-9_]")
+	referenceRE    = regexp.MustCompile(`\$[0-9]+`)
+)
+
+// A mappingRule maps the dot-separated names of imported series (Graphite
+// paths or OpenTSDB metric names) that match a pattern to a metric name and
+// labels.
+type mappingRule struct {
+	// Match is a dot-separated pattern, in which "*" matches exactly one
+	// component of a name.
+	Match string `json:"match"`
+	// Name is the metric name. It may refer to the components matched by
+	// the n-th "*" as $n.
+	Name string `json:"name"`
+	// Labels are added to the metric. Their values may refer to matched
+	// components like Name. They override OpenTSDB tags of the same name.
+	Labels map[string]string `json:"labels"`
+
+	pattern []string
+}
+
+// A mapping is a list of mappingRules, of which the first matching one is
+// applied. A name not matched by any rule is turned into a metric name by
+// replacing all characters not allowed in metric names with "_".
+//
+// Example of a mapping file:
+//
+//	{"rules": [
+//		{
+//			"match": "servers.*.cpu.*",
+//			"name": "node_cpu",
+//			"labels": {"instance": "$1", "mode": "$2"}
+//		}
+//	]}
+type mapping struct {
+	Rules []*mappingRule `json:"rules"`
+}
+
+// loadMapping reads and validates a mapping in JSON format from r.
+func loadMapping(r io.Reader) (*mapping, error) {
+	m := &mapping{}
+	if err := json.NewDecoder(r).Decode(m); err != nil {
+		return nil, err
+	}
+	for i, rule := range m.Rules {
+		if rule.Match == "" || rule.Name == "" {
+			return nil, fmt.Errorf("rule %d: match and name must not be empty", i)
+		}
+		rule.pattern = strings.Split(rule.Match, ".")
+		numWildcards := 0
+		for _, c := range rule.pattern {
+			if c == "*" {
+				numWildcards++
+			}
+		}
+		refs := []string{rule.Name}
+		for ln, lv := range rule.Labels {
+			if !labelNameRE.MatchString(ln) {
+				return nil, fmt.Errorf("rule %d: invalid label name %q", i, ln)
+			}
+			refs = append(refs, lv)
+		}
+		for _, s := range refs {
+			for _, ref := range referenceRE.FindAllString(s, -1) {
+				if n, _ := strconv.Atoi(ref[1:]); n < 1 || n > numWildcards {
+					return nil, fmt.Errorf("rule %d: %s does not refer to a wildcard in %q", i, ref, rule.Match)
+				}
+			}
+		}
+	}
+	return m, nil
+}
+
+// metricFor returns the metric for the series with the given name and tags.
+// Tag names are sanitized like metric names.
+func (m *mapping) metricFor(name string, tags map[string]string) clientmodel.Metric {
+	metric := clientmodel.Metric{}
+	for tn, tv := range tags {
+		metric[clientmodel.LabelName(sanitize(tn))] = clientmodel.LabelValue(tv)
+	}
+
+	components := strings.Split(name, ".")
+	for _, rule := range m.Rules {
+		matched, ok := rule.match(components)
+		if !ok {
+			continue
+		}
+		expand := func(s string) string {
+			return referenceRE.ReplaceAllStringFunc(s, func(ref string) string {
+				n, _ := strconv.Atoi(ref[1:])
+				return matched[n-1]
+			})
+		}
+		metric[clientmodel.MetricNameLabel] = clientmodel.LabelValue(sanitize(expand(rule.Name)))
+		for ln, lv := range rule.Labels {
+			metric[clientmodel.LabelName(ln)] = clientmodel.LabelValue(expand(lv))
+		}
+		return metric
+	}
+	metric[clientmodel.MetricNameLabel] = clientmodel.LabelValue(sanitize(name))
+	return metric
+}
+
+// match returns the components matched by the wildcards of the rule's pattern,
+// and whether the given components match the pattern at all.
+func (r *mappingRule) match(components []string) ([]string, bool) {
+	if len(components) != len(r.pattern) {
+		return nil, false
+	}
+	var matched []string
+	for i, c := range r.pattern {
+		switch c {
+		case "*":
+			matched = append(matched, components[i])
+		case components[i]:
+		default:
+			return nil, false
+		}
+	}
+	return matched, true
+}
+
+// sanitize turns s into a valid metric or label name.
+func sanitize(s string) string {
+	s = invalidCharsRE.ReplaceAllString(s, "_")
+	if s == "" || (s[0] >= '0' && s[0] <= '9') {
+		s = "_" + s
+	}
+	return s
+}
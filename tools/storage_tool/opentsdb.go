@@ -0,0 +1,63 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+// openTSDBSeries is one series as returned by the /api/query endpoint of the
+// OpenTSDB HTTP API.
+type openTSDBSeries struct {
+	Metric string             `json:"metric"`
+	Tags   map[string]string  `json:"tags"`
+	DPs    map[string]float64 `json:"dps"`
+}
+
+// parseOpenTSDB reads an OpenTSDB query result in JSON format from r. The
+// values of each series are sorted by timestamp. Timestamps may be given in
+// seconds or, if they have more than 10 digits, in milliseconds.
+func parseOpenTSDB(r io.Reader) ([]openTSDBSeries, []metric.Values, error) {
+	var series []openTSDBSeries
+	if err := json.NewDecoder(r).Decode(&series); err != nil {
+		return nil, nil, err
+	}
+	values := make([]metric.Values, len(series))
+	for i, s := range series {
+		for ts, v := range s.DPs {
+			t, err := strconv.ParseInt(ts, 10, 64)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid timestamp %q in series %q: %s", ts, s.Metric, err)
+			}
+			timestamp := clientmodel.TimestampFromUnixNano(t * 1e6)
+			if len(ts) <= 10 {
+				timestamp = clientmodel.TimestampFromUnix(t)
+			}
+			values[i] = append(values[i], metric.SamplePair{
+				Timestamp: timestamp,
+				Value:     clientmodel.SampleValue(v),
+			})
+		}
+		sort.Sort(valuesByTimestamp(values[i]))
+	}
+	return series, values, nil
+}
@@ -0,0 +1,168 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/rules"
+	"github.com/prometheus/prometheus/rules/ast"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+var (
+	orphanedListFlags = flag.NewFlagSet("orphaned-list", flag.ExitOnError)
+	orphanedListJSON  = orphanedListFlags.Bool("json", false, "Write one JSON object per orphaned file and line instead of a table.")
+
+	orphanedRestoreFlags  = flag.NewFlagSet("orphaned-restore", flag.ExitOnError)
+	orphanedRestoreMetric = orphanedRestoreFlags.String("metric", "", "The metric (e.g. 'http_requests_total{job=\"api\"}') of the series to restore, if it is not known from the label index snapshot. Only one fingerprint may be given then.")
+)
+
+// listOrphaned writes the orphaned series files of s to w, either as a table
+// or as JSON lines.
+func listOrphaned(s local.Storage, w io.Writer, asJSON bool) error {
+	orphaned, err := s.ListOrphanedSeries()
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	for _, o := range orphaned {
+		if asJSON {
+			if err := enc.Encode(o); err != nil {
+				return err
+			}
+			continue
+		}
+		problem := o.Problem
+		if problem == "" {
+			problem = "restorable"
+		}
+		m := "-"
+		if o.Metric != nil {
+			m = o.Metric.String()
+		}
+		if _, err := fmt.Fprintf(
+			w, "%s\t%v\t%s\t%d chunks\t%v-%v\t%s\n",
+			o.Path, o.Fingerprint, m, o.Chunks, o.FirstTime, o.LastTime, problem,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreOrphaned restores the orphaned series files of the given
+// fingerprints, or of all restorable ones if there are none. If m is not nil,
+// it is the metric of the single fingerprint given. It returns the number of
+// series restored.
+func restoreOrphaned(s local.Storage, fps []clientmodel.Fingerprint, m clientmodel.Metric) (int, error) {
+	if len(fps) == 0 {
+		orphaned, err := s.ListOrphanedSeries()
+		if err != nil {
+			return 0, err
+		}
+		for _, o := range orphaned {
+			if o.Problem == "" {
+				fps = append(fps, o.Fingerprint)
+			}
+		}
+	}
+	restored := 0
+	for _, fp := range fps {
+		if err := s.RestoreOrphanedSeries(fp, m); err != nil {
+			return restored, fmt.Errorf("restoring %v: %s", fp, err)
+		}
+		restored++
+	}
+	return restored, nil
+}
+
+// runOrphanedList lists the files in the orphaned directory of the local
+// storage.
+func runOrphanedList(args []string) error {
+	if len(args) != 0 {
+		orphanedListFlags.Usage()
+	}
+	storage, err := openStorage()
+	if err != nil {
+		return err
+	}
+	err = listOrphaned(storage, os.Stdout, *orphanedListJSON)
+	if stopErr := storage.Stop(); err == nil {
+		err = stopErr
+	}
+	return err
+}
+
+// runOrphanedRestore moves orphaned series files back into the local storage
+// and indexes them.
+func runOrphanedRestore(args []string) error {
+	fps := make([]clientmodel.Fingerprint, 0, len(args))
+	for _, arg := range args {
+		var fp clientmodel.Fingerprint
+		if err := fp.LoadFromString(arg); err != nil {
+			return fmt.Errorf("invalid fingerprint %q: %s", arg, err)
+		}
+		fps = append(fps, fp)
+	}
+	var m clientmodel.Metric
+	if *orphanedRestoreMetric != "" {
+		if len(fps) != 1 {
+			orphanedRestoreFlags.Usage()
+		}
+		var err error
+		if m, err = parseMetric(*orphanedRestoreMetric); err != nil {
+			return err
+		}
+	}
+
+	storage, err := openStorage()
+	if err != nil {
+		return err
+	}
+	n, err := restoreOrphaned(storage, fps, m)
+	if stopErr := storage.Stop(); err == nil {
+		err = stopErr
+	}
+	fmt.Fprintf(os.Stderr, "restored %d series\n", n)
+	return err
+}
+
+// parseMetric parses a series selector with only equality matchers into a
+// metric.
+func parseMetric(s string) (clientmodel.Metric, error) {
+	exprNode, err := rules.LoadExprFromString(s)
+	if err != nil {
+		return nil, err
+	}
+	selector, ok := exprNode.(*ast.VectorSelector)
+	if !ok {
+		return nil, fmt.Errorf("%q is not a series selector", s)
+	}
+	m := clientmodel.Metric{}
+	for _, lm := range selector.LabelMatchers() {
+		if lm.Type != metric.Equal {
+			return nil, fmt.Errorf("%q does not identify a single metric", s)
+		}
+		m[lm.Name] = lm.Value
+	}
+	return m, nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/local"
+)
+
+func TestParseMetric(t *testing.T) {
+	m, err := parseMetric(`up{job="api"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (clientmodel.Metric{clientmodel.MetricNameLabel: "up", "job": "api"}); !m.Equal(want) {
+		t.Errorf("got metric %v, want %v", m, want)
+	}
+	for _, s := range []string{`up{job=~"api"}`, `sum(up)`, `up{`} {
+		if _, err := parseMetric(s); err == nil {
+			t.Errorf("expected error parsing %q", s)
+		}
+	}
+}
+
+func TestOrphanedWithoutOrphans(t *testing.T) {
+	storage, closer := local.NewTestStorage(t, 1)
+	defer closer.Close()
+
+	var buf bytes.Buffer
+	if err := listOrphaned(storage, &buf, false); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("got output %q, want none", buf.String())
+	}
+	if n, err := restoreOrphaned(storage, nil, nil); err != nil || n != 0 {
+		t.Errorf("got %d series restored, error %v, want none", n, err)
+	}
+	if _, err := restoreOrphaned(storage, []clientmodel.Fingerprint{1}, nil); err == nil {
+		t.Error("expected error restoring a series that was never orphaned")
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+const (
+	whisperSuffix          = ".wsp"
+	whisperMetadataLen     = 16 // Aggregation type, max retention, xFilesFactor, archive count.
+	whisperArchiveInfoLen  = 12 // Offset, seconds per point, number of points.
+	whisperPointLen        = 12 // Timestamp, value.
+	whisperArchiveCountPos = 12
+)
+
+type whisperArchive struct {
+	offset, secondsPerPoint, numPoints uint32
+}
+
+// parseWhisper returns all points stored in the given content of a Graphite
+// Whisper file, sorted by timestamp. Of the time range covered by several
+// archives, only the points of the archive with the highest precision are
+// returned.
+func parseWhisper(buf []byte) (metric.Values, error) {
+	if len(buf) < whisperMetadataLen {
+		return nil, fmt.Errorf("file too short for whisper metadata")
+	}
+	numArchives := int(binary.BigEndian.Uint32(buf[whisperArchiveCountPos:]))
+	if len(buf) < whisperMetadataLen+numArchives*whisperArchiveInfoLen {
+		return nil, fmt.Errorf("file too short for %d whisper archives", numArchives)
+	}
+	archives := make([]whisperArchive, numArchives)
+	for i := range archives {
+		info := buf[whisperMetadataLen+i*whisperArchiveInfoLen:]
+		archives[i] = whisperArchive{
+			offset:          binary.BigEndian.Uint32(info),
+			secondsPerPoint: binary.BigEndian.Uint32(info[4:]),
+			numPoints:       binary.BigEndian.Uint32(info[8:]),
+		}
+		if end := int64(archives[i].offset) + int64(archives[i].numPoints)*whisperPointLen; end > int64(len(buf)) {
+			return nil, fmt.Errorf("whisper archive %d exceeds file", i)
+		}
+	}
+	// Archives are ordered by descending precision.
+	sort.Sort(archivesByPrecision(archives))
+
+	var values metric.Values
+	coveredFrom := uint32(math.MaxUint32)
+	for _, a := range archives {
+		points := make(metric.Values, 0, a.numPoints)
+		var newest uint32
+		for i := uint32(0); i < a.numPoints; i++ {
+			point := buf[a.offset+i*whisperPointLen:]
+			t := binary.BigEndian.Uint32(point)
+			if t == 0 {
+				// Slot never written.
+				continue
+			}
+			if t > newest {
+				newest = t
+			}
+			points = append(points, metric.SamplePair{
+				Timestamp: clientmodel.TimestampFromUnix(int64(t)),
+				Value:     clientmodel.SampleValue(math.Float64frombits(binary.BigEndian.Uint64(point[4:]))),
+			})
+		}
+		// The archive is a ring buffer. Points older than one round
+		// trip before the newest point are left over from earlier
+		// rounds.
+		oldest := clientmodel.TimestampFromUnix(int64(newest) - int64(a.secondsPerPoint)*int64(a.numPoints))
+		limit := clientmodel.TimestampFromUnix(int64(coveredFrom))
+		archiveFrom := coveredFrom
+		for _, p := range points {
+			if p.Timestamp.After(oldest) && p.Timestamp.Before(limit) {
+				values = append(values, p)
+				if t := uint32(p.Timestamp.Unix()); t < archiveFrom {
+					archiveFrom = t
+				}
+			}
+		}
+		coveredFrom = archiveFrom
+	}
+	sort.Sort(valuesByTimestamp(values))
+	return values, nil
+}
+
+// archivesByPrecision implements sort.Interface, sorting by ascending
+// secondsPerPoint.
+type archivesByPrecision []whisperArchive
+
+func (a archivesByPrecision) Len() int           { return len(a) }
+func (a archivesByPrecision) Less(i, j int) bool { return a[i].secondsPerPoint < a[j].secondsPerPoint }
+func (a archivesByPrecision) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// valuesByTimestamp implements sort.Interface, sorting by ascending Timestamp.
+type valuesByTimestamp metric.Values
+
+func (v valuesByTimestamp) Len() int           { return len(v) }
+func (v valuesByTimestamp) Less(i, j int) bool { return v[i].Timestamp.Before(v[j].Timestamp) }
+func (v valuesByTimestamp) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+
+// whisperFiles returns the Whisper files below root, together with their
+// Graphite paths, i.e. their paths relative to root with "/" replaced by "."
+// and without the suffix. If root is a file, its Graphite path is its base
+// name.
+func whisperFiles(root string) (map[string]string, error) {
+	files := map[string]string{}
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		files[root] = strings.TrimSuffix(filepath.Base(root), whisperSuffix)
+		return files, nil
+	}
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(path, whisperSuffix) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files[path] = strings.Replace(strings.TrimSuffix(rel, whisperSuffix), string(filepath.Separator), ".", -1)
+		return nil
+	})
+	return files, err
+}
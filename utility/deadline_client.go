@@ -23,21 +23,27 @@ import (
 // requests.
 func NewDeadlineClient(timeout time.Duration) *http.Client {
 	return &http.Client{
-		Transport: &http.Transport{
-			// We need to disable keepalive, because we set a deadline on the
-			// underlying connection.
-			DisableKeepAlives: true,
-			Dial: func(netw, addr string) (c net.Conn, err error) {
-				start := time.Now()
+		Transport: NewDeadlineTransport(timeout),
+	}
+}
+
+// NewDeadlineTransport returns a new http.Transport which will time out long
+// running requests. Its TLS and proxy settings may be changed before use.
+func NewDeadlineTransport(timeout time.Duration) *http.Transport {
+	return &http.Transport{
+		// We need to disable keepalive, because we set a deadline on the
+		// underlying connection.
+		DisableKeepAlives: true,
+		Dial: func(netw, addr string) (c net.Conn, err error) {
+			start := time.Now()
 
-				c, err = net.DialTimeout(netw, addr, timeout)
+			c, err = net.DialTimeout(netw, addr, timeout)
 
-				if err == nil {
-					c.SetDeadline(start.Add(timeout))
-				}
+			if err == nil {
+				c.SetDeadline(start.Add(timeout))
+			}
 
-				return
-			},
+			return
 		},
 	}
 }
@@ -0,0 +1,267 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/golang/glog"
+	clientmodel "github.com/prometheus/client_golang/model"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/prometheus/rules"
+	"github.com/prometheus/prometheus/rules/ast"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/prometheus/prometheus/web/httputils"
+)
+
+// RegisterAdminHandler registers the handlers for the administrative endpoints
+// below /api/admin. As they modify the state of the server, they are only
+// registered if explicitly enabled.
+func (msrv *MetricsService) RegisterAdminHandler(pathPrefix string) {
+	http.Handle(pathPrefix+"api/admin/snapshot", prometheus.InstrumentHandler(
+		pathPrefix+"api/admin/snapshot", http.HandlerFunc(msrv.Snapshot),
+	))
+	http.Handle(pathPrefix+"api/admin/delete_series", prometheus.InstrumentHandler(
+		pathPrefix+"api/admin/delete_series", http.HandlerFunc(msrv.DeleteSeries),
+	))
+	http.Handle(pathPrefix+"api/admin/backfill", prometheus.InstrumentHandler(
+		pathPrefix+"api/admin/backfill", http.HandlerFunc(msrv.Backfill),
+	))
+	http.Handle(pathPrefix+"api/admin/cancel_query", prometheus.InstrumentHandler(
+		pathPrefix+"api/admin/cancel_query", http.HandlerFunc(msrv.CancelQuery),
+	))
+	http.Handle(pathPrefix+"api/admin/check_series", prometheus.InstrumentHandler(
+		pathPrefix+"api/admin/check_series", http.HandlerFunc(msrv.CheckSeries),
+	))
+}
+
+// requirePost rejects requests not using the POST method. It returns true if
+// the request may proceed.
+func requirePost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "POST" {
+		w.Header().Add("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+// Snapshot handles the /api/admin/snapshot endpoint. It creates a snapshot of
+// the local storage and returns the directory the snapshot was written to.
+func (serv MetricsService) Snapshot(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	dir, err := serv.Storage.Snapshot()
+	if err != nil {
+		glog.Error("Error creating snapshot: ", err)
+		httpJSONError(w, fmt.Errorf("error creating snapshot: %s", err), http.StatusInternalServerError)
+		return
+	}
+	resultBytes, err := json.Marshal(struct {
+		Snapshot string `json:"snapshot"`
+	}{
+		Snapshot: dir,
+	})
+	if err != nil {
+		httpJSONError(w, fmt.Errorf("Error marshalling snapshot result: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.Write(resultBytes)
+}
+
+// DeleteSeries handles the /api/admin/delete_series endpoint. It deletes all
+// series matching the series selector given in the "match" parameter (e.g.
+// 'http_requests_total{job="api"}') from the local storage, and returns the
+// number of series deleted.
+func (serv MetricsService) DeleteSeries(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	params := httputils.GetQueryParams(r)
+	match := params.Get("match")
+	exprNode, err := rules.LoadExprFromString(match)
+	if err != nil {
+		httpJSONError(w, err, http.StatusBadRequest)
+		return
+	}
+	selector, ok := exprNode.(*ast.VectorSelector)
+	if !ok {
+		httpJSONError(w, fmt.Errorf("match parameter %q is not a series selector", match), http.StatusBadRequest)
+		return
+	}
+
+	numDeleted := serv.Storage.DropMetricsForLabelMatchers(selector.LabelMatchers())
+	glog.Infof("Deleted %d series matching %s on request.", numDeleted, match)
+	resultBytes, err := json.Marshal(struct {
+		NumDeleted int `json:"numDeleted"`
+	}{
+		NumDeleted: numDeleted,
+	})
+	if err != nil {
+		httpJSONError(w, fmt.Errorf("Error marshalling delete result: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.Write(resultBytes)
+}
+
+// Backfill handles the /api/admin/backfill endpoint. It writes the historical
+// samples in the request body directly to the series files of the local
+// storage, and returns the number of samples written and skipped. The body has
+// the format of a range query result, i.e. a JSON array of objects with a
+// "metric" and the "values" of the series, e.g.
+// '[{"metric": {"__name__": "up"}, "values": [[1435781430.781, "1"]]}]'.
+func (serv MetricsService) Backfill(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	var streams []struct {
+		Metric clientmodel.Metric `json:"metric"`
+		Values metric.Values      `json:"values"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&streams); err != nil {
+		httpJSONError(w, fmt.Errorf("error parsing samples: %s", err), http.StatusBadRequest)
+		return
+	}
+	var samples clientmodel.Samples
+	for _, s := range streams {
+		for _, v := range s.Values {
+			samples = append(samples, &clientmodel.Sample{
+				Metric:    s.Metric,
+				Timestamp: v.Timestamp,
+				Value:     v.Value,
+			})
+		}
+	}
+
+	numWritten, err := serv.Storage.Backfill(samples)
+	glog.Infof("Backfilled %d of %d samples on request.", numWritten, len(samples))
+	if err != nil {
+		glog.Error("Error backfilling samples: ", err)
+		httpJSONError(w, fmt.Errorf("error backfilling samples: %s", err), http.StatusInternalServerError)
+		return
+	}
+	resultBytes, err := json.Marshal(struct {
+		NumWritten int `json:"numWritten"`
+		NumSkipped int `json:"numSkipped"`
+	}{
+		NumWritten: numWritten,
+		NumSkipped: len(samples) - numWritten,
+	})
+	if err != nil {
+		httpJSONError(w, fmt.Errorf("Error marshalling backfill result: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.Write(resultBytes)
+}
+
+// CancelQuery handles the /api/admin/cancel_query endpoint. It cancels the
+// query with the ID given in the "id" parameter, as listed by the
+// /api/v1/queries endpoint. The query fails once it next preloads chunks or
+// reads samples.
+func (serv MetricsService) CancelQuery(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	params := httputils.GetQueryParams(r)
+	id, err := strconv.ParseUint(params.Get("id"), 10, 64)
+	if err != nil {
+		httpJSONError(w, fmt.Errorf("invalid query ID %q: %s", params.Get("id"), err), http.StatusBadRequest)
+		return
+	}
+	if !ast.CancelQuery(id) {
+		httpJSONError(w, fmt.Errorf("no active query with ID %d", id), http.StatusNotFound)
+		return
+	}
+	glog.Infof("Canceled query %d on request.", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CheckSeries handles the /api/admin/check_series endpoint. It performs the
+// pedantic consistency checks of crash recovery on the series with the
+// fingerprint given in the "fingerprint" parameter or on all series matching
+// the series selector given in the "match" parameter, without modifying them.
+// It returns the number of series checked and found inconsistent, and the
+// result per series, including the problems found.
+func (serv MetricsService) CheckSeries(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	params := httputils.GetQueryParams(r)
+	var fps clientmodel.Fingerprints
+	switch fpParam, match := params.Get("fingerprint"), params.Get("match"); {
+	case fpParam != "" && match != "":
+		httpJSONError(w, fmt.Errorf("only one of the fingerprint and match parameters may be given"), http.StatusBadRequest)
+		return
+	case fpParam != "":
+		var fp clientmodel.Fingerprint
+		if err := fp.LoadFromString(fpParam); err != nil {
+			httpJSONError(w, fmt.Errorf("invalid fingerprint %q: %s", fpParam, err), http.StatusBadRequest)
+			return
+		}
+		fps = clientmodel.Fingerprints{fp}
+	default:
+		exprNode, err := rules.LoadExprFromString(match)
+		if err != nil {
+			httpJSONError(w, err, http.StatusBadRequest)
+			return
+		}
+		selector, ok := exprNode.(*ast.VectorSelector)
+		if !ok {
+			httpJSONError(w, fmt.Errorf("match parameter %q is not a series selector", match), http.StatusBadRequest)
+			return
+		}
+		fps = serv.Storage.GetFingerprintsForLabelMatchers(selector.LabelMatchers())
+		sort.Sort(fps)
+	}
+
+	checks := serv.Storage.CheckSeries(fps)
+	numInconsistent := 0
+	for _, c := range checks {
+		if len(c.Problems) > 0 {
+			numInconsistent++
+		}
+	}
+	glog.Infof("Checked %d series on request, %d of them inconsistent.", len(checks), numInconsistent)
+	resultBytes, err := json.Marshal(struct {
+		NumChecked      int                 `json:"numChecked"`
+		NumInconsistent int                 `json:"numInconsistent"`
+		Series          []local.SeriesCheck `json:"series"`
+	}{
+		NumChecked:      len(checks),
+		NumInconsistent: numInconsistent,
+		Series:          checks,
+	})
+	if err != nil {
+		httpJSONError(w, fmt.Errorf("Error marshalling check result: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.Write(resultBytes)
+}
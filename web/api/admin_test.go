@@ -0,0 +1,338 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/rules"
+	"github.com/prometheus/prometheus/rules/ast"
+	"github.com/prometheus/prometheus/stats"
+	"github.com/prometheus/prometheus/storage/local"
+)
+
+func TestSnapshot(t *testing.T) {
+	storage, closer := local.NewTestStorage(t, 1)
+	defer closer.Close()
+
+	api := MetricsService{
+		Now:     testNow,
+		Storage: storage,
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/api/admin/snapshot", http.HandlerFunc(api.Snapshot))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/api/admin/snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("Unexpected status code for GET; got %d, want %d", resp.StatusCode, http.StatusMethodNotAllowed)
+	}
+
+	resp, err = http.Post(server.URL+"/api/admin/snapshot", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Unexpected status code for POST; got %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	var result struct {
+		Snapshot string `json:"snapshot"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(result.Snapshot); err != nil {
+		t.Fatalf("Snapshot directory %q not created: %s", result.Snapshot, err)
+	}
+}
+
+func TestDeleteSeries(t *testing.T) {
+	storage, closer := local.NewTestStorage(t, 1)
+	defer closer.Close()
+	for _, v := range []clientmodel.LabelValue{"1", "2"} {
+		storage.Append(&clientmodel.Sample{
+			Metric: clientmodel.Metric{
+				clientmodel.MetricNameLabel: "testmetric",
+				"a":                         v,
+			},
+			Timestamp: testTimestamp,
+		})
+	}
+	storage.WaitForIndexing()
+
+	api := MetricsService{
+		Now:     testNow,
+		Storage: storage,
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/api/admin/delete_series", http.HandlerFunc(api.DeleteSeries))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	scenarios := []struct {
+		match      string
+		status     int
+		numDeleted int
+	}{
+		{match: "", status: http.StatusBadRequest},
+		{match: "testmetric + 1", status: http.StatusBadRequest},
+		{match: `testmetric{a="1"}`, status: http.StatusOK, numDeleted: 1},
+		{match: `testmetric{a="1"}`, status: http.StatusOK, numDeleted: 0},
+		{match: "testmetric", status: http.StatusOK, numDeleted: 1},
+	}
+	for i, s := range scenarios {
+		resp, err := http.PostForm(server.URL+"/api/admin/delete_series", url.Values{"match": {s.match}})
+		if err != nil {
+			t.Fatalf("%d. Error calling API: %s", i, err)
+		}
+		if resp.StatusCode != s.status {
+			resp.Body.Close()
+			t.Fatalf("%d. Unexpected status code; got %d, want %d", i, resp.StatusCode, s.status)
+		}
+		if s.status != http.StatusOK {
+			resp.Body.Close()
+			continue
+		}
+		var result struct {
+			NumDeleted int `json:"numDeleted"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%d. Error decoding response: %s", i, err)
+		}
+		if result.NumDeleted != s.numDeleted {
+			t.Errorf("%d. Unexpected number of deleted series; got %d, want %d", i, result.NumDeleted, s.numDeleted)
+		}
+		storage.WaitForIndexing()
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	storage, closer := local.NewTestStorage(t, 1)
+	defer closer.Close()
+
+	api := MetricsService{
+		Now:     testNow,
+		Storage: storage,
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/api/admin/backfill", http.HandlerFunc(api.Backfill))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	scenarios := []struct {
+		body                   string
+		status                 int
+		numWritten, numSkipped int
+	}{
+		{body: "", status: http.StatusBadRequest},
+		{body: `[{"metric": {"__name__": "testmetric"}, "values": [[1, 2, 3]]}]`, status: http.StatusBadRequest},
+		{body: `[{"metric": {"__name__": "testmetric"}, "values": [[1435781430.781, "1"], [1435781445.781, "2"]]}]`, status: http.StatusOK, numWritten: 2},
+		{body: `[{"metric": {"__name__": "testmetric"}, "values": [[1435781430.781, "3"], [1435781415.781, "4"]]}]`, status: http.StatusOK, numWritten: 1, numSkipped: 1},
+	}
+	for i, s := range scenarios {
+		resp, err := http.Post(server.URL+"/api/admin/backfill", "application/json", strings.NewReader(s.body))
+		if err != nil {
+			t.Fatalf("%d. Error calling API: %s", i, err)
+		}
+		if resp.StatusCode != s.status {
+			resp.Body.Close()
+			t.Fatalf("%d. Unexpected status code; got %d, want %d", i, resp.StatusCode, s.status)
+		}
+		if s.status != http.StatusOK {
+			resp.Body.Close()
+			continue
+		}
+		var result struct {
+			NumWritten int `json:"numWritten"`
+			NumSkipped int `json:"numSkipped"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%d. Error decoding response: %s", i, err)
+		}
+		if result.NumWritten != s.numWritten || result.NumSkipped != s.numSkipped {
+			t.Errorf("%d. Unexpected result; got %d written and %d skipped, want %d and %d", i, result.NumWritten, result.NumSkipped, s.numWritten, s.numSkipped)
+		}
+	}
+
+	storage.WaitForIndexing()
+	fp := clientmodel.Metric{clientmodel.MetricNameLabel: "testmetric"}.Fingerprint()
+	p := storage.NewPreloader()
+	defer p.Close()
+	if err := p.PreloadRange(fp, 1435781400000, 1435781500000, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	values := storage.NewIterator(fp).GetValueAtTime(1435781430781)
+	if len(values) != 1 || values[0].Value != 1 {
+		t.Errorf("Unexpected values at backfilled timestamp: %v", values)
+	}
+}
+
+func TestCancelQuery(t *testing.T) {
+	storage, closer := local.NewTestStorage(t, 1)
+	defer closer.Close()
+
+	api := MetricsService{
+		Now:     testNow,
+		Storage: storage,
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/api/v1/queries", http.HandlerFunc(api.ActiveQueriesV1))
+	mux.Handle("/api/admin/cancel_query", http.HandlerFunc(api.CancelQuery))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	node, err := rules.LoadExprFromString(`sum(testmetric)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := ast.RegisterQuery(node, "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Done()
+
+	resp, err := http.Get(server.URL + "/api/v1/queries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listed struct {
+		Data []activeQuery `json:"data"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&listed)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed.Data) != 1 {
+		t.Fatalf("Unexpected active queries: %v", listed.Data)
+	}
+	if got := listed.Data[0]; got.ID != q.ID || got.Query != "SUM(testmetric)" || got.Client != "127.0.0.1" {
+		t.Errorf("Unexpected active query: %+v", got)
+	}
+
+	scenarios := []struct {
+		id   string
+		code int
+	}{
+		{"foo", http.StatusBadRequest},
+		{strconv.FormatUint(q.ID+1, 10), http.StatusNotFound},
+		{strconv.FormatUint(q.ID, 10), http.StatusNoContent},
+	}
+	for i, s := range scenarios {
+		resp, err := http.PostForm(server.URL+"/api/admin/cancel_query", url.Values{"id": {s.id}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != s.code {
+			t.Errorf("%d. Unexpected status code; got %d, want %d", i, resp.StatusCode, s.code)
+		}
+	}
+	if !ast.IsQueryCanceled(func() (err error) {
+		_, err = ast.EvalToVector(node, testTimestamp, storage, stats.NewTimerGroup())
+		return err
+	}()) {
+		t.Error("Query not canceled.")
+	}
+}
+
+func TestCheckSeries(t *testing.T) {
+	storage, closer := local.NewTestStorage(t, 1)
+	defer closer.Close()
+	m := clientmodel.Metric{clientmodel.MetricNameLabel: "testmetric", "a": "1"}
+	for _, v := range []clientmodel.LabelValue{"1", "2"} {
+		storage.Append(&clientmodel.Sample{
+			Metric: clientmodel.Metric{
+				clientmodel.MetricNameLabel: "testmetric",
+				"a":                         v,
+			},
+			Timestamp: testTimestamp,
+		})
+	}
+	storage.WaitForIndexing()
+
+	api := MetricsService{
+		Now:     testNow,
+		Storage: storage,
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/api/admin/check_series", http.HandlerFunc(api.CheckSeries))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	scenarios := []struct {
+		params     url.Values
+		status     int
+		numChecked int
+	}{
+		{params: url.Values{}, status: http.StatusBadRequest},
+		{params: url.Values{"fingerprint": {"xyz"}}, status: http.StatusBadRequest},
+		{params: url.Values{"match": {"testmetric"}, "fingerprint": {m.Fingerprint().String()}}, status: http.StatusBadRequest},
+		{params: url.Values{"match": {"sum(testmetric)"}}, status: http.StatusBadRequest},
+		{params: url.Values{"match": {"testmetric"}}, status: http.StatusOK, numChecked: 2},
+		{params: url.Values{"fingerprint": {m.Fingerprint().String()}}, status: http.StatusOK, numChecked: 1},
+	}
+	for i, s := range scenarios {
+		resp, err := http.PostForm(server.URL+"/api/admin/check_series", s.params)
+		if err != nil {
+			t.Fatalf("%d. Error calling API: %s", i, err)
+		}
+		if resp.StatusCode != s.status {
+			resp.Body.Close()
+			t.Fatalf("%d. Unexpected status code; got %d, want %d", i, resp.StatusCode, s.status)
+		}
+		if s.status != http.StatusOK {
+			resp.Body.Close()
+			continue
+		}
+		var result struct {
+			NumChecked      int                 `json:"numChecked"`
+			NumInconsistent int                 `json:"numInconsistent"`
+			Series          []local.SeriesCheck `json:"series"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("%d. Error decoding response: %s", i, err)
+		}
+		if result.NumChecked != s.numChecked || len(result.Series) != s.numChecked || result.NumInconsistent != 0 {
+			t.Errorf("%d. Unexpected check result: %+v", i, result)
+		}
+		for _, c := range result.Series {
+			if c.State != local.SeriesInMemory {
+				t.Errorf("%d. Unexpected state of series %v: %s", i, c.Metric, c.State)
+			}
+		}
+	}
+}
@@ -20,14 +20,16 @@ import (
 
 	clientmodel "github.com/prometheus/client_golang/model"
 
+	"github.com/prometheus/prometheus/retrieval"
 	"github.com/prometheus/prometheus/storage/local"
 	"github.com/prometheus/prometheus/web/httputils"
 )
 
 // MetricsService manages the /api HTTP endpoint.
 type MetricsService struct {
-	Now     func() clientmodel.Timestamp
-	Storage local.Storage
+	Now           func() clientmodel.Timestamp
+	Storage       local.Storage
+	TargetManager retrieval.TargetManager
 }
 
 // RegisterHandler registers the handler for the various endpoints below /api.
@@ -43,7 +45,43 @@ func (msrv *MetricsService) RegisterHandler(pathPrefix string) {
 	http.Handle(pathPrefix+"api/query_range", prometheus.InstrumentHandler(
 		pathPrefix+"api/query_range", handler(msrv.QueryRange),
 	))
+	http.Handle(pathPrefix+"api/v1/query", prometheus.InstrumentHandler(
+		pathPrefix+"api/v1/query", handler(msrv.QueryV1),
+	))
+	http.Handle(pathPrefix+"api/v1/query_range", prometheus.InstrumentHandler(
+		pathPrefix+"api/v1/query_range", handler(msrv.QueryRangeV1),
+	))
+	http.Handle(pathPrefix+"api/v1/series", prometheus.InstrumentHandler(
+		pathPrefix+"api/v1/series", handler(msrv.SeriesV1),
+	))
+	http.Handle(pathPrefix+"api/v1/labels", prometheus.InstrumentHandler(
+		pathPrefix+"api/v1/labels", handler(msrv.LabelNamesV1),
+	))
+	http.Handle(pathPrefix+"api/v1/label/", prometheus.InstrumentHandler(
+		pathPrefix+"api/v1/label", handler(msrv.LabelValuesV1),
+	))
+	http.Handle(pathPrefix+"api/v1/targets", prometheus.InstrumentHandler(
+		pathPrefix+"api/v1/targets", handler(msrv.TargetsV1),
+	))
+	http.Handle(pathPrefix+"api/v1/queries", prometheus.InstrumentHandler(
+		pathPrefix+"api/v1/queries", handler(msrv.ActiveQueriesV1),
+	))
 	http.Handle(pathPrefix+"api/metrics", prometheus.InstrumentHandler(
 		pathPrefix+"api/metrics", handler(msrv.Metrics),
 	))
+	http.Handle(pathPrefix+"api/memory_consumers", prometheus.InstrumentHandler(
+		pathPrefix+"api/memory_consumers", handler(msrv.MemoryConsumers),
+	))
+	http.Handle(pathPrefix+"api/disk_usage", prometheus.InstrumentHandler(
+		pathPrefix+"api/disk_usage", handler(msrv.DiskUsage),
+	))
+	http.Handle(pathPrefix+"api/status/cardinality", prometheus.InstrumentHandler(
+		pathPrefix+"api/status/cardinality", handler(msrv.Cardinality),
+	))
+	http.Handle(pathPrefix+"api/status/churn", prometheus.InstrumentHandler(
+		pathPrefix+"api/status/churn", handler(msrv.Churn),
+	))
+	http.Handle(pathPrefix+"api/status/storage", prometheus.InstrumentHandler(
+		pathPrefix+"api/status/storage", handler(msrv.StorageStatus),
+	))
 }
@@ -17,6 +17,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"sort"
 	"strconv"
@@ -29,9 +30,27 @@ import (
 	"github.com/prometheus/prometheus/rules"
 	"github.com/prometheus/prometheus/rules/ast"
 	"github.com/prometheus/prometheus/stats"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
 	"github.com/prometheus/prometheus/web/httputils"
 )
 
+// defaultMemoryConsumersLimit is the number of entries returned per category by
+// the /api/memory_consumers endpoint if no limit is requested.
+const defaultMemoryConsumersLimit = 10
+
+// defaultDiskUsageLimit is the number of metric names returned by the
+// /api/disk_usage endpoint if no limit is requested.
+const defaultDiskUsageLimit = 10
+
+// defaultCardinalityLimit is the number of entries returned per category by
+// the /api/status/cardinality endpoint if no limit is requested.
+const defaultCardinalityLimit = 10
+
+// defaultChurnLimit is the number of metric names returned by the
+// /api/status/churn endpoint if no limit is requested.
+const defaultChurnLimit = 10
+
 // Enables cross-site script calls.
 func setAccessControlHeaders(w http.ResponseWriter) {
 	w.Header().Set("Access-Control-Allow-Headers", "Accept, Authorization, Content-Type, Origin")
@@ -40,6 +59,16 @@ func setAccessControlHeaders(w http.ResponseWriter) {
 	w.Header().Set("Access-Control-Expose-Headers", "Date")
 }
 
+// clientHost returns the host the request originates from, used to take turns
+// between clients when queries have to wait for evaluation.
+func clientHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func httpJSONError(w http.ResponseWriter, err error, code int) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
@@ -66,7 +95,8 @@ func parseDuration(d string) (time.Duration, error) {
 	return time.Duration(dFloat * float64(time.Second/time.Nanosecond)), nil
 }
 
-// Query handles the /api/query endpoint.
+// Query handles the /api/query endpoint used by the graph page. New clients
+// should use the /api/v1/query endpoint, see QueryV1.
 func (serv MetricsService) Query(w http.ResponseWriter, r *http.Request) {
 	setAccessControlHeaders(w)
 	w.Header().Set("Content-Type", "application/json")
@@ -86,13 +116,22 @@ func (serv MetricsService) Query(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	query, err := ast.RegisterQuery(exprNode, clientHost(r))
+	if err != nil {
+		fmt.Fprint(w, ast.ErrorToJSON(err))
+		return
+	}
+	defer query.Done()
 	queryStats := stats.NewTimerGroup()
 	result := ast.EvalToString(exprNode, timestamp, ast.JSON, serv.Storage, queryStats)
 	glog.V(1).Infof("Instant query: %s\nQuery stats:\n%s\n", expr, queryStats)
+	ast.LogIfSlow(exprNode, queryStats)
 	fmt.Fprint(w, result)
 }
 
-// QueryRange handles the /api/query_range endpoint.
+// QueryRange handles the /api/query_range endpoint used by the graph page and
+// the consoles. New clients should use the /api/v1/query_range endpoint, see
+// QueryRangeV1.
 func (serv MetricsService) QueryRange(w http.ResponseWriter, r *http.Request) {
 	setAccessControlHeaders(w)
 	w.Header().Set("Content-Type", "application/json")
@@ -145,6 +184,12 @@ func (serv MetricsService) QueryRange(w http.ResponseWriter, r *http.Request) {
 	// Align the start to step "tick" boundary.
 	end = end.Add(-time.Duration(end.UnixNano() % int64(step)))
 
+	query, err := ast.RegisterQuery(exprNode, clientHost(r))
+	if err != nil {
+		fmt.Fprint(w, ast.ErrorToJSON(err))
+		return
+	}
+	defer query.Done()
 	queryStats := stats.NewTimerGroup()
 
 	matrix, err := ast.EvalVectorRange(
@@ -154,6 +199,7 @@ func (serv MetricsService) QueryRange(w http.ResponseWriter, r *http.Request) {
 		step,
 		serv.Storage,
 		queryStats)
+	ast.LogIfSlow(exprNode, queryStats)
 	if err != nil {
 		fmt.Fprint(w, ast.ErrorToJSON(err))
 		return
@@ -186,3 +232,158 @@ func (serv MetricsService) Metrics(w http.ResponseWriter, r *http.Request) {
 	}
 	w.Write(resultBytes)
 }
+
+// MemoryConsumers handles the /api/memory_consumers endpoint. It returns the
+// series and metric names with the highest estimated memory usage in the local
+// storage. The number of entries returned per category can be set with the
+// "limit" parameter (default 10).
+func (serv MetricsService) MemoryConsumers(w http.ResponseWriter, r *http.Request) {
+	setAccessControlHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+
+	params := httputils.GetQueryParams(r)
+	limit := defaultMemoryConsumersLimit
+	if l := params.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			httpJSONError(w, fmt.Errorf("invalid limit %q", l), http.StatusBadRequest)
+			return
+		}
+	}
+
+	series, metricNames := serv.Storage.GetTopMemoryConsumers(limit)
+	resultBytes, err := json.Marshal(struct {
+		Series      []local.MemoryConsumer `json:"series"`
+		MetricNames []local.MemoryConsumer `json:"metricNames"`
+	}{
+		Series:      series,
+		MetricNames: metricNames,
+	})
+	if err != nil {
+		glog.Error("Error marshalling memory consumers: ", err)
+		httpJSONError(w, fmt.Errorf("Error marshalling memory consumers: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.Write(resultBytes)
+}
+
+// DiskUsage handles the /api/disk_usage endpoint. It returns the number of
+// series, chunks, and bytes in series files per metric name, for the metric
+// names using the most disk space. The series can be restricted with a series
+// selector in the "match" parameter (e.g. '{job="api"}'). The number of metric
+// names returned can be set with the "limit" parameter (default 10).
+func (serv MetricsService) DiskUsage(w http.ResponseWriter, r *http.Request) {
+	setAccessControlHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+
+	params := httputils.GetQueryParams(r)
+	limit := defaultDiskUsageLimit
+	if l := params.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			httpJSONError(w, fmt.Errorf("invalid limit %q", l), http.StatusBadRequest)
+			return
+		}
+	}
+	var matchers metric.LabelMatchers
+	if match := params.Get("match"); match != "" {
+		exprNode, err := rules.LoadExprFromString(match)
+		if err != nil {
+			httpJSONError(w, err, http.StatusBadRequest)
+			return
+		}
+		selector, ok := exprNode.(*ast.VectorSelector)
+		if !ok {
+			httpJSONError(w, fmt.Errorf("match parameter %q is not a series selector", match), http.StatusBadRequest)
+			return
+		}
+		matchers = selector.LabelMatchers()
+	}
+
+	usage := serv.Storage.GetDiskUsage(matchers)
+	if len(usage) > limit {
+		usage = usage[:limit]
+	}
+	resultBytes, err := json.Marshal(usage)
+	if err != nil {
+		glog.Error("Error marshalling disk usage: ", err)
+		httpJSONError(w, fmt.Errorf("Error marshalling disk usage: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.Write(resultBytes)
+}
+
+// Cardinality handles the /api/status/cardinality endpoint. It returns the
+// label names with the most values, the label pairs with the most series, and
+// the metric names with the most series, as recorded in the label indexes of
+// the local storage. The number of entries returned per category can be set
+// with the "limit" parameter (default 10).
+func (serv MetricsService) Cardinality(w http.ResponseWriter, r *http.Request) {
+	setAccessControlHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+
+	params := httputils.GetQueryParams(r)
+	limit := defaultCardinalityLimit
+	if l := params.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			httpJSONError(w, fmt.Errorf("invalid limit %q", l), http.StatusBadRequest)
+			return
+		}
+	}
+
+	stats, err := serv.Storage.GetCardinalityStats(limit)
+	if err != nil {
+		httpJSONError(w, fmt.Errorf("error reading label indexes: %s", err), http.StatusInternalServerError)
+		return
+	}
+	resultBytes, err := json.Marshal(stats)
+	if err != nil {
+		glog.Error("Error marshalling cardinality stats: ", err)
+		httpJSONError(w, fmt.Errorf("Error marshalling cardinality stats: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.Write(resultBytes)
+}
+
+// Churn handles the /api/status/churn endpoint. It returns the number of series
+// created and archived per metric name since the local storage was started,
+// for the metric names with the most churn. The number of metric names
+// returned can be set with the "limit" parameter (default 10).
+func (serv MetricsService) Churn(w http.ResponseWriter, r *http.Request) {
+	setAccessControlHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+
+	params := httputils.GetQueryParams(r)
+	limit := defaultChurnLimit
+	if l := params.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			httpJSONError(w, fmt.Errorf("invalid limit %q", l), http.StatusBadRequest)
+			return
+		}
+	}
+
+	resultBytes, err := json.Marshal(serv.Storage.GetSeriesChurn(limit))
+	if err != nil {
+		glog.Error("Error marshalling series churn: ", err)
+		httpJSONError(w, fmt.Errorf("Error marshalling series churn: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.Write(resultBytes)
+}
+
+// StorageStatus handles the /api/status/storage endpoint. It returns the
+// internal state of the local storage.
+func (serv MetricsService) StorageStatus(w http.ResponseWriter, r *http.Request) {
+	setAccessControlHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+
+	resultBytes, err := json.Marshal(serv.Storage.Status())
+	if err != nil {
+		glog.Error("Error marshalling storage status: ", err)
+		httpJSONError(w, fmt.Errorf("Error marshalling storage status: %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.Write(resultBytes)
+}
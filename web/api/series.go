@@ -0,0 +1,262 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/rules"
+	"github.com/prometheus/prometheus/rules/ast"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/prometheus/prometheus/web/httputils"
+)
+
+var labelNameRE = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// allSeriesMatcher selects every series, as every series has a metric name.
+var allSeriesMatcher = func() *metric.LabelMatcher {
+	m, err := metric.NewLabelMatcher(metric.RegexMatch, clientmodel.MetricNameLabel, ".+")
+	if err != nil {
+		panic(err)
+	}
+	return m
+}()
+
+// parseMatchParams parses the series selectors of the "match[]" parameters
+// into sets of label matchers.
+func parseMatchParams(selectors []string) ([]metric.LabelMatchers, error) {
+	matcherSets := make([]metric.LabelMatchers, 0, len(selectors))
+	for _, s := range selectors {
+		exprNode, err := rules.LoadExprFromString(s)
+		if err != nil {
+			return nil, err
+		}
+		selector, ok := exprNode.(*ast.VectorSelector)
+		if !ok {
+			return nil, fmt.Errorf("match[] parameter %q is not a series selector", s)
+		}
+		matcherSets = append(matcherSets, selector.LabelMatchers())
+	}
+	return matcherSets, nil
+}
+
+// parseTimeRange parses the optional "start" and "end" parameters. The
+// returned interval is nil if neither is given.
+func parseTimeRange(params url.Values) (*metric.Interval, *apiError) {
+	start, end := params.Get("start"), params.Get("end")
+	if start == "" && end == "" {
+		return nil, nil
+	}
+	in := &metric.Interval{
+		OldestInclusive: clientmodel.Earliest,
+		NewestInclusive: clientmodel.Latest,
+	}
+	var err error
+	if start != "" {
+		if in.OldestInclusive, err = parseTime(start); err != nil {
+			return nil, &apiError{errorBadData, fmt.Errorf("invalid parameter 'start': %s", err)}
+		}
+	}
+	if end != "" {
+		if in.NewestInclusive, err = parseTime(end); err != nil {
+			return nil, &apiError{errorBadData, fmt.Errorf("invalid parameter 'end': %s", err)}
+		}
+	}
+	if in.NewestInclusive.Before(in.OldestInclusive) {
+		return nil, &apiError{errorBadData, fmt.Errorf("end timestamp must not be before start time")}
+	}
+	return in, nil
+}
+
+// seriesParams parses the "match[]", "start", and "end" parameters common to
+// the series metadata endpoints.
+func seriesParams(r *http.Request) ([]metric.LabelMatchers, *metric.Interval, *apiError) {
+	params := httputils.GetQueryParams(r)
+	matcherSets, err := parseMatchParams(params["match[]"])
+	if err != nil {
+		return nil, nil, &apiError{errorBadData, err}
+	}
+	in, apiErr := parseTimeRange(params)
+	if apiErr != nil {
+		return nil, nil, apiErr
+	}
+	return matcherSets, in, nil
+}
+
+// seriesForMatchers returns the metrics of the series matching any of the
+// sets of label matchers, sorted by their string representation. If an
+// interval is given, only series with samples within it are returned.
+func (serv MetricsService) seriesForMatchers(matcherSets []metric.LabelMatchers, in *metric.Interval) ([]clientmodel.Metric, error) {
+	fpSet := map[clientmodel.Fingerprint]struct{}{}
+	for _, matchers := range matcherSets {
+		for _, fp := range serv.Storage.GetFingerprintsForLabelMatchers(matchers) {
+			fpSet[fp] = struct{}{}
+		}
+	}
+	fps := make(clientmodel.Fingerprints, 0, len(fpSet))
+	for fp := range fpSet {
+		fps = append(fps, fp)
+	}
+
+	if in != nil {
+		p := serv.Storage.NewPreloader()
+		defer p.Close()
+		for _, fp := range fps {
+			if err := p.PreloadRange(fp, in.OldestInclusive, in.NewestInclusive, 0); err != nil {
+				return nil, err
+			}
+		}
+	}
+	metrics := make([]clientmodel.Metric, 0, len(fps))
+	for _, fp := range fps {
+		if in != nil && len(serv.Storage.NewIterator(fp).GetBoundaryValues(*in)) == 0 {
+			continue
+		}
+		if m := serv.Storage.GetMetricForFingerprint(fp).Metric; m != nil {
+			metrics = append(metrics, m)
+		}
+	}
+	sort.Sort(metricsByString(metrics))
+	return metrics, nil
+}
+
+// SeriesV1 handles the /api/v1/series endpoint. It returns the metrics of all
+// series matching any of the series selectors given as "match[]" parameters.
+// The optional "start" and "end" parameters restrict the result to series
+// with samples in that time range.
+func (serv MetricsService) SeriesV1(w http.ResponseWriter, r *http.Request) {
+	setAccessControlHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+
+	matcherSets, in, apiErr := seriesParams(r)
+	if apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+	if len(matcherSets) == 0 {
+		respondError(w, &apiError{errorBadData, fmt.Errorf("no match[] parameter given")})
+		return
+	}
+	metrics, err := serv.seriesForMatchers(matcherSets, in)
+	if err != nil {
+		respondError(w, &apiError{errorExecution, err})
+		return
+	}
+	respond(w, metrics)
+}
+
+// LabelNamesV1 handles the /api/v1/labels endpoint. It returns the sorted
+// label names of the series matching any of the optional "match[]" series
+// selectors, or of all series. The optional "start" and "end" parameters
+// restrict the result to series with samples in that time range.
+func (serv MetricsService) LabelNamesV1(w http.ResponseWriter, r *http.Request) {
+	setAccessControlHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+
+	matcherSets, in, apiErr := seriesParams(r)
+	if apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+	if len(matcherSets) == 0 {
+		matcherSets = []metric.LabelMatchers{{allSeriesMatcher}}
+	}
+	metrics, err := serv.seriesForMatchers(matcherSets, in)
+	if err != nil {
+		respondError(w, &apiError{errorExecution, err})
+		return
+	}
+	nameSet := map[clientmodel.LabelName]struct{}{}
+	for _, m := range metrics {
+		for ln := range m {
+			nameSet[ln] = struct{}{}
+		}
+	}
+	names := make(clientmodel.LabelNames, 0, len(nameSet))
+	for ln := range nameSet {
+		names = append(names, ln)
+	}
+	sort.Sort(names)
+	respond(w, names)
+}
+
+// LabelValuesV1 handles the /api/v1/label/<name>/values endpoint. It returns
+// the sorted values of the label for the series matching any of the optional
+// "match[]" series selectors, or for all series. The optional "start" and
+// "end" parameters restrict the result to series with samples in that time
+// range.
+func (serv MetricsService) LabelValuesV1(w http.ResponseWriter, r *http.Request) {
+	setAccessControlHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+
+	if path.Base(r.URL.Path) != "values" {
+		respondError(w, &apiError{errorBadData, fmt.Errorf("invalid path %q", r.URL.Path)})
+		return
+	}
+	name := clientmodel.LabelName(path.Base(path.Dir(r.URL.Path)))
+	if !labelNameRE.MatchString(string(name)) {
+		respondError(w, &apiError{errorBadData, fmt.Errorf("invalid label name %q", name)})
+		return
+	}
+	matcherSets, in, apiErr := seriesParams(r)
+	if apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+
+	var values clientmodel.LabelValues
+	if len(matcherSets) == 0 && in == nil {
+		// The label index answers this without looking at any series.
+		values = serv.Storage.GetLabelValuesForLabelName(name)
+	} else {
+		if len(matcherSets) == 0 {
+			matcherSets = []metric.LabelMatchers{{allSeriesMatcher}}
+		}
+		metrics, err := serv.seriesForMatchers(matcherSets, in)
+		if err != nil {
+			respondError(w, &apiError{errorExecution, err})
+			return
+		}
+		valueSet := map[clientmodel.LabelValue]struct{}{}
+		for _, m := range metrics {
+			if lv, ok := m[name]; ok {
+				valueSet[lv] = struct{}{}
+			}
+		}
+		values = make(clientmodel.LabelValues, 0, len(valueSet))
+		for lv := range valueSet {
+			values = append(values, lv)
+		}
+	}
+	if values == nil {
+		values = clientmodel.LabelValues{}
+	}
+	sort.Sort(values)
+	respond(w, values)
+}
+
+// metricsByString implements sort.Interface, sorting metrics by their string
+// representation.
+type metricsByString []clientmodel.Metric
+
+func (m metricsByString) Len() int           { return len(m) }
+func (m metricsByString) Less(i, j int) bool { return m[i].String() < m[j].String() }
+func (m metricsByString) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
@@ -0,0 +1,145 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/local"
+)
+
+func TestSeriesMetadataV1(t *testing.T) {
+	storage, closer := local.NewTestStorage(t, 1)
+	defer closer.Close()
+	for _, s := range []struct {
+		m  clientmodel.Metric
+		ts clientmodel.Timestamp
+	}{
+		{clientmodel.Metric{clientmodel.MetricNameLabel: "up", "job": "api", "instance": "a"}, testTimestamp},
+		{clientmodel.Metric{clientmodel.MetricNameLabel: "up", "job": "db"}, testTimestamp.Add(-time.Hour)},
+		{clientmodel.Metric{clientmodel.MetricNameLabel: "requests", "job": "api", "path": "/"}, testTimestamp},
+	} {
+		storage.Append(&clientmodel.Sample{Metric: s.m, Timestamp: s.ts, Value: 1})
+	}
+	storage.WaitForIndexing()
+
+	serv := MetricsService{
+		Now:     testNow,
+		Storage: storage,
+	}
+	recent := testTimestamp.Add(-time.Minute).String()
+
+	scenarios := []struct {
+		handler func(http.ResponseWriter, *http.Request)
+		path    string
+		params  url.Values
+		status  int
+		body    string
+	}{
+		{
+			handler: serv.SeriesV1,
+			path:    "/api/v1/series",
+			params:  url.Values{"match[]": {`up{job="api"}`, `{job="db"}`}},
+			status:  http.StatusOK,
+			body:    `{"status":"success","data":[{"__name__":"up","instance":"a","job":"api"},{"__name__":"up","job":"db"}]}`,
+		},
+		{
+			handler: serv.SeriesV1,
+			path:    "/api/v1/series",
+			params:  url.Values{"match[]": {"up"}, "start": {recent}},
+			status:  http.StatusOK,
+			body:    `{"status":"success","data":[{"__name__":"up","instance":"a","job":"api"}]}`,
+		},
+		{
+			handler: serv.SeriesV1,
+			path:    "/api/v1/series",
+			status:  http.StatusBadRequest,
+			body:    `{"status":"error","errorType":"bad_data","error":"no match[] parameter given"}`,
+		},
+		{
+			handler: serv.SeriesV1,
+			path:    "/api/v1/series",
+			params:  url.Values{"match[]": {"sum(up)"}},
+			status:  http.StatusBadRequest,
+			body:    `{"status":"error","errorType":"bad_data","error":"match[] parameter \"sum(up)\" is not a series selector"}`,
+		},
+		{
+			handler: serv.LabelNamesV1,
+			path:    "/api/v1/labels",
+			status:  http.StatusOK,
+			body:    `{"status":"success","data":["__name__","instance","job","path"]}`,
+		},
+		{
+			handler: serv.LabelNamesV1,
+			path:    "/api/v1/labels",
+			params:  url.Values{"match[]": {"up"}, "start": {recent}},
+			status:  http.StatusOK,
+			body:    `{"status":"success","data":["__name__","instance","job"]}`,
+		},
+		{
+			handler: serv.LabelValuesV1,
+			path:    "/api/v1/label/job/values",
+			status:  http.StatusOK,
+			body:    `{"status":"success","data":["api","db"]}`,
+		},
+		{
+			handler: serv.LabelValuesV1,
+			path:    "/api/v1/label/job/values",
+			params:  url.Values{"match[]": {"up"}, "end": {recent}},
+			status:  http.StatusOK,
+			body:    `{"status":"success","data":["db"]}`,
+		},
+		{
+			handler: serv.LabelValuesV1,
+			path:    "/api/v1/label/nonexistent/values",
+			status:  http.StatusOK,
+			body:    `{"status":"success","data":[]}`,
+		},
+		{
+			handler: serv.LabelValuesV1,
+			path:    "/api/v1/label/job-name/values",
+			status:  http.StatusBadRequest,
+			body:    `{"status":"error","errorType":"bad_data","error":"invalid label name \"job-name\""}`,
+		},
+		{
+			handler: serv.LabelValuesV1,
+			path:    "/api/v1/label/job/values",
+			params:  url.Values{"start": {recent}, "end": {"0"}},
+			status:  http.StatusBadRequest,
+			body:    `{"status":"error","errorType":"bad_data","error":"end timestamp must not be before start time"}`,
+		},
+	}
+
+	for i, s := range scenarios {
+		req, err := http.NewRequest("GET", "http://example.org"+s.path+"?"+s.params.Encode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		s.handler(w, req)
+
+		if w.Code != s.status {
+			t.Errorf("%d. got status code %d, want %d", i, w.Code, s.status)
+		}
+		if got := w.Body.String(); got != s.body {
+			t.Errorf("%d. got body %s, want %s", i, got, s.body)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/retrieval"
+)
+
+// targetStatus is the v1 representation of a scrape target.
+type targetStatus struct {
+	Job       string `json:"job"`
+	ScrapeURL string `json:"scrapeUrl"`
+	// The labels attached to the scraped series, after relabeling.
+	Labels             clientmodel.LabelSet `json:"labels"`
+	Health             string               `json:"health"`
+	LastScrape         time.Time            `json:"lastScrape"`
+	LastScrapeDuration float64              `json:"lastScrapeDuration"` // In seconds.
+	LastError          string               `json:"lastError"`
+}
+
+// TargetsV1 handles the /api/v1/targets endpoint. It returns the scrape
+// targets of all jobs, or of the job given by the optional "job" parameter,
+// sorted by job and URL, with the state of their last scrape.
+func (serv MetricsService) TargetsV1(w http.ResponseWriter, r *http.Request) {
+	setAccessControlHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+
+	pools := map[string]*retrieval.TargetPool{}
+	if serv.TargetManager != nil {
+		pools = serv.TargetManager.Pools()
+	}
+	jobs := make([]string, 0, len(pools))
+	for job := range pools {
+		if j := r.FormValue("job"); j == "" || j == job {
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Strings(jobs)
+
+	result := []targetStatus{}
+	for _, job := range jobs {
+		for _, t := range pools[job].Targets() {
+			ts := targetStatus{
+				Job:                job,
+				ScrapeURL:          t.URL(),
+				Labels:             t.BaseLabels(),
+				Health:             strings.ToLower(t.State().String()),
+				LastScrape:         t.LastScrape(),
+				LastScrapeDuration: t.LastScrapeDuration().Seconds(),
+			}
+			if err := t.LastError(); err != nil {
+				ts.LastError = err.Error()
+			}
+			result = append(result, ts)
+		}
+	}
+	respond(w, result)
+}
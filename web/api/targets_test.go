@@ -0,0 +1,118 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/retrieval"
+)
+
+type discardAppender struct{}
+
+func (discardAppender) Append(*clientmodel.Sample) {}
+
+func TestTargetsV1(t *testing.T) {
+	exporter := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/metrics" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", `text/plain; version=0.0.4`)
+		w.Write([]byte("test_metric 1\n"))
+	}))
+	defer exporter.Close()
+
+	conf, err := config.LoadFromString(`
+		global <
+			scrape_interval: "1s"
+			labels: < label: < name: "zone" value: "a" > >
+		>
+		job: <
+			name: "api"
+			target_group: < target: "` + exporter.URL + `/metrics" >
+		>
+		job: <
+			name: "broken"
+			target_group: < target: "` + exporter.URL + `/missing" >
+		>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetManager := retrieval.NewTargetManager(discardAppender{}, conf.GlobalLabels())
+	targetManager.AddTargetsFromConfig(conf)
+	defer targetManager.Stop()
+
+	serv := MetricsService{TargetManager: targetManager}
+	server := httptest.NewServer(http.HandlerFunc(serv.TargetsV1))
+	defer server.Close()
+
+	var resp struct {
+		Status string         `json:"status"`
+		Data   []targetStatus `json:"data"`
+	}
+	// Wait for the results of the first scrape of both targets. The time
+	// of a scrape is recorded before its result.
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		r, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = json.NewDecoder(r.Body).Decode(&resp)
+		r.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Data) == 2 && resp.Data[0].Health != "unknown" && resp.Data[1].Health != "unknown" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("targets not scraped in time: %+v", resp.Data)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	api, broken := resp.Data[0], resp.Data[1]
+	if api.Job != "api" || api.ScrapeURL != exporter.URL+"/metrics" || api.Health != "healthy" || api.LastError != "" {
+		t.Errorf("unexpected status of target api: %+v", api)
+	}
+	if api.Labels["zone"] != "a" || api.Labels[clientmodel.JobLabel] != "api" {
+		t.Errorf("unexpected labels of target api: %v", api.Labels)
+	}
+	if api.LastScrapeDuration <= 0 {
+		t.Errorf("unexpected scrape duration of target api: %v", api.LastScrapeDuration)
+	}
+	if broken.Job != "broken" || broken.Health != "unhealthy" || broken.LastError != "server returned HTTP status 404 Not Found" {
+		t.Errorf("unexpected status of target broken: %+v", broken)
+	}
+
+	r, err := http.Get(server.URL + "?job=broken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Data) != 1 || resp.Data[0].Job != "broken" {
+		t.Errorf("unexpected targets for job broken: %+v", resp.Data)
+	}
+}
@@ -0,0 +1,591 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/rules"
+	"github.com/prometheus/prometheus/rules/ast"
+	"github.com/prometheus/prometheus/stats"
+	"github.com/prometheus/prometheus/utility"
+	"github.com/prometheus/prometheus/web/httputils"
+)
+
+// The maximum number of points per series a range query may return. This is
+// sufficient for 60s resolution for a week or 1h resolution for a year.
+const maxPointsPerSeries = 11000
+
+// The number of steps evaluated at once when streaming the result of a range
+// query. Only the samples and chunks of one window are held in memory at a
+// time.
+const streamWindowSteps = 1000
+
+const (
+	statusSuccess = "success"
+	statusError   = "error"
+)
+
+// errorType classifies the errors returned by the v1 API.
+type errorType string
+
+const (
+	errorBadData   errorType = "bad_data"
+	errorTimeout   errorType = "timeout"
+	errorExecution errorType = "execution"
+	errorLimit     errorType = "limit_exceeded"
+	errorCanceled  errorType = "canceled"
+	errorOverload  errorType = "overloaded"
+	errorInternal  errorType = "internal"
+)
+
+// statusCodes are the HTTP status codes of the error types.
+var statusCodes = map[errorType]int{
+	errorBadData:   http.StatusBadRequest,
+	errorTimeout:   http.StatusServiceUnavailable,
+	errorExecution: 422,
+	errorLimit:     422,
+	errorCanceled:  http.StatusServiceUnavailable,
+	errorOverload:  http.StatusServiceUnavailable,
+	errorInternal:  http.StatusInternalServerError,
+}
+
+// apiError is an error returned by a v1 API endpoint.
+type apiError struct {
+	typ errorType
+	err error
+}
+
+// v1Response is the envelope of all responses of the v1 API.
+type v1Response struct {
+	Status    string      `json:"status"`
+	Data      interface{} `json:"data,omitempty"`
+	ErrorType errorType   `json:"errorType,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	// The positions of the errors in the query if it failed to parse.
+	ParseErrors rules.ParseErrors `json:"parseErrors,omitempty"`
+}
+
+// queryData is the data of a successful query response.
+type queryData struct {
+	ResultType string          `json:"resultType"`
+	Result     interface{}     `json:"result"`
+	Stats      *queryStatsData `json:"stats,omitempty"`
+}
+
+// queryStatsData is the cost of a query, returned with "stats=true".
+type queryStatsData struct {
+	IndexLookupSeconds float64 `json:"indexLookupSeconds"`
+	ChunkLoadSeconds   float64 `json:"chunkLoadSeconds"`
+	EvalSeconds        float64 `json:"evalSeconds"`
+	TotalSeconds       float64 `json:"totalSeconds"`
+	SeriesSelected     int     `json:"seriesSelected"`
+	ChunksLoaded       int     `json:"chunksLoaded"`
+	SamplesDecoded     int     `json:"samplesDecoded"`
+}
+
+func newQueryStatsData(queryStats *stats.TimerGroup) *queryStatsData {
+	seconds := func(t stats.QueryTiming) float64 {
+		return queryStats.GetTimer(t).Duration().Seconds()
+	}
+	return &queryStatsData{
+		IndexLookupSeconds: seconds(stats.IndexLookupTime),
+		ChunkLoadSeconds:   seconds(stats.PreloadTime),
+		EvalSeconds:        seconds(stats.InnerEvalTime),
+		TotalSeconds:       seconds(stats.TotalEvalTime),
+		SeriesSelected:     queryStats.GetCounter(stats.SeriesSelected).Value(),
+		ChunksLoaded:       queryStats.GetCounter(stats.ChunksLoaded).Value(),
+		SamplesDecoded:     queryStats.GetCounter(stats.SamplesDecoded).Value(),
+	}
+}
+
+// point is a value at a timestamp, encoded as a JSON array of the Unix
+// timestamp in seconds and the value as a string.
+type point struct {
+	timestamp clientmodel.Timestamp
+	value     string
+}
+
+// MarshalJSON implements json.Marshaler.
+func (p point) MarshalJSON() ([]byte, error) {
+	v, err := json.Marshal(p.value)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(fmt.Sprintf("[%s,%s]", p.timestamp, v)), nil
+}
+
+// vectorSample is an element of a vector result.
+type vectorSample struct {
+	Metric clientmodel.Metric `json:"metric"`
+	Value  point              `json:"value"`
+}
+
+// matrixSeries is an element of a matrix result.
+type matrixSeries struct {
+	Metric clientmodel.Metric `json:"metric"`
+	Values []point            `json:"values"`
+}
+
+func respond(w http.ResponseWriter, data interface{}) {
+	w.WriteHeader(http.StatusOK)
+	writeV1Response(w, &v1Response{
+		Status: statusSuccess,
+		Data:   data,
+	})
+}
+
+func respondError(w http.ResponseWriter, apiErr *apiError) {
+	w.WriteHeader(statusCodes[apiErr.typ])
+	resp := &v1Response{
+		Status:    statusError,
+		ErrorType: apiErr.typ,
+		Error:     apiErr.err.Error(),
+	}
+	if errs, ok := apiErr.err.(rules.ParseErrors); ok {
+		resp.ParseErrors = errs
+	}
+	writeV1Response(w, resp)
+}
+
+func writeV1Response(w http.ResponseWriter, resp *v1Response) {
+	b, err := json.Marshal(resp)
+	if err != nil {
+		glog.Error("Error marshalling API response: ", err)
+		return
+	}
+	w.Write(b)
+}
+
+// parseTime parses a Unix timestamp in seconds with optional decimal places or
+// an RFC 3339 timestamp.
+func parseTime(s string) (clientmodel.Timestamp, error) {
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return clientmodel.TimestampFromUnixNano(int64(f * float64(time.Second/time.Nanosecond))), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return clientmodel.TimestampFromTime(t), nil
+	}
+	return 0, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+}
+
+// parseDurationParam parses a number of seconds with optional decimal places
+// or a duration like "5m".
+func parseDurationParam(s string) (time.Duration, error) {
+	if d, err := parseDuration(s); err == nil {
+		return d, nil
+	}
+	if d, err := utility.StringToDuration(s); err == nil {
+		return d, nil
+	}
+	return 0, fmt.Errorf("cannot parse %q to a valid duration", s)
+}
+
+// queryTimeout returns the timeout requested with the "timeout" parameter,
+// limited by the -query.timeout flag.
+func queryTimeout(s string) (time.Duration, error) {
+	timeout := ast.QueryTimeout()
+	if s == "" {
+		return timeout, nil
+	}
+	d, err := parseDurationParam(s)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("timeout must be positive")
+	}
+	if d < timeout {
+		timeout = d
+	}
+	return timeout, nil
+}
+
+// QueryV1 handles the /api/v1/query endpoint. It evaluates the expression in
+// the "query" parameter at the time in the optional "time" parameter (default
+// now). The optional "timeout" parameter shortens the -query.timeout. With
+// "stats=true", the cost of the query is returned along with the result. With
+// "explain=true", the evaluation plan of the expression is returned as a
+// result of type "plan" instead, without evaluating it.
+func (serv MetricsService) QueryV1(w http.ResponseWriter, r *http.Request) {
+	setAccessControlHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+
+	params := httputils.GetQueryParams(r)
+	ts := serv.Now()
+	if t := params.Get("time"); t != "" {
+		var err error
+		if ts, err = parseTime(t); err != nil {
+			respondError(w, &apiError{errorBadData, fmt.Errorf("invalid parameter 'time': %s", err)})
+			return
+		}
+	}
+	timeout, err := queryTimeout(params.Get("timeout"))
+	if err != nil {
+		respondError(w, &apiError{errorBadData, fmt.Errorf("invalid parameter 'timeout': %s", err)})
+		return
+	}
+	exprNode, err := rules.LoadExprFromString(params.Get("query"))
+	if err != nil {
+		respondError(w, &apiError{errorBadData, err})
+		return
+	}
+	if params.Get("explain") == "true" {
+		respond(w, explainData(exprNode, serv))
+		return
+	}
+
+	query, err := ast.RegisterQuery(exprNode, clientHost(r))
+	if err != nil {
+		respondError(w, evalError(err))
+		return
+	}
+	defer query.Done()
+	queryStats := stats.NewTimerGroup()
+	data, apiErr := evalInstant(exprNode, ts, timeout, serv, queryStats)
+	glog.V(1).Infof("Instant query: %s\nQuery stats:\n%s\n", params.Get("query"), queryStats)
+	ast.LogIfSlow(exprNode, queryStats)
+	if apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+	if params.Get("stats") == "true" {
+		data.Stats = newQueryStatsData(queryStats)
+	}
+	respond(w, data)
+}
+
+// explainData returns the evaluation plan of an expression as query data.
+func explainData(node ast.Node, serv MetricsService) *queryData {
+	return &queryData{ResultType: "plan", Result: ast.Explain(node, serv.Storage)}
+}
+
+// evalInstant evaluates an expression of any type at the timestamp.
+func evalInstant(node ast.Node, ts clientmodel.Timestamp, timeout time.Duration, serv MetricsService, queryStats *stats.TimerGroup) (data *queryData, apiErr *apiError) {
+	var abortErr error
+	defer func() {
+		if abortErr != nil {
+			data, apiErr = nil, evalError(abortErr)
+		}
+	}()
+	defer ast.CatchQueryAbort(&abortErr)
+
+	totalEvalTimer := queryStats.GetTimer(stats.TotalEvalTime).Start()
+	defer totalEvalTimer.Stop()
+
+	prepareTimer := queryStats.GetTimer(stats.TotalQueryPreparationTime).Start()
+	closer, err := ast.PrepareInstantQuery(node, ts, serv.Storage, queryStats)
+	prepareTimer.Stop()
+	if err != nil {
+		return nil, evalError(err)
+	}
+	defer closer.Close()
+	if et := totalEvalTimer.ElapsedTime(); et > timeout {
+		return nil, &apiError{errorTimeout, fmt.Errorf("query timeout after %v", et)}
+	}
+
+	evalTimer := queryStats.GetTimer(stats.InnerEvalTime).Start()
+	defer evalTimer.Stop()
+	switch node.Type() {
+	case ast.ScalarType:
+		v := node.(ast.ScalarNode).Eval(ts)
+		return &queryData{ResultType: "scalar", Result: point{ts, v.String()}}, nil
+	case ast.StringType:
+		s := node.(ast.StringNode).Eval(ts)
+		return &queryData{ResultType: "string", Result: point{ts, s}}, nil
+	case ast.VectorType:
+		vector := node.(ast.VectorNode).Eval(ts)
+		result := make([]vectorSample, 0, len(vector))
+		for _, s := range vector {
+			result = append(result, vectorSample{
+				Metric: metricOrEmpty(s.Metric.Metric),
+				Value:  point{s.Timestamp, s.Value.String()},
+			})
+		}
+		return &queryData{ResultType: "vector", Result: result}, nil
+	case ast.MatrixType:
+		return &queryData{ResultType: "matrix", Result: matrixResult(node.(ast.MatrixNode).Eval(ts))}, nil
+	default:
+		return nil, &apiError{errorInternal, fmt.Errorf("unexpected expression type %v", node.Type())}
+	}
+}
+
+// QueryRangeV1 handles the /api/v1/query_range endpoint. It evaluates the
+// vector expression in the "query" parameter at every "step" from the "start"
+// to the "end" time, both inclusive. The optional "timeout" parameter
+// shortens the -query.timeout.
+//
+// With "stream=true", the range is evaluated in windows of consecutive steps,
+// and the matrix of each window is written as a separate line holding a
+// complete response as soon as it is evaluated. Clients concatenate the
+// values of the series with equal metrics. The maximum number of points per
+// series does not apply to streamed queries.
+//
+// The "stats" and "explain" parameters work as for QueryV1. Stats are not
+// returned for streamed queries.
+func (serv MetricsService) QueryRangeV1(w http.ResponseWriter, r *http.Request) {
+	setAccessControlHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+
+	params := httputils.GetQueryParams(r)
+	start, err := parseTime(params.Get("start"))
+	if err != nil {
+		respondError(w, &apiError{errorBadData, fmt.Errorf("invalid parameter 'start': %s", err)})
+		return
+	}
+	end, err := parseTime(params.Get("end"))
+	if err != nil {
+		respondError(w, &apiError{errorBadData, fmt.Errorf("invalid parameter 'end': %s", err)})
+		return
+	}
+	if end.Before(start) {
+		respondError(w, &apiError{errorBadData, fmt.Errorf("end timestamp must not be before start time")})
+		return
+	}
+	step, err := parseDurationParam(params.Get("step"))
+	if err != nil {
+		respondError(w, &apiError{errorBadData, fmt.Errorf("invalid parameter 'step': %s", err)})
+		return
+	}
+	if step <= 0 {
+		respondError(w, &apiError{errorBadData, fmt.Errorf("zero or negative query resolution step widths are not accepted")})
+		return
+	}
+	stream := params.Get("stream") == "true"
+	if !stream && end.Sub(start)/step > maxPointsPerSeries {
+		respondError(w, &apiError{errorBadData, fmt.Errorf("exceeded maximum resolution of %d points per timeseries, try decreasing the query resolution (?step=XX) or streaming the result (?stream=true)", maxPointsPerSeries)})
+		return
+	}
+	timeout, err := queryTimeout(params.Get("timeout"))
+	if err != nil {
+		respondError(w, &apiError{errorBadData, fmt.Errorf("invalid parameter 'timeout': %s", err)})
+		return
+	}
+	exprNode, err := rules.LoadExprFromString(params.Get("query"))
+	if err != nil {
+		respondError(w, &apiError{errorBadData, err})
+		return
+	}
+	vectorNode, ok := exprNode.(ast.VectorNode)
+	if !ok || exprNode.Type() != ast.VectorType {
+		respondError(w, &apiError{errorBadData, fmt.Errorf("expression must evaluate to a vector for range queries, got %v", exprNode.Type())})
+		return
+	}
+	if params.Get("explain") == "true" {
+		respond(w, explainData(exprNode, serv))
+		return
+	}
+
+	query, err := ast.RegisterQuery(exprNode, clientHost(r))
+	if err != nil {
+		respondError(w, evalError(err))
+		return
+	}
+	defer query.Done()
+	queryStats := stats.NewTimerGroup()
+	if stream {
+		serv.streamRange(w, vectorNode, start, end, step, timeout, queryStats)
+		glog.V(1).Infof("Streamed range query: %s\nQuery stats:\n%s\n", params.Get("query"), queryStats)
+		ast.LogIfSlow(exprNode, queryStats)
+		return
+	}
+	matrix, apiErr := evalRange(vectorNode, start, end, step, timeout, serv, queryStats)
+	glog.V(1).Infof("Range query: %s\nQuery stats:\n%s\n", params.Get("query"), queryStats)
+	ast.LogIfSlow(exprNode, queryStats)
+	if apiErr != nil {
+		respondError(w, apiErr)
+		return
+	}
+	var statsData *queryStatsData
+	if params.Get("stats") == "true" {
+		statsData = newQueryStatsData(queryStats)
+	}
+	w.WriteHeader(http.StatusOK)
+	writeMatrixResponse(w, matrix, statsData)
+}
+
+// evalRange evaluates a vector expression over a range and sorts the result.
+func evalRange(node ast.VectorNode, start, end clientmodel.Timestamp, step, timeout time.Duration, serv MetricsService, queryStats *stats.TimerGroup) (ast.Matrix, *apiError) {
+	matrix, err := ast.EvalVectorRangeWithTimeout(node, start, end, step, timeout, serv.Storage, queryStats)
+	if err != nil {
+		return nil, evalError(err)
+	}
+
+	sortTimer := queryStats.GetTimer(stats.ResultSortTime).Start()
+	sort.Sort(matrix)
+	sortTimer.Stop()
+	return matrix, nil
+}
+
+// evalError classifies an error returned by the query engine.
+func evalError(err error) *apiError {
+	switch {
+	case ast.IsQueryTimeout(err):
+		return &apiError{errorTimeout, err}
+	case ast.IsQueryLimitExceeded(err):
+		return &apiError{errorLimit, err}
+	case ast.IsQueryCanceled(err):
+		return &apiError{errorCanceled, err}
+	case ast.IsQueryQueueFull(err):
+		return &apiError{errorOverload, err}
+	default:
+		return &apiError{errorExecution, err}
+	}
+}
+
+// streamRange evaluates a range query window by window and writes the result
+// of each window as a line as soon as it is evaluated. The timeout applies to
+// the whole query. An error before the first line results in a regular error
+// response, a later one ends the stream with an error line.
+func (serv MetricsService) streamRange(w http.ResponseWriter, node ast.VectorNode, start, end clientmodel.Timestamp, step, timeout time.Duration, queryStats *stats.TimerGroup) {
+	begin := time.Now()
+	window := step * streamWindowSteps
+	for windowStart := start; !windowStart.After(end); windowStart = windowStart.Add(window) {
+		windowEnd := windowStart.Add(window - step)
+		if windowEnd.After(end) {
+			windowEnd = end
+		}
+		matrix, apiErr := evalRange(node, windowStart, windowEnd, step, timeout-time.Since(begin), serv, queryStats)
+		if apiErr != nil {
+			if windowStart.Equal(start) {
+				respondError(w, apiErr)
+			} else {
+				writeV1Response(w, &v1Response{
+					Status:    statusError,
+					ErrorType: apiErr.typ,
+					Error:     apiErr.err.Error(),
+				})
+				w.Write([]byte("\n"))
+			}
+			return
+		}
+		if windowStart.Equal(start) {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.WriteHeader(http.StatusOK)
+		}
+		writeMatrixResponse(w, matrix, nil)
+		w.Write([]byte("\n"))
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+}
+
+// writeMatrixResponse writes a successful response with a matrix result and
+// optional stats. The series are encoded one at a time, so that the encoded
+// response is never held in memory as a whole.
+func writeMatrixResponse(w io.Writer, matrix ast.Matrix, statsData *queryStatsData) {
+	if _, err := io.WriteString(w, `{"status":"success","data":{"resultType":"matrix","result":[`); err != nil {
+		return
+	}
+	for i, ss := range matrix {
+		values := make([]point, 0, len(ss.Values))
+		for _, v := range ss.Values {
+			values = append(values, point{v.Timestamp, v.Value.String()})
+		}
+		b, err := json.Marshal(matrixSeries{
+			Metric: metricOrEmpty(ss.Metric.Metric),
+			Values: values,
+		})
+		if err != nil {
+			glog.Error("Error marshalling API response: ", err)
+			return
+		}
+		if i > 0 {
+			b = append([]byte{','}, b...)
+		}
+		if _, err := w.Write(b); err != nil {
+			return
+		}
+	}
+	if _, err := io.WriteString(w, "]"); err != nil {
+		return
+	}
+	if statsData != nil {
+		b, err := json.Marshal(statsData)
+		if err != nil {
+			glog.Error("Error marshalling API response: ", err)
+			return
+		}
+		if _, err := fmt.Fprintf(w, `,"stats":%s`, b); err != nil {
+			return
+		}
+	}
+	io.WriteString(w, "}}")
+}
+
+// matrixResult converts a matrix into the v1 representation.
+func matrixResult(matrix ast.Matrix) []matrixSeries {
+	result := make([]matrixSeries, 0, len(matrix))
+	for _, ss := range matrix {
+		values := make([]point, 0, len(ss.Values))
+		for _, v := range ss.Values {
+			values = append(values, point{v.Timestamp, v.Value.String()})
+		}
+		result = append(result, matrixSeries{
+			Metric: metricOrEmpty(ss.Metric.Metric),
+			Values: values,
+		})
+	}
+	return result
+}
+
+// metricOrEmpty returns an empty metric for nil, which would be encoded as
+// null in JSON.
+func metricOrEmpty(m clientmodel.Metric) clientmodel.Metric {
+	if m == nil {
+		return clientmodel.Metric{}
+	}
+	return m
+}
+
+// activeQuery is the v1 representation of a query being evaluated.
+type activeQuery struct {
+	ID       uint64    `json:"id"`
+	Query    string    `json:"query"`
+	Client   string    `json:"client"`
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration"` // In seconds.
+}
+
+// ActiveQueriesV1 handles the /api/v1/queries endpoint. It lists the queries
+// currently evaluated on behalf of API clients, oldest first. They can be
+// canceled with the /api/admin/cancel_query endpoint.
+func (serv MetricsService) ActiveQueriesV1(w http.ResponseWriter, r *http.Request) {
+	setAccessControlHeaders(w)
+	w.Header().Set("Content-Type", "application/json")
+
+	queries := ast.ActiveQueries()
+	result := make([]activeQuery, 0, len(queries))
+	for _, q := range queries {
+		result = append(result, activeQuery{
+			ID:       q.ID,
+			Query:    q.Expr,
+			Client:   q.Client,
+			Start:    q.Start,
+			Duration: time.Since(q.Start).Seconds(),
+		})
+	}
+	respond(w, result)
+}
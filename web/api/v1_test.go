@@ -0,0 +1,269 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+
+	"github.com/prometheus/prometheus/storage/local"
+)
+
+func TestQueryV1(t *testing.T) {
+	storage, closer := local.NewTestStorage(t, 1)
+	defer closer.Close()
+	for i := 0; i < 3; i++ {
+		storage.Append(&clientmodel.Sample{
+			Metric: clientmodel.Metric{
+				clientmodel.MetricNameLabel: "testmetric",
+			},
+			Timestamp: testTimestamp.Add(time.Duration(i-2) * time.Minute),
+			Value:     clientmodel.SampleValue(i),
+		})
+	}
+	storage.WaitForIndexing()
+
+	serv := MetricsService{
+		Now:     testNow,
+		Storage: storage,
+	}
+	ts := testTimestamp.String()
+	start := testTimestamp.Add(-2 * time.Minute).String()
+
+	scenarios := []struct {
+		handler func(http.ResponseWriter, *http.Request)
+		params  url.Values
+		status  int
+		bodyRe  string
+	}{
+		{
+			handler: serv.QueryV1,
+			params:  url.Values{"query": {"testmetric"}},
+			status:  http.StatusOK,
+			bodyRe:  `^{"status":"success","data":{"resultType":"vector","result":\[{"metric":{"__name__":"testmetric"},"value":\[` + ts + `,"2"\]}\]}}$`,
+		},
+		{
+			handler: serv.QueryV1,
+			params:  url.Values{"query": {"testmetric"}, "time": {testTimestamp.Time().UTC().Format(time.RFC3339Nano)}},
+			status:  http.StatusOK,
+			bodyRe:  `"value":\[` + ts + `,"2"\]`,
+		},
+		{
+			handler: serv.QueryV1,
+			params:  url.Values{"query": {"1 + 1"}, "time": {ts}},
+			status:  http.StatusOK,
+			bodyRe:  `^{"status":"success","data":{"resultType":"scalar","result":\[` + ts + `,"2"\]}}$`,
+		},
+		{
+			handler: serv.QueryV1,
+			params:  url.Values{"query": {"testmetric[1m]"}},
+			status:  http.StatusOK,
+			bodyRe:  `"resultType":"matrix","result":\[{"metric":{"__name__":"testmetric"},"values":\[\[[0-9.]+,"1"\],\[` + ts + `,"2"\]\]}\]`,
+		},
+		{
+			handler: serv.QueryV1,
+			params:  url.Values{"query": {"testmetric"}, "stats": {"true"}},
+			status:  http.StatusOK,
+			bodyRe:  `"result":\[.*\],"stats":{"indexLookupSeconds":[0-9.e-]+,"chunkLoadSeconds":[0-9.e-]+,"evalSeconds":[0-9.e-]+,"totalSeconds":[0-9.e-]+,"seriesSelected":1,"chunksLoaded":1,"samplesDecoded":1}}}$`,
+		},
+		{
+			handler: serv.QueryV1,
+			params:  url.Values{"query": {"sum(testmetric offset 1m) BY (job)"}, "explain": {"true"}},
+			status:  http.StatusOK,
+			bodyRe:  `^{"status":"success","data":{"resultType":"plan","result":{"operation":"SUM BY \(job\)","type":"vector","children":\[{"operation":"testmetric","type":"vector","series":1,"offset":"1m"}\]}}}$`,
+		},
+		{
+			handler: serv.QueryV1,
+			params:  url.Values{"query": {"testmetric"}, "time": {"yesterday"}},
+			status:  http.StatusBadRequest,
+			bodyRe:  `^{"status":"error","errorType":"bad_data","error":"invalid parameter 'time'`,
+		},
+		{
+			handler: serv.QueryV1,
+			params:  url.Values{"query": {"(testmetric"}},
+			status:  http.StatusBadRequest,
+			bodyRe:  `"errorType":"bad_data","error":".*syntax error`,
+		},
+		{
+			handler: serv.QueryV1,
+			params:  url.Values{"query": {"sum(testmetric) BY job"}},
+			status:  http.StatusBadRequest,
+			bodyRe:  `"parseErrors":\[{"line":1,"column":20,"token":"job","message":"syntax error: unexpected IDENTIFIER, expecting '\('"}\]}$`,
+		},
+		{
+			handler: serv.QueryV1,
+			params:  url.Values{"query": {"testmetric"}, "timeout": {"-1s"}},
+			status:  http.StatusBadRequest,
+			bodyRe:  `invalid parameter 'timeout'`,
+		},
+		{
+			handler: serv.QueryRangeV1,
+			params:  url.Values{"query": {"testmetric"}, "start": {start}, "end": {ts}, "step": {"1m"}},
+			status:  http.StatusOK,
+			bodyRe:  `^{"status":"success","data":{"resultType":"matrix","result":\[{"metric":{"__name__":"testmetric"},"values":\[\[` + start + `,"0"\],\[[0-9.]+,"1"\],\[` + ts + `,"2"\]\]}\]}}$`,
+		},
+		{
+			handler: serv.QueryRangeV1,
+			params:  url.Values{"query": {"testmetric"}, "start": {start}, "end": {ts}, "step": {"60"}, "timeout": {"30s"}},
+			status:  http.StatusOK,
+			bodyRe:  `"values":\[\[` + start + `,"0"\]`,
+		},
+		{
+			handler: serv.QueryRangeV1,
+			params:  url.Values{"query": {"testmetric"}, "start": {start}, "end": {ts}, "step": {"1m"}, "stats": {"true"}},
+			status:  http.StatusOK,
+			bodyRe:  `"values":\[.*\]}\],"stats":{.*"seriesSelected":1,"chunksLoaded":1,"samplesDecoded":3}}}$`,
+		},
+		{
+			handler: serv.QueryRangeV1,
+			params:  url.Values{"query": {"rate(testmetric[5m])"}, "start": {start}, "end": {ts}, "step": {"1m"}, "explain": {"true"}},
+			status:  http.StatusOK,
+			bodyRe:  `^{"status":"success","data":{"resultType":"plan","result":{"operation":"rate","type":"vector","children":\[{"operation":"testmetric","type":"matrix","series":1,"range":"5m"}\]}}}$`,
+		},
+		{
+			handler: serv.QueryRangeV1,
+			params:  url.Values{"query": {"testmetric"}, "start": {ts}, "end": {start}, "step": {"1m"}},
+			status:  http.StatusBadRequest,
+			bodyRe:  `end timestamp must not be before start time`,
+		},
+		{
+			handler: serv.QueryRangeV1,
+			params:  url.Values{"query": {"testmetric"}, "start": {start}, "end": {ts}, "step": {"0"}},
+			status:  http.StatusBadRequest,
+			bodyRe:  `step widths are not accepted`,
+		},
+		{
+			handler: serv.QueryRangeV1,
+			params:  url.Values{"query": {"testmetric"}, "start": {"0"}, "end": {ts}, "step": {"1"}},
+			status:  http.StatusBadRequest,
+			bodyRe:  `exceeded maximum resolution`,
+		},
+		{
+			handler: serv.QueryRangeV1,
+			params:  url.Values{"query": {"1"}, "start": {start}, "end": {ts}, "step": {"1m"}},
+			status:  http.StatusBadRequest,
+			bodyRe:  `expression must evaluate to a vector`,
+		},
+	}
+
+	for i, s := range scenarios {
+		req, err := http.NewRequest("GET", "http://example.org/api/v1/query?"+s.params.Encode(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		s.handler(w, req)
+
+		if w.Code != s.status {
+			t.Errorf("%d. got status code %d, want %d", i, w.Code, s.status)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%d. got content type %q, want %q", i, ct, "application/json")
+		}
+		if !regexp.MustCompile(s.bodyRe).Match(w.Body.Bytes()) {
+			t.Errorf("%d. body didn't match '%s'. Body: %s", i, s.bodyRe, w.Body)
+		}
+	}
+}
+
+func TestQueryRangeV1Stream(t *testing.T) {
+	storage, closer := local.NewTestStorage(t, 1)
+	defer closer.Close()
+	storage.Append(&clientmodel.Sample{
+		Metric: clientmodel.Metric{
+			clientmodel.MetricNameLabel: "testmetric",
+		},
+		Timestamp: testTimestamp.Add(-2 * time.Minute),
+		Value:     1,
+	})
+	storage.WaitForIndexing()
+
+	serv := MetricsService{
+		Now:     testNow,
+		Storage: storage,
+	}
+	start := testTimestamp.Add(-2 * time.Minute)
+	params := url.Values{
+		"query":  {"testmetric"},
+		"start":  {start.String()},
+		"end":    {testTimestamp.String()},
+		"step":   {"0.1"},
+		"stream": {"true"},
+	}
+	req, err := http.NewRequest("GET", "http://example.org/api/v1/query_range?"+params.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	serv.QueryRangeV1(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status code %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("got content type %q, want %q", ct, "application/x-ndjson")
+	}
+	// 1201 steps are evaluated in two windows.
+	lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, want 2: %s", len(lines), w.Body)
+	}
+	wantStarts := []clientmodel.Timestamp{start, start.Add(streamWindowSteps * 100 * time.Millisecond)}
+	wantLens := []int{streamWindowSteps, 1201 - streamWindowSteps}
+	for i, line := range lines {
+		var resp struct {
+			Status string
+			Data   struct {
+				ResultType string
+				Result     []struct {
+					Values [][2]json.RawMessage
+				}
+			}
+		}
+		if err := json.Unmarshal([]byte(line), &resp); err != nil {
+			t.Fatalf("%d. error unmarshalling line: %s", i, err)
+		}
+		if resp.Status != "success" || resp.Data.ResultType != "matrix" || len(resp.Data.Result) != 1 {
+			t.Fatalf("%d. unexpected response %s", i, line)
+		}
+		values := resp.Data.Result[0].Values
+		if len(values) != wantLens[i] {
+			t.Errorf("%d. got %d values, want %d", i, len(values), wantLens[i])
+		}
+		if got := string(values[0][0]); got != wantStarts[i].String() {
+			t.Errorf("%d. got first timestamp %s, want %s", i, got, wantStarts[i])
+		}
+	}
+
+	// Without streaming, the query exceeds the maximum resolution.
+	params.Set("start", "0")
+	params.Del("stream")
+	req, err = http.NewRequest("GET", "http://example.org/api/v1/query_range?"+params.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	serv.QueryRangeV1(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("got status code %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+
+	"bitbucket.org/ww/goautoneg"
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/proto"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+	registry "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/text"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/prometheus/rules"
+	"github.com/prometheus/prometheus/rules/ast"
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/storage/metric"
+)
+
+// FederationHandler implements http.Handler. It serves the latest sample of
+// each series matching any of the series selectors given as match[]
+// parameters in the exposition format, so that other Prometheus servers can
+// scrape them. Series without samples within the staleness delta are left
+// out. The samples keep their original timestamps.
+type FederationHandler struct {
+	Storage        local.Storage
+	StalenessDelta time.Duration
+}
+
+func (h *FederationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	selectors := r.Form["match[]"]
+	if len(selectors) == 0 {
+		http.Error(w, "no match[] parameter given", http.StatusBadRequest)
+		return
+	}
+
+	fpSet := map[clientmodel.Fingerprint]struct{}{}
+	for _, s := range selectors {
+		matchers, err := parseSeriesSelector(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, fp := range h.Storage.GetFingerprintsForLabelMatchers(matchers) {
+			fpSet[fp] = struct{}{}
+		}
+	}
+
+	now := clientmodel.Now()
+	in := metric.Interval{
+		OldestInclusive: now.Add(-h.StalenessDelta),
+		NewestInclusive: now,
+	}
+	fps := make(clientmodel.Fingerprints, 0, len(fpSet))
+	ranges := make(map[clientmodel.Fingerprint]metric.Interval, len(fpSet))
+	for fp := range fpSet {
+		fps = append(fps, fp)
+		ranges[fp] = in
+	}
+	sort.Sort(fps)
+
+	p := h.Storage.NewPreloader()
+	defer p.Close()
+	if err := p.PreloadRanges(ranges, 0); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	families := map[string]*dto.MetricFamily{}
+	for _, fp := range fps {
+		values := h.Storage.NewIterator(fp).GetBoundaryValues(in)
+		if len(values) == 0 {
+			continue
+		}
+		latest := values[len(values)-1]
+		m := h.Storage.GetMetricForFingerprint(fp).Metric
+
+		name := string(m[clientmodel.MetricNameLabel])
+		mf, ok := families[name]
+		if !ok {
+			mf = &dto.MetricFamily{
+				Name: proto.String(name),
+				Type: dto.MetricType_UNTYPED.Enum(),
+			}
+			families[name] = mf
+		}
+		pm := &dto.Metric{
+			Label:       make([]*dto.LabelPair, 0, len(m)),
+			Untyped:     &dto.Untyped{Value: proto.Float64(float64(latest.Value))},
+			TimestampMs: proto.Int64(int64(latest.Timestamp)),
+		}
+		for ln, lv := range m {
+			if ln == clientmodel.MetricNameLabel {
+				continue
+			}
+			pm.Label = append(pm.Label, &dto.LabelPair{
+				Name:  proto.String(string(ln)),
+				Value: proto.String(string(lv)),
+			})
+		}
+		sort.Sort(labelPairsByName(pm.Label))
+		mf.Metric = append(mf.Metric, pm)
+	}
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	enc, contentType := chooseFederationEncoder(r)
+	w.Header().Set("Content-Type", contentType)
+	for _, name := range names {
+		if _, err := enc(w, families[name]); err != nil {
+			// The status code has already been sent.
+			glog.Errorf("Error writing federated metric family %s: %s", name, err)
+			return
+		}
+	}
+}
+
+// parseSeriesSelector parses a series selector like
+// 'http_requests_total{job="api"}' into its label matchers.
+func parseSeriesSelector(s string) (metric.LabelMatchers, error) {
+	exprNode, err := rules.LoadExprFromString(s)
+	if err != nil {
+		return nil, err
+	}
+	selector, ok := exprNode.(*ast.VectorSelector)
+	if !ok {
+		return nil, fmt.Errorf("%q is not a series selector", s)
+	}
+	return selector.LabelMatchers(), nil
+}
+
+type metricFamilyEncoder func(io.Writer, *dto.MetricFamily) (int, error)
+
+// chooseFederationEncoder negotiates the exposition format with the Accept
+// header of the request, preferring the delimited protocol buffer format and
+// falling back to the text format.
+func chooseFederationEncoder(r *http.Request) (metricFamilyEncoder, string) {
+	for _, accept := range goautoneg.ParseAccept(r.Header.Get("Accept")) {
+		if accept.Type == "application" &&
+			accept.SubType == "vnd.google.protobuf" &&
+			accept.Params["proto"] == "io.prometheus.client.MetricFamily" &&
+			accept.Params["encoding"] == "delimited" {
+			return text.WriteProtoDelimited, registry.DelimitedTelemetryContentType
+		}
+	}
+	return text.MetricFamilyToText, registry.TextTelemetryContentType
+}
+
+// labelPairsByName implements sort.Interface, sorting by label name.
+type labelPairsByName []*dto.LabelPair
+
+func (l labelPairsByName) Len() int           { return len(l) }
+func (l labelPairsByName) Less(i, j int) bool { return l[i].GetName() < l[j].GetName() }
+func (l labelPairsByName) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
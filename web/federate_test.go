@@ -0,0 +1,119 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matttproud/golang_protobuf_extensions/pbutil"
+
+	clientmodel "github.com/prometheus/client_golang/model"
+	registry "github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/prometheus/storage/local"
+)
+
+func TestFederation(t *testing.T) {
+	storage, closer := local.NewTestStorage(t, 1)
+	defer closer.Close()
+
+	now := clientmodel.Now()
+	samples := clientmodel.Samples{
+		{
+			Metric:    clientmodel.Metric{clientmodel.MetricNameLabel: "up", "job": "api", "instance": "a"},
+			Value:     0,
+			Timestamp: now.Add(-2 * time.Minute),
+		},
+		{
+			Metric:    clientmodel.Metric{clientmodel.MetricNameLabel: "up", "job": "api", "instance": "a"},
+			Value:     1,
+			Timestamp: now.Add(-time.Minute),
+		},
+		{
+			Metric:    clientmodel.Metric{clientmodel.MetricNameLabel: "up", "job": "db", "instance": "b"},
+			Value:     1,
+			Timestamp: now.Add(-time.Minute),
+		},
+		// Stale.
+		{
+			Metric:    clientmodel.Metric{clientmodel.MetricNameLabel: "up", "job": "api", "instance": "c"},
+			Value:     1,
+			Timestamp: now.Add(-time.Hour),
+		},
+		{
+			Metric:    clientmodel.Metric{clientmodel.MetricNameLabel: "http_requests_total", "job": "api"},
+			Value:     42,
+			Timestamp: now.Add(-time.Minute),
+		},
+	}
+	for _, s := range samples {
+		storage.Append(s)
+	}
+	storage.WaitForIndexing()
+
+	h := &FederationHandler{
+		Storage:        storage,
+		StalenessDelta: 5 * time.Minute,
+	}
+	federate := func(query string, accept string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "http://example.org/federate?"+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	ts := int64(now.Add(-time.Minute))
+	want := fmt.Sprintf(`# TYPE http_requests_total untyped
+http_requests_total{job="api"} 42 %d
+# TYPE up untyped
+up{instance="a",job="api"} 1 %d
+`, ts, ts)
+	w := federate(`match[]=up{job="api"}&match[]=http_requests_total`, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	if got := w.Body.String(); got != want {
+		t.Errorf("got federated metrics\n%s\nwant\n%s", got, want)
+	}
+
+	w = federate(`match[]={__name__="up"}`, registry.DelimitedTelemetryContentType)
+	if ct := w.Header().Get("Content-Type"); ct != registry.DelimitedTelemetryContentType {
+		t.Fatalf("got content type %q", ct)
+	}
+	mf := &dto.MetricFamily{}
+	if _, err := pbutil.ReadDelimited(bytes.NewReader(w.Body.Bytes()), mf); err != nil {
+		t.Fatal(err)
+	}
+	if mf.GetName() != "up" || len(mf.Metric) != 2 {
+		t.Errorf("got metric family %v, want 2 up metrics", mf)
+	}
+
+	for _, query := range []string{"", "match[]=rate(up[5m])", "match[]=up{"} {
+		if w := federate(query, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("got status %d for query %q, want %d", w.Code, query, http.StatusBadRequest)
+		}
+	}
+}
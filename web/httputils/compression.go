@@ -40,6 +40,20 @@ func (c *compressedResponseWriter) Write(p []byte) (int, error) {
 	return c.writer.Write(p)
 }
 
+// Flush writes any buffered compressed data to the client. It implements
+// http.Flusher so that handlers can stream responses.
+func (c *compressedResponseWriter) Flush() {
+	if zlibWriter, ok := c.writer.(*zlib.Writer); ok {
+		zlibWriter.Flush()
+	}
+	if gzipWriter, ok := c.writer.(*gzip.Writer); ok {
+		gzipWriter.Flush()
+	}
+	if flusher, ok := c.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
 // Closes the compressedResponseWriter and ensures to flush all data before.
 func (c *compressedResponseWriter) Close() {
 	if zlibWriter, ok := c.writer.(*zlib.Writer); ok {
@@ -0,0 +1,64 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/prometheus/storage/local"
+)
+
+// LifecycleHandler serves the readiness and health endpoints for load
+// balancers and orchestrators once the local storage has been loaded. While it
+// is loading, ServeStartupStatus serves them instead.
+type LifecycleHandler struct {
+	Storage local.Storage
+
+	mtx          sync.RWMutex
+	shuttingDown bool
+}
+
+// ShutdownStarted makes the readiness endpoint report that Prometheus is not
+// ready anymore, so that no new queries are sent to it while shutting down.
+func (h *LifecycleHandler) ShutdownStarted() {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	h.shuttingDown = true
+}
+
+// ServeReady responds with 200 if Prometheus is ready to serve queries and
+// with 503 if it is shutting down.
+func (h *LifecycleHandler) ServeReady(w http.ResponseWriter, r *http.Request) {
+	h.mtx.RLock()
+	defer h.mtx.RUnlock()
+
+	if h.shuttingDown {
+		http.Error(w, "Shutting down.", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintf(w, "Ready.")
+}
+
+// ServeHealthy responds with 200 if the local storage is consistent and with
+// 500 if it is dirty and Prometheus needs to be restarted to recover it.
+func (h *LifecycleHandler) ServeHealthy(w http.ResponseWriter, r *http.Request) {
+	if h.Storage.Dirty() {
+		http.Error(w, "The local storage is inconsistent, restart to initiate crash recovery.", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "Healthy.")
+}
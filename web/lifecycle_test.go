@@ -0,0 +1,49 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/prometheus/storage/local"
+)
+
+func TestLifecycleHandler(t *testing.T) {
+	storage, closer := local.NewTestStorage(t, 1)
+	defer closer.Close()
+
+	h := &LifecycleHandler{Storage: storage}
+	serve := func(handler http.HandlerFunc) int {
+		w := httptest.NewRecorder()
+		handler(w, &http.Request{})
+		return w.Code
+	}
+
+	if code := serve(h.ServeReady); code != http.StatusOK {
+		t.Errorf("expected ready status %d, got %d", http.StatusOK, code)
+	}
+	if code := serve(h.ServeHealthy); code != http.StatusOK {
+		t.Errorf("expected healthy status %d, got %d", http.StatusOK, code)
+	}
+
+	h.ShutdownStarted()
+	if code := serve(h.ServeReady); code != http.StatusServiceUnavailable {
+		t.Errorf("expected ready status %d while shutting down, got %d", http.StatusServiceUnavailable, code)
+	}
+	if code := serve(h.ServeHealthy); code != http.StatusOK {
+		t.Errorf("expected healthy status %d while shutting down, got %d", http.StatusOK, code)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/prometheus/storage/local"
+	"github.com/prometheus/prometheus/web/blob"
+)
+
+// RecoveryStatusHandler serves the progress of a crash recovery of the local
+// storage while Prometheus is starting up.
+type RecoveryStatusHandler struct {
+	RecoveryProgress *local.RecoveryProgress
+	PathPrefix       string
+}
+
+// Status returns the current status of the recovery.
+func (h *RecoveryStatusHandler) Status() local.RecoveryStatus {
+	return h.RecoveryProgress.Status()
+}
+
+func (h *RecoveryStatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusServiceUnavailable)
+	executeTemplate(w, "recovery", h, h.PathPrefix)
+}
+
+// ServeStartupStatus listens on the web interface's address until the returned
+// io.Closer is closed. In the meantime, it serves the status of a possible
+// crash recovery instead of the regular status page, and it serves the
+// telemetry endpoint. All other endpoints are not available yet. The caller
+// must close the returned io.Closer before calling WebService.ServeForever.
+func ServeStartupStatus(pathPrefix string, rp *local.RecoveryProgress) (io.Closer, error) {
+	l, err := net.Listen("tcp", *listenAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(pathPrefix+strings.TrimLeft(*metricsPath, "/"), prometheus.Handler())
+	if *useLocalAssets {
+		mux.Handle(pathPrefix+"static/", http.StripPrefix(pathPrefix+"static/", http.FileServer(http.Dir("web/static"))))
+	} else {
+		mux.Handle(pathPrefix+"static/", http.StripPrefix(pathPrefix+"static/", new(blob.Handler)))
+	}
+	mux.HandleFunc(pathPrefix+"-/ready", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Loading the local storage.", http.StatusServiceUnavailable)
+	})
+	// Loading the storage, even with a long crash recovery, is healthy.
+	mux.HandleFunc(pathPrefix+"-/healthy", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "Healthy.")
+	})
+	mux.Handle("/", &RecoveryStatusHandler{
+		RecoveryProgress: rp,
+		PathPrefix:       pathPrefix,
+	})
+
+	glog.Info("listening on ", *listenAddress, " during startup")
+	go func() {
+		// Serve returns an error once the listener is closed, which is
+		// the regular way of shutting down.
+		http.Serve(l, mux)
+	}()
+	return l, nil
+}
@@ -20,6 +20,7 @@ import (
 
 	"github.com/prometheus/prometheus/retrieval"
 	"github.com/prometheus/prometheus/rules/manager"
+	"github.com/prometheus/prometheus/storage/local"
 )
 
 // PrometheusStatusHandler implements http.Handler.
@@ -32,10 +33,22 @@ type PrometheusStatusHandler struct {
 	RuleManager manager.RuleManager
 	TargetPools map[string]*retrieval.TargetPool
 
+	RecoveryProgress *local.RecoveryProgress
+
 	Birth      time.Time
 	PathPrefix string
 }
 
+// ApplyConfig replaces the configuration and the target pools shown on the
+// status page, e.g. after the configuration has been reloaded.
+func (h *PrometheusStatusHandler) ApplyConfig(config string, pools map[string]*retrieval.TargetPool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.Config = config
+	h.TargetPools = pools
+}
+
 // TargetStateToClass returns a map of TargetState to the name of a Bootstrap CSS class.
 func (h *PrometheusStatusHandler) TargetStateToClass() map[retrieval.TargetState]string {
 	return map[retrieval.TargetState]string{
@@ -46,5 +59,8 @@ func (h *PrometheusStatusHandler) TargetStateToClass() map[retrieval.TargetState
 }
 
 func (h *PrometheusStatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
 	executeTemplate(w, "status", h, h.PathPrefix)
 }
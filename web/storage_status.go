@@ -0,0 +1,36 @@
+// Copyright 2015 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"net/http"
+
+	"github.com/prometheus/prometheus/storage/local"
+)
+
+// StorageStatusHandler serves a page with the internal state of the local
+// storage.
+type StorageStatusHandler struct {
+	Storage    local.Storage
+	PathPrefix string
+}
+
+// Status returns the current internal state of the local storage.
+func (h *StorageStatusHandler) Status() local.StorageStatus {
+	return h.Storage.Status()
+}
+
+func (h *StorageStatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	executeTemplate(w, "storage_status", h, h.PathPrefix)
+}
@@ -40,17 +40,26 @@ var (
 	useLocalAssets = flag.Bool("web.use-local-assets", false, "Read assets/templates from file instead of binary.")
 	userAssetsPath = flag.String("web.user-assets", "", "Path to static asset directory, available at /user.")
 	enableQuit     = flag.Bool("web.enable-remote-shutdown", false, "Enable remote service shutdown.")
+	enableAdminAPI = flag.Bool("web.enable-admin-api", false, "Enable administrative API endpoints below /api/admin, i.e. for creating storage snapshots, deleting series, backfilling historical samples, and canceling queries.")
 )
 
 // WebService handles the HTTP endpoints with the exception of /api.
 type WebService struct {
-	StatusHandler   *PrometheusStatusHandler
-	MetricsHandler  *api.MetricsService
-	AlertsHandler   *AlertsHandler
-	ConsolesHandler *ConsolesHandler
-	GraphsHandler   *GraphsHandler
+	StatusHandler     *PrometheusStatusHandler
+	MetricsHandler    *api.MetricsService
+	AlertsHandler     *AlertsHandler
+	ConsolesHandler   *ConsolesHandler
+	GraphsHandler     *GraphsHandler
+	FederationHandler *FederationHandler
+	LifecycleHandler  *LifecycleHandler
+	StorageHandler    *StorageStatusHandler
+	ReplicaHandler    http.Handler // Serves replication to standbys.
+	ReadHandler       http.Handler // Serves the local storage to generic remote storage clients.
 
 	QuitChan chan struct{}
+	// Receives a channel for each reload request via the web service, to
+	// which the result of the reload is sent.
+	ReloadChan chan chan error
 }
 
 // ServeForever serves the HTTP endpoints and only returns upon errors.
@@ -63,6 +72,9 @@ func (ws WebService) ServeForever(pathPrefix string) error {
 	http.Handle(pathPrefix, prometheus.InstrumentHandler(
 		pathPrefix, ws.StatusHandler,
 	))
+	http.Handle(pathPrefix+"status/storage", prometheus.InstrumentHandler(
+		pathPrefix+"status/storage", ws.StorageHandler,
+	))
 	http.Handle(pathPrefix+"alerts", prometheus.InstrumentHandler(
 		pathPrefix+"alerts", ws.AlertsHandler,
 	))
@@ -72,6 +84,15 @@ func (ws WebService) ServeForever(pathPrefix string) error {
 	http.Handle(pathPrefix+"graph", prometheus.InstrumentHandler(
 		pathPrefix+"graph", ws.GraphsHandler,
 	))
+	http.Handle(pathPrefix+"federate", prometheus.InstrumentHandler(
+		pathPrefix+"federate", ws.FederationHandler,
+	))
+	http.Handle(pathPrefix+"api/v1/read", prometheus.InstrumentHandler(
+		pathPrefix+"api/v1/read", ws.ReadHandler,
+	))
+	http.Handle(pathPrefix+"replication/", prometheus.InstrumentHandler(
+		pathPrefix+"replication/", http.StripPrefix(pathPrefix+"replication/", ws.ReplicaHandler),
+	))
 	http.Handle(pathPrefix+"heap", prometheus.InstrumentHandler(
 		pathPrefix+"heap", http.HandlerFunc(dumpHeap),
 	))
@@ -97,6 +118,13 @@ func (ws WebService) ServeForever(pathPrefix string) error {
 	if *enableQuit {
 		http.Handle(pathPrefix+"-/quit", http.HandlerFunc(ws.quitHandler))
 	}
+	http.Handle(pathPrefix+"-/reload", http.HandlerFunc(ws.reloadHandler))
+	http.Handle(pathPrefix+"-/ready", http.HandlerFunc(ws.LifecycleHandler.ServeReady))
+	http.Handle(pathPrefix+"-/healthy", http.HandlerFunc(ws.LifecycleHandler.ServeHealthy))
+
+	if *enableAdminAPI {
+		ws.MetricsHandler.RegisterAdminHandler(pathPrefix)
+	}
 
 	if pathPrefix != "/" {
 		http.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -121,6 +149,22 @@ func (ws WebService) quitHandler(w http.ResponseWriter, r *http.Request) {
 	close(ws.QuitChan)
 }
 
+func (ws WebService) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Add("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	errc := make(chan error)
+	ws.ReloadChan <- errc
+	if err := <-errc; err != nil {
+		http.Error(w, fmt.Sprintf("Failed to reload config: %s", err), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "Configuration reloaded.")
+}
+
 func getTemplateFile(name string) (string, error) {
 	if *useLocalAssets {
 		file, err := ioutil.ReadFile(fmt.Sprintf("web/templates/%s.html", name))